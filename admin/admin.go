@@ -0,0 +1,387 @@
+// Package admin serves administration of broker over gRPC, see adminpb for the service.
+// Listener requires mutual TLS: only clients presenting certificate signed by ClientCAFile
+// are served, so access to admin API is granted by issuing certificates
+//
+//	a, err := admin.Listen(srv, admin.Config{
+//		Address:      ":9443",
+//		CertFile:     "admin.crt",
+//		KeyFile:      "admin.key",
+//		ClientCAFile: "operators-ca.crt",
+//		Reload:       acl.Reload,
+//	})
+package admin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/admin/adminpb"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/server"
+	"github.com/troian/surgemq/session"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultRetainedLimit = 100
+	maxRetainedLimit     = 1000
+
+	// stopTimeout calls in progress are waited for by Close before connections are dropped
+	stopTimeout = 5 * time.Second
+)
+
+var (
+	// ErrNoAddress admin API configured without address
+	ErrNoAddress = errors.New("admin: address required")
+
+	// ErrNoCertificate admin API configured without certificate or key
+	ErrNoCertificate = errors.New("admin: certificate and key required")
+
+	// ErrNoClientCA admin API configured without CA of client certificates
+	ErrNoClientCA = errors.New("admin: client CA required")
+)
+
+// Broker administered, implemented by server.Type
+type Broker interface {
+	Sessions() []session.Info
+	Session(id string) (session.Info, bool)
+	Kick(id string, wipe bool) bool
+	RetainedList(filter string, after string, limit int) ([]*message.PublishMessage, error)
+	RetainedDelete(filter string) (int, error)
+	Ban(ban server.Ban) error
+	Unban(ban server.Ban) bool
+	Bans() []server.Ban
+	Reauthorize() int
+}
+
+var _ Broker = server.Type(nil)
+
+// Config of admin API
+type Config struct {
+	// Address TCP address to listen on, e.g. ":9443"
+	Address string
+
+	// CertFile and KeyFile certificate of admin API
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile PEM bundle client certificates are verified with
+	ClientCAFile string
+
+	// Reload configuration of application on ReloadConfig call, e.g. ACL files.
+	// Subscriptions are reauthorized once reloaded. Optional
+	Reload func() error
+}
+
+// Server of admin API
+type Server struct {
+	config Config
+	broker Broker
+
+	listener net.Listener
+	grpc     *grpc.Server
+
+	once sync.Once
+	wg   sync.WaitGroup
+
+	log *zap.Logger
+}
+
+// Listen start serving admin API of broker
+func Listen(broker Broker, config Config) (*Server, error) {
+	if config.Address == "" {
+		return nil, ErrNoAddress
+	}
+
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		config: config,
+		broker: broker,
+		log:    surgemq.GetProdLogger().Named("admin"),
+	}
+
+	if s.listener, err = net.Listen("tcp", config.Address); err != nil {
+		return nil, err
+	}
+
+	s.grpc = grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(tlsConfig)),
+		grpc.UnaryInterceptor(s.intercept))
+
+	adminpb.RegisterAdminServer(s.grpc, &service{broker: broker, reload: config.Reload})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		if e := s.grpc.Serve(s.listener); e != nil {
+			s.log.Error("Admin API stopped", zap.Error(e))
+		}
+	}()
+
+	s.log.Info("Admin API started", zap.String("address", s.listener.Addr().String()))
+
+	return s, nil
+}
+
+// Addr admin API listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stop serving admin API. Calls in progress are waited for
+func (s *Server) Close() error {
+	s.once.Do(func() {
+		done := make(chan struct{})
+		go func() {
+			s.grpc.GracefulStop()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(stopTimeout):
+			s.grpc.Stop()
+		}
+
+		s.wg.Wait()
+	})
+
+	return nil
+}
+
+// tlsConfig of listener requiring and verifying client certificates
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, ErrNoCertificate
+	}
+
+	if c.ClientCAFile == "" {
+		return nil, ErrNoClientCA
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pem, err := ioutil.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("admin: no certificates in " + c.ClientCAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// intercept calls to log them along with subject of client certificate
+func (s *Server) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+
+	fields := []zap.Field{zap.String("method", info.FullMethod), zap.String("client", clientOf(ctx))}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+
+	s.log.Info("Admin call", fields...)
+
+	return resp, err
+}
+
+// clientOf common name of certificate of caller
+func clientOf(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+		return info.State.VerifiedChains[0][0].Subject.CommonName
+	}
+
+	return p.Addr.String()
+}
+
+// service of admin API over broker
+type service struct {
+	adminpb.UnimplementedAdminServer
+
+	broker Broker
+	reload func() error
+
+	// reloads serialized, configuration of application isn't expected to be reloaded concurrently
+	reloadLock sync.Mutex
+}
+
+func (s *service) ListClients(ctx context.Context, req *adminpb.ListClientsRequest) (*adminpb.ListClientsResponse, error) {
+	infos := s.broker.Sessions()
+
+	resp := &adminpb.ListClientsResponse{Sessions: make([]*adminpb.Session, 0, len(infos))}
+	for i := range infos {
+		if req.ConnectedOnly && infos[i].State != session.StateConnected {
+			continue
+		}
+
+		resp.Sessions = append(resp.Sessions, sessionOf(&infos[i]))
+	}
+
+	return resp, nil
+}
+
+func (s *service) GetSession(ctx context.Context, req *adminpb.GetSessionRequest) (*adminpb.Session, error) {
+	info, ok := s.broker.Session(req.Id)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no session of %q", req.Id)
+	}
+
+	return sessionOf(&info), nil
+}
+
+func (s *service) KickClient(ctx context.Context, req *adminpb.KickClientRequest) (*adminpb.KickClientResponse, error) {
+	if !s.broker.Kick(req.Id, req.Wipe) {
+		return nil, status.Errorf(codes.NotFound, "no session of %q", req.Id)
+	}
+
+	return &adminpb.KickClientResponse{}, nil
+}
+
+func (s *service) ListRetained(ctx context.Context, req *adminpb.ListRetainedRequest) (*adminpb.ListRetainedResponse, error) {
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = defaultRetainedLimit
+	} else if limit > maxRetainedLimit {
+		limit = maxRetainedLimit
+	}
+
+	msgs, err := s.broker.RetainedList(req.Filter, req.After, limit)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	resp := &adminpb.ListRetainedResponse{Messages: make([]*adminpb.RetainedMessage, 0, len(msgs))}
+	for _, msg := range msgs {
+		resp.Messages = append(resp.Messages, &adminpb.RetainedMessage{
+			Topic:   msg.Topic(),
+			Qos:     uint32(msg.QoS()),
+			Payload: msg.Payload(),
+		})
+	}
+
+	return resp, nil
+}
+
+func (s *service) DeleteRetained(ctx context.Context, req *adminpb.DeleteRetainedRequest) (*adminpb.DeleteRetainedResponse, error) {
+	n, err := s.broker.RetainedDelete(req.Filter)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return &adminpb.DeleteRetainedResponse{Deleted: int64(n)}, nil
+}
+
+func (s *service) ListBans(ctx context.Context, req *adminpb.ListBansRequest) (*adminpb.ListBansResponse, error) {
+	bans := s.broker.Bans()
+
+	resp := &adminpb.ListBansResponse{Bans: make([]*adminpb.Ban, 0, len(bans))}
+	for _, b := range bans {
+		ban := &adminpb.Ban{ClientId: b.ClientID, Ip: b.IP}
+		if !b.Expires.IsZero() {
+			ban.Expires = timestamppb.New(b.Expires)
+		}
+
+		resp.Bans = append(resp.Bans, ban)
+	}
+
+	return resp, nil
+}
+
+func (s *service) AddBan(ctx context.Context, req *adminpb.Ban) (*adminpb.AddBanResponse, error) {
+	if err := s.broker.Ban(banOf(req)); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return &adminpb.AddBanResponse{}, nil
+}
+
+func (s *service) RemoveBan(ctx context.Context, req *adminpb.Ban) (*adminpb.RemoveBanResponse, error) {
+	return &adminpb.RemoveBanResponse{Removed: s.broker.Unban(banOf(req))}, nil
+}
+
+func (s *service) ReloadConfig(ctx context.Context, req *adminpb.ReloadConfigRequest) (*adminpb.ReloadConfigResponse, error) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	if s.reload != nil {
+		if err := s.reload(); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+
+	return &adminpb.ReloadConfigResponse{Dropped: int64(s.broker.Reauthorize())}, nil
+}
+
+// sessionOf info of session
+func sessionOf(info *session.Info) *adminpb.Session {
+	ses := &adminpb.Session{
+		Id:            info.ID,
+		State:         info.State.String(),
+		Username:      info.Username,
+		RemoteAddr:    info.RemoteAddr,
+		Subscriptions: make([]*adminpb.Subscription, 0, len(info.Subscriptions)),
+		Queued:        int64(info.Queued),
+		Offline:       int64(info.Offline),
+		InFlightIn:    int64(info.InFlightIn),
+		InFlightOut:   int64(info.InFlightOut),
+		Received:      info.Received,
+		Sent:          info.Sent,
+	}
+
+	if !info.ConnectedAt.IsZero() {
+		ses.ConnectedAt = timestamppb.New(info.ConnectedAt)
+	}
+
+	for filter, opts := range info.Subscriptions {
+		ses.Subscriptions = append(ses.Subscriptions, &adminpb.Subscription{Filter: filter, Qos: uint32(opts.QoS)})
+	}
+
+	sort.Slice(ses.Subscriptions, func(i, j int) bool { return ses.Subscriptions[i].Filter < ses.Subscriptions[j].Filter })
+
+	return ses
+}
+
+// banOf request
+func banOf(b *adminpb.Ban) server.Ban {
+	ban := server.Ban{ClientID: b.ClientId, IP: b.Ip}
+	if b.Expires != nil {
+		ban.Expires = b.Expires.AsTime()
+	}
+
+	return ban
+}
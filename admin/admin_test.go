@@ -0,0 +1,331 @@
+package admin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/admin/adminpb"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/server"
+	"github.com/troian/surgemq/session"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+type fakeBroker struct {
+	sessions []session.Info
+	retained []*message.PublishMessage
+	bans     []server.Ban
+	kicked   []string
+}
+
+func (b *fakeBroker) Sessions() []session.Info {
+	return b.sessions
+}
+
+func (b *fakeBroker) Session(id string) (session.Info, bool) {
+	for _, s := range b.sessions {
+		if s.ID == id {
+			return s, true
+		}
+	}
+
+	return session.Info{}, false
+}
+
+func (b *fakeBroker) Kick(id string, wipe bool) bool {
+	if _, ok := b.Session(id); !ok {
+		return false
+	}
+
+	b.kicked = append(b.kicked, id)
+	return true
+}
+
+func (b *fakeBroker) RetainedList(filter string, after string, limit int) ([]*message.PublishMessage, error) {
+	if filter == "a/#/b" {
+		return nil, errors.New("invalid filter")
+	}
+
+	if limit < len(b.retained) {
+		return b.retained[:limit], nil
+	}
+
+	return b.retained, nil
+}
+
+func (b *fakeBroker) RetainedDelete(filter string) (int, error) {
+	n := len(b.retained)
+	b.retained = nil
+	return n, nil
+}
+
+func (b *fakeBroker) Ban(ban server.Ban) error {
+	if ban.ClientID == "" && ban.IP == "" {
+		return server.ErrInvalidBan
+	}
+
+	b.bans = append(b.bans, ban)
+	return nil
+}
+
+func (b *fakeBroker) Unban(ban server.Ban) bool {
+	for i := range b.bans {
+		if b.bans[i].ClientID == ban.ClientID && b.bans[i].IP == ban.IP {
+			b.bans = append(b.bans[:i], b.bans[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *fakeBroker) Bans() []server.Ban {
+	return b.bans
+}
+
+func (b *fakeBroker) Reauthorize() int {
+	return 2
+}
+
+type pki struct {
+	dir    string
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caFile string
+	serial int64
+}
+
+func newPKI(t *testing.T) *pki {
+	dir, err := ioutil.TempDir("", "admin")
+	require.NoError(t, err)
+
+	p := &pki{dir: dir}
+
+	p.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &p.caKey.PublicKey, p.caKey)
+	require.NoError(t, err)
+
+	p.ca, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	p.caFile = filepath.Join(dir, "ca.crt")
+	require.NoError(t, ioutil.WriteFile(p.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+
+	p.serial = 1
+
+	return p
+}
+
+// issue certificate signed by CA, returning paths of certificate and key
+func (p *pki) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	p.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.ca, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(p.dir, cn+".crt")
+	keyFile := filepath.Join(p.dir, cn+".key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return certFile, keyFile
+}
+
+func dial(t *testing.T, s *Server, p *pki, certs ...tls.Certificate) adminpb.AdminClient {
+	roots := x509.NewCertPool()
+	roots.AddCert(p.ca)
+
+	conn, err := grpc.NewClient(s.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		RootCAs:      roots,
+		Certificates: certs,
+	})))
+	require.NoError(t, err)
+
+	t.Cleanup(func() { conn.Close() }) // nolint: errcheck
+
+	return adminpb.NewAdminClient(conn)
+}
+
+func TestConfig(t *testing.T) {
+	_, err := Listen(&fakeBroker{}, Config{})
+	require.Equal(t, ErrNoAddress, err)
+
+	_, err = Listen(&fakeBroker{}, Config{Address: "127.0.0.1:0"})
+	require.Equal(t, ErrNoCertificate, err)
+
+	_, err = Listen(&fakeBroker{}, Config{Address: "127.0.0.1:0", CertFile: "a.crt", KeyFile: "a.key"})
+	require.Equal(t, ErrNoClientCA, err)
+}
+
+func TestAdmin(t *testing.T) {
+	p := newPKI(t)
+	defer os.RemoveAll(p.dir) // nolint: errcheck
+
+	certFile, keyFile := p.issue(t, "broker", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := p.issue(t, "operator", x509.ExtKeyUsageClientAuth)
+
+	retained := message.NewPublishMessage()
+	require.NoError(t, retained.SetTopic("sensors/temp"))
+	require.NoError(t, retained.SetQoS(message.QoS1))
+	retained.SetPayload([]byte("21"))
+
+	broker := &fakeBroker{
+		sessions: []session.Info{
+			{
+				ID:            "dev1",
+				State:         session.StateConnected,
+				Username:      "user",
+				RemoteAddr:    "10.0.0.1:5000",
+				ConnectedAt:   time.Unix(1000, 0),
+				Subscriptions: message.Subscriptions{"b": {QoS: message.QoS1}, "a/#": {QoS: message.QoS0}},
+				Queued:        3,
+			},
+			{ID: "dev2", State: session.StatePersisted},
+		},
+		retained: []*message.PublishMessage{retained},
+	}
+
+	reloaded := 0
+	s, err := Listen(broker, Config{
+		Address:      "127.0.0.1:0",
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: p.caFile,
+		Reload: func() error {
+			reloaded++
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close() // nolint: errcheck
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	require.NoError(t, err)
+
+	c := dial(t, s, p, cert)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clients, err := c.ListClients(ctx, &adminpb.ListClientsRequest{})
+	require.NoError(t, err)
+	require.Len(t, clients.Sessions, 2)
+
+	clients, err = c.ListClients(ctx, &adminpb.ListClientsRequest{ConnectedOnly: true})
+	require.NoError(t, err)
+	require.Len(t, clients.Sessions, 1)
+
+	ses, err := c.GetSession(ctx, &adminpb.GetSessionRequest{Id: "dev1"})
+	require.NoError(t, err)
+	require.Equal(t, "connected", ses.State)
+	require.Equal(t, "user", ses.Username)
+	require.Equal(t, int64(1000), ses.ConnectedAt.AsTime().Unix())
+	require.Equal(t, int64(3), ses.Queued)
+	require.Len(t, ses.Subscriptions, 2)
+	require.Equal(t, "a/#", ses.Subscriptions[0].Filter)
+	require.Equal(t, uint32(1), ses.Subscriptions[1].Qos)
+
+	_, err = c.GetSession(ctx, &adminpb.GetSessionRequest{Id: "dev3"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = c.KickClient(ctx, &adminpb.KickClientRequest{Id: "dev1"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"dev1"}, broker.kicked)
+
+	_, err = c.KickClient(ctx, &adminpb.KickClientRequest{Id: "dev3"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	msgs, err := c.ListRetained(ctx, &adminpb.ListRetainedRequest{Filter: "#"})
+	require.NoError(t, err)
+	require.Len(t, msgs.Messages, 1)
+	require.Equal(t, "sensors/temp", msgs.Messages[0].Topic)
+	require.Equal(t, uint32(1), msgs.Messages[0].Qos)
+	require.Equal(t, []byte("21"), msgs.Messages[0].Payload)
+
+	_, err = c.ListRetained(ctx, &adminpb.ListRetainedRequest{Filter: "a/#/b"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	deleted, err := c.DeleteRetained(ctx, &adminpb.DeleteRetainedRequest{Filter: "#"})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted.Deleted)
+
+	_, err = c.AddBan(ctx, &adminpb.Ban{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = c.AddBan(ctx, &adminpb.Ban{ClientId: "dev1"})
+	require.NoError(t, err)
+
+	bans, err := c.ListBans(ctx, &adminpb.ListBansRequest{})
+	require.NoError(t, err)
+	require.Len(t, bans.Bans, 1)
+	require.Equal(t, "dev1", bans.Bans[0].ClientId)
+	require.Nil(t, bans.Bans[0].Expires)
+
+	removed, err := c.RemoveBan(ctx, &adminpb.Ban{ClientId: "dev1"})
+	require.NoError(t, err)
+	require.True(t, removed.Removed)
+
+	reload, err := c.ReloadConfig(ctx, &adminpb.ReloadConfigRequest{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), reload.Dropped)
+	require.Equal(t, 1, reloaded)
+
+	// clients without certificate signed by CA are refused
+	_, err = dial(t, s, p).ListBans(ctx, &adminpb.ListBansRequest{})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	other := newPKI(t)
+	defer os.RemoveAll(other.dir) // nolint: errcheck
+
+	otherCert, otherKey := other.issue(t, "intruder", x509.ExtKeyUsageClientAuth)
+	cert, err = tls.LoadX509KeyPair(otherCert, otherKey)
+	require.NoError(t, err)
+
+	_, err = dial(t, s, p, cert).ListBans(ctx, &adminpb.ListBansRequest{})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
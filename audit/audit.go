@@ -0,0 +1,140 @@
+// Package audit provides append-only log of security relevant decisions and
+// administrative actions of broker for compliance-driven deployments
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Actions recorded
+const (
+	// ActionConnect authentication of CONNECT
+	ActionConnect = "connect"
+	// ActionPublish publish of client to topic
+	ActionPublish = "publish"
+	// ActionSubscribe subscription of client to topic filter
+	ActionSubscribe = "subscribe"
+	// ActionWill will message of client
+	ActionWill = "will"
+	// ActionRevoke subscription dropped by reauthorization
+	ActionRevoke = "revoke"
+	// ActionBan client id or address banned
+	ActionBan = "ban"
+	// ActionUnban ban lifted
+	ActionUnban = "unban"
+	// ActionKick client disconnected by administrator
+	ActionKick = "kick"
+	// ActionRetainedDelete retained messages deleted by administrator
+	ActionRetainedDelete = "retained_delete"
+	// ActionReauthorize subscriptions of all sessions checked again
+	ActionReauthorize = "reauthorize"
+	// ActionTrace packet tracing of client toggled
+	ActionTrace = "trace"
+)
+
+// Results of actions
+const (
+	ResultAllowed = "allowed"
+	ResultDenied  = "denied"
+	ResultDone    = "done"
+	ResultFailed  = "failed"
+)
+
+// ErrClosed record written to closed log
+var ErrClosed = errors.New("audit: log closed")
+
+// Record of single decision or action
+type Record struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Result     string    `json:"result"`
+	ClientID   string    `json:"client_id,omitempty"`
+	Username   string    `json:"username,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Topic      string    `json:"topic,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// Logger sink of records. Record is invoked concurrently, often with locks of sessions
+// held, thus must not block for long
+type Logger interface {
+	Record(r *Record) error
+}
+
+// Writer logs records as JSON lines into writer
+type Writer struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+var _ Logger = (*Writer)(nil)
+
+// NewWriter log records into w. Every record is written with single Write
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Record append record as JSON line
+func (w *Writer) Record(r *Record) error {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	buf = append(buf, '\n')
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.w == nil {
+		return ErrClosed
+	}
+
+	_, err = w.w.Write(buf)
+
+	return err
+}
+
+// File logs records as JSON lines appended to file
+type File struct {
+	Writer
+	f *os.File
+}
+
+// NewFile open file for append, creating it if missing. Existing records are kept
+func NewFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{Writer: Writer{w: f}, f: f}, nil
+}
+
+// Close flush records to disk and close file
+func (f *File) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.w == nil {
+		return ErrClosed
+	}
+
+	f.w = nil
+
+	if err := f.f.Sync(); err != nil {
+		f.f.Close() // nolint: errcheck, gas
+		return err
+	}
+
+	return f.f.Close()
+}
@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	path := filepath.Join(dir, "audit.log")
+
+	f, err := NewFile(path)
+	require.NoError(t, err)
+	require.NoError(t, f.Record(&Record{Action: ActionConnect, Result: ResultDenied, ClientID: "c1", Detail: "banned"}))
+	require.NoError(t, f.Close())
+
+	require.Equal(t, ErrClosed, f.Record(&Record{Action: ActionKick, Result: ResultDone}))
+
+	// reopened log keeps existing records
+	f, err = NewFile(path)
+	require.NoError(t, err)
+	require.NoError(t, f.Record(&Record{Action: ActionBan, Result: ResultDone, ClientID: "c1"}))
+	require.NoError(t, f.Close())
+
+	fd, err := os.Open(path)
+	require.NoError(t, err)
+	defer fd.Close() // nolint: errcheck
+
+	var recs []Record
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		var r Record
+		require.NoError(t, json.Unmarshal(s.Bytes(), &r))
+		recs = append(recs, r)
+	}
+
+	require.Len(t, recs, 2)
+	require.Equal(t, ActionConnect, recs[0].Action)
+	require.Equal(t, "banned", recs[0].Detail)
+	require.False(t, recs[0].Time.IsZero())
+	require.Equal(t, ActionBan, recs[1].Action)
+}
@@ -0,0 +1,39 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package audit
+
+import (
+	"log/syslog"
+)
+
+// Syslog logs records as JSON to local syslog daemon
+type Syslog struct {
+	Writer
+	s *syslog.Writer
+}
+
+// NewSyslog connect to local syslog daemon. Records are logged with given tag at notice
+// severity of auth facility
+func NewSyslog(tag string) (*Syslog, error) {
+	s, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_NOTICE, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Syslog{Writer: Writer{w: s}, s: s}, nil
+}
+
+// Close connection to syslog daemon
+func (s *Syslog) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.w == nil {
+		return ErrClosed
+	}
+
+	s.w = nil
+
+	return s.s.Close()
+}
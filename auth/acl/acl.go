@@ -0,0 +1,427 @@
+// Package acl grants access to topics by patterns with client id and username substitutions
+//
+// Rules are given in format of mosquitto acl_file
+//
+//	# applies to all clients
+//	pattern readwrite devices/%c/#
+//	pattern read broadcast/#
+//
+//	user admin
+//	topic readwrite #
+//	topic deny $SYS/#
+//
+// Within pattern %c is replaced by client id and %u by username. Clients of virtual hosts are
+// substituted with client id within namespace of the host. Pattern with %u does not apply to
+// anonymous clients. Deny rules take precedence over any grant. Read access is checked on subscribe
+// and write on publish, denied subscription is answered with failure code in SUBACK, denied
+// publish is acknowledged and dropped as MQTT 3.1.1 has no way to report it
+//
+// Rules of file or backend source are reloaded on SIGHUP or by Reload. New rules apply to
+// following operations, existing subscriptions are checked again if OnReload calls
+// server Reauthorize
+package acl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/auth"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidRule rule cannot be parsed
+var ErrInvalidRule = errors.New("acl: invalid rule")
+
+// Access granted by rule
+type Access int
+
+// nolint: golint
+const (
+	AccessRead Access = 1 << iota
+	AccessWrite
+	AccessDeny
+
+	AccessReadWrite = AccessRead | AccessWrite
+)
+
+// Rule of access to topics
+type Rule struct {
+	// User rule applies to. Empty applies to every client
+	User string
+
+	// Pattern topic filter with %c and %u substitutions
+	Pattern string
+
+	Access Access
+}
+
+// Config of ACL
+type Config struct {
+	Rules []Rule
+
+	// File path of acl_file. Its rules follow Rules
+	File string
+
+	// Source loads rules from backend, e.g. database. Its rules follow rules of File
+	Source func() ([]Rule, error)
+
+	// OnReload called once new rules are in effect, e.g. to reauthorize subscriptions
+	OnReload func()
+
+	// Fallthrough ask next provider of the chain if no rule matched instead of denying
+	Fallthrough bool
+}
+
+// ACL auth provider
+type ACL struct {
+	config   Config
+	fallback bool
+
+	lock  sync.RWMutex
+	rules []Rule
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	log *zap.Logger
+}
+
+var _ auth.Auth = (*ACL)(nil)
+
+// New ACL. If File or Source is set rules are reloaded on SIGHUP until Close
+func New(config Config) (*ACL, error) {
+	a := &ACL{
+		config:   config,
+		fallback: config.Fallthrough,
+		quit:     make(chan struct{}),
+		log:      surgemq.GetProdLogger().Named("auth").Named("acl"),
+	}
+
+	rules, err := a.load()
+	if err != nil {
+		return nil, err
+	}
+
+	a.rules = rules
+
+	if config.File == "" && config.Source == nil {
+		return a, nil
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer signal.Stop(sig)
+
+		for {
+			select {
+			case <-a.quit:
+				return
+			case <-sig:
+				if e := a.Reload(); e != nil {
+					a.log.Error("Couldn't reload rules", zap.String("file", config.File), zap.Error(e))
+				}
+			}
+		}
+	}()
+
+	return a, nil
+}
+
+// Close stop watching for reloads
+func (a *ACL) Close() error {
+	select {
+	case <-a.quit:
+	default:
+		close(a.quit)
+	}
+
+	a.wg.Wait()
+
+	return nil
+}
+
+// Reload rules from File and Source. Failed reload keeps previous rules
+func (a *ACL) Reload() error {
+	rules, err := a.load()
+	if err != nil {
+		return err
+	}
+
+	a.apply(rules)
+
+	return nil
+}
+
+// SetRules replace rules, e.g. by admin call. Rules of File and Source are replaced
+// as well until next Reload
+func (a *ACL) SetRules(rules []Rule) error {
+	if err := validate(rules); err != nil {
+		return err
+	}
+
+	a.apply(rules)
+
+	return nil
+}
+
+// Rules currently in effect
+func (a *ACL) Rules() []Rule {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return append([]Rule(nil), a.rules...)
+}
+
+func (a *ACL) apply(rules []Rule) {
+	a.lock.Lock()
+	a.rules = rules
+	a.lock.Unlock()
+
+	a.log.Info("Rules loaded", zap.Int("count", len(rules)))
+
+	if a.config.OnReload != nil {
+		a.config.OnReload()
+	}
+}
+
+// load rules of config, file and source
+func (a *ACL) load() ([]Rule, error) {
+	rules := append([]Rule(nil), a.config.Rules...)
+
+	if a.config.File != "" {
+		f, err := os.Open(a.config.File)
+		if err != nil {
+			return nil, err
+		}
+
+		list, err := Parse(f)
+		f.Close() // nolint: errcheck, gas
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, list...)
+	}
+
+	if a.config.Source != nil {
+		list, err := a.config.Source()
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, list...)
+	}
+
+	if err := validate(rules); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func validate(rules []Rule) error {
+	for _, r := range rules {
+		if r.Pattern == "" || r.Access == 0 {
+			return ErrInvalidRule
+		}
+	}
+
+	return nil
+}
+
+// Parse rules in mosquitto acl_file format
+func Parse(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+
+	user := ""
+	line := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("acl: invalid rule at line %d", line)
+		}
+
+		keyword, rest := fields[0], strings.TrimSpace(fields[1])
+
+		if keyword == "user" {
+			user = rest
+			continue
+		}
+
+		if keyword != "topic" && keyword != "pattern" {
+			return nil, fmt.Errorf("acl: unknown keyword %q at line %d", keyword, line)
+		}
+
+		rule := Rule{Access: AccessReadWrite, Pattern: rest}
+
+		// topic rules belong to preceding user, pattern rules to everybody
+		if keyword == "topic" {
+			rule.User = user
+		}
+
+		if f := strings.SplitN(rest, " ", 2); len(f) == 2 {
+			switch f[0] {
+			case "read":
+				rule.Access = AccessRead
+			case "write":
+				rule.Access = AccessWrite
+			case "readwrite":
+				rule.Access = AccessReadWrite
+			case "deny":
+				rule.Access = AccessDeny
+			default:
+				f[1] = rest
+			}
+
+			rule.Pattern = strings.TrimSpace(f[1])
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// CheckConnect ACL does not authenticate
+func (a *ACL) CheckConnect(c auth.Client, password string) auth.Result {
+	return auth.Ignore
+}
+
+// CheckPublish check write access to topic
+func (a *ACL) CheckPublish(c auth.Client, topic string) auth.Result {
+	return a.check(c.ClientID(), c.User, topic, AccessWrite)
+}
+
+// CheckSubscribe check read access to filter
+func (a *ACL) CheckSubscribe(c auth.Client, filter string) auth.Result {
+	return a.check(c.ClientID(), c.User, filter, AccessRead)
+}
+
+func (a *ACL) check(clientID, user, topic string, access Access) auth.Result {
+	granted := false
+
+	a.lock.RLock()
+	rules := a.rules
+	a.lock.RUnlock()
+
+	for _, r := range rules {
+		if r.User != "" && r.User != user {
+			continue
+		}
+
+		pattern, ok := substitute(r.Pattern, clientID, user)
+		if !ok {
+			continue
+		}
+
+		if r.Access == AccessDeny {
+			// subscription denied if it might receive any of denied topics
+			if overlaps(pattern, topic) {
+				return auth.Deny
+			}
+		} else if r.Access&access != 0 && auth.Covers(pattern, topic) {
+			granted = true
+		}
+	}
+
+	if granted {
+		return auth.Allow
+	}
+
+	if a.fallback {
+		return auth.Ignore
+	}
+
+	return auth.Deny
+}
+
+// substitute %c and %u of pattern. Returns false if rule cannot apply to client, e.g. anonymous
+// client or identifiers containing wildcards which would widen pattern
+func substitute(pattern, clientID, user string) (string, bool) {
+	if strings.Contains(pattern, "%u") {
+		if user == "" || strings.ContainsAny(user, "+#/") {
+			return "", false
+		}
+
+		pattern = strings.Replace(pattern, "%u", user, -1)
+	}
+
+	if strings.Contains(pattern, "%c") {
+		if clientID == "" || strings.ContainsAny(clientID, "+#/") {
+			return "", false
+		}
+
+		pattern = strings.Replace(pattern, "%c", clientID, -1)
+	}
+
+	return pattern, true
+}
+
+// overlaps check if there is topic matched by both filters
+func overlaps(a, b string) bool {
+	al := strings.Split(a, "/")
+	bl := strings.Split(b, "/")
+
+	// [MQTT-4.7.2-1] wildcard at root does not match topics starting with '$'
+	if sys(al[0]) && wild(bl[0]) || sys(bl[0]) && wild(al[0]) {
+		return false
+	}
+
+	for i := 0; i < len(al) && i < len(bl); i++ {
+		switch {
+		case al[i] == "#" || bl[i] == "#":
+			return true
+		case al[i] == "+" || bl[i] == "+":
+		case al[i] != bl[i]:
+			return false
+		}
+	}
+
+	if len(al) == len(bl) {
+		return true
+	}
+
+	// a/# matches a as well
+	if len(al) == len(bl)+1 {
+		return al[len(al)-1] == "#"
+	}
+
+	if len(bl) == len(al)+1 {
+		return bl[len(bl)-1] == "#"
+	}
+
+	return false
+}
+
+func sys(level string) bool {
+	return strings.HasPrefix(level, "$")
+}
+
+func wild(level string) bool {
+	return level == "+" || level == "#"
+}
@@ -0,0 +1,202 @@
+package acl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/auth"
+)
+
+const rules = `
+# applies to all clients
+pattern readwrite devices/%c/#
+pattern read users/%u/+/status
+pattern write broadcast/+
+
+user admin
+topic readwrite #
+topic deny $SYS/#
+topic deny secret/+/keys
+
+user reader
+topic read sensors/#
+`
+
+func newACL(t *testing.T, config Config) *ACL {
+	a, err := New(config)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { a.Close() }) // nolint: errcheck
+
+	return a
+}
+
+func TestParse(t *testing.T) {
+	list, err := Parse(strings.NewReader(rules))
+	require.NoError(t, err)
+
+	require.Equal(t, []Rule{
+		{Pattern: "devices/%c/#", Access: AccessReadWrite},
+		{Pattern: "users/%u/+/status", Access: AccessRead},
+		{Pattern: "broadcast/+", Access: AccessWrite},
+		{User: "admin", Pattern: "#", Access: AccessReadWrite},
+		{User: "admin", Pattern: "$SYS/#", Access: AccessDeny},
+		{User: "admin", Pattern: "secret/+/keys", Access: AccessDeny},
+		{User: "reader", Pattern: "sensors/#", Access: AccessRead},
+	}, list)
+
+	// access defaults to readwrite
+	list, err = Parse(strings.NewReader("topic a/b"))
+	require.NoError(t, err)
+	require.Equal(t, []Rule{{Pattern: "a/b", Access: AccessReadWrite}}, list)
+
+	_, err = Parse(strings.NewReader("topic"))
+	require.Error(t, err)
+
+	_, err = Parse(strings.NewReader("allow a/b"))
+	require.Error(t, err)
+}
+
+func TestCheck(t *testing.T) {
+	list, err := Parse(strings.NewReader(rules))
+	require.NoError(t, err)
+
+	a := newACL(t, Config{Rules: list})
+
+	type check func(c auth.Client, topic string) auth.Result
+
+	tests := []struct {
+		name     string
+		check    check
+		clientID string
+		user     string
+		topic    string
+		res      auth.Result
+	}{
+		// %c substitution
+		{"own device publish", a.CheckPublish, "dev1", "", "devices/dev1/temp", auth.Allow},
+		{"own device subscribe", a.CheckSubscribe, "dev1", "", "devices/dev1/#", auth.Allow},
+		{"own device root", a.CheckSubscribe, "dev1", "", "devices/dev1", auth.Allow},
+		{"other device", a.CheckPublish, "dev1", "", "devices/dev2/temp", auth.Deny},
+		{"all devices", a.CheckSubscribe, "dev1", "", "devices/+/temp", auth.Deny},
+		{"wildcard client id", a.CheckPublish, "+", "", "devices/+/temp", auth.Deny},
+		{"client id with level", a.CheckPublish, "a/b", "", "devices/a/b/temp", auth.Deny},
+
+		// %u substitution
+		{"own user status", a.CheckSubscribe, "c", "bob", "users/bob/phone/status", auth.Allow},
+		{"own user any status", a.CheckSubscribe, "c", "bob", "users/bob/+/status", auth.Allow},
+		{"other user status", a.CheckSubscribe, "c", "bob", "users/alice/phone/status", auth.Deny},
+		{"anonymous user", a.CheckSubscribe, "c", "", "users//phone/status", auth.Deny},
+		{"wildcard username", a.CheckSubscribe, "c", "#", "users/#", auth.Deny},
+
+		// + and # wildcards
+		{"plus matches level", a.CheckPublish, "c", "", "broadcast/all", auth.Allow},
+		{"plus single level", a.CheckPublish, "c", "", "broadcast/all/more", auth.Deny},
+		{"hash covers subtree", a.CheckSubscribe, "c", "reader", "sensors/a/b/c", auth.Allow},
+		{"hash covers filter", a.CheckSubscribe, "c", "reader", "sensors/+/temp", auth.Allow},
+		{"filter wider than grant", a.CheckSubscribe, "c", "reader", "#", auth.Deny},
+
+		// read vs write
+		{"read only publish", a.CheckPublish, "c", "reader", "sensors/a", auth.Deny},
+		{"write only subscribe", a.CheckSubscribe, "c", "", "broadcast/all", auth.Deny},
+		{"read only status publish", a.CheckPublish, "c", "bob", "users/bob/phone/status", auth.Deny},
+
+		// deny precedence
+		{"admin publish", a.CheckPublish, "c", "admin", "any/topic", auth.Allow},
+		{"admin subscribe subtree", a.CheckSubscribe, "c", "admin", "data/#", auth.Allow},
+		{"admin subscribe all overlapping deny", a.CheckSubscribe, "c", "admin", "#", auth.Deny},
+		{"admin sys denied", a.CheckPublish, "c", "admin", "$SYS/broker/load", auth.Deny},
+		{"admin sys filter denied", a.CheckSubscribe, "c", "admin", "$SYS/#", auth.Deny},
+		{"admin keys denied", a.CheckPublish, "c", "admin", "secret/x/keys", auth.Deny},
+		{"admin filter overlapping deny", a.CheckSubscribe, "c", "admin", "secret/#", auth.Deny},
+		{"admin filter disjoint of deny", a.CheckSubscribe, "c", "admin", "secret/x/other", auth.Allow},
+		{"deny of other user", a.CheckPublish, "c", "reader", "secret/x/keys", auth.Deny},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.res, tt.check(auth.Client{ID: tt.clientID, User: tt.user}, tt.topic))
+		})
+	}
+
+	require.Equal(t, auth.Ignore, a.CheckConnect(auth.Client{ID: "c", User: "admin"}, "pass"))
+}
+
+func TestVirtualHost(t *testing.T) {
+	list, err := Parse(strings.NewReader(rules))
+	require.NoError(t, err)
+
+	a := newACL(t, Config{Rules: list})
+
+	tests := []struct {
+		client auth.Client
+		topic  string
+		res    auth.Result
+	}{
+		// %c is client id within namespace of virtual host
+		{auth.Client{ID: "$vhost/a/dev1", Namespace: "$vhost/a/"}, "devices/dev1/temp", auth.Allow},
+		{auth.Client{ID: "$vhost/a/dev1", Namespace: "$vhost/a/"}, "devices/dev2/temp", auth.Deny},
+		{auth.Client{ID: "tenant/dev1", Namespace: "tenant/"}, "devices/dev1/temp", auth.Allow},
+
+		// client id within namespace is still checked for levels and wildcards
+		{auth.Client{ID: "$vhost/a/x/dev1", Namespace: "$vhost/a/"}, "devices/x/dev1/temp", auth.Deny},
+		{auth.Client{ID: "$vhost/a/+", Namespace: "$vhost/a/"}, "devices/+/temp", auth.Deny},
+
+		// namespaced id outside of virtual host is not stripped
+		{auth.Client{ID: "$vhost/a/dev1"}, "devices/dev1/temp", auth.Deny},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.res, a.CheckPublish(tt.client, tt.topic), "%s %s", tt.client.ID, tt.topic)
+	}
+}
+
+func TestFallthrough(t *testing.T) {
+	a := newACL(t, Config{
+		Rules: []Rule{
+			{Pattern: "public/#", Access: AccessReadWrite},
+			{Pattern: "public/private", Access: AccessDeny},
+		},
+		Fallthrough: true,
+	})
+
+	require.Equal(t, auth.Allow, a.CheckPublish(auth.Client{ID: "c", User: "u"}, "public/a"))
+	require.Equal(t, auth.Deny, a.CheckPublish(auth.Client{ID: "c", User: "u"}, "public/private"))
+	require.Equal(t, auth.Ignore, a.CheckPublish(auth.Client{ID: "c", User: "u"}, "other"))
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	file := filepath.Join(dir, "acl")
+	require.NoError(t, ioutil.WriteFile(file, []byte("pattern read a/#"), 0600))
+
+	reloads := 0
+	a := newACL(t, Config{File: file, OnReload: func() { reloads++ }})
+
+	require.Equal(t, auth.Allow, a.CheckSubscribe(auth.Client{ID: "c", User: "u"}, "a/b"))
+	require.Equal(t, auth.Deny, a.CheckSubscribe(auth.Client{ID: "c", User: "u"}, "b/c"))
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("pattern read b/#"), 0600))
+	require.NoError(t, a.Reload())
+	require.Equal(t, 1, reloads)
+
+	require.Equal(t, auth.Deny, a.CheckSubscribe(auth.Client{ID: "c", User: "u"}, "a/b"))
+	require.Equal(t, auth.Allow, a.CheckSubscribe(auth.Client{ID: "c", User: "u"}, "b/c"))
+
+	// broken file keeps previous rules
+	require.NoError(t, ioutil.WriteFile(file, []byte("allow b/#"), 0600))
+	require.Error(t, a.Reload())
+	require.Equal(t, auth.Allow, a.CheckSubscribe(auth.Client{ID: "c", User: "u"}, "b/c"))
+
+	require.Equal(t, ErrInvalidRule, a.SetRules([]Rule{{Pattern: "a"}}))
+	require.NoError(t, a.SetRules([]Rule{{Pattern: "c", Access: AccessWrite}}))
+	require.Equal(t, []Rule{{Pattern: "c", Access: AccessWrite}}, a.Rules())
+	require.Equal(t, 2, reloads)
+}
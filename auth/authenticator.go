@@ -28,18 +28,99 @@ var (
 	//	ErrAuthProviderNotFound = errors.New("auth: Authentication provider not found")
 )
 
-var providers = make(map[string]Provider)
+var providers = make(map[string]Auth)
+
+// Result of single provider check
+type Result int
+
+// nolint: golint
+const (
+	// Ignore provider has no opinion, next provider of the chain is asked
+	Ignore Result = iota
+	Allow
+	Deny
+)
+
+// Client identity of session access is checked for. The same identity is passed to connect
+// and every later check of the session thus providers may keep state of client by ID
+type Client struct {
+	// ID of session, i.e. client id prefixed by namespace of virtual host. Client connected
+	// without id is given generated one thus ID is unique across server
+	ID string
+
+	// Namespace of virtual host client connected to. Empty for default one
+	Namespace string
+
+	// User name of client. Empty for anonymous one
+	User string
+}
+
+// ClientID client id within namespace, e.g. for %c substitutions of topic filters
+func (c Client) ClientID() string {
+	return strings.TrimPrefix(c.ID, c.Namespace)
+}
+
+// Auth provider of the chain. Providers are asked in order until one allows or denies
+type Auth interface {
+	CheckConnect(c Client, password string) Result
+	CheckPublish(c Client, topic string) Result
+	CheckSubscribe(c Client, filter string) Result
+}
+
+// Roles optionally implemented by provider assigning roles to authenticated clients
+// Role selects settings of client, e.g. quotas
+type Roles interface {
+	Role(c Client) (string, bool)
+}
 
 // Provider interface
+// Registered providers are wrapped into Auth of the chain and given ID of Client as client id.
+// Password allows on success and
+// ignores any error thus next provider is asked. AclCheck allows on success and denies on any
+// error thus provider rejecting access is never overruled by providers later in the chain
 type Provider interface {
 	Password(user, password string) error
 	AclCheck(clientID, user, topic string, access authTypes.AccessType) error
 	PskKey(hint, identity string, key []byte, maxKeyLen int) error
 }
 
+// legacy adapts Provider to Auth
+type legacy struct {
+	Provider
+}
+
+func result(err error, failed Result) Result {
+	if err == nil {
+		return Allow
+	}
+
+	return failed
+}
+
+func (p legacy) CheckConnect(c Client, password string) Result {
+	return result(p.Password(c.User, password), Ignore)
+}
+
+func (p legacy) CheckPublish(c Client, topic string) Result {
+	return result(p.AclCheck(c.ID, c.User, topic, authTypes.AuthAccessTypeWrite), Deny)
+}
+
+func (p legacy) CheckSubscribe(c Client, filter string) Result {
+	return result(p.AclCheck(c.ID, c.User, filter, authTypes.AuthAccessTypeRead), Deny)
+}
+
 // Register auth provider
 func Register(name string, provider Provider) error {
-	if name == "" && provider == nil {
+	if provider == nil {
+		return errors.New("Invalid args")
+	}
+
+	return RegisterAuth(name, &legacy{provider})
+}
+
+// RegisterAuth register provider of the chain under given name
+func RegisterAuth(name string, a Auth) error {
+	if name == "" || a == nil {
 		return errors.New("Invalid args")
 	}
 
@@ -47,7 +128,7 @@ func Register(name string, provider Provider) error {
 		return errors.New("Already exists")
 	}
 
-	providers[name] = provider
+	providers[name] = a
 
 	return nil
 }
@@ -58,11 +139,14 @@ func UnRegister(name string) {
 }
 
 // Manager auth
+// Chain of providers evaluated in order until one answers. Connect is denied if none has
+// answered, publish and subscribe are allowed thus providers without access control keep it open.
+// Registered Provider always answers access checks, see Provider
 type Manager struct {
-	p []Provider
+	p []Auth
 }
 
-// NewManager new auth manager
+// NewManager new auth manager from names of registered providers separated by ';'
 func NewManager(p string) (*Manager, error) {
 	m := Manager{}
 
@@ -79,35 +163,87 @@ func NewManager(p string) (*Manager, error) {
 	return &m, nil
 }
 
-// Password authentication
-func (m *Manager) Password(user, password string) error {
+// NewChain auth manager of given providers
+func NewChain(p ...Auth) *Manager {
+	return &Manager{p: p}
+}
+
+// CheckConnect authenticate client
+func (m *Manager) CheckConnect(c Client, password string) error {
+	return m.eval(ErrAuthFailure, func(a Auth) Result { return a.CheckConnect(c, password) })
+}
+
+// CheckPublish check client allowed to publish to topic
+func (m *Manager) CheckPublish(c Client, topic string) error {
+	return m.eval(nil, func(a Auth) Result { return a.CheckPublish(c, topic) })
+}
+
+// CheckSubscribe check client allowed to subscribe to filter
+func (m *Manager) CheckSubscribe(c Client, filter string) error {
+	return m.eval(nil, func(a Auth) Result { return a.CheckSubscribe(c, filter) })
+}
+
+func (m *Manager) eval(unanswered error, check func(Auth) Result) error {
+	if m == nil {
+		return unanswered
+	}
+
 	for _, p := range m.p {
-		if err := p.Password(user, password); err == nil {
+		switch check(p) {
+		case Allow:
 			return nil
+		case Deny:
+			return ErrAuthFailure
 		}
 	}
 
-	return ErrAuthFailure
+	return unanswered
+}
+
+// Role of client assigned by first provider knowing it. Empty if none does
+func (m *Manager) Role(c Client) string {
+	if m == nil {
+		return ""
+	}
+
+	for _, p := range m.p {
+		if r, ok := p.(Roles); ok {
+			if role, ok := r.Role(c); ok {
+				return role
+			}
+		}
+	}
+
+	return ""
+}
+
+// Password authentication
+func (m *Manager) Password(user, password string) error {
+	return m.CheckConnect(Client{User: user}, password)
 }
 
 // AclCheck check permissions
 // nolint: golint
 func (m *Manager) AclCheck(clientID, user, topic string, access authTypes.AccessType) error {
-	for _, p := range m.p {
-		if err := p.AclCheck(clientID, user, topic, access); err == nil {
-			return nil
-		}
+	if access == authTypes.AuthAccessTypeWrite {
+		return m.CheckPublish(Client{ID: clientID, User: user}, topic)
 	}
 
-	return ErrAuthFailure
+	return m.CheckSubscribe(Client{ID: clientID, User: user}, topic)
 }
 
 // PskKey authenticate using psk
 // nolint: golint
 func (m *Manager) PskKey(hint, identity string, key []byte, maxKeyLen int) error {
-	for _, p := range m.p {
-		if err := p.PskKey(hint, identity, key, maxKeyLen); err == nil {
-			return nil
+	if m == nil {
+		return ErrAuthFailure
+	}
+
+	for _, a := range m.p {
+		if p, ok := a.(*legacy); ok {
+			if err := p.PskKey(hint, identity, key, maxKeyLen); err == nil {
+				return nil
+			}
 		}
 	}
 
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	authTypes "github.com/troian/surgemq/auth/types"
+)
+
+type fixed struct {
+	name   string
+	res    Result
+	called *[]string
+}
+
+func (f fixed) answer() Result {
+	*f.called = append(*f.called, f.name)
+	return f.res
+}
+
+func (f fixed) CheckConnect(c Client, password string) Result { return f.answer() }
+func (f fixed) CheckPublish(c Client, topic string) Result    { return f.answer() }
+func (f fixed) CheckSubscribe(c Client, filter string) Result { return f.answer() }
+
+type denyAll struct{}
+
+func (denyAll) Password(user, password string) error { return ErrAuthFailure }
+
+func (denyAll) AclCheck(clientID, user, topic string, access authTypes.AccessType) error {
+	return ErrAuthFailure
+}
+
+func (denyAll) PskKey(hint, identity string, key []byte, maxKeyLen int) error {
+	return ErrAuthFailure
+}
+
+func TestChainResults(t *testing.T) {
+	tests := []struct {
+		name    string
+		chain   []Result
+		called  []string
+		connect bool
+		access  bool
+	}{
+		{"unanswered", []Result{Ignore, Ignore}, []string{"0", "1"}, false, true},
+		{"empty", nil, nil, false, true},
+		{"allow", []Result{Allow, Deny}, []string{"0"}, true, true},
+		{"deny", []Result{Deny, Allow}, []string{"0"}, false, false},
+		{"ignore then allow", []Result{Ignore, Allow, Deny}, []string{"0", "1"}, true, true},
+		{"ignore then deny", []Result{Ignore, Deny, Allow}, []string{"0", "1"}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called []string
+
+			var chain []Auth
+			for i, r := range tt.chain {
+				chain = append(chain, fixed{name: string(rune('0' + i)), res: r, called: &called})
+			}
+
+			m := NewChain(chain...)
+
+			check := func(err error, ok bool) {
+				if ok {
+					require.NoError(t, err)
+				} else {
+					require.Equal(t, ErrAuthFailure, err)
+				}
+				require.Equal(t, tt.called, called)
+				called = nil
+			}
+
+			check(m.CheckConnect(Client{ID: "id", User: "user"}, "pass"), tt.connect)
+			check(m.CheckPublish(Client{ID: "id", User: "user"}, "a/b"), tt.access)
+			check(m.CheckSubscribe(Client{ID: "id", User: "user"}, "a/#"), tt.access)
+			check(m.AclCheck("id", "user", "a/b", authTypes.AuthAccessTypeWrite), tt.access)
+			check(m.AclCheck("id", "user", "a/#", authTypes.AuthAccessTypeRead), tt.access)
+		})
+	}
+}
+
+func TestLegacyProvider(t *testing.T) {
+	require.NoError(t, Register("test.deny", denyAll{}))
+	defer UnRegister("test.deny")
+
+	var called []string
+	require.NoError(t, RegisterAuth("test.allow", fixed{name: "allow", res: Allow, called: &called}))
+	defer UnRegister("test.allow")
+
+	require.Error(t, Register("test.deny", denyAll{}))
+
+	_, err := NewManager("test.deny;test.unknown")
+	require.Error(t, err)
+
+	m, err := NewManager("test.deny;test.allow")
+	require.NoError(t, err)
+
+	// failed password is ignored, next provider answers
+	require.NoError(t, m.CheckConnect(Client{ID: "id", User: "user"}, "pass"))
+	require.Equal(t, []string{"allow"}, called)
+	called = nil
+
+	// failed acl check is explicit denial
+	require.Equal(t, ErrAuthFailure, m.AclCheck("id", "user", "a/b", authTypes.AuthAccessTypeWrite))
+	require.Equal(t, ErrAuthFailure, m.AclCheck("id", "user", "a/b", authTypes.AuthAccessTypeRead))
+	require.Empty(t, called)
+
+	require.Equal(t, ErrAuthFailure, m.PskKey("hint", "id", nil, 0))
+}
+
+func TestClientID(t *testing.T) {
+	require.Equal(t, "dev1", Client{ID: "dev1"}.ClientID())
+	require.Equal(t, "dev1", Client{ID: "$vhost/a/dev1", Namespace: "$vhost/a/"}.ClientID())
+	require.Equal(t, "a/dev1", Client{ID: "tenant/a/dev1", Namespace: "tenant/"}.ClientID())
+}
+
+func TestNilManager(t *testing.T) {
+	var m *Manager
+
+	require.Equal(t, ErrAuthFailure, m.CheckConnect(Client{ID: "id", User: "user"}, "pass"))
+	require.Equal(t, ErrAuthFailure, m.PskKey("hint", "id", nil, 0))
+	require.Equal(t, "", m.Role(Client{ID: "id"}))
+}
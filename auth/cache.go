@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// CacheConfig of decisions cache
+type CacheConfig struct {
+	// TTL how long decisions are reused for
+	TTL time.Duration
+
+	// DenyTTL how long denials are reused for. Default to TTL
+	// Shorter value lets client retry sooner once credentials are fixed
+	DenyTTL time.Duration
+
+	// Size maximum amount of cached decisions, least recently used are evicted. Default to 10000
+	Size int
+}
+
+// Cache decisions of slow provider, e.g. HTTP or LDAP
+// Only providers whose decisions depend on arguments only should be wrapped as cached
+// CheckConnect does not reach provider, e.g. grants of client are not refreshed
+type Cache struct {
+	inner  Auth
+	config CacheConfig
+
+	lock  sync.Mutex
+	order *list.List
+	index map[[sha256.Size]byte]*list.Element
+}
+
+type cacheEntry struct {
+	key      [sha256.Size]byte
+	clientID string
+	user     string
+	result   Result
+	expires  time.Time
+}
+
+var _ Auth = (*Cache)(nil)
+
+// NewCache wrap provider with cache
+func NewCache(inner Auth, config CacheConfig) *Cache {
+	if config.DenyTTL == 0 {
+		config.DenyTTL = config.TTL
+	}
+
+	if config.Size == 0 {
+		config.Size = 10000
+	}
+
+	return &Cache{
+		inner:  inner,
+		config: config,
+		order:  list.New(),
+		index:  make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// CheckConnect cached by hash of credentials
+func (c *Cache) CheckConnect(cl Client, password string) Result {
+	return c.check("connect", cl, password, func() Result {
+		return c.inner.CheckConnect(cl, password)
+	})
+}
+
+// CheckPublish cached by client, user and topic
+func (c *Cache) CheckPublish(cl Client, topic string) Result {
+	return c.check("publish", cl, topic, func() Result {
+		return c.inner.CheckPublish(cl, topic)
+	})
+}
+
+// CheckSubscribe cached by client, user and filter
+func (c *Cache) CheckSubscribe(cl Client, filter string) Result {
+	return c.check("subscribe", cl, filter, func() Result {
+		return c.inner.CheckSubscribe(cl, filter)
+	})
+}
+
+// Invalidate decisions of user, e.g. once password or permissions changed
+func (c *Cache) Invalidate(user string) {
+	c.remove(func(e *cacheEntry) bool { return e.user == user })
+}
+
+// InvalidateClient decisions of client by ID of Client
+func (c *Cache) InvalidateClient(clientID string) {
+	c.remove(func(e *cacheEntry) bool { return e.clientID == clientID })
+}
+
+// Flush all decisions
+func (c *Cache) Flush() {
+	c.lock.Lock()
+	c.order.Init()
+	c.index = make(map[[sha256.Size]byte]*list.Element)
+	c.lock.Unlock()
+}
+
+func (c *Cache) check(action string, cl Client, arg string, fn func() Result) Result {
+	// arguments are length prefixed thus different splits of the same bytes do not collide
+	h := sha256.New()
+	for _, s := range []string{action, cl.ID, cl.Namespace, cl.User, arg} {
+		l := len(s)
+		h.Write([]byte{byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l)}) // nolint: errcheck, gas
+		h.Write([]byte(s))                                                   // nolint: errcheck, gas
+	}
+
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+
+	now := time.Now()
+
+	c.lock.Lock()
+	if el, ok := c.index[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if now.Before(e.expires) {
+			c.order.MoveToFront(el)
+			c.lock.Unlock()
+			return e.result
+		}
+
+		c.order.Remove(el)
+		delete(c.index, key)
+	}
+	c.lock.Unlock()
+
+	// provider is called without lock, concurrent misses of the same key are rare and harmless
+	res := fn()
+
+	ttl := c.config.TTL
+	if res == Deny {
+		ttl = c.config.DenyTTL
+	}
+
+	if ttl <= 0 {
+		return res
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.index[key]; ok {
+		c.order.Remove(el)
+	}
+
+	c.index[key] = c.order.PushFront(&cacheEntry{
+		key:      key,
+		clientID: cl.ID,
+		user:     cl.User,
+		result:   res,
+		expires:  now.Add(ttl),
+	})
+
+	for c.order.Len() > c.config.Size {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.index, el.Value.(*cacheEntry).key)
+	}
+
+	return res
+}
+
+func (c *Cache) remove(match func(*cacheEntry) bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+
+		if e := el.Value.(*cacheEntry); match(e) {
+			c.order.Remove(el)
+			delete(c.index, e.key)
+		}
+
+		el = next
+	}
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// counting provider allowing everything but denied topics
+type counting struct {
+	lock   sync.Mutex
+	calls  int
+	denied map[string]bool
+}
+
+func (p *counting) answer(arg string) Result {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.calls++
+
+	if p.denied[arg] {
+		return Deny
+	}
+
+	return Allow
+}
+
+func (p *counting) count() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.calls
+}
+
+func (p *counting) CheckConnect(c Client, password string) Result { return p.answer(password) }
+func (p *counting) CheckPublish(c Client, topic string) Result    { return p.answer(topic) }
+func (p *counting) CheckSubscribe(c Client, filter string) Result { return p.answer(filter) }
+
+func TestCacheHit(t *testing.T) {
+	p := &counting{}
+	c := NewCache(p, CacheConfig{TTL: time.Hour})
+
+	cl := Client{ID: "c1", User: "u1"}
+
+	require.Equal(t, Allow, c.CheckConnect(cl, "secret"))
+	require.Equal(t, Allow, c.CheckConnect(cl, "secret"))
+	require.Equal(t, 1, p.count())
+
+	// other password, action, argument or identity is not served from cache
+	require.Equal(t, Allow, c.CheckConnect(cl, "other"))
+	require.Equal(t, Allow, c.CheckPublish(cl, "secret"))
+	require.Equal(t, Allow, c.CheckSubscribe(cl, "secret"))
+	require.Equal(t, Allow, c.CheckPublish(Client{ID: "c2", User: "u1"}, "secret"))
+	require.Equal(t, Allow, c.CheckPublish(Client{ID: "c1", Namespace: "c", User: "u1"}, "secret"))
+	require.Equal(t, 6, p.count())
+
+	// arguments of different split do not collide
+	require.Equal(t, Allow, c.CheckPublish(Client{ID: "c1u", User: "1"}, "secret"))
+	require.Equal(t, 7, p.count())
+}
+
+func TestCacheExpiry(t *testing.T) {
+	p := &counting{denied: map[string]bool{"denied": true}}
+	c := NewCache(p, CacheConfig{TTL: 50 * time.Millisecond})
+
+	cl := Client{ID: "c1", User: "u1"}
+
+	require.Equal(t, Allow, c.CheckPublish(cl, "allowed"))
+	require.Equal(t, Deny, c.CheckPublish(cl, "denied"))
+	require.Equal(t, Allow, c.CheckPublish(cl, "allowed"))
+	require.Equal(t, Deny, c.CheckPublish(cl, "denied"))
+	require.Equal(t, 2, p.count())
+
+	time.Sleep(60 * time.Millisecond)
+
+	require.Equal(t, Allow, c.CheckPublish(cl, "allowed"))
+	require.Equal(t, Deny, c.CheckPublish(cl, "denied"))
+	require.Equal(t, 4, p.count())
+}
+
+func TestCacheDenyTTL(t *testing.T) {
+	p := &counting{denied: map[string]bool{"denied": true}}
+	c := NewCache(p, CacheConfig{TTL: time.Hour, DenyTTL: 50 * time.Millisecond})
+
+	cl := Client{ID: "c1", User: "u1"}
+
+	require.Equal(t, Allow, c.CheckPublish(cl, "allowed"))
+	require.Equal(t, Deny, c.CheckPublish(cl, "denied"))
+	require.Equal(t, Deny, c.CheckPublish(cl, "denied"))
+	require.Equal(t, 2, p.count())
+
+	// denial expires sooner, e.g. once permissions are fixed client is allowed
+	time.Sleep(60 * time.Millisecond)
+	p.lock.Lock()
+	p.denied = nil
+	p.lock.Unlock()
+
+	require.Equal(t, Allow, c.CheckPublish(cl, "allowed"))
+	require.Equal(t, Allow, c.CheckPublish(cl, "denied"))
+	require.Equal(t, 3, p.count())
+
+	// negative denial TTL disables caching of denials
+	p = &counting{denied: map[string]bool{"denied": true}}
+	c = NewCache(p, CacheConfig{TTL: time.Hour, DenyTTL: -1})
+
+	require.Equal(t, Deny, c.CheckPublish(cl, "denied"))
+	require.Equal(t, Deny, c.CheckPublish(cl, "denied"))
+	require.Equal(t, 2, p.count())
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	p := &counting{}
+	c := NewCache(p, CacheConfig{TTL: time.Hour})
+
+	c1 := Client{ID: "c1", User: "u1"}
+	c2 := Client{ID: "c2", User: "u2"}
+
+	fill := func() {
+		c.CheckPublish(c1, "t")
+		c.CheckPublish(c2, "t")
+	}
+
+	fill()
+	require.Equal(t, 2, p.count())
+
+	c.Invalidate("u1")
+	fill()
+	require.Equal(t, 3, p.count())
+
+	c.InvalidateClient("c2")
+	fill()
+	require.Equal(t, 4, p.count())
+
+	c.Invalidate("unknown")
+	c.InvalidateClient("unknown")
+	fill()
+	require.Equal(t, 4, p.count())
+
+	c.Flush()
+	fill()
+	require.Equal(t, 6, p.count())
+}
+
+func TestCacheSize(t *testing.T) {
+	p := &counting{}
+	c := NewCache(p, CacheConfig{TTL: time.Hour, Size: 2})
+
+	cl := Client{ID: "c1", User: "u1"}
+
+	c.CheckPublish(cl, "a")
+	c.CheckPublish(cl, "b")
+	c.CheckPublish(cl, "a")
+	require.Equal(t, 2, p.count())
+
+	// least recently used is evicted
+	c.CheckPublish(cl, "c")
+	c.CheckPublish(cl, "a")
+	require.Equal(t, 3, p.count())
+
+	c.CheckPublish(cl, "b")
+	require.Equal(t, 4, p.count())
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Grant topic filters client is allowed to publish and subscribe to
+// nil list has no opinion on access while empty one denies any
+type Grant struct {
+	Publish   []string
+	Subscribe []string
+
+	// Expires time grant ends at. Zero never expires
+	Expires time.Time
+
+	// Role of client. Empty if not known
+	Role string
+}
+
+// Grants of connected clients kept by providers authorizing at connect, e.g. by token
+// claims or directory groups. Grants are kept by ID of Client and replaced on every connect
+type Grants struct {
+	lock sync.Mutex
+	list map[string]*Grant
+}
+
+// NewGrants allocate grants
+func NewGrants() *Grants {
+	return &Grants{
+		list: make(map[string]*Grant),
+	}
+}
+
+// Set grant of client. nil removes grant thus client is not controlled by provider
+// Expired grants of other clients are removed as well
+func (g *Grants) Set(clientID string, grant *Grant) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := time.Now()
+	for id, e := range g.list {
+		if !e.Expires.IsZero() && now.After(e.Expires) {
+			delete(g.list, id)
+		}
+	}
+
+	if grant == nil {
+		delete(g.list, clientID)
+	} else {
+		g.list[clientID] = grant
+	}
+}
+
+// Role of client from its grant
+func (g *Grants) Role(clientID string) (string, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if e, ok := g.list[clientID]; ok && e.Role != "" {
+		return e.Role, true
+	}
+
+	return "", false
+}
+
+// CheckPublish topic against grant of client
+func (g *Grants) CheckPublish(clientID, topic string) Result {
+	return g.check(clientID, topic, func(e *Grant) []string { return e.Publish })
+}
+
+// CheckSubscribe filter against grant of client
+func (g *Grants) CheckSubscribe(clientID, filter string) Result {
+	return g.check(clientID, filter, func(e *Grant) []string { return e.Subscribe })
+}
+
+func (g *Grants) check(clientID, topic string, list func(*Grant) []string) Result {
+	g.lock.Lock()
+	e, ok := g.list[clientID]
+	g.lock.Unlock()
+
+	if !ok {
+		return Ignore
+	}
+
+	// access ends along with grant
+	if !e.Expires.IsZero() && time.Now().After(e.Expires) {
+		return Deny
+	}
+
+	patterns := list(e)
+	if patterns == nil {
+		return Ignore
+	}
+
+	for _, pattern := range patterns {
+		if Covers(pattern, topic) {
+			return Allow
+		}
+	}
+
+	return Deny
+}
@@ -0,0 +1,182 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// JWKSConfig endpoint publishing signing keys
+type JWKSConfig struct {
+	// URL of key set, e.g. https://auth.example.com/.well-known/jwks.json
+	URL string
+
+	// Refresh interval keys are reloaded with. Default to 1 hour
+	Refresh time.Duration
+
+	// MinRefresh minimal interval between reloads triggered by unknown key id thus rotated
+	// keys are picked up without waiting for refresh. Default to 1 minute
+	MinRefresh time.Duration
+
+	// Client used to fetch keys. Default to client with 10 seconds timeout
+	Client *http.Client
+}
+
+type jwks struct {
+	config JWKSConfig
+
+	lock    sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newJWKS(config JWKSConfig) *jwks {
+	if config.Refresh == 0 {
+		config.Refresh = time.Hour
+	}
+
+	if config.MinRefresh == 0 {
+		config.MinRefresh = time.Minute
+	}
+
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	return &jwks{
+		config: config,
+	}
+}
+
+// key by id. Set is reloaded once stale or key is unknown, keys from previous load
+// are used if endpoint is not available
+func (j *jwks) key(kid string) (crypto.PublicKey, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	key, ok := j.keys[kid]
+
+	age := time.Since(j.fetched)
+	if age > j.config.Refresh || (!ok && age > j.config.MinRefresh) {
+		if keys, err := j.fetch(); err == nil {
+			j.keys = keys
+			key, ok = keys[kid]
+		}
+
+		// failed attempts are rate limited as well
+		j.fetched = time.Now()
+	}
+
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+func (j *jwks) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := j.config.Client.Get(j.config.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwt: jwks status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+
+	for _, k := range set.Keys {
+		// keys of other types and purposes are skipped
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		if key, e := k.publicKey(); e == nil {
+			keys[k.Kid] = key
+		}
+	}
+
+	return keys, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, ErrAlgorithm
+		}
+
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, ErrAlgorithm
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	return new(big.Int).SetBytes(buf), nil
+}
@@ -0,0 +1,372 @@
+// Package jwt authenticates clients presenting JSON Web Token in CONNECT password
+// and grants access to topics listed in token claims
+//
+//	auth.RegisterAuth("jwt", jwt.New(jwt.Config{JWKS: &jwt.JWKSConfig{URL: "https://auth.example.com/jwks.json"}}))
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	// hashes used by supported algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/troian/surgemq/auth"
+)
+
+// Token errors
+var (
+	ErrMalformed   = errors.New("jwt: malformed token")
+	ErrAlgorithm   = errors.New("jwt: unsupported algorithm")
+	ErrUnknownKey  = errors.New("jwt: unknown key")
+	ErrSignature   = errors.New("jwt: invalid signature")
+	ErrExpired     = errors.New("jwt: token expired")
+	ErrMissingExp  = errors.New("jwt: token has no expiration")
+	ErrNotValidYet = errors.New("jwt: token not valid yet")
+	ErrAudience    = errors.New("jwt: invalid audience")
+	ErrIssuer      = errors.New("jwt: invalid issuer")
+	ErrUsername    = errors.New("jwt: username does not match token")
+)
+
+// Config of provider
+type Config struct {
+	// Secret key of HS256, HS384 and HS512 tokens
+	Secret []byte
+
+	// Keys public keys of RS* and ES* tokens by key id. Key under empty id is used
+	// for tokens without kid header
+	Keys map[string]crypto.PublicKey
+
+	// JWKS endpoint keys are fetched from in addition to Keys. Optional
+	JWKS *JWKSConfig
+
+	// Audience token must be issued for. Not checked if empty
+	Audience string
+
+	// Issuer of token. Not checked if empty
+	Issuer string
+
+	// Leeway allowed clock skew of exp and nbf
+	Leeway time.Duration
+
+	// RequireExp refuse tokens without exp claim, e.g. never expiring ones
+	RequireExp bool
+
+	// UsernameClaim claim CONNECT username must be equal to, e.g. sub. Not checked if empty
+	UsernameClaim string
+
+	// PublishClaim and SubscribeClaim claims holding lists of topic filters client is allowed to
+	// publish and subscribe to. Default to "publish" and "subscribe". Token without such claim
+	// has no opinion on the access and next provider of the chain is asked
+	PublishClaim   string
+	SubscribeClaim string
+
+	// RoleClaim claim holding role of client. Default to "role"
+	RoleClaim string
+}
+
+// Provider authenticate by token and authorize by its claims
+type Provider struct {
+	config Config
+	jwks   *jwks
+	grants *auth.Grants
+}
+
+var _ auth.Auth = (*Provider)(nil)
+
+// New provider
+func New(config Config) *Provider {
+	if config.PublishClaim == "" {
+		config.PublishClaim = "publish"
+	}
+
+	if config.SubscribeClaim == "" {
+		config.SubscribeClaim = "subscribe"
+	}
+
+	if config.RoleClaim == "" {
+		config.RoleClaim = "role"
+	}
+
+	p := &Provider{
+		config: config,
+		grants: auth.NewGrants(),
+	}
+
+	if config.JWKS != nil {
+		p.jwks = newJWKS(*config.JWKS)
+	}
+
+	return p
+}
+
+// CheckConnect validate token passed as password
+// Grants of the token are kept per session id until client connects again or token expires
+func (p *Provider) CheckConnect(c auth.Client, password string) auth.Result {
+	claims, err := p.Verify(password)
+	if err == nil && p.config.UsernameClaim != "" {
+		if v, _ := claims[p.config.UsernameClaim].(string); v != c.User {
+			err = ErrUsername
+		}
+	}
+
+	if err == ErrMalformed {
+		// password is not a token, likely handled by another provider
+		p.grants.Set(c.ID, nil)
+		return auth.Ignore
+	} else if err != nil {
+		p.grants.Set(c.ID, nil)
+		return auth.Deny
+	}
+
+	_, pub := claims[p.config.PublishClaim]
+	_, sub := claims[p.config.SubscribeClaim]
+	role, _ := claims[p.config.RoleClaim].(string)
+
+	if !pub && !sub && role == "" {
+		p.grants.Set(c.ID, nil)
+		return auth.Allow
+	}
+
+	g := &auth.Grant{
+		Publish:   stringList(claims[p.config.PublishClaim]),
+		Subscribe: stringList(claims[p.config.SubscribeClaim]),
+		Role:      role,
+	}
+
+	if exp, ok := claims["exp"].(float64); ok {
+		g.Expires = time.Unix(int64(exp), 0).Add(p.config.Leeway)
+	}
+
+	p.grants.Set(c.ID, g)
+
+	return auth.Allow
+}
+
+// Role of client from role claim
+func (p *Provider) Role(c auth.Client) (string, bool) {
+	return p.grants.Role(c.ID)
+}
+
+// CheckPublish check topic against publish claim
+func (p *Provider) CheckPublish(c auth.Client, topic string) auth.Result {
+	return p.grants.CheckPublish(c.ID, topic)
+}
+
+// CheckSubscribe check filter against subscribe claim
+func (p *Provider) CheckSubscribe(c auth.Client, filter string) auth.Result {
+	return p.grants.CheckSubscribe(c.ID, filter)
+}
+
+// Verify signature and registered claims of token and return its claims
+func (p *Provider) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	if err = p.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if err = p.validate(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// curveBits size of curve of ES* algorithms
+var curveBits = map[string]int{
+	"ES256": 256,
+	"ES384": 384,
+	"ES512": 521,
+}
+
+func (p *Provider) verifySignature(alg, kid, input string, sig []byte) error {
+	var hash crypto.Hash
+
+	if len(alg) != 5 {
+		return ErrAlgorithm
+	}
+
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return ErrAlgorithm
+	}
+
+	if alg[:2] == "HS" {
+		if len(p.config.Secret) == 0 {
+			return ErrUnknownKey
+		}
+
+		mac := hmac.New(hash.New, p.config.Secret)
+		mac.Write([]byte(input)) // nolint: errcheck, gas
+
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrSignature
+		}
+
+		return nil
+	}
+
+	key, err := p.key(kid)
+	if err != nil {
+		return err
+	}
+
+	h := hash.New()
+	h.Write([]byte(input)) // nolint: errcheck, gas
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrUnknownKey
+		}
+
+		if rsa.VerifyPKCS1v15(pub, hash, digest, sig) != nil {
+			return ErrSignature
+		}
+	case "ES":
+		// curve is defined by algorithm, key of other curve must not be accepted
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve.Params().BitSize != curveBits[alg] {
+			return ErrUnknownKey
+		}
+
+		if len(sig) != 2*((curveBits[alg]+7)/8) {
+			return ErrSignature
+		}
+
+		r := new(big.Int).SetBytes(sig[:len(sig)/2])
+		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrSignature
+		}
+	default:
+		return ErrAlgorithm
+	}
+
+	return nil
+}
+
+func (p *Provider) key(kid string) (crypto.PublicKey, error) {
+	if key, ok := p.config.Keys[kid]; ok {
+		return key, nil
+	}
+
+	if p.jwks != nil {
+		return p.jwks.key(kid)
+	}
+
+	return nil, ErrUnknownKey
+}
+
+func (p *Provider) validate(claims map[string]interface{}) error {
+	now := time.Now()
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(p.config.Leeway)) {
+			return ErrExpired
+		}
+	} else if p.config.RequireExp {
+		return ErrMissingExp
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(p.config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return ErrNotValidYet
+		}
+	}
+
+	if p.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != p.config.Issuer {
+			return ErrIssuer
+		}
+	}
+
+	if p.config.Audience != "" {
+		found := false
+		for _, aud := range stringList(claims["aud"]) {
+			if aud == p.config.Audience {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return ErrAudience
+		}
+	}
+
+	return nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	if err = json.Unmarshal(buf, v); err != nil {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+// stringList claim value of either single string or array of strings
+func stringList(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		list := make([]string, 0, len(val))
+		for _, e := range val {
+			if s, ok := e.(string); ok {
+				list = append(list, s)
+			}
+		}
+
+		return list
+	}
+
+	return nil
+}
@@ -0,0 +1,320 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/auth"
+)
+
+var secret = []byte("secret")
+
+func segment(t *testing.T, v interface{}) string {
+	buf, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// sign token of claims with given algorithm, key is either secret or private key
+func sign(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+
+	input := segment(t, header) + "." + segment(t, claims)
+
+	var sig []byte
+
+	hash := crypto.SHA256
+	switch {
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	}
+
+	switch k := key.(type) {
+	case nil:
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(input)) // nolint: errcheck, gas
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := hashed(hash, input)
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hashed(hash, input))
+		require.NoError(t, err)
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func hashed(hash crypto.Hash, input string) []byte {
+	h := hash.New()
+	h.Write([]byte(input)) // nolint: errcheck, gas
+	return h.Sum(nil)
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ec384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	ec521Key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	require.NoError(t, err)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	p := New(Config{
+		Secret: secret,
+		Keys: map[string]crypto.PublicKey{
+			"rsa":   &rsaKey.PublicKey,
+			"ec":    &ecKey.PublicKey,
+			"ec384": &ec384Key.PublicKey,
+			"ec521": &ec521Key.PublicKey,
+		},
+		Audience: "broker",
+		Issuer:   "issuer",
+		Leeway:   time.Minute,
+	})
+
+	rsaOnly := New(Config{Keys: map[string]crypto.PublicKey{"": &rsaKey.PublicKey}})
+
+	withExp := New(Config{Secret: secret, RequireExp: true})
+
+	now := time.Now().Unix()
+
+	valid := func(extra map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"aud": "broker", "iss": "issuer", "exp": now + 60}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		p     *Provider
+		token string
+		err   error
+	}{
+		{"hs256", p, sign(t, "HS256", "", secret, valid(nil)), nil},
+		{"rs256", p, sign(t, "RS256", "rsa", rsaKey, valid(nil)), nil},
+		{"es256", p, sign(t, "ES256", "ec", ecKey, valid(nil)), nil},
+		{"es384", p, sign(t, "ES384", "ec384", ec384Key, valid(nil)), nil},
+		{"es512", p, sign(t, "ES512", "ec521", ec521Key, valid(nil)), nil},
+		{"aud list", p, sign(t, "HS256", "", secret, valid(map[string]interface{}{"aud": []string{"other", "broker"}})), nil},
+		{"not token", p, "password", ErrMalformed},
+		{"bad segment", p, "a.b.c", ErrMalformed},
+		{"bad hmac", p, sign(t, "HS256", "", []byte("other"), valid(nil)), ErrSignature},
+		{"bad rsa", p, sign(t, "RS256", "rsa", otherKey, valid(nil)), ErrSignature},
+		{"tampered", p, tamper(sign(t, "HS256", "", secret, valid(nil)), segment(t, valid(map[string]interface{}{"publish": "#"}))), ErrSignature},
+		{"alg none", p, sign(t, "none", "", nil, valid(nil)), ErrAlgorithm},
+		{"alg none signed", p, sign(t, "none", "", secret, valid(nil)), ErrAlgorithm},
+		{"alg unknown", p, sign(t, "PS256", "rsa", secret, valid(nil)), ErrAlgorithm},
+		{"rs key as hs secret", rsaOnly, sign(t, "HS256", "", []byte{}, valid(nil)), ErrUnknownKey},
+		{"rs kid with es alg", p, sign(t, "ES256", "rsa", ecKey, valid(nil)), ErrUnknownKey},
+		{"p384 key with es256 alg", p, sign(t, "ES256", "ec384", ec384Key, valid(nil)), ErrUnknownKey},
+		{"p256 key with es384 alg", p, sign(t, "ES384", "ec", ecKey, valid(nil)), ErrUnknownKey},
+		{"p256 key with es512 alg", p, sign(t, "ES512", "ec", ecKey, valid(nil)), ErrUnknownKey},
+		{"es signature size", p, sign(t, "ES256", "ec", []byte("short"), valid(nil)), ErrSignature},
+		{"es kid with rs alg", p, sign(t, "RS256", "ec", rsaKey, valid(nil)), ErrUnknownKey},
+		{"unknown kid", p, sign(t, "RS256", "missing", rsaKey, valid(nil)), ErrUnknownKey},
+		{"expired", p, sign(t, "HS256", "", secret, valid(map[string]interface{}{"exp": now - 120})), ErrExpired},
+		{"no exp", p, sign(t, "HS256", "", secret, map[string]interface{}{"aud": "broker", "iss": "issuer"}), nil},
+		{"no exp required", withExp, sign(t, "HS256", "", secret, map[string]interface{}{}), ErrMissingExp},
+		{"exp required", withExp, sign(t, "HS256", "", secret, map[string]interface{}{"exp": now + 60}), nil},
+		{"expired within leeway", p, sign(t, "HS256", "", secret, valid(map[string]interface{}{"exp": now - 30})), nil},
+		{"not valid yet", p, sign(t, "HS256", "", secret, valid(map[string]interface{}{"nbf": now + 120})), ErrNotValidYet},
+		{"nbf within leeway", p, sign(t, "HS256", "", secret, valid(map[string]interface{}{"nbf": now + 30})), nil},
+		{"wrong audience", p, sign(t, "HS256", "", secret, valid(map[string]interface{}{"aud": "other"})), ErrAudience},
+		{"no audience", p, sign(t, "HS256", "", secret, map[string]interface{}{"iss": "issuer"}), ErrAudience},
+		{"wrong issuer", p, sign(t, "HS256", "", secret, valid(map[string]interface{}{"iss": "other"})), ErrIssuer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.p.Verify(tt.token)
+			require.Equal(t, tt.err, err)
+		})
+	}
+}
+
+// tamper replace claims of token keeping its signature
+func tamper(token, claims string) string {
+	parts := strings.Split(token, ".")
+	return parts[0] + "." + claims + "." + parts[2]
+}
+
+func TestCheckConnect(t *testing.T) {
+	p := New(Config{Secret: secret, UsernameClaim: "sub"})
+
+	require.Equal(t, auth.Ignore, p.CheckConnect(auth.Client{ID: "id", User: "user"}, "password"))
+	require.Equal(t, auth.Deny, p.CheckConnect(auth.Client{ID: "id", User: "user"}, sign(t, "HS256", "", []byte("other"), nil)))
+	require.Equal(t, auth.Deny, p.CheckConnect(auth.Client{ID: "id", User: "user"}, sign(t, "HS256", "", secret, map[string]interface{}{"sub": "other"})))
+
+	// token without grants has no opinion on access
+	require.Equal(t, auth.Allow, p.CheckConnect(auth.Client{ID: "id", User: "user"}, sign(t, "HS256", "", secret, map[string]interface{}{"sub": "user"})))
+	require.Equal(t, auth.Ignore, p.CheckPublish(auth.Client{ID: "id", User: "user"}, "a/b"))
+
+	token := sign(t, "HS256", "", secret, map[string]interface{}{
+		"sub":       "user",
+		"publish":   []string{"a/+"},
+		"subscribe": "b/#",
+		"role":      "gold",
+	})
+
+	require.Equal(t, auth.Allow, p.CheckConnect(auth.Client{ID: "id", User: "user"}, token))
+	require.Equal(t, auth.Allow, p.CheckPublish(auth.Client{ID: "id", User: "user"}, "a/b"))
+	require.Equal(t, auth.Deny, p.CheckPublish(auth.Client{ID: "id", User: "user"}, "b/c"))
+	require.Equal(t, auth.Allow, p.CheckSubscribe(auth.Client{ID: "id", User: "user"}, "b/c/d"))
+	require.Equal(t, auth.Deny, p.CheckSubscribe(auth.Client{ID: "id", User: "user"}, "a/b"))
+
+	role, ok := p.Role(auth.Client{ID: "id", User: "user"})
+	require.True(t, ok)
+	require.Equal(t, "gold", role)
+
+	// failed connect drops grants of previous token
+	require.Equal(t, auth.Deny, p.CheckConnect(auth.Client{ID: "id", User: "user"}, sign(t, "HS256", "", []byte("other"), nil)))
+	require.Equal(t, auth.Ignore, p.CheckPublish(auth.Client{ID: "id", User: "user"}, "a/b"))
+}
+
+type keySet struct {
+	lock    sync.Mutex
+	keys    []map[string]string
+	fetches int32
+}
+
+func (s *keySet) set(keys ...map[string]string) {
+	s.lock.Lock()
+	s.keys = keys
+	s.lock.Unlock()
+}
+
+func (s *keySet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&s.fetches, 1)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys}) // nolint: errcheck, gas
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	set := &keySet{}
+	set.set(rsaJWK("k1", key1), ecJWK("ec", ecKey), map[string]string{"kty": "RSA", "kid": "enc", "use": "enc"})
+
+	srv := httptest.NewServer(set)
+	defer srv.Close()
+
+	p := New(Config{JWKS: &JWKSConfig{URL: srv.URL, MinRefresh: time.Nanosecond}})
+
+	_, err = p.Verify(sign(t, "RS256", "k1", key1, nil))
+	require.NoError(t, err)
+
+	_, err = p.Verify(sign(t, "ES256", "ec", ecKey, nil))
+	require.NoError(t, err)
+
+	// keys of other purposes are skipped
+	_, err = p.Verify(sign(t, "RS256", "enc", key1, nil))
+	require.Equal(t, ErrUnknownKey, err)
+
+	// rotated key is fetched on unknown kid
+	set.set(rsaJWK("k2", key2))
+
+	_, err = p.Verify(sign(t, "RS256", "k2", key2, nil))
+	require.NoError(t, err)
+
+	_, err = p.Verify(sign(t, "RS256", "k1", key1, nil))
+	require.Equal(t, ErrUnknownKey, err)
+
+	// keys of previous load are used while endpoint is unavailable
+	srv.Close()
+
+	_, err = p.Verify(sign(t, "RS256", "k2", key2, nil))
+	require.NoError(t, err)
+}
+
+func TestJWKSMinRefresh(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	set := &keySet{}
+	set.set(rsaJWK("k1", key))
+
+	srv := httptest.NewServer(set)
+	defer srv.Close()
+
+	p := New(Config{JWKS: &JWKSConfig{URL: srv.URL, MinRefresh: time.Hour}})
+
+	_, err = p.Verify(sign(t, "RS256", "k1", key, nil))
+	require.NoError(t, err)
+
+	// unknown kid does not hammer endpoint
+	for i := 0; i < 3; i++ {
+		_, err = p.Verify(sign(t, "RS256", "unknown", key, nil))
+		require.Equal(t, ErrUnknownKey, err)
+	}
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&set.fetches))
+}
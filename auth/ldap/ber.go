@@ -0,0 +1,180 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// errMalformed response cannot be decoded
+var errMalformed = errors.New("ldap: malformed response")
+
+// maxLength limit of element read from stream thus garbage length is not allocated
+const maxLength = 16 << 20
+
+// BER tags used by LDAP messages
+const (
+	tagInteger    = 0x02
+	tagOctets     = 0x04
+	tagEnum       = 0x0a
+	tagBoolean    = 0x01
+	tagSequence   = 0x30
+	tagSet        = 0x31
+	tagBindReq    = 0x60
+	tagBindResp   = 0x61
+	tagUnbindReq  = 0x42
+	tagSearchReq  = 0x63
+	tagSearchItem = 0x64
+	tagSearchDone = 0x65
+	tagExtReq     = 0x77
+	tagExtResp    = 0x78
+	tagContext0   = 0x80
+	tagPresent    = 0x87
+)
+
+// element single decoded BER element
+type element struct {
+	tag      byte
+	value    []byte
+	children []element
+}
+
+func encode(tag byte, content ...[]byte) []byte {
+	n := 0
+	for _, c := range content {
+		n += len(c)
+	}
+
+	buf := []byte{tag}
+
+	switch {
+	case n < 0x80:
+		buf = append(buf, byte(n))
+	case n < 0x100:
+		buf = append(buf, 0x81, byte(n))
+	case n < 0x10000:
+		buf = append(buf, 0x82, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+
+	for _, c := range content {
+		buf = append(buf, c...)
+	}
+
+	return buf
+}
+
+func encodeInt(tag byte, v int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if v == 0 && b[0] < 0x80 {
+			break
+		}
+	}
+
+	return encode(tag, b)
+}
+
+func encodeString(tag byte, s string) []byte {
+	return encode(tag, []byte(s))
+}
+
+// read single element from stream
+func read(r *bufio.Reader) (element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+
+	l, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+
+	length := int(l)
+	if l&0x80 != 0 {
+		octets := int(l & 0x7f)
+		if octets == 0 || octets > 4 {
+			return element{}, errMalformed
+		}
+
+		length = 0
+		for i := 0; i < octets; i++ {
+			b, e := r.ReadByte()
+			if e != nil {
+				return element{}, e
+			}
+
+			length = length<<8 | int(b)
+		}
+
+		if length > maxLength {
+			return element{}, errMalformed
+		}
+	}
+
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return element{}, err
+	}
+
+	return parse(tag, buf)
+}
+
+func parse(tag byte, buf []byte) (element, error) {
+	e := element{tag: tag, value: buf}
+
+	// constructed elements hold children
+	if tag&0x20 == 0 {
+		return e, nil
+	}
+
+	for len(buf) > 0 {
+		if len(buf) < 2 {
+			return e, errMalformed
+		}
+
+		ctag, l := buf[0], int(buf[1])
+		buf = buf[2:]
+
+		if l&0x80 != 0 {
+			octets := l & 0x7f
+			if octets == 0 || octets > 4 || len(buf) < octets {
+				return e, errMalformed
+			}
+
+			l = 0
+			for _, b := range buf[:octets] {
+				l = l<<8 | int(b)
+			}
+
+			buf = buf[octets:]
+		}
+
+		if len(buf) < l {
+			return e, errMalformed
+		}
+
+		child, err := parse(ctag, buf[:l])
+		if err != nil {
+			return e, err
+		}
+
+		e.children = append(e.children, child)
+		buf = buf[l:]
+	}
+
+	return e, nil
+}
+
+func (e element) int() int {
+	v := 0
+	for _, b := range e.value {
+		v = v<<8 | int(b)
+	}
+
+	return v
+}
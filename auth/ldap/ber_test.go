@@ -0,0 +1,166 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readBytes(buf []byte) (element, error) {
+	return read(bufio.NewReader(bytes.NewReader(buf)))
+}
+
+func TestBERInt(t *testing.T) {
+	for _, v := range []int{0, 1, 127, 128, 255, 256, 32767, 32768, 65535, 65536, 1 << 24, 1<<31 - 1} {
+		e, err := readBytes(encodeInt(tagInteger, v))
+		require.NoError(t, err)
+		require.Equal(t, byte(tagInteger), e.tag)
+		require.Equal(t, v, e.int())
+
+		// positive integers never have sign bit set
+		require.True(t, e.value[0] < 0x80 || len(e.value) == 0, "%d", v)
+	}
+}
+
+func TestBERLength(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 255, 256, 65535, 65536, 70000} {
+		s := strings.Repeat("x", n)
+
+		buf := encodeString(tagOctets, s)
+
+		e, err := readBytes(buf)
+		require.NoError(t, err, "%d", n)
+		require.Equal(t, byte(tagOctets), e.tag)
+		require.Equal(t, s, string(e.value))
+
+		// short form below 128, long form with minimal octets otherwise
+		switch {
+		case n < 0x80:
+			require.Equal(t, byte(n), buf[1])
+		case n < 0x100:
+			require.Equal(t, byte(0x81), buf[1])
+		case n < 0x10000:
+			require.Equal(t, byte(0x82), buf[1])
+		default:
+			require.Equal(t, byte(0x84), buf[1])
+		}
+	}
+}
+
+func TestBERConstructed(t *testing.T) {
+	long := strings.Repeat("v", 300)
+
+	buf := encode(tagSequence,
+		encodeInt(tagInteger, 7),
+		encode(tagBindResp,
+			encodeInt(tagEnum, 49),
+			encodeString(tagOctets, ""),
+			encodeString(tagOctets, long),
+		),
+		encode(tagSet),
+	)
+
+	e, err := readBytes(buf)
+	require.NoError(t, err)
+	require.Equal(t, byte(tagSequence), e.tag)
+	require.Len(t, e.children, 3)
+
+	require.Equal(t, 7, e.children[0].int())
+
+	op := e.children[1]
+	require.Equal(t, byte(tagBindResp), op.tag)
+	require.Len(t, op.children, 3)
+	require.Equal(t, byte(tagEnum), op.children[0].tag)
+	require.Equal(t, 49, op.children[0].int())
+	require.Empty(t, op.children[1].value)
+	require.Equal(t, long, string(op.children[2].value))
+
+	require.Equal(t, byte(tagSet), e.children[2].tag)
+	require.Empty(t, e.children[2].children)
+
+	// primitive elements are not parsed for children
+	e, err = readBytes(encodeString(tagOctets, string(encodeInt(tagInteger, 1))))
+	require.NoError(t, err)
+	require.Empty(t, e.children)
+}
+
+func TestBERStream(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(encodeInt(tagInteger, 1))
+	buf.Write(encodeString(tagOctets, "two"))
+
+	r := bufio.NewReader(&buf)
+
+	e, err := read(r)
+	require.NoError(t, err)
+	require.Equal(t, 1, e.int())
+
+	e, err = read(r)
+	require.NoError(t, err)
+	require.Equal(t, "two", string(e.value))
+
+	_, err = read(r)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestBERTruncated(t *testing.T) {
+	buf := encode(tagSequence,
+		encodeInt(tagInteger, 1),
+		encode(tagBindResp,
+			encodeInt(tagEnum, 0),
+			encodeString(tagOctets, ""),
+			encodeString(tagOctets, strings.Repeat("m", 200)),
+		),
+	)
+
+	for i := 0; i < len(buf); i++ {
+		_, err := readBytes(buf[:i])
+		require.Error(t, err, "%d of %d bytes", i, len(buf))
+	}
+}
+
+func TestBERMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"indefinite length":      {tagOctets, 0x80},
+		"length octets overflow": {tagOctets, 0x85, 0, 0, 0, 0, 1},
+		"length above limit":     {tagOctets, 0x84, 0x7f, 0xff, 0xff, 0xff},
+		"child header truncated": {tagSequence, 1, tagInteger},
+		"child beyond parent":    {tagSequence, 2, tagOctets, 5},
+		"child indefinite":       {tagSequence, 2, tagOctets, 0x80},
+		"child length octets":    {tagSequence, 3, tagOctets, 0x82, 1},
+		"nested child beyond":    {tagSequence, 4, tagSet, 2, tagOctets, 1},
+	}
+
+	for name, buf := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := readBytes(buf)
+			require.Equal(t, errMalformed, err)
+		})
+	}
+}
+
+func TestBERGarbage(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	valid := encode(tagSequence, encodeInt(tagInteger, 1), encode(tagSearchItem,
+		encodeString(tagOctets, "uid=a"),
+		encode(tagSequence, encode(tagSequence, encodeString(tagOctets, "memberOf"), encode(tagSet, encodeString(tagOctets, "cn=g"))))))
+
+	for i := 0; i < 10000; i++ {
+		buf := append([]byte(nil), valid...)
+
+		// corrupt some bytes of valid message
+		for n := rnd.Intn(4) + 1; n > 0; n-- {
+			buf[rnd.Intn(len(buf))] = byte(rnd.Intn(256))
+		}
+
+		require.NotPanics(t, func() {
+			readBytes(buf) // nolint: errcheck
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LDAP result codes
+const (
+	resultSuccess            = 0
+	resultInvalidCredentials = 49
+)
+
+// oidStartTLS name of StartTLS extended operation
+const oidStartTLS = "1.3.6.1.4.1.1466.20037"
+
+// ErrInvalidCredentials bind rejected by directory
+var ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+
+type conn struct {
+	net.Conn
+	r       *bufio.Reader
+	id      int
+	timeout time.Duration
+}
+
+func dial(config *Config) (*conn, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "ldaps" {
+			host += ":636"
+		} else {
+			host += ":389"
+		}
+	}
+
+	nc, err := net.DialTimeout("tcp", host, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := config.TLS
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	c := &conn{timeout: config.Timeout}
+
+	if u.Scheme == "ldaps" {
+		c.setConn(tls.Client(nc, tlsConfig))
+		return c, nil
+	}
+
+	c.setConn(nc)
+
+	if config.StartTLS {
+		var res element
+		if res, err = c.roundTrip(encode(tagExtReq, encodeString(tagContext0, oidStartTLS)), tagExtResp); err == nil {
+			err = result(res)
+		}
+
+		if err != nil {
+			nc.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+
+		c.setConn(tls.Client(nc, tlsConfig))
+	}
+
+	return c, nil
+}
+
+func (c *conn) setConn(nc net.Conn) {
+	c.Conn = nc
+	c.r = bufio.NewReader(nc)
+}
+
+// bind authenticate connection as dn
+func (c *conn) bind(dn, password string) error {
+	res, err := c.roundTrip(encode(tagBindReq,
+		encodeInt(tagInteger, 3),
+		encodeString(tagOctets, dn),
+		encodeString(tagContext0, password),
+	), tagBindResp)
+	if err != nil {
+		return err
+	}
+
+	return result(res)
+}
+
+// attribute values of entry with given dn
+func (c *conn) attribute(dn, attr string) ([]string, error) {
+	c.id++
+	id := c.id
+
+	req := encode(tagSearchReq,
+		encodeString(tagOctets, dn),
+		encodeInt(tagEnum, 0), // base object
+		encodeInt(tagEnum, 0), // never deref aliases
+		encodeInt(tagInteger, 0),
+		encodeInt(tagInteger, int(c.timeout/time.Second)),
+		encode(tagBoolean, []byte{0}),
+		encodeString(tagPresent, "objectClass"),
+		encode(tagSequence, encodeString(tagOctets, attr)),
+	)
+
+	if err := c.write(id, req); err != nil {
+		return nil, err
+	}
+
+	var values []string
+
+	for {
+		op, err := c.readOp(id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.tag {
+		case tagSearchItem:
+			if len(op.children) < 2 {
+				return nil, errMalformed
+			}
+
+			for _, a := range op.children[1].children {
+				if len(a.children) < 2 || !strings.EqualFold(string(a.children[0].value), attr) {
+					continue
+				}
+
+				for _, v := range a.children[1].children {
+					values = append(values, string(v.value))
+				}
+			}
+		case tagSearchDone:
+			return values, result(op)
+		}
+	}
+}
+
+// unbind and close connection
+func (c *conn) close() {
+	c.id++
+	c.write(c.id, encode(tagUnbindReq)) // nolint: errcheck, gas
+	c.Close()                           // nolint: errcheck, gas
+}
+
+func (c *conn) roundTrip(op []byte, tag byte) (element, error) {
+	c.id++
+	id := c.id
+
+	if err := c.write(id, op); err != nil {
+		return element{}, err
+	}
+
+	res, err := c.readOp(id)
+	if err != nil {
+		return element{}, err
+	}
+
+	if res.tag != tag {
+		return element{}, errMalformed
+	}
+
+	return res, nil
+}
+
+func (c *conn) write(id int, op []byte) error {
+	if c.timeout > 0 {
+		c.SetDeadline(time.Now().Add(c.timeout)) // nolint: errcheck, gas
+	}
+
+	_, err := c.Write(encode(tagSequence, encodeInt(tagInteger, id), op))
+
+	return err
+}
+
+// readOp protocol operation of next message with given id
+func (c *conn) readOp(id int) (element, error) {
+	for {
+		msg, err := read(c.r)
+		if err != nil {
+			return element{}, err
+		}
+
+		if msg.tag != tagSequence || len(msg.children) < 2 {
+			return element{}, errMalformed
+		}
+
+		// unsolicited notifications have id 0
+		if msg.children[0].int() == id {
+			return msg.children[1], nil
+		}
+	}
+}
+
+// result of response operation
+func result(op element) error {
+	if len(op.children) < 3 {
+		return errMalformed
+	}
+
+	switch code := op.children[0].int(); code {
+	case resultSuccess:
+		return nil
+	case resultInvalidCredentials:
+		return ErrInvalidCredentials
+	default:
+		return fmt.Errorf("ldap: result code %d: %s", code, op.children[2].value)
+	}
+}
@@ -0,0 +1,264 @@
+// Package ldap authenticates clients by bind to LDAP directory or Active Directory
+// and grants access to topics by groups user is member of
+//
+//	p := ldap.New(ldap.Config{
+//		URL:      "ldap://ldap.example.com",
+//		StartTLS: true,
+//		UserDN:   "uid=%s,ou=devices,dc=example,dc=com",
+//		Groups: map[string]auth.Grant{
+//			"sensors": {Publish: []string{"sensors/%u/#"}},
+//		},
+//	})
+//	auth.RegisterAuth("ldap", p)
+package ldap
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/auth"
+	"go.uber.org/zap"
+)
+
+// Config of directory
+type Config struct {
+	// URL of server, ldap://host[:port] or ldaps://host[:port]
+	URL string
+
+	// StartTLS upgrade ldap:// connection to TLS before bind
+	StartTLS bool
+
+	// TLS config of ldaps:// and StartTLS. Server name defaults to host of URL
+	TLS *tls.Config
+
+	// UserDN template of user DN, %s is replaced by escaped username
+	// e.g. uid=%s,ou=people,dc=example,dc=com or %s@corp.example.com for Active Directory
+	UserDN string
+
+	// Timeout of dial and every operation. Default to 5 seconds
+	Timeout time.Duration
+
+	// PoolSize amount of idle connections kept for reuse. Default to 4
+	PoolSize int
+
+	// GroupAttribute attribute of user entry listing groups. Default to memberOf
+	GroupAttribute string
+
+	// Groups grants by group DN or its common name. Within topic filters %u is replaced by
+	// username and %c by client id without namespace of virtual host. Users of no listed group
+	// have no grant and next provider of the chain decides on access. Role of first matching
+	// group is role of client
+	Groups map[string]auth.Grant
+}
+
+// Provider of directory authentication
+type Provider struct {
+	config Config
+	pool   chan *conn
+	grants *auth.Grants
+	log    *zap.Logger
+}
+
+var _ auth.Auth = (*Provider)(nil)
+
+// New provider. Connections are established on demand
+func New(config Config) *Provider {
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	if config.PoolSize == 0 {
+		config.PoolSize = 4
+	}
+
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+
+	return &Provider{
+		config: config,
+		pool:   make(chan *conn, config.PoolSize),
+		grants: auth.NewGrants(),
+		log:    surgemq.GetProdLogger().Named("auth").Named("ldap"),
+	}
+}
+
+// Close idle connections
+func (p *Provider) Close() error {
+	for {
+		select {
+		case c := <-p.pool:
+			c.close()
+		default:
+			return nil
+		}
+	}
+}
+
+// CheckConnect bind as user and load groups
+func (p *Provider) CheckConnect(c auth.Client, password string) auth.Result {
+	p.grants.Set(c.ID, nil)
+
+	// empty password is unauthenticated bind which directory accepts for any DN
+	if c.User == "" || password == "" {
+		return auth.Ignore
+	}
+
+	dn := strings.Replace(p.config.UserDN, "%s", escape(c.User), -1)
+
+	conn, err := p.bind(dn, password)
+	if err == ErrInvalidCredentials {
+		return auth.Deny
+	} else if err != nil {
+		p.log.Error("Couldn't bind", zap.String("url", p.config.URL), zap.String("dn", dn), zap.Error(err))
+		return auth.Ignore
+	}
+
+	var groups []string
+	if len(p.config.Groups) > 0 {
+		if groups, err = conn.attribute(dn, p.config.GroupAttribute); err != nil {
+			conn.close()
+			p.log.Error("Couldn't read groups", zap.String("dn", dn), zap.Error(err))
+
+			// authenticated but groups unknown, deny rather than grant less or more than expected
+			return auth.Deny
+		}
+	}
+
+	p.put(conn)
+
+	if g := p.grant(c.ClientID(), c.User, groups); g != nil {
+		p.grants.Set(c.ID, g)
+	}
+
+	return auth.Allow
+}
+
+// Role of client from grants of its groups
+func (p *Provider) Role(c auth.Client) (string, bool) {
+	return p.grants.Role(c.ID)
+}
+
+// CheckPublish check topic against grants of user groups
+func (p *Provider) CheckPublish(c auth.Client, topic string) auth.Result {
+	return p.grants.CheckPublish(c.ID, topic)
+}
+
+// CheckSubscribe check filter against grants of user groups
+func (p *Provider) CheckSubscribe(c auth.Client, filter string) auth.Result {
+	return p.grants.CheckSubscribe(c.ID, filter)
+}
+
+// grant union of group grants, nil if user is member of none of configured groups
+func (p *Provider) grant(clientID, user string, groups []string) *auth.Grant {
+	var res *auth.Grant
+
+	replacer := strings.NewReplacer("%u", user, "%c", clientID)
+
+	for name, g := range p.config.Groups {
+		for _, dn := range groups {
+			if !strings.EqualFold(name, dn) && !strings.EqualFold(name, commonName(dn)) {
+				continue
+			}
+
+			if res == nil {
+				res = &auth.Grant{Publish: []string{}, Subscribe: []string{}}
+			}
+
+			if res.Role == "" {
+				res.Role = g.Role
+			}
+
+			for _, f := range g.Publish {
+				res.Publish = append(res.Publish, replacer.Replace(f))
+			}
+
+			for _, f := range g.Subscribe {
+				res.Subscribe = append(res.Subscribe, replacer.Replace(f))
+			}
+
+			break
+		}
+	}
+
+	return res
+}
+
+// bind connection as dn. Idle connection might have been closed by server thus
+// bind failed on pooled connection is retried on new one
+func (p *Provider) bind(dn, password string) (*conn, error) {
+	select {
+	case c := <-p.pool:
+		err := c.bind(dn, password)
+		if err == nil {
+			return c, nil
+		}
+
+		if err == ErrInvalidCredentials {
+			p.put(c)
+			return nil, err
+		}
+
+		c.close()
+	default:
+	}
+
+	c, err := dial(&p.config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.bind(dn, password); err != nil {
+		if err == ErrInvalidCredentials {
+			p.put(c)
+		} else {
+			c.close()
+		}
+
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (p *Provider) put(c *conn) {
+	select {
+	case p.pool <- c:
+	default:
+		c.close()
+	}
+}
+
+// commonName value of first RDN if it is cn
+func commonName(dn string) string {
+	rdn := dn
+	if i := strings.IndexByte(dn, ','); i >= 0 {
+		rdn = dn[:i]
+	}
+
+	if len(rdn) > 3 && strings.EqualFold(rdn[:3], "cn=") {
+		return rdn[3:]
+	}
+
+	return ""
+}
+
+// escape special characters of DN value [RFC 4514]
+func escape(s string) string {
+	var b strings.Builder
+
+	for i, c := range s {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, c),
+			(i == 0 && (c == ' ' || c == '#')),
+			(i == len(s)-1 && c == ' '):
+			b.WriteByte('\\')
+		}
+
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,323 @@
+package ldap
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/auth"
+)
+
+// directory fake server of bind and base object search
+type directory struct {
+	lock     sync.Mutex
+	users    map[string]string
+	groups   map[string][]string
+	binds    []string
+	response func(id int, op element) []byte
+}
+
+func response(id int, tag byte, code int, msg string) []byte {
+	return encode(tagSequence, encodeInt(tagInteger, id), encode(tag,
+		encodeInt(tagEnum, code),
+		encodeString(tagOctets, ""),
+		encodeString(tagOctets, msg),
+	))
+}
+
+func (d *directory) serve(c net.Conn) {
+	defer c.Close() // nolint: errcheck
+
+	r := bufio.NewReader(c)
+
+	for {
+		msg, err := read(r)
+		if err != nil || len(msg.children) < 2 {
+			return
+		}
+
+		id, op := msg.children[0].int(), msg.children[1]
+
+		d.lock.Lock()
+		custom := d.response
+		d.lock.Unlock()
+
+		if custom != nil {
+			c.Write(custom(id, op)) // nolint: errcheck, gas
+			continue
+		}
+
+		switch op.tag {
+		case tagBindReq:
+			dn, password := string(op.children[1].value), string(op.children[2].value)
+
+			d.lock.Lock()
+			d.binds = append(d.binds, dn)
+			pass, ok := d.users[dn]
+			d.lock.Unlock()
+
+			if ok && pass == password {
+				c.Write(response(id, tagBindResp, resultSuccess, "")) // nolint: errcheck, gas
+			} else {
+				c.Write(response(id, tagBindResp, resultInvalidCredentials, "invalid credentials")) // nolint: errcheck, gas
+			}
+		case tagSearchReq:
+			dn := string(op.children[0].value)
+
+			var values [][]byte
+			for _, g := range d.groups[dn] {
+				values = append(values, encodeString(tagOctets, g))
+			}
+
+			// notification of other id is skipped by client
+			c.Write(response(0, tagExtResp, 0, "")) // nolint: errcheck, gas
+
+			c.Write(encode(tagSequence, encodeInt(tagInteger, id), encode(tagSearchItem, // nolint: errcheck, gas
+				encodeString(tagOctets, dn),
+				encode(tagSequence,
+					encode(tagSequence, encodeString(tagOctets, "cn"), encode(tagSet, encodeString(tagOctets, "ignored"))),
+					encode(tagSequence, encodeString(tagOctets, "memberOf"), encode(tagSet, values...)),
+				),
+			)))
+			c.Write(response(id, tagSearchDone, resultSuccess, "")) // nolint: errcheck, gas
+		case tagUnbindReq:
+			return
+		}
+	}
+}
+
+// start directory listening on loopback
+func (d *directory) start(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() }) // nolint: errcheck
+
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+
+			go d.serve(c)
+		}
+	}()
+
+	return "ldap://" + l.Addr().String()
+}
+
+// pipe connection to directory
+func pipe(d *directory) *conn {
+	client, server := net.Pipe()
+	go d.serve(server)
+
+	c := &conn{timeout: time.Second}
+	c.setConn(client)
+
+	return c
+}
+
+func TestBind(t *testing.T) {
+	d := &directory{users: map[string]string{"uid=a": "secret"}}
+
+	c := pipe(d)
+	defer c.close()
+
+	require.NoError(t, c.bind("uid=a", "secret"))
+	require.Equal(t, ErrInvalidCredentials, c.bind("uid=a", "other"))
+	require.Equal(t, ErrInvalidCredentials, c.bind("uid=b", "secret"))
+
+	// connection stays usable after failed bind
+	require.NoError(t, c.bind("uid=a", "secret"))
+	require.Equal(t, []string{"uid=a", "uid=a", "uid=b", "uid=a"}, d.binds)
+}
+
+func TestBindFailure(t *testing.T) {
+	tests := map[string]func(id int, op element) []byte{
+		"result code": func(id int, op element) []byte {
+			return response(id, tagBindResp, 53, "unwilling to perform")
+		},
+		"unexpected operation": func(id int, op element) []byte {
+			return response(id, tagSearchDone, resultSuccess, "")
+		},
+		"short result": func(id int, op element) []byte {
+			return encode(tagSequence, encodeInt(tagInteger, id), encode(tagBindResp, encodeInt(tagEnum, 0)))
+		},
+		"not message": func(id int, op element) []byte {
+			return encodeInt(tagInteger, id)
+		},
+		"malformed": func(id int, op element) []byte {
+			return []byte{tagSequence, 4, tagInteger, 1, byte(id), tagBindResp}
+		},
+	}
+
+	for name, resp := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := pipe(&directory{response: resp})
+			defer c.close()
+
+			err := c.bind("uid=a", "secret")
+			require.Error(t, err)
+			require.NotEqual(t, ErrInvalidCredentials, err)
+		})
+	}
+
+	// no answer within timeout
+	client, server := net.Pipe()
+	defer server.Close() // nolint: errcheck
+
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			if _, err := read(r); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := &conn{timeout: 50 * time.Millisecond}
+	c.setConn(client)
+	defer c.close()
+
+	require.Error(t, c.bind("uid=a", "secret"))
+}
+
+func TestAttribute(t *testing.T) {
+	d := &directory{groups: map[string][]string{"uid=a": {"cn=one,dc=x", "cn=two,dc=x"}}}
+
+	c := pipe(d)
+	defer c.close()
+
+	values, err := c.attribute("uid=a", "memberof")
+	require.NoError(t, err)
+	require.Equal(t, []string{"cn=one,dc=x", "cn=two,dc=x"}, values)
+
+	values, err = c.attribute("uid=b", "memberOf")
+	require.NoError(t, err)
+	require.Empty(t, values)
+}
+
+func TestProvider(t *testing.T) {
+	d := &directory{
+		users: map[string]string{
+			"uid=dev1,ou=devices":  "secret",
+			"uid=a\\,b,ou=devices": "secret",
+			"uid=plain,ou=devices": "secret",
+		},
+		groups: map[string][]string{
+			"uid=dev1,ou=devices": {"cn=sensors,ou=groups", "cn=admins,ou=groups"},
+		},
+	}
+
+	p := New(Config{
+		URL:    d.start(t),
+		UserDN: "uid=%s,ou=devices",
+		Groups: map[string]auth.Grant{
+			"sensors":             {Publish: []string{"sensors/%u/#"}, Role: "sensor"},
+			"cn=admins,ou=groups": {Subscribe: []string{"sensors/#"}},
+			"cn=unused,ou=groups": {Publish: []string{"#"}},
+		},
+		PoolSize: 1,
+	})
+	defer p.Close() // nolint: errcheck
+
+	require.Equal(t, auth.Allow, p.CheckConnect(auth.Client{ID: "c1", User: "dev1"}, "secret"))
+	require.Equal(t, auth.Allow, p.CheckPublish(auth.Client{ID: "c1", User: "dev1"}, "sensors/dev1/temp"))
+	require.Equal(t, auth.Deny, p.CheckPublish(auth.Client{ID: "c1", User: "dev1"}, "sensors/dev2/temp"))
+	require.Equal(t, auth.Allow, p.CheckSubscribe(auth.Client{ID: "c1", User: "dev1"}, "sensors/+/temp"))
+
+	role, ok := p.Role(auth.Client{ID: "c1", User: "dev1"})
+	require.True(t, ok)
+	require.Equal(t, "sensor", role)
+
+	// pooled connection is reused by next bind
+	require.Equal(t, auth.Deny, p.CheckConnect(auth.Client{ID: "c1", User: "dev1"}, "other"))
+	require.Equal(t, auth.Ignore, p.CheckPublish(auth.Client{ID: "c1", User: "dev1"}, "sensors/dev1/temp"))
+
+	// special characters of username are escaped
+	require.Equal(t, auth.Allow, p.CheckConnect(auth.Client{ID: "c2", User: "a,b"}, "secret"))
+
+	// member of no configured group has no grant
+	require.Equal(t, auth.Allow, p.CheckConnect(auth.Client{ID: "c3", User: "plain"}, "secret"))
+	require.Equal(t, auth.Ignore, p.CheckPublish(auth.Client{ID: "c3", User: "plain"}, "a/b"))
+
+	// unauthenticated bind is not attempted
+	require.Equal(t, auth.Ignore, p.CheckConnect(auth.Client{ID: "c4", User: "dev1"}, ""))
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	require.Equal(t, []string{
+		"uid=dev1,ou=devices",
+		"uid=dev1,ou=devices",
+		"uid=a\\,b,ou=devices",
+		"uid=plain,ou=devices",
+	}, d.binds)
+}
+
+func TestProviderVirtualHost(t *testing.T) {
+	d := &directory{
+		users:  map[string]string{"uid=dev1": "secret"},
+		groups: map[string][]string{"uid=dev1": {"cn=devices,ou=groups"}},
+	}
+
+	p := New(Config{
+		URL:    d.start(t),
+		UserDN: "uid=%s",
+		Groups: map[string]auth.Grant{
+			"devices": {Publish: []string{"devices/%c/#"}, Subscribe: []string{"devices/%c/#"}},
+		},
+	})
+	defer p.Close() // nolint: errcheck
+
+	a := auth.Client{ID: "$vhost/a/dev1", Namespace: "$vhost/a/", User: "dev1"}
+	b := auth.Client{ID: "$vhost/b/dev1", Namespace: "$vhost/b/", User: "dev1"}
+
+	require.Equal(t, auth.Allow, p.CheckConnect(a, "secret"))
+
+	// %c is client id within namespace
+	require.Equal(t, auth.Allow, p.CheckPublish(a, "devices/dev1/temp"))
+	require.Equal(t, auth.Allow, p.CheckSubscribe(a, "devices/dev1/#"))
+	require.Equal(t, auth.Deny, p.CheckPublish(a, "other/dev1"))
+	require.Equal(t, auth.Deny, p.CheckSubscribe(a, "devices/#"))
+
+	// grant is kept by session id, the same client id in other virtual host is not granted
+	require.Equal(t, auth.Ignore, p.CheckPublish(b, "devices/dev1/temp"))
+	require.Equal(t, auth.Ignore, p.CheckPublish(auth.Client{ID: "dev1", User: "dev1"}, "devices/dev1/temp"))
+}
+
+func TestProviderUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	url := "ldap://" + l.Addr().String()
+	l.Close() // nolint: errcheck
+
+	p := New(Config{URL: url, UserDN: "uid=%s", Timeout: 100 * time.Millisecond})
+
+	// directory failure is left to next provider of the chain
+	require.Equal(t, auth.Ignore, p.CheckConnect(auth.Client{ID: "c", User: "dev1"}, "secret"))
+}
+
+func TestEscape(t *testing.T) {
+	tests := map[string]string{
+		"plain":  "plain",
+		"a,b":    "a\\,b",
+		"a+b=c":  "a\\+b\\=c",
+		`"q"`:    `\"q\"`,
+		"<a>;":   "\\<a\\>\\;",
+		`a\b`:    `a\\b`,
+		" a ":    "\\ a\\ ",
+		"#a#":    "\\#a#",
+		"cn=x,o": "cn\\=x\\,o",
+	}
+
+	for in, out := range tests {
+		require.Equal(t, out, escape(in), in)
+	}
+
+	require.Equal(t, "sensors", commonName("CN=sensors,ou=groups"))
+	require.Equal(t, "", commonName("ou=groups"))
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"strings"
+)
+
+// Covers check if every topic matched by filter is matched by pattern as well
+// Filter without wildcards is a topic thus Covers reports if pattern matches it
+// Used by providers granting access by topic filters
+func Covers(pattern, filter string) bool {
+	p := strings.Split(pattern, "/")
+	f := strings.Split(filter, "/")
+
+	for i, level := range p {
+		switch {
+		case level == "#":
+			// [MQTT-4.7.2-1] wildcard at root does not match topics starting with '$'
+			return i != 0 || !strings.HasPrefix(filter, "$")
+		case i >= len(f):
+			return false
+		case level == "+":
+			if f[i] == "#" || (i == 0 && strings.HasPrefix(f[i], "$")) {
+				return false
+			}
+		case level != f[i]:
+			return false
+		}
+	}
+
+	return len(p) == len(f)
+}
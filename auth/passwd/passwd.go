@@ -0,0 +1,385 @@
+// Package passwd authenticates clients by password file
+//
+// File holds one user per line in form of username:hash, lines starting with # are ignored
+// Hashes are either bcrypt ($2a$, $2b$, $2y$) or argon2id in PHC string format
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+//
+// Salted SHA-512 ($6$) and PBKDF2-SHA512 ($7$) hashes of mosquitto_passwd are verified as well
+// thus existing mosquitto password files are accepted as is
+//
+//	$6$<salt>$<sha512 of password and salt>
+//	$7$<iterations>$<salt>$<key>
+//
+// File is reloaded on SIGHUP and, if enabled, once changed on disk. Failed reload
+// keeps previous users. Entries are managed by examples/surgemq_passwd
+package passwd
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/auth"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Errors
+var (
+	ErrInvalidHash = errors.New("passwd: invalid hash")
+	ErrInvalidUser = errors.New("passwd: invalid username")
+)
+
+// Config of provider
+type Config struct {
+	// File path of password file
+	File string
+
+	// Watch reload file once changed on disk in addition to SIGHUP
+	Watch bool
+}
+
+// Provider of password file authentication
+type Provider struct {
+	config Config
+
+	lock  sync.RWMutex
+	users map[string]string
+
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	watcher *fsnotify.Watcher
+
+	log *zap.Logger
+}
+
+var _ auth.Auth = (*Provider)(nil)
+
+// New load password file and start watching for reloads
+func New(config Config) (*Provider, error) {
+	p := &Provider{
+		config: config,
+		quit:   make(chan struct{}),
+		log:    surgemq.GetProdLogger().Named("auth").Named("passwd"),
+	}
+
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	var events chan fsnotify.Event
+
+	if config.Watch {
+		var err error
+		if p.watcher, err = fsnotify.NewWatcher(); err != nil {
+			signal.Stop(sig)
+			return nil, err
+		}
+
+		// directory is watched as editors and atomic writes replace file
+		if err = p.watcher.Add(filepath.Dir(config.File)); err != nil {
+			signal.Stop(sig)
+			p.watcher.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+
+		events = p.watcher.Events
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer signal.Stop(sig)
+
+		for {
+			select {
+			case <-p.quit:
+				return
+			case <-sig:
+			case e, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+
+				if filepath.Clean(e.Name) != filepath.Clean(config.File) || e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+			}
+
+			if err := p.Reload(); err != nil {
+				p.log.Error("Couldn't reload password file", zap.String("file", config.File), zap.Error(err))
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+// Close stop watching for reloads
+func (p *Provider) Close() error {
+	close(p.quit)
+
+	if p.watcher != nil {
+		p.watcher.Close() // nolint: errcheck, gas
+	}
+
+	p.wg.Wait()
+
+	return nil
+}
+
+// Reload password file
+func (p *Provider) Reload() error {
+	users, err := Load(p.config.File)
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	p.users = users
+	p.lock.Unlock()
+
+	p.log.Info("Password file loaded", zap.String("file", p.config.File), zap.Int("users", len(users)))
+
+	return nil
+}
+
+// CheckConnect verify password of user. Unknown users are left to next provider of the chain
+func (p *Provider) CheckConnect(c auth.Client, password string) auth.Result {
+	p.lock.RLock()
+	hash, ok := p.users[c.User]
+	p.lock.RUnlock()
+
+	if !ok {
+		return auth.Ignore
+	}
+
+	if Verify(hash, password) != nil {
+		return auth.Deny
+	}
+
+	return auth.Allow
+}
+
+// CheckPublish password file does not control access
+func (p *Provider) CheckPublish(c auth.Client, topic string) auth.Result {
+	return auth.Ignore
+}
+
+// CheckSubscribe password file does not control access
+func (p *Provider) CheckSubscribe(c auth.Client, filter string) auth.Result {
+	return auth.Ignore
+}
+
+// Load users and hashes of password file
+func Load(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+
+	users := make(map[string]string)
+
+	line := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(text, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("passwd: invalid entry at line %d", line)
+		}
+
+		users[text[:i]] = text[i+1:]
+	}
+
+	return users, scanner.Err()
+}
+
+// Store users into password file replacing it atomically
+func Store(file string, users map[string]string) error {
+	tmp := file + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for user, hash := range users {
+		if strings.ContainsAny(user, ":\n") {
+			f.Close()      // nolint: errcheck, gas
+			os.Remove(tmp) // nolint: errcheck, gas
+			return ErrInvalidUser
+		}
+
+		fmt.Fprintf(w, "%s:%s\n", user, hash) // nolint: errcheck
+	}
+
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		os.Remove(tmp) // nolint: errcheck, gas
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// Argon2 parameters of generated hashes
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// HashBcrypt hash password with bcrypt of default cost
+func HashBcrypt(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(h), err
+}
+
+// HashArgon2 hash password with argon2id
+func HashArgon2(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify password against hash
+func Verify(hash, password string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2(hash, password)
+	case strings.HasPrefix(hash, "$6$"), strings.HasPrefix(hash, "$7$"):
+		return verifySHA512(hash, password)
+	}
+
+	return ErrInvalidHash
+}
+
+func verifyArgon2(hash, password string) error {
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return ErrInvalidHash
+	}
+
+	var memory, passes uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &passes, &threads); err != nil {
+		return ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return ErrInvalidHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return ErrInvalidHash
+	}
+
+	other := argon2.IDKey([]byte(password), salt, passes, memory, threads, uint32(len(key)))
+
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+
+	return nil
+}
+
+func verifySHA512(hash, password string) error {
+	// $6$salt$hash or $7$iterations$salt$hash
+	parts := strings.Split(hash, "$")
+
+	iterations := 0
+	if parts[1] == "7" {
+		if len(parts) != 5 {
+			return ErrInvalidHash
+		}
+
+		var err error
+		if iterations, err = strconv.Atoi(parts[2]); err != nil || iterations <= 0 {
+			return ErrInvalidHash
+		}
+
+		parts = append(parts[:2], parts[3:]...)
+	}
+
+	if len(parts) != 4 {
+		return ErrInvalidHash
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidHash
+	}
+
+	key, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) != sha512.Size {
+		return ErrInvalidHash
+	}
+
+	var other []byte
+	if iterations > 0 {
+		other = pbkdf2.Key([]byte(password), salt, iterations, sha512.Size, sha512.New)
+	} else {
+		sum := sha512.Sum512(append([]byte(password), salt...))
+		other = sum[:]
+	}
+
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package passwd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashes of "secret" with salt "0123456789ab" as written by mosquitto_passwd
+const (
+	sha512Hash = "$6$MDEyMzQ1Njc4OWFi$qEXipeLbgxRlwd06QHfY5WITkUZg0jLg9SZbXzq3ifXjfj+v3GbJGrSfC5PAg3UNCS+UFfbhUIZX4bmIAs330w=="
+	pbkdf2Hash = "$7$101$MDEyMzQ1Njc4OWFi$EO/lLlkeUgIiBaS8G8UK0ZMP1u508TA7Tl+AdJ1cEsmlbGyEPAERErpfq84j1kepISs0UzmcdL4ucgZ2uodxfQ=="
+)
+
+func TestVerify(t *testing.T) {
+	bc, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	argon, err := HashArgon2("secret")
+	require.NoError(t, err)
+
+	hashes := map[string]string{
+		"bcrypt 2a":     "$2a$" + string(bc[4:]),
+		"bcrypt 2b":     "$2b$" + string(bc[4:]),
+		"bcrypt 2y":     "$2y$" + string(bc[4:]),
+		"argon2id":      argon,
+		"sha512":        sha512Hash,
+		"pbkdf2-sha512": pbkdf2Hash,
+	}
+
+	for name, hash := range hashes {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, Verify(hash, "secret"))
+			require.Equal(t, bcrypt.ErrMismatchedHashAndPassword, Verify(hash, "other"))
+			require.Error(t, Verify(hash, ""))
+		})
+	}
+
+	h, err := HashBcrypt("secret")
+	require.NoError(t, err)
+	require.NoError(t, Verify(h, "secret"))
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	hashes := []string{
+		"",
+		"secret",
+		"$1$salt$hash",
+		"$argon2id$v=19$m=65536,t=3,p=4$salt",
+		"$argon2id$v=18$m=65536,t=3,p=4$c2FsdA$a2V5",
+		"$argon2id$v=19$m=x,t=3,p=4$c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=3,p=4$!$a2V5",
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$",
+		"$6$MDEyMzQ1Njc4OWFi",
+		"$6$!$" + strings.Split(sha512Hash, "$")[3],
+		"$6$MDEyMzQ1Njc4OWFi$c2hvcnQ=",
+		"$7$MDEyMzQ1Njc4OWFi$" + strings.Split(pbkdf2Hash, "$")[4],
+		"$7$0$MDEyMzQ1Njc4OWFi$" + strings.Split(pbkdf2Hash, "$")[4],
+		"$7$x$MDEyMzQ1Njc4OWFi$" + strings.Split(pbkdf2Hash, "$")[4],
+	}
+
+	for _, hash := range hashes {
+		require.Equal(t, ErrInvalidHash, Verify(hash, "secret"), hash)
+	}
+
+	// malformed bcrypt is reported by bcrypt
+	require.Error(t, Verify("$2a$10$short", "secret"))
+}
+
+func tempFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "passwd")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) }) // nolint: errcheck
+
+	file := filepath.Join(dir, "passwd")
+	require.NoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+
+	return file
+}
+
+func TestLoad(t *testing.T) {
+	users, err := Load(tempFile(t, "# comment\n\nalice:"+sha512Hash+"\n  bob:hash:with:colons  \n"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"alice": sha512Hash, "bob": "hash:with:colons"}, users)
+
+	for _, content := range []string{"alice", "alice:hash\nbob", ":hash"} {
+		_, err = Load(tempFile(t, content))
+		require.Error(t, err, content)
+	}
+
+	_, err = Load(filepath.Join(os.TempDir(), "passwd-missing"))
+	require.Error(t, err)
+}
+
+func TestStore(t *testing.T) {
+	file := tempFile(t, "")
+
+	users := map[string]string{"alice": sha512Hash, "bob": pbkdf2Hash}
+	require.NoError(t, Store(file, users))
+
+	loaded, err := Load(file)
+	require.NoError(t, err)
+	require.Equal(t, users, loaded)
+
+	require.Equal(t, ErrInvalidUser, Store(file, map[string]string{"a:b": sha512Hash}))
+
+	// failed store keeps file
+	loaded, err = Load(file)
+	require.NoError(t, err)
+	require.Equal(t, users, loaded)
+}
+
+func TestProvider(t *testing.T) {
+	file := tempFile(t, "alice:"+sha512Hash+"\nbob:"+pbkdf2Hash+"\n")
+
+	_, err := New(Config{File: tempFile(t, "broken")})
+	require.Error(t, err)
+
+	p, err := New(Config{File: file})
+	require.NoError(t, err)
+	defer p.Close() // nolint: errcheck
+
+	require.Equal(t, auth.Allow, p.CheckConnect(auth.Client{ID: "id", User: "alice"}, "secret"))
+	require.Equal(t, auth.Allow, p.CheckConnect(auth.Client{ID: "id", User: "bob"}, "secret"))
+	require.Equal(t, auth.Deny, p.CheckConnect(auth.Client{ID: "id", User: "alice"}, "other"))
+	require.Equal(t, auth.Ignore, p.CheckConnect(auth.Client{ID: "id", User: "carol"}, "secret"))
+	require.Equal(t, auth.Ignore, p.CheckPublish(auth.Client{ID: "id", User: "alice"}, "a/b"))
+	require.Equal(t, auth.Ignore, p.CheckSubscribe(auth.Client{ID: "id", User: "alice"}, "a/#"))
+
+	// malformed file keeps previous users
+	require.NoError(t, ioutil.WriteFile(file, []byte("alice"), 0600))
+	require.Error(t, p.Reload())
+	require.Equal(t, auth.Allow, p.CheckConnect(auth.Client{ID: "id", User: "alice"}, "secret"))
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("carol:"+sha512Hash), 0600))
+	require.NoError(t, p.Reload())
+	require.Equal(t, auth.Ignore, p.CheckConnect(auth.Client{ID: "id", User: "alice"}, "secret"))
+	require.Equal(t, auth.Allow, p.CheckConnect(auth.Client{ID: "id", User: "carol"}, "secret"))
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"strings"
+)
+
+// restricted confines clients to single grant
+type restricted struct {
+	grant Grant
+}
+
+// Restricted provider confining every client to topics of grant, e.g. anonymous clients
+// Within topic filters %c is replaced by client id without namespace. Access not listed is denied thus
+// nil Publish makes clients read-only. Role of grant is role of every client
+func Restricted(grant Grant) Auth {
+	return &restricted{grant: grant}
+}
+
+// CheckConnect restricted provider does not authenticate
+func (r *restricted) CheckConnect(c Client, password string) Result {
+	return Ignore
+}
+
+// CheckPublish check topic against publish filters of grant
+func (r *restricted) CheckPublish(c Client, topic string) Result {
+	return r.check(c.ClientID(), topic, r.grant.Publish)
+}
+
+// CheckSubscribe check filter against subscribe filters of grant
+func (r *restricted) CheckSubscribe(c Client, filter string) Result {
+	return r.check(c.ClientID(), filter, r.grant.Subscribe)
+}
+
+// Role of grant
+func (r *restricted) Role(c Client) (string, bool) {
+	return r.grant.Role, r.grant.Role != ""
+}
+
+func (r *restricted) check(clientID, topic string, patterns []string) Result {
+	for _, p := range patterns {
+		if strings.Contains(p, "%c") {
+			// client id with wildcards would widen filter
+			if clientID == "" || strings.ContainsAny(clientID, "+#/") {
+				continue
+			}
+
+			p = strings.Replace(p, "%c", clientID, -1)
+		}
+
+		if Covers(p, topic) {
+			return Allow
+		}
+	}
+
+	return Deny
+}
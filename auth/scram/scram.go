@@ -0,0 +1,373 @@
+// Package scram implements server side of SCRAM-SHA-256 challenge-response [RFC 5802, RFC 7677]
+// Password never crosses the wire and broker keeps only salted keys derived from it
+//
+//	creds, _ := scram.NewCredentials(password, scram.DefaultIterations)
+//	store[user] = creds.String()
+//
+//	srv := scram.NewServer(func(user string) (*scram.Credentials, error) {
+//		return scram.ParseCredentials(store[user])
+//	})
+//
+//	conv := srv.Conversation()
+//	serverFirst, err := conv.Step(clientFirst)
+//	serverFinal, err := conv.Step(clientFinal)
+//
+// Exchange is transport agnostic. It is meant to be carried by MQTT 5 AUTH packets, the broker
+// speaks MQTT 3.1.1 which has no AUTH packet thus clients cannot reach it yet. Channel binding
+// and SASLprep normalization of passwords are not supported
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Mechanism name of SASL mechanism
+const Mechanism = "SCRAM-SHA-256"
+
+// DefaultIterations of key derivation [RFC 7677] recommends at least 4096
+const DefaultIterations = 4096
+
+// Errors
+var (
+	ErrInvalidMessage     = errors.New("scram: invalid message")
+	ErrInvalidCredentials = errors.New("scram: invalid credentials")
+	ErrInvalidProof       = errors.New("scram: invalid proof")
+	ErrChannelBinding     = errors.New("scram: channel binding not supported")
+	ErrUnknownUser        = errors.New("scram: unknown user")
+	ErrConversationDone   = errors.New("scram: conversation finished")
+)
+
+// Credentials stored by server instead of password
+type Credentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewCredentials derive keys of password with random salt
+func NewCredentials(password string, iterations int) (*Credentials, error) {
+	if iterations <= 0 {
+		iterations = DefaultIterations
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return derive(password, salt, iterations), nil
+}
+
+func derive(password string, salt []byte, iterations int) *Credentials {
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := mac(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	return &Credentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  mac(salted, "Server Key"),
+	}
+}
+
+// String credentials in form of SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+// with base64 encoded values, the same as PostgreSQL stores them
+func (c *Credentials) String() string {
+	enc := base64.StdEncoding.EncodeToString
+
+	return Mechanism + "$" + strconv.Itoa(c.Iterations) + ":" + enc(c.Salt) + "$" + enc(c.StoredKey) + ":" + enc(c.ServerKey)
+}
+
+// ParseCredentials encoded by String
+func ParseCredentials(s string) (*Credentials, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 3 || parts[0] != Mechanism {
+		return nil, ErrInvalidCredentials
+	}
+
+	iter := strings.SplitN(parts[1], ":", 2)
+	keys := strings.SplitN(parts[2], ":", 2)
+	if len(iter) != 2 || len(keys) != 2 {
+		return nil, ErrInvalidCredentials
+	}
+
+	c := &Credentials{}
+
+	var err error
+	if c.Iterations, err = strconv.Atoi(iter[0]); err != nil || c.Iterations <= 0 {
+		return nil, ErrInvalidCredentials
+	}
+
+	dec := base64.StdEncoding.DecodeString
+
+	if c.Salt, err = dec(iter[1]); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	if c.StoredKey, err = dec(keys[0]); err != nil || len(c.StoredKey) != sha256.Size {
+		return nil, ErrInvalidCredentials
+	}
+
+	if c.ServerKey, err = dec(keys[1]); err != nil || len(c.ServerKey) != sha256.Size {
+		return nil, ErrInvalidCredentials
+	}
+
+	return c, nil
+}
+
+// Lookup credentials of user. Returns ErrUnknownUser if user does not exist
+type Lookup func(user string) (*Credentials, error)
+
+// Config of server
+type Config struct {
+	// Lookup of user credentials
+	Lookup Lookup
+
+	// Nonce returns server part of nonce appended to client one. Defaults to 18 random bytes
+	// encoded in base64
+	Nonce func() (string, error)
+}
+
+// Server verifying clients by stored credentials
+type Server struct {
+	lookup Lookup
+	nonce  func() (string, error)
+
+	// secret of fake salts given to unknown users thus they cannot be told from known ones
+	secret []byte
+}
+
+// NewServer of credentials returned by config lookup
+func NewServer(config Config) *Server {
+	secret := make([]byte, 32)
+	rand.Read(secret) // nolint: errcheck, gas
+
+	s := &Server{
+		lookup: config.Lookup,
+		nonce:  config.Nonce,
+		secret: secret,
+	}
+
+	if s.nonce == nil {
+		s.nonce = randomNonce
+	}
+
+	return s
+}
+
+// Conversation start exchange with single client
+func (s *Server) Conversation() *Conversation {
+	return &Conversation{server: s}
+}
+
+// Conversation state of single exchange
+type Conversation struct {
+	server *Server
+
+	step  int
+	user  string
+	creds *Credentials
+	known bool
+	nonce string
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+
+	valid bool
+}
+
+// Step process client message and return server response
+// First step takes client-first-message, second one client-final-message
+func (c *Conversation) Step(msg []byte) ([]byte, error) {
+	c.step++
+
+	switch c.step {
+	case 1:
+		return c.first(string(msg))
+	case 2:
+		return c.final(string(msg))
+	default:
+		return nil, ErrConversationDone
+	}
+}
+
+// Valid check if client proved its password
+func (c *Conversation) Valid() bool {
+	return c.valid
+}
+
+// User authenticated by conversation
+func (c *Conversation) User() string {
+	return c.user
+}
+
+func (c *Conversation) first(msg string) ([]byte, error) {
+	// gs2-header: channel binding flag, optional authzid
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, ErrInvalidMessage
+	}
+
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return nil, ErrChannelBinding
+	default:
+		return nil, ErrInvalidMessage
+	}
+
+	c.gs2Header = parts[0] + "," + parts[1] + ","
+	c.clientFirstBare = parts[2]
+
+	attrs := attributes(c.clientFirstBare)
+
+	user, ok := unescape(attrs["n"])
+	if !ok || user == "" || attrs["r"] == "" {
+		return nil, ErrInvalidMessage
+	}
+
+	c.user = user
+
+	creds, err := c.server.lookup(user)
+	switch {
+	case err == nil && creds != nil:
+		c.creds = creds
+		c.known = true
+	case err == ErrUnknownUser || (err == nil && creds == nil):
+		// continue with fake salt, conversation fails at final step
+		c.creds = &Credentials{
+			Salt:       mac(c.server.secret, user)[:16],
+			Iterations: DefaultIterations,
+		}
+	default:
+		return nil, err
+	}
+
+	nonce, err := c.server.nonce()
+	if err != nil {
+		return nil, err
+	}
+
+	c.nonce = attrs["r"] + nonce
+
+	c.serverFirst = "r=" + c.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(c.creds.Salt) +
+		",i=" + strconv.Itoa(c.creds.Iterations)
+
+	return []byte(c.serverFirst), nil
+}
+
+func (c *Conversation) final(msg string) ([]byte, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, ErrInvalidMessage
+	}
+
+	withoutProof := msg[:i]
+
+	attrs := attributes(withoutProof)
+	// channel binding attribute repeats gs2-header as no binding data is supported
+	if attrs["r"] != c.nonce || attrs["c"] != base64.StdEncoding.EncodeToString([]byte(c.gs2Header)) {
+		return nil, ErrInvalidMessage
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, ErrInvalidMessage
+	}
+
+	if !c.known {
+		return nil, ErrInvalidProof
+	}
+
+	authMessage := c.clientFirstBare + "," + c.serverFirst + "," + withoutProof
+
+	// ClientKey = ClientProof XOR HMAC(StoredKey, AuthMessage)
+	clientKey := mac(c.creds.StoredKey, authMessage)
+	for j := range clientKey {
+		clientKey[j] ^= proof[j]
+	}
+
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], c.creds.StoredKey) != 1 {
+		return nil, ErrInvalidProof
+	}
+
+	c.valid = true
+
+	return []byte("v=" + base64.StdEncoding.EncodeToString(mac(c.creds.ServerKey, authMessage))), nil
+}
+
+func randomNonce() (string, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+func mac(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg)) // nolint: errcheck, gas
+
+	return h.Sum(nil)
+}
+
+// attributes of message in form of k=v,k=v. Later duplicates are ignored
+func attributes(msg string) map[string]string {
+	res := make(map[string]string)
+
+	for _, a := range strings.Split(msg, ",") {
+		if len(a) < 2 || a[1] != '=' {
+			continue
+		}
+
+		if _, ok := res[a[:1]]; !ok {
+			res[a[:1]] = a[2:]
+		}
+	}
+
+	return res
+}
+
+// unescape saslname, ',' and '=' are sent as =2C and =3D
+func unescape(s string) (string, bool) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		if i+3 > len(s) {
+			return "", false
+		}
+
+		switch s[i+1 : i+3] {
+		case "2C":
+			b.WriteByte(',')
+		case "3D":
+			b.WriteByte('=')
+		default:
+			return "", false
+		}
+
+		i += 2
+	}
+
+	return b.String(), true
+}
@@ -0,0 +1,257 @@
+package scram
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// exchange of [RFC 7677] section 3, user "user" with password "pencil"
+const (
+	vectorClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	vectorServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	vectorClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	vectorServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+// fixedNonce make server use given nonce
+func fixedNonce(nonce string) func() (string, error) {
+	return func() (string, error) { return nonce, nil }
+}
+
+func vectorServer(t *testing.T) *Server {
+	salt, err := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	require.NoError(t, err)
+
+	creds := derive("pencil", salt, 4096)
+
+	return NewServer(Config{
+		Lookup: func(user string) (*Credentials, error) {
+			if user != "user" {
+				return nil, ErrUnknownUser
+			}
+
+			return creds, nil
+		},
+		Nonce: fixedNonce("%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"),
+	})
+}
+
+func TestVector(t *testing.T) {
+	conv := vectorServer(t).Conversation()
+
+	msg, err := conv.Step([]byte(vectorClientFirst))
+	require.NoError(t, err)
+	require.Equal(t, vectorServerFirst, string(msg))
+	require.Equal(t, "user", conv.User())
+	require.False(t, conv.Valid())
+
+	msg, err = conv.Step([]byte(vectorClientFinal))
+	require.NoError(t, err)
+	require.Equal(t, vectorServerFinal, string(msg))
+	require.True(t, conv.Valid())
+
+	_, err = conv.Step([]byte(vectorClientFinal))
+	require.Equal(t, ErrConversationDone, err)
+}
+
+func TestVectorFailures(t *testing.T) {
+	nonce := "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+
+	proof, err := base64.StdEncoding.DecodeString("dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	require.NoError(t, err)
+	proof[0] ^= 1
+	badProof := base64.StdEncoding.EncodeToString(proof)
+
+	tests := []struct {
+		name  string
+		first string
+		final string
+		err   error
+	}{
+		{"bad proof", vectorClientFirst, "c=biws,r=" + nonce + ",p=" + badProof, ErrInvalidProof},
+		{"short proof", vectorClientFirst, "c=biws,r=" + nonce + ",p=c2hvcnQ=", ErrInvalidMessage},
+		{"proof not base64", vectorClientFirst, "c=biws,r=" + nonce + ",p=!", ErrInvalidMessage},
+		{"no proof", vectorClientFirst, "c=biws,r=" + nonce, ErrInvalidMessage},
+		{"nonce mismatch", vectorClientFirst, strings.Replace(vectorClientFinal, "k0", "k1", 1), ErrInvalidMessage},
+		{"client nonce only", vectorClientFirst, "c=biws,r=rOprNGfwEbeRWgbNEkqO,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", ErrInvalidMessage},
+		{"channel binding mismatch", vectorClientFirst, strings.Replace(vectorClientFinal, "c=biws", "c=eSws", 1), ErrInvalidMessage},
+		{"authzid changes gs2 header", "n,a=user,n=user,r=rOprNGfwEbeRWgbNEkqO", vectorClientFinal, ErrInvalidMessage},
+		{"unknown user", "n,,n=other,r=rOprNGfwEbeRWgbNEkqO", vectorClientFinal, ErrInvalidProof},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conv := vectorServer(t).Conversation()
+
+			_, err := conv.Step([]byte(tt.first))
+			require.NoError(t, err)
+
+			_, err = conv.Step([]byte(tt.final))
+			require.Equal(t, tt.err, err)
+			require.False(t, conv.Valid())
+		})
+	}
+}
+
+func TestClientFirst(t *testing.T) {
+	tests := []struct {
+		msg string
+		err error
+	}{
+		{"", ErrInvalidMessage},
+		{"n,,", ErrInvalidMessage},
+		{"x,,n=user,r=abc", ErrInvalidMessage},
+		{"p=tls-unique,,n=user,r=abc", ErrChannelBinding},
+		{"n,,r=abc", ErrInvalidMessage},
+		{"n,,n=user", ErrInvalidMessage},
+		{"n,,n=,r=abc", ErrInvalidMessage},
+		{"n,,n=us=er,r=abc", ErrInvalidMessage},
+		{"n,,n=us=2", ErrInvalidMessage},
+	}
+
+	for _, tt := range tests {
+		_, err := vectorServer(t).Conversation().Step([]byte(tt.msg))
+		require.Equal(t, tt.err, err, tt.msg)
+	}
+
+	// lookup failure other than unknown user is returned
+	failure := errors.New("store unavailable")
+	srv := NewServer(Config{Lookup: func(user string) (*Credentials, error) { return nil, failure }})
+
+	_, err := srv.Conversation().Step([]byte(vectorClientFirst))
+	require.Equal(t, failure, err)
+}
+
+func TestUnknownUser(t *testing.T) {
+	srv := vectorServer(t)
+
+	// fake salt of unknown user is stable thus not distinguishable from real one
+	first, err := srv.Conversation().Step([]byte("n,,n=other,r=abc"))
+	require.NoError(t, err)
+
+	again, err := srv.Conversation().Step([]byte("n,,n=other,r=abc"))
+	require.NoError(t, err)
+	require.Equal(t, string(first), string(again))
+	require.Contains(t, string(first), ",i=4096")
+
+	conv := NewServer(Config{
+		Lookup: func(user string) (*Credentials, error) { return nil, nil },
+		Nonce:  fixedNonce("srv"),
+	}).Conversation()
+	_, err = conv.Step([]byte("n,,n=other,r=abc"))
+	require.NoError(t, err)
+
+	_, err = conv.Step([]byte("c=biws,r=abcsrv,p=" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))))
+	require.Equal(t, ErrInvalidProof, err)
+}
+
+// client side of exchange
+func client(t *testing.T, srv *Server, user, password string) (*Conversation, error) {
+	conv := srv.Conversation()
+
+	bare := "n=" + strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user) + ",r=client"
+
+	msg, err := conv.Step([]byte("n,," + bare))
+	if err != nil {
+		return conv, err
+	}
+
+	serverFirst := string(msg)
+	attrs := attributes(serverFirst)
+
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	require.NoError(t, err)
+
+	var iterations int
+	for _, c := range attrs["i"] {
+		iterations = iterations*10 + int(c-'0')
+	}
+
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := mac(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := bare + "," + serverFirst + "," + withoutProof
+
+	proof := mac(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	msg, err = conv.Step([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return conv, err
+	}
+
+	require.Equal(t, "v="+base64.StdEncoding.EncodeToString(mac(mac(salted, "Server Key"), authMessage)), string(msg))
+
+	return conv, nil
+}
+
+func TestExchange(t *testing.T) {
+	creds, err := NewCredentials("secret", 0)
+	require.NoError(t, err)
+	require.Equal(t, DefaultIterations, creds.Iterations)
+
+	stored := creds.String()
+	require.True(t, strings.HasPrefix(stored, "SCRAM-SHA-256$4096:"))
+
+	srv := NewServer(Config{
+		Lookup: func(user string) (*Credentials, error) {
+			if user != "a,b=c" {
+				return nil, ErrUnknownUser
+			}
+
+			return ParseCredentials(stored)
+		},
+	})
+
+	conv, err := client(t, srv, "a,b=c", "secret")
+	require.NoError(t, err)
+	require.True(t, conv.Valid())
+	require.Equal(t, "a,b=c", conv.User())
+
+	conv, err = client(t, srv, "a,b=c", "other")
+	require.Equal(t, ErrInvalidProof, err)
+	require.False(t, conv.Valid())
+
+	_, err = client(t, srv, "other", "secret")
+	require.Equal(t, ErrInvalidProof, err)
+}
+
+func TestParseCredentials(t *testing.T) {
+	creds, err := NewCredentials("secret", 10)
+	require.NoError(t, err)
+
+	parsed, err := ParseCredentials(creds.String())
+	require.NoError(t, err)
+	require.Equal(t, creds, parsed)
+
+	key := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	salt := base64.StdEncoding.EncodeToString([]byte("salt"))
+
+	invalid := []string{
+		"",
+		"SCRAM-SHA-1$4096:" + salt + "$" + key + ":" + key,
+		"SCRAM-SHA-256$4096:" + salt + "$" + key,
+		"SCRAM-SHA-256$4096$" + key + ":" + key,
+		"SCRAM-SHA-256$0:" + salt + "$" + key + ":" + key,
+		"SCRAM-SHA-256$-1:" + salt + "$" + key + ":" + key,
+		"SCRAM-SHA-256$x:" + salt + "$" + key + ":" + key,
+		"SCRAM-SHA-256$4096:!$" + key + ":" + key,
+		"SCRAM-SHA-256$4096:" + salt + "$c2hvcnQ=:" + key,
+		"SCRAM-SHA-256$4096:" + salt + "$" + key + ":!",
+	}
+
+	for _, s := range invalid {
+		_, err = ParseCredentials(s)
+		require.Equal(t, ErrInvalidCredentials, err, s)
+	}
+}
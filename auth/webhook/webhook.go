@@ -0,0 +1,255 @@
+// Package webhook delegates authentication and access checks to HTTP endpoints
+//
+// Every check is POSTed as JSON
+//
+//	{"clientid": "dev1", "username": "user", "password": "secret", "topic": "a/b", "access": "publish"}
+//
+// Endpoint answers with status code
+//
+//	200       allow
+//	401, 403  deny
+//	404       no opinion, next provider of the chain is asked
+//
+// Any other status, transport error or timeout is resolved by failure policy
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/auth"
+	"go.uber.org/zap"
+)
+
+// Config of endpoints
+type Config struct {
+	// ConnectURL, PublishURL and SubscribeURL endpoints of checks
+	// Check with empty URL is not performed and next provider of the chain is asked
+	ConnectURL   string
+	PublishURL   string
+	SubscribeURL string
+
+	// Headers added to every request, e.g. Authorization
+	Headers map[string]string
+
+	// Timeout of single request. Default to 5 seconds
+	Timeout time.Duration
+
+	// CacheTTL how long answers are reused for. 0 disables cache
+	// Failures are never cached
+	CacheTTL time.Duration
+
+	// CacheSize maximum amount of cached answers. Default to 10000
+	CacheSize int
+
+	// FailOpen allow if endpoint fails to answer, deny otherwise
+	FailOpen bool
+
+	// Client used for requests. Default to http.DefaultClient
+	Client *http.Client
+}
+
+type request struct {
+	ClientID string `json:"clientid"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Access   string `json:"access"`
+}
+
+type cached struct {
+	result  auth.Result
+	expires time.Time
+}
+
+// Provider of webhook checks
+type Provider struct {
+	config Config
+
+	lock  sync.Mutex
+	cache map[string]cached
+
+	log *zap.Logger
+}
+
+var _ auth.Auth = (*Provider)(nil)
+
+// New provider
+func New(config Config) *Provider {
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	if config.CacheSize == 0 {
+		config.CacheSize = 10000
+	}
+
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+
+	return &Provider{
+		config: config,
+		cache:  make(map[string]cached),
+		log:    surgemq.GetProdLogger().Named("auth").Named("webhook"),
+	}
+}
+
+// CheckConnect POST credentials to ConnectURL
+func (p *Provider) CheckConnect(c auth.Client, password string) auth.Result {
+	return p.check(p.config.ConnectURL, &request{
+		ClientID: c.ID,
+		Username: c.User,
+		Password: password,
+		Access:   "connect",
+	})
+}
+
+// CheckPublish POST topic to PublishURL
+func (p *Provider) CheckPublish(c auth.Client, topic string) auth.Result {
+	return p.check(p.config.PublishURL, &request{
+		ClientID: c.ID,
+		Username: c.User,
+		Topic:    topic,
+		Access:   "publish",
+	})
+}
+
+// CheckSubscribe POST filter to SubscribeURL
+func (p *Provider) CheckSubscribe(c auth.Client, filter string) auth.Result {
+	return p.check(p.config.SubscribeURL, &request{
+		ClientID: c.ID,
+		Username: c.User,
+		Topic:    filter,
+		Access:   "subscribe",
+	})
+}
+
+func (p *Provider) check(url string, req *request) auth.Result {
+	if url == "" {
+		return auth.Ignore
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return p.failure(err)
+	}
+
+	// key is digest of request thus passwords are not kept in memory
+	sum := sha256.Sum256(body)
+	key := string(sum[:])
+
+	if res, ok := p.cached(key); ok {
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+
+	r, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return p.failure(err)
+	}
+
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range p.config.Headers {
+		r.Header.Set(k, v)
+	}
+
+	resp, err := p.config.Client.Do(r.WithContext(ctx))
+	if err != nil {
+		return p.failure(err)
+	}
+	resp.Body.Close() // nolint: errcheck, gas
+
+	var res auth.Result
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		res = auth.Allow
+	case http.StatusUnauthorized, http.StatusForbidden:
+		res = auth.Deny
+	case http.StatusNotFound:
+		res = auth.Ignore
+	default:
+		return p.failure(nil, zap.Int("status", resp.StatusCode))
+	}
+
+	p.store(key, res)
+
+	return res
+}
+
+func (p *Provider) failure(err error, fields ...zap.Field) auth.Result {
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+
+	p.log.Warn("Webhook check failed", append(fields, zap.Bool("fail open", p.config.FailOpen))...)
+
+	if p.config.FailOpen {
+		return auth.Allow
+	}
+
+	return auth.Deny
+}
+
+func (p *Provider) cached(key string) (auth.Result, bool) {
+	if p.config.CacheTTL <= 0 {
+		return auth.Ignore, false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	e, ok := p.cache[key]
+	if !ok {
+		return auth.Ignore, false
+	}
+
+	if time.Now().After(e.expires) {
+		delete(p.cache, key)
+		return auth.Ignore, false
+	}
+
+	return e.result, true
+}
+
+func (p *Provider) store(key string, res auth.Result) {
+	if p.config.CacheTTL <= 0 {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+
+	if len(p.cache) >= p.config.CacheSize {
+		for k, e := range p.cache {
+			if now.After(e.expires) {
+				delete(p.cache, k)
+			}
+		}
+
+		// still full, make room by dropping arbitrary entries
+		for k := range p.cache {
+			if len(p.cache) < p.config.CacheSize {
+				break
+			}
+
+			delete(p.cache, k)
+		}
+	}
+
+	p.cache[key] = cached{
+		result:  res,
+		expires: now.Add(p.config.CacheTTL),
+	}
+}
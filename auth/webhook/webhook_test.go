@@ -0,0 +1,159 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/auth"
+)
+
+type endpoint struct {
+	calls int32
+	last  atomic.Value
+}
+
+// ServeHTTP answers with status given by username of request, e.g. "200", "403"
+// Username "slow" is answered after a second
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&e.calls, 1)
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req.Password = r.Header.Get("Authorization") + ":" + req.Password
+	e.last.Store(req)
+
+	switch req.Username {
+	case "allow":
+		w.WriteHeader(http.StatusOK)
+	case "unauthorized":
+		w.WriteHeader(http.StatusUnauthorized)
+	case "forbidden":
+		w.WriteHeader(http.StatusForbidden)
+	case "unknown":
+		w.WriteHeader(http.StatusNotFound)
+	case "slow":
+		time.Sleep(time.Second)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (e *endpoint) count() int {
+	return int(atomic.LoadInt32(&e.calls))
+}
+
+func newProvider(t *testing.T, config Config) (*Provider, *endpoint) {
+	e := &endpoint{}
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	config.ConnectURL = srv.URL + "/connect"
+	config.PublishURL = srv.URL + "/publish"
+	config.SubscribeURL = srv.URL + "/subscribe"
+	config.Timeout = 100 * time.Millisecond
+
+	return New(config), e
+}
+
+func TestStatus(t *testing.T) {
+	for _, failOpen := range []bool{false, true} {
+		failure := auth.Deny
+		if failOpen {
+			failure = auth.Allow
+		}
+
+		p, _ := newProvider(t, Config{FailOpen: failOpen})
+
+		tests := []struct {
+			user string
+			res  auth.Result
+		}{
+			{"allow", auth.Allow},
+			{"unauthorized", auth.Deny},
+			{"forbidden", auth.Deny},
+			{"unknown", auth.Ignore},
+			{"error", failure},
+			{"slow", failure},
+		}
+
+		for _, tt := range tests {
+			require.Equal(t, tt.res, p.CheckConnect(auth.Client{ID: "id", User: tt.user}, "pass"), "fail open %v, user %s", failOpen, tt.user)
+			require.Equal(t, tt.res, p.CheckPublish(auth.Client{ID: "id", User: tt.user}, "a/b"), "fail open %v, user %s", failOpen, tt.user)
+			require.Equal(t, tt.res, p.CheckSubscribe(auth.Client{ID: "id", User: tt.user}, "a/#"), "fail open %v, user %s", failOpen, tt.user)
+		}
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	closed := New(Config{PublishURL: url})
+	require.Equal(t, auth.Deny, closed.CheckPublish(auth.Client{ID: "id", User: "allow"}, "a/b"))
+
+	open := New(Config{PublishURL: url, FailOpen: true})
+	require.Equal(t, auth.Allow, open.CheckPublish(auth.Client{ID: "id", User: "allow"}, "a/b"))
+
+	// check without endpoint is not performed
+	require.Equal(t, auth.Ignore, open.CheckConnect(auth.Client{ID: "id", User: "allow"}, "pass"))
+}
+
+func TestRequest(t *testing.T) {
+	p, e := newProvider(t, Config{Headers: map[string]string{"Authorization": "Bearer token"}})
+
+	require.Equal(t, auth.Allow, p.CheckConnect(auth.Client{ID: "id", User: "allow"}, "pass"))
+	require.Equal(t, request{
+		ClientID: "id",
+		Username: "allow",
+		Password: "Bearer token:pass",
+		Access:   "connect",
+	}, e.last.Load())
+
+	require.Equal(t, auth.Allow, p.CheckSubscribe(auth.Client{ID: "id", User: "allow"}, "a/#"))
+	require.Equal(t, request{
+		ClientID: "id",
+		Username: "allow",
+		Password: "Bearer token:",
+		Topic:    "a/#",
+		Access:   "subscribe",
+	}, e.last.Load())
+}
+
+func TestCache(t *testing.T) {
+	p, e := newProvider(t, Config{CacheTTL: 100 * time.Millisecond, CacheSize: 2})
+
+	require.Equal(t, auth.Allow, p.CheckPublish(auth.Client{ID: "id", User: "allow"}, "a/b"))
+	require.Equal(t, auth.Allow, p.CheckPublish(auth.Client{ID: "id", User: "allow"}, "a/b"))
+	require.Equal(t, 1, e.count())
+
+	// failures are not cached
+	require.Equal(t, auth.Deny, p.CheckPublish(auth.Client{ID: "id", User: "error"}, "a/b"))
+	require.Equal(t, auth.Deny, p.CheckPublish(auth.Client{ID: "id", User: "error"}, "a/b"))
+	require.Equal(t, 3, e.count())
+
+	// denials are
+	require.Equal(t, auth.Deny, p.CheckPublish(auth.Client{ID: "id", User: "forbidden"}, "a/b"))
+	require.Equal(t, auth.Deny, p.CheckPublish(auth.Client{ID: "id", User: "forbidden"}, "a/b"))
+	require.Equal(t, 4, e.count())
+
+	// full cache makes room for new answers
+	require.Equal(t, auth.Ignore, p.CheckPublish(auth.Client{ID: "id", User: "unknown"}, "a/b"))
+	require.Equal(t, 5, e.count())
+	require.Len(t, p.cache, 2)
+
+	time.Sleep(150 * time.Millisecond)
+
+	require.Equal(t, auth.Ignore, p.CheckPublish(auth.Client{ID: "id", User: "unknown"}, "a/b"))
+	require.Equal(t, 6, e.count())
+}
@@ -0,0 +1,559 @@
+// Package bridge connects broker to remote MQTT brokers and forwards messages of configured
+// topics in either direction, e.g. to federate with cloud brokers. Topic prefixes are remapped
+// between brokers, QoS is capped per rule and messages are never forwarded back to broker
+// they came from. Connection is redialled until bridge is closed
+package bridge
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/message"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	"github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+// Direction messages are forwarded in
+type Direction int
+
+// Directions of rules
+const (
+	// Out forwards local messages to remote broker
+	Out Direction = iota
+
+	// In forwards messages of remote broker to local subscribers
+	In
+
+	// Both forwards messages in both directions
+	Both
+)
+
+const (
+	defaultKeepAlive         = 60 * time.Second
+	defaultReconnectInterval = 30 * time.Second
+	defaultBuffer            = 4096
+	defaultEchoWindow        = 10 * time.Second
+
+	connectTimeout    = 10 * time.Second
+	disconnectQuiesce = 250
+)
+
+var (
+	// ErrNoAddress bridge configured without remote broker address
+	ErrNoAddress = errors.New("bridge: remote address required")
+
+	// ErrNoRules bridge configured without rules
+	ErrNoRules = errors.New("bridge: no rules")
+)
+
+// Rule of forwarding. Topic of message is Filter match with LocalPrefix on local broker and
+// with RemotePrefix on remote one, e.g. filter "sensors/#" with local prefix "site1/" and
+// remote prefix "fleet/site1/" maps local "site1/sensors/t" to remote "fleet/site1/sensors/t"
+type Rule struct {
+	// Filter of topics without prefix
+	Filter string
+
+	Direction Direction
+
+	LocalPrefix  string
+	RemotePrefix string
+
+	// QoS highest QoS messages are forwarded with. nil keeps QoS of message
+	QoS *message.QosType
+}
+
+// Config of bridge
+type Config struct {
+	// Name of bridge in logs and status. If not set then default to Address
+	Name string
+
+	// Address of remote broker, e.g. tcp://host:1883, ssl://host:8883 or ws://host/mqtt
+	Address string
+
+	// ClientID bridge connects to remote broker with. If not set then default to Name
+	ClientID string
+	Username string
+	Password string
+
+	// TLS of connection to remote broker. Optional
+	TLS *tls.Config
+
+	// CleanSession start clean session on remote broker, otherwise messages for bridge
+	// are queued by remote broker while bridge is disconnected
+	CleanSession bool
+
+	// KeepAlive of connection. If not set then default to 60s
+	KeepAlive time.Duration
+
+	// MaxReconnectInterval longest pause between reconnect attempts, pause doubles from 1s
+	// If not set then default to 30s
+	MaxReconnectInterval time.Duration
+
+	// Buffer amount of local messages waiting for delivery to remote broker, further ones
+	// are dropped. If not set then default to 4096
+	Buffer int
+
+	// EchoWindow messages of remote broker equal to one forwarded to it within window are
+	// taken for echo and not forwarded back. If not set then default to 10s
+	EchoWindow time.Duration
+
+	// SyncRetained retained messages of remote broker on topics of In rules are retained
+	// locally as well, thus local subscribers see upstream state immediately. Remote broker
+	// sends them on every subscribe of bridge, i.e. on connect. Further messages of
+	// synchronized topics update local copies as remote broker forwards updates of retained
+	// messages as regular ones, empty message removes local copy
+	SyncRetained bool
+
+	// RetainedSyncInterval remote filters are resubscribed with while connected, thus remote
+	// broker resends retained messages and local copies are refreshed. Requires SyncRetained
+	// 0 synchronizes on connect only
+	RetainedSyncInterval time.Duration
+
+	Rules []Rule
+}
+
+// Status of bridge
+type Status struct {
+	Name      string
+	Address   string
+	Connected bool
+
+	// Out messages forwarded to remote broker
+	Out uint64
+
+	// In messages forwarded from remote broker
+	In uint64
+
+	// Dropped messages not forwarded as queue was full or remote broker refused them
+	Dropped uint64
+
+	// Retained topics retained messages of remote broker are synchronized for
+	Retained int
+}
+
+// Bridge to remote broker
+type Bridge struct {
+	config Config
+	topics topicsTypes.Provider
+	client mqtt.Client
+
+	subscriber types.Subscriber
+	queue      chan *message.PublishMessage
+
+	// injected messages of remote broker being published locally, not forwarded back
+	injected sync.Map
+
+	echo *echoFilter
+
+	// synced local topics of retained messages synchronized from remote broker
+	synced struct {
+		lock   sync.Mutex
+		topics map[string]struct{}
+	}
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	// stat counters, updated atomically
+	out     uint64
+	in      uint64
+	dropped uint64
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+}
+
+// New start bridge publishing and subscribing locally through topics provider
+func New(config Config, topics topicsTypes.Provider) (*Bridge, error) {
+	if config.Address == "" {
+		return nil, ErrNoAddress
+	}
+
+	if len(config.Rules) == 0 {
+		return nil, ErrNoRules
+	}
+
+	if topics == nil {
+		return nil, types.ErrInvalidArgs
+	}
+
+	if config.Name == "" {
+		config.Name = config.Address
+	}
+
+	if config.ClientID == "" {
+		config.ClientID = config.Name
+	}
+
+	if config.KeepAlive <= 0 {
+		config.KeepAlive = defaultKeepAlive
+	}
+
+	if config.MaxReconnectInterval <= 0 {
+		config.MaxReconnectInterval = defaultReconnectInterval
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+
+	if config.EchoWindow <= 0 {
+		config.EchoWindow = defaultEchoWindow
+	}
+
+	b := &Bridge{
+		config: config,
+		topics: topics,
+		queue:  make(chan *message.PublishMessage, config.Buffer),
+		echo:   newEchoFilter(config.EchoWindow),
+		quit:   make(chan struct{}),
+	}
+
+	b.synced.topics = make(map[string]struct{})
+
+	b.log.prod = surgemq.GetProdLogger().Named("bridge").Named(config.Name)
+	b.log.dev = surgemq.GetDevLogger().Named("bridge").Named(config.Name)
+
+	b.subscriber.Publish = b.onLocalPublish
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Address).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetCleanSession(config.CleanSession).
+		SetKeepAlive(config.KeepAlive).
+		SetConnectTimeout(connectTimeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(config.MaxReconnectInterval).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(b.onConnectionLost)
+
+	if config.TLS != nil {
+		opts.SetTLSConfig(config.TLS)
+	}
+
+	b.client = mqtt.NewClient(opts)
+
+	for _, r := range config.Rules {
+		if r.Direction == In {
+			continue
+		}
+
+		if _, err := topics.Subscribe(r.LocalPrefix+r.Filter, message.QoS2, &b.subscriber); err != nil {
+			b.unsubscribe()
+			return nil, err
+		}
+	}
+
+	// connection is retried in background until succeeded
+	b.client.Connect()
+
+	b.wg.Add(1)
+	go b.publishWorker()
+
+	if config.SyncRetained && config.RetainedSyncInterval > 0 {
+		b.wg.Add(1)
+		go b.syncWorker()
+	}
+
+	b.log.prod.Info("Bridge started", zap.String("address", config.Address), zap.Int("rules", len(config.Rules)))
+
+	return b, nil
+}
+
+// Status of bridge
+func (b *Bridge) Status() Status {
+	b.synced.lock.Lock()
+	retained := len(b.synced.topics)
+	b.synced.lock.Unlock()
+
+	return Status{
+		Name:      b.config.Name,
+		Address:   b.config.Address,
+		Connected: b.client.IsConnectionOpen(),
+		Out:       atomic.LoadUint64(&b.out),
+		In:        atomic.LoadUint64(&b.in),
+		Dropped:   atomic.LoadUint64(&b.dropped),
+		Retained:  retained,
+	}
+}
+
+// Close stop forwarding and disconnect from remote broker. Queued messages are dropped
+func (b *Bridge) Close() error {
+	select {
+	case <-b.quit:
+		return types.ErrNotOpen
+	default:
+	}
+
+	close(b.quit)
+
+	b.unsubscribe()
+	b.wg.Wait()
+
+	b.client.Disconnect(disconnectQuiesce)
+
+	b.log.prod.Info("Bridge stopped")
+
+	return nil
+}
+
+func (b *Bridge) unsubscribe() {
+	for _, r := range b.config.Rules {
+		if r.Direction != In {
+			b.topics.UnSubscribe(r.LocalPrefix+r.Filter, &b.subscriber) // nolint: errcheck
+		}
+	}
+}
+
+// onConnect subscribe remote filters on every connect as remote session might be clean
+func (b *Bridge) onConnect(c mqtt.Client) {
+	b.log.prod.Info("Connected to remote broker", zap.String("address", b.config.Address))
+
+	b.subscribeRemote(c)
+}
+
+// subscribeRemote filters of In rules. Remote broker sends retained messages on every subscribe
+func (b *Bridge) subscribeRemote(c mqtt.Client) {
+	for i := range b.config.Rules {
+		r := &b.config.Rules[i]
+		if r.Direction == Out {
+			continue
+		}
+
+		qos := message.QoS2
+		if r.QoS != nil {
+			qos = *r.QoS
+		}
+
+		filter := r.RemotePrefix + r.Filter
+		token := c.Subscribe(filter, byte(qos), func(_ mqtt.Client, m mqtt.Message) {
+			b.onRemotePublish(r, m)
+		})
+
+		go func() {
+			if token.WaitTimeout(connectTimeout) && token.Error() != nil {
+				b.log.prod.Error("Couldn't subscribe remote filter", zap.String("filter", filter), zap.Error(token.Error()))
+			}
+		}()
+	}
+}
+
+func (b *Bridge) onConnectionLost(_ mqtt.Client, err error) {
+	b.log.prod.Warn("Connection to remote broker lost", zap.String("address", b.config.Address), zap.Error(err))
+}
+
+// onLocalPublish queue local message for remote broker. Invoked by topics provider with
+// locks held thus never blocks
+func (b *Bridge) onLocalPublish(msg *message.PublishMessage) error {
+	if _, ok := b.injected.Load(msg); ok {
+		return nil
+	}
+
+	select {
+	case b.queue <- msg:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+		b.log.prod.Warn("Queue full, message dropped", zap.String("topic", msg.Topic()))
+	}
+
+	return nil
+}
+
+// onRemotePublish deliver message of remote broker to local subscribers
+func (b *Bridge) onRemotePublish(r *Rule, m mqtt.Message) {
+	if !strings.HasPrefix(m.Topic(), r.RemotePrefix) {
+		return
+	}
+
+	topic := r.LocalPrefix + strings.TrimPrefix(m.Topic(), r.RemotePrefix)
+
+	if b.echo.seen(m.Topic(), m.Payload()) {
+		b.log.dev.Debug("Echo of forwarded message skipped", zap.String("topic", m.Topic()))
+		return
+	}
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic(topic); err != nil {
+		b.log.prod.Error("Invalid topic of remote message", zap.String("topic", topic), zap.Error(err))
+		return
+	}
+
+	msg.SetQoS(capQoS(message.QosType(m.Qos()), r.QoS)) // nolint: errcheck
+	msg.SetPayload(m.Payload())
+
+	if b.config.SyncRetained && !b.syncRetained(msg, m.Retained()) {
+		b.log.dev.Debug("Retained message unchanged", zap.String("topic", topic))
+		return
+	}
+
+	b.injected.Store(msg, struct{}{})
+	err := b.topics.Publish(msg)
+	b.injected.Delete(msg)
+
+	if err != nil {
+		b.log.prod.Error("Couldn't publish remote message", zap.String("topic", topic), zap.Error(err))
+		return
+	}
+
+	atomic.AddUint64(&b.in, 1)
+}
+
+// syncRetained update local copy of retained message of remote broker. Returns false if
+// message is resent copy of one retained already, thus not published again
+func (b *Bridge) syncRetained(msg *message.PublishMessage, retained bool) bool {
+	topic := msg.Topic()
+
+	b.synced.lock.Lock()
+	_, known := b.synced.topics[topic]
+	b.synced.lock.Unlock()
+
+	if !retained && !known {
+		return true
+	}
+
+	if retained {
+		var local []*message.PublishMessage
+		b.topics.Retained(topic, &local) // nolint: errcheck
+
+		if len(local) == 1 && local[0].QoS() == msg.QoS() && bytes.Equal(local[0].Payload(), msg.Payload()) {
+			return false
+		}
+	}
+
+	msg.SetRetain(true)
+	if err := b.topics.Retain(msg); err != nil {
+		b.log.prod.Error("Couldn't retain remote message", zap.String("topic", topic), zap.Error(err))
+	}
+
+	// [MQTT-3.3.1-10] empty message removes retained one, as QoS 0 message does locally
+	b.synced.lock.Lock()
+	if len(msg.Payload()) == 0 || msg.QoS() == message.QoS0 {
+		delete(b.synced.topics, topic)
+	} else {
+		b.synced.topics[topic] = struct{}{}
+	}
+	b.synced.lock.Unlock()
+
+	return true
+}
+
+// syncWorker resubscribe remote filters to refresh retained messages until bridge closed
+func (b *Bridge) syncWorker() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.config.RetainedSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-ticker.C:
+			if b.client.IsConnectionOpen() {
+				b.subscribeRemote(b.client)
+			}
+		}
+	}
+}
+
+// publishWorker forward queued local messages to remote broker
+// QoS 1/2 messages are retried until acknowledged thus delivery is at least once
+func (b *Bridge) publishWorker() {
+	defer b.wg.Done()
+
+	for {
+		select {
+		case <-b.quit:
+			return
+		case msg := <-b.queue:
+			b.forward(msg)
+		}
+	}
+}
+
+func (b *Bridge) forward(msg *message.PublishMessage) {
+	for i := range b.config.Rules {
+		r := &b.config.Rules[i]
+		if r.Direction == In || !strings.HasPrefix(msg.Topic(), r.LocalPrefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(msg.Topic(), r.LocalPrefix)
+		if !topicsTypes.Match(r.Filter, rest) {
+			continue
+		}
+
+		topic := r.RemotePrefix + rest
+		qos := capQoS(msg.QoS(), r.QoS)
+
+		if b.subscribed(topic) {
+			b.echo.add(topic, msg.Payload())
+		}
+
+		for {
+			token := b.client.Publish(topic, byte(qos), false, msg.Payload())
+
+			select {
+			case <-b.quit:
+				return
+			case <-token.Done():
+			case <-time.After(connectTimeout):
+			}
+
+			if token.Error() == nil {
+				atomic.AddUint64(&b.out, 1)
+				break
+			}
+
+			if qos == message.QoS0 {
+				atomic.AddUint64(&b.dropped, 1)
+				break
+			}
+
+			b.log.dev.Debug("Retry forward", zap.String("topic", topic), zap.Error(token.Error()))
+
+			select {
+			case <-b.quit:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+
+		// first matching rule wins thus overlapping rules do not duplicate messages
+		return
+	}
+}
+
+// subscribed either bridge subscribes remote topic, thus gets copy of message forwarded to it
+func (b *Bridge) subscribed(topic string) bool {
+	for i := range b.config.Rules {
+		r := &b.config.Rules[i]
+		if r.Direction != Out && strings.HasPrefix(topic, r.RemotePrefix) &&
+			topicsTypes.Match(r.Filter, strings.TrimPrefix(topic, r.RemotePrefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func capQoS(qos message.QosType, max *message.QosType) message.QosType {
+	if max != nil && qos > *max {
+		return *max
+	}
+
+	return qos
+}
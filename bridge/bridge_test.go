@@ -0,0 +1,157 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/topics/mem"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	"github.com/troian/surgemq/types"
+)
+
+func TestCapQoS(t *testing.T) {
+	max := message.QoS1
+
+	require.Equal(t, message.QoS1, capQoS(message.QoS2, &max))
+	require.Equal(t, message.QoS0, capQoS(message.QoS0, &max))
+	require.Equal(t, message.QoS2, capQoS(message.QoS2, nil))
+}
+
+func TestEchoFilter(t *testing.T) {
+	e := newEchoFilter(time.Minute)
+
+	e.add("a", []byte("1"))
+	e.add("a", []byte("1"))
+
+	require.False(t, e.seen("a", []byte("2")))
+	require.False(t, e.seen("b", []byte("1")))
+	require.True(t, e.seen("a", []byte("1")))
+	require.True(t, e.seen("a", []byte("1")))
+	require.False(t, e.seen("a", []byte("1")))
+
+	e = newEchoFilter(time.Millisecond)
+	e.add("a", []byte("1"))
+	time.Sleep(5 * time.Millisecond)
+	require.False(t, e.seen("a", []byte("1")))
+}
+
+func TestLocalPublish(t *testing.T) {
+	topics, err := mem.NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	b, err := New(Config{
+		Address: "tcp://127.0.0.1:1",
+		Rules:   []Rule{{Filter: "sensors/#", Direction: Both, LocalPrefix: "site/"}},
+	}, topics)
+	require.NoError(t, err)
+
+	publish := func(topic string) *message.PublishMessage {
+		msg := message.NewPublishMessage()
+		require.NoError(t, msg.SetTopic(topic))
+		require.NoError(t, msg.SetQoS(message.QoS1))
+		msg.SetPayload([]byte("v"))
+
+		return msg
+	}
+
+	// worker keeps retrying first message while remote broker is down
+	require.NoError(t, topics.Publish(publish("site/sensors/t")))
+	require.Eventually(t, func() bool { return len(b.queue) == 0 }, time.Second, time.Millisecond)
+
+	// messages of remote broker are not forwarded back
+	msg := publish("site/sensors/t")
+	b.injected.Store(msg, struct{}{})
+	require.NoError(t, topics.Publish(msg))
+	require.Len(t, b.queue, 0)
+
+	require.NoError(t, topics.Publish(publish("other/sensors/t")))
+	require.Len(t, b.queue, 0)
+
+	require.NoError(t, topics.Publish(publish("site/sensors/h")))
+	require.Len(t, b.queue, 1)
+
+	require.False(t, b.Status().Connected)
+	require.NoError(t, b.Close())
+	require.Equal(t, uint64(0), b.Status().Out)
+
+	_, err = New(Config{Address: "tcp://127.0.0.1:1"}, topics)
+	require.Equal(t, ErrNoRules, err)
+}
+
+type remoteMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  string
+}
+
+func (m *remoteMessage) Duplicate() bool   { return false }
+func (m *remoteMessage) Qos() byte         { return m.qos }
+func (m *remoteMessage) Retained() bool    { return m.retained }
+func (m *remoteMessage) Topic() string     { return m.topic }
+func (m *remoteMessage) MessageID() uint16 { return 0 }
+func (m *remoteMessage) Payload() []byte   { return []byte(m.payload) }
+func (m *remoteMessage) Ack()              {}
+
+func TestSyncRetained(t *testing.T) {
+	topics, err := mem.NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	b, err := New(Config{
+		Address:      "tcp://127.0.0.1:1",
+		SyncRetained: true,
+		Rules:        []Rule{{Filter: "state/#", Direction: In, LocalPrefix: "site/", RemotePrefix: "fleet/"}},
+	}, topics)
+	require.NoError(t, err)
+	defer b.Close() // nolint: errcheck
+
+	var got []string
+	sub := &types.Subscriber{
+		Publish: func(msg *message.PublishMessage) error {
+			got = append(got, string(msg.Payload()))
+			return nil
+		},
+	}
+
+	_, err = topics.Subscribe("site/#", message.QoS1, sub)
+	require.NoError(t, err)
+
+	retained := func(topic string) string {
+		var msgs []*message.PublishMessage
+		require.NoError(t, topics.Retained(topic, &msgs))
+
+		if len(msgs) == 0 {
+			return ""
+		}
+
+		return string(msgs[0].Payload())
+	}
+
+	r := &b.config.Rules[0]
+
+	// retained message sent on subscribe is retained locally
+	b.onRemotePublish(r, &remoteMessage{topic: "fleet/state/a", qos: 1, retained: true, payload: "on"})
+	require.Equal(t, "on", retained("site/state/a"))
+	require.Equal(t, 1, b.Status().Retained)
+
+	// unchanged copy resent on reconnect is not published again
+	b.onRemotePublish(r, &remoteMessage{topic: "fleet/state/a", qos: 1, retained: true, payload: "on"})
+	require.Equal(t, []string{"on"}, got)
+
+	// update of synchronized topic forwarded as regular message updates local copy
+	b.onRemotePublish(r, &remoteMessage{topic: "fleet/state/a", qos: 1, payload: "off"})
+	require.Equal(t, "off", retained("site/state/a"))
+
+	// regular message of other topic is not retained
+	b.onRemotePublish(r, &remoteMessage{topic: "fleet/state/b", qos: 1, payload: "x"})
+	require.Equal(t, "", retained("site/state/b"))
+
+	// empty message removes local copy
+	b.onRemotePublish(r, &remoteMessage{topic: "fleet/state/a", qos: 1})
+	require.Equal(t, "", retained("site/state/a"))
+	require.Equal(t, 0, b.Status().Retained)
+
+	require.Equal(t, []string{"on", "off", "x", ""}, got)
+}
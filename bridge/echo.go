@@ -0,0 +1,88 @@
+package bridge
+
+import (
+	"crypto/sha1" // nolint: gas
+	"sync"
+	"time"
+)
+
+// echoFilter remembers messages forwarded to remote broker for window, thus copies
+// remote broker delivers back to bridge subscriptions are recognized
+type echoFilter struct {
+	window time.Duration
+
+	lock    sync.Mutex
+	entries map[[sha1.Size]byte]*echoEntry
+	swept   time.Time
+}
+
+// echoEntry copies of message pending
+type echoEntry struct {
+	count  int
+	expire time.Time
+}
+
+func newEchoFilter(window time.Duration) *echoFilter {
+	return &echoFilter{
+		window:  window,
+		entries: make(map[[sha1.Size]byte]*echoEntry),
+	}
+}
+
+func echoKey(topic string, payload []byte) [sha1.Size]byte {
+	h := sha1.New()        // nolint: gas
+	h.Write([]byte(topic)) // nolint: errcheck
+	h.Write([]byte{0})     // nolint: errcheck
+	h.Write(payload)       // nolint: errcheck
+
+	var key [sha1.Size]byte
+	copy(key[:], h.Sum(nil))
+
+	return key
+}
+
+func (e *echoFilter) add(topic string, payload []byte) {
+	now := time.Now()
+	key := echoKey(topic, payload)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	entry, ok := e.entries[key]
+	if !ok {
+		entry = &echoEntry{}
+		e.entries[key] = entry
+	}
+
+	entry.count++
+	entry.expire = now.Add(e.window)
+
+	if now.Sub(e.swept) > e.window {
+		for k, entry := range e.entries {
+			if now.After(entry.expire) {
+				delete(e.entries, k)
+			}
+		}
+
+		e.swept = now
+	}
+}
+
+// seen either message has been forwarded within window. Every forwarded copy is seen once
+func (e *echoFilter) seen(topic string, payload []byte) bool {
+	key := echoKey(topic, payload)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	entry, ok := e.entries[key]
+	if !ok {
+		return false
+	}
+
+	if entry.count--; entry.count == 0 {
+		delete(e.entries, key)
+	}
+
+	return time.Now().Before(entry.expire)
+}
@@ -0,0 +1,489 @@
+// Package cluster joins brokers into cluster. Nodes discover each other from static list
+// of peers and gossip of membership, exchange digests of their subscription filters and
+// route publishes to nodes having matching subscribers. Thus client connected to one node
+// receives messages published on another
+//
+// Shared subscriptions $share/<group>/<filter> are balanced across subscribers of group on
+// all nodes: each message is delivered to single subscriber chosen by weighted rendezvous
+// hashing of topic, first among nodes by their Weight and then among subscribers of node
+// by client id. Thus messages of topic stick to the same subscriber, even once it reconnects,
+// as long as members and subscribers of group are unchanged
+package cluster
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/message"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	"github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultGossipInterval = time.Second
+	defaultDeadTimeout    = 30 * time.Second
+	defaultBuffer         = 4096
+	defaultWeight         = 1
+
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+// ErrNoAddr node configured without listen address
+var ErrNoAddr = errors.New("cluster: listen address required")
+
+// Config of cluster node
+type Config struct {
+	// Name of node reported to members. If not set then default to advertised address
+	Name string
+
+	// Addr host:port node listens on for connections of other nodes, e.g. ":7946"
+	Addr string
+
+	// Advertise host:port other nodes connect to. If not set then default to address
+	// of listener, thus must be set if Addr binds to all interfaces
+	Advertise string
+
+	// Peers addresses of nodes to join. Further members are learned by gossip
+	// Peers are redialled until node is closed while members learned by gossip are
+	// forgotten once unreachable for DeadTimeout
+	Peers []string
+
+	// Secret shared by nodes. Connections presenting another one are refused
+	Secret string
+
+	// TLS of connections between nodes used both to listen and to dial. Optional
+	TLS *tls.Config
+
+	// GossipInterval membership is exchanged and unreachable members redialled with
+	// If not set then default to 1s
+	GossipInterval time.Duration
+
+	// DeadTimeout member is forgotten after being unreachable for
+	// If not set then default to 30s
+	DeadTimeout time.Duration
+
+	// Buffer amount of publishes waiting for delivery to each member, further ones are dropped
+	// If not set then default to 4096
+	Buffer int
+
+	// OnClaim invoked once member started session of client with given id, see Node.Claim
+	// Optional
+	OnClaim func(id string)
+
+	// Weight of node in balancing of shared subscription groups relative to other members,
+	// e.g. node of weight 2 receives twice as many topics as node of weight 1
+	// If not set then default to 1
+	Weight int
+}
+
+// Member of cluster as seen by node
+type Member struct {
+	Name string
+	Addr string
+
+	// Connected either node is connected to member
+	Connected bool
+
+	// Filters amount of distinct subscription filters member has subscribers of
+	Filters int
+
+	// Shares amount of shared subscription groups member has subscribers of
+	Shares int
+
+	// Weight of member in balancing of shared subscription groups
+	Weight int
+}
+
+// Node member of cluster wrapping topics provider of broker. Publishes are delivered to
+// local subscribers and routed to members with matching filters. Publishes routed by
+// members are delivered to local subscribers only. Topics starting with $ stay local
+type Node struct {
+	topicsTypes.Provider
+
+	config    Config
+	advertise string
+	ln        net.Listener
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	// lock protects members, local filters and incoming connections
+	lock    sync.RWMutex
+	members map[string]*member
+	filters map[string]map[*types.Subscriber]struct{}
+	shares  map[string]*shareGroup
+	version uint64
+	conns   map[net.Conn]struct{}
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+}
+
+// member other node by advertised address
+type member struct {
+	name string
+	addr string
+	seed bool
+	link *link
+
+	// in incoming connection routes have been received over. nil if not connected
+	in      net.Conn
+	routes  *filterTree
+	filters int
+
+	// shares filters of shared subscription groups of member by $share filter
+	shares map[string]string
+	weight int
+}
+
+var _ topicsTypes.Provider = (*Node)(nil)
+
+// New start node on top of topics provider and join peers
+func New(config Config, topics topicsTypes.Provider) (*Node, error) {
+	if config.Addr == "" {
+		return nil, ErrNoAddr
+	}
+
+	if topics == nil {
+		return nil, types.ErrInvalidArgs
+	}
+
+	if config.GossipInterval <= 0 {
+		config.GossipInterval = defaultGossipInterval
+	}
+
+	if config.DeadTimeout <= 0 {
+		config.DeadTimeout = defaultDeadTimeout
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+
+	if config.Weight <= 0 {
+		config.Weight = defaultWeight
+	}
+
+	var ln net.Listener
+	var err error
+
+	if config.TLS != nil {
+		ln, err = tls.Listen("tcp", config.Addr, config.TLS)
+	} else {
+		ln, err = net.Listen("tcp", config.Addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		Provider:  topics,
+		config:    config,
+		advertise: config.Advertise,
+		ln:        ln,
+		quit:      make(chan struct{}),
+		members:   make(map[string]*member),
+		filters:   make(map[string]map[*types.Subscriber]struct{}),
+		shares:    make(map[string]*shareGroup),
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	if n.advertise == "" {
+		n.advertise = ln.Addr().String()
+	}
+
+	if n.config.Name == "" {
+		n.config.Name = n.advertise
+	}
+
+	n.log.prod = surgemq.GetProdLogger().Named("cluster")
+	n.log.dev = surgemq.GetDevLogger().Named("cluster")
+
+	n.wg.Add(1)
+	go n.acceptWorker()
+
+	n.lock.Lock()
+	for _, addr := range config.Peers {
+		if m := n.join(addr); m != nil {
+			m.seed = true
+		}
+	}
+	n.lock.Unlock()
+
+	n.log.prod.Info("Cluster node started",
+		zap.String("name", n.config.Name),
+		zap.String("addr", n.advertise),
+		zap.Strings("peers", config.Peers))
+
+	return n, nil
+}
+
+// Name of node
+func (n *Node) Name() string {
+	return n.config.Name
+}
+
+// Addr advertised address of node
+func (n *Node) Addr() string {
+	return n.advertise
+}
+
+// Members known to node ordered by address
+func (n *Node) Members() []Member {
+	n.lock.RLock()
+	res := make([]Member, 0, len(n.members))
+	for _, m := range n.members {
+		res = append(res, Member{
+			Name:      m.name,
+			Addr:      m.addr,
+			Connected: m.link.connected() && m.in != nil,
+			Filters:   m.filters,
+			Shares:    len(m.shares),
+			Weight:    m.weight,
+		})
+	}
+	n.lock.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Addr < res[j].Addr })
+
+	return res
+}
+
+// Subscribe add subscriber locally and advertise filter to members. Subscribers of shared
+// subscription are added to group instead
+func (n *Node) Subscribe(filter string, qos message.QosType, sub *types.Subscriber) (message.QosType, error) {
+	if f, ok := parseShare(filter); ok {
+		n.subscribeShared(filter, f, qos, sub)
+		return qos, nil
+	}
+
+	q, err := n.Provider.Subscribe(filter, qos, sub)
+	if err != nil || !routed(filter) {
+		return q, err
+	}
+
+	n.lock.Lock()
+	subs, ok := n.filters[filter]
+	if !ok {
+		subs = make(map[*types.Subscriber]struct{})
+		n.filters[filter] = subs
+		n.version++
+	}
+	subs[sub] = struct{}{}
+	n.lock.Unlock()
+
+	if !ok {
+		n.digestChanged()
+	}
+
+	return q, nil
+}
+
+// UnSubscribe remove subscriber locally and withdraw filter from members once it has none
+func (n *Node) UnSubscribe(filter string, sub *types.Subscriber) error {
+	if _, ok := parseShare(filter); ok {
+		n.unSubscribeShared(filter, sub)
+		return nil
+	}
+
+	err := n.Provider.UnSubscribe(filter, sub)
+
+	n.lock.Lock()
+	subs, ok := n.filters[filter]
+	if ok {
+		delete(subs, sub)
+		if len(subs) > 0 {
+			ok = false
+		} else {
+			delete(n.filters, filter)
+			n.version++
+		}
+	}
+	n.lock.Unlock()
+
+	if ok {
+		n.digestChanged()
+	}
+
+	return err
+}
+
+// Publish deliver message to local subscribers and route it to members with matching filters
+// Message is delivered to one subscriber of every matching shared subscription group as well
+func (n *Node) Publish(msg *message.PublishMessage) error {
+	if err := n.Provider.Publish(msg); err != nil {
+		return err
+	}
+
+	n.publishShared(msg)
+
+	if !routed(msg.Topic()) {
+		return nil
+	}
+
+	var links []*link
+
+	n.lock.RLock()
+	for _, m := range n.members {
+		if m.routes != nil && m.routes.match(msg.Topic()) {
+			links = append(links, m.link)
+		}
+	}
+	n.lock.RUnlock()
+
+	if len(links) == 0 {
+		return nil
+	}
+
+	body := encodePublish(msg)
+	for _, l := range links {
+		l.send(framePublish, body)
+	}
+
+	return nil
+}
+
+// Claim announce session of client with given id has been started by node thus members
+// release their copies of it
+func (n *Node) Claim(id string) {
+	n.lock.RLock()
+	for _, m := range n.members {
+		m.link.send(frameClaim, []byte(id))
+	}
+	n.lock.RUnlock()
+}
+
+// Close leave cluster and close underlying provider
+func (n *Node) Close() error {
+	select {
+	case <-n.quit:
+		return types.ErrNotOpen
+	default:
+	}
+
+	close(n.quit)
+	n.ln.Close() // nolint: errcheck, gas
+
+	n.lock.Lock()
+	for c := range n.conns {
+		c.Close() // nolint: errcheck, gas
+	}
+	n.lock.Unlock()
+
+	n.wg.Wait()
+
+	return n.Provider.Close()
+}
+
+// routed topics and filters starting with $ are local to node, e.g. $SYS
+func routed(topic string) bool {
+	return !strings.HasPrefix(topic, "$")
+}
+
+// join add member of given address unless known and start dialling it. Returns nil for
+// address of node itself. Caller holds lock
+func (n *Node) join(addr string) *member {
+	if addr == "" || addr == n.advertise {
+		return nil
+	}
+
+	if m, ok := n.members[addr]; ok {
+		return m
+	}
+
+	select {
+	case <-n.quit:
+		return nil
+	default:
+	}
+
+	m := &member{addr: addr}
+	m.link = newLink(n, addr, n.config.Buffer)
+	n.members[addr] = m
+
+	n.wg.Add(1)
+	go m.link.run()
+
+	n.log.dev.Debug("Member discovered", zap.String("addr", addr))
+
+	return m
+}
+
+// forget member unreachable for too long. Returns false if member is alive or a peer
+func (n *Node) forget(l *link) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	m, ok := n.members[l.addr]
+	if !ok || m.link != l {
+		return true
+	}
+
+	if m.seed || m.in != nil {
+		return false
+	}
+
+	delete(n.members, l.addr)
+
+	n.log.prod.Info("Member left", zap.String("name", m.name), zap.String("addr", m.addr))
+
+	return true
+}
+
+// digest local filters. Returns false if version has not changed since given one
+func (n *Node) digest(since uint64, sent bool) (digest, bool) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	if sent && n.version == since {
+		return digest{}, false
+	}
+
+	d := digest{Version: n.version, Filters: make([]string, 0, len(n.filters)), Weight: n.config.Weight}
+	for f := range n.filters {
+		d.Filters = append(d.Filters, f)
+	}
+
+	for key := range n.shares {
+		d.Shares = append(d.Shares, key)
+	}
+
+	sort.Strings(d.Filters)
+	sort.Strings(d.Shares)
+
+	return d, true
+}
+
+// gossip addresses of members node is connected to
+func (n *Node) gossip() []string {
+	n.lock.RLock()
+	res := make([]string, 0, len(n.members))
+	for _, m := range n.members {
+		if m.link.connected() {
+			res = append(res, m.addr)
+		}
+	}
+	n.lock.RUnlock()
+
+	return res
+}
+
+// digestChanged notify links to send digest
+func (n *Node) digestChanged() {
+	n.lock.RLock()
+	for _, m := range n.members {
+		m.link.kick()
+	}
+	n.lock.RUnlock()
+}
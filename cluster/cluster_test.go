@@ -0,0 +1,360 @@
+package cluster
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/topics/mem"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	"github.com/troian/surgemq/types"
+)
+
+func newTestNode(t *testing.T, secret string, peers ...string) *Node {
+	p, err := mem.NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	n, err := New(Config{
+		Addr:           "127.0.0.1:0",
+		Peers:          peers,
+		Secret:         secret,
+		GossipInterval: 50 * time.Millisecond,
+	}, p)
+	require.NoError(t, err)
+
+	return n
+}
+
+func testSubscriber(ch chan string) *types.Subscriber {
+	return &types.Subscriber{
+		Publish: func(msg *message.PublishMessage) error {
+			ch <- msg.Topic() + ":" + string(msg.Payload())
+			return nil
+		},
+	}
+}
+
+func testPublish(t *testing.T, n *Node, topic string, payload string) {
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic(topic))
+	msg.SetPayload([]byte(payload))
+
+	require.NoError(t, n.Publish(msg))
+}
+
+func connected(n *Node, members int) func() bool {
+	return func() bool {
+		count := 0
+		for _, m := range n.Members() {
+			if m.Connected {
+				count++
+			}
+		}
+
+		return count == members
+	}
+}
+
+func TestFilterTree(t *testing.T) {
+	tr := newFilterTree([]string{"a/+/c", "b/#", "d", "+/e"})
+
+	require.True(t, tr.match("a/x/c"))
+	require.False(t, tr.match("a/x/y"))
+	require.False(t, tr.match("a/x/c/d"))
+	require.True(t, tr.match("b"))
+	require.True(t, tr.match("b/x/y"))
+	require.True(t, tr.match("d"))
+	require.False(t, tr.match("d/x"))
+	require.True(t, tr.match("x/e"))
+	require.False(t, tr.match("x"))
+
+	require.True(t, newFilterTree([]string{"#"}).match("any/topic"))
+	require.False(t, newFilterTree(nil).match("any"))
+}
+
+func TestPublishCodec(t *testing.T) {
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic("a/b"))
+	require.NoError(t, msg.SetQoS(message.QoS1))
+	msg.SetPayload([]byte("payload"))
+
+	res, err := decodePublish(encodePublish(msg))
+	require.NoError(t, err)
+	require.Equal(t, "a/b", res.Topic())
+	require.Equal(t, message.QoS1, res.QoS())
+	require.Equal(t, []byte("payload"), res.Payload())
+
+	_, err = decodePublish([]byte{0, 5, 'a'})
+	require.Equal(t, errInvalidFrame, err)
+}
+
+func TestRouting(t *testing.T) {
+	a := newTestNode(t, "s")
+	defer a.Close() // nolint: errcheck
+
+	b := newTestNode(t, "s", a.Addr())
+	defer b.Close() // nolint: errcheck
+
+	// c learns a from b by gossip
+	c := newTestNode(t, "s", b.Addr())
+	defer c.Close() // nolint: errcheck
+
+	for _, n := range []*Node{a, b, c} {
+		require.Eventually(t, connected(n, 2), 5*time.Second, 10*time.Millisecond)
+	}
+
+	ch := make(chan string, 10)
+	sub := testSubscriber(ch)
+
+	_, err := c.Subscribe("sensors/+/temp", message.QoS0, sub)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		for _, m := range a.Members() {
+			if m.Addr == c.Addr() {
+				return m.Filters == 1
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	testPublish(t, a, "sensors/1/temp", "21")
+	testPublish(t, a, "sensors/1/humidity", "40")
+	testPublish(t, a, "$SYS/broker/uptime", "1")
+
+	select {
+	case got := <-ch:
+		require.Equal(t, "sensors/1/temp:21", got)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "routed message not received")
+	}
+
+	select {
+	case got := <-ch:
+		require.FailNow(t, "unexpected message", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	require.NoError(t, c.UnSubscribe("sensors/+/temp", sub))
+
+	require.Eventually(t, func() bool {
+		for _, m := range a.Members() {
+			if m.Addr == c.Addr() {
+				return m.Filters == 0
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSecret(t *testing.T) {
+	a := newTestNode(t, "s")
+	defer a.Close() // nolint: errcheck
+
+	b := newTestNode(t, "other", a.Addr())
+	defer b.Close() // nolint: errcheck
+
+	time.Sleep(200 * time.Millisecond)
+
+	require.True(t, connected(a, 0)())
+}
+
+func TestClaim(t *testing.T) {
+	a := newTestNode(t, "s")
+	defer a.Close() // nolint: errcheck
+
+	claims := make(chan string, 1)
+
+	p, err := mem.NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	b, err := New(Config{
+		Addr:           "127.0.0.1:0",
+		Peers:          []string{a.Addr()},
+		Secret:         "s",
+		GossipInterval: 50 * time.Millisecond,
+		OnClaim:        func(id string) { claims <- id },
+	}, p)
+	require.NoError(t, err)
+	defer b.Close() // nolint: errcheck
+
+	require.Eventually(t, connected(a, 1), 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, connected(b, 1), 5*time.Second, 10*time.Millisecond)
+
+	a.Claim("client")
+
+	select {
+	case id := <-claims:
+		require.Equal(t, "client", id)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "claim not received")
+	}
+}
+
+func TestParseShare(t *testing.T) {
+	f, ok := parseShare("$share/g/sensors/#")
+	require.True(t, ok)
+	require.Equal(t, "sensors/#", f)
+
+	for _, filter := range []string{"sensors/#", "$share/g", "$share/g/", "$share//a", "$share/+/a", "$sharex/g/a"} {
+		_, ok = parseShare(filter)
+		require.False(t, ok, filter)
+	}
+
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic("a/b"))
+	msg.SetPayload([]byte("payload"))
+
+	key, res, err := decodeShared(encodeShared("$share/g/a/+", msg))
+	require.NoError(t, err)
+	require.Equal(t, "$share/g/a/+", key)
+	require.Equal(t, "a/b", res.Topic())
+	require.Equal(t, []byte("payload"), res.Payload())
+}
+
+// shareSubscriber of client counting messages by topic
+func shareSubscriber(id string, got map[string]string, lock *sync.Mutex) *types.Subscriber {
+	return &types.Subscriber{
+		ID: id,
+		Publish: func(msg *message.PublishMessage) error {
+			lock.Lock()
+			got[msg.Topic()] += id
+			lock.Unlock()
+			return nil
+		},
+	}
+}
+
+func TestSharedLocal(t *testing.T) {
+	n := newTestNode(t, "s")
+	defer n.Close() // nolint: errcheck
+
+	var lock sync.Mutex
+	got := make(map[string]string)
+
+	a := shareSubscriber("a", got, &lock)
+	b := shareSubscriber("b", got, &lock)
+
+	for _, sub := range []*types.Subscriber{a, b} {
+		_, err := n.Subscribe("$share/g/t/+", message.QoS0, sub)
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < 100; i++ {
+		testPublish(t, n, fmt.Sprintf("t/%d", i), "x")
+	}
+
+	// every message is delivered once and both subscribers get their share
+	require.Len(t, got, 100)
+
+	count := 0
+	for _, id := range got {
+		require.Len(t, id, 1)
+		if id == "a" {
+			count++
+		}
+	}
+
+	require.True(t, count > 20 && count < 80, count)
+
+	// reconnected client gets topics it had before
+	before := make(map[string]string, len(got))
+	for topic, id := range got {
+		before[topic] = id
+	}
+
+	require.NoError(t, n.UnSubscribe("$share/g/t/+", a))
+
+	for topic := range got {
+		delete(got, topic)
+	}
+
+	_, err := n.Subscribe("$share/g/t/+", message.QoS0, shareSubscriber("a", got, &lock))
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		testPublish(t, n, fmt.Sprintf("t/%d", i), "x")
+	}
+
+	require.Equal(t, before, got)
+
+	// shared subscription is not delivered as regular one
+	var msgs []*message.PublishMessage
+	require.NoError(t, n.Retained("$share/g/t/+", &msgs))
+	require.Empty(t, msgs)
+}
+
+func TestSharedCluster(t *testing.T) {
+	a := newTestNode(t, "s")
+	defer a.Close() // nolint: errcheck
+
+	p, err := mem.NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	b, err := New(Config{
+		Addr:           "127.0.0.1:0",
+		Peers:          []string{a.Addr()},
+		Secret:         "s",
+		GossipInterval: 50 * time.Millisecond,
+		Weight:         3,
+	}, p)
+	require.NoError(t, err)
+	defer b.Close() // nolint: errcheck
+
+	require.Eventually(t, connected(a, 1), 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, connected(b, 1), 5*time.Second, 10*time.Millisecond)
+
+	var lock sync.Mutex
+	got := make(map[string]string)
+
+	_, err = a.Subscribe("$share/g/t/#", message.QoS0, shareSubscriber("a", got, &lock))
+	require.NoError(t, err)
+
+	_, err = b.Subscribe("$share/g/t/#", message.QoS0, shareSubscriber("b", got, &lock))
+	require.NoError(t, err)
+
+	for _, n := range []*Node{a, b} {
+		require.Eventually(t, func() bool {
+			m := n.Members()
+			return len(m) == 1 && m[0].Shares == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	require.Equal(t, 3, a.Members()[0].Weight)
+	require.Equal(t, 1, b.Members()[0].Weight)
+
+	// messages published on either node are balanced by weight of nodes the same way
+	for i := 0; i < 400; i++ {
+		n := a
+		if i%2 == 1 {
+			n = b
+		}
+
+		testPublish(t, n, fmt.Sprintf("t/%d", i), "x")
+	}
+
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(got) == 400
+	}, 5*time.Second, 10*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	count := 0
+	for _, id := range got {
+		require.Len(t, id, 1)
+		if id == "b" {
+			count++
+		}
+	}
+
+	// node of weight 3 gets about 3/4 of topics
+	require.True(t, count > 250 && count < 350, count)
+}
@@ -0,0 +1,368 @@
+package cluster
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// link outgoing connection to member. Carries hello, membership, digests and publishes
+// Frames from member arrive over connection it dialled
+type link struct {
+	n    *Node
+	addr string
+
+	queue   chan frame
+	changed chan struct{}
+
+	// up either connection is established, set atomically
+	up int32
+}
+
+func newLink(n *Node, addr string, buffer int) *link {
+	return &link{
+		n:       n,
+		addr:    addr,
+		queue:   make(chan frame, buffer),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// send queue frame for member. Never blocks as it is called from publish path
+func (l *link) send(kind byte, body []byte) {
+	select {
+	case l.queue <- frame{kind: kind, body: body}:
+	default:
+		l.n.log.prod.Warn("Frame for member discarded", zap.String("addr", l.addr), zap.Uint8("kind", kind))
+	}
+}
+
+// connected either link has connection to member
+func (l *link) connected() bool {
+	return atomic.LoadInt32(&l.up) == 1
+}
+
+// kick request digest to be sent
+func (l *link) kick() {
+	select {
+	case l.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run dial member until node closed or member forgotten
+func (l *link) run() {
+	defer l.n.wg.Done()
+
+	var failedSince time.Time
+
+	for {
+		conn, err := l.n.dial(l.addr)
+		if err == nil {
+			failedSince = time.Time{}
+			l.serve(conn)
+		} else {
+			if failedSince.IsZero() {
+				failedSince = time.Now()
+			}
+
+			l.n.log.dev.Debug("Couldn't connect member", zap.String("addr", l.addr), zap.Error(err))
+
+			if time.Since(failedSince) > l.n.config.DeadTimeout && l.n.forget(l) {
+				return
+			}
+		}
+
+		select {
+		case <-l.n.quit:
+			return
+		case <-time.After(l.n.config.GossipInterval):
+		}
+	}
+}
+
+// serve write frames to connection until it fails or node closed
+func (l *link) serve(conn net.Conn) {
+	defer conn.Close() // nolint: errcheck
+
+	atomic.StoreInt32(&l.up, 1)
+	defer atomic.StoreInt32(&l.up, 0)
+
+	w := bufio.NewWriter(conn)
+
+	var version uint64
+	sent := false
+
+	sendDigest := func() error {
+		d, changed := l.n.digest(version, sent)
+		if !changed {
+			return nil
+		}
+
+		body, err := json.Marshal(&d)
+		if err != nil {
+			return err
+		}
+
+		if err = writeFrame(w, frameDigest, body); err == nil {
+			version, sent = d.Version, true
+		}
+
+		return err
+	}
+
+	gossip := func() error {
+		body, err := json.Marshal(l.n.gossip())
+		if err != nil {
+			return err
+		}
+
+		if err = writeFrame(w, frameMembers, body); err != nil {
+			return err
+		}
+
+		return sendDigest()
+	}
+
+	flush := func() error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout)) // nolint: errcheck
+		return w.Flush()
+	}
+
+	body, err := json.Marshal(&hello{Name: l.n.config.Name, Addr: l.n.advertise, Secret: l.n.config.Secret})
+	if err == nil {
+		if err = writeFrame(w, frameHello, body); err == nil {
+			if err = gossip(); err == nil {
+				err = flush()
+			}
+		}
+	}
+
+	if err == nil {
+		l.n.log.prod.Info("Member connected", zap.String("addr", l.addr))
+	}
+
+	ticker := time.NewTicker(l.n.config.GossipInterval)
+	defer ticker.Stop()
+
+	for err == nil {
+		select {
+		case <-l.n.quit:
+			return
+		case f := <-l.queue:
+			err = writeFrame(w, f.kind, f.body)
+
+			// batch frames queued meanwhile into single flush
+			for pending := len(l.queue); err == nil && pending > 0; pending-- {
+				f = <-l.queue
+				err = writeFrame(w, f.kind, f.body)
+			}
+		case <-l.changed:
+			err = sendDigest()
+		case <-ticker.C:
+			err = gossip()
+		}
+
+		if err == nil {
+			err = flush()
+		}
+	}
+
+	l.n.log.prod.Warn("Member disconnected", zap.String("addr", l.addr), zap.Error(err))
+}
+
+// dial member
+func (n *Node) dial(addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+
+	if n.config.TLS != nil {
+		return tls.DialWithDialer(d, "tcp", addr, n.config.TLS)
+	}
+
+	return d.Dial("tcp", addr)
+}
+
+// acceptWorker accept connections of members until node closed
+func (n *Node) acceptWorker() {
+	defer n.wg.Done()
+
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			select {
+			case <-n.quit:
+				return
+			default:
+			}
+
+			n.log.prod.Error("Couldn't accept member", zap.Error(err))
+
+			select {
+			case <-n.quit:
+				return
+			case <-time.After(n.config.GossipInterval):
+			}
+
+			continue
+		}
+
+		n.lock.Lock()
+		n.conns[conn] = struct{}{}
+		n.lock.Unlock()
+
+		n.wg.Add(1)
+		go n.serveMember(conn)
+	}
+}
+
+// serveMember read frames of member until connection fails or node closed
+func (n *Node) serveMember(conn net.Conn) {
+	defer n.wg.Done()
+
+	defer func() {
+		n.lock.Lock()
+		delete(n.conns, conn)
+		n.lock.Unlock()
+
+		conn.Close() // nolint: errcheck
+	}()
+
+	r := bufio.NewReader(conn)
+
+	// members gossip every interval thus silent connection is dead
+	deadline := func() {
+		conn.SetReadDeadline(time.Now().Add(n.config.DeadTimeout)) // nolint: errcheck
+	}
+
+	deadline()
+
+	kind, body, err := readFrame(r)
+	if err != nil || kind != frameHello {
+		return
+	}
+
+	var h hello
+	if err = json.Unmarshal(body, &h); err != nil {
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(h.Secret), []byte(n.config.Secret)) != 1 {
+		n.log.prod.Warn("Member refused. Invalid secret", zap.String("RemoteAddr", conn.RemoteAddr().String()))
+		return
+	}
+
+	n.lock.Lock()
+	m := n.join(h.Addr)
+	if m != nil {
+		m.name = h.Name
+		m.in = conn
+		m.routes = nil
+		m.filters = 0
+		m.shares = nil
+	}
+	n.lock.Unlock()
+
+	if m == nil {
+		return
+	}
+
+	defer func() {
+		n.lock.Lock()
+		if m.in == conn {
+			m.in = nil
+			m.routes = nil
+			m.filters = 0
+			m.shares = nil
+		}
+		n.lock.Unlock()
+	}()
+
+	for {
+		deadline()
+
+		if kind, body, err = readFrame(r); err != nil {
+			return
+		}
+
+		switch kind {
+		case frameMembers:
+			var addrs []string
+			if err = json.Unmarshal(body, &addrs); err != nil {
+				return
+			}
+
+			n.lock.Lock()
+			for _, addr := range addrs {
+				n.join(addr)
+			}
+			n.lock.Unlock()
+		case frameDigest:
+			var d digest
+			if err = json.Unmarshal(body, &d); err != nil {
+				return
+			}
+
+			routes := newFilterTree(d.Filters)
+
+			shares := make(map[string]string, len(d.Shares))
+			for _, key := range d.Shares {
+				if f, ok := parseShare(key); ok {
+					shares[key] = f
+				}
+			}
+
+			// members not reporting weight balance as of default one
+			if d.Weight <= 0 {
+				d.Weight = defaultWeight
+			}
+
+			n.lock.Lock()
+			if m.in == conn {
+				m.routes = routes
+				m.filters = len(d.Filters)
+				m.shares = shares
+				m.weight = d.Weight
+			}
+			n.lock.Unlock()
+		case framePublish:
+			msg, e := decodePublish(body)
+			if e != nil {
+				n.log.prod.Error("Invalid routed message", zap.String("addr", m.addr), zap.Error(e))
+				continue
+			}
+
+			// routed messages are delivered locally only
+			if e = n.Provider.Publish(msg); e != nil {
+				n.log.prod.Error("Couldn't publish routed message", zap.String("addr", m.addr), zap.Error(e))
+			}
+		case frameShared:
+			key, msg, e := decodeShared(body)
+			if e != nil {
+				n.log.prod.Error("Invalid shared message", zap.String("addr", m.addr), zap.Error(e))
+				continue
+			}
+
+			// group might be withdrawn meanwhile, digest is on its way to member then
+			if !n.deliverShared(key, msg) {
+				n.log.dev.Debug("Shared message for unknown group", zap.String("addr", m.addr), zap.String("group", key))
+			}
+		case frameClaim:
+			if n.config.OnClaim == nil {
+				continue
+			}
+
+			// releasing session waits for its connection to close thus frames are not held
+			n.wg.Add(1)
+			go func(id string) {
+				defer n.wg.Done()
+				n.config.OnClaim(id)
+			}(string(body))
+		}
+	}
+}
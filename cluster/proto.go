@@ -0,0 +1,165 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/troian/surgemq/message"
+)
+
+// kinds of frames exchanged by nodes. Every frame is kind, big-endian length of body and body
+const (
+	// frameHello first frame of connection carrying hello in JSON
+	frameHello byte = iota + 1
+
+	// frameMembers addresses of members sender is connected to in JSON
+	frameMembers
+
+	// frameDigest subscription filters of sender in JSON
+	frameDigest
+
+	// framePublish message routed to receiver, see encodePublish
+	framePublish
+
+	// frameClaim id of client session has been started by sender
+	frameClaim
+
+	// frameShared message for shared subscription group of receiver, see encodeShared
+	frameShared
+)
+
+// maxFrame size of frame body, i.e. maximum MQTT packet plus topic and QoS
+const maxFrame = 256*1024*1024 + 64*1024
+
+var (
+	errFrameTooLarge = errors.New("cluster: frame too large")
+	errInvalidFrame  = errors.New("cluster: invalid frame")
+)
+
+// frame queued for member
+type frame struct {
+	kind byte
+	body []byte
+}
+
+// hello introduces node on connection
+type hello struct {
+	Name   string `json:"name"`
+	Addr   string `json:"addr"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// digest subscription filters of node. Version grows with every change
+type digest struct {
+	Version uint64   `json:"version"`
+	Filters []string `json:"filters"`
+
+	// Shares filters of shared subscription groups node has subscribers of
+	Shares []string `json:"shares,omitempty"`
+
+	// Weight of node in balancing of shared subscription groups
+	Weight int `json:"weight,omitempty"`
+}
+
+func writeFrame(w *bufio.Writer, kind byte, body []byte) error {
+	var hdr [5]byte
+	hdr[0] = kind
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(body)))
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(body)
+
+	return err
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if size > maxFrame {
+		return 0, nil, errFrameTooLarge
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+
+	return hdr[0], body, nil
+}
+
+// encodePublish QoS, length prefixed topic and payload of message
+// Packet id and flags are not routed as receiving node publishes message on its own
+func encodePublish(msg *message.PublishMessage) []byte {
+	topic := msg.Topic()
+
+	buf := make([]byte, 3+len(topic)+len(msg.Payload()))
+	buf[0] = byte(msg.QoS())
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(topic)))
+	copy(buf[3:], topic)
+	copy(buf[3+len(topic):], msg.Payload())
+
+	return buf
+}
+
+func decodePublish(buf []byte) (*message.PublishMessage, error) {
+	if len(buf) < 3 {
+		return nil, errInvalidFrame
+	}
+
+	size := int(binary.BigEndian.Uint16(buf[1:]))
+	if len(buf) < 3+size {
+		return nil, errInvalidFrame
+	}
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic(string(buf[3 : 3+size])); err != nil {
+		return nil, err
+	}
+
+	if err := msg.SetQoS(message.QosType(buf[0])); err != nil {
+		return nil, err
+	}
+
+	msg.SetPayload(buf[3+size:])
+
+	return msg, nil
+}
+
+// encodeShared length prefixed filter of group followed by message, see encodePublish
+func encodeShared(key string, msg *message.PublishMessage) []byte {
+	body := encodePublish(msg)
+
+	buf := make([]byte, 2+len(key)+len(body))
+	binary.BigEndian.PutUint16(buf, uint16(len(key)))
+	copy(buf[2:], key)
+	copy(buf[2+len(key):], body)
+
+	return buf
+}
+
+func decodeShared(buf []byte) (string, *message.PublishMessage, error) {
+	if len(buf) < 2 {
+		return "", nil, errInvalidFrame
+	}
+
+	size := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+size {
+		return "", nil, errInvalidFrame
+	}
+
+	msg, err := decodePublish(buf[2+size:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(buf[2 : 2+size]), msg, nil
+}
@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"strings"
+
+	topicsTypes "github.com/troian/surgemq/topics/types"
+)
+
+// filterTree subscription filters of member matched against topics of publishes
+type filterTree struct {
+	children map[string]*filterTree
+
+	// end filter ends at this level
+	end bool
+
+	// multi filter with # follows this level, thus matches it and all below
+	multi bool
+}
+
+func newFilterTree(filters []string) *filterTree {
+	t := &filterTree{}
+	for _, f := range filters {
+		t.insert(f)
+	}
+
+	return t
+}
+
+func (t *filterTree) insert(filter string) {
+	node := t
+	for _, level := range strings.Split(filter, "/") {
+		if level == topicsTypes.MWC {
+			node.multi = true
+			return
+		}
+
+		if node.children == nil {
+			node.children = make(map[string]*filterTree)
+		}
+
+		next, ok := node.children[level]
+		if !ok {
+			next = &filterTree{}
+			node.children[level] = next
+		}
+		node = next
+	}
+
+	node.end = true
+}
+
+// match either any filter matches topic
+func (t *filterTree) match(topic string) bool {
+	return t.matchLevels(strings.Split(topic, "/"))
+}
+
+func (t *filterTree) matchLevels(levels []string) bool {
+	// [MQTT-4.7.1-2] # matches parent level too
+	if t.multi {
+		return true
+	}
+
+	if len(levels) == 0 {
+		return t.end
+	}
+
+	if next, ok := t.children[levels[0]]; ok && next.matchLevels(levels[1:]) {
+		return true
+	}
+
+	if next, ok := t.children[topicsTypes.SWC]; ok && next.matchLevels(levels[1:]) {
+		return true
+	}
+
+	return false
+}
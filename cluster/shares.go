@@ -0,0 +1,201 @@
+package cluster
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+
+	"github.com/troian/surgemq/message"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	"github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+// sharePrefix of shared subscription filters, $share/<group>/<filter>
+const sharePrefix = "$share/"
+
+// shareGroup local subscribers of shared subscription group
+type shareGroup struct {
+	// filter of topics without $share/<group>/
+	filter string
+	subs   map[*types.Subscriber]message.QosType
+}
+
+// parseShare filter of shared subscription without $share/<group>/
+func parseShare(filter string) (string, bool) {
+	if !strings.HasPrefix(filter, sharePrefix) {
+		return "", false
+	}
+
+	rest := filter[len(sharePrefix):]
+
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 || i == len(rest)-1 || strings.ContainsAny(rest[:i], topicsTypes.MWC+topicsTypes.SWC) {
+		return "", false
+	}
+
+	return rest[i+1:], true
+}
+
+// score of candidate for key by weighted rendezvous hashing. Candidate of highest score
+// wins, thus key sticks to candidate as long as it's present regardless of others
+func score(key, candidate string, weight int) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))       // nolint: errcheck
+	h.Write([]byte{0})         // nolint: errcheck
+	h.Write([]byte(candidate)) // nolint: errcheck
+
+	// fnv is mixed as it distributes similar keys poorly
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+
+	return -float64(weight) / math.Log(u)
+}
+
+// subscriberID identifies subscriber across reconnects of its client
+func subscriberID(sub *types.Subscriber) string {
+	if sub.ID != "" {
+		return sub.ID
+	}
+
+	return fmt.Sprintf("%p", sub)
+}
+
+// pick subscriber of group message of given topic is delivered to
+func (g *shareGroup) pick(topic string) (*types.Subscriber, message.QosType) {
+	var best *types.Subscriber
+	var bestQoS message.QosType
+	bestScore := -1.0
+
+	for sub, qos := range g.subs {
+		if s := score(topic, subscriberID(sub), 1); s > bestScore {
+			best, bestQoS, bestScore = sub, qos, s
+		}
+	}
+
+	return best, bestQoS
+}
+
+// subscribeShared add subscriber to local group
+func (n *Node) subscribeShared(key, filter string, qos message.QosType, sub *types.Subscriber) {
+	n.lock.Lock()
+	g, ok := n.shares[key]
+	if !ok {
+		g = &shareGroup{filter: filter, subs: make(map[*types.Subscriber]message.QosType)}
+		n.shares[key] = g
+		n.version++
+	}
+	g.subs[sub] = qos
+	n.lock.Unlock()
+
+	if !ok {
+		n.digestChanged()
+	}
+}
+
+// unSubscribeShared remove subscriber from local group and withdraw group once it has none
+func (n *Node) unSubscribeShared(key string, sub *types.Subscriber) {
+	n.lock.Lock()
+	g, ok := n.shares[key]
+	if ok {
+		delete(g.subs, sub)
+		if len(g.subs) > 0 {
+			ok = false
+		} else {
+			delete(n.shares, key)
+			n.version++
+		}
+	}
+	n.lock.Unlock()
+
+	if ok {
+		n.digestChanged()
+	}
+}
+
+// publishShared deliver message to single subscriber of every group matching it. Node of
+// subscriber is chosen among members having subscribers of group by weight of nodes
+func (n *Node) publishShared(msg *message.PublishMessage) {
+	topic := msg.Topic()
+
+	// chosen link for key, nil if local subscriber has been chosen
+	targets := make(map[string]*link)
+	scores := make(map[string]float64)
+
+	consider := func(key, candidate string, weight int, l *link) {
+		s := score(key+"\x00"+topic, candidate, weight)
+		if best, ok := scores[key]; !ok || s > best {
+			scores[key] = s
+			targets[key] = l
+		}
+	}
+
+	n.lock.RLock()
+	for key, g := range n.shares {
+		if topicsTypes.Match(g.filter, topic) {
+			consider(key, n.advertise, n.config.Weight, nil)
+		}
+	}
+
+	if routed(topic) {
+		for _, m := range n.members {
+			for key, filter := range m.shares {
+				if topicsTypes.Match(filter, topic) {
+					consider(key, m.addr, m.weight, m.link)
+				}
+			}
+		}
+	}
+	n.lock.RUnlock()
+
+	for key, l := range targets {
+		if l == nil {
+			n.deliverShared(key, msg)
+		} else {
+			l.send(frameShared, encodeShared(key, msg))
+		}
+	}
+}
+
+// deliverShared message to local subscriber of group. Returns false if group has none
+func (n *Node) deliverShared(key string, msg *message.PublishMessage) bool {
+	var sub *types.Subscriber
+	var qos message.QosType
+
+	n.lock.RLock()
+	if g, ok := n.shares[key]; ok {
+		if sub, qos = g.pick(msg.Topic()); sub != nil {
+			sub.WgWriters.Add(1)
+		}
+	}
+	n.lock.RUnlock()
+
+	if sub == nil {
+		return false
+	}
+
+	defer sub.WgWriters.Done()
+
+	// message is delivered with QoS granted to subscriber if lower
+	if qos < msg.QoS() {
+		m := message.NewPublishMessage()
+		m.SetTopic(msg.Topic()) // nolint: errcheck
+		m.SetQoS(qos)           // nolint: errcheck
+		m.SetPayload(msg.Payload())
+		m.SetContext(msg.Context())
+		msg = m
+	}
+
+	if err := sub.Publish(msg); err != nil {
+		n.log.prod.Error("Couldn't deliver shared message", zap.String("group", key), zap.Error(err))
+	}
+
+	return true
+}
@@ -0,0 +1,478 @@
+// Package amqp bridges broker with AMQP 0-9-1 servers such as RabbitMQ. Publishes of
+// matching topics are sent to exchange as persistent messages and retried until confirmed
+// by server, messages of queues are published to broker and acknowledged afterwards
+// Connection is redialled until connector is closed
+package amqp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/connector"
+	"github.com/troian/surgemq/connector/types"
+	"github.com/troian/surgemq/message"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	sTypes "github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultName              = "amqp"
+	defaultBuffer            = 4096
+	defaultPrefetch          = 64
+	defaultReconnectInterval = 30 * time.Second
+
+	minReconnectInterval = time.Second
+	dialTimeout          = 10 * time.Second
+	heartbeat            = 10 * time.Second
+
+	// headerTopic of AMQP message carrying MQTT topic it was published to
+	headerTopic = "mqtt_topic"
+)
+
+var errNack = errors.New("amqp: publish not confirmed")
+
+type route struct {
+	c          *impl
+	filter     string
+	key        *types.Template
+	subscriber sTypes.Subscriber
+}
+
+type queue struct {
+	config types.AMQPQueue
+	topic  *types.Template
+}
+
+// outgoing publish of broker
+type outgoing struct {
+	topic string
+	key   string
+	body  []byte
+}
+
+type impl struct {
+	config types.AMQPConfig
+	topics topicsTypes.Provider
+
+	routes []*route
+	queues []*queue
+	queue  chan outgoing
+
+	// injected messages of AMQP being published to broker, not sent back
+	injected sync.Map
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// stat counters, updated atomically
+	connected int32
+	out       uint64
+	in        uint64
+	dropped   uint64
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+}
+
+var _ types.Connector = (*impl)(nil)
+var _ types.Forwarder = (*impl)(nil)
+
+func init() {
+	connector.Register((*types.AMQPConfig)(nil), func(config types.Config, topics topicsTypes.Provider) (types.Connector, error) { // nolint: errcheck, gas
+		return New(config.(*types.AMQPConfig), topics)
+	})
+}
+
+// New start bridging through topics provider. Server is dialled in background
+func New(config *types.AMQPConfig, topics topicsTypes.Provider) (types.Connector, error) {
+	if config.URL == "" || len(config.Routes)+len(config.Queues) == 0 || topics == nil {
+		return nil, types.ErrInvalidArgs
+	}
+
+	c := &impl{
+		config: *config,
+		topics: topics,
+	}
+
+	if c.config.Name == "" {
+		c.config.Name = defaultName
+	}
+
+	if c.config.Buffer <= 0 {
+		c.config.Buffer = defaultBuffer
+	}
+
+	if c.config.Prefetch <= 0 {
+		c.config.Prefetch = defaultPrefetch
+	}
+
+	if c.config.MaxReconnectInterval <= 0 {
+		c.config.MaxReconnectInterval = defaultReconnectInterval
+	}
+
+	c.log.prod = surgemq.GetProdLogger().Named("connector").Named(c.config.Name)
+	c.log.dev = surgemq.GetDevLogger().Named("connector").Named(c.config.Name)
+
+	for _, cfg := range c.config.Routes {
+		if cfg.Filter == "" {
+			return nil, types.ErrInvalidArgs
+		}
+
+		r := &route{
+			c:      c,
+			filter: cfg.Filter,
+		}
+
+		if cfg.RoutingKey != "" {
+			var err error
+			if r.key, err = types.ParseTemplate(cfg.RoutingKey); err != nil {
+				return nil, err
+			}
+		}
+
+		r.subscriber.Publish = r.onPublish
+		c.routes = append(c.routes, r)
+	}
+
+	for _, cfg := range c.config.Queues {
+		if cfg.Queue == "" {
+			return nil, types.ErrInvalidArgs
+		}
+
+		if cfg.MQTTTopic == "" {
+			cfg.MQTTTopic = "{topic}"
+		}
+
+		q := &queue{config: cfg}
+
+		var err error
+		if q.topic, err = types.ParseTemplate(cfg.MQTTTopic); err != nil {
+			return nil, err
+		}
+
+		c.queues = append(c.queues, q)
+	}
+
+	c.queue = make(chan outgoing, c.config.Buffer)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	for _, r := range c.routes {
+		if _, err := topics.Subscribe(r.filter, message.QoS2, &r.subscriber); err != nil {
+			c.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+	}
+
+	c.wg.Add(1)
+	go c.run()
+
+	c.log.prod.Info("AMQP connector started",
+		zap.Int("routes", len(c.routes)),
+		zap.Int("queues", len(c.queues)))
+
+	return c, nil
+}
+
+// Status of connector
+func (c *impl) Status() types.Status {
+	return types.Status{
+		Name:      c.config.Name,
+		Kind:      defaultName,
+		Connected: atomic.LoadInt32(&c.connected) == 1,
+		Out:       atomic.LoadUint64(&c.out),
+		In:        atomic.LoadUint64(&c.in),
+		Dropped:   atomic.LoadUint64(&c.dropped),
+	}
+}
+
+// Close stop bridging and disconnect. Unconfirmed and queued publishes are dropped,
+// unacknowledged messages of queues are redelivered by server
+func (c *impl) Close() error {
+	select {
+	case <-c.ctx.Done():
+		return types.ErrNotOpen
+	default:
+	}
+
+	for _, r := range c.routes {
+		c.topics.UnSubscribe(r.filter, &r.subscriber) // nolint: errcheck
+	}
+
+	c.cancel()
+	c.wg.Wait()
+
+	c.log.prod.Info("AMQP connector stopped")
+
+	return nil
+}
+
+// Forward queue message for server by first route
+func (c *impl) Forward(msg *message.PublishMessage) error {
+	if len(c.routes) == 0 {
+		return types.ErrNoRoute
+	}
+
+	c.routes[0].enqueue(msg)
+
+	return nil
+}
+
+// onPublish queue publish for server. Invoked by topics provider with locks held thus never blocks
+func (r *route) onPublish(msg *message.PublishMessage) error {
+	if _, ok := r.c.injected.Load(msg); !ok {
+		r.enqueue(msg)
+	}
+
+	return nil
+}
+
+func (r *route) enqueue(msg *message.PublishMessage) {
+	c := r.c
+
+	m := outgoing{
+		topic: msg.Topic(),
+		body:  msg.Payload(),
+	}
+
+	if r.key != nil {
+		m.key = r.key.Execute(types.TopicVars(msg.Topic()))
+	} else {
+		m.key = strings.Replace(msg.Topic(), "/", ".", -1)
+	}
+
+	select {
+	case c.queue <- m:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.prod.Warn("Queue full, message dropped", zap.String("topic", msg.Topic()))
+	}
+}
+
+// run keep connection to server until connector closed
+func (c *impl) run() {
+	defer c.wg.Done()
+
+	interval := minReconnectInterval
+
+	// pending publish not yet confirmed, sent again after reconnect
+	var pending *outgoing
+
+	for {
+		connected, err := c.session(&pending)
+		c.setConnected(false)
+
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		if connected {
+			interval = minReconnectInterval
+		}
+
+		c.log.prod.Error("Connection to AMQP server failed", zap.Error(err), zap.Duration("retry", interval))
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		if interval *= 2; interval > c.config.MaxReconnectInterval {
+			interval = c.config.MaxReconnectInterval
+		}
+	}
+}
+
+// session connect to server and bridge messages until connection fails
+// Returns either connection has been established
+func (c *impl) session(pending **outgoing) (bool, error) {
+	conn, err := amqp.DialConfig(c.config.URL, amqp.Config{
+		TLSClientConfig: c.config.TLS,
+		Heartbeat:       heartbeat,
+		Dial:            amqp.DefaultDial(dialTimeout),
+		Properties:      amqp.Table{"connection_name": c.config.Name},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	var consumers sync.WaitGroup
+
+	defer func() {
+		conn.Close() // nolint: errcheck, gas
+		consumers.Wait()
+	}()
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+
+	if err = ch.Confirm(false); err != nil {
+		return false, err
+	}
+
+	if c.config.ExchangeType != "" {
+		if err = ch.ExchangeDeclare(c.config.Exchange, c.config.ExchangeType, true, false, false, false, nil); err != nil {
+			return false, err
+		}
+	}
+
+	for _, q := range c.queues {
+		var deliveries <-chan amqp.Delivery
+		if deliveries, err = c.consume(conn, q); err != nil {
+			return false, err
+		}
+
+		consumers.Add(1)
+		go func(q *queue) {
+			defer consumers.Done()
+
+			for d := range deliveries {
+				c.deliver(q, &d)
+			}
+		}(q)
+	}
+
+	c.setConnected(true)
+	c.log.prod.Info("Connected to AMQP server")
+
+	for {
+		if *pending != nil {
+			if err = c.publish(ch, *pending); err != nil {
+				return true, err
+			}
+
+			*pending = nil
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return true, nil
+		case e := <-closed:
+			if e == nil {
+				return true, amqp.ErrClosed
+			}
+
+			return true, e
+		case m := <-c.queue:
+			*pending = &m
+		}
+	}
+}
+
+// consume open channel delivering messages of queue
+func (c *impl) consume(conn *amqp.Connection, q *queue) (<-chan amqp.Delivery, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ch.Qos(c.config.Prefetch, 0, false); err != nil {
+		return nil, err
+	}
+
+	if q.config.Binding != "" {
+		if _, err = ch.QueueDeclare(q.config.Queue, true, false, false, false, nil); err != nil {
+			return nil, err
+		}
+
+		if err = ch.QueueBind(q.config.Queue, q.config.Binding, c.config.Exchange, false, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return ch.Consume(q.config.Queue, c.config.Name, false, false, false, false, nil)
+}
+
+// publish message and wait for confirm of server
+func (c *impl) publish(ch *amqp.Channel, m *outgoing) error {
+	dc, err := ch.PublishWithDeferredConfirmWithContext(c.ctx, c.config.Exchange, m.key, false, false, amqp.Publishing{
+		Headers:      amqp.Table{headerTopic: m.topic},
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         m.body,
+	})
+	if err != nil {
+		return err
+	}
+
+	ack, err := dc.WaitContext(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	if !ack {
+		return errNack
+	}
+
+	atomic.AddUint64(&c.out, 1)
+
+	return nil
+}
+
+// deliver message of queue to broker and acknowledge it
+func (c *impl) deliver(q *queue, d *amqp.Delivery) {
+	topic := q.topic.Execute(func(name string) string {
+		switch name {
+		case "routing_key":
+			return d.RoutingKey
+		case "topic":
+			return strings.Replace(d.RoutingKey, ".", "/", -1)
+		case "exchange":
+			return d.Exchange
+		}
+
+		return ""
+	})
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic(topic); err != nil {
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.prod.Error("Invalid topic of AMQP message", zap.String("topic", topic), zap.Error(err))
+
+		// not redelivered, server dead letters it if configured
+		d.Reject(false) // nolint: errcheck
+		return
+	}
+
+	msg.SetQoS(q.config.QoS) // nolint: errcheck
+	msg.SetPayload(d.Body)
+
+	c.injected.Store(msg, struct{}{})
+	err := c.topics.Publish(msg)
+	c.injected.Delete(msg)
+
+	if err != nil {
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.prod.Error("Couldn't publish AMQP message", zap.String("topic", topic), zap.Error(err))
+		d.Reject(false) // nolint: errcheck
+		return
+	}
+
+	atomic.AddUint64(&c.in, 1)
+
+	if err = d.Ack(false); err != nil {
+		c.log.prod.Warn("Couldn't acknowledge AMQP message", zap.String("topic", topic), zap.Error(err))
+	}
+}
+
+func (c *impl) setConnected(ok bool) {
+	if ok {
+		atomic.StoreInt32(&c.connected, 1)
+	} else {
+		atomic.StoreInt32(&c.connected, 0)
+	}
+}
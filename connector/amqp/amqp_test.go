@@ -0,0 +1,67 @@
+package amqp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/connector/types"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/topics/mem"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+)
+
+func newPublish(t *testing.T, topic string) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic(topic))
+	msg.SetPayload([]byte("v"))
+
+	return msg
+}
+
+func TestRoutes(t *testing.T) {
+	topics, err := mem.NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	conn, err := New(&types.AMQPConfig{
+		URL:                  "amqp://127.0.0.1:1/",
+		MaxReconnectInterval: time.Minute,
+		Routes: []types.AMQPRoute{
+			{Filter: "devices/#"},
+			{Filter: "alerts/+", RoutingKey: "alert.{1}"},
+		},
+	}, topics)
+	require.NoError(t, err)
+
+	c := conn.(*impl)
+
+	require.NoError(t, topics.Publish(newPublish(t, "devices/d1/temp")))
+	require.NoError(t, topics.Publish(newPublish(t, "alerts/fire")))
+
+	// messages consumed from queues are not sent back
+	msg := newPublish(t, "devices/d2")
+	c.injected.Store(msg, struct{}{})
+	require.NoError(t, topics.Publish(msg))
+
+	require.Len(t, c.queue, 2)
+	require.Equal(t, outgoing{topic: "devices/d1/temp", key: "devices.d1.temp", body: []byte("v")}, <-c.queue)
+	require.Equal(t, outgoing{topic: "alerts/fire", key: "alert.fire", body: []byte("v")}, <-c.queue)
+
+	require.False(t, c.Status().Connected)
+	require.NoError(t, c.Close())
+	require.Equal(t, types.ErrNotOpen, c.Close())
+}
+
+func TestConfig(t *testing.T) {
+	topics, err := mem.NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	_, err = New(&types.AMQPConfig{URL: "amqp://127.0.0.1:1/"}, topics)
+	require.Equal(t, types.ErrInvalidArgs, err)
+
+	_, err = New(&types.AMQPConfig{
+		URL:    "amqp://127.0.0.1:1/",
+		Queues: []types.AMQPQueue{{Queue: "q", MQTTTopic: "{topic"}},
+	}, topics)
+	require.Equal(t, types.ErrInvalidTemplate, err)
+}
@@ -0,0 +1,67 @@
+// Package connector starts connectors streaming messages between broker and external systems
+// Connectors register themselves on init thus only imported ones are available, e.g.
+//
+//	import _ "github.com/troian/surgemq/connector/kafka"
+package connector
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/troian/surgemq/connector/types"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+)
+
+// Factory start connector of config publishing and subscribing through topics provider
+type Factory func(config types.Config, topics topicsTypes.Provider) (types.Connector, error)
+
+var factories = struct {
+	lock sync.RWMutex
+	list map[reflect.Type]Factory
+}{
+	list: make(map[reflect.Type]Factory),
+}
+
+// Register connector factory of config type, e.g. (*types.KafkaConfig)(nil)
+func Register(config types.Config, f Factory) error {
+	if config == nil || f == nil {
+		return types.ErrInvalidArgs
+	}
+
+	factories.lock.Lock()
+	defer factories.lock.Unlock()
+
+	t := reflect.TypeOf(config)
+	if _, ok := factories.list[t]; ok {
+		return types.ErrAlreadyExists
+	}
+
+	factories.list[t] = f
+
+	return nil
+}
+
+// UnRegister connector factory of config type
+func UnRegister(config types.Config) {
+	factories.lock.Lock()
+	delete(factories.list, reflect.TypeOf(config))
+	factories.lock.Unlock()
+}
+
+// New start connector publishing and subscribing through topics provider
+// Returns ErrUnknownConnector if connector of config is not registered
+func New(config types.Config, topics topicsTypes.Provider) (types.Connector, error) {
+	if config == nil {
+		return nil, types.ErrInvalidArgs
+	}
+
+	factories.lock.RLock()
+	f, ok := factories.list[reflect.TypeOf(config)]
+	factories.lock.RUnlock()
+
+	if !ok {
+		return nil, types.ErrUnknownConnector
+	}
+
+	return f(config, topics)
+}
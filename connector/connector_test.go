@@ -0,0 +1,43 @@
+package connector_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/connector"
+	"github.com/troian/surgemq/connector/types"
+	_ "github.com/troian/surgemq/connector/webhook"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+)
+
+type dummyConfig struct{}
+
+func TestNew(t *testing.T) {
+	_, err := connector.New(nil, nil)
+	require.Equal(t, types.ErrInvalidArgs, err)
+
+	_, err = connector.New(&dummyConfig{}, nil)
+	require.Equal(t, types.ErrUnknownConnector, err)
+
+	// imported connector is registered and validates its config
+	_, err = connector.New(&types.WebhookConfig{}, nil)
+	require.Equal(t, types.ErrInvalidArgs, err)
+}
+
+func TestRegister(t *testing.T) {
+	f := func(types.Config, topicsTypes.Provider) (types.Connector, error) { return nil, types.ErrNotOpen }
+
+	require.Equal(t, types.ErrInvalidArgs, connector.Register(nil, f))
+	require.Equal(t, types.ErrInvalidArgs, connector.Register((*dummyConfig)(nil), nil))
+	require.Equal(t, types.ErrAlreadyExists, connector.Register((*types.WebhookConfig)(nil), f))
+
+	require.NoError(t, connector.Register((*dummyConfig)(nil), f))
+
+	_, err := connector.New(&dummyConfig{}, nil)
+	require.Equal(t, types.ErrNotOpen, err)
+
+	connector.UnRegister((*dummyConfig)(nil))
+
+	_, err = connector.New(&dummyConfig{}, nil)
+	require.Equal(t, types.ErrUnknownConnector, err)
+}
@@ -0,0 +1,467 @@
+// Package kafka streams publishes of broker into Kafka topics and consumes Kafka topics
+// back into broker. Delivery is at least once in both directions: batches are written again
+// until acknowledged by all in-sync replicas, and offsets of consumed messages are
+// checkpointed only after messages have been published to broker
+package kafka
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/connector"
+	"github.com/troian/surgemq/connector/types"
+	"github.com/troian/surgemq/message"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	sTypes "github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultName           = "kafka"
+	defaultGroupID        = "surgemq"
+	defaultBuffer         = 4096
+	defaultBatchSize      = 100
+	defaultBatchTimeout   = 10 * time.Millisecond
+	defaultCommitInterval = time.Second
+
+	dialTimeout  = 10 * time.Second
+	retryBackoff = time.Second
+
+	// headerTopic of Kafka message carrying MQTT topic it was published to
+	headerTopic = "mqtt_topic"
+)
+
+type sink struct {
+	c          *impl
+	subscriber sTypes.Subscriber
+	filter     string
+	topic      *types.Template
+	key        *types.Template
+}
+
+type source struct {
+	topic     string
+	reader    *kafka.Reader
+	mqttTopic *types.Template
+	qos       message.QosType
+}
+
+type impl struct {
+	config types.KafkaConfig
+	topics topicsTypes.Provider
+	writer *kafka.Writer
+
+	sinks   []*sink
+	sources []*source
+	queue   chan kafka.Message
+
+	// injected messages of Kafka being published to broker, not streamed back
+	injected sync.Map
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// stat counters, updated atomically
+	connected int32
+	out       uint64
+	in        uint64
+	dropped   uint64
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+}
+
+var _ types.Connector = (*impl)(nil)
+var _ types.Forwarder = (*impl)(nil)
+
+func init() {
+	connector.Register((*types.KafkaConfig)(nil), func(config types.Config, topics topicsTypes.Provider) (types.Connector, error) { // nolint: errcheck, gas
+		return New(config.(*types.KafkaConfig), topics)
+	})
+}
+
+// New start streaming through topics provider
+func New(config *types.KafkaConfig, topics topicsTypes.Provider) (types.Connector, error) {
+	if len(config.Brokers) == 0 || topics == nil {
+		return nil, types.ErrInvalidArgs
+	}
+
+	c := &impl{
+		config: *config,
+		topics: topics,
+	}
+
+	if c.config.Name == "" {
+		c.config.Name = defaultName
+	}
+
+	if c.config.Buffer <= 0 {
+		c.config.Buffer = defaultBuffer
+	}
+
+	if c.config.BatchSize <= 0 {
+		c.config.BatchSize = defaultBatchSize
+	}
+
+	if c.config.BatchTimeout <= 0 {
+		c.config.BatchTimeout = defaultBatchTimeout
+	}
+
+	if c.config.CommitInterval <= 0 {
+		c.config.CommitInterval = defaultCommitInterval
+	}
+
+	c.log.prod = surgemq.GetProdLogger().Named("connector").Named(c.config.Name)
+	c.log.dev = surgemq.GetDevLogger().Named("connector").Named(c.config.Name)
+
+	for _, s := range c.config.Sinks {
+		if s.Filter == "" || s.Topic == "" {
+			return nil, types.ErrInvalidArgs
+		}
+
+		sk := &sink{
+			c:      c,
+			filter: s.Filter,
+		}
+
+		var err error
+		if sk.topic, err = types.ParseTemplate(s.Topic); err != nil {
+			return nil, err
+		}
+
+		if s.Key != "" {
+			if sk.key, err = types.ParseTemplate(s.Key); err != nil {
+				return nil, err
+			}
+		}
+
+		sk.subscriber.Publish = sk.onPublish
+		c.sinks = append(c.sinks, sk)
+	}
+
+	for _, s := range c.config.Sources {
+		if s.Topic == "" || s.MQTTTopic == "" {
+			return nil, types.ErrInvalidArgs
+		}
+
+		src := &source{
+			topic: s.Topic,
+			qos:   s.QoS,
+		}
+
+		var err error
+		if src.mqttTopic, err = types.ParseTemplate(s.MQTTTopic); err != nil {
+			return nil, err
+		}
+
+		c.sources = append(c.sources, src)
+	}
+
+	dialer := &kafka.Dialer{
+		Timeout:   dialTimeout,
+		DualStack: true,
+		TLS:       c.config.TLS,
+	}
+
+	transport := &kafka.Transport{
+		DialTimeout: dialTimeout,
+		TLS:         c.config.TLS,
+	}
+
+	if c.config.Username != "" {
+		mechanism := plain.Mechanism{
+			Username: c.config.Username,
+			Password: c.config.Password,
+		}
+
+		dialer.SASLMechanism = mechanism
+		transport.SASL = mechanism
+	}
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	if len(c.sinks) > 0 {
+		c.queue = make(chan kafka.Message, c.config.Buffer)
+		c.writer = &kafka.Writer{
+			Addr:         kafka.TCP(c.config.Brokers...),
+			Balancer:     &kafka.Hash{},
+			BatchSize:    c.config.BatchSize,
+			BatchTimeout: c.config.BatchTimeout,
+			RequiredAcks: kafka.RequireAll,
+			Transport:    transport,
+		}
+
+		c.wg.Add(1)
+		go c.writeWorker()
+	}
+
+	for i, s := range c.config.Sources {
+		groupID := s.GroupID
+		if groupID == "" {
+			groupID = defaultGroupID
+		}
+
+		src := c.sources[i]
+		src.reader = kafka.NewReader(kafka.ReaderConfig{
+			Brokers:        c.config.Brokers,
+			GroupID:        groupID,
+			Topic:          s.Topic,
+			Dialer:         dialer,
+			CommitInterval: c.config.CommitInterval,
+			StartOffset:    kafka.FirstOffset,
+		})
+
+		c.wg.Add(1)
+		go c.readWorker(src)
+	}
+
+	for _, s := range c.sinks {
+		if _, err := topics.Subscribe(s.filter, message.QoS2, &s.subscriber); err != nil {
+			c.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+	}
+
+	c.log.prod.Info("Kafka connector started",
+		zap.Strings("brokers", c.config.Brokers),
+		zap.Int("sinks", len(c.sinks)),
+		zap.Int("sources", len(c.sources)))
+
+	return c, nil
+}
+
+// Status of connector
+func (c *impl) Status() types.Status {
+	return types.Status{
+		Name:      c.config.Name,
+		Kind:      defaultName,
+		Connected: atomic.LoadInt32(&c.connected) == 1,
+		Out:       atomic.LoadUint64(&c.out),
+		In:        atomic.LoadUint64(&c.in),
+		Dropped:   atomic.LoadUint64(&c.dropped),
+	}
+}
+
+// Close stop streaming. Offsets of published messages are committed, queued publishes are dropped
+func (c *impl) Close() error {
+	select {
+	case <-c.ctx.Done():
+		return types.ErrNotOpen
+	default:
+	}
+
+	for _, s := range c.sinks {
+		c.topics.UnSubscribe(s.filter, &s.subscriber) // nolint: errcheck
+	}
+
+	c.cancel()
+	c.wg.Wait()
+
+	for _, s := range c.sources {
+		if err := s.reader.Close(); err != nil {
+			c.log.prod.Error("Couldn't close reader", zap.String("topic", s.topic), zap.Error(err))
+		}
+	}
+
+	if c.writer != nil {
+		if err := c.writer.Close(); err != nil {
+			c.log.prod.Error("Couldn't close writer", zap.Error(err))
+		}
+	}
+
+	c.log.prod.Info("Kafka connector stopped")
+
+	return nil
+}
+
+func (c *impl) setConnected(ok bool) {
+	if ok {
+		atomic.StoreInt32(&c.connected, 1)
+	} else {
+		atomic.StoreInt32(&c.connected, 0)
+	}
+}
+
+// Forward queue message for Kafka by first sink
+func (c *impl) Forward(msg *message.PublishMessage) error {
+	if len(c.sinks) == 0 {
+		return types.ErrNoRoute
+	}
+
+	c.sinks[0].enqueue(msg)
+
+	return nil
+}
+
+// onPublish queue publish for Kafka. Invoked by topics provider with locks held thus never blocks
+func (s *sink) onPublish(msg *message.PublishMessage) error {
+	if _, ok := s.c.injected.Load(msg); !ok {
+		s.enqueue(msg)
+	}
+
+	return nil
+}
+
+func (s *sink) enqueue(msg *message.PublishMessage) {
+	c := s.c
+
+	vars := types.TopicVars(msg.Topic())
+
+	m := kafka.Message{
+		Topic:   s.topic.Execute(vars),
+		Value:   msg.Payload(),
+		Headers: []kafka.Header{{Key: headerTopic, Value: []byte(msg.Topic())}},
+	}
+
+	if s.key != nil {
+		m.Key = []byte(s.key.Execute(vars))
+	}
+
+	select {
+	case c.queue <- m:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.prod.Warn("Queue full, message dropped", zap.String("topic", msg.Topic()))
+	}
+}
+
+// writeWorker write queued messages to Kafka in batches
+func (c *impl) writeWorker() {
+	defer c.wg.Done()
+
+	batch := make([]kafka.Message, 0, c.config.BatchSize)
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case m := <-c.queue:
+			batch = append(batch[:0], m)
+		}
+
+	fill:
+		for len(batch) < c.config.BatchSize {
+			select {
+			case m := <-c.queue:
+				batch = append(batch, m)
+			default:
+				break fill
+			}
+		}
+
+		if !c.write(batch) {
+			return
+		}
+	}
+}
+
+// write batch until every message is acknowledged. Returns false if connector closed meanwhile
+func (c *impl) write(batch []kafka.Message) bool {
+	for {
+		err := c.writer.WriteMessages(c.ctx, batch...)
+		if err == nil {
+			c.setConnected(true)
+			atomic.AddUint64(&c.out, uint64(len(batch)))
+			return true
+		}
+
+		// retry failed messages only
+		if errs, ok := err.(kafka.WriteErrors); ok && len(errs) == len(batch) {
+			failed := batch[:0]
+			for i, e := range errs {
+				if e != nil {
+					failed = append(failed, batch[i])
+				}
+			}
+
+			atomic.AddUint64(&c.out, uint64(len(batch)-len(failed)))
+			batch = failed
+		}
+
+		c.setConnected(false)
+		c.log.prod.Error("Couldn't write to Kafka", zap.Int("messages", len(batch)), zap.Error(err))
+
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-time.After(retryBackoff):
+		}
+	}
+}
+
+// readWorker publish messages of Kafka topic to broker and commit their offsets
+func (c *impl) readWorker(s *source) {
+	defer c.wg.Done()
+
+	for {
+		m, err := s.reader.FetchMessage(c.ctx)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+
+			c.setConnected(false)
+			c.log.prod.Error("Couldn't fetch from Kafka", zap.String("topic", s.topic), zap.Error(err))
+
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(retryBackoff):
+			}
+
+			continue
+		}
+
+		c.setConnected(true)
+
+		c.publish(s, &m)
+
+		// offset is checkpointed by reader every CommitInterval
+		if err = s.reader.CommitMessages(c.ctx, m); err != nil && c.ctx.Err() == nil {
+			c.log.prod.Error("Couldn't commit offset", zap.String("topic", s.topic), zap.Error(err))
+		}
+	}
+}
+
+func (c *impl) publish(s *source, m *kafka.Message) {
+	topic := s.mqttTopic.Execute(func(name string) string {
+		switch name {
+		case "topic":
+			return m.Topic
+		case "key":
+			return string(m.Key)
+		}
+
+		return ""
+	})
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic(topic); err != nil {
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.prod.Error("Invalid topic of Kafka message", zap.String("topic", topic), zap.Error(err))
+		return
+	}
+
+	msg.SetQoS(s.qos) // nolint: errcheck
+	msg.SetPayload(m.Value)
+
+	c.injected.Store(msg, struct{}{})
+	err := c.topics.Publish(msg)
+	c.injected.Delete(msg)
+
+	if err != nil {
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.prod.Error("Couldn't publish Kafka message", zap.String("topic", topic), zap.Error(err))
+		return
+	}
+
+	atomic.AddUint64(&c.in, 1)
+}
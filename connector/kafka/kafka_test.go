@@ -0,0 +1,92 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/connector/types"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/topics/mem"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	"go.uber.org/zap"
+)
+
+func newPublish(t *testing.T, topic string) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic(topic))
+	msg.SetPayload([]byte("v"))
+
+	return msg
+}
+
+func TestSink(t *testing.T) {
+	c := &impl{queue: make(chan kafka.Message, 1)}
+	c.log.prod = zap.NewNop()
+
+	topic, err := types.ParseTemplate("telemetry.{2}")
+	require.NoError(t, err)
+
+	key, err := types.ParseTemplate("{1}")
+	require.NoError(t, err)
+
+	s := &sink{c: c, topic: topic, key: key}
+
+	require.NoError(t, s.onPublish(newPublish(t, "devices/d1/temp")))
+
+	m := <-c.queue
+	require.Equal(t, "telemetry.temp", m.Topic)
+	require.Equal(t, "d1", string(m.Key))
+	require.Equal(t, "v", string(m.Value))
+	require.Equal(t, []kafka.Header{{Key: headerTopic, Value: []byte("devices/d1/temp")}}, m.Headers)
+
+	// messages consumed from Kafka are not streamed back
+	msg := newPublish(t, "devices/d1/temp")
+	c.injected.Store(msg, struct{}{})
+	require.NoError(t, s.onPublish(msg))
+	require.Len(t, c.queue, 0)
+
+	// overflow is dropped
+	require.NoError(t, s.onPublish(newPublish(t, "devices/d1/temp")))
+	require.NoError(t, s.onPublish(newPublish(t, "devices/d1/temp")))
+	require.Equal(t, uint64(1), c.Status().Dropped)
+}
+
+func TestConfig(t *testing.T) {
+	topics, err := mem.NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	_, err = New(&types.KafkaConfig{}, topics)
+	require.Equal(t, types.ErrInvalidArgs, err)
+
+	_, err = New(&types.KafkaConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Sinks:   []types.KafkaSink{{Filter: "a/#", Topic: "{1"}},
+	}, topics)
+	require.Equal(t, types.ErrInvalidTemplate, err)
+
+	c, err := New(&types.KafkaConfig{
+		Brokers: []string{"127.0.0.1:1"},
+		Sinks:   []types.KafkaSink{{Filter: "a/#", Topic: "a"}},
+		Sources: []types.KafkaSource{{Topic: "b", MQTTTopic: "kafka/{topic}"}},
+	}, topics)
+	require.NoError(t, err)
+
+	require.NoError(t, topics.Publish(newPublish(t, "a/b")))
+
+	done := make(chan struct{})
+	go func() {
+		require.NoError(t, c.Close())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "close blocked")
+	}
+
+	require.Equal(t, types.ErrNotOpen, c.Close())
+	require.False(t, c.Status().Connected)
+}
@@ -0,0 +1,186 @@
+package nats
+
+import (
+	"strings"
+
+	"github.com/troian/surgemq/connector/types"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+)
+
+// pattern of MQTT topic filter or NATS subject split into levels
+type pattern struct {
+	levels []string
+	single string
+	multi  string
+}
+
+func newTopicPattern(filter string) pattern {
+	return pattern{levels: strings.Split(filter, "/"), single: topicsTypes.SWC, multi: topicsTypes.MWC}
+}
+
+func newSubjectPattern(subject string) pattern {
+	return pattern{levels: strings.Split(subject, "."), single: "*", multi: ">"}
+}
+
+// wildcards of pattern in order, single ones as 1 and multi ones as 2
+func (p pattern) wildcards() ([]int, error) {
+	var res []int
+
+	for i, l := range p.levels {
+		switch l {
+		case p.single:
+			res = append(res, 1)
+		case p.multi:
+			if i != len(p.levels)-1 {
+				return nil, types.ErrInvalidArgs
+			}
+
+			res = append(res, 2)
+		case "":
+			return nil, types.ErrInvalidArgs
+		}
+	}
+
+	return res, nil
+}
+
+// capture levels matched by wildcards. Multi wildcard captures all remaining levels
+func (p pattern) capture(levels []string) ([][]string, bool) {
+	var res [][]string
+
+	for i, l := range p.levels {
+		if l == p.multi {
+			return append(res, levels[i:]), true
+		}
+
+		if i >= len(levels) {
+			return nil, false
+		}
+
+		if l == p.single {
+			res = append(res, levels[i:i+1])
+		} else if l != levels[i] {
+			return nil, false
+		}
+	}
+
+	return res, len(levels) == len(p.levels)
+}
+
+// build levels replacing wildcards by captured levels
+func (p pattern) build(captures [][]string) []string {
+	res := make([]string, 0, len(p.levels))
+
+	for _, l := range p.levels {
+		if l == p.single || l == p.multi {
+			res = append(res, captures[0]...)
+			captures = captures[1:]
+		} else {
+			res = append(res, l)
+		}
+	}
+
+	return res
+}
+
+// mapping between topic and subject of rule
+type mapping struct {
+	topic   pattern
+	subject pattern
+}
+
+// subjectOf filter converted to NATS subject
+func subjectOf(filter string) string {
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		switch l {
+		case topicsTypes.SWC:
+			levels[i] = "*"
+		case topicsTypes.MWC:
+			levels[i] = ">"
+		}
+	}
+
+	return strings.Join(levels, ".")
+}
+
+func newMapping(topic, subject string) (*mapping, error) {
+	if subject == "" {
+		subject = subjectOf(topic)
+	}
+
+	m := &mapping{
+		topic:   newTopicPattern(topic),
+		subject: newSubjectPattern(subject),
+	}
+
+	tw, err := m.topic.wildcards()
+	if err != nil {
+		return nil, err
+	}
+
+	sw, err := m.subject.wildcards()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tw) != len(sw) {
+		return nil, types.ErrInvalidArgs
+	}
+
+	for i := range tw {
+		if tw[i] != sw[i] {
+			return nil, types.ErrInvalidArgs
+		}
+	}
+
+	return m, nil
+}
+
+// toSubject map topic to subject. Returns false if topic does not match or any
+// of its levels is not valid token of subject
+func (m *mapping) toSubject(topic string) (string, bool) {
+	captures, ok := m.topic.capture(strings.Split(topic, "/"))
+	if !ok {
+		return "", false
+	}
+
+	for _, c := range captures {
+		for _, l := range c {
+			if l == "" || strings.ContainsAny(l, ".*> \t") {
+				return "", false
+			}
+		}
+	}
+
+	levels := m.subject.build(captures)
+	if len(levels) == 0 {
+		return "", false
+	}
+
+	return strings.Join(levels, "."), true
+}
+
+// toTopic map subject to topic. Returns false if subject does not match or any
+// of its tokens is not valid level of topic
+func (m *mapping) toTopic(subject string) (string, bool) {
+	captures, ok := m.subject.capture(strings.Split(subject, "."))
+	if !ok {
+		return "", false
+	}
+
+	for _, c := range captures {
+		for _, l := range c {
+			if strings.ContainsAny(l, "/+#") {
+				return "", false
+			}
+		}
+	}
+
+	levels := m.topic.build(captures)
+	if len(levels) == 0 {
+		return "", false
+	}
+
+	return strings.Join(levels, "/"), true
+}
@@ -0,0 +1,56 @@
+package nats
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/connector/types"
+)
+
+func TestMapping(t *testing.T) {
+	m, err := newMapping("sensors/+/temp", "edge.*.temperature")
+	require.NoError(t, err)
+
+	s, ok := m.toSubject("sensors/d1/temp")
+	require.True(t, ok)
+	require.Equal(t, "edge.d1.temperature", s)
+
+	topic, ok := m.toTopic("edge.d2.temperature")
+	require.True(t, ok)
+	require.Equal(t, "sensors/d2/temp", topic)
+
+	_, ok = m.toSubject("sensors/d1/hum")
+	require.False(t, ok)
+
+	// levels not valid as tokens are not mapped
+	_, ok = m.toSubject("sensors/d.1/temp")
+	require.False(t, ok)
+
+	m, err = newMapping("site/#", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"site", ">"}, m.subject.levels)
+
+	s, ok = m.toSubject("site/a/b")
+	require.True(t, ok)
+	require.Equal(t, "site.a.b", s)
+
+	topic, ok = m.toTopic("site.a.b.c")
+	require.True(t, ok)
+	require.Equal(t, "site/a/b/c", topic)
+
+	_, ok = m.toTopic("site.a/b")
+	require.False(t, ok)
+}
+
+func TestMappingInvalid(t *testing.T) {
+	for _, c := range [][2]string{
+		{"a/+", "a.>"},
+		{"a/#", "a.*"},
+		{"a/+/+", "a.*"},
+		{"a//b", ""},
+		{"a", "a.>.b"},
+	} {
+		_, err := newMapping(c[0], c[1])
+		require.Equal(t, types.ErrInvalidArgs, err, c)
+	}
+}
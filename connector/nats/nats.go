@@ -0,0 +1,282 @@
+// Package nats bridges broker with NATS subjects in both directions, thus broker can serve
+// devices at the edge of NATS based backend. Topics and subjects are mapped by rules and
+// connection is redialled until connector is closed
+package nats
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	natsio "github.com/nats-io/nats.go"
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/connector"
+	"github.com/troian/surgemq/connector/types"
+	"github.com/troian/surgemq/message"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	sTypes "github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultName              = "nats"
+	defaultReconnectInterval = 2 * time.Second
+)
+
+type rule struct {
+	c          *impl
+	config     types.NATSRule
+	mapping    *mapping
+	subscriber sTypes.Subscriber
+}
+
+type impl struct {
+	config types.NATSConfig
+	topics topicsTypes.Provider
+	conn   *natsio.Conn
+	rules  []*rule
+
+	// injected messages of NATS being published to broker, not sent back
+	injected sync.Map
+
+	quit chan struct{}
+
+	// stat counters, updated atomically
+	out     uint64
+	in      uint64
+	dropped uint64
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+}
+
+var _ types.Connector = (*impl)(nil)
+var _ types.Forwarder = (*impl)(nil)
+
+func init() {
+	connector.Register((*types.NATSConfig)(nil), func(config types.Config, topics topicsTypes.Provider) (types.Connector, error) { // nolint: errcheck, gas
+		return New(config.(*types.NATSConfig), topics)
+	})
+}
+
+// New connect to NATS and start bridging through topics provider
+func New(config *types.NATSConfig, topics topicsTypes.Provider) (types.Connector, error) {
+	if config.URL == "" || len(config.Rules) == 0 || topics == nil {
+		return nil, types.ErrInvalidArgs
+	}
+
+	c := &impl{
+		config: *config,
+		topics: topics,
+		quit:   make(chan struct{}),
+	}
+
+	if c.config.Name == "" {
+		c.config.Name = defaultName
+	}
+
+	if c.config.MaxReconnectInterval <= 0 {
+		c.config.MaxReconnectInterval = defaultReconnectInterval
+	}
+
+	c.log.prod = surgemq.GetProdLogger().Named("connector").Named(c.config.Name)
+	c.log.dev = surgemq.GetDevLogger().Named("connector").Named(c.config.Name)
+
+	for _, cfg := range c.config.Rules {
+		m, err := newMapping(cfg.Topic, cfg.Subject)
+		if err != nil {
+			return nil, err
+		}
+
+		r := &rule{
+			c:       c,
+			config:  cfg,
+			mapping: m,
+		}
+		r.subscriber.Publish = r.onPublish
+
+		c.rules = append(c.rules, r)
+	}
+
+	opts := []natsio.Option{
+		natsio.Name(c.config.Name),
+		natsio.MaxReconnects(-1),
+		natsio.ReconnectWait(c.config.MaxReconnectInterval),
+		natsio.RetryOnFailedConnect(true),
+		// own messages are not delivered back to subscriptions of connector
+		natsio.NoEcho(),
+		natsio.DisconnectErrHandler(func(_ *natsio.Conn, err error) {
+			c.log.prod.Warn("Connection to NATS lost", zap.Error(err))
+		}),
+		natsio.ReconnectHandler(func(nc *natsio.Conn) {
+			c.log.prod.Info("Reconnected to NATS", zap.String("url", nc.ConnectedUrl()))
+		}),
+		natsio.ErrorHandler(func(_ *natsio.Conn, _ *natsio.Subscription, err error) {
+			c.log.prod.Error("NATS error", zap.Error(err))
+		}),
+	}
+
+	if c.config.TLS != nil {
+		opts = append(opts, natsio.Secure(c.config.TLS))
+	}
+
+	if c.config.Username != "" {
+		opts = append(opts, natsio.UserInfo(c.config.Username, c.config.Password))
+	}
+
+	if c.config.Token != "" {
+		opts = append(opts, natsio.Token(c.config.Token))
+	}
+
+	var err error
+	if c.conn, err = natsio.Connect(c.config.URL, opts...); err != nil {
+		return nil, err
+	}
+
+	for _, r := range c.rules {
+		if r.config.Direction != types.Out {
+			subject := strings.Join(r.mapping.subject.levels, ".")
+			if _, err = c.conn.Subscribe(subject, r.onMessage); err != nil {
+				c.Close() // nolint: errcheck, gas
+				return nil, err
+			}
+		}
+
+		if r.config.Direction != types.In {
+			if _, err = topics.Subscribe(r.config.Topic, message.QoS2, &r.subscriber); err != nil {
+				c.Close() // nolint: errcheck, gas
+				return nil, err
+			}
+		}
+	}
+
+	c.log.prod.Info("NATS connector started", zap.String("url", c.config.URL), zap.Int("rules", len(c.rules)))
+
+	return c, nil
+}
+
+// Status of connector
+func (c *impl) Status() types.Status {
+	return types.Status{
+		Name:      c.config.Name,
+		Kind:      defaultName,
+		Connected: c.conn.IsConnected(),
+		Out:       atomic.LoadUint64(&c.out),
+		In:        atomic.LoadUint64(&c.in),
+		Dropped:   atomic.LoadUint64(&c.dropped),
+	}
+}
+
+// Close stop bridging. Messages buffered for NATS are flushed
+func (c *impl) Close() error {
+	select {
+	case <-c.quit:
+		return types.ErrNotOpen
+	default:
+	}
+
+	close(c.quit)
+
+	for _, r := range c.rules {
+		if r.config.Direction != types.In {
+			c.topics.UnSubscribe(r.config.Topic, &r.subscriber) // nolint: errcheck
+		}
+	}
+
+	if err := c.conn.Drain(); err != nil {
+		c.conn.Close()
+	}
+
+	c.log.prod.Info("NATS connector stopped")
+
+	return nil
+}
+
+// Forward send message to NATS by first outgoing rule. Topic not matching rule is sent to
+// subject of its levels separated by dots
+func (c *impl) Forward(msg *message.PublishMessage) error {
+	for _, r := range c.rules {
+		if r.config.Direction == types.In {
+			continue
+		}
+
+		subject, ok := r.mapping.toSubject(msg.Topic())
+		if !ok {
+			subject = strings.Replace(msg.Topic(), "/", ".", -1)
+		}
+
+		c.send(subject, msg)
+
+		return nil
+	}
+
+	return types.ErrNoRoute
+}
+
+// onPublish send publish of broker to NATS. Invoked by topics provider with locks held,
+// NATS client buffers messages, thus does not block
+func (r *rule) onPublish(msg *message.PublishMessage) error {
+	c := r.c
+
+	if _, ok := c.injected.Load(msg); ok {
+		return nil
+	}
+
+	subject, ok := r.mapping.toSubject(msg.Topic())
+	if !ok {
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.dev.Debug("Topic not mapped to subject", zap.String("topic", msg.Topic()))
+		return nil
+	}
+
+	c.send(subject, msg)
+
+	return nil
+}
+
+func (c *impl) send(subject string, msg *message.PublishMessage) {
+	if err := c.conn.Publish(subject, msg.Payload()); err != nil {
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.prod.Warn("Couldn't publish to NATS", zap.String("subject", subject), zap.Error(err))
+		return
+	}
+
+	atomic.AddUint64(&c.out, 1)
+}
+
+// onMessage publish message of NATS to broker
+func (r *rule) onMessage(m *natsio.Msg) {
+	c := r.c
+
+	topic, ok := r.mapping.toTopic(m.Subject)
+	if !ok {
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.dev.Debug("Subject not mapped to topic", zap.String("subject", m.Subject))
+		return
+	}
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic(topic); err != nil {
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.prod.Error("Invalid topic of NATS message", zap.String("topic", topic), zap.Error(err))
+		return
+	}
+
+	msg.SetQoS(r.config.QoS) // nolint: errcheck
+	msg.SetPayload(m.Data)
+
+	c.injected.Store(msg, struct{}{})
+	err := c.topics.Publish(msg)
+	c.injected.Delete(msg)
+
+	if err != nil {
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.prod.Error("Couldn't publish NATS message", zap.String("topic", topic), zap.Error(err))
+		return
+	}
+
+	atomic.AddUint64(&c.in, 1)
+}
@@ -0,0 +1,83 @@
+package types
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Template string with {name} placeholders, e.g. "devices.{1}"
+type Template struct {
+	literals []string
+	names    []string
+}
+
+// ParseTemplate parse template. Placeholders are replaced by Execute
+func ParseTemplate(s string) (*Template, error) {
+	t := &Template{}
+
+	for {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			if strings.IndexByte(s, '}') >= 0 {
+				return nil, ErrInvalidTemplate
+			}
+
+			t.literals = append(t.literals, s)
+
+			return t, nil
+		}
+
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 || strings.IndexByte(s[:open], '}') >= 0 || strings.IndexByte(s[open+1:open+end], '{') >= 0 {
+			return nil, ErrInvalidTemplate
+		}
+
+		t.literals = append(t.literals, s[:open])
+		t.names = append(t.names, s[open+1:open+end])
+		s = s[open+end+1:]
+	}
+}
+
+// Execute template replacing placeholders by values of vars
+func (t *Template) Execute(vars func(name string) string) string {
+	if len(t.names) == 0 {
+		return t.literals[0]
+	}
+
+	var b strings.Builder
+	for i, name := range t.names {
+		b.WriteString(t.literals[i])
+		b.WriteString(vars(name))
+	}
+
+	b.WriteString(t.literals[len(t.literals)-1])
+
+	return b.String()
+}
+
+// TopicVars placeholders of MQTT topic: {topic} is whole topic and {N} is its N-th level
+// counting from 0. Levels beyond topic are empty
+func TopicVars(topic string) func(name string) string {
+	var levels []string
+
+	return func(name string) string {
+		if name == "topic" {
+			return topic
+		}
+
+		i, err := strconv.Atoi(name)
+		if err != nil || i < 0 {
+			return ""
+		}
+
+		if levels == nil {
+			levels = strings.Split(topic, "/")
+		}
+
+		if i >= len(levels) {
+			return ""
+		}
+
+		return levels[i]
+	}
+}
@@ -0,0 +1,26 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplate(t *testing.T) {
+	tmpl, err := ParseTemplate("telemetry.{2}")
+	require.NoError(t, err)
+	require.Equal(t, "telemetry.temp", tmpl.Execute(TopicVars("devices/d1/temp")))
+
+	tmpl, err = ParseTemplate("{topic}|{0}|{5}|{x}")
+	require.NoError(t, err)
+	require.Equal(t, "a/b|a||", tmpl.Execute(TopicVars("a/b")))
+
+	tmpl, err = ParseTemplate("static")
+	require.NoError(t, err)
+	require.Equal(t, "static", tmpl.Execute(TopicVars("a")))
+
+	for _, s := range []string{"{", "}", "a}{0}", "{0", "{a{0}}"} {
+		_, err = ParseTemplate(s)
+		require.Equal(t, ErrInvalidTemplate, err, s)
+	}
+}
@@ -0,0 +1,81 @@
+// Package types of connectors streaming messages between broker and external systems
+package types
+
+import (
+	"errors"
+
+	"github.com/troian/surgemq/message"
+)
+
+var (
+	// ErrInvalidArgs invalid configuration of connector
+	ErrInvalidArgs = errors.New("connector: invalid arguments")
+
+	// ErrUnknownConnector configuration of unknown connector
+	ErrUnknownConnector = errors.New("connector: unknown connector")
+
+	// ErrAlreadyExists connector of config type is registered already
+	ErrAlreadyExists = errors.New("connector: already exists")
+
+	// ErrNotOpen connector has been closed
+	ErrNotOpen = errors.New("connector: not open")
+
+	// ErrInvalidTemplate template with unbalanced braces
+	ErrInvalidTemplate = errors.New("connector: invalid template")
+
+	// ErrNoRoute connector does not send messages to external system
+	ErrNoRoute = errors.New("connector: no outgoing route")
+)
+
+// Direction messages are streamed in
+type Direction int
+
+// Directions of rules
+const (
+	// Out streams publishes of broker to external system
+	Out Direction = iota
+
+	// In publishes messages of external system to broker
+	In
+
+	// Both streams messages in both directions
+	Both
+)
+
+// Config of connector, one of *Config types of this package
+type Config interface{}
+
+// Connector streams messages between broker and external system
+type Connector interface {
+	// Status of connector
+	Status() Status
+
+	// Close stop streaming and disconnect from external system
+	Close() error
+}
+
+// Forwarder connector accepting messages regardless of its filters, e.g. from rules
+type Forwarder interface {
+	// Forward send message to external system by first outgoing route of connector
+	// Must not block
+	Forward(msg *message.PublishMessage) error
+}
+
+// Status of connector
+type Status struct {
+	Name string
+
+	// Kind of external system, e.g. kafka
+	Kind string
+
+	Connected bool
+
+	// Out messages delivered to external system
+	Out uint64
+
+	// In messages of external system published to broker
+	In uint64
+
+	// Dropped messages not delivered as queue was full or external system refused them
+	Dropped uint64
+}
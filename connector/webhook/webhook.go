@@ -0,0 +1,361 @@
+// Package webhook POSTs publishes of matching topics to HTTP endpoints, thus simple
+// integrations need no MQTT client
+//
+// Batch of messages is POSTed as JSON array, payload is base64 encoded
+//
+//	[{"topic": "devices/d1/temp", "qos": 1, "payload": "MjE=", "time": "2017-08-01T12:00:00Z"}]
+//
+// Endpoint answers with status code
+//
+//	2xx            delivered
+//	408, 429, 5xx  retried with backoff
+//	other          dropped
+//
+// Transport errors and timeouts are retried as well
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/connector"
+	"github.com/troian/surgemq/connector/types"
+	"github.com/troian/surgemq/message"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	sTypes "github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultName             = "webhook"
+	defaultTimeout          = 5 * time.Second
+	defaultBatchSize        = 1
+	defaultBatchTimeout     = 100 * time.Millisecond
+	defaultMaxRetries       = 5
+	defaultRetryInterval    = time.Second
+	defaultMaxRetryInterval = time.Minute
+	defaultBuffer           = 4096
+)
+
+// entry of request body
+type entry struct {
+	Topic   string          `json:"topic"`
+	QoS     message.QosType `json:"qos"`
+	Payload []byte          `json:"payload"`
+	Time    time.Time       `json:"time"`
+
+	url string
+}
+
+type impl struct {
+	config types.WebhookConfig
+	topics topicsTypes.Provider
+	url    *types.Template
+
+	subscriber sTypes.Subscriber
+	queue      chan *entry
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// stat counters, updated atomically
+	connected int32
+	out       uint64
+	dropped   uint64
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+}
+
+var _ types.Connector = (*impl)(nil)
+var _ types.Forwarder = (*impl)(nil)
+
+func init() {
+	connector.Register((*types.WebhookConfig)(nil), func(config types.Config, topics topicsTypes.Provider) (types.Connector, error) { // nolint: errcheck, gas
+		return New(config.(*types.WebhookConfig), topics)
+	})
+}
+
+// New start POSTing publishes received through topics provider
+func New(config *types.WebhookConfig, topics topicsTypes.Provider) (types.Connector, error) {
+	if config.URL == "" || len(config.Filters) == 0 || topics == nil {
+		return nil, types.ErrInvalidArgs
+	}
+
+	c := &impl{
+		config: *config,
+		topics: topics,
+	}
+
+	if c.config.Name == "" {
+		c.config.Name = defaultName
+	}
+
+	if c.config.Timeout <= 0 {
+		c.config.Timeout = defaultTimeout
+	}
+
+	if c.config.BatchSize <= 0 {
+		c.config.BatchSize = defaultBatchSize
+	}
+
+	if c.config.BatchTimeout <= 0 {
+		c.config.BatchTimeout = defaultBatchTimeout
+	}
+
+	if c.config.MaxRetries == 0 {
+		c.config.MaxRetries = defaultMaxRetries
+	}
+
+	if c.config.RetryInterval <= 0 {
+		c.config.RetryInterval = defaultRetryInterval
+	}
+
+	if c.config.MaxRetryInterval <= 0 {
+		c.config.MaxRetryInterval = defaultMaxRetryInterval
+	}
+
+	if c.config.Buffer <= 0 {
+		c.config.Buffer = defaultBuffer
+	}
+
+	if c.config.Client == nil {
+		c.config.Client = http.DefaultClient
+	}
+
+	var err error
+	if c.url, err = types.ParseTemplate(c.config.URL); err != nil {
+		return nil, err
+	}
+
+	c.log.prod = surgemq.GetProdLogger().Named("connector").Named(c.config.Name)
+	c.log.dev = surgemq.GetDevLogger().Named("connector").Named(c.config.Name)
+
+	c.queue = make(chan *entry, c.config.Buffer)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.subscriber.Publish = c.onPublish
+
+	for _, f := range c.config.Filters {
+		if _, err = topics.Subscribe(f, message.QoS2, &c.subscriber); err != nil {
+			c.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+	}
+
+	c.wg.Add(1)
+	go c.worker()
+
+	c.log.prod.Info("Webhook connector started", zap.Strings("filters", c.config.Filters))
+
+	return c, nil
+}
+
+// Status of connector. Connected reports either last request succeeded
+func (c *impl) Status() types.Status {
+	return types.Status{
+		Name:      c.config.Name,
+		Kind:      defaultName,
+		Connected: atomic.LoadInt32(&c.connected) == 1,
+		Out:       atomic.LoadUint64(&c.out),
+		Dropped:   atomic.LoadUint64(&c.dropped),
+	}
+}
+
+// Close stop forwarding. Queued messages are dropped
+func (c *impl) Close() error {
+	select {
+	case <-c.ctx.Done():
+		return types.ErrNotOpen
+	default:
+	}
+
+	for _, f := range c.config.Filters {
+		c.topics.UnSubscribe(f, &c.subscriber) // nolint: errcheck
+	}
+
+	c.cancel()
+	c.wg.Wait()
+
+	c.log.prod.Info("Webhook connector stopped")
+
+	return nil
+}
+
+// Forward queue message for endpoint
+func (c *impl) Forward(msg *message.PublishMessage) error {
+	return c.onPublish(msg)
+}
+
+// onPublish queue publish. Invoked by topics provider with locks held thus never blocks
+func (c *impl) onPublish(msg *message.PublishMessage) error {
+	e := &entry{
+		Topic:   msg.Topic(),
+		QoS:     msg.QoS(),
+		Payload: msg.Payload(),
+		Time:    time.Now().UTC(),
+		url:     c.url.Execute(types.TopicVars(msg.Topic())),
+	}
+
+	select {
+	case c.queue <- e:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+		c.log.prod.Warn("Queue full, message dropped", zap.String("topic", msg.Topic()))
+	}
+
+	return nil
+}
+
+// worker collect batches and POST them grouped by URL in order of publishes
+func (c *impl) worker() {
+	defer c.wg.Done()
+
+	batch := make([]*entry, 0, c.config.BatchSize)
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case e := <-c.queue:
+			batch = append(batch[:0], e)
+		}
+
+		if len(batch) < c.config.BatchSize {
+			timer := time.NewTimer(c.config.BatchTimeout)
+
+		fill:
+			for len(batch) < c.config.BatchSize {
+				select {
+				case <-c.ctx.Done():
+					timer.Stop()
+					return
+				case e := <-c.queue:
+					batch = append(batch, e)
+				case <-timer.C:
+					break fill
+				}
+			}
+
+			timer.Stop()
+		}
+
+		for len(batch) > 0 {
+			url := batch[0].url
+
+			group := make([]*entry, 0, len(batch))
+			rest := batch[:0]
+			for _, e := range batch {
+				if e.url == url {
+					group = append(group, e)
+				} else {
+					rest = append(rest, e)
+				}
+			}
+
+			if !c.deliver(url, group) {
+				return
+			}
+
+			batch = rest
+		}
+	}
+}
+
+// deliver group of messages to url retrying failures. Returns false if connector closed meanwhile
+func (c *impl) deliver(url string, group []*entry) bool {
+	body, err := json.Marshal(group)
+	if err != nil {
+		atomic.AddUint64(&c.dropped, uint64(len(group)))
+		c.log.prod.Error("Couldn't encode messages", zap.Error(err))
+		return true
+	}
+
+	interval := c.config.RetryInterval
+
+	for attempt := 0; ; attempt++ {
+		retry, err := c.post(url, body)
+		if err == nil {
+			atomic.StoreInt32(&c.connected, 1)
+			atomic.AddUint64(&c.out, uint64(len(group)))
+			return true
+		}
+
+		atomic.StoreInt32(&c.connected, 0)
+
+		if c.ctx.Err() != nil {
+			return false
+		}
+
+		if !retry || (c.config.MaxRetries > 0 && attempt >= c.config.MaxRetries) {
+			atomic.AddUint64(&c.dropped, uint64(len(group)))
+			c.log.prod.Error("Webhook failed, messages dropped",
+				zap.String("url", url),
+				zap.Int("messages", len(group)),
+				zap.Error(err))
+			return true
+		}
+
+		c.log.dev.Debug("Webhook failed, retrying", zap.String("url", url), zap.Duration("retry", interval), zap.Error(err))
+
+		select {
+		case <-c.ctx.Done():
+			return false
+		case <-time.After(interval):
+		}
+
+		if interval *= 2; interval > c.config.MaxRetryInterval {
+			interval = c.config.MaxRetryInterval
+		}
+	}
+}
+
+// post body to url. Returns either failed request worth retrying
+func (c *impl) post(url string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.config.Timeout)
+	defer cancel()
+
+	r, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range c.config.Headers {
+		r.Header.Set(k, v)
+	}
+
+	resp, err := c.config.Client.Do(r.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close() // nolint: errcheck, gas
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return true, &statusError{code: resp.StatusCode}
+	default:
+		return false, &statusError{code: resp.StatusCode}
+	}
+}
+
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return "webhook: status " + strconv.Itoa(e.code)
+}
@@ -0,0 +1,136 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/connector/types"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/topics/mem"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+)
+
+type received struct {
+	path  string
+	batch []entry
+}
+
+func newServer(t *testing.T, status func(path string) int) (*httptest.Server, chan received) {
+	ch := make(chan received, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []entry
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		require.Equal(t, "secret", r.Header.Get("X-Token"))
+
+		code := status(r.URL.Path)
+		if code == http.StatusOK {
+			ch <- received{path: r.URL.Path, batch: batch}
+		}
+
+		w.WriteHeader(code)
+	}))
+
+	return srv, ch
+}
+
+func publish(t *testing.T, topics topicsTypes.Provider, topic string, payload string) {
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic(topic))
+	require.NoError(t, msg.SetQoS(message.QoS1))
+	msg.SetPayload([]byte(payload))
+
+	require.NoError(t, topics.Publish(msg))
+}
+
+func TestBatching(t *testing.T) {
+	srv, ch := newServer(t, func(string) int { return http.StatusOK })
+	defer srv.Close()
+
+	topics, err := mem.NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	c, err := New(&types.WebhookConfig{
+		Filters:      []string{"devices/#"},
+		URL:          srv.URL + "/hooks/{1}",
+		Headers:      map[string]string{"X-Token": "secret"},
+		BatchSize:    3,
+		BatchTimeout: time.Second,
+	}, topics)
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+
+	publish(t, topics, "devices/d1/temp", "1")
+	publish(t, topics, "devices/d2/temp", "2")
+	publish(t, topics, "devices/d1/temp", "3")
+	publish(t, topics, "other/d1", "4")
+
+	// batch is grouped by URL keeping order
+	r := <-ch
+	require.Equal(t, "/hooks/d1", r.path)
+	require.Len(t, r.batch, 2)
+	require.Equal(t, "devices/d1/temp", r.batch[0].Topic)
+	require.Equal(t, message.QoS1, r.batch[0].QoS)
+	require.Equal(t, "1", string(r.batch[0].Payload))
+	require.Equal(t, "3", string(r.batch[1].Payload))
+
+	r = <-ch
+	require.Equal(t, "/hooks/d2", r.path)
+	require.Len(t, r.batch, 1)
+
+	require.Eventually(t, func() bool { return c.Status().Out == 3 }, time.Second, time.Millisecond)
+	require.True(t, c.Status().Connected)
+}
+
+func TestRetry(t *testing.T) {
+	var lock sync.Mutex
+	failures := map[string]int{"/retry": 2}
+
+	srv, ch := newServer(t, func(path string) int {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if path == "/bad" {
+			return http.StatusBadRequest
+		}
+
+		if failures[path] > 0 {
+			failures[path]--
+			return http.StatusServiceUnavailable
+		}
+
+		return http.StatusOK
+	})
+	defer srv.Close()
+
+	topics, err := mem.NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	c, err := New(&types.WebhookConfig{
+		Filters:       []string{"+"},
+		URL:           srv.URL + "/{0}",
+		Headers:       map[string]string{"X-Token": "secret"},
+		RetryInterval: time.Millisecond,
+	}, topics)
+	require.NoError(t, err)
+
+	// rejected messages are not retried
+	publish(t, topics, "bad", "1")
+	publish(t, topics, "retry", "2")
+
+	select {
+	case r := <-ch:
+		require.Equal(t, "/retry", r.path)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "message not delivered")
+	}
+
+	require.Equal(t, uint64(1), c.Status().Dropped)
+	require.NoError(t, c.Close())
+	require.Equal(t, types.ErrNotOpen, c.Close())
+}
@@ -24,6 +24,8 @@ import (
 	"github.com/troian/surgemq"
 	"github.com/troian/surgemq/auth"
 	authTypes "github.com/troian/surgemq/auth/types"
+	// boltDB persistence provider
+	_ "github.com/troian/surgemq/persistence/boltdb"
 	persistType "github.com/troian/surgemq/persistence/types"
 	"github.com/troian/surgemq/server"
 	"github.com/troian/surgemq/types"
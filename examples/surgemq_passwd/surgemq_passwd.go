@@ -0,0 +1,107 @@
+// surgemq_passwd manages password file of passwd auth provider the same way mosquitto_passwd does
+//
+//	surgemq_passwd -c passwordfile username     create file with single user, password is prompted
+//	surgemq_passwd passwordfile username        add or update user
+//	surgemq_passwd -b passwordfile username pwd take password from command line
+//	surgemq_passwd -D passwordfile username     delete user
+//
+// Hashes are bcrypt unless -argon2 given. Running broker picks up changes on SIGHUP
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/troian/surgemq/auth/passwd"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-c | -D] [-b] [-argon2] passwordfile username [password]\n", os.Args[0]) // nolint: errcheck
+	os.Exit(2)
+}
+
+func main() {
+	create := flag.Bool("c", false, "create new password file, overwriting existing one")
+	del := flag.Bool("D", false, "delete user")
+	batch := flag.Bool("b", false, "take password from command line")
+	argon := flag.Bool("argon2", false, "hash with argon2id instead of bcrypt")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 || (*batch && len(args) != 3) || (!*batch && len(args) != 2) || (*create && *del) {
+		usage()
+	}
+
+	file, user := args[0], args[1]
+
+	users := make(map[string]string)
+	if !*create {
+		var err error
+		if users, err = passwd.Load(file); err != nil {
+			fail(err)
+		}
+	}
+
+	if *del {
+		if _, ok := users[user]; !ok {
+			fail(fmt.Errorf("user %q not found", user))
+		}
+
+		delete(users, user)
+	} else {
+		var password string
+		if *batch {
+			password = args[2]
+		} else {
+			password = prompt()
+		}
+
+		hash := passwd.HashBcrypt
+		if *argon {
+			hash = passwd.HashArgon2
+		}
+
+		h, err := hash(password)
+		if err != nil {
+			fail(err)
+		}
+
+		users[user] = h
+	}
+
+	if err := passwd.Store(file, users); err != nil {
+		fail(err)
+	}
+}
+
+// prompt password twice. Input is echoed as terminal is not put into raw mode
+func prompt() string {
+	r := bufio.NewReader(os.Stdin)
+
+	read := func(msg string) string {
+		fmt.Fprint(os.Stderr, msg) // nolint: errcheck
+		s, err := r.ReadString('\n')
+		if err != nil && s == "" {
+			fail(err)
+		}
+
+		return strings.TrimRight(s, "\r\n")
+	}
+
+	password := read("Password: ")
+	if read("Reenter password: ") != password {
+		fail(fmt.Errorf("passwords do not match"))
+	}
+
+	return password
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err) // nolint: errcheck
+	os.Exit(1)
+}
@@ -0,0 +1,363 @@
+// Package coap serves CoAP (RFC 7252) clients over UDP, mapping resources onto MQTT topics.
+// Gateway is transparent: each CoAP endpoint gets regular MQTT session on broker, so
+// authentication, ACLs and hooks of listener apply to it as well
+//
+// Gateway is a transport, served by broker as any other custom transport
+//
+//	gw, err := coap.Listen(coap.Config{Address: ":5683"})
+//	...
+//	srv.ListenAndServe(&server.ListenerTransport{Transport: gw})
+//
+// Topic is path of resource below prefix, e.g. coap://host/ps/sensors/temp is topic
+// sensors/temp. Methods map onto MQTT as following
+//
+//	PUT, POST    publish payload. Query parameters qos=0|1 and retain set publish options
+//	DELETE       clear retained message of topic
+//	GET          latest value of topic, retained message if not observed yet
+//	GET Observe  subscribe and get notified of every publish (RFC 7641)
+//
+// Credentials of session are taken from query parameters u, p and c (client id) of first
+// request of endpoint, or Username and Password of config
+package coap
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPrefix        = "ps"
+	defaultIdleTimeout   = 60 * time.Second
+	defaultRetainedWait  = 500 * time.Millisecond
+	defaultAckTimeout    = 2 * time.Second
+	defaultMaxRetransmit = 4
+
+	// keepAlive of MQTT sessions, gateway pings broker on behalf of endpoints
+	keepAlive = 60
+
+	// replyTimeout broker is waited for CONNACK, PUBACK, SUBACK and UNSUBACK within
+	replyTimeout = 5 * time.Second
+
+	maxDatagram   = 65535
+	inboundBuffer = 64
+)
+
+var (
+	// ErrNoAddress gateway configured without address
+	ErrNoAddress = errors.New("coap: address required")
+)
+
+// Config of gateway
+type Config struct {
+	// Address UDP address to listen on, e.g. ":5683"
+	Address string
+
+	// Prefix of resource paths mapped onto topics. If not set then default to "ps"
+	Prefix string
+
+	// Username and Password of sessions of endpoints not passing credentials in query
+	Username string
+	Password string
+
+	// IdleTimeout session of endpoint without observations is closed after. If not set
+	// then default to 60 seconds
+	IdleTimeout time.Duration
+
+	// RetainedWait retained message is waited for by GET and registration of observation.
+	// If not set then default to 500 milliseconds
+	RetainedWait time.Duration
+
+	// AckTimeout of confirmable notifications, doubled on every retransmission. If not set
+	// then default to 2 seconds
+	AckTimeout time.Duration
+
+	// MaxRetransmit of confirmable notification observation is cancelled after. If not set
+	// then default to 4
+	MaxRetransmit int
+}
+
+type gwAddr string
+
+func (a gwAddr) Network() string {
+	return "coap"
+}
+
+func (a gwAddr) String() string {
+	return string(a)
+}
+
+// pipeConn broker side of endpoint connection reporting addresses of UDP socket
+type pipeConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Gateway of CoAP endpoints
+type Gateway struct {
+	config Config
+	conn   *net.UDPConn
+
+	conns chan net.Conn
+
+	// id of last message sent
+	id uint32
+
+	lock     sync.Mutex
+	sessions map[string]*session
+
+	quit chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+}
+
+var _ types.Transport = (*Gateway)(nil)
+
+// Listen start receiving datagrams of endpoints. Endpoints connect once gateway served by broker
+func Listen(config Config) (*Gateway, error) {
+	if config.Address == "" {
+		return nil, ErrNoAddress
+	}
+
+	gw := &Gateway{
+		config:   config,
+		conns:    make(chan net.Conn),
+		id:       uint32(time.Now().UnixNano()),
+		sessions: make(map[string]*session),
+		quit:     make(chan struct{}),
+	}
+
+	if gw.config.Prefix == "" {
+		gw.config.Prefix = defaultPrefix
+	}
+
+	gw.config.Prefix = strings.Trim(gw.config.Prefix, "/")
+
+	if gw.config.IdleTimeout <= 0 {
+		gw.config.IdleTimeout = defaultIdleTimeout
+	}
+
+	if gw.config.RetainedWait <= 0 {
+		gw.config.RetainedWait = defaultRetainedWait
+	}
+
+	if gw.config.AckTimeout <= 0 {
+		gw.config.AckTimeout = defaultAckTimeout
+	}
+
+	if gw.config.MaxRetransmit <= 0 {
+		gw.config.MaxRetransmit = defaultMaxRetransmit
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if gw.conn, err = net.ListenUDP("udp", udpAddr); err != nil {
+		return nil, err
+	}
+
+	gw.log.prod = surgemq.GetProdLogger().Named("coap")
+	gw.log.dev = surgemq.GetDevLogger().Named("coap")
+
+	gw.wg.Add(1)
+	go gw.serve()
+
+	gw.log.prod.Info("CoAP gateway started", zap.String("address", gw.conn.LocalAddr().String()))
+
+	return gw, nil
+}
+
+// Accept waits for the next endpoint connecting to gateway
+func (gw *Gateway) Accept() (types.Conn, error) {
+	select {
+	case c := <-gw.conns:
+		return c, nil
+	case <-gw.quit:
+		return nil, types.ErrTransportClosed
+	}
+}
+
+// Close stop gateway and disconnect sessions of endpoints
+func (gw *Gateway) Close() error {
+	err := types.ErrTransportClosed
+
+	gw.once.Do(func() {
+		close(gw.quit)
+		err = gw.conn.Close()
+
+		gw.lock.Lock()
+		sessions := make([]*session, 0, len(gw.sessions))
+		for _, s := range gw.sessions {
+			sessions = append(sessions, s)
+		}
+		gw.lock.Unlock()
+
+		for _, s := range sessions {
+			s.close(true)
+		}
+
+		gw.wg.Wait()
+
+		gw.log.prod.Info("CoAP gateway stopped")
+	})
+
+	return err
+}
+
+// Addr UDP address of gateway with network "coap"
+func (gw *Gateway) Addr() net.Addr {
+	return gwAddr(gw.conn.LocalAddr().String())
+}
+
+// write packet to endpoint
+func (gw *Gateway) write(addr *net.UDPAddr, p *packet) {
+	if _, err := gw.conn.WriteToUDP(p.encode(), addr); err != nil {
+		gw.log.dev.Debug("Couldn't write datagram", zap.String("RemoteAddr", addr.String()), zap.Error(err))
+	}
+}
+
+// dial connection to broker. Returned connection is gateway side
+func (gw *Gateway) dial(remote net.Addr) (net.Conn, error) {
+	local, broker := net.Pipe()
+
+	select {
+	case gw.conns <- &pipeConn{Conn: broker, local: gw.conn.LocalAddr(), remote: remote}:
+		return local, nil
+	case <-gw.quit:
+		local.Close()  // nolint: errcheck, gas
+		broker.Close() // nolint: errcheck, gas
+		return nil, types.ErrTransportClosed
+	}
+}
+
+// serve datagrams of endpoints
+func (gw *Gateway) serve() {
+	defer gw.wg.Done()
+
+	buf := make([]byte, maxDatagram)
+
+	for {
+		n, addr, err := gw.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-gw.quit:
+				return
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() { // nolint: staticcheck
+				continue
+			}
+
+			gw.log.prod.Error("Couldn't read datagram", zap.Error(err))
+			return
+		}
+
+		p, err := decode(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			gw.log.dev.Debug("Invalid datagram", zap.String("RemoteAddr", addr.String()), zap.Error(err))
+			continue
+		}
+
+		gw.dispatch(addr, p)
+	}
+}
+
+// dispatch packet to session of endpoint it came from
+func (gw *Gateway) dispatch(addr *net.UDPAddr, p *packet) {
+	gw.lock.Lock()
+	s, ok := gw.sessions[addr.String()]
+	if !ok && p.isRequest() {
+		s = newSession(gw, addr)
+		gw.sessions[addr.String()] = s
+		ok = true
+
+		gw.wg.Add(1)
+		go s.run()
+	}
+	gw.lock.Unlock()
+
+	switch {
+	case p.typ == typeACK || p.typ == typeRST:
+		// answers to notifications are handled immediately as handler may wait for broker
+		if ok {
+			s.acked(p)
+		}
+	case !p.isRequest():
+		// empty CON is CoAP ping answered by RST, as any other unexpected message
+		if p.typ == typeCON {
+			gw.write(addr, &packet{typ: typeRST, id: p.id})
+		}
+	default:
+		select {
+		case s.in <- p:
+		default:
+			gw.log.prod.Warn("Endpoint too slow, request dropped", zap.String("RemoteAddr", addr.String()))
+			gw.write(addr, gw.reply(p, codeServiceUnavailable))
+		}
+	}
+}
+
+// remove session once it closed
+func (gw *Gateway) remove(s *session) {
+	gw.lock.Lock()
+	if gw.sessions[s.addr.String()] == s {
+		delete(gw.sessions, s.addr.String())
+	}
+	gw.lock.Unlock()
+}
+
+// topicOf request path below prefix
+func (gw *Gateway) topicOf(p *packet) (string, bool) {
+	path := p.path()
+	prefix := strings.Split(gw.config.Prefix, "/")
+
+	if len(path) <= len(prefix) {
+		return "", false
+	}
+
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return "", false
+		}
+	}
+
+	return strings.Join(path[len(prefix):], "/"), true
+}
+
+// nextID of message sent by gateway
+func (gw *Gateway) nextID() uint16 {
+	return uint16(atomic.AddUint32(&gw.id, 1))
+}
+
+// reply to request with code. CON request is answered by piggybacked ACK
+func (gw *Gateway) reply(req *packet, code byte) *packet {
+	if req.typ == typeCON {
+		return &packet{typ: typeACK, code: code, id: req.id, token: req.token}
+	}
+
+	return &packet{typ: typeNON, code: code, id: gw.nextID(), token: req.token}
+}
@@ -0,0 +1,319 @@
+package coap
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+)
+
+type coapClient struct {
+	t    *testing.T
+	conn *net.UDPConn
+	id   uint16
+}
+
+func newGateway(t *testing.T, config Config) *Gateway {
+	config.Address = "127.0.0.1:0"
+	config.RetainedWait = 100 * time.Millisecond
+	config.AckTimeout = 100 * time.Millisecond
+
+	gw, err := Listen(config)
+	require.NoError(t, err)
+
+	return gw
+}
+
+func dialGateway(t *testing.T, gw *Gateway) *coapClient {
+	conn, err := net.DialUDP("udp", nil, gw.conn.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+
+	return &coapClient{t: t, conn: conn}
+}
+
+// request of client to path with query parameters
+func (c *coapClient) request(code byte, path string, query ...string) *packet {
+	c.id++
+
+	p := &packet{typ: typeCON, code: code, id: c.id, token: []byte{byte(c.id), 0xAB}}
+	for _, seg := range bytes.Split([]byte(path), []byte("/")) {
+		p.addOption(optionURIPath, seg)
+	}
+
+	for _, q := range query {
+		p.addOption(optionURIQuery, []byte(q))
+	}
+
+	return p
+}
+
+func (c *coapClient) send(p *packet) {
+	_, err := c.conn.Write(p.encode())
+	require.NoError(c.t, err)
+}
+
+func (c *coapClient) recv(typ byte, code byte) *packet {
+	buf := make([]byte, maxDatagram)
+
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, err := c.conn.Read(buf)
+	require.NoError(c.t, err)
+
+	p, err := decode(buf[:n])
+	require.NoError(c.t, err)
+	require.Equal(c.t, typ, p.typ, "%+v", p)
+	require.Equal(c.t, code, p.code, "%+v", p)
+
+	return p
+}
+
+// accept connection of gateway acting as broker
+func accept(t *testing.T, gw *Gateway) net.Conn {
+	conn, err := gw.Accept()
+	require.NoError(t, err)
+
+	return conn.(net.Conn)
+}
+
+func brokerRecv(t *testing.T, conn net.Conn) message.Provider {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+
+	msg, err := message.ReadFrom(conn)
+	require.NoError(t, err)
+
+	return msg
+}
+
+func brokerSend(t *testing.T, conn net.Conn, msg message.Provider) {
+	require.NoError(t, message.WriteTo(conn, msg))
+}
+
+// connect session of client accepting it
+func connect(t *testing.T, gw *Gateway) net.Conn {
+	broker := accept(t, gw)
+
+	_, ok := brokerRecv(t, broker).(*message.ConnectMessage)
+	require.True(t, ok)
+
+	brokerSend(t, broker, message.NewConnAckMessage())
+
+	return broker
+}
+
+func publish(t *testing.T, topic string, qos message.QosType, id uint16, payload string) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic(topic))
+	require.NoError(t, msg.SetQoS(qos))
+	msg.SetPacketID(id)
+	msg.SetPayload([]byte(payload))
+
+	return msg
+}
+
+func TestPacketCodec(t *testing.T) {
+	p := &packet{typ: typeCON, code: codePUT, id: 0x1234, token: []byte{1, 2, 3}, payload: []byte("21")}
+	p.addOption(optionURIQuery, []byte("qos=1"))
+	p.addOption(optionURIPath, []byte("ps"))
+	p.addOption(optionURIPath, bytes.Repeat([]byte("a"), 20))
+	p.addOption(optionURIPath, bytes.Repeat([]byte("b"), 300))
+	p.addOption(optionObserve, uintValue(0))
+	p.addOption(300, []byte{1})
+
+	d, err := decode(p.encode())
+	require.NoError(t, err)
+	require.Equal(t, p.typ, d.typ)
+	require.Equal(t, p.code, d.code)
+	require.Equal(t, p.id, d.id)
+	require.Equal(t, p.token, d.token)
+	require.Equal(t, p.payload, d.payload)
+	require.Equal(t, []string{"ps", string(bytes.Repeat([]byte("a"), 20)), string(bytes.Repeat([]byte("b"), 300))}, d.path())
+
+	obs, ok := d.observe()
+	require.True(t, ok)
+	require.Equal(t, uint32(observeRegister), obs)
+
+	v, ok := d.query("qos")
+	require.True(t, ok)
+	require.Equal(t, "1", v)
+
+	_, ok = d.query("retain")
+	require.False(t, ok)
+
+	require.Equal(t, []byte{0x01, 0x00, 0x00}, uintValue(0x10000))
+
+	for _, buf := range [][]byte{
+		{0x40, 0x01},
+		{0x80, 0x01, 0x00, 0x01},
+		{0x49, 0x01, 0x00, 0x01},
+		{0x40, 0x01, 0x00, 0x01, 0xFF},
+		{0x40, 0x01, 0x00, 0x01, 0xB5, 'a'},
+		{0x40, 0x01, 0x00, 0x01, 0xF0},
+	} {
+		_, err = decode(buf)
+		require.Error(t, err, "%x", buf)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	gw := newGateway(t, Config{Username: "gw"})
+	defer gw.Close() // nolint: errcheck
+
+	c := dialGateway(t, gw)
+
+	req := c.request(codePUT, "ps/a/b", "c=dev1", "u=user", "p=secret", "qos=1", "retain")
+	req.payload = []byte("21")
+	c.send(req)
+
+	broker := accept(t, gw)
+	defer broker.Close() // nolint: errcheck
+
+	connect := brokerRecv(t, broker).(*message.ConnectMessage)
+	require.Equal(t, "dev1", string(connect.ClientID()))
+	require.Equal(t, "user", string(connect.Username()))
+	require.Equal(t, "secret", string(connect.Password()))
+	brokerSend(t, broker, message.NewConnAckMessage())
+
+	pub := brokerRecv(t, broker).(*message.PublishMessage)
+	require.Equal(t, "a/b", pub.Topic())
+	require.Equal(t, message.QoS1, pub.QoS())
+	require.True(t, pub.Retain())
+	require.Equal(t, "21", string(pub.Payload()))
+
+	ack := message.NewPubAckMessage()
+	ack.SetPacketID(pub.PacketID())
+	brokerSend(t, broker, ack)
+
+	resp := c.recv(typeACK, codeChanged)
+	require.Equal(t, req.id, resp.id)
+	require.Equal(t, req.token, resp.token)
+
+	// retransmitted request is answered again without publishing
+	c.send(req)
+	require.Equal(t, req.id, c.recv(typeACK, codeChanged).id)
+
+	// DELETE clears retained message
+	c.send(c.request(codeDELETE, "ps/a/b"))
+
+	pub = brokerRecv(t, broker).(*message.PublishMessage)
+	require.Equal(t, "a/b", pub.Topic())
+	require.True(t, pub.Retain())
+	require.Empty(t, pub.Payload())
+	c.recv(typeACK, codeDeleted)
+
+	// paths outside of prefix and wildcards are rejected
+	c.send(c.request(codePUT, "other/a"))
+	c.recv(typeACK, codeNotFound)
+
+	c.send(c.request(codePUT, "ps/a/+"))
+	c.recv(typeACK, codeBadRequest)
+
+	c.send(c.request(codePUT, "ps/a", "qos=2"))
+	c.recv(typeACK, codeBadRequest)
+}
+
+func TestObserve(t *testing.T) {
+	gw := newGateway(t, Config{})
+	defer gw.Close() // nolint: errcheck
+
+	c := dialGateway(t, gw)
+
+	req := c.request(codeGET, "ps/sensors/temp")
+	req.addOption(optionObserve, uintValue(observeRegister))
+	c.send(req)
+
+	broker := connect(t, gw)
+	defer broker.Close() // nolint: errcheck
+
+	sub := brokerRecv(t, broker).(*message.SubscribeMessage)
+	require.True(t, sub.TopicExists("sensors/temp"))
+
+	subAck := message.NewSubAckMessage()
+	subAck.SetPacketID(sub.PacketID())
+	require.NoError(t, subAck.AddReturnCode(message.QoS1))
+	brokerSend(t, broker, subAck)
+
+	// retained message answers registration
+	brokerSend(t, broker, publish(t, "sensors/temp", message.QoS0, 0, "20"))
+
+	resp := c.recv(typeACK, codeContent)
+	require.Equal(t, req.token, resp.token)
+	require.Equal(t, "20", string(resp.payload))
+
+	seq, ok := resp.observe()
+	require.True(t, ok)
+
+	// QoS 0 message is non-confirmable notification
+	brokerSend(t, broker, publish(t, "sensors/temp", message.QoS0, 0, "21"))
+
+	n := c.recv(typeNON, codeContent)
+	require.Equal(t, req.token, n.token)
+	require.Equal(t, "21", string(n.payload))
+
+	next, _ := n.observe()
+	require.True(t, next > seq)
+
+	// plain GET of observed topic is answered by latest value
+	c.send(c.request(codeGET, "ps/sensors/temp"))
+	require.Equal(t, "21", string(c.recv(typeACK, codeContent).payload))
+
+	// QoS 1 message is confirmable notification retransmitted until acknowledged
+	brokerSend(t, broker, publish(t, "sensors/temp", message.QoS1, 5, "22"))
+	require.Equal(t, message.PUBACK, brokerRecv(t, broker).Type())
+
+	n = c.recv(typeCON, codeContent)
+	require.Equal(t, "22", string(n.payload))
+
+	retry := c.recv(typeCON, codeContent)
+	require.Equal(t, n.id, retry.id)
+
+	c.send(&packet{typ: typeACK, id: n.id})
+
+	// rejected notification cancels observation
+	brokerSend(t, broker, publish(t, "sensors/temp", message.QoS0, 0, "23"))
+	n = c.recv(typeNON, codeContent)
+	c.send(&packet{typ: typeRST, id: n.id})
+
+	unsub := brokerRecv(t, broker).(*message.UnSubscribeMessage)
+	require.True(t, unsub.TopicExists("sensors/temp"))
+
+	// CoAP ping
+	c.send(&packet{typ: typeCON, id: 1000})
+	require.Equal(t, uint16(1000), c.recv(typeRST, codeEmpty).id)
+}
+
+func TestDenied(t *testing.T) {
+	gw := newGateway(t, Config{})
+	defer gw.Close() // nolint: errcheck
+
+	c := dialGateway(t, gw)
+
+	// refused session
+	c.send(c.request(codeGET, "ps/a"))
+
+	broker := accept(t, gw)
+	brokerRecv(t, broker)
+
+	ack := message.NewConnAckMessage()
+	require.NoError(t, ack.SetReturnCode(message.ErrNotAuthorized))
+	brokerSend(t, broker, ack)
+
+	c.recv(typeACK, codeUnauthorized)
+
+	// subscription denied by ACL
+	c.send(c.request(codeGET, "ps/a"))
+	broker = connect(t, gw)
+	defer broker.Close() // nolint: errcheck
+
+	sub := brokerRecv(t, broker).(*message.SubscribeMessage)
+
+	subAck := message.NewSubAckMessage()
+	subAck.SetPacketID(sub.PacketID())
+	require.NoError(t, subAck.AddReturnCode(message.QosFailure))
+	brokerSend(t, broker, subAck)
+
+	require.Equal(t, message.UNSUBSCRIBE, brokerRecv(t, broker).Type())
+	c.recv(typeACK, codeForbidden)
+}
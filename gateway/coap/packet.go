@@ -0,0 +1,270 @@
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+const version byte = 1
+
+// Types of CoAP messages
+const (
+	typeCON byte = 0
+	typeNON byte = 1
+	typeACK byte = 2
+	typeRST byte = 3
+)
+
+// Codes of requests and responses in form of class << 5 | detail
+const (
+	codeEmpty  byte = 0x00
+	codeGET    byte = 0x01
+	codePOST   byte = 0x02
+	codePUT    byte = 0x03
+	codeDELETE byte = 0x04
+
+	codeDeleted            byte = 2<<5 | 2
+	codeChanged            byte = 2<<5 | 4
+	codeContent            byte = 2<<5 | 5
+	codeBadRequest         byte = 4<<5 | 0
+	codeUnauthorized       byte = 4<<5 | 1
+	codeForbidden          byte = 4<<5 | 3
+	codeNotFound           byte = 4<<5 | 4
+	codeMethodNotAllowed   byte = 4<<5 | 5
+	codeInternalError      byte = 5<<5 | 0
+	codeServiceUnavailable byte = 5<<5 | 3
+	codeGatewayTimeout     byte = 5<<5 | 4
+)
+
+// Numbers of options
+const (
+	optionObserve  uint16 = 6
+	optionURIPath  uint16 = 11
+	optionURIQuery uint16 = 15
+)
+
+// Values of Observe option in requests
+const (
+	observeRegister   = 0
+	observeDeregister = 1
+)
+
+const payloadMarker byte = 0xFF
+
+var errInvalidPacket = errors.New("coap: invalid packet")
+
+type option struct {
+	num   uint16
+	value []byte
+}
+
+// packet of CoAP
+type packet struct {
+	typ     byte
+	code    byte
+	id      uint16
+	token   []byte
+	options []option
+	payload []byte
+}
+
+func (p *packet) isRequest() bool {
+	return p.code >= codeGET && p.code <= codeDELETE
+}
+
+// path of Uri-Path options
+func (p *packet) path() []string {
+	var res []string
+
+	for _, o := range p.options {
+		if o.num == optionURIPath {
+			res = append(res, string(o.value))
+		}
+	}
+
+	return res
+}
+
+// query parameter of Uri-Query options. Parameter without value is reported as present
+func (p *packet) query(name string) (string, bool) {
+	for _, o := range p.options {
+		if o.num != optionURIQuery {
+			continue
+		}
+
+		q := string(o.value)
+		if q == name {
+			return "", true
+		}
+
+		if strings.HasPrefix(q, name+"=") {
+			return q[len(name)+1:], true
+		}
+	}
+
+	return "", false
+}
+
+// observe value of Observe option
+func (p *packet) observe() (uint32, bool) {
+	for _, o := range p.options {
+		if o.num == optionObserve {
+			return uintOption(o.value), true
+		}
+	}
+
+	return 0, false
+}
+
+// addOption keeping options ordered
+func (p *packet) addOption(num uint16, value []byte) {
+	p.options = append(p.options, option{num: num, value: value})
+
+	sort.SliceStable(p.options, func(i, j int) bool {
+		return p.options[i].num < p.options[j].num
+	})
+}
+
+func uintOption(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+
+	return v
+}
+
+// uintValue of option with leading zero bytes dropped
+func uintValue(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+
+	return b
+}
+
+// decode datagram
+func decode(buf []byte) (*packet, error) {
+	if len(buf) < 4 || buf[0]>>6 != version {
+		return nil, errInvalidPacket
+	}
+
+	p := &packet{
+		typ:  (buf[0] >> 4) & 0x03,
+		code: buf[1],
+		id:   binary.BigEndian.Uint16(buf[2:]),
+	}
+
+	tkl := int(buf[0] & 0x0F)
+	if tkl > 8 || len(buf) < 4+tkl {
+		return nil, errInvalidPacket
+	}
+
+	p.token = buf[4 : 4+tkl]
+	b := buf[4+tkl:]
+
+	var num uint16
+
+	for len(b) > 0 {
+		if b[0] == payloadMarker {
+			if len(b) == 1 {
+				return nil, errInvalidPacket
+			}
+
+			p.payload = b[1:]
+			break
+		}
+
+		delta, length := int(b[0]>>4), int(b[0]&0x0F)
+		b = b[1:]
+
+		var err error
+		if delta, b, err = extended(delta, b); err != nil {
+			return nil, err
+		}
+
+		if length, b, err = extended(length, b); err != nil {
+			return nil, err
+		}
+
+		if len(b) < length || int(num)+delta > 0xFFFF {
+			return nil, errInvalidPacket
+		}
+
+		num += uint16(delta)
+		p.options = append(p.options, option{num: num, value: b[:length]})
+		b = b[length:]
+	}
+
+	return p, nil
+}
+
+// extended value of option delta or length nibble
+func extended(v int, b []byte) (int, []byte, error) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errInvalidPacket
+		}
+
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errInvalidPacket
+		}
+
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errInvalidPacket
+	}
+
+	return v, b, nil
+}
+
+// nibble of option delta or length and its extended bytes
+func nibble(v int) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		return 14, []byte{byte((v - 269) >> 8), byte(v - 269)}
+	}
+}
+
+// encode packet into datagram
+func (p *packet) encode() []byte {
+	b := make([]byte, 4, 16+len(p.token)+len(p.payload))
+
+	b[0] = version<<6 | p.typ<<4 | byte(len(p.token))
+	b[1] = p.code
+	binary.BigEndian.PutUint16(b[2:], p.id)
+	b = append(b, p.token...)
+
+	var num uint16
+
+	for _, o := range p.options {
+		d, dExt := nibble(int(o.num - num))
+		l, lExt := nibble(len(o.value))
+
+		b = append(b, d<<4|l)
+		b = append(b, dExt...)
+		b = append(b, lExt...)
+		b = append(b, o.value...)
+
+		num = o.num
+	}
+
+	if len(p.payload) > 0 {
+		b = append(b, payloadMarker)
+		b = append(b, p.payload...)
+	}
+
+	return b
+}
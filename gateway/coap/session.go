@@ -0,0 +1,703 @@
+package coap
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/troian/surgemq/message"
+	"go.uber.org/zap"
+)
+
+// recentSize responses to requests kept thus retransmitted requests are answered again
+const recentSize = 32
+
+// observer of topic registered by endpoint
+type observer struct {
+	token []byte
+	seq   uint32
+
+	// ready registration answered, notifications are sent
+	ready bool
+
+	// latest value of topic, got closed once first value received
+	value []byte
+	has   bool
+	got   chan struct{}
+
+	// id of last notification and confirmable one not acknowledged yet
+	id       uint16
+	pending  *packet
+	attempts int
+	timer    *time.Timer
+}
+
+func newObserver(token []byte) *observer {
+	return &observer{
+		token: append([]byte(nil), token...),
+		got:   make(chan struct{}),
+	}
+}
+
+// session of endpoint bound to session on broker
+type session struct {
+	gw   *Gateway
+	addr *net.UDPAddr
+	id   string
+
+	// requests of endpoint
+	in chan *packet
+
+	conn  net.Conn
+	wlock sync.Mutex
+
+	lock      sync.Mutex
+	observers map[string]*observer
+	replies   map[uint16]chan message.Provider
+	packetID  uint16
+
+	// responses to recent requests accessed by handler only
+	recent [recentSize]struct {
+		id   uint16
+		resp *packet
+	}
+	next int
+
+	// last request received
+	last time.Time
+
+	quit chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+func newSession(gw *Gateway, addr *net.UDPAddr) *session {
+	return &session{
+		gw:        gw,
+		addr:      addr,
+		in:        make(chan *packet, inboundBuffer),
+		observers: make(map[string]*observer),
+		replies:   make(map[uint16]chan message.Provider),
+		quit:      make(chan struct{}),
+	}
+}
+
+// run connect session and handle requests of endpoint until idle
+func (s *session) run() {
+	defer s.gw.wg.Done()
+
+	var p *packet
+
+	select {
+	case <-s.quit:
+		return
+	case p = <-s.in:
+	}
+
+	if code := s.connect(p); code != codeEmpty {
+		s.gw.write(s.addr, s.gw.reply(p, code))
+		s.close(false)
+		s.wg.Wait()
+		return
+	}
+
+	ping := time.NewTicker(keepAlive * time.Second / 2)
+	defer ping.Stop()
+
+	idle := time.NewTicker(s.gw.config.IdleTimeout / 2)
+	defer idle.Stop()
+
+	for {
+		if p != nil {
+			s.last = time.Now()
+			s.handle(p)
+			p = nil
+		}
+
+		select {
+		case <-s.quit:
+			s.wg.Wait()
+			return
+		case <-ping.C:
+			s.writeMessage(message.NewPingReqMessage()) // nolint: errcheck, gas
+		case <-idle.C:
+			if !s.observing() && time.Since(s.last) >= s.gw.config.IdleTimeout {
+				s.gw.log.dev.Debug("Session idle", zap.String("ClientID", s.id), zap.String("RemoteAddr", s.addr.String()))
+				s.close(true)
+			}
+		case p = <-s.in:
+		}
+	}
+}
+
+// connect session on broker with credentials of first request. Returns code of failure
+func (s *session) connect(p *packet) byte {
+	msg := message.NewConnectMessage()
+	msg.SetVersion(0x4) // nolint: errcheck
+	msg.SetCleanSession(true)
+	msg.SetKeepAlive(keepAlive)
+
+	var ok bool
+	if s.id, ok = p.query("c"); !ok {
+		s.id = clientID(s.addr)
+	}
+
+	if err := msg.SetClientID([]byte(s.id)); err != nil {
+		return codeBadRequest
+	}
+
+	username, password := s.gw.config.Username, s.gw.config.Password
+	if u, ok := p.query("u"); ok {
+		username = u
+		password, _ = p.query("p")
+	}
+
+	if username != "" {
+		msg.SetUsername([]byte(username))
+	}
+
+	if password != "" {
+		msg.SetPassword([]byte(password))
+	}
+
+	conn, err := s.gw.dial(s.addr)
+	if err != nil {
+		return codeServiceUnavailable
+	}
+
+	s.lock.Lock()
+	select {
+	case <-s.quit:
+		s.lock.Unlock()
+		conn.Close() // nolint: errcheck, gas
+		return codeServiceUnavailable
+	default:
+		s.conn = conn
+	}
+	s.lock.Unlock()
+
+	if err = s.writeMessage(msg); err != nil {
+		return codeServiceUnavailable
+	}
+
+	conn.SetReadDeadline(time.Now().Add(replyTimeout)) // nolint: errcheck, gas
+	resp, err := message.ReadFrom(conn)
+	conn.SetReadDeadline(time.Time{}) // nolint: errcheck, gas
+
+	if err != nil {
+		return codeGatewayTimeout
+	}
+
+	if ack, ok := resp.(*message.ConnAckMessage); !ok || ack.ReturnCode() != message.ConnectionAccepted {
+		s.gw.log.dev.Debug("Session refused", zap.String("ClientID", s.id), zap.String("RemoteAddr", s.addr.String()))
+		return codeUnauthorized
+	}
+
+	s.wg.Add(1)
+	go s.read()
+
+	return codeEmpty
+}
+
+// clientID of endpoint not passing one
+func clientID(addr *net.UDPAddr) string {
+	id := []byte("coap_" + addr.String())
+	for i, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			id[i] = '_'
+		}
+	}
+
+	return string(id)
+}
+
+// close session once. Observers are told observation ended, connection to broker is closed
+func (s *session) close(graceful bool) {
+	s.once.Do(func() {
+		s.gw.remove(s)
+
+		s.lock.Lock()
+		for topic, o := range s.observers {
+			if o.timer != nil {
+				o.timer.Stop()
+			}
+
+			if o.ready {
+				s.gw.write(s.addr, &packet{typ: typeNON, code: codeServiceUnavailable, id: s.gw.nextID(), token: o.token})
+			}
+
+			delete(s.observers, topic)
+		}
+		conn := s.conn
+		s.lock.Unlock()
+
+		if conn != nil && graceful {
+			s.writeMessage(message.NewDisconnectMessage()) // nolint: errcheck, gas
+		}
+
+		s.lock.Lock()
+		close(s.quit)
+		s.lock.Unlock()
+
+		if conn != nil {
+			conn.Close() // nolint: errcheck, gas
+		}
+	})
+}
+
+// handle request of endpoint answering retransmitted ones from recent responses
+func (s *session) handle(p *packet) {
+	for _, r := range s.recent {
+		if r.resp != nil && r.id == p.id {
+			if p.typ == typeCON {
+				s.gw.write(s.addr, r.resp)
+			}
+
+			return
+		}
+	}
+
+	resp := s.serve(p)
+
+	s.recent[s.next].id = p.id
+	s.recent[s.next].resp = resp
+	s.next = (s.next + 1) % recentSize
+
+	s.gw.write(s.addr, resp)
+}
+
+// serve request returning response
+func (s *session) serve(p *packet) *packet {
+	topic, ok := s.gw.topicOf(p)
+	if !ok {
+		return s.gw.reply(p, codeNotFound)
+	}
+
+	if !message.ValidTopic(topic) {
+		return s.gw.reply(p, codeBadRequest)
+	}
+
+	switch p.code {
+	case codePUT, codePOST, codeDELETE:
+		return s.publish(p, topic)
+	case codeGET:
+		if obs, ok := p.observe(); ok {
+			switch obs {
+			case observeRegister:
+				return s.observe(p, topic)
+			case observeDeregister:
+				return s.cancel(p, topic)
+			}
+		}
+
+		return s.get(p, topic)
+	}
+
+	return s.gw.reply(p, codeMethodNotAllowed)
+}
+
+// publish payload of request. DELETE clears retained message
+func (s *session) publish(p *packet, topic string) *packet {
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic(topic); err != nil {
+		return s.gw.reply(p, codeBadRequest)
+	}
+
+	code := codeChanged
+
+	if p.code == codeDELETE {
+		code = codeDeleted
+		msg.SetRetain(true)
+	} else {
+		v, ok := p.query("retain")
+		msg.SetRetain(ok && v != "0" && v != "false")
+		msg.SetPayload(p.payload)
+
+		switch v, _ = p.query("qos"); v {
+		case "", "0":
+		case "1":
+			msg.SetQoS(message.QoS1) // nolint: errcheck
+		default:
+			return s.gw.reply(p, codeBadRequest)
+		}
+	}
+
+	if msg.QoS() == message.QoS0 {
+		if err := s.writeMessage(msg); err != nil {
+			return s.gw.reply(p, codeServiceUnavailable)
+		}
+
+		return s.gw.reply(p, code)
+	}
+
+	id := s.nextPacketID()
+	msg.SetPacketID(id)
+
+	if _, failure := s.call(msg, id); failure != codeEmpty {
+		return s.gw.reply(p, failure)
+	}
+
+	return s.gw.reply(p, code)
+}
+
+// observe register observation of topic answering with retained message if any
+func (s *session) observe(p *packet, topic string) *packet {
+	s.lock.Lock()
+	o, ok := s.observers[topic]
+	if ok && o.ready {
+		// registration of observed topic replaces token
+		o.token = append([]byte(nil), p.token...)
+		resp := s.content(p, o)
+		s.lock.Unlock()
+
+		return resp
+	}
+
+	o = newObserver(p.token)
+	s.observers[topic] = o
+	s.lock.Unlock()
+
+	if code := s.subscribe(topic); code != codeEmpty {
+		s.lock.Lock()
+		delete(s.observers, topic)
+		s.lock.Unlock()
+
+		return s.gw.reply(p, code)
+	}
+
+	s.wait(o)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	o.ready = true
+
+	return s.content(p, o)
+}
+
+// content response to registration carrying sequence number of observer
+func (s *session) content(p *packet, o *observer) *packet {
+	resp := s.gw.reply(p, codeContent)
+	resp.addOption(optionObserve, uintValue(o.seq))
+	resp.payload = o.value
+
+	return resp
+}
+
+// cancel observation of topic answering with its latest value
+func (s *session) cancel(p *packet, topic string) *packet {
+	s.lock.Lock()
+	o, ok := s.observers[topic]
+	if ok {
+		delete(s.observers, topic)
+
+		if o.timer != nil {
+			o.timer.Stop()
+		}
+	}
+	s.lock.Unlock()
+
+	if !ok {
+		return s.get(p, topic)
+	}
+
+	s.unsubscribe(topic)
+
+	if !o.has {
+		return s.gw.reply(p, codeNotFound)
+	}
+
+	resp := s.gw.reply(p, codeContent)
+	resp.payload = o.value
+
+	return resp
+}
+
+// get latest value of topic. Topic not observed is subscribed for retained message only
+func (s *session) get(p *packet, topic string) *packet {
+	s.lock.Lock()
+	o, ok := s.observers[topic]
+	var value []byte
+	var has bool
+	if ok {
+		value, has = o.value, o.has
+	} else {
+		o = newObserver(nil)
+		s.observers[topic] = o
+	}
+	s.lock.Unlock()
+
+	if !ok {
+		code := s.subscribe(topic)
+		if code == codeEmpty {
+			s.wait(o)
+		}
+
+		s.lock.Lock()
+		delete(s.observers, topic)
+		value, has = o.value, o.has
+		s.lock.Unlock()
+
+		s.unsubscribe(topic)
+
+		if code != codeEmpty {
+			return s.gw.reply(p, code)
+		}
+	}
+
+	if !has {
+		return s.gw.reply(p, codeNotFound)
+	}
+
+	resp := s.gw.reply(p, codeContent)
+	resp.payload = value
+
+	return resp
+}
+
+// wait for first value of observer within retained wait
+func (s *session) wait(o *observer) {
+	timer := time.NewTimer(s.gw.config.RetainedWait)
+	defer timer.Stop()
+
+	select {
+	case <-o.got:
+	case <-timer.C:
+	case <-s.quit:
+	}
+}
+
+// subscribe topic. Returns code of failure
+func (s *session) subscribe(topic string) byte {
+	id := s.nextPacketID()
+
+	msg := message.NewSubscribeMessage()
+	msg.SetPacketID(id)
+
+	if err := msg.AddTopic(topic, message.QoS1); err != nil {
+		return codeBadRequest
+	}
+
+	resp, code := s.call(msg, id)
+	if code != codeEmpty {
+		return code
+	}
+
+	if ack, ok := resp.(*message.SubAckMessage); !ok || len(ack.ReturnCodes()) != 1 || ack.ReturnCodes()[0] == message.QosFailure {
+		return codeForbidden
+	}
+
+	return codeEmpty
+}
+
+// unsubscribe topic not waiting for acknowledgment
+func (s *session) unsubscribe(topic string) {
+	msg := message.NewUnSubscribeMessage()
+	msg.SetPacketID(s.nextPacketID())
+	msg.AddTopic(topic)
+
+	s.writeMessage(msg) // nolint: errcheck, gas
+}
+
+// call broker waiting for acknowledgment of message. Returns code of failure
+func (s *session) call(msg message.Provider, id uint16) (message.Provider, byte) {
+	reply := make(chan message.Provider, 1)
+
+	s.lock.Lock()
+	s.replies[id] = reply
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.replies, id)
+		s.lock.Unlock()
+	}()
+
+	if err := s.writeMessage(msg); err != nil {
+		return nil, codeServiceUnavailable
+	}
+
+	timer := time.NewTimer(replyTimeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-reply:
+		return resp, codeEmpty
+	case <-timer.C:
+		return nil, codeGatewayTimeout
+	case <-s.quit:
+		return nil, codeServiceUnavailable
+	}
+}
+
+func (s *session) nextPacketID() uint16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.packetID++
+	if s.packetID == 0 {
+		s.packetID = 1
+	}
+
+	return s.packetID
+}
+
+func (s *session) observing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.observers) > 0
+}
+
+// read messages of broker until connection closed
+func (s *session) read() {
+	defer s.wg.Done()
+
+	for {
+		msg, err := message.ReadFrom(s.conn)
+		if err != nil {
+			select {
+			case <-s.quit:
+			default:
+				s.gw.log.dev.Debug("Broker closed session", zap.String("ClientID", s.id), zap.Error(err))
+				s.close(false)
+			}
+
+			return
+		}
+
+		switch m := msg.(type) {
+		case *message.PublishMessage:
+			if m.QoS() == message.QoS1 {
+				ack := message.NewPubAckMessage()
+				ack.SetPacketID(m.PacketID())
+				s.writeMessage(ack) // nolint: errcheck, gas
+			}
+
+			s.notify(m)
+		case *message.PubAckMessage, *message.SubAckMessage, *message.UnSubAckMessage:
+			s.lock.Lock()
+			reply, ok := s.replies[msg.PacketID()]
+			s.lock.Unlock()
+
+			if ok {
+				select {
+				case reply <- msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// notify observer of topic of published message. Messages above QoS 0 are confirmable
+func (s *session) notify(msg *message.PublishMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	o, ok := s.observers[msg.Topic()]
+	if !ok {
+		return
+	}
+
+	o.value = msg.Payload()
+	if !o.has {
+		o.has = true
+		close(o.got)
+	}
+
+	if !o.ready {
+		return
+	}
+
+	// sequence number is 24 bits
+	o.seq = (o.seq + 1) & 0xFFFFFF
+
+	p := &packet{typ: typeNON, code: codeContent, id: s.gw.nextID(), token: o.token, payload: o.value}
+	p.addOption(optionObserve, uintValue(o.seq))
+	o.id = p.id
+
+	if msg.QoS() > message.QoS0 {
+		p.typ = typeCON
+
+		// newer notification replaces unacknowledged one
+		if o.timer != nil {
+			o.timer.Stop()
+		}
+
+		o.pending = p
+		o.attempts = 0
+		o.timer = time.AfterFunc(s.gw.config.AckTimeout, func() {
+			s.retransmit(msg.Topic(), o, p)
+		})
+	}
+
+	s.gw.write(s.addr, p)
+}
+
+// retransmit confirmable notification. Observation is cancelled once retransmissions exhausted
+func (s *session) retransmit(topic string, o *observer, p *packet) {
+	s.lock.Lock()
+
+	if s.observers[topic] != o || o.pending != p {
+		s.lock.Unlock()
+		return
+	}
+
+	if o.attempts >= s.gw.config.MaxRetransmit {
+		delete(s.observers, topic)
+		s.lock.Unlock()
+
+		s.gw.log.dev.Debug("Notification not acknowledged, observation cancelled",
+			zap.String("ClientID", s.id), zap.String("topic", topic))
+		s.unsubscribe(topic)
+
+		return
+	}
+
+	o.attempts++
+	o.timer = time.AfterFunc(s.gw.config.AckTimeout<<uint(o.attempts), func() {
+		s.retransmit(topic, o, p)
+	})
+
+	s.gw.write(s.addr, p)
+	s.lock.Unlock()
+}
+
+// acked notification by ACK or rejected by RST, the latter cancels observation
+func (s *session) acked(p *packet) {
+	s.lock.Lock()
+
+	for topic, o := range s.observers {
+		if !o.ready || o.id != p.id {
+			continue
+		}
+
+		if o.pending != nil {
+			o.timer.Stop()
+			o.pending = nil
+		}
+
+		if p.typ == typeRST {
+			delete(s.observers, topic)
+			s.lock.Unlock()
+
+			s.unsubscribe(topic)
+			return
+		}
+
+		break
+	}
+
+	s.lock.Unlock()
+}
+
+func (s *session) writeMessage(msg message.Provider) error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	// broker reads sessions continuously, stalled pipe means it is going away
+	s.conn.SetWriteDeadline(time.Now().Add(replyTimeout)) // nolint: errcheck, gas
+
+	return message.WriteTo(s.conn, msg)
+}
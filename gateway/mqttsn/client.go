@@ -0,0 +1,834 @@
+package mqttsn
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/troian/surgemq/message"
+	"go.uber.org/zap"
+)
+
+// States of client
+const (
+	stateConnecting int32 = iota
+	stateActive
+	stateAsleep
+)
+
+// How client is closed
+const (
+	// closeGraceful DISCONNECT is sent to broker and client
+	closeGraceful = iota
+
+	// closeRestart client connected again, DISCONNECT is sent to broker only
+	closeRestart
+
+	// closeLost client not heard within keep alive, connection to broker is dropped thus will is published
+	closeLost
+
+	// closeBroker broker closed connection, client is told it is disconnected
+	closeBroker
+)
+
+type eventKind int
+
+// Events of handler for sender
+const (
+	// evRegAck REGACK to REGISTER of gateway
+	evRegAck eventKind = iota
+
+	// evAcked client acknowledged PUBLISH or PUBREL of gateway
+	evAcked
+
+	// evWake PINGREQ of sleeping client, buffered messages are sent followed by PINGRESP
+	evWake
+
+	// evAwake CONNECT of sleeping client, CONNACK is sent followed by buffered messages
+	evAwake
+)
+
+type event struct {
+	kind  eventKind
+	msgID uint16
+	code  byte
+}
+
+// client of gateway bound to session on broker
+type client struct {
+	gw   *Gateway
+	addr *net.UDPAddr
+	id   string
+
+	// packets of client
+	in chan *packet
+
+	// events of handler for sender
+	events chan event
+
+	// messages of broker for sender
+	out chan message.Provider
+
+	conn  net.Conn
+	wlock sync.Mutex
+
+	state     int32
+	keepAlive time.Duration
+	sleep     time.Duration
+
+	// interval gateway pings broker with on behalf of sleeping client
+	ping time.Duration
+
+	// registry of topic ids and acknowledgments awaited from broker
+	lock   sync.Mutex
+	topics map[string]uint16
+	ids    map[uint16]string
+	nextID uint16
+	pubs   map[uint16]uint16
+	subs   map[uint16]uint16
+
+	quit chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+func newClient(gw *Gateway, addr *net.UDPAddr) *client {
+	return &client{
+		gw:     gw,
+		addr:   addr,
+		in:     make(chan *packet, inboundBuffer),
+		events: make(chan event, inboundBuffer),
+		out:    make(chan message.Provider),
+		topics: make(map[string]uint16),
+		ids:    make(map[uint16]string),
+		pubs:   make(map[uint16]uint16),
+		subs:   make(map[uint16]uint16),
+		quit:   make(chan struct{}),
+	}
+}
+
+// run connect client and handle its packets until disconnected
+func (c *client) run() {
+	defer c.gw.wg.Done()
+
+	var p *packet
+
+	select {
+	case <-c.quit:
+		return
+	case p = <-c.in:
+	}
+
+	if !c.connect(p) {
+		c.close(closeGraceful)
+		c.wg.Wait()
+		return
+	}
+
+	for {
+		// client is lost unless it sends anything within 1.5 times of keep alive or sleep duration
+		var timer *time.Timer
+		var expire <-chan time.Time
+
+		d := c.keepAlive
+		if atomic.LoadInt32(&c.state) == stateAsleep {
+			d = c.sleep
+		}
+
+		if d > 0 {
+			timer = time.NewTimer(d + d/2)
+			expire = timer.C
+		}
+
+		select {
+		case <-c.quit:
+		case <-expire:
+			c.gw.log.prod.Info("Client lost", zap.String("ClientID", c.id), zap.String("RemoteAddr", c.addr.String()))
+			c.close(closeLost)
+		case p = <-c.in:
+			c.handle(p)
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-c.quit:
+			c.wg.Wait()
+			return
+		default:
+		}
+	}
+}
+
+// connect negotiate will of client and start session on broker
+func (c *client) connect(p *packet) bool {
+	if p.typ != typeConnect {
+		return false
+	}
+
+	c.id = string(p.data)
+	c.keepAlive = time.Duration(p.duration) * time.Second
+
+	msg := message.NewConnectMessage()
+	msg.SetVersion(0x4) // nolint: errcheck
+	msg.SetCleanSession(p.flags&flagCleanSession != 0)
+
+	// session of client not using keep alive is kept by pings of gateway
+	keepAlive := p.duration
+	if keepAlive == 0 {
+		keepAlive = maxKeepAlive
+	}
+
+	msg.SetKeepAlive(keepAlive)
+	c.ping = time.Duration(keepAlive) * time.Second / 2
+	c.gw.credentials(msg)
+
+	if err := msg.SetClientID(p.data); err != nil {
+		c.gw.write(c.addr, &packet{typ: typeConnAck, code: codeNotSupported})
+		return false
+	}
+
+	if p.flags&flagWill != 0 {
+		wt := c.request(&packet{typ: typeWillTopicReq}, typeWillTopic)
+		if wt == nil {
+			return false
+		}
+
+		// empty will topic means no will
+		if len(wt.data) > 0 {
+			wm := c.request(&packet{typ: typeWillMsgReq}, typeWillMsg)
+			if wm == nil {
+				return false
+			}
+
+			msg.SetWillTopic(string(wt.data))
+			msg.SetWillMessage(wm.data)
+			msg.SetWillQos(subscribeQoS(wt.qos())) // nolint: errcheck
+			msg.SetWillRetain(wt.flags&flagRetain != 0)
+		}
+	}
+
+	conn, err := c.gw.dial(c.addr)
+	if err != nil {
+		return false
+	}
+
+	c.lock.Lock()
+	c.conn = conn
+	c.lock.Unlock()
+
+	c.wg.Add(2)
+	go c.read()
+	go c.send()
+
+	return c.writeMessage(msg) == nil
+}
+
+// request packet of client sending req until answered
+func (c *client) request(req *packet, typ byte) *packet {
+	for attempt := 0; attempt <= c.gw.config.MaxRetries; attempt++ {
+		c.gw.write(c.addr, req)
+
+		timer := time.NewTimer(c.gw.config.RetryInterval)
+
+	wait:
+		for {
+			select {
+			case <-c.quit:
+				timer.Stop()
+				return nil
+			case <-timer.C:
+				break wait
+			case p := <-c.in:
+				if p.typ == typ {
+					timer.Stop()
+					return p
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// close client once. Handler and sender exit, connection to broker is closed
+func (c *client) close(how int) {
+	c.once.Do(func() {
+		c.gw.remove(c)
+
+		c.lock.Lock()
+		conn := c.conn
+		c.lock.Unlock()
+
+		if how == closeGraceful || how == closeBroker {
+			c.gw.write(c.addr, &packet{typ: typeDisconnect})
+		}
+
+		if conn != nil && (how == closeGraceful || how == closeRestart) {
+			c.writeMessage(message.NewDisconnectMessage()) // nolint: errcheck, gas
+		}
+
+		close(c.quit)
+
+		if conn != nil {
+			conn.Close() // nolint: errcheck, gas
+		}
+	})
+}
+
+func (c *client) event(ev event) {
+	select {
+	case c.events <- ev:
+	case <-c.quit:
+	}
+}
+
+// handle packet of connected client
+func (c *client) handle(p *packet) {
+	switch p.typ {
+	case typeConnect:
+		if atomic.CompareAndSwapInt32(&c.state, stateAsleep, stateActive) {
+			c.event(event{kind: evAwake})
+			return
+		}
+
+		// client restarted, new session replaces this one
+		c.close(closeRestart)
+		c.gw.dispatch(c.addr, p)
+	case typeRegister:
+		topic := string(p.data)
+		if !message.ValidTopic(topic) {
+			c.gw.write(c.addr, &packet{typ: typeRegAck, msgID: p.msgID, code: codeNotSupported})
+			return
+		}
+
+		c.gw.write(c.addr, &packet{typ: typeRegAck, topicID: c.register(topic), msgID: p.msgID, code: codeAccepted})
+	case typeRegAck:
+		c.event(event{kind: evRegAck, msgID: p.msgID, code: p.code})
+	case typePublish:
+		c.publish(p)
+	case typePubAck:
+		c.event(event{kind: evAcked, msgID: p.msgID})
+
+		ack := message.NewPubAckMessage()
+		ack.SetPacketID(p.msgID)
+		c.writeMessage(ack) // nolint: errcheck, gas
+	case typePubRec:
+		c.event(event{kind: evAcked, msgID: p.msgID})
+
+		rec := message.NewPubRecMessage()
+		rec.SetPacketID(p.msgID)
+		c.writeMessage(rec) // nolint: errcheck, gas
+	case typePubRel:
+		rel := message.NewPubRelMessage()
+		rel.SetPacketID(p.msgID)
+		c.writeMessage(rel) // nolint: errcheck, gas
+	case typePubComp:
+		c.event(event{kind: evAcked, msgID: p.msgID})
+
+		comp := message.NewPubCompMessage()
+		comp.SetPacketID(p.msgID)
+		c.writeMessage(comp) // nolint: errcheck, gas
+	case typeSubscribe:
+		c.subscribe(p)
+	case typeUnsubscribe:
+		topic, ok := c.topicOf(p)
+		if !ok {
+			c.gw.write(c.addr, &packet{typ: typeUnsubAck, msgID: p.msgID})
+			return
+		}
+
+		msg := message.NewUnSubscribeMessage()
+		msg.SetPacketID(p.msgID)
+		msg.AddTopic(topic)
+		c.writeMessage(msg) // nolint: errcheck, gas
+	case typePingReq:
+		if atomic.LoadInt32(&c.state) == stateAsleep {
+			c.event(event{kind: evWake})
+			return
+		}
+
+		c.writeMessage(message.NewPingReqMessage()) // nolint: errcheck, gas
+	case typeDisconnect:
+		if p.duration > 0 {
+			c.sleep = time.Duration(p.duration) * time.Second
+			atomic.StoreInt32(&c.state, stateAsleep)
+			c.gw.write(c.addr, &packet{typ: typeDisconnect})
+			return
+		}
+
+		c.close(closeGraceful)
+	case typeWillTopicUpd:
+		// will of MQTT 3.1.1 session cannot be changed
+		c.gw.write(c.addr, &packet{typ: typeWillTopicResp, code: codeNotSupported})
+	case typeWillMsgUpd:
+		c.gw.write(c.addr, &packet{typ: typeWillMsgResp, code: codeNotSupported})
+	}
+}
+
+// publish message of client to broker
+func (c *client) publish(p *packet) {
+	topic, ok := c.topicOf(p)
+	if !ok {
+		c.gw.write(c.addr, &packet{typ: typePubAck, topicID: p.topicID, msgID: p.msgID, code: codeInvalidTopicID})
+		return
+	}
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic(topic); err != nil {
+		c.gw.write(c.addr, &packet{typ: typePubAck, topicID: p.topicID, msgID: p.msgID, code: codeNotSupported})
+		return
+	}
+
+	qos := message.QosType(p.qos())
+
+	msg.SetQoS(qos) // nolint: errcheck
+	msg.SetDup(p.flags&flagDup != 0)
+	msg.SetRetain(p.flags&flagRetain != 0)
+	msg.SetPayload(p.data)
+
+	if qos > message.QoS0 {
+		msg.SetPacketID(p.msgID)
+
+		c.lock.Lock()
+		c.pubs[p.msgID] = p.topicID
+		c.lock.Unlock()
+	}
+
+	c.writeMessage(msg) // nolint: errcheck, gas
+}
+
+// subscribe client to topic. Topic id of SUBACK is assigned unless topic has wildcards
+func (c *client) subscribe(p *packet) {
+	topic, ok := c.topicOf(p)
+	if !ok {
+		c.gw.write(c.addr, &packet{typ: typeSubAck, msgID: p.msgID, code: codeInvalidTopicID})
+		return
+	}
+
+	var id uint16
+
+	switch p.topicType() {
+	case topicNormal:
+		if message.ValidTopic(topic) {
+			id = c.register(topic)
+		}
+	case topicPredefined:
+		id = p.topicID
+	}
+
+	msg := message.NewSubscribeMessage()
+	msg.SetPacketID(p.msgID)
+
+	if err := msg.AddTopic(topic, subscribeQoS(p.qos())); err != nil {
+		c.gw.write(c.addr, &packet{typ: typeSubAck, msgID: p.msgID, code: codeNotSupported})
+		return
+	}
+
+	c.lock.Lock()
+	c.subs[p.msgID] = id
+	c.lock.Unlock()
+
+	c.writeMessage(msg) // nolint: errcheck, gas
+}
+
+// topicOf packet carrying topic id or name
+func (c *client) topicOf(p *packet) (string, bool) {
+	switch p.topicType() {
+	case topicNormal:
+		if p.typ == typeSubscribe || p.typ == typeUnsubscribe {
+			return string(p.data), len(p.data) > 0
+		}
+
+		c.lock.Lock()
+		topic, ok := c.ids[p.topicID]
+		c.lock.Unlock()
+
+		return topic, ok
+	default:
+		return c.gw.topicOf(p.topicType(), p.topicID)
+	}
+}
+
+// register topic returning its id
+func (c *client) register(topic string) uint16 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if id, ok := c.topics[topic]; ok {
+		return id
+	}
+
+	for {
+		// 0x0000 and 0xFFFF are reserved
+		if c.nextID++; c.nextID == 0xFFFF {
+			c.nextID = 1
+		}
+
+		if _, ok := c.ids[c.nextID]; !ok {
+			break
+		}
+	}
+
+	c.topics[topic] = c.nextID
+	c.ids[c.nextID] = topic
+
+	return c.nextID
+}
+
+func (c *client) unregister(topic string) {
+	c.lock.Lock()
+	if id, ok := c.topics[topic]; ok {
+		delete(c.topics, topic)
+		delete(c.ids, id)
+	}
+	c.lock.Unlock()
+}
+
+// registered topic id and its type, false if topic has to be registered first
+func (c *client) registered(topic string) (uint16, byte, bool) {
+	if id, ok := c.gw.predefinedID(topic); ok {
+		return id, topicPredefined, true
+	}
+
+	if len(topic) == 2 {
+		return shortID(topic), topicShort, true
+	}
+
+	c.lock.Lock()
+	id, ok := c.topics[topic]
+	c.lock.Unlock()
+
+	return id, topicNormal, ok
+}
+
+// read messages of broker for sender
+func (c *client) read() {
+	defer c.wg.Done()
+
+	for {
+		msg, err := message.ReadFrom(c.conn)
+		if err != nil {
+			// refused client already got CONNACK
+			if atomic.LoadInt32(&c.state) == stateConnecting {
+				c.close(closeLost)
+			} else {
+				c.close(closeBroker)
+			}
+
+			return
+		}
+
+		select {
+		case c.out <- msg:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// retry of packet sent to client until acknowledged
+type retry struct {
+	p        *packet
+	sent     time.Time
+	attempts int
+}
+
+// send messages of broker to client. Messages are buffered while client is asleep
+func (c *client) send() {
+	defer c.wg.Done()
+
+	s := &sender{
+		c:        c,
+		inflight: make(map[uint16]*retry),
+	}
+
+	retries := time.NewTicker(c.gw.config.RetryInterval)
+	defer retries.Stop()
+
+	// session of sleeping client kept alive by gateway
+	ping := time.NewTicker(c.ping)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-c.quit:
+			return
+		case msg := <-c.out:
+			s.deliver(msg)
+		case ev := <-c.events:
+			s.onEvent(ev)
+		case <-retries.C:
+			s.retransmit()
+		case <-ping.C:
+			if atomic.LoadInt32(&c.state) == stateAsleep || c.keepAlive == 0 {
+				s.pings++
+				c.writeMessage(message.NewPingReqMessage()) // nolint: errcheck, gas
+			}
+		}
+	}
+}
+
+type sender struct {
+	c        *client
+	buffered []message.Provider
+	inflight map[uint16]*retry
+
+	// pings of gateway awaiting PINGRESP not to be sent to client
+	pings int
+
+	// msgID of last REGISTER
+	msgID uint16
+}
+
+func (s *sender) onEvent(ev event) {
+	c := s.c
+
+	switch ev.kind {
+	case evAcked:
+		delete(s.inflight, ev.msgID)
+	case evWake:
+		s.flush()
+		c.gw.write(c.addr, &packet{typ: typePingResp})
+	case evAwake:
+		c.gw.write(c.addr, &packet{typ: typeConnAck, code: codeAccepted})
+		s.flush()
+	}
+}
+
+// flush messages buffered while client slept
+func (s *sender) flush() {
+	buffered := s.buffered
+	s.buffered = nil
+
+	for _, msg := range buffered {
+		s.send(msg)
+	}
+}
+
+func (s *sender) deliver(msg message.Provider) {
+	c := s.c
+
+	switch m := msg.(type) {
+	case *message.ConnAckMessage:
+		code := codeAccepted
+
+		switch m.ReturnCode() {
+		case message.ConnectionAccepted:
+			atomic.CompareAndSwapInt32(&c.state, stateConnecting, stateActive)
+		case message.ErrServerUnavailable:
+			code = codeCongestion
+		default:
+			code = codeNotSupported
+		}
+
+		c.gw.write(c.addr, &packet{typ: typeConnAck, code: code})
+	case *message.PublishMessage, *message.PubRelMessage:
+		if atomic.LoadInt32(&c.state) == stateAsleep {
+			if len(s.buffered) >= c.gw.config.MaxBuffered {
+				c.gw.log.prod.Warn("Buffer of sleeping client full, message dropped", zap.String("ClientID", c.id))
+				s.buffered = s.buffered[1:]
+			}
+
+			s.buffered = append(s.buffered, msg)
+			return
+		}
+
+		s.send(msg)
+	case *message.PubAckMessage:
+		c.gw.write(c.addr, &packet{typ: typePubAck, topicID: c.ack(c.pubs, m.PacketID()), msgID: m.PacketID(), code: codeAccepted})
+	case *message.PubRecMessage:
+		c.gw.write(c.addr, &packet{typ: typePubRec, msgID: m.PacketID()})
+		c.ack(c.pubs, m.PacketID())
+	case *message.PubCompMessage:
+		c.gw.write(c.addr, &packet{typ: typePubComp, msgID: m.PacketID()})
+	case *message.SubAckMessage:
+		id := c.ack(c.subs, m.PacketID())
+
+		p := &packet{typ: typeSubAck, topicID: id, msgID: m.PacketID(), code: codeAccepted}
+		if codes := m.ReturnCodes(); len(codes) == 0 || codes[0] == message.QosFailure {
+			p.code = codeNotSupported
+			p.topicID = 0
+		} else {
+			p.flags = byte(codes[0]) << offsetQoS
+		}
+
+		c.gw.write(c.addr, p)
+	case *message.UnSubAckMessage:
+		c.gw.write(c.addr, &packet{typ: typeUnsubAck, msgID: m.PacketID()})
+	case *message.PingRespMessage:
+		if s.pings > 0 {
+			s.pings--
+			return
+		}
+
+		c.gw.write(c.addr, &packet{typ: typePingResp})
+	}
+}
+
+// send PUBLISH or PUBREL to client registering topic first if needed
+func (s *sender) send(msg message.Provider) {
+	c := s.c
+
+	var p *packet
+
+	switch m := msg.(type) {
+	case *message.PubRelMessage:
+		p = &packet{typ: typePubRel, msgID: m.PacketID()}
+	case *message.PublishMessage:
+		id, typ, ok := c.registered(m.Topic())
+		if !ok {
+			if id, ok = s.register(m.Topic()); !ok {
+				return
+			}
+		}
+
+		p = &packet{
+			typ:     typePublish,
+			flags:   byte(m.QoS())<<offsetQoS | typ,
+			topicID: id,
+			msgID:   m.PacketID(),
+			data:    m.Payload(),
+		}
+
+		if m.Retain() {
+			p.flags |= flagRetain
+		}
+
+		if m.Dup() {
+			p.flags |= flagDup
+		}
+
+		if m.QoS() == message.QoS0 {
+			c.gw.write(c.addr, p)
+			return
+		}
+	default:
+		return
+	}
+
+	s.inflight[p.msgID] = &retry{p: p, sent: time.Now()}
+	c.gw.write(c.addr, p)
+}
+
+// register topic with client and wait for REGACK
+func (s *sender) register(topic string) (uint16, bool) {
+	c := s.c
+
+	id := c.register(topic)
+
+	if s.msgID++; s.msgID == 0 {
+		s.msgID = 1
+	}
+
+	req := &packet{typ: typeRegister, topicID: id, msgID: s.msgID, data: []byte(topic)}
+
+	// events other than REGACK are handled once registration finished
+	var deferred []event
+	defer func() {
+		for _, ev := range deferred {
+			s.onEvent(ev)
+		}
+	}()
+
+	for attempt := 0; attempt <= c.gw.config.MaxRetries; attempt++ {
+		c.gw.write(c.addr, req)
+
+		timer := time.NewTimer(c.gw.config.RetryInterval)
+
+	wait:
+		for {
+			select {
+			case <-c.quit:
+				timer.Stop()
+				return 0, false
+			case <-timer.C:
+				break wait
+			case ev := <-c.events:
+				switch {
+				case ev.kind == evRegAck && ev.msgID == req.msgID:
+					timer.Stop()
+
+					if ev.code != codeAccepted {
+						c.unregister(topic)
+						c.gw.log.prod.Warn("Client rejected topic, message dropped", zap.String("ClientID", c.id), zap.String("topic", topic))
+						return 0, false
+					}
+
+					return id, true
+				case ev.kind == evAcked:
+					s.onEvent(ev)
+				default:
+					deferred = append(deferred, ev)
+				}
+			}
+		}
+	}
+
+	c.unregister(topic)
+	c.gw.log.prod.Warn("Client did not acknowledge REGISTER, message dropped", zap.String("ClientID", c.id), zap.String("topic", topic))
+
+	return 0, false
+}
+
+// retransmit packets not acknowledged in time. Client is lost once retries exhausted
+func (s *sender) retransmit() {
+	c := s.c
+
+	if atomic.LoadInt32(&c.state) != stateActive {
+		return
+	}
+
+	now := time.Now()
+
+	for id, r := range s.inflight {
+		if now.Sub(r.sent) < c.gw.config.RetryInterval {
+			continue
+		}
+
+		if r.attempts++; r.attempts > c.gw.config.MaxRetries {
+			c.gw.log.prod.Info("Client lost, retries exhausted", zap.String("ClientID", c.id), zap.Uint16("MsgID", id))
+			c.close(closeLost)
+			return
+		}
+
+		if r.p.typ == typePublish {
+			r.p.flags |= flagDup
+		}
+
+		r.sent = now
+		c.gw.write(c.addr, r.p)
+	}
+}
+
+// ack drop pending acknowledgment returning topic id it was for
+func (c *client) ack(pending map[uint16]uint16, msgID uint16) uint16 {
+	c.lock.Lock()
+	id := pending[msgID]
+	delete(pending, msgID)
+	c.lock.Unlock()
+
+	return id
+}
+
+// subscribeQoS of MQTT-SN QoS, -1 is 0
+func subscribeQoS(qos byte) message.QosType {
+	if qos == qosMinusOne {
+		return message.QoS0
+	}
+
+	return message.QosType(qos)
+}
+
+func (c *client) writeMessage(msg message.Provider) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	// broker reads sessions continuously, stalled pipe means it is going away
+	c.conn.SetWriteDeadline(time.Now().Add(c.gw.config.RetryInterval)) // nolint: errcheck, gas
+
+	return message.WriteTo(c.conn, msg)
+}
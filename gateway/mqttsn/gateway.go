@@ -0,0 +1,491 @@
+// Package mqttsn serves MQTT-SN 1.2 clients over UDP, thus constrained sensors talk to broker
+// without TCP stack. Gateway is transparent: each SN client gets regular MQTT session on
+// broker, so authentication, ACLs and hooks of listener apply to them as well
+//
+// Gateway is a transport, served by broker as any other custom transport
+//
+//	gw, err := mqttsn.Listen(mqttsn.Config{Address: ":1884"})
+//	...
+//	srv.ListenAndServe(&server.ListenerTransport{Transport: gw})
+//
+// Topic names are registered by clients or gateway, predefined topic ids and two characters
+// short topic names are supported as well. Clients may publish with QoS -1 without connecting,
+// such messages are published by session of gateway itself. Sleeping clients get messages
+// buffered by gateway until they wake up
+package mqttsn
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultClientID      = "mqttsn_gateway"
+	defaultMaxBuffered   = 100
+	defaultRetryInterval = 10 * time.Second
+	defaultMaxRetries    = 3
+
+	// maxKeepAlive of MQTT sessions of clients not using keep alive
+	maxKeepAlive = 0xFFFF
+
+	maxDatagram   = 65535
+	inboundBuffer = 64
+	anonBuffer    = 256
+)
+
+var (
+	// ErrNoAddress gateway configured without address
+	ErrNoAddress = errors.New("mqttsn: address required")
+)
+
+// Config of gateway
+type Config struct {
+	// Address UDP address to listen on, e.g. ":1884"
+	Address string
+
+	// GatewayID reported in GWINFO and ADVERTISE
+	GatewayID byte
+
+	// Advertise interval ADVERTISE is sent to AdvertiseAddress with, e.g. broadcast
+	// address of network. 0 disables advertisements
+	Advertise        time.Duration
+	AdvertiseAddress string
+
+	// Predefined topic ids clients know in advance
+	Predefined map[uint16]string
+
+	// Username and Password sent in CONNECT of every client. MQTT-SN has no credentials
+	// thus broker authenticates gateway on behalf of its clients
+	Username string
+	Password string
+
+	// ClientID of gateway session publishing QoS -1 messages. If not set then default to
+	// "mqttsn_gateway"
+	ClientID string
+
+	// MaxBuffered messages kept for sleeping client, older are dropped. If not set then
+	// default to 100
+	MaxBuffered int
+
+	// RetryInterval of unacknowledged REGISTER, PUBLISH and PUBREL sent to client. If not set
+	// then default to 10 seconds
+	RetryInterval time.Duration
+
+	// MaxRetries client is considered lost after. If not set then default to 3
+	MaxRetries int
+}
+
+type gwAddr string
+
+func (a gwAddr) Network() string {
+	return "mqttsn"
+}
+
+func (a gwAddr) String() string {
+	return string(a)
+}
+
+// pipeConn broker side of client connection reporting addresses of UDP socket
+type pipeConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Gateway of MQTT-SN clients
+type Gateway struct {
+	config Config
+	conn   *net.UDPConn
+
+	conns chan net.Conn
+	anon  chan *message.PublishMessage
+
+	lock    sync.Mutex
+	clients map[string]*client
+
+	quit chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+}
+
+var _ types.Transport = (*Gateway)(nil)
+
+// Listen start receiving datagrams of clients. Clients connect once gateway served by broker
+func Listen(config Config) (*Gateway, error) {
+	if config.Address == "" {
+		return nil, ErrNoAddress
+	}
+
+	gw := &Gateway{
+		config:  config,
+		conns:   make(chan net.Conn),
+		anon:    make(chan *message.PublishMessage, anonBuffer),
+		clients: make(map[string]*client),
+		quit:    make(chan struct{}),
+	}
+
+	if gw.config.ClientID == "" {
+		gw.config.ClientID = defaultClientID
+	}
+
+	if gw.config.MaxBuffered <= 0 {
+		gw.config.MaxBuffered = defaultMaxBuffered
+	}
+
+	if gw.config.RetryInterval <= 0 {
+		gw.config.RetryInterval = defaultRetryInterval
+	}
+
+	if gw.config.MaxRetries <= 0 {
+		gw.config.MaxRetries = defaultMaxRetries
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	var advertise *net.UDPAddr
+	if gw.config.Advertise > 0 {
+		if advertise, err = net.ResolveUDPAddr("udp", gw.config.AdvertiseAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	if gw.conn, err = net.ListenUDP("udp", udpAddr); err != nil {
+		return nil, err
+	}
+
+	gw.log.prod = surgemq.GetProdLogger().Named("mqttsn")
+	gw.log.dev = surgemq.GetDevLogger().Named("mqttsn")
+
+	gw.wg.Add(2)
+	go gw.serve()
+	go gw.anonymous()
+
+	if advertise != nil {
+		gw.wg.Add(1)
+		go gw.advertise(advertise)
+	}
+
+	gw.log.prod.Info("MQTT-SN gateway started", zap.String("address", gw.conn.LocalAddr().String()))
+
+	return gw, nil
+}
+
+// Accept waits for the next client connecting to gateway
+func (gw *Gateway) Accept() (types.Conn, error) {
+	select {
+	case c := <-gw.conns:
+		return c, nil
+	case <-gw.quit:
+		return nil, types.ErrTransportClosed
+	}
+}
+
+// Close stop gateway and disconnect clients
+func (gw *Gateway) Close() error {
+	err := types.ErrTransportClosed
+
+	gw.once.Do(func() {
+		close(gw.quit)
+		err = gw.conn.Close()
+
+		gw.lock.Lock()
+		clients := make([]*client, 0, len(gw.clients))
+		for _, c := range gw.clients {
+			clients = append(clients, c)
+		}
+		gw.lock.Unlock()
+
+		for _, c := range clients {
+			c.close(closeGraceful)
+		}
+
+		gw.wg.Wait()
+
+		gw.log.prod.Info("MQTT-SN gateway stopped")
+	})
+
+	return err
+}
+
+// Addr UDP address of gateway with network "mqttsn"
+func (gw *Gateway) Addr() net.Addr {
+	return gwAddr(gw.conn.LocalAddr().String())
+}
+
+// write packet to client
+func (gw *Gateway) write(addr *net.UDPAddr, p *packet) {
+	if _, err := gw.conn.WriteToUDP(p.encode(), addr); err != nil {
+		gw.log.dev.Debug("Couldn't write datagram", zap.String("RemoteAddr", addr.String()), zap.Error(err))
+	}
+}
+
+// dial connection to broker. Returned connection is gateway side
+func (gw *Gateway) dial(remote net.Addr) (net.Conn, error) {
+	local, broker := net.Pipe()
+
+	select {
+	case gw.conns <- &pipeConn{Conn: broker, local: gw.conn.LocalAddr(), remote: remote}:
+		return local, nil
+	case <-gw.quit:
+		local.Close()  // nolint: errcheck, gas
+		broker.Close() // nolint: errcheck, gas
+		return nil, types.ErrTransportClosed
+	}
+}
+
+// serve datagrams of clients
+func (gw *Gateway) serve() {
+	defer gw.wg.Done()
+
+	buf := make([]byte, maxDatagram)
+
+	for {
+		n, addr, err := gw.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-gw.quit:
+				return
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() { // nolint: staticcheck
+				continue
+			}
+
+			gw.log.prod.Error("Couldn't read datagram", zap.Error(err))
+			return
+		}
+
+		p, err := decode(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			gw.log.dev.Debug("Invalid datagram", zap.String("RemoteAddr", addr.String()), zap.Error(err))
+			continue
+		}
+
+		gw.dispatch(addr, p)
+	}
+}
+
+// dispatch packet to client it came from
+func (gw *Gateway) dispatch(addr *net.UDPAddr, p *packet) {
+	switch p.typ {
+	case typeSearchGw:
+		gw.write(addr, &packet{typ: typeGwInfo, gwID: gw.config.GatewayID})
+		return
+	case typeAdvertise, typeGwInfo:
+		return
+	case typePublish:
+		if p.qos() == qosMinusOne {
+			gw.publishAnonymous(addr, p)
+			return
+		}
+	}
+
+	gw.lock.Lock()
+	c, ok := gw.clients[addr.String()]
+	if !ok && p.typ == typeConnect {
+		c = newClient(gw, addr)
+		gw.clients[addr.String()] = c
+		ok = true
+
+		gw.wg.Add(1)
+		go c.run()
+	}
+	gw.lock.Unlock()
+
+	if !ok {
+		// unknown client, tell it to connect
+		if p.typ != typeDisconnect {
+			gw.write(addr, &packet{typ: typeDisconnect})
+		}
+
+		return
+	}
+
+	select {
+	case c.in <- p:
+	default:
+		gw.log.prod.Warn("Client too slow, packet dropped", zap.String("ClientID", c.id), zap.String("RemoteAddr", addr.String()))
+	}
+}
+
+// remove client once it disconnected
+func (gw *Gateway) remove(c *client) {
+	gw.lock.Lock()
+	if gw.clients[c.addr.String()] == c {
+		delete(gw.clients, c.addr.String())
+	}
+	gw.lock.Unlock()
+}
+
+// topicOf of predefined or short topic id. Normal ids are resolved by client
+func (gw *Gateway) topicOf(typ byte, id uint16) (string, bool) {
+	switch typ {
+	case topicPredefined:
+		topic, ok := gw.config.Predefined[id]
+		return topic, ok
+	case topicShort:
+		return shortName(id), true
+	}
+
+	return "", false
+}
+
+// predefinedID of topic if any
+func (gw *Gateway) predefinedID(topic string) (uint16, bool) {
+	for id, t := range gw.config.Predefined {
+		if t == topic {
+			return id, true
+		}
+	}
+
+	return 0, false
+}
+
+// publishAnonymous queue QoS -1 publish of client for session of gateway
+func (gw *Gateway) publishAnonymous(addr *net.UDPAddr, p *packet) {
+	topic, ok := gw.topicOf(p.topicType(), p.topicID)
+	if !ok {
+		gw.log.dev.Debug("QoS -1 publish to unknown topic", zap.String("RemoteAddr", addr.String()), zap.Uint16("TopicID", p.topicID))
+		return
+	}
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic(topic); err != nil {
+		return
+	}
+
+	msg.SetRetain(p.flags&flagRetain != 0)
+	msg.SetPayload(p.data)
+
+	select {
+	case gw.anon <- msg:
+	default:
+		gw.log.prod.Warn("QoS -1 queue full, message dropped", zap.String("topic", topic))
+	}
+}
+
+// anonymous publish QoS -1 messages by session of gateway, connected on demand
+func (gw *Gateway) anonymous() {
+	defer gw.wg.Done()
+
+	var conn net.Conn
+	var closed chan struct{}
+
+	defer func() {
+		if conn != nil {
+			conn.SetWriteDeadline(time.Now().Add(gw.config.RetryInterval)) // nolint: errcheck, gas
+			message.WriteTo(conn, message.NewDisconnectMessage())          // nolint: errcheck, gas
+			conn.Close()                                                   // nolint: errcheck, gas
+		}
+	}()
+
+	for {
+		var msg *message.PublishMessage
+
+		select {
+		case <-gw.quit:
+			return
+		case <-closed:
+			conn, closed = nil, nil
+			continue
+		case msg = <-gw.anon:
+		}
+
+		if conn == nil {
+			var err error
+			if conn, err = gw.dial(gw.conn.LocalAddr()); err != nil {
+				return
+			}
+
+			connect := message.NewConnectMessage()
+			connect.SetVersion(0x4) // nolint: errcheck
+			connect.SetCleanSession(true)
+			connect.SetClientID([]byte(gw.config.ClientID)) // nolint: errcheck
+			gw.credentials(connect)
+
+			if err = message.WriteTo(conn, connect); err != nil {
+				conn.Close() // nolint: errcheck, gas
+				conn = nil
+				continue
+			}
+
+			// nothing but CONNACK and PINGRESP is expected, connection is redialled once broker closed it
+			closed = make(chan struct{})
+			go func(conn net.Conn, closed chan struct{}) {
+				defer close(closed)
+
+				for {
+					if _, err := message.ReadFrom(conn); err != nil {
+						conn.Close() // nolint: errcheck, gas
+						return
+					}
+				}
+			}(conn, closed)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(gw.config.RetryInterval)) // nolint: errcheck, gas
+
+		if err := message.WriteTo(conn, msg); err != nil {
+			gw.log.prod.Warn("Couldn't publish QoS -1 message", zap.String("topic", msg.Topic()), zap.Error(err))
+		}
+	}
+}
+
+// credentials of clients put into CONNECT
+func (gw *Gateway) credentials(msg *message.ConnectMessage) {
+	if gw.config.Username != "" {
+		msg.SetUsername([]byte(gw.config.Username))
+	}
+
+	if gw.config.Password != "" {
+		msg.SetPassword([]byte(gw.config.Password))
+	}
+}
+
+// advertise gateway periodically
+func (gw *Gateway) advertise(addr *net.UDPAddr) {
+	defer gw.wg.Done()
+
+	ticker := time.NewTicker(gw.config.Advertise)
+	defer ticker.Stop()
+
+	p := &packet{
+		typ:      typeAdvertise,
+		gwID:     gw.config.GatewayID,
+		duration: uint16(gw.config.Advertise / time.Second),
+	}
+
+	for {
+		gw.write(addr, p)
+
+		select {
+		case <-gw.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package mqttsn
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+)
+
+type snClient struct {
+	t    *testing.T
+	conn *net.UDPConn
+}
+
+func newGateway(t *testing.T, config Config) *Gateway {
+	config.Address = "127.0.0.1:0"
+	config.RetryInterval = 200 * time.Millisecond
+
+	gw, err := Listen(config)
+	require.NoError(t, err)
+
+	return gw
+}
+
+func dialGateway(t *testing.T, gw *Gateway) *snClient {
+	conn, err := net.DialUDP("udp", nil, gw.conn.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+
+	return &snClient{t: t, conn: conn}
+}
+
+func (c *snClient) send(p *packet) {
+	_, err := c.conn.Write(p.encode())
+	require.NoError(c.t, err)
+}
+
+func (c *snClient) recv(typ byte) *packet {
+	buf := make([]byte, maxDatagram)
+
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, err := c.conn.Read(buf)
+	require.NoError(c.t, err)
+
+	p, err := decode(buf[:n])
+	require.NoError(c.t, err)
+	require.Equal(c.t, typ, p.typ, "%+v", p)
+
+	return p
+}
+
+// accept connection of gateway acting as broker
+func accept(t *testing.T, gw *Gateway) net.Conn {
+	conn, err := gw.Accept()
+	require.NoError(t, err)
+
+	return conn.(net.Conn)
+}
+
+func brokerRecv(t *testing.T, conn net.Conn) message.Provider {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+
+	msg, err := message.ReadFrom(conn)
+	require.NoError(t, err)
+
+	return msg
+}
+
+func brokerSend(t *testing.T, conn net.Conn, msg message.Provider) {
+	require.NoError(t, message.WriteTo(conn, msg))
+}
+
+// connect client accepting its session
+func connect(t *testing.T, gw *Gateway, c *snClient, id string, duration uint16) net.Conn {
+	c.send(&packet{typ: typeConnect, flags: flagCleanSession, duration: duration, data: []byte(id)})
+
+	broker := accept(t, gw)
+
+	connect, ok := brokerRecv(t, broker).(*message.ConnectMessage)
+	require.True(t, ok)
+	require.Equal(t, id, string(connect.ClientID()))
+
+	brokerSend(t, broker, message.NewConnAckMessage())
+	require.Equal(t, codeAccepted, c.recv(typeConnAck).code)
+
+	return broker
+}
+
+func TestPacketCodec(t *testing.T) {
+	for _, p := range []*packet{
+		{typ: typeConnect, flags: flagWill | flagCleanSession, duration: 60, data: []byte("sensor")},
+		{typ: typeRegister, topicID: 1, msgID: 2, data: []byte("a/b")},
+		{typ: typePublish, flags: 1<<offsetQoS | topicShort, topicID: shortID("ab"), msgID: 3, data: bytes.Repeat([]byte{1}, 300)},
+		{typ: typeSubscribe, flags: topicPredefined, msgID: 4, topicID: 5},
+		{typ: typeSubscribe, flags: topicNormal, msgID: 4, data: []byte("a/+")},
+		{typ: typeSubAck, flags: 2 << offsetQoS, topicID: 6, msgID: 7, code: codeInvalidTopicID},
+		{typ: typeDisconnect, duration: 300},
+		{typ: typeDisconnect},
+		{typ: typeWillTopic},
+	} {
+		buf := p.encode()
+
+		d, err := decode(buf)
+		require.NoError(t, err)
+		require.Equal(t, p.typ, d.typ)
+		require.Equal(t, p.flags, d.flags)
+		require.Equal(t, p.topicID, d.topicID)
+		require.Equal(t, p.msgID, d.msgID)
+		require.Equal(t, p.duration, d.duration)
+		require.Equal(t, p.code, d.code)
+		require.Equal(t, len(p.data), len(d.data))
+	}
+
+	require.Equal(t, "ab", shortName(shortID("ab")))
+
+	_, err := decode([]byte{5, typeRegister, 0})
+	require.Error(t, err)
+
+	_, err = decode([]byte{2, 0x11})
+	require.Error(t, err)
+}
+
+func TestSession(t *testing.T) {
+	gw := newGateway(t, Config{})
+	defer gw.Close() // nolint: errcheck
+
+	c := dialGateway(t, gw)
+
+	// will is negotiated before session starts
+	c.send(&packet{typ: typeConnect, flags: flagWill | flagCleanSession, duration: 60, data: []byte("s1")})
+	c.recv(typeWillTopicReq)
+	c.send(&packet{typ: typeWillTopic, flags: 1 << offsetQoS, data: []byte("status/s1")})
+	c.recv(typeWillMsgReq)
+	c.send(&packet{typ: typeWillMsg, data: []byte("offline")})
+
+	broker := accept(t, gw)
+
+	connect := brokerRecv(t, broker).(*message.ConnectMessage)
+	require.Equal(t, "s1", string(connect.ClientID()))
+	require.Equal(t, "status/s1", connect.WillTopic())
+	require.Equal(t, "offline", string(connect.WillMessage()))
+	require.Equal(t, message.QoS1, connect.WillQos())
+	require.Equal(t, uint16(60), connect.KeepAlive())
+
+	brokerSend(t, broker, message.NewConnAckMessage())
+	c.recv(typeConnAck)
+
+	// publish by registered topic id
+	c.send(&packet{typ: typeRegister, msgID: 1, data: []byte("a/b")})
+	regAck := c.recv(typeRegAck)
+	require.Equal(t, codeAccepted, regAck.code)
+
+	c.send(&packet{typ: typePublish, flags: 1 << offsetQoS, topicID: regAck.topicID, msgID: 2, data: []byte("21")})
+
+	pub := brokerRecv(t, broker).(*message.PublishMessage)
+	require.Equal(t, "a/b", pub.Topic())
+	require.Equal(t, message.QoS1, pub.QoS())
+	require.Equal(t, uint16(2), pub.PacketID())
+	require.Equal(t, "21", string(pub.Payload()))
+
+	ack := message.NewPubAckMessage()
+	ack.SetPacketID(2)
+	brokerSend(t, broker, ack)
+
+	pubAck := c.recv(typePubAck)
+	require.Equal(t, regAck.topicID, pubAck.topicID)
+	require.Equal(t, uint16(2), pubAck.msgID)
+
+	// unknown topic id is rejected by gateway
+	c.send(&packet{typ: typePublish, flags: 1 << offsetQoS, topicID: 100, msgID: 3})
+	require.Equal(t, codeInvalidTopicID, c.recv(typePubAck).code)
+
+	// subscribe by name, topic id is assigned
+	c.send(&packet{typ: typeSubscribe, flags: 1 << offsetQoS, msgID: 4, data: []byte("c/d")})
+
+	sub := brokerRecv(t, broker).(*message.SubscribeMessage)
+	require.Equal(t, message.QoS1, sub.TopicQos("c/d"))
+
+	subAck := message.NewSubAckMessage()
+	subAck.SetPacketID(4)
+	require.NoError(t, subAck.AddReturnCode(message.QoS1))
+	brokerSend(t, broker, subAck)
+
+	snSubAck := c.recv(typeSubAck)
+	require.Equal(t, codeAccepted, snSubAck.code)
+	require.Equal(t, byte(1), snSubAck.qos())
+	require.NotZero(t, snSubAck.topicID)
+
+	out := message.NewPublishMessage()
+	require.NoError(t, out.SetTopic("c/d"))
+	require.NoError(t, out.SetQoS(message.QoS1))
+	out.SetPacketID(7)
+	out.SetPayload([]byte("on"))
+	brokerSend(t, broker, out)
+
+	p := c.recv(typePublish)
+	require.Equal(t, snSubAck.topicID, p.topicID)
+	require.Equal(t, topicNormal, p.topicType())
+	require.Equal(t, uint16(7), p.msgID)
+	require.Equal(t, "on", string(p.data))
+
+	// not acknowledged publish is retried
+	p = c.recv(typePublish)
+	require.NotZero(t, p.flags&flagDup)
+
+	c.send(&packet{typ: typePubAck, topicID: p.topicID, msgID: 7})
+	require.Equal(t, message.PUBACK, brokerRecv(t, broker).Type())
+
+	// topic unknown to client is registered by gateway first
+	out = message.NewPublishMessage()
+	require.NoError(t, out.SetTopic("e/f"))
+	out.SetPayload([]byte("x"))
+	brokerSend(t, broker, out)
+
+	reg := c.recv(typeRegister)
+	require.Equal(t, "e/f", string(reg.data))
+	c.send(&packet{typ: typeRegAck, topicID: reg.topicID, msgID: reg.msgID})
+
+	p = c.recv(typePublish)
+	require.Equal(t, reg.topicID, p.topicID)
+	require.Equal(t, "x", string(p.data))
+
+	c.send(&packet{typ: typeDisconnect})
+	c.recv(typeDisconnect)
+	require.Equal(t, message.DISCONNECT, brokerRecv(t, broker).Type())
+}
+
+func TestSleep(t *testing.T) {
+	gw := newGateway(t, Config{})
+	defer gw.Close() // nolint: errcheck
+
+	c := dialGateway(t, gw)
+	broker := connect(t, gw, c, "s2", 60)
+
+	c.send(&packet{typ: typeDisconnect, duration: 600})
+	c.recv(typeDisconnect)
+
+	for _, payload := range []string{"1", "2"} {
+		out := message.NewPublishMessage()
+		require.NoError(t, out.SetTopic("ab"))
+		out.SetPayload([]byte(payload))
+		brokerSend(t, broker, out)
+	}
+
+	// messages are buffered until client wakes up
+	c.send(&packet{typ: typePingReq, data: []byte("s2")})
+
+	for _, payload := range []string{"1", "2"} {
+		p := c.recv(typePublish)
+		require.Equal(t, topicShort, p.topicType())
+		require.Equal(t, "ab", shortName(p.topicID))
+		require.Equal(t, payload, string(p.data))
+	}
+
+	c.recv(typePingResp)
+
+	// client lost while broker closes session
+	require.NoError(t, broker.Close())
+	c.recv(typeDisconnect)
+}
+
+func TestQoSMinusOne(t *testing.T) {
+	gw := newGateway(t, Config{Predefined: map[uint16]string{10: "sensors/temp"}})
+	defer gw.Close() // nolint: errcheck
+
+	c := dialGateway(t, gw)
+	c.send(&packet{typ: typePublish, flags: qosMinusOne<<offsetQoS | topicPredefined, topicID: 10, data: []byte("21")})
+
+	broker := accept(t, gw)
+
+	connect := brokerRecv(t, broker).(*message.ConnectMessage)
+	require.Equal(t, defaultClientID, string(connect.ClientID()))
+	brokerSend(t, broker, message.NewConnAckMessage())
+
+	pub := brokerRecv(t, broker).(*message.PublishMessage)
+	require.Equal(t, "sensors/temp", pub.Topic())
+	require.Equal(t, message.QoS0, pub.QoS())
+	require.Equal(t, "21", string(pub.Payload()))
+
+	// client not connected is told so
+	c.send(&packet{typ: typePingReq})
+	c.recv(typeDisconnect)
+}
@@ -0,0 +1,320 @@
+package mqttsn
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Types of MQTT-SN 1.2 packets
+const (
+	typeAdvertise     byte = 0x00
+	typeSearchGw      byte = 0x01
+	typeGwInfo        byte = 0x02
+	typeConnect       byte = 0x04
+	typeConnAck       byte = 0x05
+	typeWillTopicReq  byte = 0x06
+	typeWillTopic     byte = 0x07
+	typeWillMsgReq    byte = 0x08
+	typeWillMsg       byte = 0x09
+	typeRegister      byte = 0x0A
+	typeRegAck        byte = 0x0B
+	typePublish       byte = 0x0C
+	typePubAck        byte = 0x0D
+	typePubComp       byte = 0x0E
+	typePubRec        byte = 0x0F
+	typePubRel        byte = 0x10
+	typeSubscribe     byte = 0x12
+	typeSubAck        byte = 0x13
+	typeUnsubscribe   byte = 0x14
+	typeUnsubAck      byte = 0x15
+	typePingReq       byte = 0x16
+	typePingResp      byte = 0x17
+	typeDisconnect    byte = 0x18
+	typeWillTopicUpd  byte = 0x1A
+	typeWillTopicResp byte = 0x1B
+	typeWillMsgUpd    byte = 0x1C
+	typeWillMsgResp   byte = 0x1D
+)
+
+// Flags of CONNECT, WILLTOPIC, PUBLISH, SUBSCRIBE and SUBACK
+const (
+	flagDup          byte = 0x80
+	flagQoSMask      byte = 0x60
+	flagRetain       byte = 0x10
+	flagWill         byte = 0x08
+	flagCleanSession byte = 0x04
+	flagTopicMask    byte = 0x03
+
+	offsetQoS = 5
+
+	// qosMinusOne QoS -1 publish of client not connected to gateway
+	qosMinusOne byte = 0x03
+)
+
+// Types of topic ids
+const (
+	topicNormal     byte = 0x00
+	topicPredefined byte = 0x01
+	topicShort      byte = 0x02
+)
+
+// Return codes
+const (
+	codeAccepted       byte = 0x00
+	codeCongestion     byte = 0x01
+	codeInvalidTopicID byte = 0x02
+	codeNotSupported   byte = 0x03
+)
+
+const protocolID byte = 0x01
+
+var errInvalidPacket = errors.New("mqttsn: invalid packet")
+
+// packet of MQTT-SN. Fields not carried by type are zero
+type packet struct {
+	typ      byte
+	flags    byte
+	topicID  uint16
+	msgID    uint16
+	duration uint16
+	code     byte
+	gwID     byte
+	radius   byte
+
+	// client id, topic name, will topic, will message or payload depending on type
+	data []byte
+}
+
+func (p *packet) qos() byte {
+	return (p.flags & flagQoSMask) >> offsetQoS
+}
+
+func (p *packet) topicType() byte {
+	return p.flags & flagTopicMask
+}
+
+// shortName topic of short topic id
+func shortName(id uint16) string {
+	return string([]byte{byte(id >> 8), byte(id)})
+}
+
+// shortID of two characters topic
+func shortID(topic string) uint16 {
+	return uint16(topic[0])<<8 | uint16(topic[1])
+}
+
+// decode datagram
+func decode(buf []byte) (*packet, error) {
+	if len(buf) < 2 {
+		return nil, errInvalidPacket
+	}
+
+	length := int(buf[0])
+	off := 1
+
+	if buf[0] == 0x01 {
+		if len(buf) < 4 {
+			return nil, errInvalidPacket
+		}
+
+		length = int(binary.BigEndian.Uint16(buf[1:]))
+		off = 3
+	}
+
+	if length > len(buf) || length <= off {
+		return nil, errInvalidPacket
+	}
+
+	p := &packet{typ: buf[off]}
+	b := buf[off+1 : length]
+
+	// need at least n bytes of body
+	need := func(n int) bool {
+		return len(b) >= n
+	}
+
+	switch p.typ {
+	case typeAdvertise:
+		if !need(3) {
+			return nil, errInvalidPacket
+		}
+
+		p.gwID = b[0]
+		p.duration = binary.BigEndian.Uint16(b[1:])
+	case typeSearchGw:
+		if !need(1) {
+			return nil, errInvalidPacket
+		}
+
+		p.radius = b[0]
+	case typeGwInfo:
+		if !need(1) {
+			return nil, errInvalidPacket
+		}
+
+		p.gwID = b[0]
+		p.data = b[1:]
+	case typeConnect:
+		if !need(4) || b[1] != protocolID {
+			return nil, errInvalidPacket
+		}
+
+		p.flags = b[0]
+		p.duration = binary.BigEndian.Uint16(b[2:])
+		p.data = b[4:]
+	case typeConnAck, typeWillTopicResp, typeWillMsgResp:
+		if !need(1) {
+			return nil, errInvalidPacket
+		}
+
+		p.code = b[0]
+	case typeWillTopicReq, typeWillMsgReq, typePingResp:
+	case typeWillTopic, typeWillTopicUpd:
+		// empty will topic deletes will
+		if need(1) {
+			p.flags = b[0]
+			p.data = b[1:]
+		}
+	case typeWillMsg, typeWillMsgUpd, typePingReq:
+		p.data = b
+	case typeRegister:
+		if !need(4) {
+			return nil, errInvalidPacket
+		}
+
+		p.topicID = binary.BigEndian.Uint16(b)
+		p.msgID = binary.BigEndian.Uint16(b[2:])
+		p.data = b[4:]
+	case typeRegAck, typePubAck:
+		if !need(5) {
+			return nil, errInvalidPacket
+		}
+
+		p.topicID = binary.BigEndian.Uint16(b)
+		p.msgID = binary.BigEndian.Uint16(b[2:])
+		p.code = b[4]
+	case typePublish:
+		if !need(5) {
+			return nil, errInvalidPacket
+		}
+
+		p.flags = b[0]
+		p.topicID = binary.BigEndian.Uint16(b[1:])
+		p.msgID = binary.BigEndian.Uint16(b[3:])
+		p.data = b[5:]
+	case typePubComp, typePubRec, typePubRel, typeUnsubAck:
+		if !need(2) {
+			return nil, errInvalidPacket
+		}
+
+		p.msgID = binary.BigEndian.Uint16(b)
+	case typeSubscribe, typeUnsubscribe:
+		if !need(3) {
+			return nil, errInvalidPacket
+		}
+
+		p.flags = b[0]
+		p.msgID = binary.BigEndian.Uint16(b[1:])
+
+		if p.topicType() == topicNormal {
+			p.data = b[3:]
+		} else if need(5) {
+			p.topicID = binary.BigEndian.Uint16(b[3:])
+		} else {
+			return nil, errInvalidPacket
+		}
+	case typeSubAck:
+		if !need(6) {
+			return nil, errInvalidPacket
+		}
+
+		p.flags = b[0]
+		p.topicID = binary.BigEndian.Uint16(b[1:])
+		p.msgID = binary.BigEndian.Uint16(b[3:])
+		p.code = b[5]
+	case typeDisconnect:
+		// duration turns client asleep
+		if need(2) {
+			p.duration = binary.BigEndian.Uint16(b)
+		}
+	default:
+		return nil, errInvalidPacket
+	}
+
+	return p, nil
+}
+
+// encode packet into datagram
+func (p *packet) encode() []byte {
+	b := make([]byte, 0, 8+len(p.data))
+
+	u16 := func(v uint16) {
+		b = append(b, byte(v>>8), byte(v))
+	}
+
+	switch p.typ {
+	case typeAdvertise:
+		b = append(b, p.gwID)
+		u16(p.duration)
+	case typeSearchGw:
+		b = append(b, p.radius)
+	case typeGwInfo:
+		b = append(b, p.gwID)
+		b = append(b, p.data...)
+	case typeConnect:
+		b = append(b, p.flags, protocolID)
+		u16(p.duration)
+		b = append(b, p.data...)
+	case typeConnAck, typeWillTopicResp, typeWillMsgResp:
+		b = append(b, p.code)
+	case typeWillTopic, typeWillTopicUpd:
+		if len(p.data) > 0 {
+			b = append(b, p.flags)
+			b = append(b, p.data...)
+		}
+	case typeWillMsg, typeWillMsgUpd, typePingReq:
+		b = append(b, p.data...)
+	case typeRegister:
+		u16(p.topicID)
+		u16(p.msgID)
+		b = append(b, p.data...)
+	case typeRegAck, typePubAck:
+		u16(p.topicID)
+		u16(p.msgID)
+		b = append(b, p.code)
+	case typePublish:
+		b = append(b, p.flags)
+		u16(p.topicID)
+		u16(p.msgID)
+		b = append(b, p.data...)
+	case typePubComp, typePubRec, typePubRel, typeUnsubAck:
+		u16(p.msgID)
+	case typeSubscribe, typeUnsubscribe:
+		b = append(b, p.flags)
+		u16(p.msgID)
+
+		if p.topicType() == topicNormal {
+			b = append(b, p.data...)
+		} else {
+			u16(p.topicID)
+		}
+	case typeSubAck:
+		b = append(b, p.flags)
+		u16(p.topicID)
+		u16(p.msgID)
+		b = append(b, p.code)
+	case typeDisconnect:
+		if p.duration > 0 {
+			u16(p.duration)
+		}
+	}
+
+	// length includes itself and type
+	if length := len(b) + 2; length < 256 {
+		return append([]byte{byte(length), p.typ}, b...)
+	}
+
+	length := len(b) + 4
+
+	return append([]byte{0x01, byte(length >> 8), byte(length), p.typ}, b...)
+}
@@ -0,0 +1,154 @@
+package surgemq
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// rootLogger name of logger all subsystem loggers are named under
+const rootLogger = "mqtt"
+
+// logLevels immutable snapshot of levels replaced on every change
+type logLevels struct {
+	def zapcore.Level
+
+	// min lowest of levels. Checked before logger name is known
+	min zapcore.Level
+
+	bySubsystem map[string]zapcore.Level
+}
+
+var levels struct {
+	lock sync.Mutex
+	curr atomic.Value
+}
+
+func init() {
+	levels.curr.Store(&logLevels{def: zapcore.InfoLevel, min: zapcore.InfoLevel})
+}
+
+func currLevels() *logLevels {
+	return levels.curr.Load().(*logLevels)
+}
+
+// of level of logger by its name. Level of subsystem applies to nested ones unless they have own
+func (l *logLevels) of(name string) zapcore.Level {
+	if len(l.bySubsystem) == 0 {
+		return l.def
+	}
+
+	name = subsystemOf(name)
+
+	for name != "" {
+		if lvl, ok := l.bySubsystem[name]; ok {
+			return lvl
+		}
+
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+
+	return l.def
+}
+
+// subsystemOf logger name without root which might be nested into name of application logger
+func subsystemOf(name string) string {
+	if i := strings.Index(name, "."+rootLogger+"."); i >= 0 {
+		return name[i+len(rootLogger)+2:]
+	}
+
+	return strings.TrimPrefix(strings.TrimPrefix(name, rootLogger), ".")
+}
+
+// setLevels replace levels. Empty subsystem sets default level
+func setLevels(update func(bySubsystem map[string]zapcore.Level)) {
+	levels.lock.Lock()
+	defer levels.lock.Unlock()
+
+	curr := currLevels()
+
+	l := &logLevels{
+		def:         curr.def,
+		bySubsystem: make(map[string]zapcore.Level, len(curr.bySubsystem)+1),
+	}
+
+	for k, v := range curr.bySubsystem {
+		l.bySubsystem[k] = v
+	}
+
+	update(l.bySubsystem)
+
+	if lvl, ok := l.bySubsystem[""]; ok {
+		l.def = lvl
+		delete(l.bySubsystem, "")
+	}
+
+	l.min = l.def
+	for _, lvl := range l.bySubsystem {
+		if lvl < l.min {
+			l.min = lvl
+		}
+	}
+
+	levels.curr.Store(l)
+}
+
+// SetLogLevel change level of subsystem logs at runtime. Subsystem is logger name without
+// root, e.g. "session", "server.tcp" or "persistence.gc". Level applies to nested subsystems
+// unless they have own one. Empty subsystem sets default level of subsystems without level
+func SetLogLevel(subsystem string, level zapcore.Level) {
+	setLevels(func(bySubsystem map[string]zapcore.Level) {
+		bySubsystem[subsystem] = level
+	})
+}
+
+// ResetLogLevel remove own level of subsystem thus it gets level of enclosing one
+func ResetLogLevel(subsystem string) {
+	setLevels(func(bySubsystem map[string]zapcore.Level) {
+		delete(bySubsystem, subsystem)
+	})
+}
+
+// LogLevel effective level of subsystem
+func LogLevel(subsystem string) zapcore.Level {
+	if subsystem == "" {
+		return currLevels().def
+	}
+
+	return currLevels().of(rootLogger + "." + subsystem)
+}
+
+// levelCore filters entries by level of subsystem logger is named after
+type levelCore struct {
+	zapcore.Core
+}
+
+func (c levelCore) Enabled(lvl zapcore.Level) bool {
+	return lvl >= currLevels().min && c.Core.Enabled(lvl)
+}
+
+func (c levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return levelCore{c.Core.With(fields)}
+}
+
+func (c levelCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if e.Level < currLevels().of(e.LoggerName) {
+		return ce
+	}
+
+	return c.Core.Check(e, ce)
+}
+
+// withLevels root logger filtering entries by subsystem levels
+func withLevels(log *zap.Logger) *zap.Logger {
+	return log.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return levelCore{c}
+	})).Named(rootLogger)
+}
@@ -16,6 +16,7 @@ package message
 
 import (
 	"encoding/binary"
+	"io"
 	"strings"
 
 	"github.com/troian/surgemq/buffer"
@@ -153,6 +154,66 @@ func WriteToBuffer(msg Provider, to *buffer.Type) (int, error) {
 	return to.Send([][]byte{to.ExternalBuf[:total]})
 }
 
+// ReadFrom read and decode next message of stream. Remaining length is read byte by byte
+// thus nothing of next message is consumed
+func ReadFrom(r io.Reader) (Provider, error) {
+	header := make([]byte, 1, 1+binary.MaxVarintLen32)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	remLen, err := binary.ReadUvarint(byteReader{r})
+	if err != nil {
+		return nil, err
+	}
+
+	if remLen > uint64(maxRemainingLength) {
+		return nil, ErrInvalidLength
+	}
+
+	header = header[:1+binary.PutUvarint(header[1:cap(header)], remLen)]
+
+	buf := make([]byte, len(header)+int(remLen))
+	copy(buf, header)
+
+	if _, err = io.ReadFull(r, buf[len(header):]); err != nil {
+		return nil, err
+	}
+
+	msg, _, err := Decode(buf)
+
+	return msg, err
+}
+
+// WriteTo encode message into stream
+func WriteTo(w io.Writer, msg Provider) error {
+	size, err := msg.Size()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, size)
+	if _, err = msg.Encode(buf); err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf)
+
+	return err
+}
+
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+
+	return b[0], err
+}
+
 // readLPBytes read length prefixed bytes
 func readLPBytes(buf []byte) ([]byte, int, error) {
 	if len(buf) < 2 {
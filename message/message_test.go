@@ -15,7 +15,9 @@
 package message
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -236,3 +238,26 @@ func TestMessageDecode(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, 0, n)
 }
+
+func TestMessageStream(t *testing.T) {
+	var stream bytes.Buffer
+
+	pub := NewPublishMessage()
+	require.NoError(t, pub.SetTopic("a/b"))
+	pub.SetPayload(bytes.Repeat([]byte{1}, 200))
+
+	require.NoError(t, WriteTo(&stream, pub))
+	require.NoError(t, WriteTo(&stream, NewPingReqMessage()))
+
+	msg, err := ReadFrom(&stream)
+	require.NoError(t, err)
+	require.Equal(t, PUBLISH, msg.Type())
+	require.Equal(t, pub.Payload(), msg.(*PublishMessage).Payload())
+
+	msg, err = ReadFrom(&stream)
+	require.NoError(t, err)
+	require.Equal(t, PINGREQ, msg.Type())
+
+	_, err = ReadFrom(&stream)
+	require.Equal(t, io.EOF, err)
+}
@@ -14,7 +14,10 @@
 
 package message
 
-import "encoding/binary"
+import (
+	"context"
+	"encoding/binary"
+)
 
 const (
 	publishFlagDupMask    byte = 0x08
@@ -29,6 +32,9 @@ type PublishMessage struct {
 
 	payload []byte
 	topic   string
+
+	// ctx of message within broker, e.g. trace it is routed under. Not encoded
+	ctx context.Context
 }
 
 var _ Provider = (*PublishMessage)(nil)
@@ -97,6 +103,21 @@ func (msg *PublishMessage) SetQoS(v QosType) error {
 	return nil
 }
 
+// Context returns context message is processed under within broker. Never nil
+func (msg *PublishMessage) Context() context.Context {
+	if msg.ctx == nil {
+		return context.Background()
+	}
+
+	return msg.ctx
+}
+
+// SetContext sets context message is processed under, e.g. carrying trace of its route
+// Context is not part of the packet thus it is lost once message is encoded
+func (msg *PublishMessage) SetContext(ctx context.Context) {
+	msg.ctx = ctx
+}
+
 // Topic returns the the topic name that identifies the information channel to which
 // payload data is published.
 func (msg *PublishMessage) Topic() string {
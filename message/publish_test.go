@@ -15,6 +15,7 @@
 package message
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -79,6 +80,28 @@ func TestPublishMessageFields(t *testing.T) {
 	require.Equal(t, []byte("this is a payload to be sent"), msg.Payload(), "Error setting payload.")
 }
 
+type ctxKey struct{}
+
+func TestPublishMessageContext(t *testing.T) {
+	msg := NewPublishMessage()
+
+	require.NotNil(t, msg.Context(), "Context must not be nil.")
+
+	msg.SetContext(context.WithValue(context.Background(), ctxKey{}, "trace"))
+	msg.SetTopic("coolstuff") // nolint: errcheck
+
+	buf := make([]byte, 100)
+	n, err := msg.Encode(buf)
+	require.NoError(t, err)
+
+	require.Equal(t, "trace", msg.Context().Value(ctxKey{}), "Error setting context.")
+
+	decoded, _, err := Decode(buf[:n])
+	require.NoError(t, err)
+
+	require.Nil(t, decoded.(*PublishMessage).Context().Value(ctxKey{}), "Context must not be encoded.")
+}
+
 func TestPublishMessageDecode1(t *testing.T) {
 	msgBytes := []byte{
 		byte(PUBLISH<<4) | 2,
@@ -0,0 +1,107 @@
+package message
+
+import (
+	"encoding/binary"
+)
+
+// SubscriptionOptions of topic filter. MQTT 3.1.1 carries QoS only, the rest are options
+// of MQTT 5 kept thus persisted subscriptions survive protocol upgrade
+type SubscriptionOptions struct {
+	// QoS granted to subscription
+	QoS QosType
+
+	// NoLocal messages published by subscriber itself are not delivered to it
+	NoLocal bool
+
+	// RetainAsPublished retain flag of forwarded messages is kept as published
+	RetainAsPublished bool
+
+	// RetainHandling when retained messages are sent on subscribe, 0 through 2
+	RetainHandling byte
+
+	// ID subscription identifier, 0 if not set
+	ID uint32
+}
+
+// Subscriptions options of topic filters
+type Subscriptions map[string]SubscriptionOptions
+
+const (
+	subOptionsQoSMask            = 0x03
+	subOptionsNoLocal            = 0x04
+	subOptionsRetainAsPublished  = 0x08
+	subOptionsRetainHandlingMask = 0x30
+	subOptionsReservedMask       = 0xC0
+
+	// maxSubscriptionID largest value of variable byte integer
+	maxSubscriptionID = 268435455
+)
+
+// Byte subscription options byte as of MQTT 5
+func (o SubscriptionOptions) Byte() byte {
+	b := byte(o.QoS) & subOptionsQoSMask
+
+	if o.NoLocal {
+		b |= subOptionsNoLocal
+	}
+
+	if o.RetainAsPublished {
+		b |= subOptionsRetainAsPublished
+	}
+
+	return b | (o.RetainHandling<<4)&subOptionsRetainHandlingMask
+}
+
+// Encode options into options byte followed by subscription identifier if set
+// Options of QoS alone encode into single byte equal to QoS
+func (o SubscriptionOptions) Encode() []byte {
+	buf := []byte{o.Byte()}
+
+	if o.ID != 0 {
+		buf = binary.AppendUvarint(buf, uint64(o.ID))
+	}
+
+	return buf
+}
+
+// DecodeSubscriptionOptions encoded by Encode
+func DecodeSubscriptionOptions(buf []byte) (SubscriptionOptions, error) {
+	var o SubscriptionOptions
+
+	if len(buf) == 0 || buf[0]&subOptionsReservedMask != 0 {
+		return o, ErrInvalidLength
+	}
+
+	b := buf[0]
+
+	o.QoS = QosType(b & subOptionsQoSMask)
+	o.NoLocal = b&subOptionsNoLocal != 0
+	o.RetainAsPublished = b&subOptionsRetainAsPublished != 0
+	o.RetainHandling = (b & subOptionsRetainHandlingMask) >> 4
+
+	if !o.QoS.IsValid() || o.RetainHandling > 2 {
+		return o, ErrInvalidQoS
+	}
+
+	if len(buf) > 1 {
+		id, n := binary.Uvarint(buf[1:])
+		if n <= 0 || n != len(buf)-1 || id == 0 || id > maxSubscriptionID {
+			return o, ErrInvalidLength
+		}
+
+		o.ID = uint32(id)
+	}
+
+	return o, nil
+}
+
+// TopicsQoS QoS of every topic filter
+func (s Subscriptions) TopicsQoS() TopicsQoS {
+	res := make(TopicsQoS, len(s))
+
+	for t, o := range s {
+		res[t] = o.QoS
+	}
+
+	return res
+}
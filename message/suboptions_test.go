@@ -0,0 +1,41 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscriptionOptionsEncode(t *testing.T) {
+	o := SubscriptionOptions{QoS: QoS1}
+	require.Equal(t, []byte{1}, o.Encode())
+
+	o = SubscriptionOptions{
+		QoS:               QoS2,
+		NoLocal:           true,
+		RetainAsPublished: true,
+		RetainHandling:    2,
+		ID:                300,
+	}
+
+	buf := o.Encode()
+	require.Equal(t, []byte{0x2E, 0xAC, 0x02}, buf)
+
+	res, err := DecodeSubscriptionOptions(buf)
+	require.NoError(t, err)
+	require.Equal(t, o, res)
+}
+
+func TestSubscriptionOptionsDecodeInvalid(t *testing.T) {
+	for _, buf := range [][]byte{
+		nil,
+		{0x03},
+		{0x30},
+		{0x40},
+		{0x01, 0x00},
+		{0x01, 0x80},
+	} {
+		_, err := DecodeSubscriptionOptions(buf)
+		require.Error(t, err, "%x", buf)
+	}
+}
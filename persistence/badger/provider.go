@@ -0,0 +1,827 @@
+package badger
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	badgerdb "github.com/dgraph-io/badger/v4"
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence"
+	"github.com/troian/surgemq/persistence/types"
+	"go.uber.org/zap"
+)
+
+// Key layout. Parts are separated by 0x00 which cannot appear in MQTT strings
+//
+//	s <id>                   session meta, value is flags byte
+//	u <id> <topic>           subscription, value is qos
+//	m <id> <dir> <seq>       message of given direction
+//	r <topic>                retained message
+//	R                        marker of stored retained messages
+//	q                        sequence of messages
+const (
+	prefixSession      = 's'
+	prefixSubscription = 'u'
+	prefixMessage      = 'm'
+	prefixRetained     = 'r'
+
+	keyRetainedMeta = "R"
+	keySequence     = "q"
+
+	flagSubscriptions byte = 0x01
+	flagMessages      byte = 0x02
+)
+
+// defaultGCDiscardRatio value log file is rewritten if at least half of it can be discarded
+const defaultGCDiscardRatio = 0.5
+
+type dbStatus struct {
+	db   *badgerdb.DB
+	seq  *badgerdb.Sequence
+	done chan struct{}
+}
+
+type impl struct {
+	db dbStatus
+
+	lock sync.Mutex
+
+	gc struct {
+		interval time.Duration
+		ratio    float64
+		wg       sync.WaitGroup
+	}
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+
+	r retained
+	s sessions
+}
+
+type sessions struct {
+	db *dbStatus
+}
+
+type session struct {
+	db *dbStatus
+
+	id string
+
+	s subscriptions
+	m messages
+}
+
+type subscriptions struct {
+	db *dbStatus
+
+	id string
+}
+
+type messages struct {
+	db *dbStatus
+
+	id string
+}
+
+type retained struct {
+	db *dbStatus
+}
+
+func init() {
+	persistence.Register((*types.BadgerConfig)(nil), func(config types.ProviderConfig) (types.Provider, error) { // nolint: errcheck, gas
+		return NewBadger(config.(*types.BadgerConfig))
+	})
+}
+
+// NewBadger allocate new persistence provider of Badger type
+func NewBadger(config *types.BadgerConfig) (types.Provider, error) {
+	pl := &impl{
+		db: dbStatus{
+			done: make(chan struct{}),
+		},
+	}
+
+	pl.log.prod = surgemq.GetProdLogger().Named("persistence.badger")
+	pl.log.dev = surgemq.GetDevLogger().Named("persistence.badger")
+
+	opts := badgerdb.DefaultOptions(config.Dir).
+		WithInMemory(config.InMemory).
+		WithSyncWrites(config.SyncWrites).
+		WithLogger(nil)
+
+	if config.ValueLogFileSize > 0 {
+		opts = opts.WithValueLogFileSize(config.ValueLogFileSize)
+	}
+
+	var err error
+	if pl.db.db, err = badgerdb.Open(opts); err != nil {
+		return nil, err
+	}
+
+	if pl.db.seq, err = pl.db.db.GetSequence([]byte(keySequence), 1000); err != nil {
+		pl.db.db.Close() // nolint: errcheck, gas
+		return nil, err
+	}
+
+	pl.r = retained{
+		db: &pl.db,
+	}
+
+	pl.s = sessions{
+		db: &pl.db,
+	}
+
+	pl.gc.interval = config.GCInterval
+	pl.gc.ratio = config.GCDiscardRatio
+	if pl.gc.ratio <= 0 || pl.gc.ratio >= 1 {
+		pl.gc.ratio = defaultGCDiscardRatio
+	}
+
+	if pl.gc.interval > 0 && !config.InMemory {
+		pl.gc.wg.Add(1)
+		go pl.gcWorker()
+	}
+
+	return pl, nil
+}
+
+// Sessions
+func (p *impl) Sessions() (types.Sessions, error) {
+	select {
+	case <-p.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &p.s, nil
+}
+
+// Retained
+func (p *impl) Retained() (types.Retained, error) {
+	select {
+	case <-p.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &p.r, nil
+}
+
+// Health reports ErrNotOpen once provider has been shut down
+func (p *impl) Health() error {
+	select {
+	case <-p.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return nil
+}
+
+// Snapshot write full backup of database as of now. Shutdown waits until it completes
+// Backup is restored with badger.DB.Load
+func (p *impl) Snapshot(w io.Writer) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	_, err := p.db.db.Backup(w, 0)
+
+	return err
+}
+
+// Shutdown provider
+func (p *impl) Shutdown() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	close(p.db.done)
+
+	p.gc.wg.Wait()
+
+	p.db.seq.Release() // nolint: errcheck, gas
+
+	return p.db.db.Close()
+}
+
+// gcWorker periodically rewrite value log files having enough garbage
+func (p *impl) gcWorker() {
+	defer p.gc.wg.Done()
+
+	ticker := time.NewTicker(p.gc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.db.done:
+			return
+		case <-ticker.C:
+			rewritten := 0
+			for {
+				if err := p.db.db.RunValueLogGC(p.gc.ratio); err != nil {
+					if err != badgerdb.ErrNoRewrite {
+						p.log.prod.Error("Value log GC failed", zap.Error(err))
+					}
+					break
+				}
+				rewritten++
+			}
+
+			p.log.dev.Debug("Value log GC finished", zap.Int("rewritten", rewritten))
+		}
+	}
+}
+
+func key(prefix byte, parts ...string) []byte {
+	k := []byte{prefix}
+	for _, p := range parts {
+		k = append(k, 0)
+		k = append(k, p...)
+	}
+
+	return k
+}
+
+func seqKey(k []byte, seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+
+	k = append(k, 0)
+
+	return append(k, b...)
+}
+
+// withPrefix prefix of all keys nested into k
+func withPrefix(k []byte) []byte {
+	return append(append([]byte{}, k...), 0)
+}
+
+func getFlags(txn *badgerdb.Txn, id string) (byte, error) {
+	item, err := txn.Get(key(prefixSession, id))
+	if err == badgerdb.ErrKeyNotFound {
+		return 0, types.ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+
+	var flags byte
+	err = item.Value(func(val []byte) error {
+		if len(val) > 0 {
+			flags = val[0]
+		}
+		return nil
+	})
+
+	return flags, err
+}
+
+func setFlags(txn *badgerdb.Txn, id string, flags byte) error {
+	return txn.Set(key(prefixSession, id), []byte{flags})
+}
+
+// deletePrefix remove all keys starting with prefix
+func deletePrefix(txn *badgerdb.Txn, prefix []byte) (int, error) {
+	opts := badgerdb.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+
+	it := txn.NewIterator(opts)
+
+	var keys [][]byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+
+	for _, k := range keys {
+		if err := txn.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+// New
+func (s *sessions) New(id string) (types.Session, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	err := s.db.db.Update(func(txn *badgerdb.Txn) error {
+		if _, err := getFlags(txn, id); err == nil {
+			return types.ErrAlreadyExists
+		} else if err != types.ErrNotFound {
+			return err
+		}
+
+		return setFlags(txn, id, 0)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	ses := newSession(s.db, id)
+
+	return &ses, nil
+}
+
+// Get
+func (s *sessions) Get(id string) (types.Session, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	err := s.db.db.View(func(txn *badgerdb.Txn) error {
+		_, err := getFlags(txn, id)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	ses := newSession(s.db, id)
+
+	return &ses, nil
+}
+
+func (s *sessions) GetAll() ([]types.Session, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	res := []types.Session{}
+
+	err := s.db.db.View(func(txn *badgerdb.Txn) error {
+		opts := badgerdb.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte{prefixSession, 0}
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			ses := newSession(s.db, string(it.Item().Key()[2:]))
+			res = append(res, &ses)
+		}
+
+		return nil
+	})
+
+	return res, err
+}
+
+// Delete
+func (s *sessions) Delete(id string) error {
+	select {
+	case <-s.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return s.db.db.Update(func(txn *badgerdb.Txn) error {
+		if _, err := getFlags(txn, id); err != nil {
+			return err
+		}
+
+		if _, err := deletePrefix(txn, withPrefix(key(prefixSubscription, id))); err != nil {
+			return err
+		}
+
+		if _, err := deletePrefix(txn, withPrefix(key(prefixMessage, id))); err != nil {
+			return err
+		}
+
+		return txn.Delete(key(prefixSession, id))
+	})
+}
+
+func newSession(db *dbStatus, id string) session {
+	ses := session{
+		db: db,
+		id: id,
+	}
+
+	ses.m = messages{
+		db: db,
+		id: id,
+	}
+
+	ses.s = subscriptions{
+		db: db,
+		id: id,
+	}
+
+	return ses
+}
+
+// Subscriptions
+func (s *session) Subscriptions() (types.Subscriptions, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &s.s, nil
+}
+
+// Messages
+func (s *session) Messages() (types.Messages, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &s.m, nil
+}
+
+func (s *session) ID() (string, error) {
+	select {
+	case <-s.db.done:
+		return "", types.ErrNotOpen
+	default:
+	}
+
+	return s.id, nil
+}
+
+func (s *subscriptions) Add(subs message.Subscriptions) error {
+	select {
+	case <-s.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return s.db.db.Update(func(txn *badgerdb.Txn) error {
+		flags, err := getFlags(txn, s.id)
+		if err != nil {
+			return err
+		}
+
+		if err = setFlags(txn, s.id, flags|flagSubscriptions); err != nil {
+			return err
+		}
+
+		for t, o := range subs {
+			if err = txn.Set(key(prefixSubscription, s.id, t), o.Encode()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *subscriptions) Get() (message.Subscriptions, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	res := make(message.Subscriptions)
+
+	err := s.db.db.View(func(txn *badgerdb.Txn) error {
+		flags, err := getFlags(txn, s.id)
+		if err != nil {
+			return err
+		}
+
+		if flags&flagSubscriptions == 0 {
+			return types.ErrNotFound
+		}
+
+		prefix := withPrefix(key(prefixSubscription, s.id))
+
+		opts := badgerdb.DefaultIteratorOptions
+		opts.Prefix = prefix
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			topic := string(item.Key()[len(prefix):])
+
+			// options of QoS alone encode into QoS byte stored by earlier versions
+			err = item.Value(func(val []byte) error {
+				o, e := message.DecodeSubscriptionOptions(val)
+				if e != nil {
+					return e
+				}
+				res[topic] = o
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *subscriptions) Delete() error {
+	select {
+	case <-s.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return s.db.db.Update(func(txn *badgerdb.Txn) error {
+		flags, err := getFlags(txn, s.id)
+		if err != nil {
+			return err
+		}
+
+		if flags&flagSubscriptions == 0 {
+			return types.ErrNotFound
+		}
+
+		if err = setFlags(txn, s.id, flags&^flagSubscriptions); err != nil {
+			return err
+		}
+
+		_, err = deletePrefix(txn, withPrefix(key(prefixSubscription, s.id)))
+		return err
+	})
+}
+
+// Store
+func (m *messages) Store(dir string, msg []message.Provider) error {
+	select {
+	case <-m.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	if dir != "in" && dir != "out" {
+		return types.ErrInvalidArgs
+	}
+
+	return m.db.db.Update(func(txn *badgerdb.Txn) error {
+		flags, err := getFlags(txn, m.id)
+		if err != nil {
+			return err
+		}
+
+		if err = setFlags(txn, m.id, flags|flagMessages); err != nil {
+			return err
+		}
+
+		for _, e := range msg {
+			var buf []byte
+			if buf, err = types.EncodeMessage(e); err != nil {
+				return err
+			}
+
+			var seq uint64
+			if seq, err = m.db.seq.Next(); err != nil {
+				return err
+			}
+
+			if err = txn.Set(seqKey(key(prefixMessage, m.id, dir), seq), buf); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Load
+func (m *messages) Load() (*types.SessionMessages, error) {
+	select {
+	case <-m.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	msg := types.SessionMessages{}
+
+	err := m.db.db.View(func(txn *badgerdb.Txn) error {
+		flags, err := getFlags(txn, m.id)
+		if err != nil {
+			return err
+		}
+
+		if flags&flagMessages == 0 {
+			return types.ErrNotFound
+		}
+
+		if msg.In.Messages, err = loadMessages(txn, withPrefix(key(prefixMessage, m.id, "in"))); err != nil {
+			return err
+		}
+
+		msg.Out.Messages, err = loadMessages(txn, withPrefix(key(prefixMessage, m.id, "out")))
+		return err
+	})
+
+	return &msg, err
+}
+
+// Delete
+func (m *messages) Delete() error {
+	select {
+	case <-m.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return m.db.db.Update(func(txn *badgerdb.Txn) error {
+		flags, err := getFlags(txn, m.id)
+		if err != nil {
+			return err
+		}
+
+		if flags&flagMessages == 0 {
+			return types.ErrNotFound
+		}
+
+		if err = setFlags(txn, m.id, flags&^flagMessages); err != nil {
+			return err
+		}
+
+		_, err = deletePrefix(txn, withPrefix(key(prefixMessage, m.id)))
+		return err
+	})
+}
+
+// Load
+func (r *retained) Load() ([]message.Provider, error) {
+	select {
+	case <-r.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	msg := []message.Provider{}
+
+	err := r.db.db.View(func(txn *badgerdb.Txn) error {
+		if _, err := txn.Get([]byte(keyRetainedMeta)); err == badgerdb.ErrKeyNotFound {
+			return types.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+
+		var err error
+		msg, err = loadMessages(txn, []byte{prefixRetained, 0})
+		return err
+	})
+
+	return msg, err
+}
+
+// Store
+func (r *retained) Store(msg []message.Provider) error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return r.db.db.Update(func(txn *badgerdb.Txn) error {
+		if err := txn.Set([]byte(keyRetainedMeta), nil); err != nil {
+			return err
+		}
+
+		for _, e := range msg {
+			buf, err := types.EncodeMessage(e)
+			if err != nil {
+				return err
+			}
+
+			m, ok := e.(*message.PublishMessage)
+			if !ok {
+				return types.ErrInvalidArgs
+			}
+
+			if err = txn.Set(key(prefixRetained, m.Topic()), buf); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Put
+func (r *retained) Put(msg *message.PublishMessage) error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	buf, err := types.EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	return r.db.db.Update(func(txn *badgerdb.Txn) error {
+		if err := txn.Set([]byte(keyRetainedMeta), nil); err != nil {
+			return err
+		}
+
+		return txn.Set(key(prefixRetained, msg.Topic()), buf)
+	})
+}
+
+// Remove
+func (r *retained) Remove(topic string) error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return r.db.db.Update(func(txn *badgerdb.Txn) error {
+		return txn.Delete(key(prefixRetained, topic))
+	})
+}
+
+// Delete
+func (r *retained) Delete() error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return r.db.db.Update(func(txn *badgerdb.Txn) error {
+		if _, err := txn.Get([]byte(keyRetainedMeta)); err == badgerdb.ErrKeyNotFound {
+			return types.ErrNotFound
+		} else if err != nil {
+			return err
+		}
+
+		if err := txn.Delete([]byte(keyRetainedMeta)); err != nil {
+			return err
+		}
+
+		_, err := deletePrefix(txn, []byte{prefixRetained, 0})
+		return err
+	})
+}
+
+// loadMessages decode values of all keys with given prefix in order of sequence
+func loadMessages(txn *badgerdb.Txn, prefix []byte) ([]message.Provider, error) {
+	entries := []message.Provider{}
+
+	opts := badgerdb.DefaultIteratorOptions
+	opts.Prefix = prefix
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		var m message.Provider
+		err := it.Item().Value(func(val []byte) error {
+			var e error
+			m, e = types.DecodeMessage(val)
+			return e
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, m)
+	}
+
+	return entries, nil
+}
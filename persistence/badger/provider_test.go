@@ -0,0 +1,101 @@
+package badger
+
+import (
+	"bytes"
+	"testing"
+
+	badgerdb "github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+func newProvider(t *testing.T) *impl {
+	p, err := NewBadger(&types.BadgerConfig{InMemory: true})
+	require.NoError(t, err)
+
+	return p.(*impl)
+}
+
+func TestHealth(t *testing.T) {
+	p := newProvider(t)
+
+	require.NoError(t, types.CheckHealth(p))
+	require.NoError(t, p.Shutdown())
+	require.Equal(t, types.ErrNotOpen, types.CheckHealth(p))
+}
+
+func TestSubscriptionOptions(t *testing.T) {
+	p := newProvider(t)
+	defer p.Shutdown() // nolint: errcheck
+
+	ss, err := p.Sessions()
+	require.NoError(t, err)
+
+	ses, err := ss.New("c1")
+	require.NoError(t, err)
+
+	subs, err := ses.Subscriptions()
+	require.NoError(t, err)
+
+	_, err = subs.Get()
+	require.Equal(t, types.ErrNotFound, err)
+
+	expected := message.Subscriptions{
+		"a/#": {QoS: message.QoS1, NoLocal: true, RetainAsPublished: true, RetainHandling: 2, ID: 42},
+		"b":   {QoS: message.QoS2},
+	}
+	require.NoError(t, subs.Add(expected))
+
+	res, err := subs.Get()
+	require.NoError(t, err)
+	require.Equal(t, expected, res)
+
+	// QoS byte stored by earlier versions
+	require.NoError(t, p.db.db.Update(func(txn *badgerdb.Txn) error {
+		return txn.Set(key(prefixSubscription, "c1", "legacy"), []byte{byte(message.QoS1)})
+	}))
+
+	res, err = subs.Get()
+	require.NoError(t, err)
+	require.Equal(t, message.SubscriptionOptions{QoS: message.QoS1}, res["legacy"])
+}
+
+func TestSnapshot(t *testing.T) {
+	p := newProvider(t)
+
+	ss, err := p.Sessions()
+	require.NoError(t, err)
+
+	ses, err := ss.New("c1")
+	require.NoError(t, err)
+
+	subs, err := ses.Subscriptions()
+	require.NoError(t, err)
+	require.NoError(t, subs.Add(message.Subscriptions{"a/#": {QoS: message.QoS1, ID: 7}}))
+
+	var buf bytes.Buffer
+	require.NoError(t, types.TakeSnapshot(p, &buf))
+	require.NoError(t, p.Shutdown())
+	require.Equal(t, types.ErrNotOpen, types.TakeSnapshot(p, &buf))
+
+	// backup restores into empty database
+	db, err := badgerdb.Open(badgerdb.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	defer db.Close() // nolint: errcheck
+
+	require.NoError(t, db.Load(&buf, 16))
+
+	restored := &impl{db: dbStatus{db: db, done: make(chan struct{})}}
+	restored.s = sessions{db: &restored.db}
+
+	ses, err = restored.s.Get("c1")
+	require.NoError(t, err)
+
+	subs, err = ses.Subscriptions()
+	require.NoError(t, err)
+
+	res, err := subs.Get()
+	require.NoError(t, err)
+	require.Equal(t, message.Subscriptions{"a/#": {QoS: message.QoS1, ID: 7}}, res)
+}
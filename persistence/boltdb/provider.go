@@ -2,10 +2,12 @@ package boltdb
 
 import (
 	"encoding/binary"
+	"io"
 	"sync"
 
 	"github.com/boltdb/bolt"
 	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence"
 	"github.com/troian/surgemq/persistence/types"
 )
 
@@ -71,6 +73,12 @@ type retained struct {
 	//tx *boltDB.Tx
 }
 
+func init() {
+	persistence.Register((*types.BoltDBConfig)(nil), func(config types.ProviderConfig) (types.Provider, error) { // nolint: errcheck, gas
+		return NewBoltDB(config.(*types.BoltDBConfig))
+	})
+}
+
 // NewBoltDB allocate new persistence provider of boltDB type
 func NewBoltDB(config *types.BoltDBConfig) (p types.Provider, err error) {
 	pl := &impl{
@@ -122,6 +130,34 @@ func (p *impl) Retained() (types.Retained, error) {
 	return &p.r, nil
 }
 
+// Health reports ErrNotOpen once provider has been shut down
+func (p *impl) Health() error {
+	select {
+	case <-p.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return nil
+}
+
+// Snapshot write consistent copy of database file. Shutdown waits until it completes
+func (p *impl) Snapshot(w io.Writer) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return p.db.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
 // Shutdown provider
 func (p *impl) Shutdown() error {
 	p.lock.Lock()
@@ -309,7 +345,7 @@ func (s *session) ID() (string, error) {
 	return s.id, nil
 }
 
-func (s *subscriptions) Add(subs message.TopicsQoS) error {
+func (s *subscriptions) Add(subs message.Subscriptions) error {
 	select {
 	case <-s.db.done:
 		return types.ErrNotOpen
@@ -332,7 +368,7 @@ func (s *subscriptions) Add(subs message.TopicsQoS) error {
 		if err != nil {
 			return err
 		}
-		for t, q := range subs {
+		for t, o := range subs {
 			id, _ := bucket.NextSequence() // nolint: gas
 
 			var pb *bolt.Bucket
@@ -344,7 +380,11 @@ func (s *subscriptions) Add(subs message.TopicsQoS) error {
 				return err
 			}
 
-			if err := pb.Put([]byte("qos"), []byte{byte(q)}); err != nil {
+			if err := pb.Put([]byte("qos"), []byte{byte(o.QoS)}); err != nil {
+				return err
+			}
+
+			if err := pb.Put([]byte("options"), o.Encode()); err != nil {
 				return err
 			}
 		}
@@ -352,14 +392,14 @@ func (s *subscriptions) Add(subs message.TopicsQoS) error {
 	})
 }
 
-func (s *subscriptions) Get() (message.TopicsQoS, error) {
+func (s *subscriptions) Get() (message.Subscriptions, error) {
 	select {
 	case <-s.db.done:
 		return nil, types.ErrNotOpen
 	default:
 	}
 
-	res := make(message.TopicsQoS)
+	res := make(message.Subscriptions)
 	err := s.db.db.View(func(tx *bolt.Tx) error {
 		// get sessions bucket
 		sesBucket := tx.Bucket([]byte(bucketSessions))
@@ -382,7 +422,7 @@ func (s *subscriptions) Get() (message.TopicsQoS, error) {
 			c := bucket.Cursor()
 			for k, _ := c.First(); k != nil; k, _ = c.Next() {
 				var t string
-				var q message.QosType
+				var o message.SubscriptionOptions
 				subBuck := bucket.Bucket(k)
 				err := subBuck.ForEach(func(k, v []byte) error {
 					name := string(k)
@@ -390,16 +430,21 @@ func (s *subscriptions) Get() (message.TopicsQoS, error) {
 					case "topic":
 						t = string(v)
 					case "qos":
-						q = message.QosType(v[0])
+						o.QoS = message.QosType(v[0])
 					}
 					return nil
 				})
 
+				// subscriptions stored by earlier versions have QoS only
+				if v := subBuck.Get([]byte("options")); v != nil && err == nil {
+					o, err = message.DecodeSubscriptionOptions(v)
+				}
+
 				if err != nil {
 					return err
 				}
 
-				res[t] = q
+				res[t] = o
 			}
 
 			return nil
@@ -587,13 +632,12 @@ func (r *retained) Store(msg []message.Provider) error {
 		}
 
 		for _, m := range msg {
-			id, _ := bucket.NextSequence() // nolint: gas
-			var pb *bolt.Bucket
-			if pb, err = bucket.CreateBucket(itob64(id)); err != nil {
-				return err
+			pm, ok := m.(*message.PublishMessage)
+			if !ok {
+				return types.ErrInvalidArgs
 			}
-			err = putMsg(pb, m)
-			if err != nil {
+
+			if err = putRetained(bucket, pm); err != nil {
 				return err
 			}
 		}
@@ -602,6 +646,62 @@ func (r *retained) Store(msg []message.Provider) error {
 	})
 }
 
+// Put
+func (r *retained) Put(msg *message.PublishMessage) error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return r.db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketRetained))
+		if err != nil {
+			return err
+		}
+
+		return putRetained(bucket, msg)
+	})
+}
+
+// Remove
+func (r *retained) Remove(topic string) error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return r.db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketRetained))
+		if bucket == nil {
+			return nil
+		}
+
+		if err := bucket.DeleteBucket([]byte(topic)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		return nil
+	})
+}
+
+// putRetained store message in bucket keyed by topic replacing previous one
+func putRetained(bucket *bolt.Bucket, msg *message.PublishMessage) error {
+	key := []byte(msg.Topic())
+
+	if err := bucket.DeleteBucket(key); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+
+	pb, err := bucket.CreateBucket(key)
+	if err != nil {
+		return err
+	}
+
+	return putMsg(pb, msg)
+}
+
 // Delete
 func (r *retained) Delete() error {
 	select {
@@ -652,6 +752,14 @@ func getMsgs(b *bolt.Bucket) ([]message.Provider, error) {
 				case "qos":
 					e = m.SetQoS(message.QosType(val[0]))
 				}
+			case *message.PubRelMessage:
+				if string(name) == "id" {
+					m.SetPacketID(binary.BigEndian.Uint16(val))
+				}
+			case *message.PubRecMessage:
+				if string(name) == "id" {
+					m.SetPacketID(binary.BigEndian.Uint16(val))
+				}
 			}
 
 			return e
@@ -692,7 +800,7 @@ func putMsg(b *bolt.Bucket, msg message.Provider) error {
 				return err
 			}
 		}
-	case *message.PubRelMessage:
+	case *message.PubRelMessage, *message.PubRecMessage:
 		// have nothing to do here
 	}
 
@@ -0,0 +1,167 @@
+// Package compress compression of persisted message payloads
+package compress
+
+import (
+	"errors"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/troian/surgemq/persistence"
+	"github.com/troian/surgemq/persistence/transform"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+// Layout of compressed payload
+//
+//	magic(4) algorithm(1) data
+//
+// payloads smaller than MinSize are stored as is unless they start with magic
+var magic = []byte{'S', 'M', 'Q', 2}
+
+const (
+	algNone   byte = 0
+	algSnappy byte = 1
+	algZstd   byte = 2
+)
+
+// defaultMinSize payloads below are not worth compressing
+const defaultMinSize = 256
+
+var (
+	// ErrUnknownAlgorithm compression algorithm is not supported
+	ErrUnknownAlgorithm = errors.New("compress: unknown algorithm")
+
+	// ErrMalformed compressed payload is truncated
+	ErrMalformed = errors.New("compress: malformed payload")
+)
+
+// Transformer compresses payloads
+type Transformer struct {
+	alg     byte
+	minSize int
+
+	zenc *zstd.Encoder
+	zdec *zstd.Decoder
+}
+
+func init() {
+	persistence.Register((*types.CompressionConfig)(nil), func(config types.ProviderConfig) (types.Provider, error) { // nolint: errcheck, gas
+		cfg := config.(*types.CompressionConfig)
+		if cfg.Provider == nil {
+			return nil, types.ErrInvalidArgs
+		}
+
+		t, err := New(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		inner, err := persistence.New(cfg.Provider)
+		if err != nil {
+			return nil, err
+		}
+
+		return transform.New(inner, t), nil
+	})
+}
+
+// New transformer
+func New(config *types.CompressionConfig) (*Transformer, error) {
+	t := &Transformer{
+		minSize: config.MinSize,
+	}
+
+	if t.minSize <= 0 {
+		t.minSize = defaultMinSize
+	}
+
+	switch config.Algorithm {
+	case types.CompressionSnappy:
+		t.alg = algSnappy
+	case types.CompressionZstd:
+		t.alg = algZstd
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+
+	var err error
+
+	level := zstd.SpeedDefault
+	if config.Level > 0 {
+		level = zstd.EncoderLevelFromZstd(config.Level)
+	}
+
+	if t.zenc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1)); err != nil {
+		return nil, err
+	}
+
+	// decoder is needed even with snappy to read data stored under other configuration
+	if t.zdec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1)); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Encode compress payload
+func (t *Transformer) Encode(topic string, payload []byte) ([]byte, error) {
+	if len(payload) < t.minSize {
+		if !hasMagic(payload) {
+			return payload, nil
+		}
+
+		return wrap(algNone, payload), nil
+	}
+
+	var data []byte
+
+	switch t.alg {
+	case algSnappy:
+		data = snappy.Encode(nil, payload)
+	case algZstd:
+		data = t.zenc.EncodeAll(payload, nil)
+	}
+
+	// incompressible, e.g. encrypted or already compressed data
+	if len(data) >= len(payload) {
+		return wrap(algNone, payload), nil
+	}
+
+	return wrap(t.alg, data), nil
+}
+
+// Decode decompress payload. Payloads stored before compression has been enabled are returned as is
+func (t *Transformer) Decode(topic string, payload []byte) ([]byte, error) {
+	if !hasMagic(payload) {
+		return payload, nil
+	}
+
+	if len(payload) < len(magic)+1 {
+		return nil, ErrMalformed
+	}
+
+	data := payload[len(magic)+1:]
+
+	switch payload[len(magic)] {
+	case algNone:
+		return data, nil
+	case algSnappy:
+		return snappy.Decode(nil, data)
+	case algZstd:
+		return t.zdec.DecodeAll(data, nil)
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+}
+
+func hasMagic(payload []byte) bool {
+	return len(payload) >= len(magic) && string(payload[:len(magic)]) == string(magic)
+}
+
+func wrap(alg byte, data []byte) []byte {
+	buf := make([]byte, 0, len(magic)+1+len(data))
+	buf = append(buf, magic...)
+	buf = append(buf, alg)
+
+	return append(buf, data...)
+}
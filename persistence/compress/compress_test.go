@@ -0,0 +1,64 @@
+package compress
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+func TestRoundTrip(t *testing.T) {
+	large := bytes.Repeat([]byte("compressible payload "), 100)
+
+	for _, alg := range []string{types.CompressionSnappy, types.CompressionZstd} {
+		t.Run(alg, func(t *testing.T) {
+			tr, err := New(&types.CompressionConfig{Algorithm: alg})
+			require.NoError(t, err)
+
+			enc, err := tr.Encode("t", large)
+			require.NoError(t, err)
+			require.True(t, len(enc) < len(large))
+
+			dec, err := tr.Decode("t", enc)
+			require.NoError(t, err)
+			require.Equal(t, large, dec)
+
+			// small payload stored as is
+			enc, err = tr.Encode("t", []byte("small"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("small"), enc)
+
+			// small payload looking like compressed one is wrapped
+			tricky := append(append([]byte{}, magic...), algZstd, 'x')
+			enc, err = tr.Encode("t", tricky)
+			require.NoError(t, err)
+
+			dec, err = tr.Decode("t", enc)
+			require.NoError(t, err)
+			require.Equal(t, tricky, dec)
+		})
+	}
+}
+
+func TestCrossAlgorithm(t *testing.T) {
+	large := bytes.Repeat([]byte("compressible payload "), 100)
+
+	snappyTr, err := New(&types.CompressionConfig{Algorithm: types.CompressionSnappy})
+	require.NoError(t, err)
+
+	zstdTr, err := New(&types.CompressionConfig{Algorithm: types.CompressionZstd})
+	require.NoError(t, err)
+
+	enc, err := snappyTr.Encode("t", large)
+	require.NoError(t, err)
+
+	dec, err := zstdTr.Decode("t", enc)
+	require.NoError(t, err)
+	require.Equal(t, large, dec)
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	_, err := New(&types.CompressionConfig{Algorithm: "lz4"})
+	require.Equal(t, ErrUnknownAlgorithm, err)
+}
@@ -0,0 +1,356 @@
+// Package dump export and import of persisted state in backend independent format
+// Allows migrating sessions, subscriptions and retained messages between backends
+package dump
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+// Version of dump format
+const Version = 1
+
+// Format of encoded dump
+type Format string
+
+// Supported formats
+const (
+	FormatJSON Format = "json"
+	FormatCBOR Format = "cbor"
+)
+
+var (
+	// ErrUnknownFormat format is neither json nor cbor
+	ErrUnknownFormat = errors.New("dump: unknown format")
+
+	// ErrVersion dump has been made by newer version
+	ErrVersion = errors.New("dump: unsupported version")
+)
+
+// Message persisted message
+type Message struct {
+	Type     byte   `json:"type" cbor:"1,keyasint"`
+	PacketID uint16 `json:"packetId,omitempty" cbor:"2,keyasint,omitempty"`
+	QoS      byte   `json:"qos,omitempty" cbor:"3,keyasint,omitempty"`
+	Retain   bool   `json:"retain,omitempty" cbor:"4,keyasint,omitempty"`
+	Dup      bool   `json:"dup,omitempty" cbor:"5,keyasint,omitempty"`
+	Topic    string `json:"topic,omitempty" cbor:"6,keyasint,omitempty"`
+	Payload  []byte `json:"payload,omitempty" cbor:"7,keyasint,omitempty"`
+}
+
+// SubscriptionOptions of subscription other than QoS
+type SubscriptionOptions struct {
+	NoLocal           bool   `json:"noLocal,omitempty" cbor:"1,keyasint,omitempty"`
+	RetainAsPublished bool   `json:"retainAsPublished,omitempty" cbor:"2,keyasint,omitempty"`
+	RetainHandling    byte   `json:"retainHandling,omitempty" cbor:"3,keyasint,omitempty"`
+	ID                uint32 `json:"id,omitempty" cbor:"4,keyasint,omitempty"`
+}
+
+// Session persisted session
+// Options are present only for subscriptions having ones other than QoS
+type Session struct {
+	ID            string                         `json:"id" cbor:"1,keyasint"`
+	Subscriptions map[string]byte                `json:"subscriptions,omitempty" cbor:"2,keyasint,omitempty"`
+	In            []Message                      `json:"in,omitempty" cbor:"3,keyasint,omitempty"`
+	Out           []Message                      `json:"out,omitempty" cbor:"4,keyasint,omitempty"`
+	Options       map[string]SubscriptionOptions `json:"options,omitempty" cbor:"5,keyasint,omitempty"`
+}
+
+// Dump whole persisted state
+type Dump struct {
+	Version  int       `json:"version" cbor:"1,keyasint"`
+	Sessions []Session `json:"sessions" cbor:"2,keyasint"`
+	Retained []Message `json:"retained" cbor:"3,keyasint"`
+}
+
+// Export read all sessions and retained messages. Provider state is not modified
+func Export(p types.Provider) (*Dump, error) {
+	d := &Dump{
+		Version:  Version,
+		Sessions: []Session{},
+		Retained: []Message{},
+	}
+
+	sessions, err := p.Sessions()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []types.Session
+	if list, err = sessions.GetAll(); err != nil && err != types.ErrNotFound {
+		return nil, err
+	}
+
+	for _, ses := range list {
+		var s Session
+		if s, err = exportSession(ses); err != nil {
+			return nil, err
+		}
+
+		d.Sessions = append(d.Sessions, s)
+	}
+
+	var retained types.Retained
+	if retained, err = p.Retained(); err != nil {
+		return nil, err
+	}
+
+	var msg []message.Provider
+	if msg, err = retained.Load(); err != nil && err != types.ErrNotFound {
+		return nil, err
+	}
+
+	d.Retained = fromMessages(msg)
+
+	return d, nil
+}
+
+// Import write dump into provider. Existing sessions are merged
+func Import(p types.Provider, d *Dump) error {
+	if d.Version > Version {
+		return ErrVersion
+	}
+
+	sessions, err := p.Sessions()
+	if err != nil {
+		return err
+	}
+
+	for i := range d.Sessions {
+		if err = importSession(sessions, &d.Sessions[i]); err != nil {
+			return err
+		}
+	}
+
+	if len(d.Retained) > 0 {
+		var retained types.Retained
+		if retained, err = p.Retained(); err != nil {
+			return err
+		}
+
+		var msg []message.Provider
+		if msg, err = toMessages(d.Retained); err != nil {
+			return err
+		}
+
+		if err = retained.Store(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Encode dump in given format
+func (d *Dump) Encode(w io.Writer, format Format) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	case FormatCBOR:
+		return cbor.NewEncoder(w).Encode(d)
+	default:
+		return ErrUnknownFormat
+	}
+}
+
+// Decode dump of given format
+func Decode(r io.Reader, format Format) (*Dump, error) {
+	d := &Dump{}
+
+	var err error
+
+	switch format {
+	case FormatJSON:
+		err = json.NewDecoder(r).Decode(d)
+	case FormatCBOR:
+		err = cbor.NewDecoder(r).Decode(d)
+	default:
+		err = ErrUnknownFormat
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func exportSession(ses types.Session) (Session, error) {
+	var s Session
+
+	var err error
+	if s.ID, err = ses.ID(); err != nil {
+		return s, err
+	}
+
+	var subs types.Subscriptions
+	if subs, err = ses.Subscriptions(); err != nil {
+		return s, err
+	}
+
+	var topics message.Subscriptions
+	if topics, err = subs.Get(); err != nil && err != types.ErrNotFound {
+		return s, err
+	}
+
+	if len(topics) > 0 {
+		s.Subscriptions = make(map[string]byte, len(topics))
+		for t, o := range topics {
+			s.Subscriptions[t] = byte(o.QoS)
+
+			if opts := (SubscriptionOptions{
+				NoLocal:           o.NoLocal,
+				RetainAsPublished: o.RetainAsPublished,
+				RetainHandling:    o.RetainHandling,
+				ID:                o.ID,
+			}); opts != (SubscriptionOptions{}) {
+				if s.Options == nil {
+					s.Options = make(map[string]SubscriptionOptions)
+				}
+				s.Options[t] = opts
+			}
+		}
+	}
+
+	var msg types.Messages
+	if msg, err = ses.Messages(); err != nil {
+		return s, err
+	}
+
+	var stored *types.SessionMessages
+	if stored, err = msg.Load(); err != nil && err != types.ErrNotFound {
+		return s, err
+	}
+
+	if stored != nil {
+		s.In = fromMessages(stored.In.Messages)
+		s.Out = fromMessages(stored.Out.Messages)
+	}
+
+	return s, nil
+}
+
+func importSession(sessions types.Sessions, s *Session) error {
+	ses, err := sessions.New(s.ID)
+	if err == types.ErrAlreadyExists {
+		ses, err = sessions.Get(s.ID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(s.Subscriptions) > 0 {
+		topics := make(message.Subscriptions, len(s.Subscriptions))
+		for t, q := range s.Subscriptions {
+			opts := s.Options[t]
+			topics[t] = message.SubscriptionOptions{
+				QoS:               message.QosType(q),
+				NoLocal:           opts.NoLocal,
+				RetainAsPublished: opts.RetainAsPublished,
+				RetainHandling:    opts.RetainHandling,
+				ID:                opts.ID,
+			}
+		}
+
+		var subs types.Subscriptions
+		if subs, err = ses.Subscriptions(); err != nil {
+			return err
+		}
+
+		if err = subs.Add(topics); err != nil {
+			return err
+		}
+	}
+
+	if len(s.In) == 0 && len(s.Out) == 0 {
+		return nil
+	}
+
+	var msg types.Messages
+	if msg, err = ses.Messages(); err != nil {
+		return err
+	}
+
+	for dir, list := range map[string][]Message{"in": s.In, "out": s.Out} {
+		if len(list) == 0 {
+			continue
+		}
+
+		var m []message.Provider
+		if m, err = toMessages(list); err != nil {
+			return err
+		}
+
+		if err = msg.Store(dir, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func fromMessages(msg []message.Provider) []Message {
+	res := make([]Message, 0, len(msg))
+
+	for _, e := range msg {
+		m := Message{
+			Type:     byte(e.Type()),
+			PacketID: e.PacketID(),
+		}
+
+		if p, ok := e.(*message.PublishMessage); ok {
+			m.QoS = byte(p.QoS())
+			m.Retain = p.Retain()
+			m.Dup = p.Dup()
+			m.Topic = p.Topic()
+			m.Payload = p.Payload()
+		}
+
+		res = append(res, m)
+	}
+
+	return res
+}
+
+func toMessages(list []Message) ([]message.Provider, error) {
+	res := make([]message.Provider, 0, len(list))
+
+	for _, m := range list {
+		msg, err := message.Type(m.Type).NewMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		switch e := msg.(type) {
+		case *message.PublishMessage:
+			e.SetPacketID(m.PacketID)
+			e.SetRetain(m.Retain)
+			e.SetDup(m.Dup)
+			e.SetPayload(m.Payload)
+
+			if err = e.SetQoS(message.QosType(m.QoS)); err != nil {
+				return nil, err
+			}
+
+			if err = e.SetTopic(m.Topic); err != nil {
+				return nil, err
+			}
+		case *message.PubRelMessage:
+			e.SetPacketID(m.PacketID)
+		case *message.PubRecMessage:
+			e.SetPacketID(m.PacketID)
+		}
+
+		res = append(res, msg)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,106 @@
+package dump
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/boltdb"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+func newPublish(t *testing.T, id uint16, topic string, payload string) *message.PublishMessage {
+	m := message.NewPublishMessage()
+	require.NoError(t, m.SetQoS(message.QoS1))
+	require.NoError(t, m.SetTopic(topic))
+	m.SetPacketID(id)
+	m.SetPayload([]byte(payload))
+
+	return m
+}
+
+func populate(t *testing.T, p types.Provider) {
+	sessions, err := p.Sessions()
+	require.NoError(t, err)
+
+	ses, err := sessions.New("client1")
+	require.NoError(t, err)
+
+	subs, err := ses.Subscriptions()
+	require.NoError(t, err)
+	require.NoError(t, subs.Add(message.Subscriptions{
+		"a/b": {QoS: message.QoS1},
+		"c/#": {QoS: message.QoS2, NoLocal: true, ID: 7},
+	}))
+
+	msg, err := ses.Messages()
+	require.NoError(t, err)
+
+	rel := message.NewPubRelMessage()
+	rel.SetPacketID(3)
+
+	require.NoError(t, msg.Store("out", []message.Provider{newPublish(t, 1, "a/b", "one"), rel}))
+	require.NoError(t, msg.Store("in", []message.Provider{newPublish(t, 2, "x", "two")}))
+
+	_, err = sessions.New("client2")
+	require.NoError(t, err)
+
+	retained, err := p.Retained()
+	require.NoError(t, err)
+	require.NoError(t, retained.Put(newPublish(t, 0, "r/1", "retained")))
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	src, err := boltdb.NewBoltDB(&types.BoltDBConfig{File: filepath.Join(dir, "src.db")})
+	require.NoError(t, err)
+	defer src.Shutdown() // nolint: errcheck
+
+	populate(t, src)
+
+	d, err := Export(src)
+	require.NoError(t, err)
+	require.Len(t, d.Sessions, 2)
+	require.Len(t, d.Retained, 1)
+	require.Equal(t, map[string]SubscriptionOptions{"c/#": {NoLocal: true, ID: 7}}, d.Sessions[0].Options)
+
+	for i, format := range []Format{FormatJSON, FormatCBOR} {
+		buf := &bytes.Buffer{}
+		require.NoError(t, d.Encode(buf, format))
+
+		var decoded *Dump
+		decoded, err = Decode(buf, format)
+		require.NoError(t, err)
+
+		var dst types.Provider
+		dst, err = boltdb.NewBoltDB(&types.BoltDBConfig{File: filepath.Join(dir, string(rune('a'+i))+".db")})
+		require.NoError(t, err)
+
+		require.NoError(t, Import(dst, decoded))
+
+		var res *Dump
+		res, err = Export(dst)
+		require.NoError(t, err)
+		require.Equal(t, d, res)
+
+		require.NoError(t, dst.Shutdown())
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	d := &Dump{Version: Version}
+	require.Equal(t, ErrUnknownFormat, d.Encode(&bytes.Buffer{}, "xml"))
+
+	_, err := Decode(&bytes.Buffer{}, "xml")
+	require.Equal(t, ErrUnknownFormat, err)
+
+	d.Version = Version + 1
+	require.Equal(t, ErrVersion, Import(nil, d))
+}
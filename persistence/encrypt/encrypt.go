@@ -0,0 +1,266 @@
+// Package encrypt AES-GCM encryption of persisted message payloads
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/troian/surgemq/persistence"
+	"github.com/troian/surgemq/persistence/transform"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+// Layout of encrypted payload
+//
+//	magic(4) keyIDLen(1) keyID nonce(12) ciphertext
+//
+// topic of message is used as additional data thus payload cannot be moved between topics
+var magic = []byte{'S', 'M', 'Q', 1}
+
+var (
+	// ErrInvalidKey key is not 16, 24 or 32 bytes long
+	ErrInvalidKey = errors.New("encrypt: invalid key size")
+
+	// ErrUnknownKey key of encrypted data is not known to key provider
+	ErrUnknownKey = errors.New("encrypt: unknown key")
+
+	// ErrMalformed encrypted payload is truncated
+	ErrMalformed = errors.New("encrypt: malformed payload")
+)
+
+// Transformer encrypts payloads with keys given by provider
+type Transformer struct {
+	keys types.KeyProvider
+
+	lock  sync.Mutex
+	aeads map[string]cipher.AEAD
+}
+
+func init() {
+	persistence.Register((*types.EncryptionConfig)(nil), func(config types.ProviderConfig) (types.Provider, error) { // nolint: errcheck, gas
+		cfg := config.(*types.EncryptionConfig)
+		if cfg.Provider == nil || cfg.Keys == nil {
+			return nil, types.ErrInvalidArgs
+		}
+
+		inner, err := persistence.New(cfg.Provider)
+		if err != nil {
+			return nil, err
+		}
+
+		return transform.New(inner, New(cfg.Keys)), nil
+	})
+}
+
+// New transformer
+func New(keys types.KeyProvider) *Transformer {
+	return &Transformer{
+		keys:  keys,
+		aeads: make(map[string]cipher.AEAD),
+	}
+}
+
+// Encode encrypt payload with current key
+func (t *Transformer) Encode(topic string, payload []byte) ([]byte, error) {
+	id, key, err := t.keys.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(id) > 0xFF {
+		return nil, ErrInvalidKey
+	}
+
+	var aead cipher.AEAD
+	if aead, err = t.aead(id, key); err != nil {
+		return nil, err
+	}
+
+	hdr := len(magic) + 1 + len(id)
+
+	buf := make([]byte, hdr+aead.NonceSize(), hdr+aead.NonceSize()+len(payload)+aead.Overhead())
+	copy(buf, magic)
+	buf[len(magic)] = byte(len(id))
+	copy(buf[len(magic)+1:], id)
+
+	nonce := buf[hdr:]
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(buf, nonce, payload, []byte(topic)), nil
+}
+
+// Decode decrypt payload. Payloads stored before encryption has been enabled are returned as is
+func (t *Transformer) Decode(topic string, payload []byte) ([]byte, error) {
+	if len(payload) < len(magic)+1 || string(payload[:len(magic)]) != string(magic) {
+		return payload, nil
+	}
+
+	idLen := int(payload[len(magic)])
+	hdr := len(magic) + 1 + idLen
+	if len(payload) < hdr {
+		return nil, ErrMalformed
+	}
+
+	id := string(payload[len(magic)+1 : hdr])
+
+	aead, err := t.aead(id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) < hdr+aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+
+	nonce := payload[hdr : hdr+aead.NonceSize()]
+
+	return aead.Open(nil, nonce, payload[hdr+aead.NonceSize():], []byte(topic))
+}
+
+// aead cipher of key. key is requested from provider if nil
+func (t *Transformer) aead(id string, key []byte) (cipher.AEAD, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if a, ok := t.aeads[id]; ok {
+		return a, nil
+	}
+
+	if key == nil {
+		var err error
+		if key, err = t.keys.KeyByID(id); err != nil {
+			return nil, err
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+
+	var a cipher.AEAD
+	if a, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	t.aeads[id] = a
+
+	return a, nil
+}
+
+// staticKey single key known at start
+type staticKey struct {
+	id  string
+	key []byte
+}
+
+func (k *staticKey) Key() (string, []byte, error) {
+	return k.id, k.key, nil
+}
+
+func (k *staticKey) KeyByID(id string) ([]byte, error) {
+	if id != k.id {
+		return nil, ErrUnknownKey
+	}
+
+	return k.key, nil
+}
+
+// NewStaticKey provider of single key
+func NewStaticKey(id string, key []byte) (types.KeyProvider, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	return &staticKey{id: id, key: key}, nil
+}
+
+// NewEnvKey provider of key taken from environment variable
+// Value is either hex or base64 encoded, variable name is used as key id
+func NewEnvKey(name string) (types.KeyProvider, error) {
+	key, err := parseKey(os.Getenv(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStaticKey(name, key)
+}
+
+// NewFileKey provider of key read from file
+// File contains either raw key or hex/base64 encoded one, file name is used as key id
+func NewFileKey(path string) (types.KeyProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := data
+	if checkKey(key) != nil {
+		if key, err = parseKey(string(data)); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewStaticKey(filepath.Base(path), key)
+}
+
+// KeyFunc provider delegating to callbacks, e.g. KMS client
+// Keys returned by ByID are cached for life of transformer
+type KeyFunc struct {
+	// Current key used to encrypt new data
+	Current func() (id string, key []byte, err error)
+
+	// ByID key data has been encrypted with
+	ByID func(id string) ([]byte, error)
+}
+
+var _ types.KeyProvider = (*KeyFunc)(nil)
+
+// Key
+func (k *KeyFunc) Key() (string, []byte, error) {
+	return k.Current()
+}
+
+// KeyByID
+func (k *KeyFunc) KeyByID(id string) ([]byte, error) {
+	if k.ByID == nil {
+		return nil, ErrUnknownKey
+	}
+
+	return k.ByID(id)
+}
+
+func checkKey(key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return ErrInvalidKey
+	}
+}
+
+func parseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+
+	if key, err := hex.DecodeString(s); err == nil && checkKey(key) == nil {
+		return key, nil
+	}
+
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && checkKey(key) == nil {
+		return key, nil
+	}
+
+	return nil, ErrInvalidKey
+}
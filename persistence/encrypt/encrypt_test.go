@@ -0,0 +1,100 @@
+package encrypt
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestRoundTrip(t *testing.T) {
+	keys, err := NewStaticKey("k1", testKey)
+	require.NoError(t, err)
+
+	tr := New(keys)
+
+	enc, err := tr.Encode("a/b", []byte("payload"))
+	require.NoError(t, err)
+	require.NotContains(t, string(enc), "payload")
+
+	dec, err := tr.Decode("a/b", enc)
+	require.NoError(t, err)
+	require.Equal(t, []byte("payload"), dec)
+
+	// payload is bound to topic
+	_, err = tr.Decode("a/c", enc)
+	require.Error(t, err)
+
+	// data stored before encryption enabled
+	dec, err = tr.Decode("a/b", []byte("plain"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("plain"), dec)
+}
+
+func TestKeyRotation(t *testing.T) {
+	old, err := NewStaticKey("old", testKey)
+	require.NoError(t, err)
+
+	enc, err := New(old).Encode("t", []byte("payload"))
+	require.NoError(t, err)
+
+	current := []byte("fedcba9876543210")
+
+	tr := New(&KeyFunc{
+		Current: func() (string, []byte, error) {
+			return "new", current, nil
+		},
+		ByID: func(id string) ([]byte, error) {
+			switch id {
+			case "old":
+				return testKey, nil
+			case "new":
+				return current, nil
+			}
+			return nil, ErrUnknownKey
+		},
+	})
+
+	dec, err := tr.Decode("t", enc)
+	require.NoError(t, err)
+	require.Equal(t, []byte("payload"), dec)
+
+	_, err = New(&KeyFunc{Current: old.Key}).Decode("t", enc)
+	require.Equal(t, ErrUnknownKey, err)
+}
+
+func TestKeyProviders(t *testing.T) {
+	_, err := NewStaticKey("k", []byte("short"))
+	require.Equal(t, ErrInvalidKey, err)
+
+	require.NoError(t, os.Setenv("SURGEMQ_TEST_KEY", hex.EncodeToString(testKey)))
+	defer os.Unsetenv("SURGEMQ_TEST_KEY") // nolint: errcheck
+
+	keys, err := NewEnvKey("SURGEMQ_TEST_KEY")
+	require.NoError(t, err)
+
+	id, key, err := keys.Key()
+	require.NoError(t, err)
+	require.Equal(t, "SURGEMQ_TEST_KEY", id)
+	require.Equal(t, testKey, key)
+
+	dir, err := ioutil.TempDir("", "encrypt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	path := filepath.Join(dir, "persist.key")
+	require.NoError(t, ioutil.WriteFile(path, testKey, 0600))
+
+	keys, err = NewFileKey(path)
+	require.NoError(t, err)
+
+	id, key, err = keys.Key()
+	require.NoError(t, err)
+	require.Equal(t, "persist.key", id)
+	require.Equal(t, testKey, key)
+}
@@ -0,0 +1,409 @@
+// Package gc periodically removes expired sessions, messages of long idle sessions
+// and orphaned retained entries from underlying persistence provider
+package gc
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence"
+	"github.com/troian/surgemq/persistence/types"
+	"go.uber.org/zap"
+)
+
+const defaultInterval = time.Hour
+
+// Stats state reclaimed by single collection
+type Stats struct {
+	Sessions uint64
+	Messages uint64
+	Retained uint64
+
+	// Bytes encoded size of removed messages
+	Bytes uint64
+}
+
+type impl struct {
+	inner    types.Provider
+	sessions types.Sessions
+	config   types.GCConfig
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// lock protects last access time of sessions
+	lock     sync.Mutex
+	accessed map[string]time.Time
+
+	s sessions
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+}
+
+type sessions struct {
+	p *impl
+}
+
+var _ types.Provider = (*impl)(nil)
+var _ types.Sessions = (*sessions)(nil)
+
+func init() {
+	persistence.Register((*types.GCConfig)(nil), func(config types.ProviderConfig) (types.Provider, error) { // nolint: errcheck, gas
+		cfg := config.(*types.GCConfig)
+		if cfg.Provider == nil {
+			return nil, types.ErrInvalidArgs
+		}
+
+		inner, err := persistence.New(cfg.Provider)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := New(inner, cfg)
+		if err != nil {
+			inner.Shutdown() // nolint: errcheck, gas
+			return nil, err
+		}
+
+		return p, nil
+	})
+}
+
+// New wrap provider with garbage collector
+func New(inner types.Provider, config *types.GCConfig) (types.Provider, error) {
+	s, err := inner.Sessions()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &impl{
+		inner:    inner,
+		sessions: s,
+		config:   *config,
+		done:     make(chan struct{}),
+		accessed: make(map[string]time.Time),
+	}
+
+	if p.config.Interval <= 0 {
+		p.config.Interval = defaultInterval
+	}
+
+	p.s.p = p
+
+	// idle time of sessions stored before is counted from now
+	now := time.Now()
+	if list, err := s.GetAll(); err == nil {
+		for _, ses := range list {
+			if id, e := ses.ID(); e == nil {
+				p.accessed[id] = now
+			}
+		}
+	}
+
+	p.log.prod = surgemq.GetProdLogger().Named("persistence.gc")
+	p.log.dev = surgemq.GetDevLogger().Named("persistence.gc")
+
+	if p.config.SessionExpiry > 0 || p.config.MessageExpiry > 0 {
+		p.wg.Add(1)
+		go p.worker()
+	}
+
+	return p, nil
+}
+
+// Sessions
+func (p *impl) Sessions() (types.Sessions, error) {
+	select {
+	case <-p.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &p.s, nil
+}
+
+// Retained
+func (p *impl) Retained() (types.Retained, error) {
+	select {
+	case <-p.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return p.inner.Retained()
+}
+
+// Health of underlying provider
+func (p *impl) Health() error {
+	select {
+	case <-p.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return types.CheckHealth(p.inner)
+}
+
+// Snapshot of underlying provider
+func (p *impl) Snapshot(w io.Writer) error {
+	return types.TakeSnapshot(p.inner, w)
+}
+
+// Shutdown stop collector and shutdown underlying provider
+func (p *impl) Shutdown() error {
+	p.lock.Lock()
+	select {
+	case <-p.done:
+		p.lock.Unlock()
+		return types.ErrNotOpen
+	default:
+	}
+
+	close(p.done)
+	p.lock.Unlock()
+
+	p.wg.Wait()
+
+	return p.inner.Shutdown()
+}
+
+func (p *impl) worker() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			st, err := p.collect(time.Now())
+			if err != nil {
+				p.log.prod.Error("Couldn't collect expired state", zap.Error(err))
+			}
+
+			if st.Sessions > 0 || st.Messages > 0 || st.Retained > 0 {
+				p.log.prod.Info("Collected expired state",
+					zap.Uint64("sessions", st.Sessions),
+					zap.Uint64("messages", st.Messages),
+					zap.Uint64("retained", st.Retained),
+					zap.Uint64("bytes", st.Bytes))
+			}
+
+			if p.config.Stat != nil {
+				p.config.Stat.Collected(st.Sessions, st.Messages, st.Retained, st.Bytes)
+			}
+		}
+	}
+}
+
+// touch record access of session
+func (p *impl) touch(id string, now time.Time) {
+	p.lock.Lock()
+	p.accessed[id] = now
+	p.lock.Unlock()
+}
+
+// idle time of session. Sessions not seen before are considered accessed now
+func (p *impl) idle(id string, now time.Time) time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	t, ok := p.accessed[id]
+	if !ok {
+		p.accessed[id] = now
+		return 0
+	}
+
+	return now.Sub(t)
+}
+
+// collect expired state as of given time
+func (p *impl) collect(now time.Time) (Stats, error) {
+	var st Stats
+
+	list, err := p.sessions.GetAll()
+	if err != nil && err != types.ErrNotFound {
+		return st, err
+	}
+
+	for _, ses := range list {
+		select {
+		case <-p.done:
+			return st, nil
+		default:
+		}
+
+		var id string
+		if id, err = ses.ID(); err != nil {
+			return st, err
+		}
+
+		idle := p.idle(id, now)
+
+		switch {
+		case p.config.SessionExpiry > 0 && idle > p.config.SessionExpiry:
+			if p.config.Expire != nil && !p.config.Expire(id) {
+				continue
+			}
+
+			err = p.collectSession(id, ses, &st)
+		case p.config.MessageExpiry > 0 && idle > p.config.MessageExpiry:
+			err = p.collectMessages(id, ses, &st)
+		}
+
+		if err != nil {
+			return st, err
+		}
+	}
+
+	err = p.collectRetained(&st)
+
+	return st, err
+}
+
+func (p *impl) collectSession(id string, ses types.Session, st *Stats) error {
+	msg, err := ses.Messages()
+	if err != nil {
+		return err
+	}
+
+	count, size := p.expire(id, msg)
+
+	if err = p.sessions.Delete(id); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	delete(p.accessed, id)
+	p.lock.Unlock()
+
+	st.Sessions++
+	st.Messages += count
+	st.Bytes += size
+
+	p.log.dev.Debug("Session expired", zap.String("ClientID", id))
+
+	return nil
+}
+
+func (p *impl) collectMessages(id string, ses types.Session, st *Stats) error {
+	msg, err := ses.Messages()
+	if err != nil {
+		return err
+	}
+
+	count, size := p.expire(id, msg)
+	if count == 0 {
+		return nil
+	}
+
+	if err = msg.Delete(); err != nil {
+		return err
+	}
+
+	st.Messages += count
+	st.Bytes += size
+
+	return nil
+}
+
+// collectRetained remove retained entries having empty payload
+// Such entries clear retained message of topic thus must not be stored
+func (p *impl) collectRetained(st *Stats) error {
+	r, err := p.inner.Retained()
+	if err != nil {
+		return err
+	}
+
+	var list []message.Provider
+	if list, err = r.Load(); err != nil {
+		if err == types.ErrNotFound {
+			err = nil
+		}
+
+		return err
+	}
+
+	for _, e := range list {
+		m, ok := e.(*message.PublishMessage)
+		if !ok || len(m.Payload()) > 0 {
+			continue
+		}
+
+		if err = r.Remove(m.Topic()); err != nil {
+			return err
+		}
+
+		st.Retained++
+		st.Bytes += uint64(size(m))
+	}
+
+	return nil
+}
+
+// expire account messages about to be removed and report undelivered ones
+func (p *impl) expire(id string, msg types.Messages) (uint64, uint64) {
+	stored, err := msg.Load()
+	if err != nil || stored == nil {
+		return 0, 0
+	}
+
+	if p.config.OnExpired != nil {
+		for _, m := range stored.Out.Messages {
+			if pm, ok := m.(*message.PublishMessage); ok {
+				p.config.OnExpired(id, pm)
+			}
+		}
+	}
+
+	var count, bytes uint64
+	for _, list := range [][]message.Provider{stored.In.Messages, stored.Out.Messages} {
+		for _, m := range list {
+			count++
+			bytes += uint64(size(m))
+		}
+	}
+
+	return count, bytes
+}
+
+func size(m message.Provider) int {
+	sz, err := m.Size()
+	if err != nil {
+		return 0
+	}
+
+	return sz
+}
+
+func (s *sessions) New(id string) (types.Session, error) {
+	s.p.touch(id, time.Now())
+
+	return s.p.sessions.New(id)
+}
+
+func (s *sessions) Get(id string) (types.Session, error) {
+	s.p.touch(id, time.Now())
+
+	return s.p.sessions.Get(id)
+}
+
+func (s *sessions) GetAll() ([]types.Session, error) {
+	return s.p.sessions.GetAll()
+}
+
+func (s *sessions) Delete(id string) error {
+	s.p.lock.Lock()
+	delete(s.p.accessed, id)
+	s.p.lock.Unlock()
+
+	return s.p.sessions.Delete(id)
+}
@@ -0,0 +1,109 @@
+package gc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/boltdb"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+func newPublish(t *testing.T, topic string, payload []byte) *message.PublishMessage {
+	m := message.NewPublishMessage()
+	require.NoError(t, m.SetTopic(topic))
+	require.NoError(t, m.SetQoS(message.QoS1))
+	m.SetPacketID(1)
+	m.SetPayload(payload)
+
+	return m
+}
+
+func TestCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq-gc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	inner, err := boltdb.NewBoltDB(&types.BoltDBConfig{File: filepath.Join(dir, "gc.db")})
+	require.NoError(t, err)
+
+	expired := make(map[string]string)
+
+	pr, err := New(inner, &types.GCConfig{
+		SessionExpiry: 2 * time.Hour,
+		MessageExpiry: time.Hour,
+		Expire: func(id string) bool {
+			return id != "connected"
+		},
+		OnExpired: func(id string, msg *message.PublishMessage) {
+			expired[id] = msg.Topic()
+		},
+	})
+	require.NoError(t, err)
+	defer pr.Shutdown() // nolint: errcheck
+
+	p := pr.(*impl)
+
+	sessions, err := pr.Sessions()
+	require.NoError(t, err)
+
+	for _, id := range []string{"idle", "connected"} {
+		var ses types.Session
+		ses, err = sessions.New(id)
+		require.NoError(t, err)
+
+		var msg types.Messages
+		msg, err = ses.Messages()
+		require.NoError(t, err)
+
+		err = msg.Store("out", []message.Provider{newPublish(t, "a/b", []byte("data"))})
+		require.NoError(t, err)
+	}
+
+	retained, err := pr.Retained()
+	require.NoError(t, err)
+
+	err = retained.Store([]message.Provider{
+		newPublish(t, "kept", []byte("data")),
+		newPublish(t, "orphan", nil),
+	})
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	// nothing expired yet, orphaned retained entry is removed
+	st, err := p.collect(now)
+	require.NoError(t, err)
+	require.Equal(t, Stats{Retained: 1, Bytes: st.Bytes}, st)
+	require.NotZero(t, st.Bytes)
+
+	var list []message.Provider
+	list, err = retained.Load()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	// messages expired, sessions kept
+	st, err = p.collect(now.Add(90 * time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), st.Sessions)
+	require.Equal(t, uint64(2), st.Messages)
+	require.Equal(t, map[string]string{"idle": "a/b", "connected": "a/b"}, expired)
+
+	// idle session expired, connected one is kept
+	st, err = p.collect(now.Add(3 * time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), st.Sessions)
+	require.Equal(t, uint64(0), st.Messages)
+
+	all, err := sessions.GetAll()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+
+	id, err := all[0].ID()
+	require.NoError(t, err)
+	require.Equal(t, "connected", id)
+}
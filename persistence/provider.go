@@ -1,20 +1,66 @@
+// Package persistence allocates persistence providers by config. Providers register
+// themselves on init thus only imported ones are available, e.g.
+//
+//	import _ "github.com/troian/surgemq/persistence/boltdb"
 package persistence
 
 import (
-	"github.com/troian/surgemq/persistence/boltdb"
+	"reflect"
+	"sync"
+
 	"github.com/troian/surgemq/persistence/types"
 )
 
-// New persistence provider
+// Factory allocate provider of config. Providers wrapping other ones, e.g. write-behind,
+// allocate inner provider by New
+type Factory func(config types.ProviderConfig) (types.Provider, error)
+
+var factories = struct {
+	lock sync.RWMutex
+	list map[reflect.Type]Factory
+}{
+	list: make(map[reflect.Type]Factory),
+}
+
+// Register provider factory of config type, e.g. (*types.BoltDBConfig)(nil)
+func Register(config types.ProviderConfig, f Factory) error {
+	if config == nil || f == nil {
+		return types.ErrInvalidArgs
+	}
+
+	factories.lock.Lock()
+	defer factories.lock.Unlock()
+
+	t := reflect.TypeOf(config)
+	if _, ok := factories.list[t]; ok {
+		return types.ErrAlreadyExists
+	}
+
+	factories.list[t] = f
+
+	return nil
+}
+
+// UnRegister provider factory of config type
+func UnRegister(config types.ProviderConfig) {
+	factories.lock.Lock()
+	delete(factories.list, reflect.TypeOf(config))
+	factories.lock.Unlock()
+}
+
+// New persistence provider. Returns ErrUnknownProvider if provider of config is not registered
 func New(config types.ProviderConfig) (types.Provider, error) {
 	if config == nil {
 		return nil, types.ErrInvalidArgs
 	}
 
-	switch cfg := config.(type) {
-	case *types.BoltDBConfig:
-		return boltdb.NewBoltDB(cfg)
-	default:
+	factories.lock.RLock()
+	f, ok := factories.list[reflect.TypeOf(config)]
+	factories.lock.RUnlock()
+
+	if !ok {
 		return nil, types.ErrUnknownProvider
 	}
+
+	return f(config)
 }
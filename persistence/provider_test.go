@@ -1,14 +1,27 @@
-package persistence
+package persistence_test
 
 import (
+	"database/sql"
 	"os"
 	"testing"
 
 	"strconv"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/require"
 	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence"
+	_ "github.com/troian/surgemq/persistence/badger"
+	_ "github.com/troian/surgemq/persistence/boltdb"
+	_ "github.com/troian/surgemq/persistence/compress"
+	"github.com/troian/surgemq/persistence/encrypt"
+	_ "github.com/troian/surgemq/persistence/gc"
+	_ "github.com/troian/surgemq/persistence/redis"
+	_ "github.com/troian/surgemq/persistence/sqldb"
+	_ "github.com/troian/surgemq/persistence/tenant"
 	"github.com/troian/surgemq/persistence/types"
+	_ "github.com/troian/surgemq/persistence/writebehind"
 )
 
 type configWrap struct {
@@ -19,6 +32,46 @@ func (c *configWrap) cleanup() error {
 	switch t := c.config.(type) {
 	case *types.BoltDBConfig:
 		return os.Remove(t.File)
+	case *types.BadgerConfig:
+		return os.RemoveAll(t.Dir)
+	case *types.RedisConfig:
+		testRedis.FlushAll()
+	case *types.PostgreSQLConfig:
+		return cleanupSQL("pgx", t.DSN)
+	case *types.MySQLConfig:
+		return cleanupSQL("mysql", t.DSN)
+	case *types.WriteBehindConfig:
+		inner := configWrap{config: t.Provider}
+		return inner.cleanup()
+	case *types.EncryptionConfig:
+		inner := configWrap{config: t.Provider}
+		return inner.cleanup()
+	case *types.CompressionConfig:
+		inner := configWrap{config: t.Provider}
+		return inner.cleanup()
+	case *types.GCConfig:
+		inner := configWrap{config: t.Provider}
+		return inner.cleanup()
+	case *types.TenantConfig:
+		inner := configWrap{config: t.Provider}
+		return inner.cleanup()
+	}
+
+	return nil
+}
+
+// cleanupSQL wipe data stored by SQL backends, schema is kept
+func cleanupSQL(driver, dsn string) error {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close() // nolint: errcheck
+
+	for _, t := range []string{"subscriptions", "messages", "sessions", "retained", "markers"} {
+		if _, err = db.Exec("DELETE FROM " + t); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -35,6 +88,8 @@ var _ types.ProviderConfig = (*dummyProvider)(nil)
 
 var testProviders []*providerTest
 
+var testRedis *miniredis.Miniredis
+
 func init() {
 	testProviders = append(testProviders, &providerTest{
 		name: "boltdb",
@@ -44,6 +99,124 @@ func init() {
 			},
 		},
 	})
+
+	testProviders = append(testProviders, &providerTest{
+		name: "badger",
+		wrap: configWrap{
+			config: &types.BadgerConfig{
+				Dir:        "./persist.badger",
+				SyncWrites: true,
+				GCInterval: time.Minute,
+			},
+		},
+	})
+
+	testRedis = miniredis.NewMiniRedis()
+	if err := testRedis.Start(); err != nil {
+		panic(err)
+	}
+
+	testProviders = append(testProviders, &providerTest{
+		name: "redis",
+		wrap: configWrap{
+			config: &types.RedisConfig{
+				Address: testRedis.Addr(),
+				Prefix:  "surgemq:",
+			},
+		},
+	})
+
+	testProviders = append(testProviders, &providerTest{
+		name: "writebehind",
+		wrap: configWrap{
+			config: &types.WriteBehindConfig{
+				Provider: &types.BoltDBConfig{
+					File: "./persist.wb.db",
+				},
+				MaxBatch:      2,
+				FlushInterval: 10 * time.Millisecond,
+			},
+		},
+	})
+
+	keys, err := encrypt.NewStaticKey("test", []byte("0123456789abcdef"))
+	if err != nil {
+		panic(err)
+	}
+
+	testProviders = append(testProviders, &providerTest{
+		name: "encrypted",
+		wrap: configWrap{
+			config: &types.EncryptionConfig{
+				Provider: &types.BoltDBConfig{
+					File: "./persist.enc.db",
+				},
+				Keys: keys,
+			},
+		},
+	})
+
+	testProviders = append(testProviders, &providerTest{
+		name: "compressed",
+		wrap: configWrap{
+			config: &types.CompressionConfig{
+				Provider: &types.BoltDBConfig{
+					File: "./persist.zstd.db",
+				},
+				Algorithm: types.CompressionZstd,
+				MinSize:   1,
+			},
+		},
+	})
+
+	testProviders = append(testProviders, &providerTest{
+		name: "gc",
+		wrap: configWrap{
+			config: &types.GCConfig{
+				Provider: &types.BoltDBConfig{
+					File: "./persist.gc.db",
+				},
+				SessionExpiry: time.Hour,
+			},
+		},
+	})
+
+	testProviders = append(testProviders, &providerTest{
+		name: "tenant",
+		wrap: configWrap{
+			config: &types.TenantConfig{
+				Provider: &types.BoltDBConfig{
+					File: "./persist.tenant.db",
+				},
+				Tenants: map[string]types.TenantQuota{
+					"tenant/": {MaxSessions: 1},
+				},
+			},
+		},
+	})
+
+	// SQL backends require running server
+	if dsn := os.Getenv("SURGEMQ_TEST_POSTGRES"); dsn != "" {
+		testProviders = append(testProviders, &providerTest{
+			name: "postgres",
+			wrap: configWrap{
+				config: &types.PostgreSQLConfig{
+					DSN: dsn,
+				},
+			},
+		})
+	}
+
+	if dsn := os.Getenv("SURGEMQ_TEST_MYSQL"); dsn != "" {
+		testProviders = append(testProviders, &providerTest{
+			name: "mysql",
+			wrap: configWrap{
+				config: &types.MySQLConfig{
+					DSN: dsn,
+				},
+			},
+		})
+	}
 }
 
 func TestProvider(t *testing.T) {
@@ -51,19 +224,42 @@ func TestProvider(t *testing.T) {
 
 	//var pr types.Provider
 
-	_, err := New(config)
+	_, err := persistence.New(config)
 	require.EqualError(t, err, types.ErrInvalidArgs.Error())
 
 	config = &dummyProvider{}
 
-	_, err = New(config)
+	_, err = persistence.New(config)
 	require.EqualError(t, err, types.ErrUnknownProvider.Error())
 }
 
+func TestRegister(t *testing.T) {
+	require.Equal(t, types.ErrInvalidArgs, persistence.Register(nil, nil))
+	require.Equal(t, types.ErrAlreadyExists, persistence.Register((*types.BoltDBConfig)(nil),
+		func(types.ProviderConfig) (types.Provider, error) { return nil, nil }))
+
+	var got types.ProviderConfig
+
+	config := &dummyProvider{}
+	require.NoError(t, persistence.Register((*dummyProvider)(nil), func(c types.ProviderConfig) (types.Provider, error) {
+		got = c
+		return nil, types.ErrNotSupported
+	}))
+
+	_, err := persistence.New(config)
+	require.Equal(t, types.ErrNotSupported, err)
+	require.True(t, got == config)
+
+	persistence.UnRegister((*dummyProvider)(nil))
+
+	_, err = persistence.New(config)
+	require.Equal(t, types.ErrUnknownProvider, err)
+}
+
 func TestOpenClose(t *testing.T) {
 	for _, p := range testProviders {
 		t.Run(p.name, func(t *testing.T) {
-			pr, err := New(p.wrap.config)
+			pr, err := persistence.New(p.wrap.config)
 			require.NoError(t, err)
 
 			err = pr.Shutdown()
@@ -78,13 +274,13 @@ func TestOpenClose(t *testing.T) {
 func TestReopen(t *testing.T) {
 	for _, p := range testProviders {
 		t.Run(p.name, func(t *testing.T) {
-			pr, err := New(p.wrap.config)
+			pr, err := persistence.New(p.wrap.config)
 			require.NoError(t, err)
 
 			err = pr.Shutdown()
 			require.NoError(t, err)
 
-			pr, err = New(p.wrap.config)
+			pr, err = persistence.New(p.wrap.config)
 			require.NoError(t, err)
 
 			err = pr.Shutdown()
@@ -99,10 +295,34 @@ func TestReopen(t *testing.T) {
 	}
 }
 
+func TestHealth(t *testing.T) {
+	for _, p := range testProviders {
+		t.Run(p.name, func(t *testing.T) {
+			pr, err := persistence.New(p.wrap.config)
+			require.NoError(t, err)
+
+			_, ok := pr.(types.HealthChecker)
+			require.True(t, ok)
+
+			err = types.CheckHealth(pr)
+			require.NoError(t, err)
+
+			err = pr.Shutdown()
+			require.NoError(t, err)
+
+			err = types.CheckHealth(pr)
+			require.EqualError(t, err, types.ErrNotOpen.Error())
+
+			err = p.wrap.cleanup()
+			require.NoError(t, err)
+		})
+	}
+}
+
 func TestSessions(t *testing.T) {
 	for _, p := range testProviders {
 		t.Run(p.name, func(t *testing.T) {
-			pr, err := New(p.wrap.config)
+			pr, err := persistence.New(p.wrap.config)
 			require.NoError(t, err)
 
 			var sessions types.Sessions
@@ -122,7 +342,7 @@ func TestSessions(t *testing.T) {
 			err = pr.Shutdown()
 			require.NoError(t, err)
 
-			pr, err = New(p.wrap.config)
+			pr, err = persistence.New(p.wrap.config)
 			require.NoError(t, err)
 
 			sessions, err = pr.Sessions()
@@ -149,7 +369,7 @@ func TestSessions(t *testing.T) {
 func TestSubscriptions(t *testing.T) {
 	for _, p := range testProviders {
 		t.Run(p.name, func(t *testing.T) {
-			pr, err := New(p.wrap.config)
+			pr, err := persistence.New(p.wrap.config)
 			require.NoError(t, err)
 
 			var sessions types.Sessions
@@ -169,15 +389,15 @@ func TestSubscriptions(t *testing.T) {
 			_, err = subscriptions.Get()
 			require.EqualError(t, err, types.ErrNotFound.Error())
 
-			subsList := make(message.TopicsQoS)
-			subsList["topic1"] = message.QoS1
-			subsList["topic2"] = message.QoS1
-			subsList["topic3"] = message.QoS2
+			subsList := make(message.Subscriptions)
+			subsList["topic1"] = message.SubscriptionOptions{QoS: message.QoS1}
+			subsList["topic2"] = message.SubscriptionOptions{QoS: message.QoS1, NoLocal: true, ID: 300}
+			subsList["topic3"] = message.SubscriptionOptions{QoS: message.QoS2, RetainAsPublished: true, RetainHandling: 2}
 
 			err = subscriptions.Add(subsList)
 			require.NoError(t, err)
 
-			var subsList1 message.TopicsQoS
+			var subsList1 message.Subscriptions
 			subsList1, err = subscriptions.Get()
 			require.NoError(t, err)
 			require.Equal(t, len(subsList), len(subsList1))
@@ -189,7 +409,7 @@ func TestSubscriptions(t *testing.T) {
 			err = pr.Shutdown()
 			require.NoError(t, err)
 
-			pr, err = New(p.wrap.config)
+			pr, err = persistence.New(p.wrap.config)
 			require.NoError(t, err)
 
 			sessions, err = pr.Sessions()
@@ -223,7 +443,7 @@ func TestSubscriptions(t *testing.T) {
 func TestRetained(t *testing.T) {
 	for _, p := range testProviders {
 		t.Run(p.name, func(t *testing.T) {
-			pr, err := New(p.wrap.config)
+			pr, err := persistence.New(p.wrap.config)
 			require.NoError(t, err)
 
 			retained, err := pr.Retained()
@@ -243,6 +463,8 @@ func TestRetained(t *testing.T) {
 				} else {
 					msg.SetQoS(message.QoS1) // nolint: errcheck
 				}
+
+				messages = append(messages, msg)
 			}
 
 			err = retained.Store(messages)
@@ -259,7 +481,7 @@ func TestRetained(t *testing.T) {
 			err = pr.Shutdown()
 			require.NoError(t, err)
 
-			pr, err = New(p.wrap.config)
+			pr, err = persistence.New(p.wrap.config)
 			require.NoError(t, err)
 
 			retained, err = pr.Retained()
@@ -287,10 +509,65 @@ func TestRetained(t *testing.T) {
 	}
 }
 
+func TestRetainedPutRemove(t *testing.T) {
+	for _, p := range testProviders {
+		t.Run(p.name, func(t *testing.T) {
+			pr, err := persistence.New(p.wrap.config)
+			require.NoError(t, err)
+
+			retained, err := pr.Retained()
+			require.NoError(t, err)
+
+			for i := 1; i <= 3; i++ {
+				msg := message.NewPublishMessage()
+				msg.SetTopic("Topic:" + strconv.Itoa(i)) // nolint: errcheck
+				msg.SetPayload([]byte("v1"))
+				require.NoError(t, retained.Put(msg))
+			}
+
+			// replace message of the same topic
+			msg := message.NewPublishMessage()
+			msg.SetTopic("Topic:1") // nolint: errcheck
+			msg.SetPayload([]byte("v2"))
+			require.NoError(t, retained.Put(msg))
+
+			require.NoError(t, retained.Remove("Topic:2"))
+			require.NoError(t, retained.Remove("Topic:unknown"))
+
+			err = pr.Shutdown()
+			require.NoError(t, err)
+
+			pr, err = persistence.New(p.wrap.config)
+			require.NoError(t, err)
+
+			retained, err = pr.Retained()
+			require.NoError(t, err)
+
+			messages, err := retained.Load()
+			require.NoError(t, err)
+			require.Len(t, messages, 2)
+
+			payloads := make(map[string]string)
+			for _, m := range messages {
+				pm := m.(*message.PublishMessage)
+				payloads[pm.Topic()] = string(pm.Payload())
+			}
+
+			require.Equal(t, map[string]string{"Topic:1": "v2", "Topic:3": "v1"}, payloads)
+
+			err = pr.Shutdown()
+			require.NoError(t, err)
+
+			err = p.wrap.cleanup()
+			require.NoError(t, err)
+		})
+	}
+}
+
 func TestMessages(t *testing.T) {
 	for _, p := range testProviders {
 		t.Run(p.name, func(t *testing.T) {
-			pr, err := New(p.wrap.config)
+			pr, err := persistence.New(p.wrap.config)
 			require.NoError(t, err)
 
 			var sessions types.Sessions
@@ -362,7 +639,7 @@ func TestMessages(t *testing.T) {
 			err = pr.Shutdown()
 			require.NoError(t, err)
 
-			pr, err = New(p.wrap.config)
+			pr, err = persistence.New(p.wrap.config)
 			require.NoError(t, err)
 
 			sessions, err = pr.Sessions()
@@ -393,3 +670,121 @@ func TestMessages(t *testing.T) {
 		})
 	}
 }
+
+func TestMessagesExchangeState(t *testing.T) {
+	for _, p := range testProviders {
+		t.Run(p.name, func(t *testing.T) {
+			pr, err := persistence.New(p.wrap.config)
+			require.NoError(t, err)
+
+			sessions, err := pr.Sessions()
+			require.NoError(t, err)
+
+			session, err := sessions.New("test1")
+			require.NoError(t, err)
+
+			messages, err := session.Messages()
+			require.NoError(t, err)
+
+			pub := message.NewPublishMessage()
+			pub.SetPacketID(1)
+			pub.SetQoS(message.QoS2)   // nolint: errcheck
+			pub.SetTopic("test/topic") // nolint: errcheck
+
+			rec := message.NewPubRecMessage()
+			rec.SetPacketID(2)
+
+			rel := message.NewPubRelMessage()
+			rel.SetPacketID(3)
+
+			require.NoError(t, messages.Store("in", []message.Provider{pub, rec}))
+			require.NoError(t, messages.Store("out", []message.Provider{rel}))
+
+			loaded, err := messages.Load()
+			require.NoError(t, err)
+
+			state := func(list []message.Provider) map[uint16]message.Type {
+				res := make(map[uint16]message.Type)
+				for _, m := range list {
+					res[m.PacketID()] = m.Type()
+				}
+
+				return res
+			}
+
+			require.Equal(t, map[uint16]message.Type{1: message.PUBLISH, 2: message.PUBREC}, state(loaded.In.Messages))
+			require.Equal(t, map[uint16]message.Type{3: message.PUBREL}, state(loaded.Out.Messages))
+
+			err = pr.Shutdown()
+			require.NoError(t, err)
+
+			err = p.wrap.cleanup()
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestMessagesOrder(t *testing.T) {
+	for _, p := range testProviders {
+		t.Run(p.name, func(t *testing.T) {
+			pr, err := persistence.New(p.wrap.config)
+			require.NoError(t, err)
+
+			sessions, err := pr.Sessions()
+			require.NoError(t, err)
+
+			session, err := sessions.New("test1")
+			require.NoError(t, err)
+
+			messages, err := session.Messages()
+			require.NoError(t, err)
+
+			var topics []string
+
+			newPublish := func(topic string) message.Provider {
+				m := message.NewPublishMessage()
+				m.SetQoS(message.QoS1) // nolint: errcheck
+				m.SetTopic(topic)      // nolint: errcheck
+				topics = append(topics, topic)
+
+				return m
+			}
+
+			// stored on disconnect then while session is offline
+			require.NoError(t, messages.Store("out", []message.Provider{newPublish("a"), newPublish("b"), newPublish("c")}))
+			require.NoError(t, messages.Store("out", []message.Provider{newPublish("d")}))
+			require.NoError(t, messages.Store("out", []message.Provider{newPublish("e")}))
+
+			err = pr.Shutdown()
+			require.NoError(t, err)
+
+			pr, err = persistence.New(p.wrap.config)
+			require.NoError(t, err)
+
+			sessions, err = pr.Sessions()
+			require.NoError(t, err)
+
+			session, err = sessions.Get("test1")
+			require.NoError(t, err)
+
+			messages, err = session.Messages()
+			require.NoError(t, err)
+
+			loaded, err := messages.Load()
+			require.NoError(t, err)
+
+			var res []string
+			for _, m := range loaded.Out.Messages {
+				res = append(res, m.(*message.PublishMessage).Topic())
+			}
+
+			require.Equal(t, topics, res)
+
+			err = pr.Shutdown()
+			require.NoError(t, err)
+
+			err = p.wrap.cleanup()
+			require.NoError(t, err)
+		})
+	}
+}
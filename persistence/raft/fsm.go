@@ -0,0 +1,305 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	hraft "github.com/hashicorp/raft"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/dump"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+// operations committed to log
+const (
+	opSessionNew byte = iota + 1
+	opSessionDelete
+	opSubscriptionsAdd
+	opSubscriptionsDelete
+	opMessagesStore
+	opMessagesDelete
+	opRetainedStore
+	opRetainedDelete
+	opRetainedPut
+	opRetainedRemove
+)
+
+// command entry of log. Messages are encoded by types.EncodeMessage
+// Origin identifies provider instance command has been written by
+type command struct {
+	Op            byte                  `json:"op"`
+	Origin        string                `json:"origin,omitempty"`
+	ID            string                `json:"id,omitempty"`
+	Dir           string                `json:"dir,omitempty"`
+	Topic         string                `json:"topic,omitempty"`
+	Subscriptions message.Subscriptions `json:"subscriptions,omitempty"`
+	Messages      [][]byte              `json:"messages,omitempty"`
+}
+
+// knownErrors are passed between nodes by text and restored to be comparable
+var knownErrors = []error{
+	types.ErrInvalidArgs,
+	types.ErrAlreadyExists,
+	types.ErrNotFound,
+	types.ErrNotOpen,
+	types.ErrNotSupported,
+	types.ErrQuotaExceeded,
+	ErrNoLeader,
+}
+
+func errorFromString(s string) error {
+	if s == "" {
+		return nil
+	}
+
+	for _, e := range knownErrors {
+		if e.Error() == s {
+			return e
+		}
+	}
+
+	return errors.New(s)
+}
+
+func encodeMessages(msg []message.Provider) ([][]byte, error) {
+	res := make([][]byte, 0, len(msg))
+	for _, m := range msg {
+		buf, err := types.EncodeMessage(m)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, buf)
+	}
+
+	return res, nil
+}
+
+func decodeMessages(list [][]byte) ([]message.Provider, error) {
+	res := make([]message.Provider, 0, len(list))
+	for _, buf := range list {
+		m, err := types.DecodeMessage(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, m)
+	}
+
+	return res, nil
+}
+
+// fsm applies committed commands to local backend
+type fsm struct {
+	p *impl
+}
+
+type fsmSnapshot struct {
+	d *dump.Dump
+}
+
+var _ hraft.FSM = (*fsm)(nil)
+var _ hraft.FSMSnapshot = (*fsmSnapshot)(nil)
+
+// Apply command. Returned error is response of write
+func (f *fsm) Apply(l *hraft.Log) interface{} {
+	var c command
+	if err := json.Unmarshal(l.Data, &c); err != nil {
+		return err
+	}
+
+	return f.p.execute(&c)
+}
+
+// Snapshot whole state of backend. Raft does not apply commands meanwhile
+func (f *fsm) Snapshot() (hraft.FSMSnapshot, error) {
+	d, err := dump.Export(f.p.inner)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fsmSnapshot{d: d}, nil
+}
+
+// Restore replace state of backend by snapshot
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close() // nolint: errcheck
+
+	d, err := dump.Decode(r, dump.FormatCBOR)
+	if err != nil {
+		return err
+	}
+
+	removed := f.p.retainedTopics()
+
+	if err = f.p.wipe(); err != nil {
+		return err
+	}
+
+	if err = dump.Import(f.p.inner, d); err != nil {
+		return err
+	}
+
+	if f.p.onRetained == nil {
+		return nil
+	}
+
+	msg, err := f.p.retained.Load()
+	if err != nil && err != types.ErrNotFound {
+		return err
+	}
+
+	for _, m := range msg {
+		if m, ok := m.(*message.PublishMessage); ok {
+			delete(removed, m.Topic())
+			f.p.onRetained(m)
+		}
+	}
+
+	f.p.notifyRemoved(removed)
+
+	return nil
+}
+
+func (s *fsmSnapshot) Persist(sink hraft.SnapshotSink) error {
+	if err := s.d.Encode(sink, dump.FormatCBOR); err != nil {
+		sink.Cancel() // nolint: errcheck, gas
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
+
+// execute command against local backend
+func (p *impl) execute(c *command) error {
+	switch c.Op {
+	case opSessionNew:
+		_, err := p.sessions.New(c.ID)
+		return err
+	case opSessionDelete:
+		return p.sessions.Delete(c.ID)
+	case opRetainedStore:
+		msg, err := decodeMessages(c.Messages)
+		if err != nil {
+			return err
+		}
+
+		if err = p.retained.Store(msg); err == nil && p.notified(c) {
+			for _, m := range msg {
+				if m, ok := m.(*message.PublishMessage); ok {
+					p.onRetained(m)
+				}
+			}
+		}
+
+		return err
+	case opRetainedDelete:
+		var removed map[string]struct{}
+		if p.notified(c) {
+			removed = p.retainedTopics()
+		}
+
+		err := p.retained.Delete()
+		if err == nil {
+			p.notifyRemoved(removed)
+		}
+
+		return err
+	case opRetainedPut:
+		msg, err := decodeMessages(c.Messages)
+		if err != nil {
+			return err
+		}
+
+		if len(msg) != 1 {
+			return types.ErrInvalidArgs
+		}
+
+		m, ok := msg[0].(*message.PublishMessage)
+		if !ok {
+			return types.ErrInvalidArgs
+		}
+
+		if err = p.retained.Put(m); err == nil && p.notified(c) {
+			p.onRetained(m)
+		}
+
+		return err
+	case opRetainedRemove:
+		err := p.retained.Remove(c.Topic)
+		if err == nil && p.notified(c) {
+			p.notifyRemoved(map[string]struct{}{c.Topic: {}})
+		}
+
+		return err
+	}
+
+	ses, err := p.sessions.Get(c.ID)
+	if err != nil {
+		return err
+	}
+
+	switch c.Op {
+	case opSubscriptionsAdd, opSubscriptionsDelete:
+		var subs types.Subscriptions
+		if subs, err = ses.Subscriptions(); err != nil {
+			return err
+		}
+
+		if c.Op == opSubscriptionsAdd {
+			return subs.Add(c.Subscriptions)
+		}
+
+		return subs.Delete()
+	case opMessagesStore, opMessagesDelete:
+		var m types.Messages
+		if m, err = ses.Messages(); err != nil {
+			return err
+		}
+
+		if c.Op == opMessagesDelete {
+			return m.Delete()
+		}
+
+		var msg []message.Provider
+		if msg, err = decodeMessages(c.Messages); err != nil {
+			return err
+		}
+
+		return m.Store(c.Dir, msg)
+	default:
+		return types.ErrInvalidArgs
+	}
+}
+
+// notified either changes of retained messages made by command are reported
+func (p *impl) notified(c *command) bool {
+	return p.onRetained != nil && c.Origin != p.origin
+}
+
+// retainedTopics stored in local backend
+func (p *impl) retainedTopics() map[string]struct{} {
+	res := make(map[string]struct{})
+
+	msg, _ := p.retained.Load() // nolint: gas
+	for _, m := range msg {
+		if m, ok := m.(*message.PublishMessage); ok {
+			res[m.Topic()] = struct{}{}
+		}
+	}
+
+	return res
+}
+
+// notifyRemoved report retained messages of topics removed
+func (p *impl) notifyRemoved(topics map[string]struct{}) {
+	for t := range topics {
+		m := message.NewPublishMessage()
+		if err := m.SetTopic(t); err == nil {
+			p.onRetained(m)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+// Package raft replicates persisted state across nodes by Raft consensus
+// Writes are committed to Raft log through leader and applied to underlying backend of every
+// node, thus session reconnecting to another node finds its subscriptions and messages there
+package raft
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	hraft "github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence"
+	"github.com/troian/surgemq/persistence/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultApplyTimeout = 10 * time.Second
+
+	transportPool    = 3
+	transportTimeout = 10 * time.Second
+	snapshotsRetain  = 2
+)
+
+var (
+	// ErrNoAddr node configured without listen address
+	ErrNoAddr = errors.New("raft: listen address required")
+
+	// ErrNoLeader cluster has no leader, thus writes are not possible
+	ErrNoLeader = errors.New("raft: no leader")
+)
+
+type impl struct {
+	inner    types.Provider
+	sessions types.Sessions
+	retained types.Retained
+
+	raft      *hraft.Raft
+	logs      *raftboltdb.BoltStore
+	stream    *streamLayer
+	timeout   time.Duration
+	forwarder forwarder
+
+	// origin random id of provider instance commands are written by
+	origin     string
+	onRetained func(msg *message.PublishMessage)
+
+	ln   net.Listener
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	// lock protects connections of forwarded writes
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+
+	s sessions
+	r retained
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+}
+
+var _ types.Provider = (*impl)(nil)
+var _ types.HealthChecker = (*impl)(nil)
+var _ types.Snapshotter = (*impl)(nil)
+
+func init() {
+	persistence.Register((*types.RaftConfig)(nil), func(config types.ProviderConfig) (types.Provider, error) { // nolint: errcheck, gas
+		cfg := config.(*types.RaftConfig)
+		if cfg.Provider == nil {
+			return nil, types.ErrInvalidArgs
+		}
+
+		if _, ok := cfg.Provider.(*types.RaftConfig); ok {
+			return nil, types.ErrInvalidArgs
+		}
+
+		inner, err := persistence.New(cfg.Provider)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := New(inner, cfg)
+		if err != nil {
+			inner.Shutdown() // nolint: errcheck, gas
+			return nil, err
+		}
+
+		return p, nil
+	})
+}
+
+// New replicate state of given local backend
+func New(inner types.Provider, config *types.RaftConfig) (types.Provider, error) {
+	if config.Addr == "" {
+		return nil, ErrNoAddr
+	}
+
+	if config.Dir == "" {
+		return nil, types.ErrInvalidArgs
+	}
+
+	s, err := inner.Sessions()
+	if err != nil {
+		return nil, err
+	}
+
+	var r types.Retained
+	if r, err = inner.Retained(); err != nil {
+		return nil, err
+	}
+
+	p := &impl{
+		inner:      inner,
+		sessions:   s,
+		retained:   r,
+		timeout:    config.ApplyTimeout,
+		origin:     origin(),
+		onRetained: config.OnRetained,
+		quit:       make(chan struct{}),
+		conns:      make(map[net.Conn]struct{}),
+	}
+
+	if p.timeout <= 0 {
+		p.timeout = defaultApplyTimeout
+	}
+
+	p.s.p = p
+	p.r.p = p
+	p.forwarder.p = p
+
+	p.log.prod = surgemq.GetProdLogger().Named("persistence.raft")
+	p.log.dev = surgemq.GetDevLogger().Named("persistence.raft")
+
+	// backend is rebuilt from log and snapshots
+	if err = p.wipe(); err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	if p.ln, err = net.Listen("tcp", config.Addr); err != nil {
+		return nil, err
+	}
+
+	if err = p.start(config); err != nil {
+		p.ln.Close() // nolint: errcheck, gas
+		if p.logs != nil {
+			p.logs.Close() // nolint: errcheck, gas
+		}
+
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *impl) start(config *types.RaftConfig) error {
+	advertise := config.Advertise
+	if advertise == "" {
+		advertise = p.ln.Addr().String()
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return err
+	}
+
+	p.stream = newStreamLayer(p, addr)
+
+	p.wg.Add(1)
+	go p.acceptWorker()
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Info,
+		Output: &logWriter{log: p.log.prod},
+	})
+
+	rc := hraft.DefaultConfig()
+	rc.LocalID = hraft.ServerID(config.NodeID)
+	if rc.LocalID == "" {
+		rc.LocalID = hraft.ServerID(advertise)
+	}
+
+	rc.Logger = logger
+
+	if config.SnapshotThreshold > 0 {
+		rc.SnapshotThreshold = config.SnapshotThreshold
+	}
+
+	if p.logs, err = raftboltdb.NewBoltStore(filepath.Join(config.Dir, "raft.db")); err != nil {
+		return err
+	}
+
+	var snapshots hraft.SnapshotStore
+	if snapshots, err = hraft.NewFileSnapshotStoreWithLogger(config.Dir, snapshotsRetain, logger); err != nil {
+		return err
+	}
+
+	transport := hraft.NewNetworkTransportWithConfig(&hraft.NetworkTransportConfig{
+		Stream:  p.stream,
+		MaxPool: transportPool,
+		Timeout: transportTimeout,
+		Logger:  logger,
+	})
+
+	var existing bool
+	if existing, err = hraft.HasExistingState(p.logs, p.logs, snapshots); err != nil {
+		return err
+	}
+
+	if !existing {
+		servers := []hraft.Server{{ID: rc.LocalID, Address: transport.LocalAddr()}}
+		if len(config.Peers) > 0 {
+			servers = servers[:0]
+			for _, peer := range config.Peers {
+				servers = append(servers, hraft.Server{ID: hraft.ServerID(peer.ID), Address: hraft.ServerAddress(peer.Addr)})
+			}
+		}
+
+		if err = hraft.BootstrapCluster(rc, p.logs, p.logs, snapshots, transport, hraft.Configuration{Servers: servers}); err != nil {
+			return err
+		}
+	}
+
+	if p.raft, err = hraft.NewRaft(rc, &fsm{p: p}, p.logs, p.logs, snapshots, transport); err != nil {
+		return err
+	}
+
+	p.log.prod.Info("Raft node started", zap.String("id", string(rc.LocalID)), zap.String("addr", advertise))
+
+	return nil
+}
+
+// Sessions
+func (p *impl) Sessions() (types.Sessions, error) {
+	select {
+	case <-p.quit:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &p.s, nil
+}
+
+// Retained
+func (p *impl) Retained() (types.Retained, error) {
+	select {
+	case <-p.quit:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &p.r, nil
+}
+
+// Health returns ErrNoLeader while cluster has no leader
+func (p *impl) Health() error {
+	select {
+	case <-p.quit:
+		return types.ErrNotOpen
+	default:
+	}
+
+	if addr, _ := p.raft.LeaderWithID(); addr == "" {
+		return ErrNoLeader
+	}
+
+	return types.CheckHealth(p.inner)
+}
+
+// Snapshot of local backend
+func (p *impl) Snapshot(w io.Writer) error {
+	return types.TakeSnapshot(p.inner, w)
+}
+
+// Shutdown leave cluster and shutdown underlying provider
+func (p *impl) Shutdown() error {
+	select {
+	case <-p.quit:
+		return types.ErrNotOpen
+	default:
+	}
+
+	err := p.raft.Shutdown().Error()
+
+	close(p.quit)
+	p.ln.Close() // nolint: errcheck, gas
+
+	p.lock.Lock()
+	for c := range p.conns {
+		c.Close() // nolint: errcheck, gas
+	}
+	p.lock.Unlock()
+
+	p.forwarder.close()
+	p.wg.Wait()
+
+	if e := p.logs.Close(); err == nil {
+		err = e
+	}
+
+	if e := p.inner.Shutdown(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// wipe all state of local backend
+func (p *impl) wipe() error {
+	list, err := p.sessions.GetAll()
+	if err != nil && err != types.ErrNotFound {
+		return err
+	}
+
+	for _, ses := range list {
+		var id string
+		if id, err = ses.ID(); err != nil {
+			return err
+		}
+
+		if err = p.sessions.Delete(id); err != nil && err != types.ErrNotFound {
+			return err
+		}
+	}
+
+	if err = p.retained.Delete(); err != nil && err != types.ErrNotFound {
+		return err
+	}
+
+	return nil
+}
+
+func origin() string {
+	b := make([]byte, 8)
+	rand.Read(b) // nolint: errcheck, gas
+
+	return hex.EncodeToString(b)
+}
+
+// logWriter forwards lines of Raft library into zap
+type logWriter struct {
+	log *zap.Logger
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	w.log.Info(string(trimNewline(b)))
+
+	return len(b), nil
+}
+
+func trimNewline(b []byte) []byte {
+	for len(b) > 0 && (b[len(b)-1] == '\n' || b[len(b)-1] == '\r') {
+		b = b[:len(b)-1]
+	}
+
+	return b
+}
@@ -0,0 +1,218 @@
+package raft
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/boltdb"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	return addr
+}
+
+func open(t *testing.T, dir string, peers []types.RaftPeer, i int, onRetained func(*message.PublishMessage)) types.Provider {
+	inner, err := boltdb.NewBoltDB(&types.BoltDBConfig{File: filepath.Join(dir, "store"+strconv.Itoa(i)+".db")})
+	require.NoError(t, err)
+
+	p, err := New(inner, &types.RaftConfig{
+		NodeID: peers[i].ID,
+		Addr:   peers[i].Addr,
+		Dir:    filepath.Join(dir, "raft"+strconv.Itoa(i)),
+		Peers:  peers,
+
+		OnRetained: onRetained,
+	})
+	require.NoError(t, err)
+
+	return p
+}
+
+func newPublish(t *testing.T, topic string, payload string) *message.PublishMessage {
+	m := message.NewPublishMessage()
+	require.NoError(t, m.SetTopic(topic))
+	require.NoError(t, m.SetQoS(message.QoS1))
+	m.SetPacketID(1)
+	m.SetPayload([]byte(payload))
+
+	return m
+}
+
+func leader(nodes []types.Provider) int {
+	for i, p := range nodes {
+		if p.(*impl).raft.State().String() == "Leader" {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func TestReplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	peers := make([]types.RaftPeer, 3)
+	for i := range peers {
+		peers[i] = types.RaftPeer{ID: "n" + strconv.Itoa(i), Addr: freeAddr(t)}
+	}
+
+	nodes := make([]types.Provider, 3)
+	retainedCh := make([]chan string, 3)
+	for i := range nodes {
+		ch := make(chan string, 10)
+		retainedCh[i] = ch
+
+		nodes[i] = open(t, dir, peers, i, func(m *message.PublishMessage) {
+			ch <- m.Topic() + ":" + string(m.Payload())
+		})
+	}
+
+	require.Eventually(t, func() bool { return leader(nodes) >= 0 }, 10*time.Second, 10*time.Millisecond)
+
+	for _, p := range nodes {
+		require.Eventually(t, func() bool { return types.CheckHealth(p) == nil }, 10*time.Second, 10*time.Millisecond)
+	}
+
+	// write through follower
+	origin := (leader(nodes) + 1) % 3
+	follower := nodes[origin]
+
+	sessions, err := follower.Sessions()
+	require.NoError(t, err)
+
+	ses, err := sessions.New("client")
+	require.NoError(t, err)
+
+	_, err = sessions.New("client")
+	require.Equal(t, types.ErrAlreadyExists, err)
+
+	subs, err := ses.Subscriptions()
+	require.NoError(t, err)
+	require.NoError(t, subs.Add(message.Subscriptions{"a/#": {QoS: message.QoS1}}))
+
+	msg, err := ses.Messages()
+	require.NoError(t, err)
+	require.NoError(t, msg.Store("out", []message.Provider{newPublish(t, "a/b", "queued")}))
+
+	retained, err := follower.Retained()
+	require.NoError(t, err)
+	require.NoError(t, retained.Put(newPublish(t, "r", "retained")))
+
+	// read-your-writes on follower
+	stored, err := msg.Load()
+	require.NoError(t, err)
+	require.Len(t, stored.Out.Messages, 1)
+
+	for _, p := range nodes {
+		require.Eventually(t, func() bool {
+			s, e := p.Sessions()
+			require.NoError(t, e)
+
+			var ses types.Session
+			if ses, e = s.Get("client"); e != nil {
+				return false
+			}
+
+			var subs types.Subscriptions
+			subs, e = ses.Subscriptions()
+			require.NoError(t, e)
+
+			var topics message.Subscriptions
+			if topics, e = subs.Get(); e != nil || len(topics) != 1 {
+				return false
+			}
+
+			var msg types.Messages
+			msg, e = ses.Messages()
+			require.NoError(t, e)
+
+			var stored *types.SessionMessages
+			if stored, e = msg.Load(); e != nil || len(stored.Out.Messages) != 1 {
+				return false
+			}
+
+			var r types.Retained
+			r, e = p.Retained()
+			require.NoError(t, e)
+
+			var list []message.Provider
+			list, e = r.Load()
+
+			return e == nil && len(list) == 1
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+
+	// retained messages changed by other nodes are reported
+	for i, ch := range retainedCh {
+		if i == origin {
+			require.Len(t, ch, 0)
+			continue
+		}
+
+		select {
+		case got := <-ch:
+			require.Equal(t, "r:retained", got)
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "retained message not reported")
+		}
+	}
+
+	require.NoError(t, retained.Remove("r"))
+
+	for i, ch := range retainedCh {
+		if i == origin {
+			continue
+		}
+
+		select {
+		case got := <-ch:
+			require.Equal(t, "r:", got)
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "removed retained message not reported")
+		}
+	}
+
+	for _, p := range nodes {
+		require.NoError(t, p.Shutdown())
+	}
+
+	// state is rebuilt from log on restart
+	for i := range nodes {
+		nodes[i] = open(t, dir, peers, i, nil)
+	}
+
+	require.Eventually(t, func() bool {
+		s, e := nodes[0].Sessions()
+		require.NoError(t, e)
+
+		_, e = s.Get("client")
+
+		return e == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, p := range nodes {
+		require.NoError(t, p.Shutdown())
+	}
+}
+
+func TestErrorFromString(t *testing.T) {
+	require.Nil(t, errorFromString(""))
+	require.Equal(t, types.ErrNotFound, errorFromString(types.ErrNotFound.Error()))
+	require.Equal(t, "other", errorFromString("other").Error())
+}
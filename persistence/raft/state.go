@@ -0,0 +1,165 @@
+package raft
+
+import (
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+type sessions struct {
+	p *impl
+}
+
+type session struct {
+	p  *impl
+	id string
+}
+
+type subscriptions struct {
+	p  *impl
+	id string
+}
+
+type messages struct {
+	p  *impl
+	id string
+}
+
+type retained struct {
+	p *impl
+}
+
+var _ types.Sessions = (*sessions)(nil)
+var _ types.Session = (*session)(nil)
+var _ types.Subscriptions = (*subscriptions)(nil)
+var _ types.Messages = (*messages)(nil)
+var _ types.Retained = (*retained)(nil)
+
+func (s *sessions) New(id string) (types.Session, error) {
+	if err := s.p.apply(&command{Op: opSessionNew, ID: id}); err != nil {
+		return nil, err
+	}
+
+	return &session{p: s.p, id: id}, nil
+}
+
+func (s *sessions) Get(id string) (types.Session, error) {
+	if _, err := s.p.sessions.Get(id); err != nil {
+		return nil, err
+	}
+
+	return &session{p: s.p, id: id}, nil
+}
+
+func (s *sessions) GetAll() ([]types.Session, error) {
+	list, err := s.p.sessions.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]types.Session, 0, len(list))
+	for _, ses := range list {
+		var id string
+		if id, err = ses.ID(); err != nil {
+			return nil, err
+		}
+
+		res = append(res, &session{p: s.p, id: id})
+	}
+
+	return res, nil
+}
+
+func (s *sessions) Delete(id string) error {
+	return s.p.apply(&command{Op: opSessionDelete, ID: id})
+}
+
+func (s *session) Subscriptions() (types.Subscriptions, error) {
+	return &subscriptions{p: s.p, id: s.id}, nil
+}
+
+func (s *session) Messages() (types.Messages, error) {
+	return &messages{p: s.p, id: s.id}, nil
+}
+
+func (s *session) ID() (string, error) {
+	return s.id, nil
+}
+
+func (s *subscriptions) Add(subs message.Subscriptions) error {
+	return s.p.apply(&command{Op: opSubscriptionsAdd, ID: s.id, Subscriptions: subs})
+}
+
+func (s *subscriptions) Get() (message.Subscriptions, error) {
+	ses, err := s.p.sessions.Get(s.id)
+	if err != nil {
+		return nil, err
+	}
+
+	var subs types.Subscriptions
+	if subs, err = ses.Subscriptions(); err != nil {
+		return nil, err
+	}
+
+	return subs.Get()
+}
+
+func (s *subscriptions) Delete() error {
+	return s.p.apply(&command{Op: opSubscriptionsDelete, ID: s.id})
+}
+
+func (m *messages) Store(dir string, msg []message.Provider) error {
+	list, err := encodeMessages(msg)
+	if err != nil {
+		return err
+	}
+
+	return m.p.apply(&command{Op: opMessagesStore, ID: m.id, Dir: dir, Messages: list})
+}
+
+func (m *messages) Load() (*types.SessionMessages, error) {
+	ses, err := m.p.sessions.Get(m.id)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg types.Messages
+	if msg, err = ses.Messages(); err != nil {
+		return nil, err
+	}
+
+	return msg.Load()
+}
+
+func (m *messages) Delete() error {
+	return m.p.apply(&command{Op: opMessagesDelete, ID: m.id})
+}
+
+func (r *retained) Load() ([]message.Provider, error) {
+	return r.p.retained.Load()
+}
+
+func (r *retained) Store(msg []message.Provider) error {
+	list, err := encodeMessages(msg)
+	if err != nil {
+		return err
+	}
+
+	return r.p.apply(&command{Op: opRetainedStore, Messages: list})
+}
+
+func (r *retained) Delete() error {
+	return r.p.apply(&command{Op: opRetainedDelete})
+}
+
+func (r *retained) Put(msg *message.PublishMessage) error {
+	list, err := encodeMessages([]message.Provider{msg})
+	if err != nil {
+		return err
+	}
+
+	return r.p.apply(&command{Op: opRetainedPut, Messages: list})
+}
+
+func (r *retained) Remove(topic string) error {
+	return r.p.apply(&command{Op: opRetainedRemove, Topic: topic})
+}
@@ -0,0 +1,397 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	hraft "github.com/hashicorp/raft"
+	"github.com/troian/surgemq/persistence/types"
+	"go.uber.org/zap"
+)
+
+// first byte of connection tells what it carries, thus Raft and forwarded writes share port
+const (
+	muxRaft    byte = 'R'
+	muxForward byte = 'F'
+)
+
+const (
+	handshakeTimeout = 5 * time.Second
+	applyPoll        = 2 * time.Millisecond
+	forwardIdle      = 4
+
+	// maxForward size of forwarded command
+	maxForward = 1024 * 1024 * 1024
+)
+
+var errForwardTooLarge = errors.New("raft: forwarded write too large")
+
+// streamLayer Raft connections of node listener
+type streamLayer struct {
+	p     *impl
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+var _ hraft.StreamLayer = (*streamLayer)(nil)
+
+func newStreamLayer(p *impl, addr net.Addr) *streamLayer {
+	return &streamLayer{
+		p:     p,
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (s *streamLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.done:
+		return nil, types.ErrNotOpen
+	}
+}
+
+func (s *streamLayer) Close() error {
+	s.once.Do(func() { close(s.done) })
+
+	return nil
+}
+
+func (s *streamLayer) Addr() net.Addr {
+	return s.addr
+}
+
+func (s *streamLayer) Dial(address hraft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return dial(string(address), muxRaft, timeout)
+}
+
+func dial(addr string, kind byte, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write([]byte{kind}); err != nil {
+		conn.Close() // nolint: errcheck, gas
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// acceptWorker accept connections until provider shutdown
+func (p *impl) acceptWorker() {
+	defer p.wg.Done()
+
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			select {
+			case <-p.quit:
+				return
+			default:
+			}
+
+			p.log.prod.Error("Couldn't accept connection", zap.Error(err))
+
+			select {
+			case <-p.quit:
+				return
+			case <-time.After(time.Second):
+			}
+
+			continue
+		}
+
+		p.wg.Add(1)
+		go p.handshake(conn)
+	}
+}
+
+// handshake pass connection to Raft or serve forwarded writes over it
+func (p *impl) handshake(conn net.Conn) {
+	defer p.wg.Done()
+
+	var kind [1]byte
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout)) // nolint: errcheck
+	if _, err := io.ReadFull(conn, kind[:]); err != nil {
+		conn.Close() // nolint: errcheck, gas
+		return
+	}
+	conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+
+	switch kind[0] {
+	case muxRaft:
+		select {
+		case p.stream.conns <- conn:
+		case <-p.stream.done:
+			conn.Close() // nolint: errcheck, gas
+		case <-p.quit:
+			conn.Close() // nolint: errcheck, gas
+		}
+	case muxForward:
+		p.serveForward(conn)
+	default:
+		conn.Close() // nolint: errcheck, gas
+	}
+}
+
+// serveForward apply writes forwarded by followers until connection fails
+// Every request is length prefixed command, response is log index followed by
+// length prefixed text of error
+func (p *impl) serveForward(conn net.Conn) {
+	p.lock.Lock()
+	select {
+	case <-p.quit:
+		p.lock.Unlock()
+		conn.Close() // nolint: errcheck, gas
+		return
+	default:
+	}
+	p.conns[conn] = struct{}{}
+	p.lock.Unlock()
+
+	defer func() {
+		p.lock.Lock()
+		delete(p.conns, conn)
+		p.lock.Unlock()
+
+		conn.Close() // nolint: errcheck, gas
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		body, err := readBlock(r)
+		if err != nil {
+			return
+		}
+
+		index, res := p.applyLocal(body)
+
+		var hdr [8]byte
+		binary.BigEndian.PutUint64(hdr[:], index)
+
+		var text []byte
+		if res != nil {
+			text = []byte(res.Error())
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(transportTimeout)) // nolint: errcheck
+
+		if _, err = w.Write(hdr[:]); err == nil {
+			if err = writeBlock(w, text); err == nil {
+				err = w.Flush()
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// apply command through leader. Returns once command is applied to local backend
+// or ApplyTimeout passed
+func (p *impl) apply(c *command) error {
+	c.Origin = p.origin
+
+	body, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	if p.raft.State() == hraft.Leader {
+		_, err = p.applyLocal(body)
+		return err
+	}
+
+	index, err := p.forwarder.forward(body)
+	if index > 0 {
+		p.waitApplied(index)
+	}
+
+	return err
+}
+
+// applyLocal commit command on leader. Returns index of command and its result
+func (p *impl) applyLocal(body []byte) (uint64, error) {
+	f := p.raft.Apply(body, p.timeout)
+	if err := f.Error(); err != nil {
+		if err == hraft.ErrNotLeader {
+			err = ErrNoLeader
+		}
+
+		return 0, err
+	}
+
+	if err, ok := f.Response().(error); ok {
+		return f.Index(), err
+	}
+
+	return f.Index(), nil
+}
+
+// waitApplied wait for local backend to catch up with given index
+func (p *impl) waitApplied(index uint64) {
+	deadline := time.Now().Add(p.timeout)
+
+	for p.raft.AppliedIndex() < index && time.Now().Before(deadline) {
+		select {
+		case <-p.quit:
+			return
+		case <-time.After(applyPoll):
+		}
+	}
+}
+
+// forwarder writes of follower to leader over pooled connections
+type forwarder struct {
+	p *impl
+
+	lock   sync.Mutex
+	addr   string
+	idle   []net.Conn
+	closed bool
+}
+
+// forward command to leader. Returns index of applied command and its result
+func (f *forwarder) forward(body []byte) (uint64, error) {
+	addr, _ := f.p.raft.LeaderWithID()
+	if addr == "" {
+		return 0, ErrNoLeader
+	}
+
+	conn, err := f.get(string(addr))
+	if err != nil {
+		return 0, err
+	}
+
+	conn.SetDeadline(time.Now().Add(f.p.timeout + transportTimeout)) // nolint: errcheck
+
+	var index uint64
+	var res error
+
+	w := bufio.NewWriter(conn)
+	if err = writeBlock(w, body); err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		r := bufio.NewReader(conn)
+
+		var hdr [8]byte
+		if _, err = io.ReadFull(r, hdr[:]); err == nil {
+			var text []byte
+			if text, err = readBlock(r); err == nil {
+				index = binary.BigEndian.Uint64(hdr[:])
+				res = errorFromString(string(text))
+			}
+		}
+	}
+
+	if err != nil {
+		conn.Close() // nolint: errcheck, gas
+		return 0, err
+	}
+
+	f.put(string(addr), conn)
+
+	return index, res
+}
+
+func (f *forwarder) get(addr string) (net.Conn, error) {
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return nil, types.ErrNotOpen
+	}
+
+	if addr != f.addr {
+		f.drop()
+		f.addr = addr
+	}
+
+	if n := len(f.idle); n > 0 {
+		conn := f.idle[n-1]
+		f.idle = f.idle[:n-1]
+		f.lock.Unlock()
+
+		return conn, nil
+	}
+	f.lock.Unlock()
+
+	return dial(addr, muxForward, transportTimeout)
+}
+
+func (f *forwarder) put(addr string, conn net.Conn) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed || addr != f.addr || len(f.idle) >= forwardIdle {
+		conn.Close() // nolint: errcheck, gas
+		return
+	}
+
+	f.idle = append(f.idle, conn)
+}
+
+func (f *forwarder) close() {
+	f.lock.Lock()
+	f.closed = true
+	f.drop()
+	f.lock.Unlock()
+}
+
+// drop idle connections. Caller holds lock
+func (f *forwarder) drop() {
+	for _, conn := range f.idle {
+		conn.Close() // nolint: errcheck, gas
+	}
+
+	f.idle = nil
+}
+
+func writeBlock(w *bufio.Writer, body []byte) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(body)))
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	_, err := w.Write(body)
+
+	return err
+}
+
+func readBlock(r *bufio.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > maxForward {
+		return nil, errForwardTooLarge
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
@@ -0,0 +1,760 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+// Key layout. Every key is prefixed with RedisConfig.Prefix
+//
+//	sessions                 set of session ids
+//	session:<id>             hash with session meta (created, subscriptions and messages flags)
+//	session:<id>:subs        hash topic -> qos
+//	session:<id>:in          list of encoded incoming messages
+//	session:<id>:out         list of encoded outgoing messages
+//	retained                 hash topic -> encoded retained message
+//	retained:meta            marker of stored retained messages
+const (
+	keySessions     = "sessions"
+	keySession      = "session:"
+	keyRetained     = "retained"
+	keyRetainedMeta = "retained:meta"
+
+	suffixSubs = ":subs"
+	suffixIn   = ":in"
+	suffixOut  = ":out"
+
+	fieldCreated       = "created"
+	fieldSubscriptions = "subscriptions"
+	fieldMessages      = "messages"
+)
+
+// healthTimeout bounds ping of health check
+const healthTimeout = 2 * time.Second
+
+type dbStatus struct {
+	db     *goredis.Client
+	prefix string
+	ttl    time.Duration
+	done   chan struct{}
+}
+
+type impl struct {
+	db dbStatus
+
+	lock sync.Mutex
+
+	r retained
+	s sessions
+}
+
+type sessions struct {
+	db *dbStatus
+}
+
+type session struct {
+	db *dbStatus
+
+	id string
+
+	s subscriptions
+	m messages
+}
+
+type subscriptions struct {
+	db *dbStatus
+
+	id string
+}
+
+type messages struct {
+	db *dbStatus
+
+	id string
+}
+
+type retained struct {
+	db *dbStatus
+}
+
+func init() {
+	persistence.Register((*types.RedisConfig)(nil), func(config types.ProviderConfig) (types.Provider, error) { // nolint: errcheck, gas
+		return NewRedis(config.(*types.RedisConfig))
+	})
+}
+
+// NewRedis allocate new persistence provider of Redis type
+func NewRedis(config *types.RedisConfig) (types.Provider, error) {
+	pl := &impl{
+		db: dbStatus{
+			prefix: config.Prefix,
+			ttl:    config.SessionTTL,
+			done:   make(chan struct{}),
+		},
+	}
+
+	pl.db.db = goredis.NewClient(&goredis.Options{
+		Addr:     config.Address,
+		Password: config.Password,
+		DB:       config.DB,
+	})
+
+	if err := pl.db.db.Ping(context.Background()).Err(); err != nil {
+		pl.db.db.Close() // nolint: errcheck, gas
+		return nil, err
+	}
+
+	pl.r = retained{
+		db: &pl.db,
+	}
+
+	pl.s = sessions{
+		db: &pl.db,
+	}
+
+	return pl, nil
+}
+
+// Sessions
+func (p *impl) Sessions() (types.Sessions, error) {
+	select {
+	case <-p.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &p.s, nil
+}
+
+// Retained
+func (p *impl) Retained() (types.Retained, error) {
+	select {
+	case <-p.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &p.r, nil
+}
+
+// Health ping server
+func (p *impl) Health() error {
+	select {
+	case <-p.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+
+	return p.db.db.Ping(ctx).Err()
+}
+
+// Shutdown provider
+func (p *impl) Shutdown() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	close(p.db.done)
+
+	return p.db.db.Close()
+}
+
+func (db *dbStatus) key(k string) string {
+	return db.prefix + k
+}
+
+func (db *dbStatus) sessionKey(id string) string {
+	return db.prefix + keySession + id
+}
+
+// sessionExists check if meta of the session is present
+// members of sessions set whose keys have expired are removed
+func (db *dbStatus) sessionExists(ctx context.Context, id string) (bool, error) {
+	n, err := db.db.Exists(ctx, db.sessionKey(id)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	if n == 0 {
+		db.db.SRem(ctx, db.key(keySessions), id) // nolint: errcheck, gas
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// touch refresh TTL of all keys of the session
+func (db *dbStatus) touch(ctx context.Context, pipe goredis.Pipeliner, id string) {
+	if db.ttl <= 0 {
+		return
+	}
+
+	k := db.sessionKey(id)
+	for _, key := range []string{k, k + suffixSubs, k + suffixIn, k + suffixOut} {
+		pipe.Expire(ctx, key, db.ttl)
+	}
+}
+
+// New
+func (s *sessions) New(id string) (types.Session, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	ctx := context.Background()
+
+	created, err := s.db.db.HSetNX(ctx, s.db.sessionKey(id), fieldCreated, time.Now().Unix()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if !created {
+		return nil, types.ErrAlreadyExists
+	}
+
+	_, err = s.db.db.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.SAdd(ctx, s.db.key(keySessions), id)
+		s.db.touch(ctx, pipe, id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ses := newSession(s.db, id)
+
+	return &ses, nil
+}
+
+// Get
+func (s *sessions) Get(id string) (types.Session, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	exists, err := s.db.sessionExists(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, types.ErrNotFound
+	}
+
+	ses := newSession(s.db, id)
+
+	return &ses, nil
+}
+
+func (s *sessions) GetAll() ([]types.Session, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	ctx := context.Background()
+
+	ids, err := s.db.db.SMembers(ctx, s.db.key(keySessions)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) == 0 {
+		return nil, types.ErrNotFound
+	}
+
+	res := []types.Session{}
+
+	for _, id := range ids {
+		var exists bool
+		if exists, err = s.db.sessionExists(ctx, id); err != nil {
+			return nil, err
+		}
+
+		if exists {
+			ses := newSession(s.db, id)
+			res = append(res, &ses)
+		}
+	}
+
+	return res, nil
+}
+
+// Delete
+func (s *sessions) Delete(id string) error {
+	select {
+	case <-s.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	ctx := context.Background()
+	k := s.db.sessionKey(id)
+
+	var del *goredis.IntCmd
+	_, err := s.db.db.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		del = pipe.Del(ctx, k)
+		pipe.Del(ctx, k+suffixSubs, k+suffixIn, k+suffixOut)
+		pipe.SRem(ctx, s.db.key(keySessions), id)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if del.Val() == 0 {
+		return types.ErrNotFound
+	}
+
+	return nil
+}
+
+func newSession(db *dbStatus, id string) session {
+	ses := session{
+		db: db,
+		id: id,
+	}
+
+	ses.m = messages{
+		db: db,
+		id: id,
+	}
+
+	ses.s = subscriptions{
+		db: db,
+		id: id,
+	}
+
+	return ses
+}
+
+// Subscriptions
+func (s *session) Subscriptions() (types.Subscriptions, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &s.s, nil
+}
+
+// Messages
+func (s *session) Messages() (types.Messages, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &s.m, nil
+}
+
+func (s *session) ID() (string, error) {
+	select {
+	case <-s.db.done:
+		return "", types.ErrNotOpen
+	default:
+	}
+
+	return s.id, nil
+}
+
+func (s *subscriptions) Add(subs message.Subscriptions) error {
+	select {
+	case <-s.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	ctx := context.Background()
+
+	exists, err := s.db.sessionExists(ctx, s.id)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return types.ErrNotFound
+	}
+
+	k := s.db.sessionKey(s.id)
+
+	_, err = s.db.db.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.HSet(ctx, k, fieldSubscriptions, 1)
+		for t, o := range subs {
+			pipe.HSet(ctx, k+suffixSubs, t, formatSubscription(o))
+		}
+		s.db.touch(ctx, pipe, s.id)
+		return nil
+	})
+
+	return err
+}
+
+func (s *subscriptions) Get() (message.Subscriptions, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	ctx := context.Background()
+	k := s.db.sessionKey(s.id)
+
+	stored, err := s.db.db.HExists(ctx, k, fieldSubscriptions).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if !stored {
+		return nil, types.ErrNotFound
+	}
+
+	vals, err := s.db.db.HGetAll(ctx, k+suffixSubs).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(message.Subscriptions)
+	for t, v := range vals {
+		if res[t], err = parseSubscription(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// formatSubscription options byte and subscription identifier if set, i.e. <options>[:<id>]
+// Options of QoS alone format the same as QoS stored by earlier versions
+func formatSubscription(o message.SubscriptionOptions) string {
+	v := strconv.Itoa(int(o.Byte()))
+	if o.ID != 0 {
+		v += ":" + strconv.FormatUint(uint64(o.ID), 10)
+	}
+
+	return v
+}
+
+// parseSubscription formatted by formatSubscription
+func parseSubscription(v string) (message.SubscriptionOptions, error) {
+	parts := strings.SplitN(v, ":", 2)
+
+	b, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil {
+		return message.SubscriptionOptions{}, err
+	}
+
+	o, err := message.DecodeSubscriptionOptions([]byte{byte(b)})
+	if err != nil || len(parts) == 1 {
+		return o, err
+	}
+
+	var id uint64
+	if id, err = strconv.ParseUint(parts[1], 10, 32); err != nil {
+		return o, err
+	}
+
+	o.ID = uint32(id)
+
+	return o, nil
+}
+
+func (s *subscriptions) Delete() error {
+	select {
+	case <-s.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	ctx := context.Background()
+	k := s.db.sessionKey(s.id)
+
+	var del *goredis.IntCmd
+	_, err := s.db.db.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		del = pipe.HDel(ctx, k, fieldSubscriptions)
+		pipe.Del(ctx, k+suffixSubs)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if del.Val() == 0 {
+		return types.ErrNotFound
+	}
+
+	return nil
+}
+
+// Store
+func (m *messages) Store(dir string, msg []message.Provider) error {
+	select {
+	case <-m.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	var suffix string
+	switch dir {
+	case "in":
+		suffix = suffixIn
+	case "out":
+		suffix = suffixOut
+	default:
+		return types.ErrInvalidArgs
+	}
+
+	ctx := context.Background()
+
+	exists, err := m.db.sessionExists(ctx, m.id)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return types.ErrNotFound
+	}
+
+	values, err := encodeMessages(msg)
+	if err != nil {
+		return err
+	}
+
+	k := m.db.sessionKey(m.id)
+
+	_, err = m.db.db.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.HSet(ctx, k, fieldMessages, 1)
+		if len(values) > 0 {
+			pipe.RPush(ctx, k+suffix, values...)
+		}
+		m.db.touch(ctx, pipe, m.id)
+		return nil
+	})
+
+	return err
+}
+
+// Load
+func (m *messages) Load() (*types.SessionMessages, error) {
+	select {
+	case <-m.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	ctx := context.Background()
+	k := m.db.sessionKey(m.id)
+
+	msg := types.SessionMessages{}
+
+	stored, err := m.db.db.HExists(ctx, k, fieldMessages).Result()
+	if err != nil {
+		return &msg, err
+	}
+
+	if !stored {
+		return &msg, types.ErrNotFound
+	}
+
+	var in, out *goredis.StringSliceCmd
+	_, err = m.db.db.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		in = pipe.LRange(ctx, k+suffixIn, 0, -1)
+		out = pipe.LRange(ctx, k+suffixOut, 0, -1)
+		return nil
+	})
+
+	if err != nil {
+		return &msg, err
+	}
+
+	if msg.In.Messages, err = decodeMessages(in.Val()); err != nil {
+		return &msg, err
+	}
+
+	msg.Out.Messages, err = decodeMessages(out.Val())
+
+	return &msg, err
+}
+
+// Delete
+func (m *messages) Delete() error {
+	select {
+	case <-m.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	ctx := context.Background()
+	k := m.db.sessionKey(m.id)
+
+	var del *goredis.IntCmd
+	_, err := m.db.db.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		del = pipe.HDel(ctx, k, fieldMessages)
+		pipe.Del(ctx, k+suffixIn, k+suffixOut)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if del.Val() == 0 {
+		return types.ErrNotFound
+	}
+
+	return nil
+}
+
+// Load
+func (r *retained) Load() ([]message.Provider, error) {
+	select {
+	case <-r.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	ctx := context.Background()
+
+	n, err := r.db.db.Exists(ctx, r.db.key(keyRetainedMeta)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		return []message.Provider{}, types.ErrNotFound
+	}
+
+	vals, err := r.db.db.HVals(ctx, r.db.key(keyRetained)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeMessages(vals)
+}
+
+// Store
+func (r *retained) Store(msg []message.Provider) error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	values := make([]interface{}, 0, len(msg)*2)
+	for _, e := range msg {
+		m, ok := e.(*message.PublishMessage)
+		if !ok {
+			return types.ErrInvalidArgs
+		}
+
+		buf, err := types.EncodeMessage(m)
+		if err != nil {
+			return err
+		}
+
+		values = append(values, m.Topic(), buf)
+	}
+
+	ctx := context.Background()
+
+	_, err := r.db.db.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Set(ctx, r.db.key(keyRetainedMeta), 1, 0)
+		if len(values) > 0 {
+			pipe.HSet(ctx, r.db.key(keyRetained), values...)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// Put
+func (r *retained) Put(msg *message.PublishMessage) error {
+	return r.Store([]message.Provider{msg})
+}
+
+// Remove
+func (r *retained) Remove(topic string) error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return r.db.db.HDel(context.Background(), r.db.key(keyRetained), topic).Err()
+}
+
+// Delete
+func (r *retained) Delete() error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	n, err := r.db.db.Del(context.Background(), r.db.key(keyRetainedMeta), r.db.key(keyRetained)).Result()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return types.ErrNotFound
+	}
+
+	return nil
+}
+
+func encodeMessages(msg []message.Provider) ([]interface{}, error) {
+	values := make([]interface{}, 0, len(msg))
+
+	for _, m := range msg {
+		buf, err := types.EncodeMessage(m)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, buf)
+	}
+
+	return values, nil
+}
+
+func decodeMessages(vals []string) ([]message.Provider, error) {
+	entries := []message.Provider{}
+
+	for _, v := range vals {
+		m, err := types.DecodeMessage([]byte(v))
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, m)
+	}
+
+	return entries, nil
+}
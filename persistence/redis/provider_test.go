@@ -0,0 +1,87 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+func newProvider(t *testing.T) (types.Provider, *miniredis.Miniredis) {
+	srv := miniredis.NewMiniRedis()
+	require.NoError(t, srv.Start())
+	t.Cleanup(srv.Close)
+
+	p, err := NewRedis(&types.RedisConfig{Address: srv.Addr(), Prefix: "test"})
+	require.NoError(t, err)
+
+	return p, srv
+}
+
+func TestHealth(t *testing.T) {
+	p, srv := newProvider(t)
+
+	require.NoError(t, types.CheckHealth(p))
+
+	srv.Close()
+	require.Error(t, types.CheckHealth(p))
+
+	require.NoError(t, p.Shutdown())
+	require.Equal(t, types.ErrNotOpen, types.CheckHealth(p))
+}
+
+func TestSubscriptionOptions(t *testing.T) {
+	p, _ := newProvider(t)
+	defer p.Shutdown() // nolint: errcheck
+
+	ss, err := p.Sessions()
+	require.NoError(t, err)
+
+	ses, err := ss.New("c1")
+	require.NoError(t, err)
+
+	subs, err := ses.Subscriptions()
+	require.NoError(t, err)
+
+	_, err = subs.Get()
+	require.Equal(t, types.ErrNotFound, err)
+
+	expected := message.Subscriptions{
+		"a/#": {QoS: message.QoS1, NoLocal: true, RetainAsPublished: true, RetainHandling: 2, ID: 42},
+		"b":   {QoS: message.QoS2},
+	}
+	require.NoError(t, subs.Add(expected))
+
+	res, err := subs.Get()
+	require.NoError(t, err)
+	require.Equal(t, expected, res)
+}
+
+func TestSubscriptionFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		opts message.SubscriptionOptions
+		v    string
+	}{
+		{"qos only", message.SubscriptionOptions{QoS: message.QoS2}, "2"},
+		{"options", message.SubscriptionOptions{QoS: message.QoS1, NoLocal: true, RetainHandling: 1}, "21"},
+		{"identifier", message.SubscriptionOptions{QoS: message.QoS0, ID: 268435455}, "0:268435455"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.v, formatSubscription(tt.opts))
+
+			o, err := parseSubscription(tt.v)
+			require.NoError(t, err)
+			require.Equal(t, tt.opts, o)
+		})
+	}
+
+	for _, v := range []string{"", "x", "1:x", "1:4294967296", "256"} {
+		_, err := parseSubscription(v)
+		require.Error(t, err, v)
+	}
+}
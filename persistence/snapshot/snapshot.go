@@ -0,0 +1,156 @@
+// Package snapshot copies persistence store into directory or S3-compatible object
+// store while broker keeps running
+//
+// Backends able to copy themselves consistently (BoltDB, Badger) are saved in native
+// format: BoltDB database file or Badger backup. Others are saved as CBOR dump which
+// is imported back by persistdump
+package snapshot
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/troian/surgemq/persistence/dump"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+// Target stores snapshot under given name
+type Target interface {
+	Put(name string, r io.Reader) error
+}
+
+// S3Config S3-compatible object store
+type S3Config struct {
+	// Endpoint host[:port] of object store
+	Endpoint string
+
+	// Secure use https
+	Secure bool
+
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	Bucket string
+
+	// Prefix prepended to name of every snapshot object
+	Prefix string
+}
+
+type dirTarget struct {
+	dir string
+}
+
+type s3Target struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// Write snapshot of provider into w
+func Write(p types.Provider, w io.Writer) error {
+	err := types.TakeSnapshot(p, w)
+	if err != types.ErrNotSupported {
+		return err
+	}
+
+	var d *dump.Dump
+	if d, err = dump.Export(p); err != nil {
+		return err
+	}
+
+	return d.Encode(w, dump.FormatCBOR)
+}
+
+// Take snapshot of provider and store it in target. Returns name of snapshot
+func Take(p types.Provider, t Target) (string, error) {
+	name := "surgemq-" + time.Now().UTC().Format("20060102T150405.000Z") + ".snap"
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		pw.CloseWithError(Write(p, pw)) // nolint: errcheck, gas
+	}()
+
+	err := t.Put(name, pr)
+
+	// unblock writer if target gave up early
+	pr.CloseWithError(err) // nolint: errcheck, gas
+	<-done
+
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// NewDirTarget target storing snapshots as files in directory
+func NewDirTarget(dir string) Target {
+	return &dirTarget{dir: dir}
+}
+
+// Put write snapshot into temporary file and rename it once complete
+func (t *dirTarget) Put(name string, r io.Reader) error {
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(t.dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(t.dir, name))
+	}
+
+	if err != nil {
+		os.Remove(f.Name()) // nolint: errcheck, gas
+	}
+
+	return err
+}
+
+// NewS3Target target storing snapshots as objects in bucket
+func NewS3Target(config S3Config) (Target, error) {
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.Secure,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Target{
+		client: client,
+		bucket: config.Bucket,
+		prefix: config.Prefix,
+	}, nil
+}
+
+// Put upload snapshot. Size is unknown thus multipart upload is used
+func (t *s3Target) Put(name string, r io.Reader) error {
+	_, err := t.client.PutObject(context.Background(), t.bucket, t.prefix+name, r, -1, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+
+	return err
+}
@@ -0,0 +1,99 @@
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/boltdb"
+	"github.com/troian/surgemq/persistence/dump"
+	"github.com/troian/surgemq/persistence/redis"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+func populate(t *testing.T, p types.Provider) {
+	sessions, err := p.Sessions()
+	require.NoError(t, err)
+
+	ses, err := sessions.New("client")
+	require.NoError(t, err)
+
+	subs, err := ses.Subscriptions()
+	require.NoError(t, err)
+	require.NoError(t, subs.Add(message.Subscriptions{"a/b": {QoS: message.QoS1}}))
+
+	retained, err := p.Retained()
+	require.NoError(t, err)
+
+	m := message.NewPublishMessage()
+	require.NoError(t, m.SetTopic("a/b"))
+	m.SetPayload([]byte("data"))
+	require.NoError(t, retained.Put(m))
+}
+
+func TestNative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq-snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	p, err := boltdb.NewBoltDB(&types.BoltDBConfig{File: filepath.Join(dir, "live.db")})
+	require.NoError(t, err)
+	defer p.Shutdown() // nolint: errcheck
+
+	populate(t, p)
+
+	target := filepath.Join(dir, "backup")
+
+	name, err := Take(p, NewDirTarget(target))
+	require.NoError(t, err)
+
+	files, err := ioutil.ReadDir(target)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, name, files[0].Name())
+
+	// snapshot is usable database
+	restored, err := boltdb.NewBoltDB(&types.BoltDBConfig{File: filepath.Join(target, name)})
+	require.NoError(t, err)
+	defer restored.Shutdown() // nolint: errcheck
+
+	d, err := dump.Export(restored)
+	require.NoError(t, err)
+	require.Len(t, d.Sessions, 1)
+	require.Equal(t, "client", d.Sessions[0].ID)
+	require.Len(t, d.Retained, 1)
+}
+
+func TestLogical(t *testing.T) {
+	srv, err := miniredis.Run()
+	require.NoError(t, err)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "surgemq-snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	p, err := redis.NewRedis(&types.RedisConfig{Address: srv.Addr()})
+	require.NoError(t, err)
+	defer p.Shutdown() // nolint: errcheck
+
+	populate(t, p)
+
+	name, err := Take(p, NewDirTarget(dir))
+	require.NoError(t, err)
+
+	f, err := os.Open(filepath.Join(dir, name))
+	require.NoError(t, err)
+	defer f.Close() // nolint: errcheck
+
+	d, err := dump.Decode(f, dump.FormatCBOR)
+	require.NoError(t, err)
+	require.Len(t, d.Sessions, 1)
+	require.Equal(t, map[string]byte{"a/b": 1}, d.Sessions[0].Subscriptions)
+	require.Len(t, d.Retained, 1)
+	require.Equal(t, []byte("data"), d.Retained[0].Payload)
+}
@@ -0,0 +1,89 @@
+package sqldb
+
+import (
+	"strconv"
+	"strings"
+)
+
+// dialect differences between SQL databases
+// Queries are written with ? placeholders and rebound for the dialect
+type dialect struct {
+	// driver name of database/sql driver
+	driver string
+
+	// schema directory with schema files of the dialect
+	schema string
+
+	// numbered placeholders ($1, $2...) instead of ?
+	numbered bool
+
+	// insertIgnore statement inserting row unless it exists
+	insertIgnore func(table, columns, values string) string
+
+	// upsert statement inserting rows or updating given columns on key conflict
+	upsert func(table, columns, values, key string, update []string) string
+}
+
+var dialectPostgres = &dialect{
+	driver:   "pgx",
+	schema:   "postgres",
+	numbered: true,
+	insertIgnore: func(table, columns, values string) string {
+		return "INSERT INTO " + table + " (" + columns + ") VALUES " + values + " ON CONFLICT DO NOTHING"
+	},
+	upsert: func(table, columns, values, key string, update []string) string {
+		set := make([]string, 0, len(update))
+		for _, c := range update {
+			set = append(set, c+" = EXCLUDED."+c)
+		}
+
+		return "INSERT INTO " + table + " (" + columns + ") VALUES " + values +
+			" ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(set, ", ")
+	},
+}
+
+var dialectMySQL = &dialect{
+	driver: "mysql",
+	schema: "mysql",
+	insertIgnore: func(table, columns, values string) string {
+		return "INSERT IGNORE INTO " + table + " (" + columns + ") VALUES " + values
+	},
+	// key is implied by unique indexes of the table
+	upsert: func(table, columns, values, key string, update []string) string {
+		set := make([]string, 0, len(update))
+		for _, c := range update {
+			set = append(set, c+" = VALUES("+c+")")
+		}
+
+		return "INSERT INTO " + table + " (" + columns + ") VALUES " + values +
+			" ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+	},
+}
+
+// bind replace ? placeholders with dialect specific ones
+func (d *dialect) bind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String()
+}
+
+// placeholders build values list of rows with given amount of columns, e.g. (?, ?), (?, ?)
+func placeholders(rows, columns int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", columns), ", ") + ")"
+
+	return strings.TrimSuffix(strings.Repeat(row+", ", rows), ", ")
+}
@@ -0,0 +1,46 @@
+package sqldb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBind(t *testing.T) {
+	q := "SELECT a FROM t WHERE b = ? AND c IN " + placeholders(2, 2)
+
+	require.Equal(t, "SELECT a FROM t WHERE b = ? AND c IN (?, ?), (?, ?)", q)
+	require.Equal(t, "SELECT a FROM t WHERE b = $1 AND c IN ($2, $3), ($4, $5)", dialectPostgres.bind(q))
+	require.Equal(t, q, dialectMySQL.bind(q))
+}
+
+func TestUpsert(t *testing.T) {
+	q := dialectPostgres.upsert("subscriptions", "session_id, topic, qos", placeholders(1, 3), "session_id, topic", []string{"qos"})
+
+	require.Equal(t,
+		"INSERT INTO subscriptions (session_id, topic, qos) VALUES (?, ?, ?) ON CONFLICT (session_id, topic) DO UPDATE SET qos = EXCLUDED.qos",
+		q)
+}
+
+func TestUpsertMySQL(t *testing.T) {
+	q := dialectMySQL.upsert("subscriptions", "session_id, topic, qos", placeholders(1, 3), "session_id, topic", []string{"qos"})
+
+	require.Equal(t,
+		"INSERT INTO subscriptions (session_id, topic, qos) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE qos = VALUES(qos)",
+		q)
+
+	require.Equal(t, "INSERT IGNORE INTO markers (name) VALUES (?)", dialectMySQL.insertIgnore("markers", "name", placeholders(1, 1)))
+}
+
+func TestLoadMigrations(t *testing.T) {
+	for _, d := range []*dialect{dialectPostgres, dialectMySQL} {
+		m, err := loadMigrations(d)
+		require.NoError(t, err)
+		require.NotEmpty(t, m)
+
+		for i := range m {
+			require.Equal(t, i+1, m[i].version)
+			require.NotEmpty(t, m[i].statements)
+		}
+	}
+}
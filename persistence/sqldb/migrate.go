@@ -0,0 +1,118 @@
+package sqldb
+
+import (
+	"database/sql"
+	"embed"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed schema
+var schemaFS embed.FS
+
+type migration struct {
+	version    int
+	statements []string
+}
+
+// loadMigrations read schema files of the dialect in order of versions
+// Files are named <version>_<description>.sql
+func loadMigrations(d *dialect) ([]migration, error) {
+	dir := path.Join("schema", d.schema)
+
+	entries, err := schemaFS.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []migration
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+
+		var version int
+		if version, err = strconv.Atoi(strings.SplitN(name, "_", 2)[0]); err != nil {
+			return nil, err
+		}
+
+		var data []byte
+		if data, err = schemaFS.ReadFile(path.Join(dir, name)); err != nil {
+			return nil, err
+		}
+
+		m := migration{version: version}
+		for _, st := range strings.Split(string(data), ";") {
+			if st = strings.TrimSpace(st); st != "" {
+				m.statements = append(m.statements, st)
+			}
+		}
+
+		res = append(res, m)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].version < res[j].version
+	})
+
+	return res, nil
+}
+
+// migrate bring schema up to date. Each version applied in own transaction
+func migrate(db *sql.DB, d *dialect) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)"); err != nil {
+		return err
+	}
+
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+
+	migrations, err := loadMigrations(d)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		err = inTx(db, func(tx *sql.Tx) error {
+			for _, st := range m.statements {
+				if _, e := tx.Exec(st); e != nil {
+					return e
+				}
+			}
+
+			_, e := tx.Exec(d.bind("INSERT INTO schema_migrations (version) VALUES (?)"), m.version)
+			return e
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inTx run fn within transaction, rollback if it fails
+func inTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		tx.Rollback() // nolint: errcheck, gas
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,793 @@
+// Package sqldb persistence provider backed by SQL database
+// Dialect specific parts are schema files and few statements, everything else is shared
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	// MySQL driver
+	_ "github.com/go-sql-driver/mysql"
+	// PostgreSQL driver
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+// maxBatchRows amount of rows inserted by single statement
+const maxBatchRows = 500
+
+const markerRetained = "retained"
+
+// healthTimeout bounds ping of health check
+const healthTimeout = 2 * time.Second
+
+type dbStatus struct {
+	db   *sql.DB
+	d    *dialect
+	done chan struct{}
+}
+
+type impl struct {
+	db dbStatus
+
+	lock sync.Mutex
+
+	r retained
+	s sessions
+}
+
+type sessions struct {
+	db *dbStatus
+}
+
+type session struct {
+	db *dbStatus
+
+	id string
+
+	s subscriptions
+	m messages
+}
+
+type subscriptions struct {
+	db *dbStatus
+
+	id string
+}
+
+type messages struct {
+	db *dbStatus
+
+	id string
+}
+
+type retained struct {
+	db *dbStatus
+}
+
+func init() {
+	persistence.Register((*types.PostgreSQLConfig)(nil), func(config types.ProviderConfig) (types.Provider, error) { // nolint: errcheck, gas
+		return NewPostgreSQL(config.(*types.PostgreSQLConfig))
+	})
+
+	persistence.Register((*types.MySQLConfig)(nil), func(config types.ProviderConfig) (types.Provider, error) { // nolint: errcheck, gas
+		return NewMySQL(config.(*types.MySQLConfig))
+	})
+}
+
+// NewPostgreSQL allocate new persistence provider of PostgreSQL type
+func NewPostgreSQL(config *types.PostgreSQLConfig) (types.Provider, error) {
+	return newProvider(dialectPostgres, config.DSN, config.MaxOpenConns)
+}
+
+// NewMySQL allocate new persistence provider of MySQL/MariaDB type
+func NewMySQL(config *types.MySQLConfig) (types.Provider, error) {
+	return newProvider(dialectMySQL, config.DSN, config.MaxOpenConns)
+}
+
+func newProvider(d *dialect, dsn string, maxOpenConns int) (types.Provider, error) {
+	pl := &impl{
+		db: dbStatus{
+			d:    d,
+			done: make(chan struct{}),
+		},
+	}
+
+	var err error
+	if pl.db.db, err = sql.Open(d.driver, dsn); err != nil {
+		return nil, err
+	}
+
+	if maxOpenConns > 0 {
+		pl.db.db.SetMaxOpenConns(maxOpenConns)
+	}
+
+	if err = pl.db.db.Ping(); err != nil {
+		pl.db.db.Close() // nolint: errcheck, gas
+		return nil, err
+	}
+
+	if err = migrate(pl.db.db, d); err != nil {
+		pl.db.db.Close() // nolint: errcheck, gas
+		return nil, err
+	}
+
+	if err = upgradeRetained(pl.db.db, d); err != nil {
+		pl.db.db.Close() // nolint: errcheck, gas
+		return nil, err
+	}
+
+	pl.r = retained{
+		db: &pl.db,
+	}
+
+	pl.s = sessions{
+		db: &pl.db,
+	}
+
+	return pl, nil
+}
+
+// Sessions
+func (p *impl) Sessions() (types.Sessions, error) {
+	select {
+	case <-p.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &p.s, nil
+}
+
+// Retained
+func (p *impl) Retained() (types.Retained, error) {
+	select {
+	case <-p.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &p.r, nil
+}
+
+// Health ping database
+func (p *impl) Health() error {
+	select {
+	case <-p.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+
+	return p.db.db.PingContext(ctx)
+}
+
+// Shutdown provider
+func (p *impl) Shutdown() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	close(p.db.done)
+
+	return p.db.db.Close()
+}
+
+// flag read boolean column of the session
+// returns ErrNotFound if either session does not exist or flag is not set
+func (db *dbStatus) flag(id, column string) error {
+	var set bool
+	err := db.db.QueryRow(db.d.bind("SELECT "+column+" FROM sessions WHERE id = ?"), id).Scan(&set)
+	if err == sql.ErrNoRows || (err == nil && !set) {
+		return types.ErrNotFound
+	}
+
+	return err
+}
+
+// sessionExists returns ErrNotFound if session does not exist
+func sessionExists(tx *sql.Tx, d *dialect, id string) error {
+	var tmp string
+	err := tx.QueryRow(d.bind("SELECT id FROM sessions WHERE id = ?"), id).Scan(&tmp)
+	if err == sql.ErrNoRows {
+		return types.ErrNotFound
+	}
+
+	return err
+}
+
+// setFlag set boolean column of the session within transaction
+// reports whether flag has been changed
+func setFlag(tx *sql.Tx, d *dialect, id, column string, value bool) (bool, error) {
+	res, err := tx.Exec(d.bind("UPDATE sessions SET "+column+" = ? WHERE id = ? AND "+column+" = ?"), value, id, !value)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+// New
+func (s *sessions) New(id string) (types.Session, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	res, err := s.db.db.Exec(s.db.d.bind(s.db.d.insertIgnore("sessions", "id, created_at", placeholders(1, 2))), id, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	var n int64
+	if n, err = res.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		return nil, types.ErrAlreadyExists
+	}
+
+	ses := newSession(s.db, id)
+
+	return &ses, nil
+}
+
+// Get
+func (s *sessions) Get(id string) (types.Session, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	var tmp string
+	err := s.db.db.QueryRow(s.db.d.bind("SELECT id FROM sessions WHERE id = ?"), id).Scan(&tmp)
+	if err == sql.ErrNoRows {
+		return nil, types.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	ses := newSession(s.db, id)
+
+	return &ses, nil
+}
+
+func (s *sessions) GetAll() ([]types.Session, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	rows, err := s.db.db.Query("SELECT id FROM sessions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	res := []types.Session{}
+
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ses := newSession(s.db, id)
+		res = append(res, &ses)
+	}
+
+	return res, rows.Err()
+}
+
+// Delete
+func (s *sessions) Delete(id string) error {
+	select {
+	case <-s.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	var n int64
+
+	err := inTx(s.db.db, func(tx *sql.Tx) error {
+		for _, q := range []string{
+			"DELETE FROM subscriptions WHERE session_id = ?",
+			"DELETE FROM messages WHERE session_id = ?",
+		} {
+			if _, err := tx.Exec(s.db.d.bind(q), id); err != nil {
+				return err
+			}
+		}
+
+		res, err := tx.Exec(s.db.d.bind("DELETE FROM sessions WHERE id = ?"), id)
+		if err != nil {
+			return err
+		}
+
+		n, err = res.RowsAffected()
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return types.ErrNotFound
+	}
+
+	return nil
+}
+
+func newSession(db *dbStatus, id string) session {
+	ses := session{
+		db: db,
+		id: id,
+	}
+
+	ses.m = messages{
+		db: db,
+		id: id,
+	}
+
+	ses.s = subscriptions{
+		db: db,
+		id: id,
+	}
+
+	return ses
+}
+
+// Subscriptions
+func (s *session) Subscriptions() (types.Subscriptions, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &s.s, nil
+}
+
+// Messages
+func (s *session) Messages() (types.Messages, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &s.m, nil
+}
+
+func (s *session) ID() (string, error) {
+	select {
+	case <-s.db.done:
+		return "", types.ErrNotOpen
+	default:
+	}
+
+	return s.id, nil
+}
+
+func (s *subscriptions) Add(subs message.Subscriptions) error {
+	select {
+	case <-s.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	d := s.db.d
+
+	return inTx(s.db.db, func(tx *sql.Tx) error {
+		if err := sessionExists(tx, d, s.id); err != nil {
+			return err
+		}
+
+		if _, err := setFlag(tx, d, s.id, "subs_stored", true); err != nil {
+			return err
+		}
+
+		args := make([]interface{}, 0, len(subs)*5)
+		for t, o := range subs {
+			args = append(args, s.id, t, int(o.QoS), int(o.Byte()), int64(o.ID))
+		}
+
+		return batchExec(tx, len(args)/5, 5, args, func(values string) string {
+			return d.bind(d.upsert("subscriptions", "session_id, topic, qos, options, sub_id", values,
+				"session_id, topic", []string{"qos", "options", "sub_id"}))
+		})
+	})
+}
+
+func (s *subscriptions) Get() (message.Subscriptions, error) {
+	select {
+	case <-s.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	if err := s.db.flag(s.id, "subs_stored"); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.db.Query(s.db.d.bind("SELECT topic, qos, options, sub_id FROM subscriptions WHERE session_id = ?"), s.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	res := make(message.Subscriptions)
+
+	for rows.Next() {
+		var t string
+		var q, opts int
+		var id int64
+		if err = rows.Scan(&t, &q, &opts, &id); err != nil {
+			return nil, err
+		}
+
+		var o message.SubscriptionOptions
+		if o, err = message.DecodeSubscriptionOptions([]byte{byte(opts)}); err != nil {
+			return nil, err
+		}
+
+		// rows stored by earlier versions have QoS column only
+		o.QoS = message.QosType(q)
+		o.ID = uint32(id)
+
+		res[t] = o
+	}
+
+	return res, rows.Err()
+}
+
+func (s *subscriptions) Delete() error {
+	select {
+	case <-s.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return inTx(s.db.db, func(tx *sql.Tx) error {
+		changed, err := setFlag(tx, s.db.d, s.id, "subs_stored", false)
+		if err != nil {
+			return err
+		}
+
+		if !changed {
+			return types.ErrNotFound
+		}
+
+		_, err = tx.Exec(s.db.d.bind("DELETE FROM subscriptions WHERE session_id = ?"), s.id)
+		return err
+	})
+}
+
+// Store
+func (m *messages) Store(dir string, msg []message.Provider) error {
+	select {
+	case <-m.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	if dir != "in" && dir != "out" {
+		return types.ErrInvalidArgs
+	}
+
+	args := make([]interface{}, 0, len(msg)*3)
+	for _, e := range msg {
+		buf, err := types.EncodeMessage(e)
+		if err != nil {
+			return err
+		}
+
+		args = append(args, m.id, dir, buf)
+	}
+
+	d := m.db.d
+
+	return inTx(m.db.db, func(tx *sql.Tx) error {
+		if err := sessionExists(tx, d, m.id); err != nil {
+			return err
+		}
+
+		if _, err := setFlag(tx, d, m.id, "msgs_stored", true); err != nil {
+			return err
+		}
+
+		return batchExec(tx, len(msg), 3, args, func(values string) string {
+			return d.bind("INSERT INTO messages (session_id, direction, data) VALUES " + values)
+		})
+	})
+}
+
+// Load
+func (m *messages) Load() (*types.SessionMessages, error) {
+	select {
+	case <-m.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	msg := types.SessionMessages{}
+
+	if err := m.db.flag(m.id, "msgs_stored"); err != nil {
+		return &msg, err
+	}
+
+	rows, err := m.db.db.Query(m.db.d.bind("SELECT direction, data FROM messages WHERE session_id = ? ORDER BY id"), m.id)
+	if err != nil {
+		return &msg, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	for rows.Next() {
+		var dir string
+		var buf []byte
+		if err = rows.Scan(&dir, &buf); err != nil {
+			return &msg, err
+		}
+
+		var e message.Provider
+		if e, err = types.DecodeMessage(buf); err != nil {
+			return &msg, err
+		}
+
+		if dir == "in" {
+			msg.In.Messages = append(msg.In.Messages, e)
+		} else {
+			msg.Out.Messages = append(msg.Out.Messages, e)
+		}
+	}
+
+	return &msg, rows.Err()
+}
+
+// Delete
+func (m *messages) Delete() error {
+	select {
+	case <-m.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return inTx(m.db.db, func(tx *sql.Tx) error {
+		changed, err := setFlag(tx, m.db.d, m.id, "msgs_stored", false)
+		if err != nil {
+			return err
+		}
+
+		if !changed {
+			return types.ErrNotFound
+		}
+
+		_, err = tx.Exec(m.db.d.bind("DELETE FROM messages WHERE session_id = ?"), m.id)
+		return err
+	})
+}
+
+// Load
+func (r *retained) Load() ([]message.Provider, error) {
+	select {
+	case <-r.db.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	msg := []message.Provider{}
+
+	var name string
+	err := r.db.db.QueryRow(r.db.d.bind("SELECT name FROM markers WHERE name = ?"), markerRetained).Scan(&name)
+	if err == sql.ErrNoRows {
+		return msg, types.ErrNotFound
+	} else if err != nil {
+		return msg, err
+	}
+
+	rows, err := r.db.db.Query("SELECT data FROM retained ORDER BY id")
+	if err != nil {
+		return msg, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	for rows.Next() {
+		var buf []byte
+		if err = rows.Scan(&buf); err != nil {
+			return msg, err
+		}
+
+		var e message.Provider
+		if e, err = types.DecodeMessage(buf); err != nil {
+			return msg, err
+		}
+
+		msg = append(msg, e)
+	}
+
+	return msg, rows.Err()
+}
+
+// Store
+func (r *retained) Store(msg []message.Provider) error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	// single upsert statement cannot touch same row twice, last message of a topic wins
+	index := make(map[string]int)
+	args := make([]interface{}, 0, len(msg)*2)
+	for _, e := range msg {
+		m, ok := e.(*message.PublishMessage)
+		if !ok {
+			return types.ErrInvalidArgs
+		}
+
+		buf, err := types.EncodeMessage(m)
+		if err != nil {
+			return err
+		}
+
+		if i, ok := index[m.Topic()]; ok {
+			args[i+1] = buf
+			continue
+		}
+
+		index[m.Topic()] = len(args)
+		args = append(args, m.Topic(), buf)
+	}
+
+	d := r.db.d
+
+	return inTx(r.db.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(d.bind(d.insertIgnore("markers", "name", placeholders(1, 1))), markerRetained); err != nil {
+			return err
+		}
+
+		return batchExec(tx, len(args)/2, 2, args, func(values string) string {
+			return d.bind(d.upsert("retained", "topic, data", values, "topic", []string{"data"}))
+		})
+	})
+}
+
+// Put
+func (r *retained) Put(msg *message.PublishMessage) error {
+	return r.Store([]message.Provider{msg})
+}
+
+// Remove
+func (r *retained) Remove(topic string) error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	_, err := r.db.db.Exec(r.db.d.bind("DELETE FROM retained WHERE topic = ?"), topic)
+	return err
+}
+
+// Delete
+func (r *retained) Delete() error {
+	select {
+	case <-r.db.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return inTx(r.db.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(r.db.d.bind("DELETE FROM markers WHERE name = ?"), markerRetained)
+		if err != nil {
+			return err
+		}
+
+		var n int64
+		if n, err = res.RowsAffected(); err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return types.ErrNotFound
+		}
+
+		_, err = tx.Exec("DELETE FROM retained")
+		return err
+	})
+}
+
+// upgradeRetained assign topics to retained messages stored before they were keyed by topic
+// Message already stored under the same topic is newer thus legacy one is dropped
+func upgradeRetained(db *sql.DB, d *dialect) error {
+	rows, err := db.Query("SELECT id, data FROM retained WHERE topic IS NULL")
+	if err != nil {
+		return err
+	}
+
+	type legacy struct {
+		id  int64
+		msg message.Provider
+	}
+
+	var list []legacy
+	for rows.Next() {
+		var l legacy
+		var buf []byte
+		if err = rows.Scan(&l.id, &buf); err != nil {
+			rows.Close() // nolint: errcheck, gas
+			return err
+		}
+
+		if l.msg, err = types.DecodeMessage(buf); err != nil {
+			rows.Close() // nolint: errcheck, gas
+			return err
+		}
+
+		list = append(list, l)
+	}
+	rows.Close() // nolint: errcheck, gas
+
+	if err = rows.Err(); err != nil || len(list) == 0 {
+		return err
+	}
+
+	return inTx(db, func(tx *sql.Tx) error {
+		for _, l := range list {
+			if _, err := tx.Exec(d.bind("DELETE FROM retained WHERE id = ?"), l.id); err != nil {
+				return err
+			}
+
+			m, ok := l.msg.(*message.PublishMessage)
+			if !ok {
+				continue
+			}
+
+			buf, err := types.EncodeMessage(m)
+			if err != nil {
+				return err
+			}
+
+			if _, err = tx.Exec(d.bind(d.insertIgnore("retained", "topic, data", placeholders(1, 2))), m.Topic(), buf); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// batchExec insert rows in chunks of maxBatchRows
+// query builds statement for given values list
+func batchExec(tx *sql.Tx, rows, columns int, args []interface{}, query func(values string) string) error {
+	for start := 0; start < rows; start += maxBatchRows {
+		end := start + maxBatchRows
+		if end > rows {
+			end = rows
+		}
+
+		if _, err := tx.Exec(query(placeholders(end-start, columns)), args[start*columns:end*columns]...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+-- topics are keyed by their SHA-256 as InnoDB limits length of index keys
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id            VARCHAR(255) NOT NULL PRIMARY KEY,
+	created_at    BIGINT NOT NULL,
+	subs_stored   BOOLEAN NOT NULL DEFAULT FALSE,
+	msgs_stored   BOOLEAN NOT NULL DEFAULT FALSE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+	id            BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	session_id    VARCHAR(255) NOT NULL,
+	topic         TEXT NOT NULL,
+	topic_hash    BINARY(32) AS (UNHEX(SHA2(topic, 256))) STORED,
+	qos           SMALLINT NOT NULL,
+	UNIQUE INDEX subscriptions_topic_idx (session_id, topic_hash),
+	FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS messages (
+	id            BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	session_id    VARCHAR(255) NOT NULL,
+	direction     VARCHAR(3) NOT NULL,
+	data          LONGBLOB NOT NULL,
+	INDEX messages_session_idx (session_id, direction, id),
+	FOREIGN KEY (session_id) REFERENCES sessions (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS retained (
+	id            BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	topic         TEXT,
+	topic_hash    BINARY(32) AS (UNHEX(SHA2(topic, 256))) STORED,
+	data          LONGBLOB NOT NULL,
+	UNIQUE INDEX retained_topic_idx (topic_hash)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+CREATE TABLE IF NOT EXISTS markers (
+	name          VARCHAR(64) NOT NULL PRIMARY KEY
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin
@@ -0,0 +1,3 @@
+ALTER TABLE subscriptions
+	ADD COLUMN options SMALLINT NOT NULL DEFAULT 0,
+	ADD COLUMN sub_id BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS sessions (
+	id            TEXT PRIMARY KEY,
+	created_at    BIGINT NOT NULL,
+	subs_stored   BOOLEAN NOT NULL DEFAULT FALSE,
+	msgs_stored   BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+	session_id    TEXT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+	topic         TEXT NOT NULL,
+	qos           SMALLINT NOT NULL,
+	PRIMARY KEY (session_id, topic)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	id            BIGSERIAL PRIMARY KEY,
+	session_id    TEXT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+	direction     VARCHAR(3) NOT NULL,
+	data          BYTEA NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS messages_session_idx ON messages (session_id, direction, id);
+
+CREATE TABLE IF NOT EXISTS retained (
+	id            BIGSERIAL PRIMARY KEY,
+	data          BYTEA NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS markers (
+	name          VARCHAR(64) PRIMARY KEY
+);
@@ -0,0 +1,3 @@
+ALTER TABLE retained ADD COLUMN IF NOT EXISTS topic TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS retained_topic_idx ON retained (topic);
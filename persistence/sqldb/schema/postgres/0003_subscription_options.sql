@@ -0,0 +1,3 @@
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS options SMALLINT NOT NULL DEFAULT 0;
+
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS sub_id BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,615 @@
+// Package tenant tracks persisted state per tenant namespace and enforces quotas
+// Namespace is virtual host topic prefix which session IDs and retained topics of
+// tenant clients are mapped into
+package tenant
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+type counter struct {
+	messages int
+	bytes    int64
+}
+
+type impl struct {
+	inner    types.Provider
+	sessions types.Sessions
+	retained types.Retained
+
+	quotas map[string]types.TenantQuota
+
+	// prefixes namespaces sorted longest first
+	prefixes []string
+
+	lock   sync.Mutex
+	usage  map[string]*types.TenantUsage
+	stored map[string]*counter
+	topics map[string]int64
+
+	s sessions
+	r retained
+}
+
+type sessions struct {
+	p *impl
+}
+
+type session struct {
+	types.Session
+	p  *impl
+	id string
+}
+
+type messages struct {
+	types.Messages
+	p  *impl
+	id string
+}
+
+type retained struct {
+	p *impl
+}
+
+var _ types.Provider = (*impl)(nil)
+var _ types.Tenants = (*impl)(nil)
+var _ types.Sessions = (*sessions)(nil)
+var _ types.Session = (*session)(nil)
+var _ types.Messages = (*messages)(nil)
+var _ types.Retained = (*retained)(nil)
+
+func init() {
+	persistence.Register((*types.TenantConfig)(nil), func(config types.ProviderConfig) (types.Provider, error) { // nolint: errcheck, gas
+		cfg := config.(*types.TenantConfig)
+		if cfg.Provider == nil {
+			return nil, types.ErrInvalidArgs
+		}
+
+		inner, err := persistence.New(cfg.Provider)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := New(inner, cfg)
+		if err != nil {
+			inner.Shutdown() // nolint: errcheck, gas
+			return nil, err
+		}
+
+		return p, nil
+	})
+}
+
+// New wrap provider with per tenant accounting
+// Usage of state stored before is counted on start
+func New(inner types.Provider, config *types.TenantConfig) (types.Provider, error) {
+	s, err := inner.Sessions()
+	if err != nil {
+		return nil, err
+	}
+
+	var r types.Retained
+	if r, err = inner.Retained(); err != nil {
+		return nil, err
+	}
+
+	p := &impl{
+		inner:    inner,
+		sessions: s,
+		retained: r,
+		quotas:   make(map[string]types.TenantQuota),
+		usage:    make(map[string]*types.TenantUsage),
+		stored:   make(map[string]*counter),
+		topics:   make(map[string]int64),
+	}
+
+	for ns, q := range config.Tenants {
+		p.quotas[ns] = q
+		if ns != "" {
+			p.prefixes = append(p.prefixes, ns)
+		}
+	}
+
+	sort.Slice(p.prefixes, func(i, j int) bool {
+		return len(p.prefixes[i]) > len(p.prefixes[j])
+	})
+
+	p.s.p = p
+	p.r.p = p
+
+	if err = p.scan(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Sessions
+func (p *impl) Sessions() (types.Sessions, error) {
+	if _, err := p.inner.Sessions(); err != nil {
+		return nil, err
+	}
+
+	return &p.s, nil
+}
+
+// Retained
+func (p *impl) Retained() (types.Retained, error) {
+	if _, err := p.inner.Retained(); err != nil {
+		return nil, err
+	}
+
+	return &p.r, nil
+}
+
+// Health of underlying provider
+func (p *impl) Health() error {
+	return types.CheckHealth(p.inner)
+}
+
+// Snapshot of underlying provider
+func (p *impl) Snapshot(w io.Writer) error {
+	return types.TakeSnapshot(p.inner, w)
+}
+
+// Shutdown
+func (p *impl) Shutdown() error {
+	return p.inner.Shutdown()
+}
+
+// Usage of tenant
+func (p *impl) Usage(namespace string) types.TenantUsage {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if u, ok := p.usage[namespace]; ok {
+		return *u
+	}
+
+	return types.TenantUsage{}
+}
+
+// Wipe sessions and retained messages of tenant. State of other tenants is not touched
+func (p *impl) Wipe(namespace string) error {
+	var ids, topics []string
+
+	p.lock.Lock()
+	for id := range p.stored {
+		if p.tenant(id) == namespace {
+			ids = append(ids, id)
+		}
+	}
+
+	for t := range p.topics {
+		if p.tenant(t) == namespace {
+			topics = append(topics, t)
+		}
+	}
+	p.lock.Unlock()
+
+	for _, id := range ids {
+		if err := p.s.Delete(id); err != nil && err != types.ErrNotFound {
+			return err
+		}
+	}
+
+	for _, t := range topics {
+		if err := p.r.Remove(t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scan count state stored before
+func (p *impl) scan() error {
+	list, err := p.sessions.GetAll()
+	if err != nil && err != types.ErrNotFound {
+		return err
+	}
+
+	for _, ses := range list {
+		var id string
+		if id, err = ses.ID(); err != nil {
+			return err
+		}
+
+		var msg types.Messages
+		if msg, err = ses.Messages(); err != nil {
+			return err
+		}
+
+		var stored *types.SessionMessages
+		if stored, err = msg.Load(); err != nil && err != types.ErrNotFound {
+			return err
+		}
+
+		p.addSession(id)
+
+		if stored != nil {
+			count, bytes := size(stored.In.Messages)
+			c, b := size(stored.Out.Messages)
+			p.addMessages(id, count+c, bytes+b)
+		}
+	}
+
+	var msg []message.Provider
+	if msg, err = p.retained.Load(); err != nil && err != types.ErrNotFound {
+		return err
+	}
+
+	for _, m := range msg {
+		if pm, ok := m.(*message.PublishMessage); ok {
+			p.setRetained(pm.Topic(), msgSize(pm))
+		}
+	}
+
+	return nil
+}
+
+// tenant namespace of session ID or retained topic
+func (p *impl) tenant(key string) string {
+	for _, ns := range p.prefixes {
+		if strings.HasPrefix(key, ns) {
+			return ns
+		}
+	}
+
+	return ""
+}
+
+// tenantUsage of key. Must be called with lock held
+func (p *impl) tenantUsage(key string) (*types.TenantUsage, types.TenantQuota) {
+	ns := p.tenant(key)
+
+	u, ok := p.usage[ns]
+	if !ok {
+		u = &types.TenantUsage{}
+		p.usage[ns] = u
+	}
+
+	return u, p.quotas[ns]
+}
+
+// reserveSession account new session. Returns ErrQuotaExceeded if tenant is out of sessions
+func (p *impl) reserveSession(id string) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.stored[id]; ok {
+		return false, nil
+	}
+
+	u, q := p.tenantUsage(id)
+	if q.MaxSessions > 0 && u.Sessions >= q.MaxSessions {
+		return false, types.ErrQuotaExceeded
+	}
+
+	u.Sessions++
+	p.stored[id] = &counter{}
+
+	return true, nil
+}
+
+func (p *impl) addSession(id string) {
+	p.reserveSession(id) // nolint: errcheck, gas
+}
+
+// removeSession drop session and its messages from usage
+func (p *impl) removeSession(id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c, ok := p.stored[id]
+	if !ok {
+		return
+	}
+
+	u, _ := p.tenantUsage(id)
+	u.Sessions--
+	u.Messages -= c.messages
+	u.Bytes -= c.bytes
+
+	delete(p.stored, id)
+}
+
+// reserveMessages account messages of session. Returns ErrQuotaExceeded if they do not fit quota
+func (p *impl) reserveMessages(id string, count int, bytes int64) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	u, q := p.tenantUsage(id)
+	if (q.MaxMessages > 0 && u.Messages+count > q.MaxMessages) || (q.MaxBytes > 0 && u.Bytes+bytes > q.MaxBytes) {
+		return types.ErrQuotaExceeded
+	}
+
+	c, ok := p.stored[id]
+	if !ok {
+		c = &counter{}
+		p.stored[id] = c
+		u.Sessions++
+	}
+
+	c.messages += count
+	c.bytes += bytes
+	u.Messages += count
+	u.Bytes += bytes
+
+	return nil
+}
+
+func (p *impl) addMessages(id string, count int, bytes int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	u, _ := p.tenantUsage(id)
+
+	c, ok := p.stored[id]
+	if !ok {
+		c = &counter{}
+		p.stored[id] = c
+		u.Sessions++
+	}
+
+	c.messages += count
+	c.bytes += bytes
+	u.Messages += count
+	u.Bytes += bytes
+}
+
+// clearMessages drop messages of session from usage
+func (p *impl) clearMessages(id string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	c, ok := p.stored[id]
+	if !ok {
+		return
+	}
+
+	u, _ := p.tenantUsage(id)
+	u.Messages -= c.messages
+	u.Bytes -= c.bytes
+
+	c.messages = 0
+	c.bytes = 0
+}
+
+// reserveRetained account retained message replacing previous one of the topic
+func (p *impl) reserveRetained(topic string, bytes int64) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	u, q := p.tenantUsage(topic)
+
+	prev, ok := p.topics[topic]
+	if q.MaxBytes > 0 && bytes > prev && u.Bytes+bytes-prev > q.MaxBytes {
+		return types.ErrQuotaExceeded
+	}
+
+	if !ok {
+		u.Retained++
+	}
+
+	u.Bytes += bytes - prev
+	p.topics[topic] = bytes
+
+	return nil
+}
+
+func (p *impl) setRetained(topic string, bytes int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	u, _ := p.tenantUsage(topic)
+
+	prev, ok := p.topics[topic]
+	if !ok {
+		u.Retained++
+	}
+
+	u.Bytes += bytes - prev
+	p.topics[topic] = bytes
+}
+
+func (p *impl) removeRetained(topic string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	prev, ok := p.topics[topic]
+	if !ok {
+		return
+	}
+
+	u, _ := p.tenantUsage(topic)
+	u.Retained--
+	u.Bytes -= prev
+
+	delete(p.topics, topic)
+}
+
+func (s *sessions) New(id string) (types.Session, error) {
+	reserved, err := s.p.reserveSession(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var ses types.Session
+	if ses, err = s.p.sessions.New(id); err != nil {
+		if reserved && err != types.ErrAlreadyExists {
+			s.p.removeSession(id)
+		}
+
+		return nil, err
+	}
+
+	return &session{Session: ses, p: s.p, id: id}, nil
+}
+
+func (s *sessions) Get(id string) (types.Session, error) {
+	ses, err := s.p.sessions.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{Session: ses, p: s.p, id: id}, nil
+}
+
+func (s *sessions) GetAll() ([]types.Session, error) {
+	list, err := s.p.sessions.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]types.Session, 0, len(list))
+	for _, ses := range list {
+		var id string
+		if id, err = ses.ID(); err != nil {
+			return nil, err
+		}
+
+		res = append(res, &session{Session: ses, p: s.p, id: id})
+	}
+
+	return res, nil
+}
+
+func (s *sessions) Delete(id string) error {
+	if err := s.p.sessions.Delete(id); err != nil {
+		return err
+	}
+
+	s.p.removeSession(id)
+
+	return nil
+}
+
+func (s *session) Messages() (types.Messages, error) {
+	m, err := s.Session.Messages()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messages{Messages: m, p: s.p, id: s.id}, nil
+}
+
+// Store returns ErrQuotaExceeded if messages do not fit quota of tenant
+func (m *messages) Store(dir string, msg []message.Provider) error {
+	count, bytes := size(msg)
+
+	if err := m.p.reserveMessages(m.id, count, bytes); err != nil {
+		return err
+	}
+
+	if err := m.Messages.Store(dir, msg); err != nil {
+		m.p.addMessages(m.id, -count, -bytes)
+		return err
+	}
+
+	return nil
+}
+
+func (m *messages) Delete() error {
+	if err := m.Messages.Delete(); err != nil {
+		return err
+	}
+
+	m.p.clearMessages(m.id)
+
+	return nil
+}
+
+func (r *retained) Load() ([]message.Provider, error) {
+	return r.p.retained.Load()
+}
+
+// Store retained messages. Quota is not enforced as messages are stored as a whole
+func (r *retained) Store(msg []message.Provider) error {
+	if err := r.p.retained.Store(msg); err != nil {
+		return err
+	}
+
+	for _, m := range msg {
+		if pm, ok := m.(*message.PublishMessage); ok {
+			r.p.setRetained(pm.Topic(), msgSize(pm))
+		}
+	}
+
+	return nil
+}
+
+// Put returns ErrQuotaExceeded if message does not fit quota of tenant
+func (r *retained) Put(msg *message.PublishMessage) error {
+	r.p.lock.Lock()
+	prev, existed := r.p.topics[msg.Topic()]
+	r.p.lock.Unlock()
+
+	if err := r.p.reserveRetained(msg.Topic(), msgSize(msg)); err != nil {
+		return err
+	}
+
+	if err := r.p.retained.Put(msg); err != nil {
+		if existed {
+			r.p.setRetained(msg.Topic(), prev)
+		} else {
+			r.p.removeRetained(msg.Topic())
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (r *retained) Remove(topic string) error {
+	if err := r.p.retained.Remove(topic); err != nil {
+		return err
+	}
+
+	r.p.removeRetained(topic)
+
+	return nil
+}
+
+func (r *retained) Delete() error {
+	if err := r.p.retained.Delete(); err != nil {
+		return err
+	}
+
+	r.p.lock.Lock()
+	for t, bytes := range r.p.topics {
+		u, _ := r.p.tenantUsage(t)
+		u.Retained--
+		u.Bytes -= bytes
+	}
+	r.p.topics = make(map[string]int64)
+	r.p.lock.Unlock()
+
+	return nil
+}
+
+func size(msg []message.Provider) (int, int64) {
+	var bytes int64
+	for _, m := range msg {
+		bytes += msgSize(m)
+	}
+
+	return len(msg), bytes
+}
+
+func msgSize(m message.Provider) int64 {
+	sz, err := m.Size()
+	if err != nil {
+		return 0
+	}
+
+	return int64(sz)
+}
@@ -0,0 +1,126 @@
+package tenant
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/boltdb"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+func newPublish(t *testing.T, topic string) *message.PublishMessage {
+	m := message.NewPublishMessage()
+	require.NoError(t, m.SetTopic(topic))
+	require.NoError(t, m.SetQoS(message.QoS1))
+	m.SetPacketID(1)
+	m.SetPayload([]byte("data"))
+
+	return m
+}
+
+func open(t *testing.T, file string) types.Provider {
+	inner, err := boltdb.NewBoltDB(&types.BoltDBConfig{File: file})
+	require.NoError(t, err)
+
+	p, err := New(inner, &types.TenantConfig{
+		Tenants: map[string]types.TenantQuota{
+			"a/": {MaxSessions: 1, MaxMessages: 2},
+			"b/": {},
+		},
+	})
+	require.NoError(t, err)
+
+	return p
+}
+
+func store(t *testing.T, p types.Provider, id string, count int) error {
+	sessions, err := p.Sessions()
+	require.NoError(t, err)
+
+	ses, err := sessions.New(id)
+	if err == types.ErrAlreadyExists {
+		ses, err = sessions.Get(id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	msg, err := ses.Messages()
+	require.NoError(t, err)
+
+	list := make([]message.Provider, 0, count)
+	for i := 0; i < count; i++ {
+		list = append(list, newPublish(t, "t"))
+	}
+
+	return msg.Store("out", list)
+}
+
+func TestQuotaAndWipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq-tenant")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	file := filepath.Join(dir, "tenant.db")
+
+	p := open(t, file)
+
+	require.NoError(t, store(t, p, "a/c1", 2))
+	require.NoError(t, store(t, p, "b/c1", 3))
+	require.NoError(t, store(t, p, "c1", 1))
+
+	// out of sessions and messages
+	require.Equal(t, types.ErrQuotaExceeded, store(t, p, "a/c2", 0))
+	require.Equal(t, types.ErrQuotaExceeded, store(t, p, "a/c1", 1))
+
+	retained, err := p.Retained()
+	require.NoError(t, err)
+	require.NoError(t, retained.Put(newPublish(t, "a/r")))
+	require.NoError(t, retained.Put(newPublish(t, "b/r")))
+
+	tenants := p.(types.Tenants)
+
+	a := tenants.Usage("a/")
+	require.Equal(t, 1, a.Sessions)
+	require.Equal(t, 2, a.Messages)
+	require.Equal(t, 1, a.Retained)
+	require.NotZero(t, a.Bytes)
+
+	require.Equal(t, 3, tenants.Usage("b/").Messages)
+	require.Equal(t, 1, tenants.Usage("").Sessions)
+
+	// usage is restored on start
+	require.NoError(t, p.Shutdown())
+	p = open(t, file)
+	defer p.Shutdown() // nolint: errcheck
+
+	tenants = p.(types.Tenants)
+	require.Equal(t, a, tenants.Usage("a/"))
+
+	require.NoError(t, tenants.Wipe("a/"))
+	require.Equal(t, types.TenantUsage{}, tenants.Usage("a/"))
+	require.Equal(t, 3, tenants.Usage("b/").Messages)
+
+	sessions, err := p.Sessions()
+	require.NoError(t, err)
+
+	all, err := sessions.GetAll()
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+
+	retained, err = p.Retained()
+	require.NoError(t, err)
+
+	list, err := retained.Load()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, "b/r", list[0].(*message.PublishMessage).Topic())
+
+	// quota is free again
+	require.NoError(t, store(t, p, "a/c2", 2))
+}
@@ -0,0 +1,251 @@
+// Package transform wraps persistence provider converting payloads of stored messages
+// Used to implement encryption and compression transparently to backends
+package transform
+
+import (
+	"io"
+
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/dump"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+// Transformer converts payload of persisted PUBLISH messages
+// Topic is passed to allow binding payload to it
+type Transformer interface {
+	Encode(topic string, payload []byte) ([]byte, error)
+	Decode(topic string, payload []byte) ([]byte, error)
+}
+
+type impl struct {
+	inner types.Provider
+	t     Transformer
+}
+
+type sessions struct {
+	types.Sessions
+	t Transformer
+}
+
+type session struct {
+	types.Session
+	t Transformer
+}
+
+type messages struct {
+	types.Messages
+	t Transformer
+}
+
+type retained struct {
+	types.Retained
+	t Transformer
+}
+
+var _ types.Provider = (*impl)(nil)
+
+// New wrap provider with transformer
+func New(inner types.Provider, t Transformer) types.Provider {
+	return &impl{
+		inner: inner,
+		t:     t,
+	}
+}
+
+// Sessions
+func (p *impl) Sessions() (types.Sessions, error) {
+	s, err := p.inner.Sessions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessions{Sessions: s, t: p.t}, nil
+}
+
+// Retained
+func (p *impl) Retained() (types.Retained, error) {
+	r, err := p.inner.Retained()
+	if err != nil {
+		return nil, err
+	}
+
+	return &retained{Retained: r, t: p.t}, nil
+}
+
+// Health of underlying provider
+func (p *impl) Health() error {
+	return types.CheckHealth(p.inner)
+}
+
+// Snapshot of underlying provider. Backends without native snapshot are dumped
+// here rather than above thus payloads stay transformed, e.g. encrypted
+func (p *impl) Snapshot(w io.Writer) error {
+	err := types.TakeSnapshot(p.inner, w)
+	if err != types.ErrNotSupported {
+		return err
+	}
+
+	var d *dump.Dump
+	if d, err = dump.Export(p.inner); err != nil {
+		return err
+	}
+
+	return d.Encode(w, dump.FormatCBOR)
+}
+
+// Shutdown
+func (p *impl) Shutdown() error {
+	return p.inner.Shutdown()
+}
+
+func (s *sessions) New(id string) (types.Session, error) {
+	ses, err := s.Sessions.New(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{Session: ses, t: s.t}, nil
+}
+
+func (s *sessions) Get(id string) (types.Session, error) {
+	ses, err := s.Sessions.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{Session: ses, t: s.t}, nil
+}
+
+func (s *sessions) GetAll() ([]types.Session, error) {
+	list, err := s.Sessions.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]types.Session, 0, len(list))
+	for _, ses := range list {
+		res = append(res, &session{Session: ses, t: s.t})
+	}
+
+	return res, nil
+}
+
+func (s *session) Messages() (types.Messages, error) {
+	m, err := s.Session.Messages()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messages{Messages: m, t: s.t}, nil
+}
+
+func (m *messages) Store(dir string, msg []message.Provider) error {
+	list, err := encode(m.t, msg)
+	if err != nil {
+		return err
+	}
+
+	return m.Messages.Store(dir, list)
+}
+
+func (m *messages) Load() (*types.SessionMessages, error) {
+	res, err := m.Messages.Load()
+	if err != nil {
+		return res, err
+	}
+
+	if res.In.Messages, err = decode(m.t, res.In.Messages); err != nil {
+		return nil, err
+	}
+
+	if res.Out.Messages, err = decode(m.t, res.Out.Messages); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (r *retained) Load() ([]message.Provider, error) {
+	msg, err := r.Retained.Load()
+	if err != nil {
+		return msg, err
+	}
+
+	return decode(r.t, msg)
+}
+
+func (r *retained) Store(msg []message.Provider) error {
+	list, err := encode(r.t, msg)
+	if err != nil {
+		return err
+	}
+
+	return r.Retained.Store(list)
+}
+
+func (r *retained) Put(msg *message.PublishMessage) error {
+	m, err := transform(msg, r.t.Encode)
+	if err != nil {
+		return err
+	}
+
+	return r.Retained.Put(m)
+}
+
+func encode(t Transformer, msg []message.Provider) ([]message.Provider, error) {
+	res := make([]message.Provider, 0, len(msg))
+
+	for _, e := range msg {
+		if m, ok := e.(*message.PublishMessage); ok {
+			var err error
+			if e, err = transform(m, t.Encode); err != nil {
+				return nil, err
+			}
+		}
+
+		res = append(res, e)
+	}
+
+	return res, nil
+}
+
+func decode(t Transformer, msg []message.Provider) ([]message.Provider, error) {
+	for _, e := range msg {
+		if m, ok := e.(*message.PublishMessage); ok {
+			payload, err := t.Decode(m.Topic(), m.Payload())
+			if err != nil {
+				return nil, err
+			}
+
+			// loaded messages are owned by caller, modify in place
+			m.SetPayload(payload)
+		}
+	}
+
+	return msg, nil
+}
+
+// transform copy of message with converted payload. Messages being stored are still in use by
+// sessions thus cannot be modified
+func transform(msg *message.PublishMessage, fn func(string, []byte) ([]byte, error)) (*message.PublishMessage, error) {
+	payload, err := fn(msg.Topic(), msg.Payload())
+	if err != nil {
+		return nil, err
+	}
+
+	m := message.NewPublishMessage()
+	m.SetPacketID(msg.PacketID())
+	m.SetRetain(msg.Retain())
+	m.SetDup(msg.Dup())
+	m.SetPayload(payload)
+
+	if err = m.SetQoS(msg.QoS()); err != nil {
+		return nil, err
+	}
+
+	if err = m.SetTopic(msg.Topic()); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,100 @@
+package transform
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/badger"
+	"github.com/troian/surgemq/persistence/dump"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+// prefix transformer marking payloads it has encoded
+type prefix struct{}
+
+func (prefix) Encode(topic string, payload []byte) ([]byte, error) {
+	return append([]byte("x:"), payload...), nil
+}
+
+func (prefix) Decode(topic string, payload []byte) ([]byte, error) {
+	return bytes.TrimPrefix(payload, []byte("x:")), nil
+}
+
+// plain provider hiding health and snapshot abilities of inner one
+type plain struct {
+	types.Provider
+}
+
+// sick provider reporting given health
+type sick struct {
+	types.Provider
+	err error
+}
+
+func (p *sick) Health() error { return p.err }
+
+// native provider with snapshot of its own
+type native struct {
+	types.Provider
+}
+
+func (p *native) Snapshot(w io.Writer) error {
+	_, err := w.Write([]byte("native"))
+	return err
+}
+
+func newBadger(t *testing.T) types.Provider {
+	p, err := badger.NewBadger(&types.BadgerConfig{InMemory: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Shutdown() }) // nolint: errcheck
+
+	return p
+}
+
+func TestHealth(t *testing.T) {
+	inner := newBadger(t)
+
+	require.NoError(t, types.CheckHealth(New(&plain{inner}, prefix{})))
+	require.NoError(t, types.CheckHealth(New(inner, prefix{})))
+
+	errSick := errors.New("sick")
+	require.Equal(t, errSick, types.CheckHealth(New(&sick{Provider: inner, err: errSick}, prefix{})))
+}
+
+func TestSnapshot(t *testing.T) {
+	inner := newBadger(t)
+	p := New(&plain{inner}, prefix{})
+
+	r, err := p.Retained()
+	require.NoError(t, err)
+
+	m := message.NewPublishMessage()
+	require.NoError(t, m.SetTopic("a/b"))
+	m.SetPayload([]byte("on"))
+	require.NoError(t, r.Put(m))
+
+	// native snapshot of inner provider is passed through
+	var buf bytes.Buffer
+	require.NoError(t, types.TakeSnapshot(New(&native{inner}, prefix{}), &buf))
+	require.Equal(t, "native", buf.String())
+
+	// others are dumped with payloads as stored
+	buf.Reset()
+	require.NoError(t, types.TakeSnapshot(p, &buf))
+
+	d, err := dump.Decode(&buf, dump.FormatCBOR)
+	require.NoError(t, err)
+	require.Len(t, d.Retained, 1)
+	require.Equal(t, "a/b", d.Retained[0].Topic)
+	require.Equal(t, "x:on", string(d.Retained[0].Payload))
+
+	// while read through provider they are decoded
+	msgs, err := r.Load()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "on", string(msgs[0].(*message.PublishMessage).Payload()))
+}
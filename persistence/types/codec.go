@@ -0,0 +1,103 @@
+package types
+
+import (
+	"encoding/binary"
+
+	"github.com/troian/surgemq/message"
+)
+
+// Layout of encoded message
+//
+//	type(1) packetID(2) [qos(1) flags(1) topicLen(2) topic payload]
+//
+// fields in brackets present for PUBLISH only
+const (
+	codecFlagRetain = 0x01
+	codecFlagDup    = 0x02
+)
+
+// EncodeMessage serialize message into compact record
+// Used by backends storing messages as opaque values
+func EncodeMessage(msg message.Provider) ([]byte, error) {
+	buf := make([]byte, 3)
+	buf[0] = byte(msg.Type())
+	binary.BigEndian.PutUint16(buf[1:], msg.PacketID())
+
+	if m, ok := msg.(*message.PublishMessage); ok {
+		var flags byte
+		if m.Retain() {
+			flags |= codecFlagRetain
+		}
+
+		if m.Dup() {
+			flags |= codecFlagDup
+		}
+
+		topic := m.Topic()
+		if len(topic) > 0xFFFF {
+			return nil, ErrInvalidArgs
+		}
+
+		hdr := make([]byte, 4)
+		hdr[0] = byte(m.QoS())
+		hdr[1] = flags
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(topic)))
+
+		buf = append(buf, hdr...)
+		buf = append(buf, topic...)
+		buf = append(buf, m.Payload()...)
+	}
+
+	return buf, nil
+}
+
+// DecodeMessage restore message encoded by EncodeMessage
+func DecodeMessage(buf []byte) (message.Provider, error) {
+	if len(buf) < 3 {
+		return nil, ErrInvalidArgs
+	}
+
+	msg, err := message.Type(buf[0]).NewMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	id := binary.BigEndian.Uint16(buf[1:])
+
+	switch m := msg.(type) {
+	case *message.PublishMessage:
+		if len(buf) < 7 {
+			return nil, ErrInvalidArgs
+		}
+
+		m.SetPacketID(id)
+
+		if err = m.SetQoS(message.QosType(buf[3])); err != nil {
+			return nil, err
+		}
+
+		m.SetRetain(buf[4]&codecFlagRetain != 0)
+		m.SetDup(buf[4]&codecFlagDup != 0)
+
+		topicLen := int(binary.BigEndian.Uint16(buf[5:]))
+		if len(buf) < 7+topicLen {
+			return nil, ErrInvalidArgs
+		}
+
+		if err = m.SetTopic(string(buf[7 : 7+topicLen])); err != nil {
+			return nil, err
+		}
+
+		if payload := buf[7+topicLen:]; len(payload) > 0 {
+			p := make([]byte, len(payload))
+			copy(p, payload)
+			m.SetPayload(p)
+		}
+	case *message.PubRelMessage:
+		m.SetPacketID(id)
+	case *message.PubRecMessage:
+		m.SetPacketID(id)
+	}
+
+	return msg, nil
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"errors"
+	"io"
 
 	"github.com/troian/surgemq/message"
 )
@@ -21,6 +22,15 @@ var (
 
 	// ErrNotOpen storage is not open
 	ErrNotOpen = errors.New("not open")
+
+	// ErrNotSupported operation is not supported by provider
+	ErrNotSupported = errors.New("not supported")
+
+	// ErrQuotaExceeded tenant has reached limit of persisted state
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrExpired message removed by garbage collection before delivery
+	ErrExpired = errors.New("expired")
 )
 
 // Retained provider for load/store retained messages
@@ -28,12 +38,18 @@ type Retained interface {
 	Load() ([]message.Provider, error)
 	Store([]message.Provider) error
 	Delete() error
+
+	// Put store retained message replacing previous one of the same topic
+	Put(msg *message.PublishMessage) error
+
+	// Remove retained message of the topic if any
+	Remove(topic string) error
 }
 
 // Subscriptions interface within session
 type Subscriptions interface {
-	Add(s message.TopicsQoS) error
-	Get() (message.TopicsQoS, error)
+	Add(s message.Subscriptions) error
+	Get() (message.Subscriptions, error)
 	Delete() error
 }
 
@@ -76,5 +92,70 @@ type Provider interface {
 	Shutdown() error
 }
 
+// HealthChecker implemented by providers able to report reachability of backend
+type HealthChecker interface {
+	// Health returns nil if backend is reachable
+	Health() error
+}
+
+// CheckHealth of provider. Providers not implementing HealthChecker are considered healthy
+func CheckHealth(p Provider) error {
+	if hc, ok := p.(HealthChecker); ok {
+		return hc.Health()
+	}
+
+	return nil
+}
+
+// Snapshotter implemented by providers able to copy whole store consistently
+// while it is in use
+type Snapshotter interface {
+	// Snapshot write copy of store in backend native format
+	// ErrNotSupported is returned before anything written if backend has no such ability
+	Snapshot(w io.Writer) error
+}
+
+// TakeSnapshot of provider. Returns ErrNotSupported if provider is not Snapshotter
+func TakeSnapshot(p Provider, w io.Writer) error {
+	if s, ok := p.(Snapshotter); ok {
+		return s.Snapshot(w)
+	}
+
+	return ErrNotSupported
+}
+
+// TenantUsage persisted state of tenant
+type TenantUsage struct {
+	Sessions int
+	Messages int
+	Retained int
+
+	// Bytes encoded size of stored session and retained messages
+	Bytes int64
+}
+
+// Tenants implemented by providers tracking persisted state per tenant
+type Tenants interface {
+	// Usage of tenant with given namespace
+	Usage(namespace string) TenantUsage
+
+	// Wipe all persisted sessions and retained messages of tenant
+	Wipe(namespace string) error
+}
+
+// GCStat receives statistic of garbage collection
+type GCStat interface {
+	Collected(sessions, messages, retained, bytes uint64)
+}
+
+// KeyProvider supplies keys for encryption of persisted data
+type KeyProvider interface {
+	// Key used to encrypt new data along with its id
+	Key() (id string, key []byte, err error)
+
+	// KeyByID key data has been encrypted with
+	KeyByID(id string) ([]byte, error)
+}
+
 // ProviderConfig interface implemented by every backend
 type ProviderConfig interface{}
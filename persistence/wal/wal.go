@@ -0,0 +1,413 @@
+// Package wal append-only log of in-flight QoS 1/2 messages
+// Log is replayed after crash to restore ack queues of sessions
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+// Record layout
+//
+//	length(4) crc32(4) op(1) dir(1) sessionLen(2) session packetID(2) [message]
+//
+// message is present for put only and encoded by types.EncodeMessage
+const (
+	opPut   byte = 1
+	opAck   byte = 2
+	opClear byte = 3
+
+	dirIn  byte = 0
+	dirOut byte = 1
+
+	recordHeader = 8
+	bodyHeader   = 6
+)
+
+// DefaultCompactSize log is rewritten with live entries only once it grows above
+const DefaultCompactSize = 64 * 1024 * 1024
+
+var (
+	// ErrClosed log has been closed
+	ErrClosed = errors.New("wal: closed")
+
+	// ErrInvalidDirection direction is neither in nor out
+	ErrInvalidDirection = errors.New("wal: invalid direction")
+)
+
+// Config of write-ahead log
+type Config struct {
+	// Path of log file
+	Path string
+
+	// Sync fsync after every record. Without it records survive process crash but not power loss
+	Sync bool
+
+	// CompactSize size of file triggering compaction. If not set DefaultCompactSize used
+	CompactSize int64
+}
+
+type entry struct {
+	seq uint64
+	msg message.Provider
+}
+
+type sessionState struct {
+	dirs [2]map[uint16]entry
+}
+
+// Log write-ahead log of in-flight messages
+type Log struct {
+	config Config
+
+	lock  sync.Mutex
+	f     *os.File
+	size  int64
+	seq   uint64
+	state map[string]*sessionState
+}
+
+// Open log and replay existing records
+// Torn record at the end of file left by crash is discarded
+func Open(config Config) (*Log, error) {
+	if config.CompactSize <= 0 {
+		config.CompactSize = DefaultCompactSize
+	}
+
+	l := &Log{
+		config: config,
+		state:  make(map[string]*sessionState),
+	}
+
+	f, err := os.OpenFile(config.Path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	valid, err := l.replay(f)
+	if err != nil {
+		f.Close() // nolint: errcheck, gas
+		return nil, err
+	}
+
+	if err = f.Truncate(valid); err != nil {
+		f.Close() // nolint: errcheck, gas
+		return nil, err
+	}
+
+	if _, err = f.Seek(valid, io.SeekStart); err != nil {
+		f.Close() // nolint: errcheck, gas
+		return nil, err
+	}
+
+	l.f = f
+	l.size = valid
+
+	return l, nil
+}
+
+// Put record message sent or received but not yet acknowledged
+// Message with same packet ID in the same direction is replaced
+func (l *Log) Put(session, dir string, msg message.Provider) error {
+	d, err := direction(dir)
+	if err != nil {
+		return err
+	}
+
+	buf, err := types.EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err = l.write(opPut, d, session, msg.PacketID(), buf); err != nil {
+		return err
+	}
+
+	l.apply(opPut, d, session, msg.PacketID(), msg)
+
+	return l.compactIfNeeded()
+}
+
+// Ack record exchange of given packet ID has been completed
+func (l *Log) Ack(session, dir string, id uint16) error {
+	d, err := direction(dir)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err = l.write(opAck, d, session, id, nil); err != nil {
+		return err
+	}
+
+	l.apply(opAck, d, session, id, nil)
+
+	return l.compactIfNeeded()
+}
+
+// Clear forget all in-flight messages of the session
+// Invoked once messages have been moved into persistent storage or session is gone
+func (l *Log) Clear(session string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.state[session]; !ok {
+		return nil
+	}
+
+	if err := l.write(opClear, 0, session, 0, nil); err != nil {
+		return err
+	}
+
+	l.apply(opClear, 0, session, 0, nil)
+
+	return l.compactIfNeeded()
+}
+
+// Sessions in-flight messages of every session in order they have been put
+func (l *Log) Sessions() map[string]*types.SessionMessages {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	res := make(map[string]*types.SessionMessages)
+
+	for id, st := range l.state {
+		msg := &types.SessionMessages{}
+		msg.In.Messages = sorted(st.dirs[dirIn])
+		msg.Out.Messages = sorted(st.dirs[dirOut])
+		res[id] = msg
+	}
+
+	return res
+}
+
+// Close log
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.f == nil {
+		return ErrClosed
+	}
+
+	err := l.f.Close()
+	l.f = nil
+
+	return err
+}
+
+func direction(dir string) (byte, error) {
+	switch dir {
+	case "in":
+		return dirIn, nil
+	case "out":
+		return dirOut, nil
+	default:
+		return 0, ErrInvalidDirection
+	}
+}
+
+func sorted(entries map[uint16]entry) []message.Provider {
+	list := make([]entry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].seq < list[j].seq
+	})
+
+	res := make([]message.Provider, 0, len(list))
+	for _, e := range list {
+		res = append(res, e.msg)
+	}
+
+	return res
+}
+
+func (l *Log) apply(op, dir byte, session string, id uint16, msg message.Provider) {
+	st, ok := l.state[session]
+
+	switch op {
+	case opPut:
+		if !ok {
+			st = &sessionState{}
+			l.state[session] = st
+		}
+
+		if st.dirs[dir] == nil {
+			st.dirs[dir] = make(map[uint16]entry)
+		}
+
+		l.seq++
+		st.dirs[dir][id] = entry{seq: l.seq, msg: msg}
+	case opAck:
+		if ok {
+			delete(st.dirs[dir], id)
+			if len(st.dirs[dirIn]) == 0 && len(st.dirs[dirOut]) == 0 {
+				delete(l.state, session)
+			}
+		}
+	case opClear:
+		delete(l.state, session)
+	}
+}
+
+func encodeRecord(op, dir byte, session string, id uint16, msg []byte) []byte {
+	bodyLen := bodyHeader + len(session) + len(msg)
+
+	buf := make([]byte, recordHeader+bodyLen)
+	body := buf[recordHeader:]
+
+	body[0] = op
+	body[1] = dir
+	binary.BigEndian.PutUint16(body[2:], uint16(len(session)))
+	copy(body[4:], session)
+	binary.BigEndian.PutUint16(body[4+len(session):], id)
+	copy(body[bodyHeader+len(session):], msg)
+
+	binary.BigEndian.PutUint32(buf, uint32(bodyLen))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(body))
+
+	return buf
+}
+
+func (l *Log) write(op, dir byte, session string, id uint16, msg []byte) error {
+	if l.f == nil {
+		return ErrClosed
+	}
+
+	buf := encodeRecord(op, dir, session, id, msg)
+
+	if _, err := l.f.Write(buf); err != nil {
+		return err
+	}
+
+	l.size += int64(len(buf))
+
+	if l.config.Sync {
+		return l.f.Sync()
+	}
+
+	return nil
+}
+
+// replay read records and rebuild state. Returns offset of the end of last valid record
+func (l *Log) replay(f *os.File) (int64, error) {
+	r := bufio.NewReader(f)
+
+	var offset int64
+	hdr := make([]byte, recordHeader)
+
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			// EOF or torn header
+			return offset, nil
+		}
+
+		bodyLen := binary.BigEndian.Uint32(hdr)
+		if bodyLen < bodyHeader || bodyLen > uint32(l.config.CompactSize) {
+			return offset, nil
+		}
+
+		body := make([]byte, bodyLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return offset, nil
+		}
+
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(hdr[4:]) {
+			return offset, nil
+		}
+
+		op := body[0]
+		dir := body[1]
+		sLen := int(binary.BigEndian.Uint16(body[2:]))
+		if bodyHeader+sLen > len(body) || dir > dirOut {
+			return offset, nil
+		}
+
+		session := string(body[4 : 4+sLen])
+		id := binary.BigEndian.Uint16(body[4+sLen:])
+
+		var msg message.Provider
+		if op == opPut {
+			var err error
+			if msg, err = types.DecodeMessage(body[bodyHeader+sLen:]); err != nil {
+				return offset, nil
+			}
+		}
+
+		l.apply(op, dir, session, id, msg)
+
+		offset += int64(recordHeader) + int64(bodyLen)
+	}
+}
+
+// compactIfNeeded rewrite log with live entries only once it has grown above limit
+func (l *Log) compactIfNeeded() error {
+	if l.size < l.config.CompactSize {
+		return nil
+	}
+
+	tmpPath := l.config.Path + ".compact"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+
+	for id, st := range l.state {
+		for d := dirIn; d <= dirOut; d++ {
+			for _, m := range sorted(st.dirs[d]) {
+				var buf []byte
+				if buf, err = types.EncodeMessage(m); err != nil {
+					break
+				}
+
+				rec := encodeRecord(opPut, d, id, m.PacketID(), buf)
+				if _, err = tmp.Write(rec); err != nil {
+					break
+				}
+
+				size += int64(len(rec))
+			}
+		}
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if err != nil {
+		tmp.Close()        // nolint: errcheck, gas
+		os.Remove(tmpPath) // nolint: errcheck, gas
+		return err
+	}
+
+	if err = os.Rename(tmpPath, l.config.Path); err != nil {
+		tmp.Close() // nolint: errcheck, gas
+		return err
+	}
+
+	l.f.Close() // nolint: errcheck, gas
+	l.f = tmp
+	l.size = size
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+)
+
+func newPublish(t *testing.T, id uint16, topic string) *message.PublishMessage {
+	m := message.NewPublishMessage()
+	require.NoError(t, m.SetQoS(message.QoS1))
+	require.NoError(t, m.SetTopic(topic))
+	m.SetPacketID(id)
+	m.SetPayload([]byte("payload"))
+
+	return m
+}
+
+func tempLog(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "wal")
+	require.NoError(t, err)
+
+	return filepath.Join(dir, "inflight.wal"), func() {
+		os.RemoveAll(dir) // nolint: errcheck
+	}
+}
+
+func TestReplay(t *testing.T) {
+	path, cleanup := tempLog(t)
+	defer cleanup()
+
+	l, err := Open(Config{Path: path})
+	require.NoError(t, err)
+
+	require.NoError(t, l.Put("c1", "out", newPublish(t, 1, "a")))
+	require.NoError(t, l.Put("c1", "out", newPublish(t, 2, "b")))
+	require.NoError(t, l.Put("c1", "in", newPublish(t, 7, "c")))
+	require.NoError(t, l.Put("c2", "out", newPublish(t, 1, "d")))
+	require.NoError(t, l.Ack("c1", "out", 1))
+	require.NoError(t, l.Clear("c2"))
+	require.NoError(t, l.Close())
+
+	l, err = Open(Config{Path: path})
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+
+	sessions := l.Sessions()
+	require.Len(t, sessions, 1)
+	require.Contains(t, sessions, "c1")
+
+	require.Len(t, sessions["c1"].Out.Messages, 1)
+	require.Equal(t, uint16(2), sessions["c1"].Out.Messages[0].PacketID())
+	require.Equal(t, "b", sessions["c1"].Out.Messages[0].(*message.PublishMessage).Topic())
+
+	require.Len(t, sessions["c1"].In.Messages, 1)
+	require.Equal(t, uint16(7), sessions["c1"].In.Messages[0].PacketID())
+}
+
+func TestTornRecord(t *testing.T) {
+	path, cleanup := tempLog(t)
+	defer cleanup()
+
+	l, err := Open(Config{Path: path})
+	require.NoError(t, err)
+	require.NoError(t, l.Put("c1", "out", newPublish(t, 1, "a")))
+	require.NoError(t, l.Put("c1", "out", newPublish(t, 2, "b")))
+	require.NoError(t, l.Close())
+
+	st, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, st.Size()-3))
+
+	l, err = Open(Config{Path: path})
+	require.NoError(t, err)
+
+	sessions := l.Sessions()
+	require.Len(t, sessions["c1"].Out.Messages, 1)
+	require.Equal(t, uint16(1), sessions["c1"].Out.Messages[0].PacketID())
+
+	// torn tail truncated and log remains appendable
+	require.NoError(t, l.Put("c1", "out", newPublish(t, 3, "c")))
+	require.NoError(t, l.Close())
+
+	l, err = Open(Config{Path: path})
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+
+	require.Len(t, l.Sessions()["c1"].Out.Messages, 2)
+}
+
+func TestCompact(t *testing.T) {
+	path, cleanup := tempLog(t)
+	defer cleanup()
+
+	l, err := Open(Config{Path: path, CompactSize: 512})
+	require.NoError(t, err)
+
+	for i := 1; i <= 100; i++ {
+		require.NoError(t, l.Put("c1", "out", newPublish(t, uint16(i), "topic")))
+		require.NoError(t, l.Ack("c1", "out", uint16(i)))
+	}
+
+	require.NoError(t, l.Put("c1", "out", newPublish(t, 101, "last")))
+	require.NoError(t, l.Close())
+
+	st, err := os.Stat(path)
+	require.NoError(t, err)
+	require.True(t, st.Size() < 512)
+
+	l, err = Open(Config{Path: path, CompactSize: 512})
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+
+	sessions := l.Sessions()
+	require.Len(t, sessions["c1"].Out.Messages, 1)
+	require.Equal(t, uint16(101), sessions["c1"].Out.Messages[0].PacketID())
+}
+
+func TestInvalidDirection(t *testing.T) {
+	path, cleanup := tempLog(t)
+	defer cleanup()
+
+	l, err := Open(Config{Path: path})
+	require.NoError(t, err)
+	defer l.Close() // nolint: errcheck
+
+	require.Equal(t, ErrInvalidDirection, l.Put("c1", "x", newPublish(t, 1, "a")))
+	require.Equal(t, ErrInvalidDirection, l.Ack("c1", "x", 1))
+}
@@ -0,0 +1,455 @@
+// Package writebehind buffers session messages in memory and stores them into
+// underlying backend in batches
+package writebehind
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence"
+	"github.com/troian/surgemq/persistence/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxBatch      = 1000
+	defaultFlushInterval = 100 * time.Millisecond
+)
+
+type pendingKey struct {
+	id  string
+	dir string
+}
+
+type impl struct {
+	inner    types.Provider
+	sessions types.Sessions
+
+	maxBatch int
+	interval time.Duration
+	sync     bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// lock protects pending messages
+	lock    sync.Mutex
+	pending map[pendingKey][]message.Provider
+	order   []pendingKey
+	count   int
+
+	// flushLock serialize flushes thus messages of a session hit backend in order
+	flushLock sync.Mutex
+
+	s sessions
+
+	log struct {
+		prod *zap.Logger
+		dev  *zap.Logger
+	}
+}
+
+type sessions struct {
+	p *impl
+}
+
+type session struct {
+	types.Session
+	p *impl
+}
+
+type messages struct {
+	types.Messages
+	p  *impl
+	id string
+}
+
+var _ types.Provider = (*impl)(nil)
+var _ types.Sessions = (*sessions)(nil)
+var _ types.Session = (*session)(nil)
+var _ types.Messages = (*messages)(nil)
+
+func init() {
+	persistence.Register((*types.WriteBehindConfig)(nil), func(config types.ProviderConfig) (types.Provider, error) { // nolint: errcheck, gas
+		cfg := config.(*types.WriteBehindConfig)
+		if cfg.Provider == nil {
+			return nil, types.ErrInvalidArgs
+		}
+
+		if _, ok := cfg.Provider.(*types.WriteBehindConfig); ok {
+			return nil, types.ErrInvalidArgs
+		}
+
+		inner, err := persistence.New(cfg.Provider)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := NewWriteBehind(inner, cfg)
+		if err != nil {
+			inner.Shutdown() // nolint: errcheck, gas
+			return nil, err
+		}
+
+		return p, nil
+	})
+}
+
+// NewWriteBehind wrap provider with write-behind buffer of session messages
+func NewWriteBehind(inner types.Provider, config *types.WriteBehindConfig) (types.Provider, error) {
+	s, err := inner.Sessions()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &impl{
+		inner:    inner,
+		sessions: s,
+		maxBatch: config.MaxBatch,
+		interval: config.FlushInterval,
+		sync:     config.Sync,
+		done:     make(chan struct{}),
+		pending:  make(map[pendingKey][]message.Provider),
+	}
+
+	if p.maxBatch <= 0 {
+		p.maxBatch = defaultMaxBatch
+	}
+
+	if p.interval <= 0 {
+		p.interval = defaultFlushInterval
+	}
+
+	p.s.p = p
+
+	p.log.prod = surgemq.GetProdLogger().Named("persistence.writebehind")
+	p.log.dev = surgemq.GetDevLogger().Named("persistence.writebehind")
+
+	if !p.sync {
+		p.wg.Add(1)
+		go p.flushWorker()
+	}
+
+	return p, nil
+}
+
+// Sessions
+func (p *impl) Sessions() (types.Sessions, error) {
+	select {
+	case <-p.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return &p.s, nil
+}
+
+// Retained are not buffered
+func (p *impl) Retained() (types.Retained, error) {
+	select {
+	case <-p.done:
+		return nil, types.ErrNotOpen
+	default:
+	}
+
+	return p.inner.Retained()
+}
+
+// Health of underlying provider
+func (p *impl) Health() error {
+	select {
+	case <-p.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	return types.CheckHealth(p.inner)
+}
+
+// Snapshot flush pending messages and snapshot underlying provider
+func (p *impl) Snapshot(w io.Writer) error {
+	select {
+	case <-p.done:
+		return types.ErrNotOpen
+	default:
+	}
+
+	if err := p.flush(""); err != nil {
+		return err
+	}
+
+	return types.TakeSnapshot(p.inner, w)
+}
+
+// Shutdown flush pending messages and shutdown underlying provider
+func (p *impl) Shutdown() error {
+	p.lock.Lock()
+	select {
+	case <-p.done:
+		p.lock.Unlock()
+		return types.ErrNotOpen
+	default:
+	}
+
+	close(p.done)
+	p.lock.Unlock()
+
+	p.wg.Wait()
+
+	// messages failed to flush are lost, caller is told about it
+	flushErr := p.flush("")
+
+	if err := p.inner.Shutdown(); err != nil {
+		return err
+	}
+
+	return flushErr
+}
+
+func (p *impl) flushWorker() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.flush("")
+		}
+	}
+}
+
+// enqueue message for later store. Flushes in caller context once batch is full
+// thus producers are slowed down when backend does not keep up
+func (p *impl) enqueue(id, dir string, msg []message.Provider) error {
+	p.lock.Lock()
+
+	select {
+	case <-p.done:
+		p.lock.Unlock()
+		return types.ErrNotOpen
+	default:
+	}
+
+	key := pendingKey{id: id, dir: dir}
+	if _, ok := p.pending[key]; !ok {
+		p.order = append(p.order, key)
+	}
+
+	p.pending[key] = append(p.pending[key], msg...)
+	p.count += len(msg)
+	full := p.count >= p.maxBatch
+
+	p.lock.Unlock()
+
+	if full {
+		p.flush("")
+	}
+
+	return nil
+}
+
+// take pending messages of given session or all of them if id is empty
+func (p *impl) take(id string) ([]pendingKey, map[pendingKey][]message.Provider) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if id == "" {
+		order, pending := p.order, p.pending
+		p.order = nil
+		p.pending = make(map[pendingKey][]message.Provider)
+		p.count = 0
+
+		return order, pending
+	}
+
+	var order []pendingKey
+	pending := make(map[pendingKey][]message.Provider)
+
+	rest := p.order[:0]
+	for _, key := range p.order {
+		if key.id == id {
+			order = append(order, key)
+			pending[key] = p.pending[key]
+			p.count -= len(p.pending[key])
+			delete(p.pending, key)
+		} else {
+			rest = append(rest, key)
+		}
+	}
+	p.order = rest
+
+	return order, pending
+}
+
+// requeue batches failed to store ahead of messages enqueued meanwhile thus order is kept
+func (p *impl) requeue(failed []pendingKey, pending map[pendingKey][]message.Provider) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	order := failed
+	for _, key := range p.order {
+		if !contains(failed, key) {
+			order = append(order, key)
+		}
+	}
+	p.order = order
+
+	for _, key := range failed {
+		p.pending[key] = append(pending[key], p.pending[key]...)
+		p.count += len(pending[key])
+	}
+}
+
+func contains(list []pendingKey, key pendingKey) bool {
+	for _, k := range list {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// drop pending messages of session
+func (p *impl) drop(id string) {
+	p.flushLock.Lock()
+	defer p.flushLock.Unlock()
+
+	p.take(id)
+}
+
+// flush pending messages of given session or all of them if id is empty
+// Batches backend failed to store are kept pending and retried by next flush
+func (p *impl) flush(id string) error {
+	p.flushLock.Lock()
+	defer p.flushLock.Unlock()
+
+	order, pending := p.take(id)
+
+	var res error
+	var failed []pendingKey
+
+	for _, key := range order {
+		err := p.store(key, pending[key])
+		if err != nil {
+			p.log.prod.Error("Couldn't flush messages", zap.String("ClientID", key.id), zap.String("dir", key.dir), zap.Error(err))
+			failed = append(failed, key)
+			res = err
+		}
+	}
+
+	if len(failed) > 0 {
+		p.requeue(failed, pending)
+	}
+
+	if len(order) > 0 {
+		p.log.dev.Debug("Flushed messages", zap.Int("batches", len(order)))
+	}
+
+	return res
+}
+
+func (p *impl) store(key pendingKey, msg []message.Provider) error {
+	ses, err := p.sessions.Get(key.id)
+	if err != nil {
+		return err
+	}
+
+	var m types.Messages
+	if m, err = ses.Messages(); err != nil {
+		return err
+	}
+
+	return m.Store(key.dir, msg)
+}
+
+func (s *sessions) New(id string) (types.Session, error) {
+	ses, err := s.p.sessions.New(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{Session: ses, p: s.p}, nil
+}
+
+func (s *sessions) Get(id string) (types.Session, error) {
+	ses, err := s.p.sessions.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{Session: ses, p: s.p}, nil
+}
+
+func (s *sessions) GetAll() ([]types.Session, error) {
+	list, err := s.p.sessions.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]types.Session, 0, len(list))
+	for _, ses := range list {
+		res = append(res, &session{Session: ses, p: s.p})
+	}
+
+	return res, nil
+}
+
+func (s *sessions) Delete(id string) error {
+	s.p.drop(id)
+
+	return s.p.sessions.Delete(id)
+}
+
+func (s *session) Messages() (types.Messages, error) {
+	id, err := s.Session.ID()
+	if err != nil {
+		return nil, err
+	}
+
+	var m types.Messages
+	if m, err = s.Session.Messages(); err != nil {
+		return nil, err
+	}
+
+	return &messages{Messages: m, p: s.p, id: id}, nil
+}
+
+// Store buffer messages unless provider in sync mode
+func (m *messages) Store(dir string, msg []message.Provider) error {
+	if m.p.sync || len(msg) == 0 {
+		m.p.flush(m.id) // nolint: errcheck, gas
+		return m.Messages.Store(dir, msg)
+	}
+
+	if dir != "in" && dir != "out" {
+		return types.ErrInvalidArgs
+	}
+
+	return m.p.enqueue(m.id, dir, msg)
+}
+
+// Load flush pending messages of session before loading
+func (m *messages) Load() (*types.SessionMessages, error) {
+	if err := m.p.flush(m.id); err != nil {
+		return nil, err
+	}
+
+	return m.Messages.Load()
+}
+
+// Delete flush pending messages of session before delete
+func (m *messages) Delete() error {
+	if err := m.p.flush(m.id); err != nil {
+		return err
+	}
+
+	return m.Messages.Delete()
+}
@@ -0,0 +1,360 @@
+package writebehind
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/types"
+)
+
+var errBackend = errors.New("backend unavailable")
+
+// backend in-memory provider of session messages failing stores while fail is set
+type backend struct {
+	lock     sync.Mutex
+	sessions map[string]*types.SessionMessages
+	fail     bool
+	health   error
+	shutdown bool
+}
+
+type backendSession struct {
+	b  *backend
+	id string
+}
+
+func newBackend() *backend {
+	return &backend{sessions: make(map[string]*types.SessionMessages)}
+}
+
+func (b *backend) setFail(fail bool) {
+	b.lock.Lock()
+	b.fail = fail
+	b.lock.Unlock()
+}
+
+// stored topics of session in given direction
+func (b *backend) stored(id, dir string) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return topics(b.messages(id, dir))
+}
+
+func (b *backend) messages(id, dir string) []message.Provider {
+	s, ok := b.sessions[id]
+	if !ok {
+		return nil
+	}
+
+	if dir == "in" {
+		return s.In.Messages
+	}
+
+	return s.Out.Messages
+}
+
+func (b *backend) setHealth(err error) {
+	b.lock.Lock()
+	b.health = err
+	b.lock.Unlock()
+}
+
+func (b *backend) Health() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.health
+}
+
+// Snapshot write topics of stored outgoing messages of every session
+func (b *backend) Snapshot(w io.Writer) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for id := range b.sessions {
+		for _, topic := range topics(b.messages(id, "out")) {
+			if _, err := io.WriteString(w, id+":"+topic+";"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *backend) Sessions() (types.Sessions, error) { return b, nil }
+func (b *backend) Retained() (types.Retained, error) { return nil, types.ErrNotSupported }
+
+func (b *backend) Shutdown() error {
+	b.lock.Lock()
+	b.shutdown = true
+	b.lock.Unlock()
+
+	return nil
+}
+
+func (b *backend) New(id string) (types.Session, error) { return &backendSession{b: b, id: id}, nil }
+func (b *backend) Get(id string) (types.Session, error) { return &backendSession{b: b, id: id}, nil }
+func (b *backend) GetAll() ([]types.Session, error)     { return nil, nil }
+
+func (b *backend) Delete(id string) error {
+	b.lock.Lock()
+	delete(b.sessions, id)
+	b.lock.Unlock()
+
+	return nil
+}
+
+func (s *backendSession) Subscriptions() (types.Subscriptions, error) {
+	return nil, types.ErrNotSupported
+}
+func (s *backendSession) Messages() (types.Messages, error) { return s, nil }
+func (s *backendSession) ID() (string, error)               { return s.id, nil }
+
+func (s *backendSession) Store(dir string, msg []message.Provider) error {
+	s.b.lock.Lock()
+	defer s.b.lock.Unlock()
+
+	if s.b.fail {
+		return errBackend
+	}
+
+	m, ok := s.b.sessions[s.id]
+	if !ok {
+		m = &types.SessionMessages{}
+		s.b.sessions[s.id] = m
+	}
+
+	if dir == "in" {
+		m.In.Messages = append(m.In.Messages, msg...)
+	} else {
+		m.Out.Messages = append(m.Out.Messages, msg...)
+	}
+
+	return nil
+}
+
+func (s *backendSession) Load() (*types.SessionMessages, error) {
+	s.b.lock.Lock()
+	defer s.b.lock.Unlock()
+
+	if m, ok := s.b.sessions[s.id]; ok {
+		return m, nil
+	}
+
+	return &types.SessionMessages{}, nil
+}
+
+func (s *backendSession) Delete() error {
+	return s.b.Delete(s.id)
+}
+
+func topics(list []message.Provider) []string {
+	var res []string
+	for _, m := range list {
+		res = append(res, m.(*message.PublishMessage).Topic())
+	}
+
+	return res
+}
+
+func publishes(t *testing.T, list ...string) []message.Provider {
+	var res []message.Provider
+	for _, topic := range list {
+		m := message.NewPublishMessage()
+		require.NoError(t, m.SetTopic(topic))
+		res = append(res, m)
+	}
+
+	return res
+}
+
+func newProvider(t *testing.T, b *backend, config types.WriteBehindConfig) (types.Provider, types.Sessions) {
+	p, err := NewWriteBehind(b, &config)
+	require.NoError(t, err)
+
+	s, err := p.Sessions()
+	require.NoError(t, err)
+
+	return p, s
+}
+
+func sessionMessages(t *testing.T, s types.Sessions, id string) types.Messages {
+	ses, err := s.New(id)
+	require.NoError(t, err)
+
+	m, err := ses.Messages()
+	require.NoError(t, err)
+
+	return m
+}
+
+func TestBatchFlush(t *testing.T) {
+	b := newBackend()
+	p, s := newProvider(t, b, types.WriteBehindConfig{MaxBatch: 3, FlushInterval: time.Hour})
+	defer p.Shutdown() // nolint: errcheck
+
+	m := sessionMessages(t, s, "c1")
+
+	require.NoError(t, m.Store("out", publishes(t, "a", "b")))
+	require.Empty(t, b.stored("c1", "out"))
+
+	// full batch is flushed by producer
+	require.NoError(t, m.Store("out", publishes(t, "c")))
+	require.Equal(t, []string{"a", "b", "c"}, b.stored("c1", "out"))
+
+	require.Equal(t, types.ErrInvalidArgs, m.Store("other", publishes(t, "d")))
+}
+
+func TestIntervalFlush(t *testing.T) {
+	b := newBackend()
+	p, s := newProvider(t, b, types.WriteBehindConfig{FlushInterval: 10 * time.Millisecond})
+	defer p.Shutdown() // nolint: errcheck
+
+	require.NoError(t, sessionMessages(t, s, "c1").Store("in", publishes(t, "a")))
+
+	require.Eventually(t, func() bool {
+		return len(b.stored("c1", "in")) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestFlushOnLoadAndDelete(t *testing.T) {
+	b := newBackend()
+	p, s := newProvider(t, b, types.WriteBehindConfig{FlushInterval: time.Hour})
+	defer p.Shutdown() // nolint: errcheck
+
+	m1 := sessionMessages(t, s, "c1")
+	m2 := sessionMessages(t, s, "c2")
+
+	require.NoError(t, m1.Store("in", publishes(t, "a")))
+	require.NoError(t, m1.Store("out", publishes(t, "b")))
+	require.NoError(t, m2.Store("out", publishes(t, "c")))
+
+	// load of session flushes its messages only
+	loaded, err := m1.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, topics(loaded.In.Messages))
+	require.Equal(t, []string{"b"}, topics(loaded.Out.Messages))
+	require.Empty(t, b.stored("c2", "out"))
+
+	require.NoError(t, m2.Delete())
+	require.Empty(t, b.stored("c2", "out"))
+	require.Equal(t, []string{"b"}, b.stored("c1", "out"))
+
+	// deleted session drops messages not flushed yet
+	require.NoError(t, m2.Store("out", publishes(t, "d")))
+	require.NoError(t, s.Delete("c2"))
+
+	loaded, err = m2.Load()
+	require.NoError(t, err)
+	require.Empty(t, loaded.Out.Messages)
+}
+
+func TestFailedStore(t *testing.T) {
+	b := newBackend()
+	p, s := newProvider(t, b, types.WriteBehindConfig{MaxBatch: 2, FlushInterval: time.Hour})
+	defer p.Shutdown() // nolint: errcheck
+
+	m := sessionMessages(t, s, "c1")
+
+	b.setFail(true)
+
+	// flush of full batch fails, messages are kept rather than dropped
+	require.NoError(t, m.Store("out", publishes(t, "a", "b")))
+	require.NoError(t, m.Store("out", publishes(t, "c")))
+
+	_, err := m.Load()
+	require.Equal(t, errBackend, err)
+	require.Equal(t, errBackend, m.Delete())
+
+	b.setFail(false)
+
+	require.NoError(t, m.Store("out", publishes(t, "d")))
+
+	loaded, err := m.Load()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c", "d"}, topics(loaded.Out.Messages))
+}
+
+func TestShutdown(t *testing.T) {
+	b := newBackend()
+	p, s := newProvider(t, b, types.WriteBehindConfig{FlushInterval: time.Hour})
+
+	m := sessionMessages(t, s, "c1")
+	require.NoError(t, m.Store("out", publishes(t, "a", "b")))
+
+	// pending messages are drained into backend
+	require.NoError(t, p.Shutdown())
+	require.Equal(t, []string{"a", "b"}, b.stored("c1", "out"))
+	require.True(t, b.shutdown)
+
+	require.Equal(t, types.ErrNotOpen, p.Shutdown())
+	require.Equal(t, types.ErrNotOpen, m.Store("out", publishes(t, "c")))
+
+	_, err := p.Sessions()
+	require.Equal(t, types.ErrNotOpen, err)
+
+	// messages which cannot be drained are reported
+	b = newBackend()
+	p, s = newProvider(t, b, types.WriteBehindConfig{FlushInterval: time.Hour})
+
+	require.NoError(t, sessionMessages(t, s, "c1").Store("out", publishes(t, "a")))
+
+	b.setFail(true)
+	require.Equal(t, errBackend, p.Shutdown())
+}
+
+func TestSync(t *testing.T) {
+	b := newBackend()
+	p, s := newProvider(t, b, types.WriteBehindConfig{Sync: true})
+	defer p.Shutdown() // nolint: errcheck
+
+	require.NoError(t, sessionMessages(t, s, "c1").Store("out", publishes(t, "a")))
+	require.Equal(t, []string{"a"}, b.stored("c1", "out"))
+}
+
+func TestHealth(t *testing.T) {
+	b := newBackend()
+	p, _ := newProvider(t, b, types.WriteBehindConfig{FlushInterval: time.Hour})
+
+	require.NoError(t, types.CheckHealth(p))
+
+	b.setHealth(errBackend)
+	require.Equal(t, errBackend, types.CheckHealth(p))
+
+	b.setHealth(nil)
+	require.NoError(t, p.Shutdown())
+	require.Equal(t, types.ErrNotOpen, types.CheckHealth(p))
+}
+
+func TestSnapshot(t *testing.T) {
+	b := newBackend()
+	p, s := newProvider(t, b, types.WriteBehindConfig{FlushInterval: time.Hour})
+
+	m := sessionMessages(t, s, "c1")
+	require.NoError(t, m.Store("out", publishes(t, "a")))
+
+	// pending messages are flushed before snapshot is taken
+	var buf bytes.Buffer
+	require.NoError(t, types.TakeSnapshot(p, &buf))
+	require.Equal(t, "c1:a;", buf.String())
+
+	// snapshot missing pending messages is not taken
+	require.NoError(t, m.Store("out", publishes(t, "b")))
+	b.setFail(true)
+
+	buf.Reset()
+	require.Equal(t, errBackend, types.TakeSnapshot(p, &buf))
+	require.Empty(t, buf.String())
+
+	b.setFail(false)
+	require.NoError(t, p.Shutdown())
+	require.Equal(t, types.ErrNotOpen, types.TakeSnapshot(p, &buf))
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+// Quota limits of single client
+type Quota struct {
+	// Rate publishes per second and burst. 0 means unlimited
+	Rate  float64
+	Burst int
+
+	// ByteRate payload bytes per second and burst. 0 means unlimited
+	ByteRate  float64
+	ByteBurst int
+
+	// MaxInFlight amount of QoS 2 publishes of client awaiting release. 0 means unlimited
+	// Client exceeding it is always disconnected as it ignores flow control
+	MaxInFlight int
+
+	// Disconnect client exceeding rate instead of throttling it
+	Disconnect bool
+}
+
+// Client usage of quota by single connection
+type Client struct {
+	quota Quota
+	msgs  *Bucket
+	bytes *Bucket
+}
+
+// NewClient allocate usage of quota. Returns nil if quota is nil
+func NewClient(q *Quota) *Client {
+	if q == nil {
+		return nil
+	}
+
+	c := &Client{quota: *q}
+
+	if q.Rate > 0 {
+		c.msgs = NewBucket(q.Rate, q.Burst)
+	}
+
+	if q.ByteRate > 0 {
+		c.bytes = NewBucket(q.ByteRate, q.ByteBurst)
+	}
+
+	return c
+}
+
+// Take account publish of given size while inFlight publishes are not finished yet
+// Returns false if client must be disconnected, otherwise time client should be throttled for
+func (c *Client) Take(size int, inFlight int) (time.Duration, bool) {
+	if c == nil {
+		return 0, true
+	}
+
+	if c.quota.MaxInFlight > 0 && inFlight >= c.quota.MaxInFlight {
+		return 0, false
+	}
+
+	if c.quota.Disconnect {
+		if c.bytes != nil && !c.bytes.AllowN(size) {
+			return 0, false
+		}
+
+		if c.msgs != nil && !c.msgs.Allow() {
+			return 0, false
+		}
+
+		return 0, true
+	}
+
+	var delay time.Duration
+
+	if c.msgs != nil {
+		delay = c.msgs.Delay(1)
+	}
+
+	if c.bytes != nil {
+		if d := c.bytes.Delay(size); d > delay {
+			delay = d
+		}
+	}
+
+	return delay, true
+}
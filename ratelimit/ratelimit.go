@@ -0,0 +1,176 @@
+// Package ratelimit provides token bucket limiters used to protect broker
+// from floods of connections, publishes and bytes
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket token bucket limiter
+// Bucket is filled at rate tokens per second up to burst tokens
+type Bucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewBucket allocate bucket with given rate (tokens per second) and burst
+// Bucket starts full
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	b := &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+
+	b.last = b.now()
+
+	return b
+}
+
+// Allow take one token if available
+func (b *Bucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+// AllowN take n tokens if available
+func (b *Bucket) AllowN(n int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+
+	if b.tokens < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+
+	return true
+}
+
+// Delay take n tokens and return time caller should wait before proceeding
+// to stay within the rate. Bucket goes into debt thus subsequent calls
+// get longer delays
+func (b *Bucket) Delay(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full reports bucket has been fully replenished
+func (b *Bucket) full() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+
+	return b.tokens >= b.burst
+}
+
+func (b *Bucket) refill() {
+	now := b.now()
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+
+	if elapsed <= 0 {
+		return
+	}
+
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Keyed set of buckets with same parameters, e.g. one per source IP
+// Buckets fully replenished are evicted periodically
+type Keyed struct {
+	lock      sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// sweepInterval how often idle buckets are evicted
+const sweepInterval = time.Minute
+
+// NewKeyed allocate keyed limiter
+func NewKeyed(rate float64, burst int) *Keyed {
+	k := &Keyed{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*Bucket),
+		now:     time.Now,
+	}
+
+	k.lastSweep = k.now()
+
+	return k
+}
+
+// Allow take one token from bucket of the key
+func (k *Keyed) Allow(key string) bool {
+	return k.AllowN(key, 1)
+}
+
+// AllowN take n tokens from bucket of the key
+func (k *Keyed) AllowN(key string, n int) bool {
+	return k.bucket(key).AllowN(n)
+}
+
+// Delay take n tokens from bucket of the key and return time to wait
+func (k *Keyed) Delay(key string, n int) time.Duration {
+	return k.bucket(key).Delay(n)
+}
+
+// Len amount of tracked keys
+func (k *Keyed) Len() int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return len(k.buckets)
+}
+
+func (k *Keyed) bucket(key string) *Bucket {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if now := k.now(); now.Sub(k.lastSweep) >= sweepInterval {
+		k.lastSweep = now
+		for id, b := range k.buckets {
+			if b.full() {
+				delete(k.buckets, id)
+			}
+		}
+	}
+
+	b, ok := k.buckets[key]
+	if !ok {
+		b = NewBucket(k.rate, k.burst)
+		b.now = k.now
+		b.last = k.now()
+		k.buckets[key] = b
+	}
+
+	return b
+}
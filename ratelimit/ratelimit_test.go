@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestBucketBurst(t *testing.T) {
+	clk := &fakeClock{t: time.Now()}
+
+	b := NewBucket(1, 3)
+	b.now = clk.now
+	b.last = clk.now()
+
+	require.True(t, b.Allow())
+	require.True(t, b.Allow())
+	require.True(t, b.Allow())
+	require.False(t, b.Allow())
+
+	clk.advance(time.Second)
+	require.True(t, b.Allow())
+	require.False(t, b.Allow())
+
+	// never refills above burst
+	clk.advance(time.Hour)
+	require.True(t, b.AllowN(3))
+	require.False(t, b.Allow())
+}
+
+func TestBucketDelay(t *testing.T) {
+	clk := &fakeClock{t: time.Now()}
+
+	b := NewBucket(10, 10)
+	b.now = clk.now
+	b.last = clk.now()
+
+	require.Equal(t, time.Duration(0), b.Delay(10))
+	require.Equal(t, 500*time.Millisecond, b.Delay(5))
+
+	clk.advance(500 * time.Millisecond)
+	require.Equal(t, time.Duration(0), b.Delay(0))
+}
+
+func TestKeyed(t *testing.T) {
+	clk := &fakeClock{t: time.Now()}
+
+	k := NewKeyed(1, 1)
+	k.now = clk.now
+	k.lastSweep = clk.now()
+
+	require.True(t, k.Allow("a"))
+	require.False(t, k.Allow("a"))
+	require.True(t, k.Allow("b"))
+	require.Equal(t, 2, k.Len())
+
+	clk.advance(sweepInterval)
+	require.True(t, k.Allow("a"))
+
+	// b has been replenished and evicted
+	require.Equal(t, 1, k.Len())
+}
+
+func TestTopics(t *testing.T) {
+	l := NewTopics([]TopicLimit{
+		{Prefix: "sensors/", Rate: 0.001, Burst: 2},
+		{Prefix: "sensors/bulk/", ByteRate: 0.001, ByteBurst: 100, PerClient: true},
+		{Prefix: "slow/", Rate: 1, Burst: 1, Throttle: true},
+	})
+
+	// longest prefix wins
+	for i := 0; i < 2; i++ {
+		_, ok := l.Take("a", "sensors/t", 10)
+		require.True(t, ok)
+	}
+
+	_, ok := l.Take("b", "sensors/t", 10)
+	require.False(t, ok)
+
+	_, ok = l.Take("a", "sensors/bulk/x", 60)
+	require.True(t, ok)
+
+	_, ok = l.Take("a", "sensors/bulk/x", 60)
+	require.False(t, ok)
+
+	_, ok = l.Take("b", "sensors/bulk/x", 60)
+	require.True(t, ok)
+
+	_, ok = l.Take("a", "other", 1<<20)
+	require.True(t, ok)
+
+	d, ok := l.Take("a", "slow/x", 1)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), d)
+
+	d, ok = l.Take("a", "slow/x", 1)
+	require.True(t, ok)
+	require.True(t, d > 900*time.Millisecond)
+
+	var n *Topics
+	_, ok = n.Take("a", "sensors/t", 1)
+	require.True(t, ok)
+}
+
+func TestQuota(t *testing.T) {
+	var nilClient *Client
+	_, ok := nilClient.Take(100, 100)
+	require.True(t, ok)
+	require.Nil(t, NewClient(nil))
+
+	c := NewClient(&Quota{Rate: 1, Burst: 1, MaxInFlight: 2, Disconnect: true})
+
+	_, ok = c.Take(10, 0)
+	require.True(t, ok)
+
+	// rate exceeded
+	_, ok = c.Take(10, 0)
+	require.False(t, ok)
+
+	// too many unfinished exchanges
+	_, ok = c.Take(10, 2)
+	require.False(t, ok)
+
+	c = NewClient(&Quota{ByteRate: 100, ByteBurst: 100})
+
+	delay, ok := c.Take(100, 0)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), delay)
+
+	delay, ok = c.Take(50, 0)
+	require.True(t, ok)
+	require.True(t, delay > 0)
+}
@@ -0,0 +1,131 @@
+package ratelimit
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// TopicLimit limits of publishes to topics starting with prefix
+type TopicLimit struct {
+	// Prefix of topic as seen by broker, i.e. after rewrite and with virtual host prefix
+	Prefix string
+
+	// Rate messages per second and burst. 0 means unlimited
+	Rate  float64
+	Burst int
+
+	// ByteRate payload bytes per second and burst. 0 means unlimited
+	ByteRate  float64
+	ByteBurst int
+
+	// PerClient limits apply to every publisher separately rather than to all of them together
+	PerClient bool
+
+	// Throttle slow down offending client instead of dropping messages above limit
+	Throttle bool
+}
+
+type topicLimit struct {
+	TopicLimit
+
+	msgs        *Bucket
+	bytes       *Bucket
+	clientMsgs  *Keyed
+	clientBytes *Keyed
+}
+
+// Topics set of limits selected by longest matching topic prefix
+type Topics struct {
+	list []*topicLimit
+}
+
+// NewTopics allocate limits
+func NewTopics(limits []TopicLimit) *Topics {
+	t := &Topics{}
+
+	for _, l := range limits {
+		e := &topicLimit{TopicLimit: l}
+
+		if l.PerClient {
+			if l.Rate > 0 {
+				e.clientMsgs = NewKeyed(l.Rate, l.Burst)
+			}
+
+			if l.ByteRate > 0 {
+				e.clientBytes = NewKeyed(l.ByteRate, l.ByteBurst)
+			}
+		} else {
+			if l.Rate > 0 {
+				e.msgs = NewBucket(l.Rate, l.Burst)
+			}
+
+			if l.ByteRate > 0 {
+				e.bytes = NewBucket(l.ByteRate, l.ByteBurst)
+			}
+		}
+
+		t.list = append(t.list, e)
+	}
+
+	sort.SliceStable(t.list, func(i, j int) bool { return len(t.list[i].Prefix) > len(t.list[j].Prefix) })
+
+	return t
+}
+
+// Take account message of given size published by client
+// Returns false if message must be dropped, otherwise time client should be throttled for
+func (t *Topics) Take(client, topic string, size int) (time.Duration, bool) {
+	if t == nil {
+		return 0, true
+	}
+
+	for _, l := range t.list {
+		if strings.HasPrefix(topic, l.Prefix) {
+			return l.take(client, size)
+		}
+	}
+
+	return 0, true
+}
+
+func (l *topicLimit) take(client string, size int) (time.Duration, bool) {
+	msgs, bytes := l.msgs, l.bytes
+	if l.PerClient {
+		if l.clientMsgs != nil {
+			msgs = l.clientMsgs.bucket(client)
+		}
+
+		if l.clientBytes != nil {
+			bytes = l.clientBytes.bucket(client)
+		}
+	}
+
+	if l.Throttle {
+		var delay time.Duration
+
+		if msgs != nil {
+			delay = msgs.Delay(1)
+		}
+
+		if bytes != nil {
+			if d := bytes.Delay(size); d > delay {
+				delay = d
+			}
+		}
+
+		return delay, true
+	}
+
+	// bytes checked first as message may be too big for bucket at all, in such
+	// case message token is not wasted
+	if bytes != nil && !bytes.AllowN(size) {
+		return 0, false
+	}
+
+	if msgs != nil && !msgs.Allow() {
+		return 0, false
+	}
+
+	return 0, true
+}
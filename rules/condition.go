@@ -0,0 +1,207 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// Operator of condition
+type Operator int
+
+// Operators of conditions
+const (
+	// Equal field equals Value
+	Equal Operator = iota
+
+	// NotEqual field missing or differs from Value
+	NotEqual
+
+	// Greater field is number greater than Value
+	Greater
+
+	// GreaterOrEqual field is number greater than or equal to Value
+	GreaterOrEqual
+
+	// Less field is number less than Value
+	Less
+
+	// LessOrEqual field is number less than or equal to Value
+	LessOrEqual
+
+	// Exists field is present
+	Exists
+
+	// Contains field is string containing Value
+	Contains
+)
+
+// Condition on field of JSON payload
+type Condition struct {
+	// Field dot separated path of payload field, e.g. "data.temp"
+	Field string
+
+	Op Operator
+
+	// Value field is compared to. Numbers of any Go type compare as float64
+	Value interface{}
+}
+
+func (c *Condition) validate() error {
+	if c.Field == "" || c.Op < Equal || c.Op > Contains {
+		return ErrInvalidRule
+	}
+
+	switch c.Op {
+	case Greater, GreaterOrEqual, Less, LessOrEqual:
+		if _, ok := number(c.Value); !ok {
+			return ErrInvalidRule
+		}
+	case Contains:
+		if _, ok := c.Value.(string); !ok {
+			return ErrInvalidRule
+		}
+	}
+
+	return nil
+}
+
+func (c *Condition) holds(doc map[string]interface{}) bool {
+	v, ok := getField(doc, splitField(c.Field))
+
+	switch c.Op {
+	case Exists:
+		return ok
+	case NotEqual:
+		return !ok || !equal(v, c.Value)
+	}
+
+	if !ok {
+		return false
+	}
+
+	switch c.Op {
+	case Equal:
+		return equal(v, c.Value)
+	case Contains:
+		s, isString := v.(string)
+		return isString && strings.Contains(s, c.Value.(string))
+	}
+
+	a, isNumber := number(v)
+	if !isNumber {
+		return false
+	}
+
+	b, _ := number(c.Value)
+
+	switch c.Op {
+	case Greater:
+		return a > b
+	case GreaterOrEqual:
+		return a >= b
+	case Less:
+		return a < b
+	default:
+		return a <= b
+	}
+}
+
+func equal(v, value interface{}) bool {
+	if a, ok := number(v); ok {
+		b, isNumber := number(value)
+		return isNumber && a == b
+	}
+
+	return v == value
+}
+
+// number of JSON or Go numeric value
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+
+	return 0, false
+}
+
+// decode JSON keeping numbers as they are, thus modified payload does not lose precision
+func decode(buf []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(buf))
+	d.UseNumber()
+
+	return d.Decode(v)
+}
+
+func splitField(field string) []string {
+	return strings.Split(field, ".")
+}
+
+func getField(doc map[string]interface{}, field []string) (interface{}, bool) {
+	var v interface{} = doc
+
+	for _, name := range field {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if v, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// setField set value creating missing objects on path. nil value removes field
+func setField(doc map[string]interface{}, field []string, value interface{}) {
+	obj := doc
+
+	for _, name := range field[:len(field)-1] {
+		next, ok := obj[name].(map[string]interface{})
+		if !ok {
+			if value == nil {
+				return
+			}
+
+			next = make(map[string]interface{})
+			obj[name] = next
+		}
+
+		obj = next
+	}
+
+	last := field[len(field)-1]
+	if value == nil {
+		delete(obj, last)
+	} else {
+		obj[last] = value
+	}
+}
@@ -0,0 +1,356 @@
+// Package rules routes and transforms messages published by clients. Rules are evaluated in
+// order inline in publish path, before message reaches subscribers. Rule matches message by
+// topic, client and fields of JSON payload, then its actions republish message to another
+// topic, drop it, modify fields of payload or forward it to connector
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"sync/atomic"
+
+	"github.com/troian/surgemq"
+	connectorTypes "github.com/troian/surgemq/connector/types"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/session"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	"go.uber.org/zap"
+)
+
+// ActionKind what action does
+type ActionKind int
+
+// Kinds of actions
+const (
+	// Republish copy of message to Topic
+	Republish ActionKind = iota
+
+	// Drop message. Further actions and rules are skipped
+	Drop
+
+	// Set Field of JSON payload to Value. nil Value removes field
+	Set
+
+	// Forward message to Connector
+	Forward
+)
+
+var (
+	// ErrDropped message dropped by rule
+	ErrDropped = errors.New("rules: message dropped")
+
+	// ErrInvalidRule rule with invalid condition or action
+	ErrInvalidRule = errors.New("rules: invalid rule")
+
+	// ErrNotObject payload is not JSON object thus its fields cannot be modified
+	ErrNotObject = errors.New("rules: payload is not JSON object")
+)
+
+// Action of rule
+type Action struct {
+	Kind ActionKind
+
+	// Topic template of republished message, {clientid} is id of publisher, see
+	// connectorTypes.TopicVars for others, e.g. "archive/{clientid}/{topic}"
+	Topic string
+
+	// QoS of republished message. nil keeps QoS of message
+	QoS *message.QosType
+
+	// Field dot separated path of payload field to set, e.g. "meta.site"
+	Field string
+	Value interface{}
+
+	// Connector name of connector message is forwarded to
+	Connector string
+}
+
+// Rule matches message if all of its conditions hold
+type Rule struct {
+	// Name of rule in logs and stats
+	Name string
+
+	// Topic filter of message. Empty matches any. Topics of virtual hosts include namespace
+	Topic string
+
+	// Client pattern of publisher id as of path.Match, e.g. "sensor-*". Empty matches any
+	Client string
+
+	// Payload conditions on fields of JSON payload. Message without JSON payload does not
+	// match rule with payload conditions
+	Payload []Condition
+
+	Actions []Action
+}
+
+// Config of engine
+type Config struct {
+	Rules []Rule
+
+	// Publish republished messages. Required by Republish actions
+	Publish func(msg *message.PublishMessage) error
+
+	// Connector by name. Required by Forward actions
+	Connector func(name string) connectorTypes.Forwarder
+}
+
+// Stat of rule
+type Stat struct {
+	Name    string
+	Matched uint64
+	Failed  uint64
+}
+
+type action struct {
+	Action
+	topic *connectorTypes.Template
+	field []string
+}
+
+type rule struct {
+	Rule
+	actions []*action
+
+	// counters, updated atomically
+	matched uint64
+	failed  uint64
+}
+
+// Engine evaluates rules with publishes of clients
+type Engine struct {
+	session.HooksBase
+
+	config Config
+	rules  []*rule
+
+	log *zap.Logger
+}
+
+var _ session.Hooks = (*Engine)(nil)
+
+// New engine. Rules are validated
+func New(config Config) (*Engine, error) {
+	e := &Engine{
+		config: config,
+		log:    surgemq.GetProdLogger().Named("rules"),
+	}
+
+	for i := range config.Rules {
+		r := &rule{Rule: config.Rules[i]}
+
+		if r.Client != "" {
+			if _, err := path.Match(r.Client, ""); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, c := range r.Payload {
+			if err := c.validate(); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, a := range r.Actions {
+			act := &action{Action: a}
+
+			switch a.Kind {
+			case Republish:
+				if a.Topic == "" || config.Publish == nil {
+					return nil, ErrInvalidRule
+				}
+
+				var err error
+				if act.topic, err = connectorTypes.ParseTemplate(a.Topic); err != nil {
+					return nil, err
+				}
+			case Drop:
+			case Set:
+				if a.Field == "" {
+					return nil, ErrInvalidRule
+				}
+
+				act.field = splitField(a.Field)
+			case Forward:
+				if a.Connector == "" || config.Connector == nil {
+					return nil, ErrInvalidRule
+				}
+			default:
+				return nil, ErrInvalidRule
+			}
+
+			r.actions = append(r.actions, act)
+		}
+
+		e.rules = append(e.rules, r)
+	}
+
+	return e, nil
+}
+
+// Stats of rules in order
+func (e *Engine) Stats() []Stat {
+	res := make([]Stat, 0, len(e.rules))
+	for _, r := range e.rules {
+		res = append(res, Stat{
+			Name:    r.Name,
+			Matched: atomic.LoadUint64(&r.matched),
+			Failed:  atomic.LoadUint64(&r.failed),
+		})
+	}
+
+	return res
+}
+
+// OnPublishIn evaluate rules with message of client. ErrDropped drops message
+func (e *Engine) OnPublishIn(id string, msg *message.PublishMessage) error {
+	p := &payload{msg: msg}
+
+	for _, r := range e.rules {
+		if !r.match(id, msg, p) {
+			continue
+		}
+
+		atomic.AddUint64(&r.matched, 1)
+
+		for _, a := range r.actions {
+			if a.Kind == Drop {
+				return ErrDropped
+			}
+
+			if err := e.apply(a, id, msg, p); err != nil {
+				atomic.AddUint64(&r.failed, 1)
+				e.log.Warn("Action of rule failed",
+					zap.String("rule", r.Name),
+					zap.String("ClientID", id),
+					zap.String("topic", msg.Topic()),
+					zap.Error(err))
+			}
+		}
+	}
+
+	return p.flush()
+}
+
+func (r *rule) match(id string, msg *message.PublishMessage, p *payload) bool {
+	if r.Topic != "" && !topicsTypes.Match(r.Topic, msg.Topic()) {
+		return false
+	}
+
+	if r.Client != "" {
+		if ok, _ := path.Match(r.Client, id); !ok {
+			return false
+		}
+	}
+
+	if len(r.Payload) == 0 {
+		return true
+	}
+
+	doc := p.object()
+	if doc == nil {
+		return false
+	}
+
+	for _, c := range r.Payload {
+		if !c.holds(doc) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e *Engine) apply(a *action, id string, msg *message.PublishMessage, p *payload) error {
+	switch a.Kind {
+	case Republish:
+		if err := p.flush(); err != nil {
+			return err
+		}
+
+		vars := connectorTypes.TopicVars(msg.Topic())
+
+		m := message.NewPublishMessage()
+		if err := m.SetTopic(a.topic.Execute(func(name string) string {
+			if name == "clientid" {
+				return id
+			}
+
+			return vars(name)
+		})); err != nil {
+			return err
+		}
+
+		qos := msg.QoS()
+		if a.QoS != nil {
+			qos = *a.QoS
+		}
+
+		m.SetQoS(qos) // nolint: errcheck
+		m.SetPayload(msg.Payload())
+
+		return e.config.Publish(m)
+	case Set:
+		doc := p.object()
+		if doc == nil {
+			return ErrNotObject
+		}
+
+		setField(doc, a.field, a.Value)
+		p.modified = true
+
+		return nil
+	case Forward:
+		if err := p.flush(); err != nil {
+			return err
+		}
+
+		c := e.config.Connector(a.Connector)
+		if c == nil {
+			return connectorTypes.ErrUnknownConnector
+		}
+
+		return c.Forward(msg)
+	}
+
+	return nil
+}
+
+// payload of message decoded once on demand
+type payload struct {
+	msg      *message.PublishMessage
+	decoded  bool
+	doc      map[string]interface{}
+	modified bool
+}
+
+// object of JSON payload. nil if payload is not JSON object
+func (p *payload) object() map[string]interface{} {
+	if !p.decoded {
+		p.decoded = true
+
+		var doc map[string]interface{}
+		if err := decode(p.msg.Payload(), &doc); err == nil {
+			p.doc = doc
+		}
+	}
+
+	return p.doc
+}
+
+// flush modified object into payload of message
+func (p *payload) flush() error {
+	if !p.modified {
+		return nil
+	}
+
+	buf, err := json.Marshal(p.doc)
+	if err != nil {
+		return err
+	}
+
+	p.msg.SetPayload(buf)
+	p.modified = false
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package rules
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	connectorTypes "github.com/troian/surgemq/connector/types"
+	"github.com/troian/surgemq/message"
+)
+
+type forwarder struct {
+	msgs []*message.PublishMessage
+}
+
+func (f *forwarder) Forward(msg *message.PublishMessage) error {
+	f.msgs = append(f.msgs, msg)
+	return nil
+}
+
+func newMessage(t *testing.T, topic string, payload string) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic(topic))
+	require.NoError(t, msg.SetQoS(message.QoS1))
+	msg.SetPayload([]byte(payload))
+
+	return msg
+}
+
+func TestInvalidRules(t *testing.T) {
+	publish := func(*message.PublishMessage) error { return nil }
+
+	for _, r := range []Rule{
+		{Client: "[", Actions: []Action{{Kind: Drop}}},
+		{Payload: []Condition{{Op: Equal, Value: 1}}},
+		{Payload: []Condition{{Field: "a", Op: Greater, Value: "x"}}},
+		{Payload: []Condition{{Field: "a", Op: Contains, Value: 1}}},
+		{Actions: []Action{{Kind: Republish}}},
+		{Actions: []Action{{Kind: Republish, Topic: "a/{1"}}},
+		{Actions: []Action{{Kind: Set}}},
+		{Actions: []Action{{Kind: Forward, Connector: "kafka"}}},
+		{Actions: []Action{{Kind: ActionKind(10)}}},
+	} {
+		_, err := New(Config{Rules: []Rule{r}, Publish: publish})
+		require.Error(t, err, "%+v", r)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	var doc map[string]interface{}
+	require.NoError(t, decode([]byte(`{"temp": 21.5, "id": 12345678901234567890, "meta": {"site": "north-1", "on": true}}`), &doc))
+
+	for _, tc := range []struct {
+		c     Condition
+		holds bool
+	}{
+		{Condition{Field: "temp", Op: Equal, Value: 21.5}, true},
+		{Condition{Field: "temp", Op: Greater, Value: 20}, true},
+		{Condition{Field: "temp", Op: Less, Value: 20}, false},
+		{Condition{Field: "temp", Op: GreaterOrEqual, Value: 21.5}, true},
+		{Condition{Field: "temp", Op: LessOrEqual, Value: int64(21)}, false},
+		{Condition{Field: "temp", Op: NotEqual, Value: 21.5}, false},
+		{Condition{Field: "meta.site", Op: Equal, Value: "north-1"}, true},
+		{Condition{Field: "meta.site", Op: Contains, Value: "north"}, true},
+		{Condition{Field: "meta.site", Op: Greater, Value: 1}, false},
+		{Condition{Field: "meta.on", Op: Equal, Value: true}, true},
+		{Condition{Field: "meta.off", Op: Exists}, false},
+		{Condition{Field: "meta.off", Op: NotEqual, Value: true}, true},
+		{Condition{Field: "meta.site.x", Op: Exists}, false},
+		{Condition{Field: "id", Op: Exists}, true},
+	} {
+		require.Equal(t, tc.holds, tc.c.holds(doc), "%+v", tc.c)
+	}
+}
+
+func TestRepublish(t *testing.T) {
+	var published []*message.PublishMessage
+
+	qos := message.QoS0
+
+	e, err := New(Config{
+		Rules: []Rule{
+			{
+				Name:   "hot",
+				Topic:  "sensors/+/temp",
+				Client: "sensor-*",
+				Payload: []Condition{
+					{Field: "temp", Op: Greater, Value: 30},
+				},
+				Actions: []Action{
+					{Kind: Republish, Topic: "alerts/{clientid}/{1}", QoS: &qos},
+				},
+			},
+		},
+		Publish: func(msg *message.PublishMessage) error {
+			published = append(published, msg)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, e.OnPublishIn("sensor-1", newMessage(t, "sensors/kitchen/temp", `{"temp": 35}`)))
+	require.NoError(t, e.OnPublishIn("sensor-1", newMessage(t, "sensors/kitchen/temp", `{"temp": 25}`)))
+	require.NoError(t, e.OnPublishIn("sensor-1", newMessage(t, "sensors/kitchen/temp", `not json`)))
+	require.NoError(t, e.OnPublishIn("panel", newMessage(t, "sensors/kitchen/temp", `{"temp": 35}`)))
+	require.NoError(t, e.OnPublishIn("sensor-1", newMessage(t, "sensors/kitchen/humidity", `{"temp": 35}`)))
+
+	require.Len(t, published, 1)
+	require.Equal(t, "alerts/sensor-1/kitchen", published[0].Topic())
+	require.Equal(t, message.QoS0, published[0].QoS())
+	require.Equal(t, `{"temp": 35}`, string(published[0].Payload()))
+
+	require.Equal(t, []Stat{{Name: "hot", Matched: 1}}, e.Stats())
+}
+
+func TestDrop(t *testing.T) {
+	var published []*message.PublishMessage
+
+	e, err := New(Config{
+		Rules: []Rule{
+			{Topic: "debug/#", Actions: []Action{{Kind: Drop}}},
+			{Actions: []Action{{Kind: Republish, Topic: "all/{topic}"}}},
+		},
+		Publish: func(msg *message.PublishMessage) error {
+			published = append(published, msg)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, ErrDropped, e.OnPublishIn("c", newMessage(t, "debug/x", "1")))
+	require.Len(t, published, 0)
+
+	require.NoError(t, e.OnPublishIn("c", newMessage(t, "data/x", "1")))
+	require.Len(t, published, 1)
+	require.Equal(t, "all/data/x", published[0].Topic())
+}
+
+func TestModifyAndForward(t *testing.T) {
+	f := &forwarder{}
+
+	e, err := New(Config{
+		Rules: []Rule{
+			{
+				Topic: "devices/#",
+				Actions: []Action{
+					{Kind: Set, Field: "meta.site", Value: "north"},
+					{Kind: Set, Field: "secret", Value: nil},
+					{Kind: Forward, Connector: "kafka"},
+					{Kind: Forward, Connector: "missing"},
+				},
+			},
+		},
+		Connector: func(name string) connectorTypes.Forwarder {
+			if name == "kafka" {
+				return f
+			}
+
+			return nil
+		},
+	})
+	require.NoError(t, err)
+
+	msg := newMessage(t, "devices/d1", `{"id": 12345678901234567890, "secret": "x"}`)
+	require.NoError(t, e.OnPublishIn("d1", msg))
+
+	var doc map[string]interface{}
+	require.NoError(t, decode(msg.Payload(), &doc))
+	require.Equal(t, map[string]interface{}{
+		"id":   json.Number("12345678901234567890"),
+		"meta": map[string]interface{}{"site": "north"},
+	}, doc)
+
+	require.Len(t, f.msgs, 1)
+	require.Equal(t, msg.Payload(), f.msgs[0].Payload())
+
+	require.Equal(t, []Stat{{Matched: 1, Failed: 1}}, e.Stats())
+
+	// payload not JSON object is not modified
+	msg = newMessage(t, "devices/d1", `[1, 2]`)
+	require.NoError(t, e.OnPublishIn("d1", msg))
+	require.Equal(t, `[1, 2]`, string(msg.Payload()))
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultQueueAlarmInterval = 5 * time.Second
+
+// Kinds of queue alarms. Alarm of session is named <kind>/<client id>
+const (
+	alarmQueued   = "queued"
+	alarmOffline  = "offline"
+	alarmInFlight = "inflight"
+)
+
+// QueueAlarmConfig thresholds of session queues alarms are raised at. Alarm is cleared
+// once depth falls under threshold. 0 disables threshold
+type QueueAlarmConfig struct {
+	// Queued messages waiting to be written to connected client
+	Queued int
+
+	// Offline messages stored for client while it is offline
+	Offline int
+
+	// InFlight QoS 1/2 messages sent to client and not yet acknowledged
+	InFlight int
+
+	// Interval queues are checked at. If not set then default to 5 seconds
+	Interval time.Duration
+}
+
+// setAlarm raise or clear alarm of systree. Changes are logged and reported as events
+// clientID and value describe alarm of session
+func (s *implementation) setAlarm(name string, on bool, clientID string, value int) {
+	alarms := s.inner.sysTree.Alarms()
+
+	kind := EventAlarmCleared
+	if on {
+		if !alarms.Raise(name) {
+			return
+		}
+		kind = EventAlarmRaised
+		s.log.Prod.Warn("Alarm raised", zap.String("alarm", name), zap.Int("value", value))
+	} else {
+		if !alarms.Clear(name) {
+			return
+		}
+		s.log.Prod.Info("Alarm cleared", zap.String("alarm", name), zap.Int("value", value))
+	}
+
+	if s.inner.events.queue != nil {
+		s.event(&Event{Event: kind, ClientID: clientID, Reason: name, Value: value})
+	}
+}
+
+// queueAlarmWorker periodically check queues of sessions against thresholds
+func (s *implementation) queueAlarmWorker(config *QueueAlarmConfig) {
+	defer s.inner.alarms.wg.Done()
+
+	interval := config.Interval
+	if interval <= 0 {
+		interval = defaultQueueAlarmInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// raised alarms of sessions along with client id
+	raised := make(map[string]string)
+
+	for {
+		select {
+		case <-s.inner.quit:
+			return
+		case <-ticker.C:
+			s.checkQueues(config, raised)
+		}
+	}
+}
+
+func (s *implementation) checkQueues(config *QueueAlarmConfig, raised map[string]string) {
+	seen := make(map[string]bool, len(raised))
+
+	check := func(kind string, id string, value, threshold int) {
+		if threshold <= 0 {
+			return
+		}
+
+		name := kind + "/" + id
+		if value >= threshold {
+			s.setAlarm(name, true, id, value)
+			raised[name] = id
+			seen[name] = true
+		}
+	}
+
+	for _, i := range s.inner.sessionsMgr.MemorySessions() {
+		check(alarmQueued, i.ID, i.Queued-i.Offline, config.Queued)
+		check(alarmOffline, i.ID, i.Offline, config.Offline)
+		check(alarmInFlight, i.ID, i.InFlightOut, config.InFlight)
+	}
+
+	// sessions recovered or gone
+	for name, id := range raised {
+		if !seen[name] {
+			s.setAlarm(name, false, id, 0)
+			delete(raised, name)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/troian/surgemq/audit"
+	"github.com/troian/surgemq/message"
+	"go.uber.org/zap"
+)
+
+// audit record decision or action if audit log is configured
+func (l *listenerInner) audit(log *zap.Logger, r *audit.Record) {
+	if l.config.Audit == nil {
+		return
+	}
+
+	if err := l.config.Audit.Record(r); err != nil {
+		log.Error("Couldn't write audit record", zap.String("action", r.Action), zap.Error(err))
+	}
+}
+
+// auditConnect record outcome of CONNECT. method is how client authenticated, refused
+// reason listener refused it for. Refusals by session manager are described by code
+func (l *ListenerBase) auditConnect(msg *message.ConnectMessage, user string, addr net.Addr, code message.ConnAckCode, method, refused string) {
+	r := &audit.Record{
+		Action:   audit.ActionConnect,
+		Result:   audit.ResultAllowed,
+		ClientID: string(msg.ClientID()),
+		Username: user,
+		Detail:   method,
+	}
+
+	if addr != nil {
+		r.RemoteAddr = addr.String()
+	}
+
+	if code != message.ConnectionAccepted {
+		r.Result = audit.ResultDenied
+		r.Detail = refused
+		if r.Detail == "" {
+			r.Detail = code.Error()
+		}
+	}
+
+	l.inner.audit(l.log.Prod, r)
+}
+
+// auditAdmin record administrative action
+func (s *implementation) auditAdmin(action string, err error, r audit.Record) {
+	r.Action = action
+	r.Result = audit.ResultDone
+
+	if err != nil {
+		r.Result = audit.ResultFailed
+		r.Detail = err.Error()
+	}
+
+	s.inner.audit(s.log.Prod, &r)
+}
+
+// banExpiry detail of ban record
+func banExpiry(b Ban) string {
+	if b.Expires.IsZero() {
+		return "permanent"
+	}
+
+	return "until " + b.Expires.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrInvalidBan ban has neither client id nor valid IP address or network
+var ErrInvalidBan = errors.New("server: ban requires client id or IP address")
+
+// Ban of client id or source address. Banned clients are refused before
+// CONNECT is processed, connected ones are not disconnected
+type Ban struct {
+	// ClientID banned client id
+	ClientID string
+
+	// IP banned address or network in CIDR notation
+	IP string
+
+	// Expires when ban is lifted. Zero time means permanent
+	Expires time.Time
+}
+
+type banList struct {
+	lock    sync.Mutex
+	clients map[string]time.Time
+	nets    map[string]banNet
+}
+
+type banNet struct {
+	net     *net.IPNet
+	expires time.Time
+}
+
+// parseNet address or network in CIDR notation
+func parseNet(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// parseNets list of addresses or networks
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+
+	for _, s := range list {
+		n, err := parseNet(s)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, n)
+	}
+
+	return res, nil
+}
+
+// containsIP check if any network contains ip
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hostIP IP of address, nil if address is not IP based
+func hostIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return net.ParseIP(host)
+}
+
+func (b *banList) add(ban Ban) error {
+	if ban.ClientID == "" && ban.IP == "" {
+		return ErrInvalidBan
+	}
+
+	var n *net.IPNet
+	if ban.IP != "" {
+		var err error
+		if n, err = parseNet(ban.IP); err != nil {
+			return ErrInvalidBan
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if ban.ClientID != "" {
+		if b.clients == nil {
+			b.clients = make(map[string]time.Time)
+		}
+
+		b.clients[ban.ClientID] = ban.Expires
+	}
+
+	if n != nil {
+		if b.nets == nil {
+			b.nets = make(map[string]banNet)
+		}
+
+		b.nets[n.String()] = banNet{net: n, expires: ban.Expires}
+	}
+
+	return nil
+}
+
+func (b *banList) remove(ban Ban) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	found := false
+
+	if _, ok := b.clients[ban.ClientID]; ok {
+		delete(b.clients, ban.ClientID)
+		found = true
+	}
+
+	if n, err := parseNet(ban.IP); err == nil {
+		if _, ok := b.nets[n.String()]; ok {
+			delete(b.nets, n.String())
+			found = true
+		}
+	}
+
+	return found
+}
+
+// list active bans, client ids first then networks
+func (b *banList) list() []Ban {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.expire(time.Now())
+
+	res := make([]Ban, 0, len(b.clients)+len(b.nets))
+
+	for id, exp := range b.clients {
+		res = append(res, Ban{ClientID: id, Expires: exp})
+	}
+
+	for key, n := range b.nets {
+		res = append(res, Ban{IP: key, Expires: n.expires})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		// client bans go first
+		if (res[i].ClientID == "") != (res[j].ClientID == "") {
+			return res[i].ClientID != ""
+		}
+
+		return res[i].ClientID+res[i].IP < res[j].ClientID+res[j].IP
+	})
+
+	return res
+}
+
+func (b *banList) clientBanned(id string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	exp, ok := b.clients[id]
+	if ok && !exp.IsZero() && time.Now().After(exp) {
+		delete(b.clients, id)
+		return false
+	}
+
+	return ok
+}
+
+func (b *banList) ipBanned(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.nets) == 0 {
+		return false
+	}
+
+	b.expire(time.Now())
+
+	for _, n := range b.nets {
+		if n.net.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expire drop lifted bans, must be called with lock held
+func (b *banList) expire(now time.Time) {
+	for id, exp := range b.clients {
+		if !exp.IsZero() && now.After(exp) {
+			delete(b.clients, id)
+		}
+	}
+
+	for key, n := range b.nets {
+		if !n.expires.IsZero() && now.After(n.expires) {
+			delete(b.nets, key)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/session"
+)
+
+// claimHook announces sessions started by broker to cluster members sharing persistence
+// thus they release their copies of these sessions
+type claimHook struct {
+	session.HooksBase
+	s *implementation
+}
+
+func (h *claimHook) OnConnect(id string, msg *message.ConnectMessage) error {
+	if c := h.s.inner.cluster; c != nil {
+		c.Claim(id)
+	}
+
+	return nil
+}
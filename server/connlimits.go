@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net"
+	"sync"
+
+	"github.com/troian/surgemq/systree"
+)
+
+// connLimits concurrent connections across all listeners, total and per source IP
+type connLimits struct {
+	max      int
+	maxPerIP int
+	stat     systree.ConnectionsStat
+
+	lock  sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnLimits(max, maxPerIP int, stat systree.ConnectionsStat) *connLimits {
+	stat.Limits(max, maxPerIP)
+
+	return &connLimits{
+		max:      max,
+		maxPerIP: maxPerIP,
+		stat:     stat,
+		perIP:    make(map[string]int),
+	}
+}
+
+// acquire connection slot for source address. Returns false if limits reached
+// release must be called once connection is closed, regardless of result
+func (c *connLimits) acquire(addr net.Addr) (func(), bool) {
+	// non IP transports, e.g. in-memory, are counted against total only
+	var key string
+	if ip := hostIP(addr); ip != nil {
+		key = ip.String()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if (c.max > 0 && c.total >= c.max) || (c.maxPerIP > 0 && key != "" && c.perIP[key] >= c.maxPerIP) {
+		c.stat.Rejected()
+		return func() {}, false
+	}
+
+	c.total++
+	if key != "" {
+		c.perIP[key]++
+	}
+
+	c.stat.Opened()
+
+	return func() { c.release(key) }, true
+}
+
+func (c *connLimits) release(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.total--
+	if key != "" {
+		if c.perIP[key]--; c.perIP[key] <= 0 {
+			delete(c.perIP, key)
+		}
+	}
+
+	c.stat.Closed()
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/troian/surgemq/message"
+	persistTypes "github.com/troian/surgemq/persistence/types"
+	"github.com/troian/surgemq/session"
+	"go.uber.org/zap"
+)
+
+const defaultDeadLetterBuffer = 1024
+
+// DeadLetterConfig republishing of messages broker gave up delivering to clients
+type DeadLetterConfig struct {
+	// Topic prefix dead letters are published under as <Topic>/<reason> where reason is
+	// one of retries, queue or expired, e.g. $DLQ. Clients of virtual hosts see dead letters
+	// only if topic is within their namespace
+	Topic string
+
+	// QoS of dead letters
+	QoS message.QosType
+
+	// Buffer amount of dead letters waiting for publish, further ones are discarded
+	// If not set then default to 1024
+	Buffer int
+}
+
+// DeadLetter payload of dead letter message. MQTT 3.1.1 has no message properties thus
+// metadata is carried along with original payload in JSON
+type DeadLetter struct {
+	ClientID string    `json:"client_id"`
+	Topic    string    `json:"topic"`
+	QoS      byte      `json:"qos"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+	Payload  []byte    `json:"payload"`
+}
+
+type undelivered struct {
+	id     string
+	msg    *message.PublishMessage
+	reason error
+	at     time.Time
+}
+
+// deadLetterReason topic level of reason message has not been delivered
+func deadLetterReason(err error) string {
+	switch err {
+	case session.ErrRetriesExhausted:
+		return "retries"
+	case session.ErrQueueFull:
+		return "queue"
+	case persistTypes.ErrExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// undelivered queue message given up by session or persistence. Never blocks as it is
+// called with session locks held
+func (s *implementation) undelivered(id string, msg *message.PublishMessage, reason error) {
+	u := undelivered{id: id, msg: msg, reason: reason, at: time.Now()}
+
+	if s.inner.events.queue != nil {
+		s.dropped(&u)
+	}
+
+	if s.inner.deadLetters.queue == nil {
+		return
+	}
+
+	select {
+	case s.inner.deadLetters.queue <- u:
+	default:
+		s.log.Prod.Warn("Dead letter discarded", zap.String("ClientID", id), zap.String("topic", msg.Topic()))
+	}
+}
+
+// deadLetterWorker report undelivered messages to callback and dead letter topic
+func (s *implementation) deadLetterWorker() {
+	defer s.inner.deadLetters.wg.Done()
+
+	for {
+		select {
+		case <-s.inner.quit:
+			return
+		case u := <-s.inner.deadLetters.queue:
+			if s.inner.config.OnUndelivered != nil {
+				s.inner.config.OnUndelivered(u.id, u.msg, u.reason)
+			}
+
+			if s.inner.config.DeadLetter != nil {
+				s.publishDeadLetter(s.inner.config.DeadLetter, &u)
+			}
+		}
+	}
+}
+
+func (s *implementation) publishDeadLetter(cfg *DeadLetterConfig, u *undelivered) {
+	// dead letters of dead letters would loop
+	if strings.HasPrefix(u.msg.Topic(), cfg.Topic+"/") {
+		return
+	}
+
+	reason := deadLetterReason(u.reason)
+
+	payload, err := json.Marshal(&DeadLetter{
+		ClientID: u.id,
+		Topic:    u.msg.Topic(),
+		QoS:      byte(u.msg.QoS()),
+		Reason:   reason,
+		Time:     u.at.UTC(),
+		Payload:  u.msg.Payload(),
+	})
+	if err != nil {
+		s.log.Prod.Error("Couldn't encode dead letter", zap.Error(err))
+		return
+	}
+
+	msg := message.NewPublishMessage()
+	if err = msg.SetTopic(cfg.Topic + "/" + reason); err != nil {
+		s.log.Prod.Error("Invalid dead letter topic", zap.String("topic", cfg.Topic), zap.Error(err))
+		return
+	}
+
+	msg.SetQoS(cfg.QoS) // nolint: errcheck
+	msg.SetPayload(payload)
+
+	if err = s.inner.topicsMgr.Publish(msg); err != nil {
+		s.log.Prod.Error("Couldn't publish dead letter", zap.String("ClientID", u.id), zap.Error(err))
+	}
+}
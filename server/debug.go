@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"path"
+	"reflect"
+	"runtime"
+	runtimePprof "runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// ErrDebugCredentials debug listener configured without credentials
+var ErrDebugCredentials = errors.New("server: debug listener requires username and password")
+
+const debugRealm = "surgemq debug"
+
+// modulePath import path of broker module goroutines are attributed to subsystems by
+var modulePath = path.Dir(reflect.TypeOf(implementation{}).PkgPath())
+
+// DebugConfig HTTP listener serving net/http/pprof profiles under /debug/pprof/ and broker
+// diagnostics at /debug/surgemq. Every request requires HTTP basic authentication
+type DebugConfig struct {
+	// Addr host:port listener binds to, e.g. "127.0.0.1:6060"
+	Addr string
+
+	// Username and Password of basic authentication. Both are required
+	Username string
+	Password string
+}
+
+// Diagnostics runtime state of broker
+type Diagnostics struct {
+	// Goroutines total amount of goroutines
+	Goroutines int `json:"goroutines"`
+
+	// GoroutinesBySubsystem amount of goroutines by package of broker they have been
+	// started in, e.g. "session" or "persistence/boltdb". Others are counted as "other"
+	GoroutinesBySubsystem map[string]int `json:"goroutines_by_subsystem"`
+
+	// Sessions queues of connected and suspended sessions, longest queue first
+	Sessions []SessionQueues `json:"sessions"`
+}
+
+// SessionQueues depths of publisher and ack queues of session
+type SessionQueues struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+
+	// Queued messages waiting in publisher queue
+	Queued int `json:"queued"`
+
+	// InFlightIn QoS 2 messages received and awaiting release
+	InFlightIn int `json:"in_flight_in"`
+
+	// InFlightOut QoS 1/2 messages sent and awaiting acknowledge
+	InFlightOut int `json:"in_flight_out"`
+}
+
+// Diagnostics snapshot of goroutines and queues of sessions
+func (s *implementation) Diagnostics() Diagnostics {
+	d := Diagnostics{
+		Goroutines:            runtime.NumGoroutine(),
+		GoroutinesBySubsystem: goroutinesBySubsystem(),
+		Sessions:              []SessionQueues{},
+	}
+
+	if s.inner.sessionsMgr != nil {
+		for _, i := range s.inner.sessionsMgr.MemorySessions() {
+			d.Sessions = append(d.Sessions, SessionQueues{
+				ID:          i.ID,
+				State:       i.State.String(),
+				Queued:      i.Queued,
+				InFlightIn:  i.InFlightIn,
+				InFlightOut: i.InFlightOut,
+			})
+		}
+	}
+
+	sort.Slice(d.Sessions, func(i, j int) bool {
+		if d.Sessions[i].Queued != d.Sessions[j].Queued {
+			return d.Sessions[i].Queued > d.Sessions[j].Queued
+		}
+
+		return d.Sessions[i].ID < d.Sessions[j].ID
+	})
+
+	return d
+}
+
+// goroutinesBySubsystem count goroutines by package of function they have been started with
+func goroutinesBySubsystem() map[string]int {
+	res := make(map[string]int)
+
+	var buf bytes.Buffer
+	if err := runtimePprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return res
+	}
+
+	// profile lists stacks as "<count> @ <pcs>" followed by "#" frame lines, outermost last
+	count := 0
+	entry := ""
+
+	flush := func() {
+		if count > 0 {
+			res[goroutineSubsystem(entry)] += count
+		}
+		count, entry = 0, ""
+	}
+
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		line := sc.Text()
+
+		switch {
+		case strings.HasPrefix(line, "#"):
+			if fields := strings.Fields(line); len(fields) >= 3 {
+				entry = fields[2]
+			}
+		case strings.Contains(line, " @ "):
+			flush()
+			count, _ = strconv.Atoi(line[:strings.IndexByte(line, ' ')]) // nolint: errcheck
+		}
+	}
+	flush()
+
+	return res
+}
+
+// goroutineSubsystem package of function relative to broker module
+func goroutineSubsystem(fn string) string {
+	if i := strings.LastIndexByte(fn, '+'); i >= 0 {
+		fn = fn[:i]
+	}
+
+	if !strings.HasPrefix(fn, modulePath) {
+		return "other"
+	}
+
+	fn = fn[len(modulePath):]
+
+	switch {
+	case strings.HasPrefix(fn, "."):
+		return path.Base(modulePath)
+	case strings.HasPrefix(fn, "/"):
+		fn = fn[1:]
+		slash := strings.LastIndexByte(fn, '/') + 1
+		if dot := strings.IndexByte(fn[slash:], '.'); dot >= 0 {
+			return fn[:slash+dot]
+		}
+		return fn
+	default:
+		return "other"
+	}
+}
+
+// DiagnosticsHandler handler serving Diagnostics in JSON
+func (s *implementation) DiagnosticsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		if err := enc.Encode(s.Diagnostics()); err != nil {
+			s.log.Dev.Debug("Couldn't write diagnostics", zap.String("RemoteAddr", r.RemoteAddr), zap.Error(err))
+		}
+	})
+}
+
+// basicAuth require credentials of config on every request
+func basicAuth(config *DebugConfig, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+
+		// compare both to not reveal which one mismatched by timing
+		userOk := subtle.ConstantTimeCompare([]byte(user), []byte(config.Username)) == 1
+		passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(config.Password)) == 1
+
+		if !ok || !userOk || !passOk {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+debugRealm+`"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// startDebug listen on debug endpoint. Served until server is closed
+func (s *implementation) startDebug(config *DebugConfig) error {
+	if config.Username == "" || config.Password == "" {
+		return ErrDebugCredentials
+	}
+
+	ln, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/surgemq", s.DiagnosticsHandler())
+
+	srv := &http.Server{Handler: basicAuth(config, mux)}
+
+	s.inner.debug.wg.Add(2)
+	go func() {
+		defer s.inner.debug.wg.Done()
+
+		if e := srv.Serve(ln); e != nil && e != http.ErrServerClosed {
+			s.log.Prod.Error("Debug endpoint stopped", zap.Error(e))
+		}
+	}()
+
+	go func() {
+		defer s.inner.debug.wg.Done()
+
+		<-s.inner.quit
+
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+
+		srv.Shutdown(ctx) // nolint: errcheck, gas
+	}()
+
+	s.log.Prod.Info("Debug endpoint started", zap.String("addr", ln.Addr().String()))
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/session"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultEventsTopic  = "$SYS/broker/events"
+	defaultEventsBuffer = 1024
+)
+
+// Kinds of client events, published as last level of events topic
+const (
+	EventConnected    = "connected"
+	EventDisconnected = "disconnected"
+	EventSubscribed   = "subscribed"
+	EventUnsubscribed = "unsubscribed"
+	EventDropped      = "dropped"
+	EventAlarmRaised  = "alarm_raised"
+	EventAlarmCleared = "alarm_cleared"
+)
+
+// EventsConfig publishing of client lifecycle events as JSON messages
+type EventsConfig struct {
+	// Topic prefix events are published under as <Topic>/<kind> where kind is one of
+	// connected, disconnected, subscribed, unsubscribed, dropped, alarm_raised or alarm_cleared
+	// If not set then default to $SYS/broker/events
+	Topic string
+
+	// QoS of events
+	QoS message.QosType
+
+	// Buffer amount of events waiting for publish, further ones are discarded
+	// If not set then default to 1024
+	Buffer int
+}
+
+// Event payload of event message. Client id and topics include namespace of virtual host
+type Event struct {
+	Event    string    `json:"event"`
+	ClientID string    `json:"client_id"`
+	Username string    `json:"username,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Topic    string    `json:"topic,omitempty"`
+	QoS      byte      `json:"qos"`
+	Time     time.Time `json:"time"`
+
+	// Value of alarm, e.g. queue depth
+	Value int `json:"value,omitempty"`
+}
+
+// eventsHook turns hooks of sessions into events
+type eventsHook struct {
+	session.HooksBase
+	s *implementation
+}
+
+func (h *eventsHook) OnConnect(id string, msg *message.ConnectMessage) error {
+	h.s.event(&Event{Event: EventConnected, ClientID: id, Username: string(msg.Username())})
+	return nil
+}
+
+func (h *eventsHook) OnDisconnect(id string, reason session.DisconnectReason) {
+	h.s.event(&Event{Event: EventDisconnected, ClientID: id, Reason: reason.String()})
+}
+
+func (h *eventsHook) OnSubscribe(id string, topic string, qos message.QosType) (message.QosType, error) {
+	h.s.event(&Event{Event: EventSubscribed, ClientID: id, Topic: topic, QoS: byte(qos)})
+	return qos, nil
+}
+
+func (h *eventsHook) OnUnsubscribe(id string, topic string) {
+	h.s.event(&Event{Event: EventUnsubscribed, ClientID: id, Topic: topic})
+}
+
+// dropped queue event of message given up on delivering to client
+func (s *implementation) dropped(u *undelivered) {
+	// drops of events would loop
+	if strings.HasPrefix(u.msg.Topic(), s.inner.events.topic+"/") {
+		return
+	}
+
+	s.event(&Event{
+		Event:    EventDropped,
+		ClientID: u.id,
+		Reason:   deadLetterReason(u.reason),
+		Topic:    u.msg.Topic(),
+		QoS:      byte(u.msg.QoS()),
+	})
+}
+
+// event queue event for publish. Never blocks as it is called from connection routines
+func (s *implementation) event(e *Event) {
+	e.Time = time.Now().UTC()
+
+	select {
+	case s.inner.events.queue <- e:
+	default:
+		s.log.Prod.Warn("Event discarded", zap.String("event", e.Event), zap.String("ClientID", e.ClientID))
+	}
+}
+
+// eventsWorker publish queued events
+func (s *implementation) eventsWorker(cfg *EventsConfig) {
+	defer s.inner.events.wg.Done()
+
+	for {
+		select {
+		case <-s.inner.quit:
+			return
+		case e := <-s.inner.events.queue:
+			s.publishEvent(cfg, e)
+		}
+	}
+}
+
+func (s *implementation) publishEvent(cfg *EventsConfig, e *Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		s.log.Prod.Error("Couldn't encode event", zap.Error(err))
+		return
+	}
+
+	msg := message.NewPublishMessage()
+	if err = msg.SetTopic(s.inner.events.topic + "/" + e.Event); err != nil {
+		s.log.Prod.Error("Invalid events topic", zap.String("topic", s.inner.events.topic), zap.Error(err))
+		return
+	}
+
+	msg.SetQoS(cfg.QoS) // nolint: errcheck
+	msg.SetPayload(payload)
+
+	if err = s.inner.topicsMgr.Publish(msg); err != nil {
+		s.log.Prod.Error("Couldn't publish event", zap.String("event", e.Event), zap.Error(err))
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	persistTypes "github.com/troian/surgemq/persistence/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHealthCheckInterval = 5 * time.Second
+
+	// alarmPersistence raised in systree while persistence backend is unreachable
+	alarmPersistence = "persistence"
+)
+
+// healthWorker periodically check persistence backend and switch server into degraded
+// mode when it is unreachable. In degraded mode only clean-session clients are accepted
+func (s *implementation) healthWorker(interval time.Duration) {
+	defer s.inner.health.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.inner.quit:
+			return
+		case <-ticker.C:
+			s.checkHealth()
+		}
+	}
+}
+
+func (s *implementation) checkHealth() {
+	err := persistTypes.CheckHealth(s.inner.persist)
+
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&s.inner.health.degraded, 0, 1) {
+			s.log.Prod.Error("Persistence unreachable, accepting clean sessions only", zap.Error(err))
+			s.setAlarm(alarmPersistence, true, "", 0)
+		}
+	} else if atomic.CompareAndSwapInt32(&s.inner.health.degraded, 1, 0) {
+		s.log.Prod.Info("Persistence recovered")
+		s.setAlarm(alarmPersistence, false, "", 0)
+	}
+}
+
+// degraded either persistence backend is unreachable
+func (l *listenerInner) degraded() bool {
+	return atomic.LoadInt32(&l.health.degraded) == 1
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net"
+
+	"github.com/troian/surgemq/ratelimit"
+)
+
+// initLimits allocate rate limiters and address filters configured for the listener
+func (l *ListenerBase) initLimits() error {
+	var err error
+
+	if l.limits.allow, err = parseNets(l.AllowCIDR); err != nil {
+		return err
+	}
+
+	if l.limits.deny, err = parseNets(l.DenyCIDR); err != nil {
+		return err
+	}
+
+	l.limits.accept = nil
+	if l.AcceptRate > 0 {
+		l.limits.accept = ratelimit.NewBucket(l.AcceptRate, l.AcceptBurst)
+	}
+
+	l.limits.connect = nil
+	if l.ConnectRatePerIP > 0 {
+		l.limits.connect = ratelimit.NewKeyed(l.ConnectRatePerIP, l.ConnectBurstPerIP)
+	}
+
+	return nil
+}
+
+// addrAllowed check source address against allow and deny lists of listener and bans
+func (l *ListenerBase) addrAllowed(addr net.Addr) bool {
+	ip := hostIP(addr)
+	if ip == nil {
+		// non IP transports, e.g. in-memory, are not filtered
+		return true
+	}
+
+	if len(l.limits.allow) > 0 && !containsIP(l.limits.allow, ip) {
+		return false
+	}
+
+	if containsIP(l.limits.deny, ip) {
+		return false
+	}
+
+	return !l.inner.bans.ipBanned(ip)
+}
+
+// acceptAllowed check if new connection fits into listener accept rate
+func (l *ListenerBase) acceptAllowed() bool {
+	if l.limits.accept == nil {
+		return true
+	}
+
+	return l.limits.accept.Allow()
+}
+
+// connectAllowed check if CONNECT from given address fits into per IP rate
+func (l *ListenerBase) connectAllowed(addr net.Addr) bool {
+	if l.limits.connect == nil || addr == nil {
+		return true
+	}
+
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return l.limits.connect.Allow(host)
+}
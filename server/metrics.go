@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMetricsPath = "/metrics"
+
+	metricsShutdownTimeout = 5 * time.Second
+)
+
+// MetricsConfig HTTP endpoint exporting broker statistics in Prometheus text format
+// Liveness and readiness probes are served at /healthz and /readyz, Stats in JSON at /stats
+type MetricsConfig struct {
+	// Addr host:port endpoint listens on, e.g. ":9090"
+	Addr string
+
+	// Path metrics are served at. If not set then default to /metrics
+	Path string
+}
+
+// MetricsHandler handler serving broker statistics in Prometheus text format, e.g. for
+// mounting into HTTP server of application embedding broker
+func (s *implementation) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		if err := s.inner.sysTree.WritePrometheus(w); err != nil {
+			s.log.Dev.Debug("Couldn't write metrics", zap.String("RemoteAddr", r.RemoteAddr), zap.Error(err))
+		}
+	})
+}
+
+// startMetrics listen on metrics endpoint. Served until server is closed
+func (s *implementation) startMetrics(config *MetricsConfig) error {
+	path := config.Path
+	if path == "" {
+		path = defaultMetricsPath
+	}
+
+	ln, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, s.MetricsHandler())
+	mux.Handle(healthPath, s.HealthHandler())
+	mux.Handle(readyPath, s.ReadyHandler())
+	mux.Handle(statsPath, s.StatsHandler())
+
+	srv := &http.Server{Handler: mux}
+
+	s.inner.metrics.wg.Add(2)
+	go func() {
+		defer s.inner.metrics.wg.Done()
+
+		if e := srv.Serve(ln); e != nil && e != http.ErrServerClosed {
+			s.log.Prod.Error("Metrics endpoint stopped", zap.Error(e))
+		}
+	}()
+
+	go func() {
+		defer s.inner.metrics.wg.Done()
+
+		<-s.inner.quit
+
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+
+		srv.Shutdown(ctx) // nolint: errcheck, gas
+	}()
+
+	s.log.Prod.Info("Metrics endpoint started", zap.String("addr", ln.Addr().String()), zap.String("path", path))
+
+	return nil
+}
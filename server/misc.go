@@ -18,7 +18,6 @@ package server
 import (
 	"encoding/binary"
 	"io"
-	"net"
 
 	"errors"
 
@@ -47,7 +46,7 @@ func GetMessageBuffer(c io.Closer) ([]byte, error) {
 		return nil, types.ErrInvalidConnectionType
 	}
 
-	conn, ok := c.(net.Conn)
+	conn, ok := c.(io.Reader)
 	if !ok {
 		return nil, types.ErrInvalidConnectionType
 	}
@@ -105,7 +104,7 @@ func WriteMessageBuffer(c io.Closer, b []byte) error {
 		return types.ErrInvalidConnectionType
 	}
 
-	conn, ok := c.(net.Conn)
+	conn, ok := c.(io.Writer)
 	if !ok {
 		return types.ErrInvalidConnectionType
 	}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troian/surgemq/audit"
+	"github.com/troian/surgemq/message"
+	"go.uber.org/zap"
+)
+
+const defaultPacketTraceBuffer = 1024
+
+// PacketTraceConfig publishing of packets of traced clients, see TracePackets
+type PacketTraceConfig struct {
+	// Topic prefix packets are published under as <Topic>/<client id>, e.g. $SYS/broker/trace
+	// Packets are only logged if not set
+	Topic string
+
+	// QoS of published packets
+	QoS message.QosType
+
+	// Buffer amount of packets waiting for publish, further ones are discarded
+	// If not set then default to 1024
+	Buffer int
+}
+
+// Packet control packet of traced client with decoded header
+type Packet struct {
+	ClientID string    `json:"client_id"`
+	Incoming bool      `json:"incoming"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Flags    byte      `json:"flags"`
+
+	// RemainingLength of fixed header
+	RemainingLength int32 `json:"remaining_length"`
+
+	PacketID uint16 `json:"packet_id,omitempty"`
+
+	// Fields of variable header and payload by packet type. Password of CONNECT is
+	// never reported
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// packetHeader fixed header of every packet
+type packetHeader interface {
+	Flags() byte
+	RemainingLength() int32
+}
+
+// newPacket decode packet for trace. Payloads are copied as buffers of received
+// packets are reused
+func newPacket(id string, incoming bool, msg message.Provider) *Packet {
+	p := &Packet{
+		ClientID: id,
+		Incoming: incoming,
+		Time:     time.Now().UTC(),
+		Type:     msg.Type().Name(),
+		PacketID: msg.PacketID(),
+	}
+
+	if h, ok := msg.(packetHeader); ok {
+		p.Flags = h.Flags()
+		p.RemainingLength = h.RemainingLength()
+	}
+
+	switch m := msg.(type) {
+	case *message.ConnectMessage:
+		p.Fields = map[string]interface{}{
+			"version":       m.Version(),
+			"client_id":     string(m.ClientID()),
+			"clean_session": m.CleanSession(),
+			"keep_alive":    m.KeepAlive(),
+			"username":      string(m.Username()),
+			"password":      m.PasswordFlag(),
+		}
+
+		if m.WillFlag() {
+			p.Fields["will_topic"] = m.WillTopic()
+			p.Fields["will_qos"] = m.WillQos()
+			p.Fields["will_retain"] = m.WillRetain()
+			p.Fields["will_payload"] = append([]byte(nil), m.WillMessage()...)
+		}
+	case *message.ConnAckMessage:
+		p.Fields = map[string]interface{}{
+			"session_present": m.SessionPresent(),
+			"return_code":     m.ReturnCode().Value(),
+			"return_desc":     m.ReturnCode().Desc(),
+		}
+	case *message.PublishMessage:
+		p.Fields = map[string]interface{}{
+			"topic":   m.Topic(),
+			"qos":     m.QoS(),
+			"dup":     m.Dup(),
+			"retain":  m.Retain(),
+			"payload": append([]byte(nil), m.Payload()...),
+		}
+	case *message.SubscribeMessage:
+		topics := make(map[string]message.QosType, len(m.Topics()))
+		for _, t := range m.Topics() {
+			topics[t] = m.TopicQos(t)
+		}
+		p.Fields = map[string]interface{}{"topics": topics}
+	case *message.SubAckMessage:
+		p.Fields = map[string]interface{}{"return_codes": m.ReturnCodes()}
+	case *message.UnSubscribeMessage:
+		p.Fields = map[string]interface{}{"topics": m.Topics()}
+	}
+
+	return p
+}
+
+// onPacket report packet of traced client. Invoked with write lock of connection held
+// thus publish is deferred to worker
+func (s *implementation) onPacket(id string, incoming bool, msg message.Provider) {
+	p := newPacket(id, incoming, msg)
+
+	s.inner.packets.log.Info("Packet",
+		zap.String("ClientID", id),
+		zap.Bool("incoming", incoming),
+		zap.String("type", p.Type),
+		zap.Uint8("flags", p.Flags),
+		zap.Int32("remainingLength", p.RemainingLength),
+		zap.Uint16("packetID", p.PacketID),
+		zap.Any("fields", p.Fields))
+
+	if s.inner.packets.queue == nil {
+		return
+	}
+
+	// traces of packets carrying traces would loop
+	if m, ok := msg.(*message.PublishMessage); ok && strings.HasPrefix(m.Topic(), s.inner.config.PacketTrace.Topic+"/") {
+		return
+	}
+
+	select {
+	case s.inner.packets.queue <- p:
+	default:
+		s.log.Prod.Warn("Traced packet discarded", zap.String("ClientID", id))
+	}
+}
+
+// packetTraceWorker publish packets of traced clients
+func (s *implementation) packetTraceWorker(cfg *PacketTraceConfig) {
+	defer s.inner.packets.wg.Done()
+
+	for {
+		select {
+		case <-s.inner.quit:
+			return
+		case p := <-s.inner.packets.queue:
+			s.publishPacket(cfg, p)
+		}
+	}
+}
+
+func (s *implementation) publishPacket(cfg *PacketTraceConfig, p *Packet) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		s.log.Prod.Error("Couldn't encode traced packet", zap.Error(err))
+		return
+	}
+
+	msg := message.NewPublishMessage()
+	if err = msg.SetTopic(cfg.Topic + "/" + p.ClientID); err != nil {
+		s.log.Prod.Error("Invalid packet trace topic", zap.String("ClientID", p.ClientID), zap.Error(err))
+		return
+	}
+
+	msg.SetQoS(cfg.QoS) // nolint: errcheck
+	msg.SetPayload(payload)
+
+	if err = s.inner.topicsMgr.Publish(msg); err != nil {
+		s.log.Prod.Error("Couldn't publish traced packet", zap.String("ClientID", p.ClientID), zap.Error(err))
+	}
+}
+
+// TracePackets enable or disable tracing of control packets of client
+func (s *implementation) TracePackets(id string, on bool) {
+	s.inner.sessionsMgr.TracePackets(id, on)
+
+	s.log.Prod.Info("Packet tracing", zap.String("ClientID", id), zap.Bool("enabled", on))
+	s.auditAdmin(audit.ActionTrace, nil, audit.Record{ClientID: id, Detail: strconv.FormatBool(on)})
+}
+
+// TracedClients ids of clients packets are traced of
+func (s *implementation) TracedClients() []string {
+	return s.inner.sessionsMgr.TracedClients()
+}
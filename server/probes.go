@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	persistTypes "github.com/troian/surgemq/persistence/types"
+	"go.uber.org/zap"
+)
+
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+)
+
+// States reported by Health
+const (
+	HealthOK          = "ok"
+	HealthDegraded    = "degraded"
+	HealthStopped     = "stopped"
+	HealthUnavailable = "unavailable"
+)
+
+// Health state of broker reported by probes
+// Broker is alive unless listener stopped while server is running. It is ready once
+// alive, at least one listener is serving, persistence is reachable and server is
+// not closed
+type Health struct {
+	// Status ok or unavailable
+	Status string `json:"status"`
+
+	// Ready either broker accepts clients
+	Ready bool `json:"ready"`
+
+	// Listeners state by address, ok or stopped
+	Listeners map[string]string `json:"listeners"`
+
+	// Persistence ok or degraded
+	Persistence string `json:"persistence"`
+}
+
+// serving notify listener started or stopped serving
+func (l *ListenerBase) serving(addr string, up bool) {
+	l.inner.health.lock.Lock()
+	l.inner.health.listeners[addr] = up
+	l.inner.health.lock.Unlock()
+
+	if l.inner.config.ListenerStatus != nil {
+		l.inner.config.ListenerStatus(addr, up)
+	}
+}
+
+// Health state of listeners and persistence backend
+func (s *implementation) Health() Health {
+	h := Health{
+		Status:      HealthOK,
+		Listeners:   make(map[string]string),
+		Persistence: HealthOK,
+	}
+
+	closed := false
+	select {
+	case <-s.inner.quit:
+		closed = true
+	default:
+	}
+
+	serving := 0
+
+	s.inner.health.lock.Lock()
+	for addr, up := range s.inner.health.listeners {
+		if up {
+			h.Listeners[addr] = HealthOK
+			serving++
+		} else {
+			h.Listeners[addr] = HealthStopped
+		}
+	}
+	s.inner.health.lock.Unlock()
+
+	if !closed && serving < len(h.Listeners) {
+		h.Status = HealthUnavailable
+	}
+
+	// without health worker backend is checked on demand
+	if s.inner.config.HealthCheckInterval > 0 {
+		if s.inner.degraded() {
+			h.Persistence = HealthDegraded
+		}
+	} else if s.inner.persist != nil && persistTypes.CheckHealth(s.inner.persist) != nil {
+		h.Persistence = HealthDegraded
+	}
+
+	h.Ready = !closed && h.Status == HealthOK && serving > 0 && h.Persistence == HealthOK
+
+	return h
+}
+
+// HealthHandler liveness probe responding 503 Service Unavailable once broker is not alive
+func (s *implementation) HealthHandler() http.Handler {
+	return s.probeHandler(func(h *Health) bool { return h.Status == HealthOK })
+}
+
+// ReadyHandler readiness probe responding 503 Service Unavailable while broker is not ready
+func (s *implementation) ReadyHandler() http.Handler {
+	return s.probeHandler(func(h *Health) bool { return h.Ready })
+}
+
+// probeHandler respond with Health in JSON and status by passed check
+func (s *implementation) probeHandler(ok func(h *Health) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		h := s.Health()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		if !ok(&h) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		if err := json.NewEncoder(w).Encode(&h); err != nil {
+			s.log.Dev.Debug("Couldn't write health", zap.String("RemoteAddr", r.RemoteAddr), zap.Error(err))
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol header as described at
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+)
+
+const (
+	// proxyV1MaxLength maximum length of v1 header including CRLF
+	proxyV1MaxLength = 107
+
+	// DefaultProxyHeaderTimeout time given to load balancer to send PROXY header
+	DefaultProxyHeaderTimeout = 5 * time.Second
+)
+
+var (
+	// ErrProxyHeaderInvalid PROXY header could not be parsed
+	ErrProxyHeaderInvalid = errors.New("invalid PROXY protocol header")
+
+	// ErrProxyHeaderMissing connection does not start with PROXY header
+	ErrProxyHeaderMissing = errors.New("PROXY protocol header missing")
+)
+
+// proxyConn wraps accepted connection and reports addresses received in PROXY header
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads PROXY protocol v1 or v2 header from the connection and returns
+// connection reporting original client address
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout == 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout)) // nolint: errcheck, gas
+	defer conn.SetReadDeadline(time.Time{})       // nolint: errcheck
+
+	pc := &proxyConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	sig, err := pc.r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(sig, proxyV1Prefix) {
+		err = pc.readV1()
+	} else {
+		if sig, err = pc.r.Peek(len(proxyV2Signature)); err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(sig, proxyV2Signature) {
+			return nil, ErrProxyHeaderMissing
+		}
+
+		err = pc.readV2()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
+
+// readV1 parses human readable header
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func (c *proxyConn) readV1() error {
+	var line []byte
+
+	for len(line) < proxyV1MaxLength {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrProxyHeaderInvalid
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return ErrProxyHeaderInvalid
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		// keep addresses of the real connection
+		return nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return ErrProxyHeaderInvalid
+		}
+	default:
+		return ErrProxyHeaderInvalid
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil {
+		return ErrProxyHeaderInvalid
+	}
+
+	srcPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return ErrProxyHeaderInvalid
+	}
+
+	dstPort, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return ErrProxyHeaderInvalid
+	}
+
+	c.remote = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	c.local = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+
+	return nil
+}
+
+// readV2 parses binary header
+func (c *proxyConn) readV2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return err
+	}
+
+	// upper 4 bits is version, lower is command
+	if hdr[12]>>4 != 0x2 {
+		return ErrProxyHeaderInvalid
+	}
+
+	cmd := hdr[12] & 0x0F
+	family := hdr[13]
+
+	addrs := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.r, addrs); err != nil {
+		return err
+	}
+
+	// LOCAL command means connection established by proxy itself (e.g. health check)
+	if cmd == 0x0 {
+		return nil
+	}
+
+	if cmd != 0x1 {
+		return ErrProxyHeaderInvalid
+	}
+
+	var ipLen int
+
+	switch family {
+	case 0x11, 0x12: // TCP/UDP over IPv4
+		ipLen = net.IPv4len
+	case 0x21, 0x22: // TCP/UDP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// unix sockets and unspecified families carry nothing useful for us
+		return nil
+	}
+
+	if len(addrs) < ipLen*2+4 {
+		return ErrProxyHeaderInvalid
+	}
+
+	srcIP := net.IP(addrs[:ipLen])
+	dstIP := net.IP(addrs[ipLen : ipLen*2])
+	srcPort := binary.BigEndian.Uint16(addrs[ipLen*2:])
+	dstPort := binary.BigEndian.Uint16(addrs[ipLen*2+2:])
+
+	c.remote = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	c.local = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+
+	return nil
+}
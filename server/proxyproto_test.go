@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2 header of command and family followed by addrs
+func proxyV2(ver byte, family byte, addrs []byte) []byte {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, ver, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+
+	return append(hdr, addrs...)
+}
+
+// proxyAddrs source and destination addresses of v2 header
+func proxyAddrs(src, dst string, srcPort, dstPort uint16) []byte {
+	s, d := net.ParseIP(src), net.ParseIP(dst)
+	if s4 := s.To4(); s4 != nil {
+		s, d = s4, d.To4()
+	}
+
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, srcPort)
+	binary.BigEndian.PutUint16(ports[2:], dstPort)
+
+	return append(append(append([]byte{}, s...), d...), ports...)
+}
+
+// pipe of accepted connection whose peer writes data and closes unless keep is set
+func pipe(t *testing.T, data []byte, keep bool) net.Conn {
+	client, srv := net.Pipe()
+	t.Cleanup(func() {
+		client.Close() // nolint: errcheck
+		srv.Close()    // nolint: errcheck
+	})
+
+	go func() {
+		client.Write(data) // nolint: errcheck
+		if !keep {
+			client.Close() // nolint: errcheck
+		}
+	}()
+
+	return srv
+}
+
+func TestProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		remote string
+		local  string
+		err    error
+	}{
+		{
+			name:   "v1 tcp4",
+			header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"),
+			remote: "192.168.0.1:56324",
+			local:  "192.168.0.11:443",
+		},
+		{
+			name:   "v1 tcp6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			remote: "[2001:db8::1]:56324",
+			local:  "[2001:db8::2]:443",
+		},
+		{
+			name:   "v1 unknown",
+			header: []byte("PROXY UNKNOWN\r\n"),
+			remote: "pipe",
+			local:  "pipe",
+		},
+		{
+			name:   "v1 unknown with addresses",
+			header: []byte("PROXY UNKNOWN 192.168.0.1 192.168.0.11 56324 443\r\n"),
+			remote: "pipe",
+			local:  "pipe",
+		},
+		{name: "v1 unknown protocol", header: []byte("PROXY UDP4 192.168.0.1 192.168.0.11 56324 443\r\n"), err: ErrProxyHeaderInvalid},
+		{name: "v1 missing fields", header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n"), err: ErrProxyHeaderInvalid},
+		{name: "v1 no protocol", header: []byte("PROXY \r\n"), err: ErrProxyHeaderInvalid},
+		{name: "v1 bad address", header: []byte("PROXY TCP4 192.168.0 192.168.0.11 56324 443\r\n"), err: ErrProxyHeaderInvalid},
+		{name: "v1 bad port", header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 65536 443\r\n"), err: ErrProxyHeaderInvalid},
+		{name: "v1 bad destination port", header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 https\r\n"), err: ErrProxyHeaderInvalid},
+		{name: "v1 without cr", header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n"), err: ErrProxyHeaderInvalid},
+		{name: "v1 oversized", header: []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), err: ErrProxyHeaderInvalid},
+		{name: "v1 truncated", header: []byte("PROXY TCP4 192.168.0.1"), err: io.EOF},
+		{
+			name:   "v2 proxy tcp4",
+			header: proxyV2(0x21, 0x11, proxyAddrs("192.168.0.1", "192.168.0.11", 56324, 443)),
+			remote: "192.168.0.1:56324",
+			local:  "192.168.0.11:443",
+		},
+		{
+			name:   "v2 proxy tcp6",
+			header: proxyV2(0x21, 0x21, proxyAddrs("2001:db8::1", "2001:db8::2", 56324, 443)),
+			remote: "[2001:db8::1]:56324",
+			local:  "[2001:db8::2]:443",
+		},
+		{
+			name:   "v2 proxy with tlvs",
+			header: proxyV2(0x21, 0x11, append(proxyAddrs("192.168.0.1", "192.168.0.11", 56324, 443), 0x04, 0x00, 0x01, 0x00)),
+			remote: "192.168.0.1:56324",
+			local:  "192.168.0.11:443",
+		},
+		{
+			name:   "v2 local",
+			header: proxyV2(0x20, 0x11, proxyAddrs("192.168.0.1", "192.168.0.11", 56324, 443)),
+			remote: "pipe",
+			local:  "pipe",
+		},
+		{
+			name:   "v2 unix",
+			header: proxyV2(0x21, 0x31, make([]byte, 216)),
+			remote: "pipe",
+			local:  "pipe",
+		},
+		{name: "v2 bad version", header: proxyV2(0x11, 0x11, proxyAddrs("192.168.0.1", "192.168.0.11", 56324, 443)), err: ErrProxyHeaderInvalid},
+		{name: "v2 bad command", header: proxyV2(0x22, 0x11, proxyAddrs("192.168.0.1", "192.168.0.11", 56324, 443)), err: ErrProxyHeaderInvalid},
+		{name: "v2 short addresses", header: proxyV2(0x21, 0x21, proxyAddrs("192.168.0.1", "192.168.0.11", 56324, 443)), err: ErrProxyHeaderInvalid},
+		{name: "v2 truncated header", header: proxyV2(0x21, 0x11, nil)[:14], err: io.ErrUnexpectedEOF},
+		{name: "v2 truncated addresses", header: proxyV2(0x21, 0x11, proxyAddrs("192.168.0.1", "192.168.0.11", 56324, 443))[:22], err: io.ErrUnexpectedEOF},
+		{name: "truncated signature", header: proxyV2Signature[:8], err: io.EOF},
+		{name: "bad signature", header: []byte("GET / HTTP/1.1\r\n\r\n"), err: ErrProxyHeaderMissing},
+		{name: "mqtt connect", header: []byte{0x10, 0x0c, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c, 0x00, 0x00}, err: ErrProxyHeaderMissing},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.header
+			if tt.err == nil {
+				data = append(append([]byte{}, data...), "payload"...)
+			}
+
+			conn, err := readProxyHeader(pipe(t, data, false), time.Second)
+			require.Equal(t, tt.err, err)
+
+			if tt.err != nil {
+				require.Nil(t, conn)
+				return
+			}
+
+			require.Equal(t, tt.remote, conn.RemoteAddr().String())
+			require.Equal(t, tt.local, conn.LocalAddr().String())
+
+			// data following header is not consumed
+			payload, err := ioutil.ReadAll(conn)
+			require.NoError(t, err)
+			require.Equal(t, "payload", string(payload))
+		})
+	}
+}
+
+func TestProxyHeaderTimeout(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close() // nolint: errcheck
+	defer srv.Close()    // nolint: errcheck
+
+	_, err := readProxyHeader(srv, 20*time.Millisecond)
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded), "%v", err)
+
+	// deadline of header is cleared once it is read
+	conn := pipe(t, []byte("PROXY UNKNOWN\r\n"), true)
+
+	conn, err = readProxyHeader(conn, 20*time.Millisecond)
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		require.Fail(t, "read ended before data arrived", "%v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/session"
+	"go.uber.org/zap"
+)
+
+// ErrServerClosed server has been closed
+var ErrServerClosed = errors.New("server closed")
+
+// Publish deliver message to subscribers as if it came from client connected to broker
+// If retain is set message replaces retained one of topic, empty payload removes it
+func (s *implementation) Publish(topic string, qos message.QosType, retain bool, payload []byte) error {
+	select {
+	case <-s.inner.quit:
+		return ErrServerClosed
+	default:
+	}
+
+	if s.inner.config.MaxQoS != nil && qos > *s.inner.config.MaxQoS {
+		return session.ErrQoSNotSupported
+	}
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic(topic); err != nil {
+		return err
+	}
+
+	if err := msg.SetQoS(qos); err != nil {
+		return err
+	}
+
+	msg.SetPayload(payload)
+
+	// [MQTT-3.3.1.3]
+	if retain {
+		msg.SetRetain(true)
+		if err := s.inner.topicsMgr.Retain(msg); err != nil {
+			s.log.Prod.Error("Couldn't retain message", zap.String("topic", topic), zap.Error(err))
+			return err
+		}
+
+		// [MQTT-3.3.1-9]
+		msg.SetRetain(false)
+	}
+
+	return s.inner.topicsMgr.Publish(msg)
+}
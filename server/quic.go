@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+// ALPN protocol negotiated by MQTT over QUIC clients
+const quicNextProto = "mqtt"
+
+// ListenerQUIC listener object for QUIC server
+// EXPERIMENTAL: each QUIC connection carries single MQTT session on the first
+// bidirectional stream opened by the client
+type ListenerQUIC struct {
+	ListenerBase
+
+	Host string
+
+	// MaxIdleTimeout closes connection if peer has not sent anything within given duration
+	// If not set keep alive of the session is used
+	MaxIdleTimeout time.Duration
+
+	listener  *quic.Listener
+	tlsConfig *tls.Config
+}
+
+func (l *ListenerQUIC) start() error {
+	select {
+	case <-l.inner.quit:
+		return nil
+	default:
+	}
+
+	defer l.inner.lock.Unlock()
+	l.inner.lock.Lock()
+
+	if _, ok := l.inner.listeners.list[l.address()]; ok {
+		return errors.New("Listener already exists")
+	}
+
+	if err := l.initLimits(); err != nil {
+		return err
+	}
+
+	var err error
+
+	if l.tlsConfig, err = l.newTLSConfig(); err != nil {
+		return err
+	}
+
+	// TLS is mandatory for QUIC
+	if l.tlsConfig == nil {
+		return errors.New("QUIC listener requires certificate")
+	}
+
+	l.tlsConfig.NextProtos = []string{quicNextProto}
+
+	qConfig := &quic.Config{
+		MaxIdleTimeout: l.MaxIdleTimeout,
+	}
+
+	if l.listener, err = quic.ListenAddr(l.Host+":"+strconv.Itoa(l.Port), l.tlsConfig, qConfig); err != nil {
+		return err
+	}
+
+	l.inner.listeners.list[l.address()] = l
+	l.inner.listeners.wg.Add(1)
+
+	go func() {
+		defer l.inner.listeners.wg.Done()
+
+		l.serving(l.address(), true)
+
+		if e := l.serve(); e != nil {
+			l.log.Prod.Error("Listener stopped", zap.Error(e))
+		}
+
+		l.serving(l.address(), false)
+	}()
+
+	return nil
+}
+
+func (l *ListenerQUIC) close() error {
+	l.stopCertificatesWatch()
+
+	return l.listener.Close()
+}
+
+func (l *ListenerQUIC) listenerProtocol() string {
+	return "udp"
+}
+
+func (l *ListenerQUIC) address() string {
+	return "quic://" + l.Host + ":" + strconv.Itoa(l.Port)
+}
+
+func (l *ListenerQUIC) serve() error {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			select {
+			case <-l.inner.quit:
+				return nil
+			default:
+			}
+
+			return err
+		}
+
+		if !l.acceptAllowed() {
+			l.log.Dev.Debug("Accept rate exceeded. Dropping connection", zap.String("RemoteAddr", conn.RemoteAddr().String()))
+			conn.CloseWithError(0, "") // nolint: errcheck, gas
+			continue
+		}
+
+		l.inner.wgConnections.Add(1)
+		go func(cn *quic.Conn) {
+			defer l.inner.wgConnections.Done()
+
+			// client must open stream within connect timeout
+			ctx, cancel := context.WithTimeout(cn.Context(), time.Second*time.Duration(l.inner.config.ConnectTimeout))
+			stream, err := cn.AcceptStream(ctx)
+			cancel()
+
+			if err != nil {
+				l.log.Prod.Error("Couldn't accept QUIC stream", zap.Error(err))
+				cn.CloseWithError(0, "") // nolint: errcheck, gas
+				return
+			}
+
+			if conn, err := types.NewConnQUIC(cn, stream, l.stat.Bytes()); err != nil {
+				l.log.Prod.Error("Couldn't create connection interface", zap.Error(err))
+			} else {
+				state := cn.ConnectionState().TLS
+				l.handleConnection(conn, &state)
+			}
+		}(conn)
+	}
+}
@@ -0,0 +1,526 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/troian/surgemq/audit"
+	"github.com/troian/surgemq/auth"
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/session"
+	"github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+// ErrRESTAddress REST listener configured without address
+var ErrRESTAddress = errors.New("server: REST listener requires address")
+
+const (
+	restTopicsPath = "/topics/"
+	restRealm      = "surgemq"
+
+	defaultRESTClientID    = "rest"
+	defaultRESTMaxPayload  = 256 * 1024
+	defaultRESTPollTimeout = 30 * time.Second
+	defaultRESTBuffer      = 256
+
+	// restPollLimit messages returned by long poll unless limit is requested
+	restPollLimit = 100
+
+	// restHeartbeat interval comment is sent with to idle event stream, thus proxies keep it open
+	restHeartbeat = 15 * time.Second
+)
+
+// RESTConfig HTTP API for backend services not using MQTT client library. Messages are
+// published by POST /topics/{topic} with payload in body and query parameters qos and retain
+// GET /topics/{filter} subscribes filter for duration of request: long poll returns JSON
+// array of messages once any arrives, while request accepting text/event-stream is streamed
+// server-sent events. Query parameter retained delivers retained messages first
+// Requests authenticate by HTTP basic authentication against auth providers of broker
+// as CONNECT does, ACLs of publishes and subscriptions are checked with client id passed
+// in query parameter client_id
+type RESTConfig struct {
+	// Addr host:port listener binds to, e.g. ":8080"
+	Addr string
+
+	// ClientID of requests not passing client_id. If not set then default to "rest"
+	ClientID string
+
+	// MaxPayload size of published body in bytes. If not set then default to 256KiB
+	MaxPayload int64
+
+	// PollTimeout longest wait of long poll, request may ask for shorter one with query
+	// parameter timeout in seconds. If not set then default to 30 seconds
+	PollTimeout time.Duration
+
+	// Buffer messages of subscription awaiting response, further ones are dropped
+	// If not set then default to 256
+	Buffer int
+}
+
+// RESTMessage message delivered to subscription. Retain is set for retained messages
+// delivered on subscribe, Time is when subscription received message
+type RESTMessage struct {
+	Topic   string    `json:"topic"`
+	QoS     byte      `json:"qos"`
+	Retain  bool      `json:"retain"`
+	Time    time.Time `json:"time"`
+	Payload []byte    `json:"payload"`
+}
+
+// restClient identity of request ACLs are checked with
+type restClient struct {
+	id   string
+	user string
+	auth *auth.Manager
+}
+
+// identity of client ACLs are checked for
+func (c *restClient) identity() auth.Client {
+	return auth.Client{ID: c.id, User: c.user}
+}
+
+type restAddr string
+
+func (a restAddr) Network() string {
+	return "tcp"
+}
+
+func (a restAddr) String() string {
+	return string(a)
+}
+
+func restMessage(msg *message.PublishMessage, retain bool) RESTMessage {
+	return RESTMessage{
+		Topic:   msg.Topic(),
+		QoS:     byte(msg.QoS()),
+		Retain:  retain,
+		Time:    time.Now().UTC(),
+		Payload: append([]byte(nil), msg.Payload()...),
+	}
+}
+
+// restConfig with defaults applied
+func (s *implementation) restConfig() RESTConfig {
+	var c RESTConfig
+	if s.inner.config.REST != nil {
+		c = *s.inner.config.REST
+	}
+
+	if c.ClientID == "" {
+		c.ClientID = defaultRESTClientID
+	}
+
+	if c.MaxPayload <= 0 {
+		c.MaxPayload = defaultRESTMaxPayload
+	}
+
+	if c.PollTimeout <= 0 {
+		c.PollTimeout = defaultRESTPollTimeout
+	}
+
+	if c.Buffer <= 0 {
+		c.Buffer = defaultRESTBuffer
+	}
+
+	return c
+}
+
+// RESTHandler handler serving REST API under /topics/, see RESTConfig
+func (s *implementation) RESTHandler() http.Handler {
+	config := s.restConfig()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, restTopicsPath) || len(r.URL.Path) == len(restTopicsPath) {
+			http.NotFound(w, r)
+			return
+		}
+
+		topic := r.URL.Path[len(restTopicsPath):]
+
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		c, ok := s.restAuthenticate(w, r, &config)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			s.restPublish(w, r, &config, c, topic)
+		} else {
+			s.restSubscribe(w, r, &config, c, topic)
+		}
+	})
+}
+
+// restAuthenticate request by basic authentication or as anonymous client. Request is
+// answered if refused
+func (s *implementation) restAuthenticate(w http.ResponseWriter, r *http.Request, config *RESTConfig) (*restClient, bool) {
+	c := &restClient{id: r.URL.Query().Get("client_id"), auth: s.inner.authMgr}
+	if c.id == "" {
+		c.id = config.ClientID
+	}
+
+	addr := restAddr(r.RemoteAddr)
+	user, password, hasAuth := r.BasicAuth()
+
+	record := &audit.Record{
+		Action:     audit.ActionConnect,
+		Result:     audit.ResultDenied,
+		ClientID:   c.id,
+		Username:   user,
+		RemoteAddr: r.RemoteAddr,
+		Detail:     "rest",
+	}
+
+	refuse := func(status int, reason string) (*restClient, bool) {
+		record.Detail = "rest: " + reason
+		s.inner.audit(s.log.Prod, record)
+
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+restRealm+`"`)
+		}
+
+		http.Error(w, http.StatusText(status), status)
+
+		return nil, false
+	}
+
+	switch {
+	case s.inner.bans.clientBanned(c.id) || s.inner.bans.ipBanned(hostIP(addr)):
+		return refuse(http.StatusForbidden, "banned")
+	case s.inner.throttle.blocked(c.id, addr):
+		return refuse(http.StatusTooManyRequests, "throttled")
+	case hasAuth:
+		if err := c.auth.CheckConnect(auth.Client{ID: c.id, User: user}, password); err != nil {
+			s.inner.throttle.failed(c.id, addr)
+			return refuse(http.StatusUnauthorized, "bad credentials")
+		}
+
+		s.inner.throttle.succeeded(c.id)
+		c.user = user
+	case s.inner.config.Anonymous:
+		if s.inner.anonAuth != nil {
+			c.auth = s.inner.anonAuth
+		}
+	default:
+		return refuse(http.StatusUnauthorized, "anonymous not allowed")
+	}
+
+	return c, true
+}
+
+// restDenied record ACL denial of request
+func (s *implementation) restDenied(r *http.Request, c *restClient, action, topic string) {
+	s.inner.audit(s.log.Prod, &audit.Record{
+		Action:     action,
+		Result:     audit.ResultDenied,
+		ClientID:   c.id,
+		Username:   c.user,
+		RemoteAddr: r.RemoteAddr,
+		Topic:      topic,
+		Detail:     "rest",
+	})
+}
+
+// restPublish publish body of request to topic
+func (s *implementation) restPublish(w http.ResponseWriter, r *http.Request, config *RESTConfig, c *restClient, topic string) {
+	query := r.URL.Query()
+
+	qos := message.QoS0
+	if v := query.Get("qos"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || !message.QosType(n).IsValid() {
+			http.Error(w, "invalid qos", http.StatusBadRequest)
+			return
+		}
+
+		qos = message.QosType(n)
+	}
+
+	retain := false
+	if v := query.Get("retain"); v != "" {
+		var err error
+		if retain, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid retain", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !message.ValidTopic(topic) {
+		http.Error(w, "invalid topic", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.auth.CheckPublish(c.identity(), topic); err != nil {
+		s.restDenied(r, c, audit.ActionPublish, topic)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, config.MaxPayload))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	switch err = s.Publish(topic, qos, retain, payload); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrServerClosed:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case session.ErrQoSNotSupported:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		s.log.Dev.Debug("Couldn't publish REST message", zap.String("topic", topic), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// restSubscribe subscribe filter for duration of request
+func (s *implementation) restSubscribe(w http.ResponseWriter, r *http.Request, config *RESTConfig, c *restClient, filter string) {
+	query := r.URL.Query()
+
+	withRetained := false
+	if v := query.Get("retained"); v != "" {
+		var err error
+		if withRetained, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid retained", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := c.auth.CheckSubscribe(c.identity(), filter); err != nil {
+		s.restDenied(r, c, audit.ActionSubscribe, filter)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	queue := make(chan RESTMessage, config.Buffer)
+	var dropped uint64
+
+	// invoked by topics provider with locks held thus never blocks
+	sub := &types.Subscriber{
+		Publish: func(msg *message.PublishMessage) error {
+			select {
+			case queue <- restMessage(msg, false):
+			default:
+				atomic.AddUint64(&dropped, 1)
+			}
+
+			return nil
+		},
+	}
+
+	if _, err := s.inner.topicsMgr.Subscribe(filter, message.QoS2, sub); err != nil {
+		http.Error(w, "invalid filter", http.StatusBadRequest)
+		return
+	}
+
+	defer func() {
+		s.inner.topicsMgr.UnSubscribe(filter, sub) // nolint: errcheck, gas
+
+		if n := atomic.LoadUint64(&dropped); n > 0 {
+			s.log.Dev.Debug("REST subscription too slow, messages dropped",
+				zap.String("ClientID", c.id), zap.String("filter", filter), zap.Uint64("dropped", n))
+		}
+	}()
+
+	var retained []RESTMessage
+	if withRetained {
+		var msgs []*message.PublishMessage
+		if err := s.inner.topicsMgr.Retained(filter, &msgs); err == nil {
+			for _, m := range msgs {
+				retained = append(retained, restMessage(m, true))
+			}
+		}
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.restStream(w, r, c, retained, queue)
+	} else {
+		s.restPoll(w, r, config, retained, queue)
+	}
+}
+
+// restPoll respond with messages once any is available or poll timed out
+func (s *implementation) restPoll(w http.ResponseWriter, r *http.Request, config *RESTConfig, msgs []RESTMessage, queue chan RESTMessage) {
+	query := r.URL.Query()
+
+	timeout := config.PollTimeout
+	if v := query.Get("timeout"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+
+		if d := time.Duration(n) * time.Second; d < timeout {
+			timeout = d
+		}
+	}
+
+	limit := restPollLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+
+		limit = n
+	}
+
+	if msgs == nil {
+		msgs = []RESTMessage{}
+	}
+
+	if len(msgs) == 0 {
+		timer := time.NewTimer(timeout)
+
+		select {
+		case m := <-queue:
+			msgs = append(msgs, m)
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		case <-s.inner.quit:
+		}
+
+		timer.Stop()
+	}
+
+drain:
+	for len(msgs) < limit {
+		select {
+		case m := <-queue:
+			msgs = append(msgs, m)
+		default:
+			break drain
+		}
+	}
+
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if err := json.NewEncoder(w).Encode(msgs); err != nil {
+		s.log.Dev.Debug("Couldn't write REST messages", zap.String("RemoteAddr", r.RemoteAddr), zap.Error(err))
+	}
+}
+
+// restStream stream messages as server-sent events until client goes away
+func (s *implementation) restStream(w http.ResponseWriter, r *http.Request, c *restClient, msgs []RESTMessage, queue chan RESTMessage) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusNotAcceptable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(m RESTMessage) bool {
+		data, err := json.Marshal(m)
+		if err == nil {
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+
+		if err != nil {
+			s.log.Dev.Debug("Couldn't write REST event", zap.String("ClientID", c.id), zap.Error(err))
+			return false
+		}
+
+		flusher.Flush()
+
+		return true
+	}
+
+	for _, m := range msgs {
+		if !send(m) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(restHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case m := <-queue:
+			if !send(m) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.inner.quit:
+			return
+		}
+	}
+}
+
+// startREST listen on REST endpoint. Served until server is closed
+func (s *implementation) startREST(config *RESTConfig) error {
+	if config.Addr == "" {
+		return ErrRESTAddress
+	}
+
+	ln, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(restTopicsPath, s.RESTHandler())
+
+	srv := &http.Server{Handler: mux}
+
+	s.inner.rest.wg.Add(2)
+	go func() {
+		defer s.inner.rest.wg.Done()
+
+		if e := srv.Serve(ln); e != nil && e != http.ErrServerClosed {
+			s.log.Prod.Error("REST endpoint stopped", zap.Error(e))
+		}
+	}()
+
+	go func() {
+		defer s.inner.rest.wg.Done()
+
+		<-s.inner.quit
+
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+
+		srv.Shutdown(ctx) // nolint: errcheck, gas
+	}()
+
+	s.log.Prod.Info("REST endpoint started", zap.String("addr", ln.Addr().String()))
+
+	return nil
+}
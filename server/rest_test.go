@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/auth"
+	"github.com/troian/surgemq/message"
+	persistTypes "github.com/troian/surgemq/persistence/types"
+	"github.com/troian/surgemq/types"
+)
+
+// restServer without listeners serving REST API by its handler
+func restServer(t *testing.T, config Config) *implementation {
+	config.SysInterval = -1
+	config.Persistence = &persistTypes.BadgerConfig{InMemory: true}
+
+	srv, err := New(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() }) // nolint: errcheck
+
+	return srv.(*implementation)
+}
+
+// restRequest served by handler of s, authenticated as user/pass unless user is empty
+func restRequest(s *implementation, method, target, user, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if user != "" {
+		r.SetBasicAuth(user, "pass")
+	}
+
+	w := httptest.NewRecorder()
+	s.RESTHandler().ServeHTTP(w, r)
+
+	return w
+}
+
+// collector subscriber of topics manager keeping received messages
+type collector struct {
+	lock sync.Mutex
+	msgs []*message.PublishMessage
+}
+
+func (c *collector) subscribe(t *testing.T, s *implementation, filter string) {
+	sub := &types.Subscriber{
+		Publish: func(msg *message.PublishMessage) error {
+			c.lock.Lock()
+			c.msgs = append(c.msgs, msg)
+			c.lock.Unlock()
+
+			return nil
+		},
+	}
+
+	_, err := s.inner.topicsMgr.Subscribe(filter, message.QoS2, sub)
+	require.NoError(t, err)
+}
+
+func (c *collector) list() []*message.PublishMessage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]*message.PublishMessage(nil), c.msgs...)
+}
+
+func TestRESTAuth(t *testing.T) {
+	s := restServer(t, Config{Authenticators: "test.topics"})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		user   string
+		status int
+	}{
+		{"anonymous", http.MethodPost, "/topics/a", "", http.StatusUnauthorized},
+		{"bad credentials", http.MethodPost, "/topics/a", "other", http.StatusUnauthorized},
+		{"authenticated", http.MethodPost, "/topics/a", "user", http.StatusNoContent},
+		{"no topic", http.MethodPost, "/topics/", "user", http.StatusNotFound},
+		{"bad method", http.MethodPut, "/topics/a", "user", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := restRequest(s, tt.method, tt.target, tt.user, "")
+			require.Equal(t, tt.status, w.Code)
+
+			if tt.status == http.StatusUnauthorized {
+				require.Equal(t, `Basic realm="surgemq"`, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// banned client is refused even with valid credentials
+	require.NoError(t, s.Ban(Ban{ClientID: "banned"}))
+	require.Equal(t, http.StatusForbidden, restRequest(s, http.MethodPost, "/topics/a?client_id=banned", "user", "").Code)
+	require.Equal(t, http.StatusNoContent, restRequest(s, http.MethodPost, "/topics/a?client_id=other", "user", "").Code)
+
+	// anonymous requests are confined to anonymous grant
+	s = restServer(t, Config{
+		Authenticators: "test.topics",
+		Anonymous:      true,
+		AnonymousGrant: &auth.Grant{Publish: []string{"public/#"}},
+	})
+
+	require.Equal(t, http.StatusNoContent, restRequest(s, http.MethodPost, "/topics/public/a", "", "").Code)
+	require.Equal(t, http.StatusForbidden, restRequest(s, http.MethodPost, "/topics/other", "", "").Code)
+}
+
+func TestRESTPublish(t *testing.T) {
+	s := restServer(t, Config{
+		Authenticators: "test.topics",
+		REST:           &RESTConfig{Addr: "127.0.0.1:0", MaxPayload: 8},
+	})
+
+	c := &collector{}
+	c.subscribe(t, s, "#")
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		status int
+	}{
+		{"bad qos", "/topics/a?qos=3", "", http.StatusBadRequest},
+		{"qos not number", "/topics/a?qos=one", "", http.StatusBadRequest},
+		{"bad retain", "/topics/a?retain=maybe", "", http.StatusBadRequest},
+		{"wildcard topic", "/topics/a/%23", "", http.StatusBadRequest},
+		{"denied topic", "/topics/secret/a", "", http.StatusForbidden},
+		{"too large", "/topics/a", "123456789", http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.status, restRequest(s, http.MethodPost, tt.target, "user", tt.body).Code)
+		})
+	}
+
+	require.Empty(t, c.list())
+
+	w := restRequest(s, http.MethodPost, "/topics/devices/1?qos=1&retain=true", "user", "on")
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	require.Eventually(t, func() bool { return len(c.list()) == 1 }, time.Second, 5*time.Millisecond)
+
+	msg := c.list()[0]
+	require.Equal(t, "devices/1", msg.Topic())
+	require.Equal(t, message.QoS1, msg.QoS())
+	require.Equal(t, "on", string(msg.Payload()))
+
+	var retained []*message.PublishMessage
+	require.NoError(t, s.inner.topicsMgr.Retained("devices/#", &retained))
+	require.Len(t, retained, 1)
+	require.Equal(t, "on", string(retained[0].Payload()))
+}
+
+// publishUntil publish message to topic until done is closed, thus message published after
+// subscription of request is received
+func publishUntil(t *testing.T, s *implementation, topic string, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(5 * time.Millisecond):
+			if err := s.Publish(topic, message.QoS0, false, []byte("live")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}
+}
+
+func TestRESTPoll(t *testing.T) {
+	s := restServer(t, Config{Authenticators: "test.topics"})
+
+	require.NoError(t, s.Publish("devices/1", message.QoS1, true, []byte("retained")))
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"denied filter", "/topics/secret/%23", http.StatusForbidden},
+		{"bad filter", "/topics/a/%23/b", http.StatusBadRequest},
+		{"bad retained", "/topics/a?retained=maybe", http.StatusBadRequest},
+		{"bad timeout", "/topics/a?timeout=-1", http.StatusBadRequest},
+		{"bad limit", "/topics/a?limit=0", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.status, restRequest(s, http.MethodGet, tt.target, "user", "").Code)
+		})
+	}
+
+	decode := func(w *httptest.ResponseRecorder) []RESTMessage {
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var msgs []RESTMessage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &msgs))
+
+		return msgs
+	}
+
+	// poll timing out returns empty list
+	require.Empty(t, decode(restRequest(s, http.MethodGet, "/topics/devices/%23?timeout=0", "user", "")))
+
+	// retained messages are returned at once
+	msgs := decode(restRequest(s, http.MethodGet, "/topics/devices/%23?retained=true", "user", ""))
+	require.Len(t, msgs, 1)
+	require.Equal(t, RESTMessage{Topic: "devices/1", QoS: 1, Retain: true, Time: msgs[0].Time, Payload: []byte("retained")}, msgs[0])
+
+	// poll waits for message
+	done := make(chan struct{})
+	res := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		defer close(done)
+		res <- restRequest(s, http.MethodGet, "/topics/devices/%23?limit=1", "user", "")
+	}()
+
+	publishUntil(t, s, "devices/2", done)
+
+	msgs = decode(<-res)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "devices/2", msgs[0].Topic)
+	require.False(t, msgs[0].Retain)
+	require.Equal(t, "live", string(msgs[0].Payload))
+}
+
+func TestRESTStream(t *testing.T) {
+	s := restServer(t, Config{Authenticators: "test.topics"})
+
+	require.NoError(t, s.Publish("devices/1", message.QoS1, true, []byte("retained")))
+
+	srv := httptest.NewServer(s.RESTHandler())
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/topics/devices/%23?retained=true", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("user", "pass")
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close() // nolint: errcheck
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan RESTMessage, 16)
+	go func() {
+		defer close(events)
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+
+			var m RESTMessage
+			if json.Unmarshal([]byte(line[len("data: "):]), &m) == nil {
+				events <- m
+			}
+		}
+	}()
+
+	next := func() RESTMessage {
+		select {
+		case m, ok := <-events:
+			require.True(t, ok, "stream ended")
+			return m
+		case <-time.After(time.Second):
+			require.Fail(t, "no event")
+		}
+
+		return RESTMessage{}
+	}
+
+	// retained message comes first, live ones follow
+	m := next()
+	require.Equal(t, "devices/1", m.Topic)
+	require.True(t, m.Retain)
+
+	done := make(chan struct{})
+	go publishUntil(t, s, "devices/2", done)
+
+	m = next()
+	close(done)
+	require.Equal(t, "devices/2", m.Topic)
+	require.Equal(t, "live", string(m.Payload))
+
+	// stream ends once server is closed
+	require.NoError(t, s.Close())
+
+	require.Eventually(t, func() bool {
+		select {
+		case _, ok := <-events:
+			return !ok
+		default:
+			return false
+		}
+	}, time.Second, 5*time.Millisecond)
+}
@@ -15,23 +15,38 @@
 package server
 
 import (
+	"crypto/tls"
 	"errors"
+	"net"
+	"net/http"
 	"sync"
 
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"go.uber.org/zap"
 
 	"strconv"
+	"sync/atomic"
 
 	"time"
 
 	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/audit"
 	"github.com/troian/surgemq/auth"
+	"github.com/troian/surgemq/bridge"
+	"github.com/troian/surgemq/cluster"
+	"github.com/troian/surgemq/connector"
+	connectorTypes "github.com/troian/surgemq/connector/types"
 	"github.com/troian/surgemq/message"
 	"github.com/troian/surgemq/persistence"
 	persistTypes "github.com/troian/surgemq/persistence/types"
+	"github.com/troian/surgemq/persistence/wal"
+	"github.com/troian/surgemq/ratelimit"
+	"github.com/troian/surgemq/rules"
 	"github.com/troian/surgemq/session"
 	"github.com/troian/surgemq/systree"
 	"github.com/troian/surgemq/topics"
+	"github.com/troian/surgemq/topics/rewrite"
 	topicsTypes "github.com/troian/surgemq/topics/types"
 	types "github.com/troian/surgemq/types"
 )
@@ -46,7 +61,8 @@ type Config struct {
 	// If not set then default to 2 seconds.
 	ConnectTimeout int
 
-	// The number of seconds to wait for any ACK messages before failing.
+	// The number of seconds to wait for any ACK messages before sending QoS 1/2 message again.
+	// Timeout doubles on every retry. Negative disables retransmission.
 	// If not set then default to 20 seconds.
 	AckTimeout int
 
@@ -54,17 +70,53 @@ type Config struct {
 	// If no set then default to 3 retries.
 	TimeoutRetries int
 
-	// Authenticator is the authenticator used to check username and password sent
-	// in the CONNECT message. If not set then default to "mockSuccess".
+	// MaxQoS highest QoS supported by broker, e.g. QoS 1 for deployments not needing
+	// exactly-once. Subscriptions are granted at most MaxQoS, clients publishing above it
+	// are disconnected as MQTT 3.1.1 has no reason code for it. nil means QoS 2
+	MaxQoS *message.QosType
+
+	// StrictOrdering send QoS 1/2 messages of topic to client one at a time, next one
+	// waits until previous is acknowledged. Trades throughput for ordering across
+	// retransmissions. Messages of topic queued behind unacknowledged one wait as well
+	StrictOrdering bool
+
+	// OnUndelivered invoked with message given up on delivering to client, i.e. once
+	// retries are exhausted, queue limits dropped it or it expired in persistence
+	// clientID includes namespace of virtual host if any
+	OnUndelivered func(clientID string, msg *message.PublishMessage, reason error)
+
+	// DeadLetter republishing of undelivered messages to dead letter topic. nil disables
+	DeadLetter *DeadLetterConfig
+
+	// Events publishing of client connects, disconnects, subscriptions and dropped
+	// messages as JSON to $SYS/broker/events topics. nil disables
+	Events *EventsConfig
+
+	// Audit log of authentication decisions, ACL denials, bans and administrative actions
+	// Log is not closed by server. nil disables
+	Audit audit.Logger
+
+	// Hooks of embedding application observing, modifying or rejecting connects,
+	// subscriptions and publishes of clients. Invoked in order, see session.Hooks
+	Hooks []session.Hooks
+
+	// Authenticators chain of registered providers separated by ';' used to check CONNECT
+	// and every publish and subscription of client. If not set then default to "mockSuccess".
 	Authenticators string
 
 	// TopicsProvider is the topic store that keeps all the subscription topics.
-	// If not set then default to "mem".
+	// Alternate stores are registered by topics.Register. If not set then default to "mem".
 	TopicsProvider string
 
 	// Anonymous either allow anonymous access or not
 	Anonymous bool
 
+	// AnonymousGrant topics and role of clients connected without username when Anonymous
+	// is set. Such clients are checked against grant only, access not listed is denied
+	// e.g. Subscribe: []string{"public/#"} gives read-only access to public topics
+	// nil leaves anonymous clients to auth chain
+	AnonymousGrant *auth.Grant
+
 	// ClientIDFromUser
 	ClientIDFromUser bool
 
@@ -75,6 +127,146 @@ type Config struct {
 	DupConfig types.DuplicateConfig
 
 	ListenerStatus func(id string, start bool)
+
+	// OfflineQueue limits of messages queued for every session and drop policy
+	// Zero value means unlimited
+	OfflineQueue types.OfflineQueueConfig
+
+	// InFlightLog write-ahead log of in-flight QoS 1/2 messages
+	// Protects messages awaiting acknowledge from broker crash. nil disables
+	InFlightLog *wal.Config
+
+	// DrainTimeout grace period given on Close to connected clients to finish
+	// 0 closes connections immediately
+	DrainTimeout time.Duration
+
+	// DisconnectNotice tell clients why broker closes their connections, e.g. on kick,
+	// takeover or shutdown, by notice on session.DisconnectTopic. Notice is not part of
+	// MQTT 3.1.1 thus disabled by default
+	DisconnectNotice bool
+
+	// HealthCheckInterval how often persistence backend is checked for reachability
+	// While it is unreachable clients with clean session unset are refused with
+	// server unavailable and systree alarm is raised. Negative value disables checks
+	// If not set then default to 5 seconds
+	HealthCheckInterval time.Duration
+
+	// Snapshot backup of persistence store. nil disables snapshots
+	Snapshot *SnapshotConfig
+
+	// TopicRewrite rules remapping topics of inbound messages and subscription filters
+	// Applied before virtual host prefix. Delivered messages carry rewritten topic
+	TopicRewrite []rewrite.Rule
+
+	// TopicLimits publish rate limits selected by longest matching topic prefix
+	// Messages above limit are acknowledged but dropped unless limit throttles client
+	TopicLimits []ratelimit.TopicLimit
+
+	// RetainedLimits caps of amount and payload size of retained messages
+	// Zero value means unlimited
+	RetainedLimits topicsTypes.RetainedLimits
+
+	// SysInterval how often broker statistics are published into $SYS topics
+	// Negative value disables $SYS topics. If not set then default to 10 seconds
+	SysInterval time.Duration
+
+	// TopicStatsSize amount of most recently published topics access statistics
+	// are kept for. 0 disables statistics
+	TopicStatsSize int
+
+	// LastValueCacheSize amount of topics last message is cached for. Clients subscribing
+	// with $lvc/ prefix, e.g. $lvc/sensors/#, receive cached messages as retained ones
+	// 0 disables cache thus such subscriptions receive retained messages only
+	LastValueCacheSize int
+
+	// HistorySize amount of topics last HistoryDepth messages are kept for. Clients subscribing
+	// with $replay/<n>/ prefix, e.g. $replay/10/sensors/#, receive up to n last messages of
+	// every matching topic as retained ones. 0 disables history thus such subscriptions
+	// receive retained messages only
+	HistorySize int
+
+	// HistoryDepth amount of last messages kept per topic. If not set then default to 10
+	HistoryDepth int
+
+	// Quotas of clients by role assigned by auth providers. Quota under empty role applies
+	// to clients without role or with role not listed. Clients without quota are unlimited
+	Quotas map[string]*ratelimit.Quota
+
+	// AckPolicies retransmission of unacknowledged messages by role of client, e.g. longer
+	// timeouts for devices on cellular links. Selected as Quotas, clients without policy
+	// use AckTimeout and TimeoutRetries
+	AckPolicies map[string]*types.AckPolicy
+
+	// TopicShards amount of partitions subscription tree is split into to reduce contention
+	// of concurrent subscribes, e.g. during reconnect storms. 0 keeps single tree
+	TopicShards int
+
+	// AuthThrottle backoff and lockout of client ids and addresses repeatedly failing
+	// authentication. Blocked clients are refused with CONNACK Not authorized. nil disables
+	AuthThrottle *AuthThrottleConfig
+
+	// MaxConnections amount of simultaneous connections across all listeners
+	// Connections above limit are rejected with CONNACK Server unavailable. 0 means unlimited
+	MaxConnections int
+
+	// MaxConnectionsPerIP amount of simultaneous connections from single source IP
+	// Connections above limit are rejected with CONNACK Server unavailable. 0 means unlimited
+	MaxConnectionsPerIP int
+
+	// SlowClient detection of clients not consuming messages as fast as they are sent
+	// Zero Timeout disables detection
+	SlowClient types.SlowClientConfig
+
+	// ProtocolViolations policies of client protocol violations, e.g. second CONNECT or
+	// topic with invalid UTF-8. Violations are counted under $SYS/broker/violations/
+	// Violations without policy close connection as spec requires
+	ProtocolViolations types.ViolationConfig
+
+	// Metrics HTTP endpoint exporting broker statistics for Prometheus. nil disables endpoint
+	// Statistics are available through MetricsHandler regardless
+	Metrics *MetricsConfig
+
+	// QueueAlarms thresholds of session queues raising systree alarms, reported as events
+	// if Events are enabled. nil disables
+	QueueAlarms *QueueAlarmConfig
+
+	// PacketTrace publishing of packets of clients traced by TracePackets. Traced packets
+	// are logged by "server.trace" logger regardless. nil disables publishing
+	PacketTrace *PacketTraceConfig
+
+	// Debug authenticated HTTP listener serving pprof profiles and broker diagnostics
+	// nil disables listener
+	Debug *DebugConfig
+
+	// REST HTTP API publishing and subscribing without MQTT client, see RESTConfig
+	// nil disables listener, RESTHandler serves API regardless
+	REST *RESTConfig
+
+	// Cluster joins broker into cluster with other nodes. Publishes are routed to nodes
+	// having matching subscribers, while retained messages and sessions stay local to node
+	// unless persistence is shared. nil runs broker standalone
+	Cluster *cluster.Config
+
+	// SharedPersistence persistence is shared with other brokers of cluster, see
+	// session.Config.SharedPersistence. Sessions started by a member are released here
+	// Implied by Raft persistence
+	SharedPersistence bool
+
+	// Bridges to remote brokers messages of configured topics are forwarded to and from
+	Bridges []bridge.Config
+
+	// Connectors streaming messages between broker and external systems, e.g.
+	// *connectorTypes.KafkaConfig. Package of connector must be imported to register it
+	Connectors []connectorTypes.Config
+
+	// Rules routing and transforming publishes of clients, evaluated in order after hooks
+	// of application. Forward actions refer to Connectors by name
+	Rules []rules.Rule
+
+	// TracerProvider OpenTelemetry provider spans of CONNECT handling, received messages,
+	// their fan-out and acknowledged deliveries to subscribers are reported to
+	// MQTT 3.1.1 has no user properties thus traces start at broker. nil disables tracing
+	TracerProvider trace.TracerProvider
 }
 
 type listenerInner struct {
@@ -83,14 +275,80 @@ type listenerInner struct {
 	// incoming connections
 	authMgr *auth.Manager
 
+	// anonAuth restricted chain of anonymous clients. nil if not configured
+	anonAuth *auth.Manager
+
 	// sessionsMgr is the sessions manager for keeping track of the sessions
 	sessionsMgr *session.Manager
 
 	// topicsMgr is the topics manager for keeping track of subscriptions
 	topicsMgr topicsTypes.Provider
 
+	// cluster node wrapping topicsMgr. nil if standalone
+	cluster *cluster.Node
+
+	bridges []*bridge.Bridge
+
+	connectors []connectorTypes.Connector
+
+	// rules engine. nil if no rules configured
+	rules *rules.Engine
+
 	persist persistTypes.Provider
 
+	wal *wal.Log
+
+	health struct {
+		degraded int32
+		wg       sync.WaitGroup
+
+		// listeners serving state by address
+		lock      sync.Mutex
+		listeners map[string]bool
+	}
+
+	snapshot struct {
+		running int32
+		wg      sync.WaitGroup
+	}
+
+	sys struct {
+		wg sync.WaitGroup
+	}
+
+	metrics struct {
+		wg sync.WaitGroup
+	}
+
+	debug struct {
+		wg sync.WaitGroup
+	}
+
+	rest struct {
+		wg sync.WaitGroup
+	}
+
+	alarms struct {
+		wg sync.WaitGroup
+	}
+
+	deadLetters struct {
+		queue chan undelivered
+		wg    sync.WaitGroup
+	}
+
+	events struct {
+		topic string
+		queue chan *Event
+		wg    sync.WaitGroup
+	}
+
+	packets struct {
+		log   *zap.Logger
+		queue chan *Packet
+		wg    sync.WaitGroup
+	}
+
 	// The quit channel for the server. If the server detects that this channel
 	// is closed, then it's a signal for it to shutdown as well.
 	quit chan struct{}
@@ -98,22 +356,119 @@ type listenerInner struct {
 	lock sync.Mutex
 
 	listeners struct {
-		list map[int]Listener
+		list map[string]Listener
 		wg   sync.WaitGroup
 	}
 
 	wgConnections sync.WaitGroup
 
 	sysTree systree.Provider
+
+	tracer trace.Tracer
+
+	bans banList
+
+	conns *connLimits
+
+	throttle *authThrottle
 }
 
 // ListenerBase base configuration object for listeners
 type ListenerBase struct {
-	Port        int
-	CertFile    string
-	KeyFile     string
+	Port     int
+	CertFile string
+	KeyFile  string
+
+	// CertReloadInterval how often certificate files are checked for renewal
+	// 0 disables reload
+	CertReloadInterval time.Duration
+
+	// GetCertificate optional callback providing certificate on each handshake
+	// Takes precedence over CertFile/KeyFile
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// AuthManager auth providers chain used by this listener
+	// If not set server wide chain from Config.Authenticators is used
 	AuthManager *auth.Manager
 
+	// ClientCAFile CA certificates client certificates are verified against. Enables mutual TLS
+	ClientCAFile string
+
+	// ClientCertOptional accept clients without certificate. Presented certificates are still verified
+	ClientCertOptional bool
+
+	// CertIdentity part of verified client certificate used as username of the client
+	// Such client is authenticated by certificate and its password is not checked
+	CertIdentity CertIdentity
+
+	// CertOverridesUsername use certificate identity even if client sent username in CONNECT
+	// Otherwise identity applies to clients without username only
+	CertOverridesUsername bool
+
+	// MaxConnections amount of simultaneous connections served by listener
+	// Connections above limit are rejected with CONNACK Server unavailable
+	// 0 means unlimited
+	MaxConnections int
+
+	// ProtocolVersions MQTT protocol levels accepted by listener (0x3 - v3.1, 0x4 - v3.1.1)
+	// If empty all supported versions are accepted
+	ProtocolVersions []byte
+
+	// VirtualHosts tenants selected by TLS SNI hostname (lower case)
+	// If set connections without matching hostname are not authorized
+	VirtualHosts map[string]*VirtualHost
+
+	// VirtualHostByUser tenant of user. Consulted if tenant is not selected by hostname. It is
+	// consulted before authentication as providers are given session id within namespace of
+	// tenant, though auth chain of returned host is not used
+	VirtualHostByUser func(user string) *VirtualHost
+
+	// VirtualHost tenant of clients not assigned to any other. nil keeps them outside of tenants
+	VirtualHost *VirtualHost
+
+	// AcceptRate new connections per second accepted by listener
+	// Connections above rate are dropped right after accept. 0 means unlimited
+	AcceptRate  float64
+	AcceptBurst int
+
+	// ConnectRatePerIP CONNECT packets per second processed from single source IP
+	// CONNECT above rate is rejected with CONNACK Server unavailable. 0 means unlimited
+	ConnectRatePerIP  float64
+	ConnectBurstPerIP int
+
+	// AllowCIDR addresses or networks connections are accepted from. Empty allows any
+	AllowCIDR []string
+
+	// DenyCIDR addresses or networks connections are dropped from. Takes precedence over AllowCIDR
+	DenyCIDR []string
+
+	// SubscriptionPolicy wildcard restrictions of clients served by listener
+	// Denied filters are answered with SUBACK failure. nil means unrestricted
+	SubscriptionPolicy *topicsTypes.SubscriptionPolicy
+
+	// AnonymousSubscriptionPolicy restrictions of clients connected without username
+	// If not set SubscriptionPolicy applies
+	AnonymousSubscriptionPolicy *topicsTypes.SubscriptionPolicy
+
+	limits struct {
+		accept  *ratelimit.Bucket
+		connect *ratelimit.Keyed
+		allow   []*net.IPNet
+		deny    []*net.IPNet
+	}
+
+	// amount of connections currently served
+	connections int64
+
+	certs struct {
+		def  *keyPair
+		quit chan struct{}
+		wg   sync.WaitGroup
+	}
+
+	// stat traffic of listener exported with per listener labels
+	stat systree.ListenerStat
+
 	inner *listenerInner
 	log   types.LogInterface
 }
@@ -121,6 +476,8 @@ type ListenerBase struct {
 // Listener listener
 type Listener interface {
 	listenerProtocol() string
+	// address unique address of listener in form of scheme://host:port
+	address() string
 	start() error
 	close() error
 }
@@ -129,6 +486,101 @@ type Listener interface {
 type Type interface {
 	ListenAndServe(listener Listener) error
 	Close() error
+
+	// Tenants persisted state accounting of tenants. nil unless persistence is
+	// configured with TenantConfig. Wipe should be used while clients of the tenant
+	// are disconnected otherwise their sessions are stored again on disconnect
+	Tenants() persistTypes.Tenants
+
+	// Snapshot copy persistence store into configured target while server keeps running
+	Snapshot() (string, error)
+
+	// RetainedList page of retained messages matching filter ordered by topic, see topics Provider
+	RetainedList(filter string, after string, limit int) ([]*message.PublishMessage, error)
+
+	// RetainedDelete remove retained messages matching filter
+	RetainedDelete(filter string) (int, error)
+
+	// TopicStats access statistics of topics ordered by amount of published messages
+	TopicStats(limit int) []topicsTypes.TopicStat
+
+	// FilterStats subscriber counts of filters ordered by amount of subscribers
+	FilterStats(limit int) []systree.FilterCount
+
+	// Ban refuse connections of client id or from IP address or network until ban expires
+	Ban(ban Ban) error
+
+	// Unban lift ban of client id or IP. Returns false if neither is banned
+	Unban(ban Ban) bool
+
+	// Bans currently active
+	Bans() []Ban
+
+	// Reauthorize check subscriptions of all sessions against auth providers, e.g. once
+	// ACL is reloaded, and drop denied ones. Connections are kept. Returns amount dropped
+	Reauthorize() int
+
+	// Sessions snapshot of connected, suspended and persisted sessions ordered by client id
+	Sessions() []session.Info
+
+	// Session snapshot of single session. Returns false if it does not exist
+	Session(id string) (session.Info, bool)
+
+	// Kick force disconnect client by id. If wipe is set its persisted session is discarded
+	// Returns false if session does not exist
+	Kick(id string, wipe bool) bool
+
+	// Publish deliver message to subscribers without connection of client, e.g. by
+	// application embedding broker. Returns ErrServerClosed once server is closed
+	Publish(topic string, qos message.QosType, retain bool, payload []byte) error
+
+	// MetricsHandler handler serving broker statistics in Prometheus text format
+	MetricsHandler() http.Handler
+
+	// Health state of listeners and persistence backend
+	Health() Health
+
+	// HealthHandler liveness probe handler, see Health
+	HealthHandler() http.Handler
+
+	// ReadyHandler readiness probe handler, see Health
+	ReadyHandler() http.Handler
+
+	// TracePackets enable or disable tracing of control packets sent to and received from
+	// client with decoded headers to log and trace topic, e.g. to debug device firmware.
+	// Takes effect immediately if client is connected. Password of CONNECT is never traced
+	TracePackets(id string, on bool)
+
+	// TracedClients ids of clients packets are traced of
+	TracedClients() []string
+
+	// Diagnostics goroutines by subsystem and queue depths of sessions
+	Diagnostics() Diagnostics
+
+	// DiagnosticsHandler handler serving Diagnostics in JSON
+	DiagnosticsHandler() http.Handler
+
+	// ClusterMembers nodes of cluster known to broker. nil if standalone
+	ClusterMembers() []cluster.Member
+
+	// Bridges status of bridges to remote brokers
+	Bridges() []bridge.Status
+
+	// Connectors status of connectors to external systems
+	Connectors() []connectorTypes.Status
+
+	// Rules statistics of rules in order
+	Rules() []rules.Stat
+
+	// Stats snapshot of totals, load averages and top busiest topics and clients
+	Stats(top int) Stats
+
+	// StatsHandler handler serving Stats in JSON. Amount of top entries is taken from
+	// query parameter top
+	StatsHandler() http.Handler
+
+	// RESTHandler handler serving publish and subscribe API under /topics/, see RESTConfig
+	RESTHandler() http.Handler
 }
 
 // Type is a library implementation of the MQTT server that, as best it can, complies
@@ -149,7 +601,8 @@ func New(config Config) (Type, error) {
 	s.log.Dev = surgemq.GetDevLogger().Named("server")
 
 	s.inner.quit = make(chan struct{})
-	s.inner.listeners.list = make(map[int]Listener)
+	s.inner.listeners.list = make(map[string]Listener)
+	s.inner.health.listeners = make(map[string]bool)
 
 	if s.inner.config.KeepAlive == 0 {
 		s.inner.config.KeepAlive = types.DefaultAckTimeout
@@ -176,14 +629,160 @@ func New(config Config) (Type, error) {
 		return nil, err
 	}
 
+	if s.inner.config.AnonymousGrant != nil {
+		s.inner.anonAuth = auth.NewChain(auth.Restricted(*s.inner.config.AnonymousGrant))
+	}
+
 	if s.inner.sysTree, err = systree.NewTree(); err != nil {
 		return nil, err
 	}
 
+	tp := s.inner.config.TracerProvider
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+	s.inner.tracer = tp.Tracer(tracerName)
+
+	s.inner.conns = newConnLimits(s.inner.config.MaxConnections, s.inner.config.MaxConnectionsPerIP,
+		s.inner.sysTree.Connections())
+
+	if s.inner.config.AuthThrottle != nil {
+		s.inner.throttle = newAuthThrottle(s.inner.config.AuthThrottle, s.inner.sysTree.Auth())
+	}
+
 	if s.inner.config.Persistence == nil {
 		return nil, errors.New("Persistence provider cannot be nil")
 	}
 
+	// persisted state of connected sessions must not be collected. Manager is not
+	// allocated yet thus it is resolved at collection time
+	var sessionsMgr atomic.Value
+
+	// retained messages changed by other nodes are applied to topics allocated below
+	var topicsMgr atomic.Value
+
+	shared := s.inner.config.SharedPersistence
+
+	if cfg, ok := s.inner.config.Persistence.(*persistTypes.RaftConfig); ok {
+		raftConfig := *cfg
+
+		onRetained := raftConfig.OnRetained
+		raftConfig.OnRetained = func(msg *message.PublishMessage) {
+			if onRetained != nil {
+				onRetained(msg)
+			}
+
+			if t, ok := topicsMgr.Load().(topicsTypes.Provider); ok {
+				if err := t.RetainReplicated(msg); err != nil {
+					s.log.Prod.Error("Couldn't apply replicated retained message", zap.String("topic", msg.Topic()), zap.Error(err))
+				}
+			}
+		}
+
+		s.inner.config.Persistence = &raftConfig
+		shared = true
+	}
+
+	// undelivered messages are reported through queue as they are given up with locks held
+	var onUndelivered func(string, *message.PublishMessage, error)
+
+	if s.inner.config.OnUndelivered != nil || s.inner.config.DeadLetter != nil {
+		size := defaultDeadLetterBuffer
+		if s.inner.config.DeadLetter != nil && s.inner.config.DeadLetter.Buffer > 0 {
+			size = s.inner.config.DeadLetter.Buffer
+		}
+
+		s.inner.deadLetters.queue = make(chan undelivered, size)
+		onUndelivered = s.undelivered
+	}
+
+	s.inner.packets.log = s.log.Prod.Named("trace")
+
+	if cfg := s.inner.config.PacketTrace; cfg != nil && cfg.Topic != "" {
+		size := defaultPacketTraceBuffer
+		if cfg.Buffer > 0 {
+			size = cfg.Buffer
+		}
+
+		s.inner.packets.queue = make(chan *Packet, size)
+	}
+
+	hooks := s.inner.config.Hooks
+
+	if len(s.inner.config.Rules) > 0 {
+		if s.inner.rules, err = rules.New(rules.Config{
+			Rules: s.inner.config.Rules,
+			// topics manager is wrapped by cluster node later on
+			Publish: func(msg *message.PublishMessage) error {
+				return s.inner.topicsMgr.Publish(msg)
+			},
+			Connector: s.connector,
+		}); err != nil {
+			s.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+
+		hooks = append(hooks[:len(hooks):len(hooks)], s.inner.rules)
+	}
+
+	if cfg := s.inner.config.Events; cfg != nil {
+		s.inner.events.topic = cfg.Topic
+		if s.inner.events.topic == "" {
+			s.inner.events.topic = defaultEventsTopic
+		}
+
+		size := defaultEventsBuffer
+		if cfg.Buffer > 0 {
+			size = cfg.Buffer
+		}
+
+		s.inner.events.queue = make(chan *Event, size)
+		onUndelivered = s.undelivered
+
+		// observes outcome of hooks of application thus goes last
+		hooks = append(hooks[:len(hooks):len(hooks)], &eventsHook{s: s})
+	}
+
+	if s.inner.config.Cluster != nil && shared {
+		// members release sessions once client connected here
+		hooks = append(hooks[:len(hooks):len(hooks)], &claimHook{s: s})
+	}
+
+	if cfg, ok := s.inner.config.Persistence.(*persistTypes.GCConfig); ok {
+		gcConfig := *cfg
+
+		onExpired := gcConfig.OnExpired
+		drops := s.inner.sysTree.Drops()
+		gcConfig.OnExpired = func(id string, msg *message.PublishMessage) {
+			drops.Dropped(systree.DropExpired)
+
+			if onExpired != nil {
+				onExpired(id, msg)
+			}
+
+			if onUndelivered != nil {
+				onUndelivered(id, msg, persistTypes.ErrExpired)
+			}
+		}
+
+		if gcConfig.Stat == nil {
+			gcConfig.Stat = s.inner.sysTree.Persistence()
+		}
+
+		expire := gcConfig.Expire
+		gcConfig.Expire = func(id string) bool {
+			if expire != nil && !expire(id) {
+				return false
+			}
+
+			m, ok := sessionsMgr.Load().(*session.Manager)
+
+			return ok && m.Expire(id)
+		}
+
+		s.inner.config.Persistence = &gcConfig
+	}
+
 	if s.inner.persist, err = persistence.New(s.inner.config.Persistence); err != nil {
 		return nil, err
 	}
@@ -192,37 +791,193 @@ func New(config Config) (Type, error) {
 
 	persisRetained, _ = s.inner.persist.Retained()
 
+	if s.inner.config.TopicsProvider == "" {
+		s.inner.config.TopicsProvider = types.DefaultTopicsProvider
+	}
+
 	tConfig := &topicsTypes.MemConfig{
-		Name:    s.inner.config.TopicsProvider,
-		Stat:    s.inner.sysTree.Topics(),
-		Persist: persisRetained,
+		Name:          s.inner.config.TopicsProvider,
+		Stat:          s.inner.sysTree.Topics(),
+		Subscriptions: s.inner.sysTree.Subscriptions(),
+		Drops:         s.inner.sysTree.Drops(),
+		Persist:       persisRetained,
+		Retained:      s.inner.config.RetainedLimits,
+		StatsSize:     s.inner.config.TopicStatsSize,
+		LastValues:    s.inner.config.LastValueCacheSize,
+		History:       s.inner.config.HistorySize,
+		HistoryDepth:  s.inner.config.HistoryDepth,
+		Shards:        s.inner.config.TopicShards,
 	}
 	if s.inner.topicsMgr, err = topics.New(tConfig); err != nil {
+		s.Close() // nolint: errcheck, gas
 		return nil, err
 	}
 
+	if s.inner.config.Cluster != nil {
+		clusterConfig := *s.inner.config.Cluster
+
+		if shared {
+			onClaim := clusterConfig.OnClaim
+			clusterConfig.OnClaim = func(id string) {
+				if onClaim != nil {
+					onClaim(id)
+				}
+
+				if m, ok := sessionsMgr.Load().(*session.Manager); ok {
+					m.Release(id)
+				}
+			}
+		}
+
+		if s.inner.cluster, err = cluster.New(clusterConfig, s.inner.topicsMgr); err != nil {
+			s.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+
+		s.inner.topicsMgr = s.inner.cluster
+	}
+
+	topicsMgr.Store(s.inner.topicsMgr)
+
 	var persisSession persistTypes.Sessions
 
 	persisSession, _ = s.inner.persist.Sessions()
 
+	if s.inner.config.InFlightLog != nil {
+		if s.inner.wal, err = wal.Open(*s.inner.config.InFlightLog); err != nil {
+			s.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+	}
+
+	var rules *rewrite.Rules
+	if len(s.inner.config.TopicRewrite) > 0 {
+		if rules, err = rewrite.New(s.inner.config.TopicRewrite); err != nil {
+			s.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+	}
+
 	mConfig := session.Config{
-		TopicsMgr:      s.inner.topicsMgr,
-		ConnectTimeout: s.inner.config.ConnectTimeout,
-		AckTimeout:     s.inner.config.AckTimeout,
-		TimeoutRetries: s.inner.config.TimeoutRetries,
-		Persist:        persisSession,
-		OnDup:          s.inner.config.DupConfig,
+		TopicsMgr:         s.inner.topicsMgr,
+		ConnectTimeout:    s.inner.config.ConnectTimeout,
+		AckTimeout:        s.inner.config.AckTimeout,
+		TimeoutRetries:    s.inner.config.TimeoutRetries,
+		OnUndelivered:     onUndelivered,
+		Persist:           persisSession,
+		SharedPersistence: shared,
+		OnDup:             s.inner.config.DupConfig,
+		WAL:               s.inner.wal,
+		OfflineQueue:      s.inner.config.OfflineQueue,
+		StrictOrdering:    s.inner.config.StrictOrdering,
+		DisconnectNotice:  s.inner.config.DisconnectNotice,
+		MaxQoS:            s.inner.config.MaxQoS,
+		SlowClient:        s.inner.config.SlowClient,
+		Hooks:             hooks,
+		Audit:             s.inner.config.Audit,
+		OnPacket:          s.onPacket,
+		Violations:        s.inner.config.ProtocolViolations,
+		OnSysPublish:      s.onSysPublish,
+		Rewrite:           rules,
 	}
+
+	if len(s.inner.config.TopicLimits) > 0 {
+		mConfig.TopicLimits = ratelimit.NewTopics(s.inner.config.TopicLimits)
+	}
+	mConfig.Tracer = s.inner.tracer
 	mConfig.Metric.Packets = s.inner.sysTree.Metric().Packets()
+	mConfig.Metric.Bytes = s.inner.sysTree.Metric().Bytes()
 	mConfig.Metric.Session = s.inner.sysTree.Session()
 	mConfig.Metric.Sessions = s.inner.sysTree.Sessions()
+	mConfig.Metric.Connections = s.inner.sysTree.Connections()
+	mConfig.Metric.Violations = s.inner.sysTree.Violations()
+	mConfig.Metric.Latency = s.inner.sysTree.Latency()
+	mConfig.Metric.Drops = s.inner.sysTree.Drops()
 
 	if s.inner.sessionsMgr, err = session.NewManager(mConfig); err != nil {
+		s.Close() // nolint: errcheck, gas
 		return nil, err
 	}
 
-	if s.inner.config.TopicsProvider == "" {
-		s.inner.config.TopicsProvider = "mem"
+	sessionsMgr.Store(s.inner.sessionsMgr)
+
+	if s.inner.config.HealthCheckInterval == 0 {
+		s.inner.config.HealthCheckInterval = defaultHealthCheckInterval
+	}
+
+	if s.inner.config.HealthCheckInterval > 0 {
+		s.inner.health.wg.Add(1)
+		go s.healthWorker(s.inner.config.HealthCheckInterval)
+	}
+
+	if s.inner.config.SysInterval == 0 {
+		s.inner.config.SysInterval = defaultSysInterval
+	}
+
+	if s.inner.config.SysInterval > 0 {
+		s.inner.sys.wg.Add(1)
+		go s.sysWorker(s.inner.config.SysInterval)
+	}
+
+	if s.inner.deadLetters.queue != nil {
+		s.inner.deadLetters.wg.Add(1)
+		go s.deadLetterWorker()
+	}
+
+	if s.inner.events.queue != nil {
+		s.inner.events.wg.Add(1)
+		go s.eventsWorker(s.inner.config.Events)
+	}
+
+	if s.inner.packets.queue != nil {
+		s.inner.packets.wg.Add(1)
+		go s.packetTraceWorker(s.inner.config.PacketTrace)
+	}
+
+	if s.inner.config.QueueAlarms != nil {
+		s.inner.alarms.wg.Add(1)
+		go s.queueAlarmWorker(s.inner.config.QueueAlarms)
+	}
+
+	if s.inner.config.Metrics != nil {
+		if err = s.startMetrics(s.inner.config.Metrics); err != nil {
+			s.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+	}
+
+	if s.inner.config.Debug != nil {
+		if err = s.startDebug(s.inner.config.Debug); err != nil {
+			s.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+	}
+
+	for _, c := range s.inner.config.Bridges {
+		var b *bridge.Bridge
+		if b, err = bridge.New(c, s.inner.topicsMgr); err != nil {
+			s.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+
+		s.inner.bridges = append(s.inner.bridges, b)
+	}
+
+	for _, c := range s.inner.config.Connectors {
+		var conn connectorTypes.Connector
+		if conn, err = connector.New(c, s.inner.topicsMgr); err != nil {
+			s.Close() // nolint: errcheck, gas
+			return nil, err
+		}
+
+		s.inner.connectors = append(s.inner.connectors, conn)
+	}
+
+	if s.inner.config.REST != nil {
+		if err = s.startREST(s.inner.config.REST); err != nil {
+			s.Close() // nolint: errcheck, gas
+			return nil, err
+		}
 	}
 
 	return s, nil
@@ -234,14 +989,31 @@ func (s *implementation) ListenAndServe(listener Listener) error {
 	switch l := listener.(type) {
 	case *ListenerTCP:
 		l.inner = &s.inner
+		l.stat = s.inner.sysTree.Listener(l.address())
 		l.log.Prod = s.log.Prod.Named("tcp").Named(strconv.Itoa(l.Port))
 		l.log.Dev = s.log.Dev.Named("tcp").Named(strconv.Itoa(l.Port))
 		err = l.start()
 	case *ListenerWS:
 		l.inner = &s.inner
+		l.stat = s.inner.sysTree.Listener(l.address())
 		l.log.Prod = s.log.Prod.Named("ws").Named(strconv.Itoa(l.Port))
 		l.log.Dev = s.log.Dev.Named("ws").Named(strconv.Itoa(l.Port))
 		err = l.start()
+	case *ListenerQUIC:
+		l.inner = &s.inner
+		l.stat = s.inner.sysTree.Listener(l.address())
+		l.log.Prod = s.log.Prod.Named("quic").Named(strconv.Itoa(l.Port))
+		l.log.Dev = s.log.Dev.Named("quic").Named(strconv.Itoa(l.Port))
+		err = l.start()
+	case *ListenerTransport:
+		if l.Transport == nil {
+			return errors.New("Transport not set")
+		}
+		l.inner = &s.inner
+		l.stat = s.inner.sysTree.Listener(l.address())
+		l.log.Prod = s.log.Prod.Named(l.Transport.Addr().Network())
+		l.log.Dev = s.log.Dev.Named(l.Transport.Addr().Network())
+		err = l.start()
 	default:
 		err = errors.New("Invalid listener type")
 	}
@@ -249,6 +1021,161 @@ func (s *implementation) ListenAndServe(listener Listener) error {
 	return err
 }
 
+// Tenants persisted state accounting of tenants
+func (s *implementation) Tenants() persistTypes.Tenants {
+	if t, ok := s.inner.persist.(persistTypes.Tenants); ok {
+		return t
+	}
+
+	return nil
+}
+
+// RetainedList page of retained messages matching filter
+func (s *implementation) RetainedList(filter string, after string, limit int) ([]*message.PublishMessage, error) {
+	return s.inner.topicsMgr.RetainedList(filter, after, limit)
+}
+
+// RetainedDelete remove retained messages matching filter
+func (s *implementation) RetainedDelete(filter string) (int, error) {
+	n, err := s.inner.topicsMgr.RetainedDelete(filter)
+	if err == nil && n > 0 {
+		s.log.Prod.Info("Retained messages deleted", zap.String("filter", filter), zap.Int("count", n))
+	}
+
+	r := audit.Record{Topic: filter}
+	if err == nil {
+		r.Detail = "deleted " + strconv.Itoa(n)
+	}
+	s.auditAdmin(audit.ActionRetainedDelete, err, r)
+
+	return n, err
+}
+
+// ClusterMembers nodes of cluster known to broker
+func (s *implementation) ClusterMembers() []cluster.Member {
+	if s.inner.cluster == nil {
+		return nil
+	}
+
+	return s.inner.cluster.Members()
+}
+
+// Bridges status of bridges to remote brokers
+func (s *implementation) Bridges() []bridge.Status {
+	res := make([]bridge.Status, 0, len(s.inner.bridges))
+	for _, b := range s.inner.bridges {
+		res = append(res, b.Status())
+	}
+
+	return res
+}
+
+// Connectors status of connectors to external systems
+func (s *implementation) Connectors() []connectorTypes.Status {
+	res := make([]connectorTypes.Status, 0, len(s.inner.connectors))
+	for _, c := range s.inner.connectors {
+		res = append(res, c.Status())
+	}
+
+	return res
+}
+
+// Rules statistics of rules in order
+func (s *implementation) Rules() []rules.Stat {
+	if s.inner.rules == nil {
+		return nil
+	}
+
+	return s.inner.rules.Stats()
+}
+
+// connector by name, nil if there is no such connector or it cannot forward messages
+func (s *implementation) connector(name string) connectorTypes.Forwarder {
+	for _, c := range s.inner.connectors {
+		if c.Status().Name == name {
+			f, _ := c.(connectorTypes.Forwarder)
+			return f
+		}
+	}
+
+	return nil
+}
+
+// TopicStats access statistics of most recently published topics
+func (s *implementation) TopicStats(limit int) []topicsTypes.TopicStat {
+	return s.inner.topicsMgr.TopicStats(limit)
+}
+
+// FilterStats subscriber counts of filters with largest fan-out
+func (s *implementation) FilterStats(limit int) []systree.FilterCount {
+	return s.inner.sysTree.Subscriptions().Filters(limit)
+}
+
+// Ban refuse connections of client id or from IP address or network
+func (s *implementation) Ban(ban Ban) error {
+	err := s.inner.bans.add(ban)
+	s.auditAdmin(audit.ActionBan, err, audit.Record{ClientID: ban.ClientID, RemoteAddr: ban.IP, Detail: banExpiry(ban)})
+	if err != nil {
+		return err
+	}
+
+	s.log.Prod.Info("Ban added",
+		zap.String("ClientID", ban.ClientID),
+		zap.String("ip", ban.IP),
+		zap.Time("expires", ban.Expires))
+
+	return nil
+}
+
+// Unban lift ban of client id or IP
+func (s *implementation) Unban(ban Ban) bool {
+	removed := s.inner.bans.remove(ban)
+	if removed {
+		s.auditAdmin(audit.ActionUnban, nil, audit.Record{ClientID: ban.ClientID, RemoteAddr: ban.IP})
+	}
+
+	return removed
+}
+
+// Bans currently active
+func (s *implementation) Bans() []Ban {
+	return s.inner.bans.list()
+}
+
+// Reauthorize check subscriptions of all sessions against auth providers
+func (s *implementation) Reauthorize() int {
+	dropped := s.inner.sessionsMgr.Reauthorize()
+
+	s.log.Prod.Info("Subscriptions reauthorized", zap.Int("dropped", dropped))
+	s.auditAdmin(audit.ActionReauthorize, nil, audit.Record{Detail: "dropped " + strconv.Itoa(dropped)})
+
+	return dropped
+}
+
+// Sessions snapshot of all sessions
+func (s *implementation) Sessions() []session.Info {
+	return s.inner.sessionsMgr.Sessions()
+}
+
+// Session snapshot of session
+func (s *implementation) Session(id string) (session.Info, bool) {
+	return s.inner.sessionsMgr.Session(id)
+}
+
+// Kick force disconnect client
+func (s *implementation) Kick(id string, wipe bool) bool {
+	kicked := s.inner.sessionsMgr.Kick(id, wipe)
+	if kicked {
+		r := audit.Record{ClientID: id}
+		if wipe {
+			r.Detail = "wipe"
+		}
+		s.auditAdmin(audit.ActionKick, nil, r)
+	}
+
+	return kicked
+}
+
 // Close terminates the server by shutting down all the client connections and closing
 // the listener. It will, as best it can, clean up after itself.
 func (s *implementation) Close() error {
@@ -264,6 +1191,17 @@ func (s *implementation) Close() error {
 	defer s.inner.lock.Unlock()
 	s.inner.lock.Lock()
 
+	s.inner.health.wg.Wait()
+	s.inner.snapshot.wg.Wait()
+	s.inner.sys.wg.Wait()
+	s.inner.deadLetters.wg.Wait()
+	s.inner.events.wg.Wait()
+	s.inner.packets.wg.Wait()
+	s.inner.alarms.wg.Wait()
+	s.inner.metrics.wg.Wait()
+	s.inner.debug.wg.Wait()
+	s.inner.rest.wg.Wait()
+
 	// We then close all net.Listener, which will force Accept() to return if it's
 	// blocked waiting for new connections.
 	for _, l := range s.inner.listeners.list {
@@ -278,32 +1216,97 @@ func (s *implementation) Close() error {
 	// Wait all of listeners has finished
 	s.inner.listeners.wg.Wait()
 
-	for port := range s.inner.listeners.list {
-		delete(s.inner.listeners.list, port)
+	for addr := range s.inner.listeners.list {
+		delete(s.inner.listeners.list, addr)
+	}
+
+	for _, b := range s.inner.bridges {
+		b.Close() // nolint: errcheck, gas
+	}
+
+	for _, c := range s.inner.connectors {
+		c.Close() // nolint: errcheck, gas
 	}
 
 	if s.inner.sessionsMgr != nil {
+		if s.inner.config.DrainTimeout > 0 {
+			s.log.Prod.Info("Draining sessions", zap.Duration("timeout", s.inner.config.DrainTimeout))
+			s.inner.sessionsMgr.Drain(s.inner.config.DrainTimeout)
+		}
+
 		if s.inner.persist != nil {
 			s.inner.sessionsMgr.Shutdown() // nolint: errcheck, gas
 		}
 	}
 
+	if s.inner.wal != nil {
+		if err := s.inner.wal.Close(); err != nil {
+			s.log.Prod.Error("Couldn't close in-flight log", zap.Error(err))
+		}
+	}
+
 	if s.inner.topicsMgr != nil {
 		s.inner.topicsMgr.Close() // nolint: errcheck, gas
 	}
 
+	// flush persisted state only when sessions and retained messages stored
+	if s.inner.persist != nil {
+		if err := s.inner.persist.Shutdown(); err != nil {
+			s.log.Prod.Error("Couldn't shutdown persistence", zap.Error(err))
+		}
+	}
+
 	return nil
 }
 
 // handleConnection is for the broker to handle an incoming connection from a client
-func (l *ListenerBase) handleConnection(c types.Conn) {
+// state is TLS connection state if connection is secured
+func (l *ListenerBase) handleConnection(c types.Conn, state *tls.ConnectionState) {
 	if c == nil {
 		l.log.Prod.Error("Invalid connection type")
 		return
 	}
 
+	if !l.addrAllowed(c.RemoteAddr()) {
+		l.log.Dev.Debug("Connection refused by address filter", zap.Stringer("addr", c.RemoteAddr()))
+		c.Close() // nolint: errcheck, gas
+		return
+	}
+
+	var serverName string
+	if state != nil {
+		serverName = state.ServerName
+	}
+
 	var err error
 
+	release, allowed := l.inner.conns.acquire(c.RemoteAddr())
+	overLimit := !allowed
+
+	if l.MaxConnections > 0 {
+		if atomic.AddInt64(&l.connections, 1) > int64(l.MaxConnections) {
+			overLimit = true
+		}
+
+		serverRelease := release
+		release = func() {
+			atomic.AddInt64(&l.connections, -1)
+			serverRelease()
+		}
+	}
+
+	l.stat.Opened()
+	limitsRelease := release
+	release = func() {
+		l.stat.Closed()
+		limitsRelease()
+	}
+
+	c = &trackedConn{
+		Conn:    c,
+		release: release,
+	}
+
 	defer func() {
 		if err != nil {
 			c.Close() // nolint: errcheck, gas
@@ -355,17 +1358,93 @@ func (l *ListenerBase) handleConnection(c types.Conn) {
 	} else {
 		switch r := req.(type) {
 		case *message.ConnectMessage:
-			if r.UsernameFlag() {
-				if err = l.AuthManager.Password(string(r.Username()), string(r.Password())); err == nil {
+			endTrace := l.traceConnect(r, c.RemoteAddr(), resp)
+
+			authMgr := l.authManager()
+			var params session.StartParams
+
+			// identity of verified client certificate replaces password check
+			certUser := l.certIdentity(state)
+			if certUser != "" && r.UsernameFlag() && !l.CertOverridesUsername {
+				certUser = ""
+			}
+
+			user := string(r.Username())
+			if certUser != "" {
+				user = certUser
+			}
+
+			authenticated := certUser != "" || r.UsernameFlag()
+
+			vHost := l.virtualHost(serverName)
+			if vHost != nil && vHost.AuthManager != nil {
+				authMgr = vHost.AuthManager
+			}
+
+			knownHost := len(l.VirtualHosts) == 0 || vHost != nil
+
+			// namespace and session id are resolved before authentication thus providers
+			// see the same client identity at connect and every later check
+			if vHost == nil && authenticated && l.VirtualHostByUser != nil {
+				vHost = l.VirtualHostByUser(user)
+			}
+
+			if vHost == nil {
+				vHost = l.VirtualHost
+			}
+
+			if vHost != nil {
+				params.Namespace = vHost.namespace()
+			}
+
+			params.ID = l.inner.sessionsMgr.SessionID(string(r.ClientID()), params.Namespace)
+			client := auth.Client{ID: params.ID, Namespace: params.Namespace}
+			if authenticated {
+				client.User = user
+			}
+
+			// how client has been authenticated or why refused, recorded into audit log
+			var method, refused string
+
+			if !l.versionAllowed(r.Version()) {
+				resp.SetReturnCode(message.ErrInvalidProtocolVersion) // nolint: errcheck
+				refused = "protocol version"
+			} else if overLimit || !l.connectAllowed(c.RemoteAddr()) {
+				resp.SetReturnCode(message.ErrServerUnavailable) // nolint: errcheck
+				refused = "connection limit"
+			} else if !r.CleanSession() && l.inner.degraded() {
+				// persistent session cannot be restored nor stored while backend is down
+				resp.SetReturnCode(message.ErrServerUnavailable) // nolint: errcheck
+				refused = "persistence degraded"
+			} else if l.inner.bans.clientBanned(string(r.ClientID())) {
+				resp.SetReturnCode(message.ErrNotAuthorized) // nolint: errcheck
+				refused = "banned"
+			} else if l.inner.throttle.blocked(string(r.ClientID()), c.RemoteAddr()) {
+				resp.SetReturnCode(message.ErrNotAuthorized) // nolint: errcheck
+				refused = "throttled"
+			} else if !knownHost {
+				resp.SetReturnCode(message.ErrNotAuthorized) // nolint: errcheck
+				refused = "unknown virtual host"
+			} else if certUser != "" {
+				resp.SetReturnCode(message.ConnectionAccepted) // nolint: errcheck
+				method = "certificate"
+			} else if r.UsernameFlag() {
+				if err = authMgr.CheckConnect(client, string(r.Password())); err == nil {
 					resp.SetReturnCode(message.ConnectionAccepted) // nolint: errcheck
+					l.inner.throttle.succeeded(string(r.ClientID()))
+					method = "password"
 				} else {
 					resp.SetReturnCode(message.ErrBadUsernameOrPassword) // nolint: errcheck
+					l.inner.throttle.failed(string(r.ClientID()), c.RemoteAddr())
+					refused = "bad credentials"
 				}
 			} else {
 				if l.inner.config.Anonymous {
 					resp.SetReturnCode(message.ConnectionAccepted) // nolint: errcheck
+					method = "anonymous"
 				} else {
 					resp.SetReturnCode(message.ErrNotAuthorized) // nolint: errcheck
+					refused = "anonymous not allowed"
 				}
 			}
 
@@ -373,13 +1452,93 @@ func (l *ListenerBase) handleConnection(c types.Conn) {
 				r.SetKeepAlive(uint16(l.inner.config.KeepAlive))
 			}
 
-			if err = l.inner.sessionsMgr.Start(r, resp, c); err != nil {
-				if err != session.ErrNotAccepted {
-					l.log.Prod.Error("Couldn't start session", zap.Error(err))
-				}
+			params.Auth = authMgr
+			if authenticated {
+				params.Username = user
+			} else if l.inner.anonAuth != nil {
+				authMgr = l.inner.anonAuth
+				params.Auth = authMgr
+			}
+
+			role := authMgr.Role(client)
+			params.Quota = l.inner.quota(role)
+			params.Ack = l.inner.ackPolicy(role)
+			params.Listener = l.stat
+
+			params.Subscriptions = l.SubscriptionPolicy
+			if !authenticated && l.AnonymousSubscriptionPolicy != nil {
+				params.Subscriptions = l.AnonymousSubscriptionPolicy
+			}
+
+			if vHost != nil && vHost.SubscriptionPolicy != nil {
+				params.Subscriptions = vHost.SubscriptionPolicy
 			}
+
+			err = l.inner.sessionsMgr.Start(r, resp, c, params)
+			if err != nil && err != session.ErrNotAccepted {
+				l.log.Prod.Error("Couldn't start session", zap.Error(err))
+				endTrace(err)
+			} else {
+				endTrace(nil)
+			}
+
+			l.auditConnect(r, user, c.RemoteAddr(), resp.ReturnCode(), method, refused)
 		default:
 			l.log.Prod.Error("Unexpected message type", zap.String("expected", "CONNECT"), zap.String("received", r.Type().Name()))
 		}
 	}
 }
+
+// quota of clients with given role
+func (l *listenerInner) quota(role string) *ratelimit.Quota {
+	if q, ok := l.config.Quotas[role]; ok {
+		return q
+	}
+
+	return l.config.Quotas[""]
+}
+
+// ackPolicy of clients with given role
+func (l *listenerInner) ackPolicy(role string) *types.AckPolicy {
+	if p, ok := l.config.AckPolicies[role]; ok {
+		return p
+	}
+
+	return l.config.AckPolicies[""]
+}
+
+// authManager returns auth chain of the listener or server wide one if not set
+func (l *ListenerBase) authManager() *auth.Manager {
+	if l.AuthManager != nil {
+		return l.AuthManager
+	}
+
+	return l.inner.authMgr
+}
+
+// versionAllowed check if listener accepts given protocol level
+func (l *ListenerBase) versionAllowed(v byte) bool {
+	if len(l.ProtocolVersions) == 0 {
+		return true
+	}
+
+	for _, allowed := range l.ProtocolVersions {
+		if allowed == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trackedConn releases connection slots once closed
+type trackedConn struct {
+	types.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
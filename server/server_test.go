@@ -0,0 +1,330 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/auth"
+	"github.com/troian/surgemq/auth/jwt"
+	authTypes "github.com/troian/surgemq/auth/types"
+	"github.com/troian/surgemq/message"
+	_ "github.com/troian/surgemq/persistence/badger"
+	_ "github.com/troian/surgemq/persistence/boltdb"
+	_ "github.com/troian/surgemq/persistence/tenant"
+	persistTypes "github.com/troian/surgemq/persistence/types"
+	"github.com/troian/surgemq/topics/rewrite"
+	"github.com/troian/surgemq/types"
+)
+
+// topicsAuth accepts user with password "pass" and denies access to secret topics
+type topicsAuth struct{}
+
+func (topicsAuth) CheckConnect(c auth.Client, password string) auth.Result {
+	if c.User == "user" && password == "pass" {
+		return auth.Allow
+	}
+
+	return auth.Deny
+}
+
+func (topicsAuth) CheckPublish(c auth.Client, topic string) auth.Result {
+	if strings.HasPrefix(topic, "secret/") {
+		return auth.Deny
+	}
+
+	return auth.Ignore
+}
+
+func (topicsAuth) CheckSubscribe(c auth.Client, filter string) auth.Result {
+	if strings.HasPrefix(filter, "secret/") {
+		return auth.Deny
+	}
+
+	return auth.Ignore
+}
+
+// allowAuth registered provider allowing everything
+type allowAuth struct{}
+
+func (allowAuth) Password(user, password string) error { return nil }
+
+func (allowAuth) AclCheck(clientID, user, topic string, access authTypes.AccessType) error {
+	return nil
+}
+
+func (allowAuth) PskKey(hint, identity string, key []byte, maxKeyLen int) error { return nil }
+
+// tokenSecret key of tokens accepted by "test.jwt" provider
+var tokenSecret = []byte("secret")
+
+func init() {
+	auth.RegisterAuth("test.topics", topicsAuth{})                          // nolint: errcheck
+	auth.Register("test.allow", allowAuth{})                                // nolint: errcheck
+	auth.RegisterAuth("test.jwt", jwt.New(jwt.Config{Secret: tokenSecret})) // nolint: errcheck
+}
+
+// token HS256 signed by tokenSecret
+func token(t *testing.T, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	input := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(input)) // nolint: errcheck
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// tempFile path within temporary directory removed once test ends
+func tempFile(t *testing.T, name string) string {
+	dir, err := ioutil.TempDir("", "server")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) }) // nolint: errcheck
+
+	return filepath.Join(dir, name)
+}
+
+// startServer with in-memory transport of listener l, default one if nil
+// Persistence defaults to bolt database in temporary directory
+func startServer(t *testing.T, config Config, l *ListenerTransport) *types.TransportMem {
+	config.SysInterval = -1
+	if config.Persistence == nil {
+		config.Persistence = &persistTypes.BoltDBConfig{File: tempFile(t, "bolt.db")}
+	}
+
+	srv, err := New(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() }) // nolint: errcheck
+
+	if l == nil {
+		l = &ListenerTransport{}
+	}
+
+	tr := types.NewTransportMem("local")
+	l.Transport = tr
+	require.NoError(t, srv.ListenAndServe(l))
+
+	return tr
+}
+
+// dial connect client and check CONNACK
+func dial(t *testing.T, tr *types.TransportMem, id string) net.Conn {
+	return dialAs(t, tr, id, "user", "pass")
+}
+
+// dialAs connect client with credentials and check CONNACK
+func dialAs(t *testing.T, tr *types.TransportMem, id, user, password string) net.Conn {
+	c, code := connect(t, tr, id, user, password, true)
+	require.Equal(t, message.ConnectionAccepted, code)
+
+	return c
+}
+
+// connect client and return code of CONNACK
+func connect(t *testing.T, tr *types.TransportMem, id, user, password string, clean bool) (net.Conn, message.ConnAckCode) {
+	c, err := tr.Dial()
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() }) // nolint: errcheck
+
+	require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+
+	msg := message.NewConnectMessage()
+	require.NoError(t, msg.SetVersion(0x4))
+	require.NoError(t, msg.SetClientID([]byte(id)))
+	msg.SetCleanSession(clean)
+	msg.SetKeepAlive(30)
+	msg.SetUsername([]byte(user))
+	msg.SetPassword([]byte(password))
+	require.NoError(t, message.WriteTo(c, msg))
+
+	resp := read(t, c)
+	require.IsType(t, &message.ConnAckMessage{}, resp)
+
+	return c, resp.(*message.ConnAckMessage).ReturnCode()
+}
+
+func read(t *testing.T, c net.Conn) message.Provider {
+	msg, err := message.ReadFrom(c)
+	require.NoError(t, err)
+
+	return msg
+}
+
+func publish(t *testing.T, c net.Conn, id uint16, topic string) {
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic(topic))
+	require.NoError(t, msg.SetQoS(message.QoS1))
+	msg.SetPacketID(id)
+	msg.SetPayload([]byte(topic))
+	require.NoError(t, message.WriteTo(c, msg))
+}
+
+// subscribe single filter as SUBSCRIBE does not keep order of filters
+func subscribe(t *testing.T, c net.Conn, id uint16, filter string, granted message.QosType) {
+	msg := message.NewSubscribeMessage()
+	msg.SetPacketID(id)
+	require.NoError(t, msg.AddTopic(filter, message.QoS1))
+	require.NoError(t, message.WriteTo(c, msg))
+
+	ack := read(t, c)
+	require.IsType(t, &message.SubAckMessage{}, ack)
+	require.Equal(t, []message.QosType{granted}, ack.(*message.SubAckMessage).ReturnCodes())
+}
+
+func TestAuthChain(t *testing.T) {
+	tr := startServer(t, Config{Authenticators: "test.topics;test.allow"}, nil)
+
+	sub := dial(t, tr, "sub")
+
+	// denied subscription fails, allowed one is granted
+	subscribe(t, sub, 1, "secret/#", message.QosFailure)
+	subscribe(t, sub, 2, "#", message.QoS1)
+
+	pub := dial(t, tr, "pub")
+
+	// denied publish is acknowledged as MQTT 3.1.1 has no way to report it
+	publish(t, pub, 1, "secret/keys")
+	ack := read(t, pub)
+	require.IsType(t, &message.PubAckMessage{}, ack)
+	require.Equal(t, uint16(1), ack.(*message.PubAckMessage).PacketID())
+
+	publish(t, pub, 2, "public/news")
+	ack = read(t, pub)
+	require.IsType(t, &message.PubAckMessage{}, ack)
+	require.Equal(t, uint16(2), ack.(*message.PubAckMessage).PacketID())
+
+	// subscriber of # receives allowed message only, denied one published before is dropped
+	got := read(t, sub)
+	require.IsType(t, &message.PublishMessage{}, got)
+	require.Equal(t, "public/news", got.(*message.PublishMessage).Topic())
+
+	require.NoError(t, sub.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, err := message.ReadFrom(sub)
+	require.Error(t, err)
+}
+
+func TestAuthChainBadCredentials(t *testing.T) {
+	tr := startServer(t, Config{Authenticators: "test.topics;test.allow"}, nil)
+
+	c, err := tr.Dial()
+	require.NoError(t, err)
+	defer c.Close() // nolint: errcheck
+
+	require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+
+	msg := message.NewConnectMessage()
+	require.NoError(t, msg.SetVersion(0x4))
+	require.NoError(t, msg.SetClientID([]byte("bad")))
+	msg.SetCleanSession(true)
+	msg.SetUsername([]byte("user"))
+	msg.SetPassword([]byte("wrong"))
+	require.NoError(t, message.WriteTo(c, msg))
+
+	// explicit denial is not overruled by providers later in the chain
+	resp := read(t, c)
+	require.IsType(t, &message.ConnAckMessage{}, resp)
+	require.Equal(t, message.ErrBadUsernameOrPassword, resp.(*message.ConnAckMessage).ReturnCode())
+}
+
+func TestTokenGrants(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    string
+		vhost *VirtualHost
+	}{
+		{"client id", "dev1", nil},
+		{"empty client id", "", nil},
+		{"virtual host", "dev1", &VirtualHost{Name: "tenant"}},
+		{"virtual host with prefix", "dev1", &VirtualHost{TopicPrefix: "tenant/"}},
+		{"virtual host empty client id", "", &VirtualHost{Name: "tenant"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := startServer(t, Config{Authenticators: "test.jwt;test.allow"},
+				&ListenerTransport{ListenerBase: ListenerBase{VirtualHost: tt.vhost}})
+
+			// client of password rather than token is not restricted
+			obs := dial(t, tr, "observer")
+			subscribe(t, obs, 1, "#", message.QoS1)
+
+			// grants of token are kept by session id thus apply after connect whatever id is
+			c := dialAs(t, tr, tt.id, "user", token(t, map[string]interface{}{
+				"publish":   []string{"allowed/#"},
+				"subscribe": []string{"allowed/#"},
+			}))
+
+			subscribe(t, c, 1, "other/#", message.QosFailure)
+			subscribe(t, c, 2, "#", message.QosFailure)
+			subscribe(t, c, 3, "allowed/#", message.QoS1)
+
+			// publish outside of grant is dropped, the one after it is delivered first
+			publish(t, c, 4, "other/x")
+			publish(t, c, 5, "allowed/x")
+
+			got := read(t, obs)
+			require.IsType(t, &message.PublishMessage{}, got)
+			require.Equal(t, "allowed/x", got.(*message.PublishMessage).Topic())
+		})
+	}
+}
+
+func TestQuotaRefused(t *testing.T) {
+	tr := startServer(t, Config{
+		Authenticators: "test.allow",
+		Persistence: &persistTypes.TenantConfig{
+			Provider: &persistTypes.BadgerConfig{InMemory: true},
+			Tenants:  map[string]persistTypes.TenantQuota{"": {MaxSessions: 1}},
+		},
+	}, &ListenerTransport{ListenerBase: ListenerBase{MaxConnections: 2}})
+
+	_, code := connect(t, tr, "a", "user", "pass", false)
+	require.Equal(t, message.ConnectionAccepted, code)
+
+	// persistent session over quota is refused and its connection closed
+	c, code := connect(t, tr, "b", "user", "pass", false)
+	require.Equal(t, message.ErrServerUnavailable, code)
+
+	_, err := message.ReadFrom(c)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	// slot of refused connection is released
+	dial(t, tr, "c")
+}
+
+func TestNewFailureReleasesPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	config := Config{
+		Authenticators: "test.allow",
+		SysInterval:    -1,
+		Persistence:    &persistTypes.BadgerConfig{Dir: dir},
+		TopicRewrite:   []rewrite.Rule{{}},
+	}
+
+	_, err = New(config)
+	require.Equal(t, rewrite.ErrInvalidRule, err)
+
+	// database locked by failed server would not open again
+	config.TopicRewrite = nil
+
+	srv, err := New(config)
+	require.NoError(t, err)
+	require.NoError(t, srv.Close())
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/snapshot"
+	"go.uber.org/zap"
+)
+
+// TopicSnapshot publishing to it triggers snapshot of persistence store. Payload is ignored
+const TopicSnapshot = "$SYS/broker/persistence/snapshot"
+
+var (
+	// ErrSnapshotNotConfigured snapshot target is not set
+	ErrSnapshotNotConfigured = errors.New("snapshot target not configured")
+
+	// ErrSnapshotInProgress previous snapshot has not finished yet
+	ErrSnapshotInProgress = errors.New("snapshot in progress")
+)
+
+// SnapshotConfig backup of persistence store taken while server keeps running
+type SnapshotConfig struct {
+	// Target snapshots are stored into, e.g. snapshot.NewDirTarget or snapshot.NewS3Target
+	Target snapshot.Target
+
+	// CommandClients IDs of clients allowed to trigger snapshot by publishing to
+	// TopicSnapshot. Empty disables the command
+	CommandClients []string
+}
+
+// Snapshot copy persistence store into configured target. Returns name of snapshot
+func (s *implementation) Snapshot() (string, error) {
+	cfg := s.inner.config.Snapshot
+	if cfg == nil || cfg.Target == nil {
+		return "", ErrSnapshotNotConfigured
+	}
+
+	if !atomic.CompareAndSwapInt32(&s.inner.snapshot.running, 0, 1) {
+		return "", ErrSnapshotInProgress
+	}
+	defer atomic.StoreInt32(&s.inner.snapshot.running, 0)
+
+	s.inner.snapshot.wg.Add(1)
+	defer s.inner.snapshot.wg.Done()
+
+	select {
+	case <-s.inner.quit:
+		return "", errors.New("server is closing")
+	default:
+	}
+
+	name, err := snapshot.Take(s.inner.persist, cfg.Target)
+	if err != nil {
+		s.log.Prod.Error("Couldn't take snapshot", zap.Error(err))
+		return "", err
+	}
+
+	s.log.Prod.Info("Snapshot taken", zap.String("name", name))
+
+	return name, nil
+}
+
+// onSysPublish handle commands published by clients to system topics
+func (s *implementation) onSysPublish(id string, msg *message.PublishMessage) {
+	if msg.Topic() != TopicSnapshot {
+		s.log.Dev.Debug("Unknown system topic", zap.String("ClientID", id), zap.String("topic", msg.Topic()))
+		return
+	}
+
+	if !s.commandAllowed(id) {
+		s.log.Prod.Warn("Snapshot command denied", zap.String("ClientID", id))
+		return
+	}
+
+	go s.Snapshot() // nolint: errcheck
+}
+
+func (s *implementation) commandAllowed(id string) bool {
+	if s.inner.config.Snapshot == nil {
+		return false
+	}
+
+	for _, c := range s.inner.config.Snapshot.CommandClients {
+		if c == id {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	statsPath       = "/stats"
+	defaultStatsTop = 10
+)
+
+// Stats snapshot of broker statistics suitable for dashboards
+type Stats struct {
+	Time time.Time `json:"time"`
+
+	// Uptime in seconds
+	Uptime int64 `json:"uptime"`
+
+	ClientsConnected uint64 `json:"clients_connected"`
+	ClientsMaximum   uint64 `json:"clients_maximum"`
+	Connections      int64  `json:"connections"`
+	Retained         uint64 `json:"retained"`
+	Subscriptions    uint64 `json:"subscriptions"`
+
+	// Totals cumulative counters named as $SYS topics, e.g. "publish/messages/received"
+	Totals map[string]uint64 `json:"totals"`
+
+	// Rates per minute of Totals averaged over last 1, 5 and 15 minutes
+	Rates map[string]StatsRates `json:"rates"`
+
+	// Dropped messages by cause, e.g. "queue full"
+	Dropped map[string]uint64 `json:"dropped"`
+
+	// TopTopics busiest topics by amount of published messages
+	TopTopics []TopicUsage `json:"top_topics"`
+
+	// TopClients busiest clients by amount of published messages received and sent
+	TopClients []ClientUsage `json:"top_clients"`
+
+	// Alarms currently raised
+	Alarms []string `json:"alarms"`
+}
+
+// StatsRates per minute rate of counter
+type StatsRates struct {
+	Min1  float64 `json:"1min"`
+	Min5  float64 `json:"5min"`
+	Min15 float64 `json:"15min"`
+}
+
+// TopicUsage messages published to and delivered from topic
+type TopicUsage struct {
+	Topic         string    `json:"topic"`
+	Published     uint64    `json:"published"`
+	Delivered     uint64    `json:"delivered"`
+	LastPublished time.Time `json:"last_published"`
+}
+
+// ClientUsage messages published by and delivered to client since its session is in memory
+type ClientUsage struct {
+	ID       string `json:"id"`
+	State    string `json:"state"`
+	Received uint64 `json:"received"`
+	Sent     uint64 `json:"sent"`
+}
+
+// Stats snapshot of totals, load averages and top busiest topics and clients
+// Top limits amount of topics and clients, 0 omits them
+func (s *implementation) Stats(top int) Stats {
+	snap := s.inner.sysTree.Snapshot()
+
+	st := Stats{
+		Time:             time.Now().UTC(),
+		Uptime:           int64(snap.Uptime.Seconds()),
+		ClientsConnected: snap.ClientsConnected,
+		ClientsMaximum:   snap.ClientsMaximum,
+		Connections:      snap.Connections,
+		Retained:         snap.Retained,
+		Subscriptions:    snap.Subscriptions,
+		Totals:           snap.Totals,
+		Rates:            make(map[string]StatsRates, len(snap.Rates)),
+		Dropped:          snap.Dropped,
+		TopTopics:        []TopicUsage{},
+		TopClients:       []ClientUsage{},
+		Alarms:           snap.Alarms,
+	}
+
+	if st.Alarms == nil {
+		st.Alarms = []string{}
+	}
+
+	for name, r := range snap.Rates {
+		st.Rates[name] = StatsRates{Min1: r.Min1, Min5: r.Min5, Min15: r.Min15}
+	}
+
+	if top <= 0 {
+		return st
+	}
+
+	if s.inner.topicsMgr != nil {
+		for _, t := range s.inner.topicsMgr.TopicStats(top) {
+			st.TopTopics = append(st.TopTopics, TopicUsage{
+				Topic:         t.Topic,
+				Published:     t.Published,
+				Delivered:     t.Delivered,
+				LastPublished: t.LastPublished,
+			})
+		}
+	}
+
+	if s.inner.sessionsMgr != nil {
+		for _, i := range s.inner.sessionsMgr.MemorySessions() {
+			st.TopClients = append(st.TopClients, ClientUsage{
+				ID:       i.ID,
+				State:    i.State.String(),
+				Received: i.Received,
+				Sent:     i.Sent,
+			})
+		}
+
+		sort.Slice(st.TopClients, func(i, j int) bool {
+			a, b := st.TopClients[i], st.TopClients[j]
+			if a.Received+a.Sent != b.Received+b.Sent {
+				return a.Received+a.Sent > b.Received+b.Sent
+			}
+
+			return a.ID < b.ID
+		})
+
+		if len(st.TopClients) > top {
+			st.TopClients = st.TopClients[:top]
+		}
+	}
+
+	return st
+}
+
+// StatsHandler handler serving Stats in JSON
+func (s *implementation) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		top := defaultStatsTop
+		if v := r.URL.Query().Get("top"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid top", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		if err := json.NewEncoder(w).Encode(s.Stats(top)); err != nil {
+			s.log.Dev.Debug("Couldn't write stats", zap.String("RemoteAddr", r.RemoteAddr), zap.Error(err))
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"time"
+
+	"github.com/troian/surgemq/message"
+	"go.uber.org/zap"
+)
+
+const defaultSysInterval = 10 * time.Second
+
+// sysWorker periodically publish $SYS topics from systree as retained messages
+// Only values changed since previous round are published
+func (s *implementation) sysWorker(interval time.Duration) {
+	defer s.inner.sys.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := make(map[string]string)
+
+	s.publishSys(last)
+
+	for {
+		select {
+		case <-s.inner.quit:
+			return
+		case <-ticker.C:
+			s.publishSys(last)
+		}
+	}
+}
+
+func (s *implementation) publishSys(last map[string]string) {
+	for _, e := range s.inner.sysTree.Entries() {
+		if v, ok := last[e.Topic]; ok && v == e.Value {
+			continue
+		}
+
+		last[e.Topic] = e.Value
+
+		msg := message.NewPublishMessage()
+		if err := msg.SetTopic(e.Topic); err != nil {
+			s.log.Prod.Error("Invalid $SYS topic", zap.String("topic", e.Topic), zap.Error(err))
+			continue
+		}
+
+		msg.SetPayload([]byte(e.Value))
+		msg.SetRetain(true)
+
+		if err := s.inner.topicsMgr.Retain(msg); err != nil {
+			s.log.Prod.Error("Couldn't retain $SYS topic", zap.String("topic", e.Topic), zap.Error(err))
+		}
+
+		// [MQTT-3.3.1-9]
+		msg.SetRetain(false)
+
+		if err := s.inner.topicsMgr.Publish(msg); err != nil {
+			s.log.Prod.Error("Couldn't publish $SYS topic", zap.String("topic", e.Topic), zap.Error(err))
+		}
+	}
+}
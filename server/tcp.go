@@ -15,8 +15,19 @@ import (
 type ListenerTCP struct {
 	ListenerBase
 
-	Scheme    string
-	Host      string
+	Scheme string
+	Host   string
+
+	// ProxyProtocol expect HAProxy PROXY protocol (v1 or v2) header on every accepted connection
+	// Enable only if listener is behind load balancer as header is trusted as is
+	ProxyProtocol bool
+
+	// ProxyHeaderTimeout time to wait for PROXY header. If not set DefaultProxyHeaderTimeout used
+	ProxyHeaderTimeout time.Duration
+
+	// TCP socket options of accepted connections
+	TCP TCPOptions
+
 	listener  net.Listener
 	tlsConfig *tls.Config
 }
@@ -36,56 +47,48 @@ func (l *ListenerTCP) start() error {
 	defer l.inner.lock.Unlock()
 	l.inner.lock.Lock()
 
-	var err error
-
-	if l.CertFile != "" && l.KeyFile != "" {
-		l.tlsConfig = &tls.Config{
-			Certificates: make([]tls.Certificate, 1),
-		}
+	if _, ok := l.inner.listeners.list[l.address()]; ok {
+		return errors.New("Listener already exists")
+	}
 
-		l.tlsConfig.Certificates[0], err = tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
-		if err != nil {
-			l.tlsConfig = nil
-			return err
-		}
+	if err := l.initLimits(); err != nil {
+		return err
 	}
 
-	var ln net.Listener
-	if ln, err = net.Listen(l.Scheme, l.Host+":"+strconv.Itoa(l.Port)); err != nil {
+	var err error
+
+	if l.tlsConfig, err = l.newTLSConfig(); err != nil {
 		return err
 	}
 
-	if l.tlsConfig != nil {
-		l.listener = tls.NewListener(ln, l.tlsConfig)
-	} else {
-		l.listener = ln
+	// TLS handshake is done per connection as PROXY header if any precedes it
+	if l.listener, err = net.Listen(l.Scheme, l.Host+":"+strconv.Itoa(l.Port)); err != nil {
+		return err
 	}
 
-	if _, ok := l.inner.listeners.list[l.Port]; !ok {
-		//listener.quit = s.quit
-		l.inner.listeners.list[l.Port] = l
-		l.inner.listeners.wg.Add(1)
+	l.listener = &tunedListener{Listener: l.listener, opts: &l.TCP, log: &l.log}
 
-		go func() {
-			defer l.inner.listeners.wg.Done()
+	l.inner.listeners.list[l.address()] = l
+	l.inner.listeners.wg.Add(1)
 
-			if l.inner.config.ListenerStatus != nil {
-				l.inner.config.ListenerStatus(l.Scheme+"://"+l.Host+":"+strconv.Itoa(l.Port), true)
-			}
-			err = l.serve()
+	go func() {
+		defer l.inner.listeners.wg.Done()
 
-			if l.inner.config.ListenerStatus != nil {
-				l.inner.config.ListenerStatus(l.Scheme+"://"+l.Host+":"+strconv.Itoa(l.Port), false)
-			}
-		}()
-	} else {
-		err = errors.New("Listener already exists")
-	}
+		l.serving(l.address(), true)
 
-	return err
+		if e := l.serve(); e != nil {
+			l.log.Prod.Error("Listener stopped", zap.Error(e))
+		}
+
+		l.serving(l.address(), false)
+	}()
+
+	return nil
 }
 
 func (l *ListenerTCP) close() error {
+	l.stopCertificatesWatch()
+
 	return l.listener.Close()
 }
 
@@ -93,6 +96,10 @@ func (l *ListenerTCP) listenerProtocol() string {
 	return "tcp"
 }
 
+func (l *ListenerTCP) address() string {
+	return l.Scheme + "://" + l.Host + ":" + strconv.Itoa(l.Port)
+}
+
 func (l *ListenerTCP) serve() error {
 	var tempDelay time.Duration // how long to sleep on accept failure
 
@@ -126,14 +133,48 @@ func (l *ListenerTCP) serve() error {
 			return err
 		}
 
+		if !l.acceptAllowed() {
+			l.log.Dev.Debug("Accept rate exceeded. Dropping connection", zap.String("RemoteAddr", conn.RemoteAddr().String()))
+			conn.Close() // nolint: errcheck, gas
+			continue
+		}
+
 		l.inner.wgConnections.Add(1)
 		go func(cn net.Conn) {
 			defer l.inner.wgConnections.Done()
 
-			if conn, err := types.NewConnTCP(cn, l.inner.sysTree.Metric().Bytes()); err != nil {
+			if l.ProxyProtocol {
+				pc, err := readProxyHeader(cn, l.ProxyHeaderTimeout)
+				if err != nil {
+					l.log.Prod.Error("Couldn't read PROXY header", zap.String("RemoteAddr", cn.RemoteAddr().String()), zap.Error(err))
+					cn.Close() // nolint: errcheck, gas
+					return
+				}
+				cn = pc
+			}
+
+			var state *tls.ConnectionState
+
+			if l.tlsConfig != nil {
+				tc := tls.Server(cn, l.tlsConfig)
+
+				// complete handshake here to know which virtual host client is asking for
+				tc.SetDeadline(time.Now().Add(time.Second * time.Duration(l.inner.config.ConnectTimeout))) // nolint: errcheck, gas
+				if err := tc.Handshake(); err != nil {
+					l.log.Prod.Error("TLS handshake failed", zap.String("RemoteAddr", cn.RemoteAddr().String()), zap.Error(err))
+					tc.Close() // nolint: errcheck, gas
+					return
+				}
+
+				cs := tc.ConnectionState()
+				state = &cs
+				cn = tc
+			}
+
+			if conn, err := types.NewConnTCP(cn, l.stat.Bytes()); err != nil {
 				l.log.Prod.Error("Couldn't create connection interface", zap.Error(err))
 			} else {
-				l.handleConnection(conn)
+				l.handleConnection(conn, state)
 			}
 		}(conn)
 	}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+// TCPOptions socket options applied to every accepted TCP connection
+// Zero value keeps Go runtime and OS defaults
+type TCPOptions struct {
+	// Nagle enable Nagle's algorithm (TCP_NODELAY off) trading latency for throughput
+	Nagle bool
+
+	// KeepAlivePeriod interval of TCP keep alive probes
+	// 0 uses runtime default, negative disables SO_KEEPALIVE
+	KeepAlivePeriod time.Duration
+
+	// ReadBuffer and WriteBuffer size of socket buffers in bytes. 0 uses OS default
+	ReadBuffer  int
+	WriteBuffer int
+
+	// Linger seconds to wait for unsent data on close. 0 uses OS default,
+	// negative discards unsent data and resets connection
+	Linger int
+}
+
+// apply set options on connection if it is TCP one
+func (o *TCPOptions) apply(c net.Conn) error {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if o.Nagle {
+		if err := tc.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+
+	if o.KeepAlivePeriod < 0 {
+		if err := tc.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if o.KeepAlivePeriod > 0 {
+		if err := tc.SetKeepAlive(true); err != nil {
+			return err
+		}
+
+		if err := tc.SetKeepAlivePeriod(o.KeepAlivePeriod); err != nil {
+			return err
+		}
+	}
+
+	if o.ReadBuffer > 0 {
+		if err := tc.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+
+	if o.WriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+
+	if o.Linger < 0 {
+		if err := tc.SetLinger(0); err != nil {
+			return err
+		}
+	} else if o.Linger > 0 {
+		if err := tc.SetLinger(o.Linger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tunedListener applies TCP options on accepted connections
+// Connections options cannot be set on are dropped
+type tunedListener struct {
+	net.Listener
+	opts *TCPOptions
+	log  *types.LogInterface
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if err = l.opts.apply(c); err != nil {
+			l.log.Prod.Error("Couldn't set TCP options", zap.String("RemoteAddr", c.RemoteAddr().String()), zap.Error(err))
+			c.Close() // nolint: errcheck, gas
+			continue
+		}
+
+		return c, nil
+	}
+}
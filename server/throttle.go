@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/troian/surgemq/systree"
+)
+
+// AuthThrottleConfig backoff of sources repeatedly failing authentication
+// Failures are counted separately per client id and per source IP
+type AuthThrottleConfig struct {
+	// MaxFailures failed attempts allowed before source is blocked. Default to 5
+	MaxFailures int
+
+	// Backoff how long source is blocked once MaxFailures reached. Doubled on every
+	// further failure. Default to 1 second
+	Backoff time.Duration
+
+	// MaxBackoff cap of backoff, i.e. duration of lockout. Default to 15 minutes
+	MaxBackoff time.Duration
+
+	// Forget failures of source not seen for this long. Default to MaxBackoff
+	Forget time.Duration
+}
+
+type authFailures struct {
+	count int
+	until time.Time
+	last  time.Time
+}
+
+type authThrottle struct {
+	config *AuthThrottleConfig
+	stat   systree.AuthStat
+
+	lock    sync.Mutex
+	sources map[string]*authFailures
+	pruned  time.Time
+}
+
+func newAuthThrottle(config *AuthThrottleConfig, stat systree.AuthStat) *authThrottle {
+	c := *config
+
+	if c.MaxFailures == 0 {
+		c.MaxFailures = 5
+	}
+
+	if c.Backoff == 0 {
+		c.Backoff = time.Second
+	}
+
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 15 * time.Minute
+	}
+
+	if c.Forget == 0 {
+		c.Forget = c.MaxBackoff
+	}
+
+	return &authThrottle{
+		config:  &c,
+		stat:    stat,
+		sources: make(map[string]*authFailures),
+	}
+}
+
+// throttleKeys of client id and address, auto assigned client ids are not tracked
+func throttleKeys(clientID string, addr net.Addr) []string {
+	var keys []string
+
+	if clientID != "" {
+		keys = append(keys, "id:"+clientID)
+	}
+
+	if ip := hostIP(addr); ip != nil {
+		keys = append(keys, "ip:"+ip.String())
+	}
+
+	return keys
+}
+
+// blocked check if any of sources is backing off. nil throttle never blocks
+func (t *authThrottle) blocked(clientID string, addr net.Addr) bool {
+	if t == nil {
+		return false
+	}
+
+	now := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, k := range throttleKeys(clientID, addr) {
+		if f, ok := t.sources[k]; ok && now.Before(f.until) {
+			t.stat.Throttled()
+			return true
+		}
+	}
+
+	return false
+}
+
+// failed account rejected credentials of sources
+func (t *authThrottle) failed(clientID string, addr net.Addr) {
+	if t == nil {
+		return
+	}
+
+	t.stat.Failed()
+
+	now := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.prune(now)
+
+	for _, k := range throttleKeys(clientID, addr) {
+		f, ok := t.sources[k]
+		if !ok || (now.After(f.until) && now.Sub(f.last) > t.config.Forget) {
+			f = &authFailures{}
+			t.sources[k] = f
+		}
+
+		f.count++
+		f.last = now
+
+		if over := f.count - t.config.MaxFailures; over >= 0 {
+			backoff := t.config.MaxBackoff
+			if over < 32 {
+				if d := t.config.Backoff << uint(over); d > 0 && d < backoff {
+					backoff = d
+				}
+			}
+
+			f.until = now.Add(backoff)
+
+			if over == 0 {
+				t.stat.LockedOut()
+			}
+		}
+	}
+}
+
+// succeeded reset failures of client id. Address keeps its record as single valid
+// account must not let the source continue guessing credentials of others
+func (t *authThrottle) succeeded(clientID string) {
+	if t == nil || clientID == "" {
+		return
+	}
+
+	t.lock.Lock()
+	delete(t.sources, "id:"+clientID)
+	t.lock.Unlock()
+}
+
+// prune forgotten sources, must be called with lock held
+func (t *authThrottle) prune(now time.Time) {
+	if now.Sub(t.pruned) < t.config.Forget/4 {
+		return
+	}
+
+	t.pruned = now
+
+	for k, f := range t.sources {
+		if now.After(f.until) && now.Sub(f.last) > t.config.Forget {
+			delete(t.sources, k)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troian/surgemq/auth"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	"go.uber.org/zap"
+)
+
+// VirtualHost tenant selected by TLS SNI hostname, identity of client or listener
+type VirtualHost struct {
+	// Name of the tenant. If TopicPrefix is not set tenant topics are mapped into $vhost/<Name>/
+	Name string
+
+	// TopicPrefix namespace every topic of tenant clients is mapped into.
+	// Clients of the tenant never see the prefix. Prefix starting with '$' isolates
+	// tenant from wildcard subscriptions of clients outside of any virtual host
+	TopicPrefix string
+
+	// AuthManager auth realm of the tenant. If not set listener's chain is used
+	AuthManager *auth.Manager
+
+	// SubscriptionPolicy wildcard restrictions of tenant clients
+	// If not set listener's policy is used
+	SubscriptionPolicy *topicsTypes.SubscriptionPolicy
+
+	// CertFile and KeyFile certificate presented to clients of the tenant
+	// If not set listener's certificate is used
+	CertFile string
+	KeyFile  string
+
+	cert *keyPair
+}
+
+// CertIdentity part of client certificate used as identity
+type CertIdentity int
+
+// nolint: golint
+const (
+	// CertIdentityNone certificate does not authenticate client
+	CertIdentityNone CertIdentity = iota
+	// CertIdentityCN subject common name
+	CertIdentityCN
+	// CertIdentitySAN first of DNS names, email addresses or URIs of subject alternative names
+	CertIdentitySAN
+)
+
+// certIdentity of verified client certificate, empty if not available or not enabled
+func (l *ListenerBase) certIdentity(state *tls.ConnectionState) string {
+	if l.CertIdentity == CertIdentityNone || state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := state.VerifiedChains[0][0]
+
+	switch l.CertIdentity {
+	case CertIdentityCN:
+		return cert.Subject.CommonName
+	case CertIdentitySAN:
+		switch {
+		case len(cert.DNSNames) > 0:
+			return cert.DNSNames[0]
+		case len(cert.EmailAddresses) > 0:
+			return cert.EmailAddresses[0]
+		case len(cert.URIs) > 0:
+			return cert.URIs[0].String()
+		}
+	}
+
+	return ""
+}
+
+// keyPair certificate loaded from files which can be replaced on the fly
+type keyPair struct {
+	certFile string
+	keyFile  string
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newKeyPair(certFile, keyFile string) (*keyPair, error) {
+	kp := &keyPair{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if _, err := kp.reload(); err != nil {
+		return nil, err
+	}
+
+	return kp, nil
+}
+
+func (kp *keyPair) get() *tls.Certificate {
+	kp.lock.RLock()
+	defer kp.lock.RUnlock()
+
+	return kp.cert
+}
+
+// reload certificate if any of files has been modified since last load
+// previous certificate is kept if new one cannot be loaded
+func (kp *keyPair) reload() (bool, error) {
+	modTime, err := kp.lastModified()
+	if err != nil {
+		return false, err
+	}
+
+	kp.lock.RLock()
+	same := kp.cert != nil && modTime.Equal(kp.modTime)
+	kp.lock.RUnlock()
+
+	if same {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	kp.lock.Lock()
+	kp.cert = &cert
+	kp.modTime = modTime
+	kp.lock.Unlock()
+
+	return true, nil
+}
+
+func (kp *keyPair) lastModified() (time.Time, error) {
+	var last time.Time
+
+	for _, f := range []string{kp.certFile, kp.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return last, err
+		}
+
+		if fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+
+	return last, nil
+}
+
+// newTLSConfig build TLS config of the listener
+// returns nil config if listener has neither certificate nor GetCertificate configured
+func (l *ListenerBase) newTLSConfig() (*tls.Config, error) {
+	var err error
+
+	l.certs.def = nil
+	if l.CertFile != "" && l.KeyFile != "" {
+		if l.certs.def, err = newKeyPair(l.CertFile, l.KeyFile); err != nil {
+			return nil, err
+		}
+	} else if l.GetCertificate == nil {
+		return nil, nil
+	}
+
+	for _, vh := range l.VirtualHosts {
+		if vh.CertFile != "" && vh.KeyFile != "" {
+			if vh.cert, err = newKeyPair(vh.CertFile, vh.KeyFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if vh := l.virtualHost(hello.ServerName); vh != nil && vh.cert != nil {
+				return vh.cert.get(), nil
+			}
+
+			if l.GetCertificate != nil {
+				return l.GetCertificate(hello)
+			}
+
+			return l.certs.def.get(), nil
+		},
+	}
+
+	if l.ClientCAFile != "" {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(l.ClientCAFile); err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("listener: no certificates in " + l.ClientCAFile)
+		}
+
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if l.ClientCertOptional {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	if l.CertReloadInterval > 0 {
+		l.certs.quit = make(chan struct{})
+		l.certs.wg.Add(1)
+		go l.watchCertificates()
+	}
+
+	return config, nil
+}
+
+// watchCertificates periodically check certificate files and pick up renewed ones
+// Established connections are not affected, new handshakes use renewed certificate
+func (l *ListenerBase) watchCertificates() {
+	defer l.certs.wg.Done()
+
+	ticker := time.NewTicker(l.CertReloadInterval)
+	defer ticker.Stop()
+
+	reload := func(kp *keyPair) {
+		if kp == nil {
+			return
+		}
+
+		if reloaded, err := kp.reload(); err != nil {
+			l.log.Prod.Error("Couldn't reload certificate", zap.String("cert", kp.certFile), zap.Error(err))
+		} else if reloaded {
+			l.log.Prod.Info("Certificate reloaded", zap.String("cert", kp.certFile))
+		}
+	}
+
+	for {
+		select {
+		case <-l.certs.quit:
+			return
+		case <-ticker.C:
+			reload(l.certs.def)
+			for _, vh := range l.VirtualHosts {
+				reload(vh.cert)
+			}
+		}
+	}
+}
+
+// stopCertificatesWatch stop watcher if running
+func (l *ListenerBase) stopCertificatesWatch() {
+	if l.certs.quit != nil {
+		close(l.certs.quit)
+		l.certs.wg.Wait()
+		l.certs.quit = nil
+	}
+}
+
+// virtualHost lookup tenant by SNI hostname
+// namespace topics of tenant clients are mapped into
+func (vh *VirtualHost) namespace() string {
+	if vh.TopicPrefix != "" || vh.Name == "" {
+		return vh.TopicPrefix
+	}
+
+	return "$vhost/" + vh.Name + "/"
+}
+
+func (l *ListenerBase) virtualHost(serverName string) *VirtualHost {
+	if len(l.VirtualHosts) == 0 || serverName == "" {
+		return nil
+	}
+
+	return l.VirtualHosts[strings.ToLower(serverName)]
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"net"
+
+	"github.com/troian/surgemq/message"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName instrumentation name spans of broker are started with
+const tracerName = "github.com/troian/surgemq"
+
+// traceConnect start span of CONNECT handling. Span is ended with CONNACK return code
+// by returned func once session has been started or connection refused
+func (l *ListenerBase) traceConnect(r *message.ConnectMessage, addr net.Addr, resp *message.ConnAckMessage) func(err error) {
+	attrs := []attribute.KeyValue{
+		attribute.String("mqtt.client_id", string(r.ClientID())),
+		attribute.Int("mqtt.protocol_version", int(r.Version())),
+		attribute.Bool("mqtt.clean_session", r.CleanSession()),
+	}
+
+	if addr != nil {
+		attrs = append(attrs, attribute.String("net.peer.addr", addr.String()))
+	}
+
+	_, span := l.inner.tracer.Start(context.Background(), "mqtt.connect",
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+
+	return func(err error) {
+		span.SetAttributes(attribute.Int("mqtt.connack.return_code", int(resp.ReturnCode())))
+
+		if err != nil {
+			span.RecordError(err)
+		}
+
+		if resp.ReturnCode() != message.ConnectionAccepted {
+			span.SetStatus(codes.Error, resp.ReturnCode().Desc())
+		} else if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		span.End()
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+// ListenerTransport listener serving connections of custom transport
+type ListenerTransport struct {
+	ListenerBase
+
+	Transport types.Transport
+}
+
+func (l *ListenerTransport) start() error {
+	select {
+	case <-l.inner.quit:
+		return nil
+	default:
+	}
+
+	defer l.inner.lock.Unlock()
+	l.inner.lock.Lock()
+
+	if _, ok := l.inner.listeners.list[l.address()]; ok {
+		return errors.New("Listener already exists")
+	}
+
+	if err := l.initLimits(); err != nil {
+		return err
+	}
+
+	l.inner.listeners.list[l.address()] = l
+	l.inner.listeners.wg.Add(1)
+
+	go func() {
+		defer l.inner.listeners.wg.Done()
+
+		l.serving(l.address(), true)
+
+		if e := l.serve(); e != nil {
+			l.log.Prod.Error("Listener stopped", zap.Error(e))
+		}
+
+		l.serving(l.address(), false)
+	}()
+
+	return nil
+}
+
+func (l *ListenerTransport) close() error {
+	return l.Transport.Close()
+}
+
+func (l *ListenerTransport) listenerProtocol() string {
+	return l.Transport.Addr().Network()
+}
+
+func (l *ListenerTransport) address() string {
+	addr := l.Transport.Addr()
+
+	return addr.Network() + "://" + addr.String()
+}
+
+func (l *ListenerTransport) serve() error {
+	for {
+		cn, err := l.Transport.Accept()
+		if err != nil {
+			select {
+			case <-l.inner.quit:
+				return nil
+			default:
+			}
+
+			return err
+		}
+
+		if !l.acceptAllowed() {
+			l.log.Dev.Debug("Accept rate exceeded. Dropping connection")
+			cn.Close() // nolint: errcheck, gas
+			continue
+		}
+
+		l.inner.wgConnections.Add(1)
+		go func(cn types.Conn) {
+			defer l.inner.wgConnections.Done()
+
+			if conn, err := types.NewConnStream(cn, l.stat.Bytes()); err != nil {
+				l.log.Prod.Error("Couldn't create connection interface", zap.Error(err))
+			} else {
+				l.handleConnection(conn, nil)
+			}
+		}(cn)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+// tunnelProtocol value of Upgrade header requesting raw MQTT stream
+const tunnelProtocol = "mqtt"
+
+// serveHTTP dispatch tunnel requests if enabled, everything else goes to WebSocket handler
+func (l *ListenerWS) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.Tunneling {
+		if r.Method == http.MethodConnect {
+			l.serveTunnel(w, r, "HTTP/1.1 200 Connection established\r\n\r\n")
+			return
+		}
+
+		if strings.EqualFold(r.Header.Get("Upgrade"), tunnelProtocol) {
+			l.serveTunnel(w, r, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: "+tunnelProtocol+"\r\nConnection: Upgrade\r\n\r\n")
+			return
+		}
+	}
+
+	l.s.mux.ServeHTTP(w, r)
+}
+
+// serveTunnel take over HTTP connection and serve raw MQTT stream over it
+func (l *ListenerWS) serveTunnel(w http.ResponseWriter, r *http.Request, reply string) {
+	if !l.acceptAllowed() {
+		l.log.Dev.Debug("Accept rate exceeded. Dropping connection", zap.String("RemoteAddr", r.RemoteAddr))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+
+	cn, rw, err := hj.Hijack()
+	if err != nil {
+		l.log.Prod.Error("Couldn't hijack HTTP connection", zap.Error(err))
+		return
+	}
+
+	if _, err = cn.Write([]byte(reply)); err != nil {
+		l.log.Prod.Error("Couldn't write tunnel reply", zap.Error(err))
+		cn.Close() // nolint: errcheck, gas
+		return
+	}
+
+	// client may have sent MQTT data along with request which is buffered already
+	var c net.Conn = cn
+	if rw.Reader.Buffered() > 0 {
+		c = &proxyConn{Conn: cn, r: rw.Reader}
+	}
+
+	l.inner.wgConnections.Add(1)
+	go func() {
+		defer l.inner.wgConnections.Done()
+
+		if conn, err := types.NewConnTCP(c, l.stat.Bytes()); err != nil {
+			l.log.Prod.Error("Couldn't create connection interface", zap.Error(err))
+		} else {
+			l.handleConnection(conn, r.TLS)
+		}
+	}()
+}
@@ -1,10 +1,12 @@
 package server
 
 import (
+	"net"
 	"net/http"
 
 	"errors"
 	"strconv"
+	"strings"
 
 	"crypto/tls"
 
@@ -24,32 +26,60 @@ type httpServer struct {
 // ListenerWS listener object for websocket server
 type ListenerWS struct {
 	ListenerBase
+	Host string
 	Path string
 
-	up  websocket.Upgrader
-	log types.LogInterface
+	// TCP socket options of accepted connections
+	TCP TCPOptions
 
-	s httpServer
-}
+	// AllowedOrigins origins browsers are allowed to connect from, "*" allows any
+	// If empty only requests with Origin matching Host are accepted
+	AllowedOrigins []string
+
+	// Subprotocols negotiated with client in order of preference
+	// If empty mqtt, mqttv3.1 and mqttv3.1.1 are offered
+	Subprotocols []string
+
+	// EnableCompression negotiate permessage-deflate with clients supporting it
+	EnableCompression bool
+
+	// MaxFrameSize maximum size in bytes of message read from client
+	// Connection is closed if exceeded. 0 means unlimited
+	MaxFrameSize int64
+
+	// Tunneling accept raw MQTT stream over HTTP CONNECT or "Upgrade: mqtt" requests
+	// on the same port for clients behind restrictive proxies
+	Tunneling bool
+
+	up websocket.Upgrader
 
-func (s *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.mux.ServeHTTP(w, r)
+	s httpServer
 }
 
 func (l *ListenerWS) serveWs(w http.ResponseWriter, r *http.Request) {
+	if !l.acceptAllowed() {
+		l.log.Dev.Debug("Accept rate exceeded. Dropping connection", zap.String("RemoteAddr", r.RemoteAddr))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
 	conn, err := l.up.Upgrade(w, r, nil)
 	if err != nil {
 		l.log.Prod.Error("Couldn't upgrade WebSocket connection", zap.Error(err))
 		return
 	}
 
+	if l.MaxFrameSize > 0 {
+		conn.SetReadLimit(l.MaxFrameSize)
+	}
+
 	l.inner.wgConnections.Add(1)
 	go func(cn *websocket.Conn) {
 		defer l.inner.wgConnections.Done()
-		if conn, err := types.NewConnWs(cn, l.inner.sysTree.Metric().Bytes()); err != nil {
+		if conn, err := types.NewConnWs(cn, l.stat.Bytes()); err != nil {
 			l.log.Prod.Error("Couldn't create connection interface", zap.Error(err))
 		} else {
-			l.handleConnection(conn)
+			l.handleConnection(conn, r.TLS)
 		}
 	}(conn)
 }
@@ -68,68 +98,77 @@ func (l *ListenerWS) start() error {
 		l.Path = "/"
 	}
 
-	l.up.Subprotocols = make([]string, 3)
-	l.up.Subprotocols[0] = "mqtt"
-	l.up.Subprotocols[1] = "mqttv3.1"
-	l.up.Subprotocols[2] = "mqttv3.1.1"
+	if len(l.Subprotocols) > 0 {
+		l.up.Subprotocols = l.Subprotocols
+	} else {
+		l.up.Subprotocols = []string{"mqtt", "mqttv3.1", "mqttv3.1.1"}
+	}
 
-	var err error
+	l.up.EnableCompression = l.EnableCompression
 
-	isTLS := false
+	if len(l.AllowedOrigins) > 0 {
+		l.up.CheckOrigin = l.checkOrigin
+	}
 
-	if l.CertFile != "" && l.KeyFile != "" {
-		certificates := make([]tls.Certificate, 1)
+	if _, ok := l.inner.listeners.list[l.address()]; ok {
+		return errors.New("Listener already exists")
+	}
 
-		if certificates[0], err = tls.LoadX509KeyPair(l.CertFile, l.KeyFile); err != nil {
-			return err
-		}
-		isTLS = true
+	if err := l.initLimits(); err != nil {
+		return err
+	}
+
+	var err error
+
+	var tlsConfig *tls.Config
+	if tlsConfig, err = l.newTLSConfig(); err != nil {
+		return err
 	}
 
 	l.s.mux = http.NewServeMux()
 	l.s.mux.HandleFunc(l.Path, l.serveWs)
 
 	l.s.h = &http.Server{
-		Addr:    ":" + strconv.Itoa(l.Port),
-		Handler: &l.s,
+		Addr:      l.Host + ":" + strconv.Itoa(l.Port),
+		Handler:   http.HandlerFunc(l.serveHTTP),
+		TLSConfig: tlsConfig,
 	}
 
-	if _, ok := l.inner.listeners.list[l.Port]; !ok {
-		l.inner.listeners.list[l.Port] = l
-		l.inner.listeners.wg.Add(1)
-
-		go func() {
-			defer l.inner.listeners.wg.Done()
-
-			var statusAddr string
-
-			if isTLS {
-				statusAddr = "wss://:" + strconv.Itoa(l.Port)
-			} else {
-				statusAddr = "ws://:" + strconv.Itoa(l.Port)
-			}
-			if l.inner.config.ListenerStatus != nil {
-				l.inner.config.ListenerStatus(statusAddr, true)
-			}
-
-			if isTLS {
-				err = l.s.h.ListenAndServeTLS(l.CertFile, l.KeyFile)
-			} else {
-				err = l.s.h.ListenAndServe()
-			}
-
-			if l.inner.config.ListenerStatus != nil {
-				l.inner.config.ListenerStatus(statusAddr, false)
-			}
-		}()
-	} else {
-		err = errors.New("Listener already exists")
+	var ln net.Listener
+	if ln, err = net.Listen("tcp", l.s.h.Addr); err != nil {
+		return err
 	}
 
-	return err
+	ln = &tunedListener{Listener: ln, opts: &l.TCP, log: &l.log}
+
+	l.inner.listeners.list[l.address()] = l
+	l.inner.listeners.wg.Add(1)
+
+	go func() {
+		defer l.inner.listeners.wg.Done()
+
+		l.serving(l.address(), true)
+
+		var e error
+		if l.isTLS() {
+			e = l.s.h.ServeTLS(ln, "", "")
+		} else {
+			e = l.s.h.Serve(ln)
+		}
+
+		if e != nil && e != http.ErrServerClosed {
+			l.log.Prod.Error("Listener stopped", zap.Error(e))
+		}
+
+		l.serving(l.address(), false)
+	}()
+
+	return nil
 }
 
 func (l *ListenerWS) close() error {
+	l.stopCertificatesWatch()
+
 	ctx, ctxCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer ctxCancel()
 
@@ -139,3 +178,35 @@ func (l *ListenerWS) close() error {
 func (l *ListenerWS) listenerProtocol() string {
 	return "tcp"
 }
+
+func (l *ListenerWS) address() string {
+	scheme := "ws"
+	if l.isTLS() {
+		scheme = "wss"
+	}
+
+	return scheme + "://" + l.Host + ":" + strconv.Itoa(l.Port) + l.Path
+}
+
+func (l *ListenerWS) isTLS() bool {
+	return (l.CertFile != "" && l.KeyFile != "") || l.GetCertificate != nil
+}
+
+// checkOrigin validate Origin header of upgrade request against allowed list
+// Requests without Origin are not sent by browsers thus are accepted
+func (l *ListenerWS) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, o := range l.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+
+	l.log.Prod.Warn("WebSocket origin not allowed", zap.String("origin", origin), zap.String("RemoteAddr", r.RemoteAddr))
+
+	return false
+}
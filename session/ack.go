@@ -2,38 +2,127 @@ package session
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/persistence/wal"
+	"github.com/troian/surgemq/systree"
+	"go.uber.org/zap"
 )
 
 var (
 	errAckDoesNotExists = errors.New("Ack does not exists")
+
+	// ErrRetriesExhausted message has not been acknowledged after all retransmissions
+	ErrRetriesExhausted = errors.New("session: retries exhausted")
 )
 
 type onAckComplete func(msg message.Provider, err error)
 
+// ackJournal mirrors ack queue into write-ahead log
+type ackJournal struct {
+	log  *wal.Log
+	id   string
+	dir  string
+	err  *zap.Logger
+	stat systree.LatencyStat
+}
+
+// ackRetry retransmission state of message awaiting ack
+type ackRetry struct {
+	next    time.Time
+	attempt int
+}
+
+// ackRetryPolicy when unacknowledged messages are sent again. Zero timeout disables retries
+type ackRetryPolicy struct {
+	timeout time.Duration
+	retries int
+}
+
 type ackQueue struct {
 	lock          sync.Mutex
 	messages      map[uint16]message.Provider
+	retry         map[uint16]*ackRetry
+	order         map[uint16]uint64
+	seq           uint64
+	sent          map[uint16]time.Time
+	policy        ackRetryPolicy
 	onAckComplete onAckComplete
+	journal       ackJournal
+
+	// latency ack round-trip times are accounted into. Optional
+	latency systree.LatencyStat
 }
 
-func newAckQueue(onAckComplete onAckComplete) *ackQueue {
+func newAckQueue(onAckComplete onAckComplete, journal ackJournal, policy ackRetryPolicy) *ackQueue {
 	a := ackQueue{
 		messages:      make(map[uint16]message.Provider),
+		retry:         make(map[uint16]*ackRetry),
+		order:         make(map[uint16]uint64),
+		sent:          make(map[uint16]time.Time),
+		policy:        policy,
 		onAckComplete: onAckComplete,
+		journal:       journal,
 	}
 
 	return &a
 }
 
+// setPolicy of messages put from now on
+func (a *ackQueue) setPolicy(policy ackRetryPolicy) {
+	a.lock.Lock()
+	a.policy = policy
+	a.lock.Unlock()
+}
+
+func (j *ackJournal) put(msg message.Provider) {
+	if j.log == nil {
+		return
+	}
+
+	defer j.observe(time.Now())
+
+	if err := j.log.Put(j.id, j.dir, msg); err != nil {
+		j.err.Error("Couldn't journal in-flight message", zap.String("ClientID", j.id), zap.Error(err))
+	}
+}
+
+func (j *ackJournal) ack(id uint16) {
+	if j.log == nil {
+		return
+	}
+
+	defer j.observe(time.Now())
+
+	if err := j.log.Ack(j.id, j.dir, id); err != nil {
+		j.err.Error("Couldn't journal ack", zap.String("ClientID", j.id), zap.Error(err))
+	}
+}
+
+// observe account duration of journal write started at given time
+func (j *ackJournal) observe(start time.Time) {
+	if j.stat != nil {
+		j.stat.PersistenceWrite(time.Since(start))
+	}
+}
+
 func (a *ackQueue) put(msg message.Provider) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
 	if _, ok := a.messages[msg.PacketID()]; !ok {
 		a.messages[msg.PacketID()] = msg
+		a.order[msg.PacketID()] = a.seq
+		a.sent[msg.PacketID()] = time.Now()
+		a.seq++
+		a.journal.put(msg)
+
+		if a.policy.timeout > 0 {
+			a.retry[msg.PacketID()] = &ackRetry{next: time.Now().Add(a.policy.timeout)}
+		}
 	}
 }
 
@@ -47,8 +136,15 @@ func (a *ackQueue) ack(msg message.Provider) error {
 		if a.onAckComplete != nil {
 			a.onAckComplete(e, nil)
 		}
+		if a.latency != nil {
+			a.latency.AckRoundTrip(time.Since(a.sent[id]))
+		}
 		a.messages[id] = nil
 		delete(a.messages, id)
+		delete(a.retry, id)
+		delete(a.order, id)
+		delete(a.sent, id)
+		a.journal.ack(id)
 		return nil
 	}
 
@@ -56,13 +152,81 @@ func (a *ackQueue) ack(msg message.Provider) error {
 
 }
 
+// has check if exchange of packet ID is in progress
+func (a *ackQueue) has(id uint16) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	_, ok := a.messages[id]
+
+	return ok
+}
+
 func (a *ackQueue) get() map[uint16]message.Provider {
 	return a.messages
 }
 
+// ordered messages in order they were put
+func (a *ackQueue) ordered() []message.Provider {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	res := make([]message.Provider, 0, len(a.messages))
+	for _, m := range a.messages {
+		res = append(res, m)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return a.order[res[i].PacketID()] < a.order[res[j].PacketID()]
+	})
+
+	return res
+}
+
+func (a *ackQueue) size() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return len(a.messages)
+}
+
 func (a *ackQueue) wipe() {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
 	a.messages = make(map[uint16]message.Provider)
+	a.retry = make(map[uint16]*ackRetry)
+	a.order = make(map[uint16]uint64)
+	a.sent = make(map[uint16]time.Time)
+}
+
+// due messages which ack timed out. Messages to be sent again are returned in resend
+// with timeout doubled for every attempt, those out of retries are removed from queue
+func (a *ackQueue) due(now time.Time) (resend []message.Provider, expired []message.Provider) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for id, r := range a.retry {
+		if now.Before(r.next) {
+			continue
+		}
+
+		msg := a.messages[id]
+
+		if r.attempt >= a.policy.retries {
+			delete(a.messages, id)
+			delete(a.retry, id)
+			delete(a.order, id)
+			delete(a.sent, id)
+			a.journal.ack(id)
+			expired = append(expired, msg)
+			continue
+		}
+
+		r.attempt++
+		r.next = now.Add(a.policy.timeout << uint(r.attempt))
+		resend = append(resend, msg)
+	}
+
+	return resend, expired
 }
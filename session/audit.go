@@ -0,0 +1,25 @@
+package session
+
+import (
+	"github.com/troian/surgemq/audit"
+	"go.uber.org/zap"
+)
+
+// auditDenied record action of client denied by auth providers or subscription policy
+func (s *Type) auditDenied(action string, topic string) {
+	if s.config.audit == nil {
+		return
+	}
+
+	err := s.config.audit.Record(&audit.Record{
+		Action:     action,
+		Result:     audit.ResultDenied,
+		ClientID:   s.config.id,
+		Username:   s.username,
+		RemoteAddr: s.remoteAddr,
+		Topic:      topic,
+	})
+	if err != nil {
+		s.log.prod.Error("Couldn't write audit record", zap.String("ClientID", s.config.id), zap.Error(err))
+	}
+}
@@ -2,14 +2,25 @@ package session
 
 import (
 	"container/list"
+	"strings"
 	"sync/atomic"
+	"time"
 
+	"github.com/troian/surgemq/audit"
 	"github.com/troian/surgemq/message"
 	persistTypes "github.com/troian/surgemq/persistence/types"
+	"github.com/troian/surgemq/systree"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
 func (s *Type) onDisconnect(will bool) {
+	reason := DisconnectClient
+	if will {
+		reason = DisconnectReason(atomic.LoadInt32(&s.closeReason))
+	}
+
 	defer func() {
 		var persist *persistTypes.SessionMessages
 		shutdown := true
@@ -19,21 +30,39 @@ func (s *Type) onDisconnect(will bool) {
 
 			var next *list.Element
 
+			s.publisher.lock.Lock()
+
+			// messages are persisted in order they were published, in-flight ones were
+			// sent before those still queued
+			for _, m := range s.ack.pubOut.ordered() {
+				if p, ok := m.(*message.PublishMessage); ok {
+					traceDelivered(p, errDeliveryInterrupted)
+				}
+				persist.Out.Messages = append(persist.Out.Messages, m)
+			}
+			s.ack.pubOut.wipe()
+
 			for elem := s.publisher.messages.Front(); elem != nil; elem = next {
 				next = elem.Next()
 
-				if m, ok := s.publisher.messages.Remove(elem).(message.Provider); ok {
+				if m := s.publisher.remove(elem); m != nil {
 					persist.Out.Messages = append(persist.Out.Messages, m)
 				}
 			}
 
-			for _, m := range s.ack.pubOut.get() {
-				persist.Out.Messages = append(persist.Out.Messages, m)
+			// IDs are reserved again once persisted messages restored
+			s.publisher.ids.reset()
+
+			// persisted messages stay accounted by offline queue limits
+			s.publisher.offline.count = len(persist.Out.Messages)
+			s.publisher.offline.bytes = 0
+			for _, m := range persist.Out.Messages {
+				s.publisher.offline.bytes += msgSize(m)
 			}
-			s.ack.pubOut.wipe()
+			s.publisher.lock.Unlock()
 
 			for _, m := range s.ack.pubIn.get() {
-				persist.Out.Messages = append(persist.In.Messages, m)
+				persist.In.Messages = append(persist.In.Messages, m)
 			}
 
 			s.ack.pubIn.wipe()
@@ -45,7 +74,12 @@ func (s *Type) onDisconnect(will bool) {
 			}
 		}
 
-		s.config.callbacks.onDisconnect(s.config.id, persist, shutdown)
+		if s.config.metric.session != nil {
+			s.config.metric.session.Disconnected()
+		}
+
+		s.config.manager.onDisconnect(s.config.id, persist, shutdown)
+		s.config.hooks.OnDisconnect(s.config.id, reason)
 
 		atomic.StoreInt64(&s.connected, 0)
 		s.wg.conn.stopped.Done()
@@ -54,10 +88,16 @@ func (s *Type) onDisconnect(will bool) {
 	// just in case make sure session has been started
 	s.wg.conn.started.Wait()
 
-	// [MQTT-3.1.3.3]
+	s.log.dev.Debug("Connection closed", zap.String("ClientID", s.config.id), zap.Stringer("reason", reason))
+
+	// [MQTT-3.1.3.3] will is published only if client has not sent DISCONNECT
 	if will && s.will != nil {
-		s.log.dev.Debug("Connection unexpectedly closed. Sending Will", zap.String("ClientID", s.config.id))
-		s.publishToTopic(s.will) // nolint: errcheck
+		if s.config.hooks.OnWill(s.config.id, reason, s.will) {
+			s.log.dev.Debug("Connection unexpectedly closed. Sending Will", zap.String("ClientID", s.config.id))
+			s.publishToTopic(s.will) // nolint: errcheck
+		} else {
+			s.log.dev.Debug("Will suppressed by hook", zap.String("ClientID", s.config.id))
+		}
 	}
 
 	unSub := func(t string, q message.QosType) {
@@ -67,11 +107,11 @@ func (s *Type) onDisconnect(will bool) {
 		}
 	}
 
-	for t, q := range s.config.subscriptions {
+	for t, o := range s.config.subscriptions {
 		// if this is clean session unsubscribe from all topics
 		// if session is non-clean unsubscribe only QoS 0 topics
-		if s.clean || q == message.QoS0 {
-			unSub(t, q)
+		if s.clean || o.QoS == message.QoS0 {
+			unSub(t, o.QoS)
 			delete(s.config.subscriptions, t)
 		}
 	}
@@ -106,17 +146,106 @@ func (s *Type) onDisconnect(will bool) {
 // On QoS == 1, send back PUBACK, then take the next step
 // On QoS == 2, we need to put it in the ack queue, send back PUBREC
 func (s *Type) onPublish(msg *message.PublishMessage) error {
-	// check for topic access
 	var err error
 
+	// MQTT 3.1.1 has no reason code for unsupported QoS thus connection is closed
+	if msg.QoS() > s.config.maxQoS {
+		s.log.prod.Warn("QoS not supported. Disconnecting",
+			zap.String("ClientID", s.config.id),
+			zap.Int8("QoS", int8(msg.QoS())))
+		return ErrQoSNotSupported
+	}
+
+	// [MQTT-4.3.3-2] exchange stays in progress until PUBREL thus PUBLISH with the same
+	// packet ID is a duplicate, e.g. resent after reconnect. It is acknowledged again only
+	if msg.QoS() == message.QoS2 && s.ack.pubIn.has(msg.PacketID()) {
+		s.log.dev.Debug("Duplicate QoS 2 publish", zap.String("ClientID", s.config.id), zap.Uint16("PacketID", msg.PacketID()))
+
+		resp := message.NewPubRecMessage()
+		resp.SetPacketID(msg.PacketID())
+
+		_, err = s.conn.writeMessage(resp)
+		return err
+	}
+
+	s.markReceived(msg)
+
+	span := s.traceReceive(msg)
+	defer span.End()
+
+	// check for topic access
+
+	topic := s.config.rewrite.Publish(msg.Topic())
+	allowed := s.auth.CheckPublish(s.identity(), topic) == nil
+
+	if t := s.namespace + topic; t != msg.Topic() {
+		if err = msg.SetTopic(t); err != nil {
+			return err
+		}
+	}
+
+	// only QoS 2 exchanges stay unfinished after publish is received
+	inFlight := 0
+	if msg.QoS() == message.QoS2 {
+		inFlight = s.ack.pubIn.size()
+	}
+
+	delay, ok := s.quota.Take(len(msg.Payload()), inFlight)
+	if !ok {
+		s.log.prod.Warn("Quota exceeded. Disconnecting", zap.String("ClientID", s.config.id), zap.String("username", s.username))
+		return ErrQuotaExceeded
+	}
+
+	d, admit := s.config.limits.Take(s.config.id, msg.Topic(), len(msg.Payload()))
+	if d > delay {
+		delay = d
+	}
+
+	if delay > 0 {
+		// reading from connection is suspended thus client is slowed down by TCP flow control
+		select {
+		case <-time.After(delay):
+		case <-s.conn.done:
+			return nil
+		}
+	}
+
+	if !admit {
+		s.log.dev.Debug("Publish rate limit exceeded. Dropping message", zap.String("ClientID", s.config.id), zap.String("topic", msg.Topic()))
+	}
+
+	if !allowed {
+		s.log.dev.Debug("Publish denied. Dropping message", zap.String("ClientID", s.config.id), zap.String("topic", msg.Topic()))
+		s.auditDenied(audit.ActionPublish, msg.Topic())
+		s.drop(systree.DropACLDenied)
+		admit = false
+	}
+
+	if admit {
+		if err = s.config.hooks.OnPublishIn(s.config.id, msg); err != nil {
+			s.log.dev.Debug("Publish dropped by hook", zap.String("ClientID", s.config.id), zap.String("topic", msg.Topic()), zap.Error(err))
+			admit = false
+			err = nil
+		}
+	}
+
+	span.SetAttributes(attribute.Bool("mqtt.dropped", !admit))
+
+	// messages above rate or denied are still acknowledged thus client does not retransmit them
 	switch msg.QoS() {
 	case message.QoS2:
 		resp := message.NewPubRecMessage()
 		resp.SetPacketID(msg.PacketID())
 
-		if _, err = s.conn.writeMessage(resp); err == nil {
+		// Store exchange state before PUBREC is sent thus duplicates are detected
+		// even if PUBREC is lost. Dropped message is remembered by PUBREC alone
+		if admit {
 			s.ack.pubIn.put(msg)
+		} else {
+			s.ack.pubIn.put(resp)
 		}
+
+		_, err = s.conn.writeMessage(resp)
 	case message.QoS1:
 		resp := message.NewPubAckMessage()
 		resp.SetPacketID(msg.PacketID())
@@ -126,7 +255,9 @@ func (s *Type) onPublish(msg *message.PublishMessage) error {
 		s.conn.writeMessage(resp) // nolint: errcheck
 		fallthrough
 	case message.QoS0: // QoS 0
-		err = s.publishToTopic(msg)
+		if admit {
+			err = s.publishToTopic(msg)
+		}
 	}
 
 	return err
@@ -139,7 +270,9 @@ func (s *Type) onAck(msg message.Provider) error {
 	switch msg.(type) {
 	case *message.PubAckMessage:
 		// remote acknowledged PUBLISH QoS 1 message sent by this server
-		s.ack.pubOut.ack(msg) // nolint: errcheck
+		if s.ack.pubOut.ack(msg) == nil {
+			s.freePacketID(msg.PacketID())
+		}
 	case *message.PubRecMessage:
 		// remote received PUBLISH message sent by this server
 		s.ack.pubOut.ack(msg) // nolint: errcheck
@@ -153,12 +286,12 @@ func (s *Type) onAck(msg message.Provider) error {
 		s.ack.pubOut.put(resp)
 
 		// 2. Try send PUBREL reply
-		if _, err = s.conn.writeMessage(resp); err == nil {
+		if _, err = s.conn.writeMessage(resp); err != nil {
 			s.log.dev.Debug("Couldn't deliver PUBREL. Requeue publish", zap.String("ClientID", s.config.id))
 			// Couldn't deliver message. Remove it from ack queue and put into publish queue
 			s.ack.pubOut.ack(resp) // nolint: errcheck
 			s.publisher.lock.Lock()
-			s.publisher.messages.PushBack(resp)
+			s.publisher.pushBack(resp)
 			s.publisher.lock.Unlock()
 			s.publisher.cond.Signal()
 		}
@@ -176,7 +309,9 @@ func (s *Type) onAck(msg message.Provider) error {
 		}
 	case *message.PubCompMessage:
 		// PUBREL message has been acknowledged, release from queue
-		s.ack.pubOut.ack(msg) // nolint: errcheck
+		if s.ack.pubOut.ack(msg) == nil {
+			s.freePacketID(msg.PacketID())
+		}
 	default:
 		s.log.prod.Error("Unsupported ack message type", zap.String("ClientID", s.config.id), zap.String("type", msg.Type().Name()))
 	}
@@ -197,21 +332,68 @@ func (s *Type) onSubscribe(msg *message.SubscribeMessage) error {
 
 	for _, t := range topics {
 		// Let topic manager know we want to listen to given topic
-		qos := msg.TopicQos(t)
+		// [MQTT-3.9.3-2] server might grant lower QoS than requested
+		qos := s.grantQoS(msg.TopicQos(t))
+
+		lastValue := strings.HasPrefix(t, topicsTypes.LVC)
+		if lastValue {
+			t = strings.TrimPrefix(t, topicsTypes.LVC)
+		}
+
+		replay := 0
+		if f, n, ok := topicsTypes.ParseReplay(t); ok {
+			t, replay = f, n
+		}
+
+		t = s.config.rewrite.Subscribe(t)
+
+		if !s.policy.Allowed(t) {
+			s.log.dev.Debug("Subscription denied by policy", zap.String("ClientID", s.config.id), zap.String("topic", t))
+			s.auditDenied(audit.ActionSubscribe, s.namespace+t)
+			retCodes = append(retCodes, message.QosFailure)
+			continue
+		}
+
+		if err := s.auth.CheckSubscribe(s.identity(), t); err != nil {
+			s.log.dev.Debug("Subscription denied", zap.String("ClientID", s.config.id), zap.String("topic", t))
+			s.auditDenied(audit.ActionSubscribe, s.namespace+t)
+			retCodes = append(retCodes, message.QosFailure)
+			continue
+		}
+
+		t = s.namespace + t
+
+		hQoS, err := s.config.hooks.OnSubscribe(s.config.id, t, qos)
+		if err != nil || !hQoS.IsValid() {
+			s.log.dev.Debug("Subscription denied by hook", zap.String("ClientID", s.config.id), zap.String("topic", t), zap.Error(err))
+			retCodes = append(retCodes, message.QosFailure)
+			continue
+		}
+		qos = s.grantQoS(hQoS)
+
 		s.log.dev.Debug("Subscribing", zap.String("ClientID", s.config.id), zap.String("topic", t), zap.Int8("QoS", int8(qos)))
 		rQoS, err := s.config.topicsMgr.Subscribe(t, qos, &s.subscriber)
 		if err != nil {
 			return err
 		}
-		s.addTopic(t, qos) // nolint: errcheck
+		// MQTT 3.1.1 subscription carries QoS only
+		s.addTopic(t, message.SubscriptionOptions{QoS: qos}) // nolint: errcheck
 
 		retCodes = append(retCodes, rQoS)
 
 		// yeah I am not checking errors here. If there's an error we don't want the
 		// subscription to stop, just let it go.
-		s.config.topicsMgr.Retained(t, &retainedMessages) // nolint: errcheck
+		if lastValue {
+			s.config.topicsMgr.LastValues(t, &retainedMessages) // nolint: errcheck
+		} else if replay > 0 {
+			s.config.topicsMgr.History(t, replay, &retainedMessages) // nolint: errcheck
+		} else {
+			s.config.topicsMgr.Retained(t, &retainedMessages) // nolint: errcheck
+		}
 	}
 
+	s.persistSubscriptions()
+
 	if err := resp.AddReturnCodes(retCodes); err != nil {
 		return err
 	}
@@ -227,15 +409,12 @@ func (s *Type) onSubscribe(msg *message.SubscribeMessage) error {
 		m := message.NewPublishMessage()
 		// [MQTT-3.3.1-8]
 		m.SetRetain(true)
-		m.SetQoS(rm.QoS()) // nolint: errcheck
+		m.SetQoS(s.grantQoS(rm.QoS())) // nolint: errcheck
 		m.SetPayload(rm.Payload())
 		m.SetTopic(rm.Topic()) // nolint: errcheck
-		if m.PacketID() == 0 && (m.QoS() == message.QoS1 || m.QoS() == message.QoS2) {
-			m.SetPacketID(s.newPacketID())
-		}
 
 		s.publisher.lock.Lock()
-		s.publisher.messages.PushBack(m)
+		s.publisher.pushBack(m)
 		s.publisher.lock.Unlock()
 		s.publisher.cond.Signal()
 	}
@@ -245,10 +424,19 @@ func (s *Type) onSubscribe(msg *message.SubscribeMessage) error {
 
 func (s *Type) onUnSubscribe(msg *message.UnSubscribeMessage) (*message.UnSubAckMessage, error) {
 	for _, t := range msg.Topics() {
+		t = strings.TrimPrefix(t, topicsTypes.LVC)
+		if f, _, ok := topicsTypes.ParseReplay(t); ok {
+			t = f
+		}
+
+		t = s.namespace + s.config.rewrite.Subscribe(t)
 		s.config.topicsMgr.UnSubscribe(t, &s.subscriber) // nolint: errcheck
 		s.removeTopic(t)                                 // nolint: errcheck
+		s.config.hooks.OnUnsubscribe(s.config.id, t)
 	}
 
+	s.persistSubscriptions()
+
 	resp := message.NewUnSubAckMessage()
 	resp.SetPacketID(msg.PacketID())
 
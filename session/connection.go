@@ -7,8 +7,10 @@ import (
 	"time"
 
 	"errors"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"unicode/utf8"
 
 	"github.com/troian/surgemq"
 	"github.com/troian/surgemq/buffer"
@@ -18,6 +20,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// errPacketDropped packet violating protocol is dropped and connection kept by policy
+var errPacketDropped = errors.New("packet dropped")
+
 type onProcess struct {
 	publish     func(msg *message.PublishMessage) error
 	ack         func(msg message.Provider) error
@@ -28,10 +33,31 @@ type onProcess struct {
 
 type connConfig struct {
 	id            string
+	namespace     string
 	keepAlive     int
-	conn          io.Closer
+	conn          types.Conn
 	on            onProcess
 	packetsMetric systree.PacketsMetric
+	bytesMetric   systree.BytesMetric
+	publishMetric systree.PublishMetric
+	connStat      systree.ConnectionsStat
+	violationStat systree.ViolationsStat
+	dropStat      systree.DropsStat
+	slowClient    types.SlowClientConfig
+	violations    types.ViolationConfig
+
+	// traced either packets are reported to onPacket, set atomically
+	traced   *int32
+	onPacket func(incoming bool, msg message.Provider)
+
+	// published counts of PUBLISH packets of session, updated atomically
+	published *publishCounts
+}
+
+// publishCounts PUBLISH packets received from and sent to client
+type publishCounts struct {
+	received uint64
+	sent     uint64
 }
 
 type connection struct {
@@ -65,6 +91,9 @@ type connection struct {
 
 	will bool
 
+	// lastPacket unix nano time last complete control packet received at
+	lastPacket int64
+
 	log struct {
 		prod *zap.Logger
 		dev  *zap.Logger
@@ -78,19 +107,26 @@ type netReader interface {
 
 type timeoutReader struct {
 	d    time.Duration
+	last *int64
 	conn netReader
 }
 
 func newConnection(config connConfig) (conn *connection, err error) {
 	conn = &connection{
-		config: config,
-		done:   make(chan struct{}),
-		will:   true,
+		config:     config,
+		done:       make(chan struct{}),
+		will:       true,
+		lastPacket: time.Now().UnixNano(),
 	}
 
 	conn.log.prod = surgemq.GetProdLogger().Named("session.conn." + config.id)
 	conn.log.dev = surgemq.GetDevLogger().Named("session.conn." + config.id)
 
+	if addr := config.conn.RemoteAddr(); addr != nil {
+		conn.log.prod = conn.log.prod.With(zap.String("RemoteAddr", addr.String()))
+		conn.log.dev = conn.log.dev.With(zap.String("RemoteAddr", addr.String()))
+	}
+
 	conn.wg.conn.started.Add(1)
 	conn.wg.conn.stopped.Add(1)
 
@@ -175,8 +211,16 @@ func (s *connection) stop() (ret bool) {
 	return true
 }
 
+// Read with deadline of 1.5 keep-alive counted from last complete control packet
+// rather than last byte thus client trickling partial packet is disconnected as well
+// [MQTT-3.1.2-24]. Zero keep-alive disables deadline
 func (r timeoutReader) Read(b []byte) (int, error) {
-	if err := r.conn.SetReadDeadline(time.Now().Add(r.d)); err != nil {
+	var deadline time.Time
+	if r.d > 0 {
+		deadline = time.Unix(0, atomic.LoadInt64(r.last)).Add(r.d)
+	}
+
+	if err := r.conn.SetReadDeadline(deadline); err != nil {
 		return 0, err
 	}
 	return r.conn.Read(b)
@@ -218,6 +262,11 @@ func (s *connection) processIncoming() {
 
 		// 2. Now read message including fixed header
 		msg, _, err = s.readMessage(total)
+		if err == errPacketDropped {
+			atomic.StoreInt64(&s.lastPacket, time.Now().UnixNano())
+			continue
+		}
+
 		if err != nil {
 			if err != io.EOF {
 				s.log.prod.Error("Couldn't read message",
@@ -228,7 +277,31 @@ func (s *connection) processIncoming() {
 			return
 		}
 
+		atomic.StoreInt64(&s.lastPacket, time.Now().UnixNano())
+
 		s.config.packetsMetric.Received(msg.Type())
+		if s.config.bytesMetric != nil {
+			s.config.bytesMetric.Received(uint64(total))
+		}
+		if m, ok := msg.(*message.PublishMessage); ok {
+			if s.config.publishMetric != nil {
+				s.config.publishMetric.Received(m.QoS())
+			}
+			if s.config.published != nil {
+				atomic.AddUint64(&s.config.published.received, 1)
+			}
+		}
+
+		s.tracePacket(true, msg)
+
+		if t, ok := invalidTopic(msg); ok {
+			switch s.onViolation(types.ViolationInvalidUTF8, zap.String("topic", t)) {
+			case types.ViolationDisconnect:
+				return
+			case types.ViolationDrop:
+				continue
+			}
+		}
 
 		// 3. Put message for further processing
 		var resp message.Provider
@@ -260,6 +333,11 @@ func (s *connection) processIncoming() {
 			// For DISCONNECT message, we should quit without sending Will
 			s.will = false
 			return
+		case *message.ConnectMessage:
+			// [MQTT-3.1.0-2] CONNECT cannot be processed twice thus dropped unless policy disconnects
+			if s.onViolation(types.ViolationSecondConnect) == types.ViolationDisconnect {
+				return
+			}
 		default:
 			s.log.prod.Error("Unsupported incoming message type", zap.String("ClientID", s.config.id), zap.String("type", msg.Type().Name()))
 			return
@@ -281,21 +359,24 @@ func (s *connection) receiver() {
 
 	s.wg.routines.started.Done()
 
-	switch conn := s.config.conn.(type) {
-	case net.Conn:
-		keepAlive := time.Second * time.Duration(s.config.keepAlive)
-		r := timeoutReader{
-			d:    keepAlive + (keepAlive / 2),
-			conn: conn,
-		}
+	keepAlive := time.Second * time.Duration(s.config.keepAlive)
+	r := timeoutReader{
+		d:    keepAlive + (keepAlive / 2),
+		last: &s.lastPacket,
+		conn: s.config.conn,
+	}
 
-		for {
-			if _, err := s.in.ReadFrom(r); err != nil {
-				return
+	for {
+		if _, err := s.in.ReadFrom(r); err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				s.log.prod.Info("Keep-alive expired", zap.String("ClientID", s.config.id))
+
+				if s.config.connStat != nil {
+					s.config.connStat.KeepAliveExpired()
+				}
 			}
+			return
 		}
-	default:
-		s.log.prod.Error("Invalid connection type", zap.String("ClientID", s.config.id))
 	}
 }
 
@@ -305,15 +386,10 @@ func (s *connection) sender() {
 
 	s.wg.routines.started.Done()
 
-	switch conn := s.config.conn.(type) {
-	case net.Conn:
-		for {
-			if _, err := s.out.WriteTo(conn); err != nil {
-				return
-			}
+	for {
+		if _, err := s.out.WriteTo(s.config.conn); err != nil {
+			return
 		}
-	default:
-		s.log.prod.Error("Invalid connection type", zap.String("ClientID", s.config.id))
 	}
 }
 
@@ -448,8 +524,27 @@ func (s *connection) readMessage(total int) (message.Provider, int, error) {
 		}
 	}
 
+	buf := s.in.ExternalBuf[:total]
+
+	if reservedFlags(buf[0]) {
+		switch s.onViolation(types.ViolationReservedBits, zap.Uint8("header", buf[0])) {
+		case types.ViolationDisconnect:
+			return nil, 0, message.ErrInvalidMessageTypeFlags
+		case types.ViolationCount:
+			// flags of all but PUBLISH are fixed thus packet is processed as if they are not set
+			// PUBLISH with QoS 3 has no meaning
+			if t := message.Type(buf[0] >> 4); t != message.PUBLISH {
+				buf[0] = byte(t)<<4 | t.DefaultFlags()
+				break
+			}
+			fallthrough
+		default:
+			return nil, 0, errPacketDropped
+		}
+	}
+
 	var dTotal int
-	if msg, dTotal, err = message.Decode(s.in.ExternalBuf[:total]); err == nil && total != dTotal {
+	if msg, dTotal, err = message.Decode(buf); err == nil && total != dTotal {
 		s.log.prod.Error("Incoming and outgoing length does not match",
 			zap.Int("in", total),
 			zap.Int("out", dTotal))
@@ -475,10 +570,39 @@ func (s *connection) writeMessage(msg message.Provider) (int, error) {
 	s.wmu.Lock()
 	defer s.wmu.Unlock()
 
+	return s.write(msg)
+}
+
+// write message to outgoing buffer, caller holds wmu
+func (s *connection) write(msg message.Provider) (int, error) {
 	if s.out == nil {
 		return 0, types.ErrBufferNotReady
 	}
 
+	if s.config.slowClient.Timeout > 0 {
+		if size, err := msg.Size(); err == nil && s.out.Len()+size > int(s.out.Size()) {
+			// write buffer is full thus client does not keep up with messages
+			if m, ok := msg.(*message.PublishMessage); ok && m.QoS() == message.QoS0 &&
+				s.config.slowClient.Policy == types.SlowClientDropQoS0 {
+				if s.config.connStat != nil {
+					s.config.connStat.SlowDropped()
+				}
+				if s.config.dropStat != nil {
+					s.config.dropStat.Dropped(systree.DropSlowConsumer)
+				}
+				return 0, nil
+			}
+
+			timer := time.AfterFunc(s.config.slowClient.Timeout, s.onSlowClient)
+			defer timer.Stop()
+		}
+	}
+
+	// client must not see namespace topics are mapped into
+	if m, ok := msg.(*message.PublishMessage); ok && s.config.namespace != "" {
+		msg = stripNamespace(m, s.config.namespace)
+	}
+
 	var total int
 	var err error
 
@@ -486,7 +610,139 @@ func (s *connection) writeMessage(msg message.Provider) (int, error) {
 
 	if err == nil {
 		s.config.packetsMetric.Sent(msg.Type())
+		if s.config.bytesMetric != nil {
+			s.config.bytesMetric.Sent(uint64(total))
+		}
+		if m, ok := msg.(*message.PublishMessage); ok {
+			if s.config.publishMetric != nil {
+				s.config.publishMetric.Sent(m.QoS())
+			}
+			if s.config.published != nil {
+				atomic.AddUint64(&s.config.published.sent, 1)
+			}
+		}
+
+		s.tracePacket(false, msg)
 	}
 
 	return total, err
 }
+
+// tracePacket report packet if tracing of client is enabled
+func (s *connection) tracePacket(incoming bool, msg message.Provider) {
+	if s.config.onPacket != nil && atomic.LoadInt32(s.config.traced) == 1 {
+		s.config.onPacket(incoming, msg)
+	}
+}
+
+// onViolation account protocol violation of client. Returns policy to apply
+func (s *connection) onViolation(v types.Violation, fields ...zap.Field) types.ViolationPolicy {
+	policy := s.config.violations[v]
+
+	if s.config.violationStat != nil {
+		s.config.violationStat.Violation(v.String())
+	}
+
+	fields = append([]zap.Field{zap.String("ClientID", s.config.id), zap.Stringer("violation", v)}, fields...)
+
+	switch policy {
+	case types.ViolationDisconnect:
+		s.log.prod.Warn("Protocol violation. Disconnecting", fields...)
+	case types.ViolationDrop:
+		s.log.prod.Warn("Protocol violation. Dropping packet", fields...)
+	}
+
+	return policy
+}
+
+// reservedFlags check if reserved flags of fixed header are set [MQTT-2.2.2-2]
+func reservedFlags(b byte) bool {
+	t := message.Type(b >> 4)
+	if t == message.PUBLISH {
+		return (b>>1)&0x03 == 0x03
+	}
+
+	return b&0x0F != t.DefaultFlags()
+}
+
+// invalidTopic find topic of PUBLISH, SUBSCRIBE or UNSUBSCRIBE which is not well-formed UTF-8
+// or contains U+0000 [MQTT-1.5.3-1, MQTT-1.5.3-2]
+func invalidTopic(msg message.Provider) (string, bool) {
+	var topics []string
+
+	switch m := msg.(type) {
+	case *message.PublishMessage:
+		topics = []string{m.Topic()}
+	case *message.SubscribeMessage:
+		topics = m.Topics()
+	case *message.UnSubscribeMessage:
+		topics = m.Topics()
+	}
+
+	for _, t := range topics {
+		if !utf8.ValidString(t) || strings.IndexByte(t, 0) >= 0 {
+			return t, true
+		}
+	}
+
+	return "", false
+}
+
+// notify queue notice of disconnect reason, see DisconnectTopic. Notice is not queued
+// if outgoing buffer has no room for it thus client which does not read cannot block caller
+func (s *connection) notify(reason DisconnectReason) bool {
+	m := message.NewPublishMessage()
+	m.SetTopic(DisconnectTopic) // nolint: errcheck
+	m.SetPayload([]byte(reason.String()))
+
+	size, err := m.Size()
+	if err != nil {
+		return false
+	}
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if s.isDone() || s.out == nil || s.out.Len()+size > int(s.out.Size()) {
+		return false
+	}
+
+	_, err = s.write(m)
+
+	return err == nil
+}
+
+// flush wait until outgoing buffer out is sent, connection stops or timeout elapses
+func (s *connection) flush(out *buffer.Type, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	for !s.isDone() && out.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(flushPollInterval)
+	}
+}
+
+// onSlowClient close connection which write buffer stayed full for timeout
+// Closing buffers releases writer waiting for space
+func (s *connection) onSlowClient() {
+	s.log.prod.Warn("Slow client. Disconnecting", zap.String("ClientID", s.config.id))
+
+	if s.config.connStat != nil {
+		s.config.connStat.SlowClient()
+	}
+
+	s.stop()
+}
+
+// stripNamespace copy PUBLISH message with namespace removed from topic
+func stripNamespace(msg *message.PublishMessage, namespace string) *message.PublishMessage {
+	m := message.NewPublishMessage()
+	m.SetQoS(msg.QoS())                                    // nolint: errcheck
+	m.SetTopic(strings.TrimPrefix(msg.Topic(), namespace)) // nolint: errcheck
+	m.SetPayload(msg.Payload())
+	m.SetRetain(msg.Retain())
+	m.SetDup(msg.Dup())
+	m.SetPacketID(msg.PacketID())
+	m.SetContext(msg.Context())
+
+	return m
+}
@@ -0,0 +1,37 @@
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+)
+
+type ctxKey struct{}
+
+func TestStripNamespace(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ctxKey{}, "trace")
+
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic("tenant/a/b"))
+	require.NoError(t, msg.SetQoS(message.QoS2))
+	msg.SetPayload([]byte("payload"))
+	msg.SetRetain(true)
+	msg.SetDup(true)
+	msg.SetPacketID(7)
+	msg.SetContext(ctx)
+
+	m := stripNamespace(msg, "tenant/")
+
+	require.Equal(t, "a/b", m.Topic())
+	require.Equal(t, message.QoS2, m.QoS())
+	require.Equal(t, []byte("payload"), m.Payload())
+	require.True(t, m.Retain())
+	require.True(t, m.Dup())
+	require.Equal(t, uint16(7), m.PacketID())
+	require.Equal(t, ctx, m.Context())
+
+	// original is left as is
+	require.Equal(t, "tenant/a/b", msg.Topic())
+}
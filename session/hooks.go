@@ -0,0 +1,189 @@
+package session
+
+import (
+	"github.com/troian/surgemq/message"
+)
+
+// DisconnectReason why connection of session has been closed
+type DisconnectReason int32
+
+const (
+	// DisconnectConnectionLost network connection dropped, keep-alive expired or client was too slow
+	DisconnectConnectionLost DisconnectReason = iota
+	// DisconnectClient client sent DISCONNECT
+	DisconnectClient
+	// DisconnectTakeover client with the same id connected
+	DisconnectTakeover
+	// DisconnectKick client kicked by administrator
+	DisconnectKick
+	// DisconnectShutdown broker is shutting down
+	DisconnectShutdown
+	// DisconnectQueueFull offline queue overflowed with disconnect policy
+	DisconnectQueueFull
+)
+
+var disconnectReasons = map[DisconnectReason]string{
+	DisconnectConnectionLost: "connection lost",
+	DisconnectClient:         "client disconnect",
+	DisconnectTakeover:       "takeover",
+	DisconnectKick:           "kick",
+	DisconnectShutdown:       "shutdown",
+	DisconnectQueueFull:      "queue full",
+}
+
+// DisconnectTopic topic of notice sent to client before broker closes its connection by
+// takeover, kick, shutdown or queue overflow. Payload is reason, e.g. "kick". MQTT 3.1.1 has no
+// server side DISCONNECT thus notice is QoS 0 PUBLISH client receives without subscribing,
+// e.g. by default message handler. Notice is not standard and clients not expecting it might
+// treat it as protocol violation, thus it is sent only if Config.DisconnectNotice is set
+const DisconnectTopic = "$disconnect"
+
+// notified reason is told to client before connection is closed
+func (r DisconnectReason) notified() bool {
+	switch r {
+	case DisconnectTakeover, DisconnectKick, DisconnectShutdown, DisconnectQueueFull:
+		return true
+	}
+
+	return false
+}
+
+func (r DisconnectReason) String() string {
+	if s, ok := disconnectReasons[r]; ok {
+		return s
+	}
+
+	return "unknown"
+}
+
+// Hooks intercept traffic of sessions. Methods are invoked synchronously from connection
+// routines thus must not block. id is client id and topics include namespace of virtual host
+type Hooks interface {
+	// OnConnect invoked once client passed authentication. Error refuses connection
+	// with not authorized return code
+	OnConnect(id string, msg *message.ConnectMessage) error
+
+	// OnDisconnect invoked once connection of session closed
+	OnDisconnect(id string, reason DisconnectReason)
+
+	// OnWill invoked before will message is published, i.e. connection closed by any
+	// reason but DISCONNECT of client. Returning false suppresses will
+	OnWill(id string, reason DisconnectReason, msg *message.PublishMessage) bool
+
+	// OnSubscribe invoked with every allowed topic filter of SUBSCRIBE. Returned QoS is
+	// granted, error fails subscription of filter
+	OnSubscribe(id string, topic string, qos message.QosType) (message.QosType, error)
+
+	// OnUnsubscribe invoked with every topic filter of UNSUBSCRIBE
+	OnUnsubscribe(id string, topic string)
+
+	// OnPublishIn invoked with message received from client before it is routed. Message
+	// might be modified. Error drops message, it is still acknowledged to client
+	OnPublishIn(id string, msg *message.PublishMessage) error
+
+	// OnPublishOut invoked with copy of message before it is queued to client. Message
+	// might be modified. Error drops message for this client only
+	OnPublishOut(id string, msg *message.PublishMessage) error
+}
+
+// HooksBase does nothing. Embed it to implement only methods of Hooks needed
+type HooksBase struct{}
+
+// OnConnect accept client
+func (HooksBase) OnConnect(string, *message.ConnectMessage) error { return nil }
+
+// OnDisconnect do nothing
+func (HooksBase) OnDisconnect(string, DisconnectReason) {}
+
+// OnWill publish will
+func (HooksBase) OnWill(string, DisconnectReason, *message.PublishMessage) bool { return true }
+
+// OnSubscribe grant requested QoS
+func (HooksBase) OnSubscribe(_ string, _ string, qos message.QosType) (message.QosType, error) {
+	return qos, nil
+}
+
+// OnUnsubscribe do nothing
+func (HooksBase) OnUnsubscribe(string, string) {}
+
+// OnPublishIn pass message
+func (HooksBase) OnPublishIn(string, *message.PublishMessage) error { return nil }
+
+// OnPublishOut pass message
+func (HooksBase) OnPublishOut(string, *message.PublishMessage) error { return nil }
+
+// Pipeline of hooks invoked in order. First error stops pipeline
+type Pipeline []Hooks
+
+var _ Hooks = Pipeline(nil)
+
+// OnConnect ask every hook to accept client
+func (p Pipeline) OnConnect(id string, msg *message.ConnectMessage) error {
+	for _, h := range p {
+		if err := h.OnConnect(id, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OnDisconnect notify every hook
+func (p Pipeline) OnDisconnect(id string, reason DisconnectReason) {
+	for _, h := range p {
+		h.OnDisconnect(id, reason)
+	}
+}
+
+// OnWill publish will unless any hook suppresses it
+func (p Pipeline) OnWill(id string, reason DisconnectReason, msg *message.PublishMessage) bool {
+	for _, h := range p {
+		if !h.OnWill(id, reason, msg) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// OnSubscribe pass QoS granted by hook to next one
+func (p Pipeline) OnSubscribe(id string, topic string, qos message.QosType) (message.QosType, error) {
+	var err error
+
+	for _, h := range p {
+		if qos, err = h.OnSubscribe(id, topic, qos); err != nil {
+			return message.QosFailure, err
+		}
+	}
+
+	return qos, nil
+}
+
+// OnUnsubscribe notify every hook
+func (p Pipeline) OnUnsubscribe(id string, topic string) {
+	for _, h := range p {
+		h.OnUnsubscribe(id, topic)
+	}
+}
+
+// OnPublishIn pass message through every hook
+func (p Pipeline) OnPublishIn(id string, msg *message.PublishMessage) error {
+	for _, h := range p {
+		if err := h.OnPublishIn(id, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OnPublishOut pass message through every hook
+func (p Pipeline) OnPublishOut(id string, msg *message.PublishMessage) error {
+	for _, h := range p {
+		if err := h.OnPublishOut(id, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package session
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/troian/surgemq/message"
+	persistenceTypes "github.com/troian/surgemq/persistence/types"
+)
+
+// State of session as seen by manager
+type State int
+
+const (
+	// StateConnected client is connected
+	StateConnected State = iota
+
+	// StateSuspended client is offline, session is kept in memory along with its subscriptions
+	StateSuspended
+
+	// StatePersisted session exists in persistence only
+	StatePersisted
+)
+
+// String name of state
+func (s State) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateSuspended:
+		return "suspended"
+	case StatePersisted:
+		return "persisted"
+	default:
+		return "unknown"
+	}
+}
+
+// Info snapshot of session for inspection. Topics include namespace of virtual host if any
+type Info struct {
+	ID    string
+	State State
+
+	// Username of the last connection, empty for anonymous client
+	Username string
+
+	// RemoteAddr and ConnectedAt of the last connection. Empty for persisted sessions
+	RemoteAddr  string
+	ConnectedAt time.Time
+
+	Subscriptions message.Subscriptions
+
+	// Queued messages waiting to be sent, including ones stored while client is offline
+	Queued int
+
+	// Offline messages of Queued stored while client is offline
+	Offline int
+
+	// InFlightIn QoS 2 messages received from client and not yet released
+	InFlightIn int
+
+	// InFlightOut QoS 1/2 messages sent to client and not yet acknowledged
+	InFlightOut int
+
+	// Received and Sent PUBLISH packets of client since session is in memory
+	Received uint64
+	Sent     uint64
+}
+
+// info snapshot of session state
+func (s *Type) info(state State) Info {
+	s.mu.Lock()
+	i := Info{
+		ID:            s.config.id,
+		State:         state,
+		Username:      s.username,
+		RemoteAddr:    s.remoteAddr,
+		ConnectedAt:   s.connectedAt,
+		Subscriptions: make(message.Subscriptions, len(s.config.subscriptions)),
+	}
+
+	for t, o := range s.config.subscriptions {
+		i.Subscriptions[t] = o
+	}
+	s.mu.Unlock()
+
+	s.publisher.lock.Lock()
+	i.Queued = s.publisher.messages.Len() + s.publisher.offline.count
+	i.Offline = s.publisher.offline.count
+	s.publisher.lock.Unlock()
+
+	i.InFlightIn = s.ack.pubIn.size()
+	i.InFlightOut = s.ack.pubOut.size()
+
+	i.Received = atomic.LoadUint64(&s.published.received)
+	i.Sent = atomic.LoadUint64(&s.published.sent)
+
+	return i
+}
+
+// Sessions snapshot of active, suspended and persisted sessions ordered by id
+func (m *Manager) Sessions() []Info {
+	res := m.memorySessions()
+
+	known := make(map[string]bool, len(res))
+	for _, i := range res {
+		known[i.ID] = true
+	}
+
+	if persisted, err := m.config.Persist.GetAll(); err == nil {
+		for _, p := range persisted {
+			if id, err := p.ID(); err == nil && !known[id] {
+				res = append(res, persistedInfo(id, p))
+			}
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+
+	return res
+}
+
+// Session snapshot of single session. Returns false if session does not exist
+func (m *Manager) Session(id string) (Info, bool) {
+	for _, l := range m.stateLists() {
+		l.list.lock.RLock()
+		s, ok := l.list.list[id]
+		l.list.lock.RUnlock()
+
+		if ok && s != nil {
+			return s.info(l.state), true
+		}
+	}
+
+	p, err := m.config.Persist.Get(id)
+	if err != nil {
+		return Info{}, false
+	}
+
+	return persistedInfo(id, p), true
+}
+
+type stateList struct {
+	list  *sessionsList
+	state State
+}
+
+// stateLists in-memory sessions lists along with state of their sessions
+func (m *Manager) stateLists() []stateList {
+	return []stateList{
+		{&m.sessions.active, StateConnected},
+		{&m.sessions.suspended, StateSuspended},
+	}
+}
+
+// MemorySessions snapshot of connected and suspended sessions. Unlike Sessions persistence
+// is not read thus it is cheap enough for diagnostics
+func (m *Manager) MemorySessions() []Info {
+	return m.memorySessions()
+}
+
+// memorySessions snapshot of active and suspended sessions
+func (m *Manager) memorySessions() []Info {
+	var res []Info
+
+	for _, l := range m.stateLists() {
+		l.list.lock.RLock()
+		sessions := make([]*Type, 0, len(l.list.list))
+		for _, s := range l.list.list {
+			if s != nil {
+				sessions = append(sessions, s)
+			}
+		}
+		l.list.lock.RUnlock()
+
+		for _, s := range sessions {
+			res = append(res, s.info(l.state))
+		}
+	}
+
+	return res
+}
+
+// persistedInfo snapshot of session stored in persistence only
+func persistedInfo(id string, p persistenceTypes.Session) Info {
+	i := Info{
+		ID:            id,
+		State:         StatePersisted,
+		Subscriptions: message.Subscriptions{},
+	}
+
+	if subs, err := p.Subscriptions(); err == nil {
+		if topics, err := subs.Get(); err == nil && topics != nil {
+			i.Subscriptions = topics
+		}
+	}
+
+	if msgs, err := p.Messages(); err == nil {
+		if stored, err := msgs.Load(); err == nil && stored != nil {
+			i.Queued = len(stored.Out.Messages)
+			i.InFlightIn = len(stored.In.Messages)
+		}
+	}
+
+	return i
+}
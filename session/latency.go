@@ -0,0 +1,42 @@
+package session
+
+import (
+	"context"
+	"time"
+
+	"github.com/troian/surgemq/message"
+	persistenceTypes "github.com/troian/surgemq/persistence/types"
+)
+
+// receivedKey context key of time PUBLISH has been received from client
+type receivedKey struct{}
+
+// markReceived remember time message received thus delivery latency of its copies is measured
+func (s *Type) markReceived(msg *message.PublishMessage) {
+	if s.config.metric.latency != nil {
+		msg.SetContext(context.WithValue(msg.Context(), receivedKey{}, time.Now()))
+	}
+}
+
+// observeDelivery account latency of message written to client. Messages not received
+// from clients, e.g. restored from persistence or published by broker, are skipped
+func (s *Type) observeDelivery(msg *message.PublishMessage) {
+	if s.config.metric.latency == nil {
+		return
+	}
+
+	if t, ok := msg.Context().Value(receivedKey{}).(time.Time); ok {
+		s.config.metric.latency.Delivery(time.Since(t))
+	}
+}
+
+// store messages into persistence accounting write latency
+func (m *Manager) store(msgs persistenceTypes.Messages, dir string, list []message.Provider) error {
+	if m.config.Metric.Latency != nil {
+		defer func(start time.Time) {
+			m.config.Metric.Latency.PersistenceWrite(time.Since(start))
+		}(time.Now())
+	}
+
+	return msgs.Store(dir, list)
+}
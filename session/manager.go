@@ -19,15 +19,23 @@ import (
 	"encoding/base64"
 	"errors"
 	"io"
-	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/audit"
+	"github.com/troian/surgemq/auth"
 	"github.com/troian/surgemq/message"
 	persistenceTypes "github.com/troian/surgemq/persistence/types"
+	"github.com/troian/surgemq/persistence/wal"
+	"github.com/troian/surgemq/ratelimit"
 	"github.com/troian/surgemq/systree"
+	"github.com/troian/surgemq/topics/rewrite"
 	topicsTypes "github.com/troian/surgemq/topics/types"
 	"github.com/troian/surgemq/types"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"go.uber.org/zap"
 )
 
@@ -35,8 +43,14 @@ var (
 	// ErrNotAccepted new connection does not meet requirements
 	ErrNotAccepted = errors.New("Connection not accepted")
 
+	// ErrQuotaExceeded client exceeded its quota and is disconnected
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
 	// ErrDupNotAllowed case when new client with existing ID connected
 	ErrDupNotAllowed = errors.New("duplicate not allowed")
+
+	// ErrQoSNotSupported client published with QoS above maximum supported by broker
+	ErrQoSNotSupported = errors.New("QoS not supported")
 )
 
 // Config manager configuration
@@ -48,23 +62,138 @@ type Config struct {
 	// If not set then default to 2 seconds.
 	ConnectTimeout int
 
-	// The number of seconds to wait for any ACK messages before failing.
-	// If not set then default to 20 seconds.
+	// The number of seconds to wait for any ACK messages before sending again.
+	// Timeout doubles on every retry. 0 or negative disables retransmission
 	AckTimeout int
 
 	// The number of times to retry sending a packet if ACK is not received.
-	// If no set then default to 3 retries.
+	// Message is dropped once retries exhausted
 	TimeoutRetries int
 
 	Metric struct {
-		Packets  systree.PacketsMetric
-		Sessions systree.SessionsStat
-		Session  systree.SessionStat
+		Packets     systree.PacketsMetric
+		Bytes       systree.BytesMetric
+		Sessions    systree.SessionsStat
+		Session     systree.SessionStat
+		Connections systree.ConnectionsStat
+		Violations  systree.ViolationsStat
+		Latency     systree.LatencyStat
+		Drops       systree.DropsStat
 	}
 
+	// SlowClient detection of clients which write buffer stays full
+	SlowClient types.SlowClientConfig
+
+	// Violations policies of protocol violations by clients. Nil closes connection on any
+	Violations types.ViolationConfig
+
 	OnDup types.DuplicateConfig
 
 	Persist persistenceTypes.Sessions
+
+	// SharedPersistence persistence is shared with other brokers, e.g. replicated by Raft
+	// Subscriptions of sessions are persisted on every change and messages of any QoS are
+	// persisted while client is offline, thus client reconnecting to another broker finds
+	// them there. Persisted sessions are not restored on start but once client connects
+	SharedPersistence bool
+
+	// OfflineQueue limits of messages queued for every session
+	OfflineQueue types.OfflineQueueConfig
+
+	// OnSysPublish invoked when client publishes to system ($) topic. Such messages
+	// are not routed to subscribers. Optional
+	OnSysPublish func(id string, msg *message.PublishMessage)
+
+	// Rewrite rules applied to topics of inbound messages and subscription filters
+	// before namespace prefix. Optional
+	Rewrite *rewrite.Rules
+
+	// TopicLimits rate limits of publishes by topic prefix. Optional
+	TopicLimits *ratelimit.Topics
+
+	// WAL write-ahead log of in-flight QoS 1/2 messages. Optional
+	// Messages left in log by crash are moved into persisted sessions on start
+	WAL *wal.Log
+
+	// MaxQoS highest QoS supported by broker. Subscriptions are granted at most MaxQoS
+	// and clients publishing above it are disconnected. nil means QoS 2
+	MaxQoS *message.QosType
+
+	// StrictOrdering deliver QoS 1/2 messages of topic one by one, next message is not sent
+	// until previous one is acknowledged. Messages of other topics are not held
+	StrictOrdering bool
+
+	// DisconnectNotice send notice on DisconnectTopic to client before broker closes its
+	// connection. Notice is not part of MQTT thus off by default
+	DisconnectNotice bool
+
+	// OnUndelivered invoked with message session gave up delivering to client, i.e. once
+	// retransmissions are exhausted or queue limits dropped it. id is session id including
+	// namespace. Might be called with session locks held thus must not block nor publish. Optional
+	OnUndelivered func(id string, msg *message.PublishMessage, reason error)
+
+	// Hooks invoked in order on connect, disconnect, subscribe and publishes of sessions
+	// Optional
+	Hooks []Hooks
+
+	// Tracer spans of received messages, their route and deliveries to subscribers are
+	// started with. Optional
+	Tracer trace.Tracer
+
+	// Audit log of publishes, subscriptions and wills denied by auth providers. Optional
+	Audit audit.Logger
+
+	// OnPacket invoked with control packets sent to and received from clients packet
+	// tracing is enabled for, see TracePackets. Outgoing packets are reported with write
+	// lock of connection held thus it must not block nor publish. Optional
+	OnPacket func(id string, incoming bool, msg message.Provider)
+}
+
+// drainPollInterval how often in-flight messages are checked during drain
+const drainPollInterval = 100 * time.Millisecond
+
+// disconnectFlushTimeout how long notice of disconnect reason is given to be sent
+const disconnectFlushTimeout = time.Second
+
+// flushPollInterval how often outgoing buffer is checked while notice is sent
+const flushPollInterval = 10 * time.Millisecond
+
+// retryPollInterval how often ack timeouts of in-flight messages are checked
+const retryPollInterval = 250 * time.Millisecond
+
+// StartParams connection specific parameters provided by listener
+type StartParams struct {
+	// Namespace prefix every topic of the session is mapped into.
+	// Client ID is unique within namespace only
+	Namespace string
+
+	// Subscriptions wildcard restrictions of the client. nil means unrestricted
+	Subscriptions *topicsTypes.SubscriptionPolicy
+
+	// Auth chain publishes and subscriptions of the client are checked against
+	// Topics are checked as seen by client, i.e. without namespace. nil allows all
+	Auth *auth.Manager
+
+	// Username of authenticated client, empty for anonymous one
+	Username string
+
+	// ID of session as given by SessionID. Empty derives it from client id of CONNECT
+	ID string
+
+	// Quota of client publishes. nil means unlimited
+	Quota *ratelimit.Quota
+
+	// Ack retransmission policy of client. nil means AckTimeout and TimeoutRetries
+	Ack *types.AckPolicy
+
+	// Listener stat of listener client connected through. nil skips per listener accounting
+	Listener systree.ListenerStat
+}
+
+// idLock serializes starts of single client id
+type idLock struct {
+	sync.Mutex
+	refs int
 }
 
 type sessionsList struct {
@@ -83,6 +212,21 @@ type Manager struct {
 	lock sync.Mutex
 	quit chan struct{}
 
+	// starts in progress by client id
+	starts struct {
+		lock sync.Mutex
+		list map[string]*idLock
+	}
+
+	// draining new sessions are not accepted
+	draining int32
+
+	// traced client ids packets of are reported
+	traced struct {
+		lock sync.Mutex
+		ids  map[string]bool
+	}
+
 	log struct {
 		prod *zap.Logger
 		dev  *zap.Logger
@@ -99,6 +243,14 @@ func NewManager(cfg Config) (*Manager, error) {
 		return nil, errors.New("No persist provider")
 	}
 
+	if cfg.MaxQoS != nil && !cfg.MaxQoS.IsValid() {
+		return nil, message.ErrInvalidQoS
+	}
+
+	if cfg.Tracer == nil {
+		cfg.Tracer = noop.NewTracerProvider().Tracer("")
+	}
+
 	m := &Manager{
 		config: cfg,
 		quit:   make(chan struct{}),
@@ -110,34 +262,23 @@ func NewManager(cfg Config) (*Manager, error) {
 	m.sessions.active.list = make(map[string]*Type)
 	m.sessions.suspended.list = make(map[string]*Type)
 
-	// 1. load persisted sessions
+	if m.config.WAL != nil {
+		m.replayWAL()
+	}
+
+	// 1. load persisted sessions. Shared ones are restored by broker client connects to
 	persistedSessions, err := m.config.Persist.GetAll()
-	if err == nil {
+	if err == nil && !m.config.SharedPersistence {
 		for _, s := range persistedSessions {
 			// 2. restore only those having persisted subscriptions
 			if persistedSubs, err := s.Subscriptions(); err == nil {
-				var subscriptions message.TopicsQoS
+				var subscriptions message.Subscriptions
 				if subscriptions, err = persistedSubs.Get(); err == nil && len(subscriptions) > 0 {
 					var sID string
 					if sID, err = s.ID(); err != nil {
 						m.log.prod.Error("Couldn't get persisted session ID", zap.Error(err))
 					} else {
-						sCfg := config{
-							topicsMgr:      m.config.TopicsMgr,
-							connectTimeout: m.config.ConnectTimeout,
-							ackTimeout:     m.config.AckTimeout,
-							timeoutRetries: m.config.TimeoutRetries,
-							subscriptions:  subscriptions,
-							id:             sID,
-							callbacks: managerCallbacks{
-								onDisconnect: m.onDisconnect,
-								onStop:       m.onStop,
-								onPublish:    m.onPublish,
-							},
-						}
-
-						sCfg.metric.session = m.config.Metric.Session
-						sCfg.metric.packets = m.config.Metric.Packets
+						sCfg := m.sessionConfig(sID, subscriptions)
 
 						var ses *Type
 						if ses, err = newSession(sCfg); err != nil {
@@ -159,11 +300,20 @@ func NewManager(cfg Config) (*Manager, error) {
 }
 
 // Start try start new session
-func (m *Manager) Start(msg *message.ConnectMessage, resp *message.ConnAckMessage, conn io.Closer) error {
+func (m *Manager) Start(msg *message.ConnectMessage, resp *message.ConnAckMessage, conn types.Conn, params StartParams) error {
 	var err error
 	var ses *Type
 	present := false
 
+	id := params.ID
+	if id == "" {
+		id = m.SessionID(string(msg.ClientID()), params.Namespace)
+	}
+
+	// connects of the same client are serialized until session is started thus
+	// takeover never sees session half way started
+	defer m.lockID(id)()
+
 	defer func() {
 		resp.SetSessionPresent(present)
 
@@ -172,16 +322,23 @@ func (m *Manager) Start(msg *message.ConnectMessage, resp *message.ConnAckMessag
 			zap.String("ClientID", string(msg.ClientID())),
 			zap.Bool("Clean session", msg.CleanSession()),
 			zap.Bool("Session present", present),
-			zap.String("RemoteAddr", conn.(net.Conn).RemoteAddr().String()),
+			zap.String("RemoteAddr", conn.RemoteAddr().String()),
 		)
 
+		traced := m.isTraced(id)
+
 		if err = m.writeMessage(conn, resp); err != nil {
 			m.log.prod.Error("Couldn't write CONNACK", zap.Error(err))
 		}
+		if traced && m.config.OnPacket != nil {
+			m.config.OnPacket(id, true, msg)
+			m.config.OnPacket(id, false, resp)
+		}
 		if err == nil {
 			if ses != nil {
+				ses.setTraced(traced)
 				// try start session
-				ses.start(msg, conn)
+				ses.start(msg, conn, params)
 			}
 		}
 	}()
@@ -193,19 +350,25 @@ func (m *Manager) Start(msg *message.ConnectMessage, resp *message.ConnAckMessag
 	default:
 	}
 
+	if atomic.LoadInt32(&m.draining) == 1 {
+		resp.SetReturnCode(message.ErrServerUnavailable) // nolint: errcheck
+		return errors.New("Draining")
+	}
+
 	if resp.ReturnCode() != message.ConnectionAccepted {
 		return ErrNotAccepted
 	}
 
+	if err = Pipeline(m.config.Hooks).OnConnect(id, msg); err != nil {
+		m.log.prod.Info("Connection refused by hook", zap.String("ClientID", id), zap.Error(err))
+		resp.SetReturnCode(message.ErrNotAuthorized) // nolint: errcheck
+		return ErrNotAccepted
+	}
+
 	// serialize access to multiple starts
 	defer m.lock.Unlock()
 	m.lock.Lock()
 
-	id := string(msg.ClientID())
-	if len(id) == 0 {
-		id = m.genSessionID()
-	}
-
 	m.sessions.active.lock.RLock()
 
 	alloc := true
@@ -225,9 +388,13 @@ func (m *Manager) Start(msg *message.ConnectMessage, resp *message.ConnAckMessag
 			err = ErrDupNotAllowed
 			replaced = false
 			alloc = false
+			ses = nil
 		} else {
-			// duplicate allowed stop current session
-			ses.stop(true)
+			// duplicate allowed. Close connection of current session and wait until its
+			// state is either suspended or persisted, new connection picks it up below
+			// Client is told reason by notice on DisconnectTopic if Config.DisconnectNotice is set
+			m.log.prod.Info("Session taken over", zap.String("ClientID", id))
+			ses.takeover(DisconnectTakeover)
 		}
 
 		// notify subscriber about dup attempt
@@ -240,9 +407,70 @@ func (m *Manager) Start(msg *message.ConnectMessage, resp *message.ConnAckMessag
 		ses, present, err = m.allocSession(id, msg, resp)
 	}
 
+	// connection of refused client is closed by caller
+	if ses == nil {
+		return err
+	}
+
 	return nil
 }
 
+// lockID serialize starts of client id. Returns unlock function
+func (m *Manager) lockID(id string) func() {
+	m.starts.lock.Lock()
+	if m.starts.list == nil {
+		m.starts.list = make(map[string]*idLock)
+	}
+
+	l, ok := m.starts.list[id]
+	if !ok {
+		l = &idLock{}
+		m.starts.list[id] = l
+	}
+	l.refs++
+	m.starts.lock.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		m.starts.lock.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(m.starts.list, id)
+		}
+		m.starts.lock.Unlock()
+	}
+}
+
+// Drain stop accepting new sessions and wait until active sessions finish
+// in-flight exchanges or grace period elapses. Sessions are not closed
+func (m *Manager) Drain(grace time.Duration) {
+	atomic.StoreInt32(&m.draining, 1)
+
+	deadline := time.Now().Add(grace)
+
+	for time.Now().Before(deadline) {
+		pending := 0
+
+		m.sessions.active.lock.RLock()
+		for _, s := range m.sessions.active.list {
+			pending += s.inFlight()
+		}
+		m.sessions.active.lock.RUnlock()
+
+		if pending == 0 {
+			return
+		}
+
+		m.log.dev.Debug("Waiting in-flight messages", zap.Int("count", pending))
+
+		time.Sleep(drainPollInterval)
+	}
+
+	m.log.prod.Warn("Drain grace period elapsed with in-flight messages")
+}
+
 // Shutdown manager
 func (m *Manager) Shutdown() error {
 	defer m.lock.Unlock()
@@ -258,7 +486,7 @@ func (m *Manager) Shutdown() error {
 	// 1. Now signal all active sessions to finish
 	m.sessions.active.lock.Lock()
 	for _, s := range m.sessions.active.list {
-		s.disconnect()
+		s.disconnect(DisconnectShutdown)
 	}
 	m.sessions.active.lock.Unlock()
 
@@ -282,6 +510,174 @@ func (m *Manager) Shutdown() error {
 	return nil
 }
 
+// maxQoS highest QoS supported by sessions
+func (m *Manager) maxQoS() message.QosType {
+	if m.config.MaxQoS == nil {
+		return message.QoS2
+	}
+
+	return *m.config.MaxQoS
+}
+
+// Reauthorize check subscriptions of every session against current auth rules, e.g.
+// after ACL reload. Denied subscriptions are dropped silently as MQTT 3.1.1 has no
+// way to notify client. Returns amount of dropped subscriptions
+func (m *Manager) Reauthorize() int {
+	dropped := 0
+
+	for _, l := range []*sessionsList{&m.sessions.active, &m.sessions.suspended} {
+		l.lock.RLock()
+		for _, s := range l.list {
+			if s == nil {
+				continue
+			}
+
+			if n := s.reauthorize(); n > 0 {
+				s.persistSubscriptions()
+				dropped += n
+			}
+		}
+		l.lock.RUnlock()
+	}
+
+	return dropped
+}
+
+// Expire drop suspended session which persisted state is about to be removed
+// Returns false if client is connected thus session must be kept
+func (m *Manager) Expire(id string) bool {
+	// serialize with starts of the same client thus it cannot reconnect half way
+	defer m.lockID(id)()
+
+	m.sessions.active.lock.RLock()
+	_, active := m.sessions.active.list[id]
+	m.sessions.active.lock.RUnlock()
+
+	if active {
+		return false
+	}
+
+	m.sessions.suspended.lock.Lock()
+	s, ok := m.sessions.suspended.list[id]
+	if ok {
+		delete(m.sessions.suspended.list, id)
+	}
+	m.sessions.suspended.lock.Unlock()
+
+	if ok && s != nil {
+		// subscriptions are dropped first thus stop does not persist them again
+		s.unSubscribeAll()
+		s.stop(false)
+	}
+
+	return true
+}
+
+// Kick force disconnect client. Will message is published unless Hooks suppress it
+// If wipe is set suspended and persisted state of session is discarded too
+// Client is told reason by notice on DisconnectTopic if Config.DisconnectNotice is set
+// Returns false if session does not exist
+func (m *Manager) Kick(id string, wipe bool) bool {
+	select {
+	case <-m.quit:
+		return false
+	default:
+	}
+
+	// serialize with starts of the same client thus it cannot reconnect half way
+	defer m.lockID(id)()
+
+	m.sessions.active.lock.RLock()
+	ses, found := m.sessions.active.list[id]
+	m.sessions.active.lock.RUnlock()
+
+	if found {
+		m.log.prod.Info("Kick client", zap.String("ClientID", id), zap.Bool("wipe", wipe))
+		ses.takeover(DisconnectKick)
+	}
+
+	if !wipe {
+		return found
+	}
+
+	m.sessions.suspended.lock.Lock()
+	s, ok := m.sessions.suspended.list[id]
+	if ok {
+		delete(m.sessions.suspended.list, id)
+	}
+	m.sessions.suspended.lock.Unlock()
+
+	if ok && s != nil {
+		found = true
+		s.unSubscribeAll()
+		s.stop(false)
+	}
+
+	if _, err := m.config.Persist.Get(id); err == nil {
+		found = true
+		if err = m.config.Persist.Delete(id); err != nil {
+			m.log.prod.Error("Couldn't wipe session", zap.String("ClientID", id), zap.Error(err))
+		}
+	}
+
+	m.clearWAL(id)
+
+	if found {
+		m.log.prod.Info("Session wiped", zap.String("ClientID", id))
+	}
+
+	return found
+}
+
+// Release drop session of client connected to another broker sharing persistence
+// Connection is closed if client is still connected here. Persisted state is kept for
+// other broker. Returns false if session does not exist
+func (m *Manager) Release(id string) bool {
+	select {
+	case <-m.quit:
+		return false
+	default:
+	}
+
+	// serialize with starts of the same client thus it cannot reconnect half way
+	defer m.lockID(id)()
+
+	m.sessions.active.lock.RLock()
+	ses, found := m.sessions.active.list[id]
+	m.sessions.active.lock.RUnlock()
+
+	if found {
+		ses.takeover(DisconnectTakeover)
+	}
+
+	m.sessions.suspended.lock.Lock()
+	s, ok := m.sessions.suspended.list[id]
+	if ok {
+		delete(m.sessions.suspended.list, id)
+	}
+	m.sessions.suspended.lock.Unlock()
+
+	if ok && s != nil {
+		found = true
+		s.handOver()
+	}
+
+	if found {
+		m.log.prod.Info("Session released to another broker", zap.String("ClientID", id))
+	}
+
+	return found
+}
+
+// SessionID of client connecting to namespace. Client without id is given generated one
+func (m *Manager) SessionID(clientID, namespace string) string {
+	if clientID == "" {
+		clientID = m.genSessionID()
+	}
+
+	return namespace + clientID
+}
+
 func (m *Manager) genSessionID() string {
 	b := make([]byte, 15)
 	if _, err := io.ReadFull(rand.Reader, b); err != nil {
@@ -291,27 +687,50 @@ func (m *Manager) genSessionID() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
-func (m *Manager) allocSession(id string, msg *message.ConnectMessage, resp *message.ConnAckMessage) (*Type, bool, error) {
-	var ses *Type
-	present := false
-	var err error
-
-	sConfig := config{
+// sessionConfig of both new and restored sessions
+func (m *Manager) sessionConfig(id string, subscriptions message.Subscriptions) config {
+	c := config{
 		topicsMgr:      m.config.TopicsMgr,
 		connectTimeout: m.config.ConnectTimeout,
 		ackTimeout:     m.config.AckTimeout,
 		timeoutRetries: m.config.TimeoutRetries,
-		subscriptions:  make(message.TopicsQoS),
+		subscriptions:  subscriptions,
+		wal:            m.config.WAL,
+		queue:          m.config.OfflineQueue,
+		strictOrdering: m.config.StrictOrdering,
+		notice:         m.config.DisconnectNotice,
+		maxQoS:         m.maxQoS(),
+		shared:         m.config.SharedPersistence,
+		rewrite:        m.config.Rewrite,
+		limits:         m.config.TopicLimits,
+		tracer:         m.config.Tracer,
+		audit:          m.config.Audit,
+		manager:        m,
+		hooks:          m.config.Hooks,
+		onUndelivered:  m.config.OnUndelivered,
+		onPacket:       m.config.OnPacket,
+		slowClient:     m.config.SlowClient,
+		violations:     m.config.Violations,
 		id:             id,
-		callbacks: managerCallbacks{
-			onDisconnect: m.onDisconnect,
-			onStop:       m.onStop,
-			onPublish:    m.onPublish,
-		},
 	}
 
-	sConfig.metric.session = m.config.Metric.Session
-	sConfig.metric.packets = m.config.Metric.Packets
+	c.metric.session = m.config.Metric.Session
+	c.metric.packets = m.config.Metric.Packets
+	c.metric.bytes = m.config.Metric.Bytes
+	c.metric.conns = m.config.Metric.Connections
+	c.metric.violations = m.config.Metric.Violations
+	c.metric.latency = m.config.Metric.Latency
+	c.metric.drops = m.config.Metric.Drops
+
+	return c
+}
+
+func (m *Manager) allocSession(id string, msg *message.ConnectMessage, resp *message.ConnAckMessage) (*Type, bool, error) {
+	var ses *Type
+	present := false
+	var err error
+
+	sConfig := m.sessionConfig(id, make(message.Subscriptions))
 
 	var pSes persistenceTypes.Session
 
@@ -324,6 +743,7 @@ func (m *Manager) allocSession(id string, msg *message.ConnectMessage, resp *mes
 		if msg.CleanSession() {
 			// client may want clear previously persisted state. If client with same ID is clean
 			// delete all persisted data
+			s.unSubscribeAll()
 			s.stop(false)
 		} else {
 			if s != nil && s.isOpen() {
@@ -341,6 +761,11 @@ func (m *Manager) allocSession(id string, msg *message.ConnectMessage, resp *mes
 	if ses == nil {
 		m.log.dev.Debug("Allocate session", zap.String("ClientID", id))
 
+		// session might have been suspended by another broker sharing persistence
+		if m.config.SharedPersistence && !msg.CleanSession() {
+			sConfig.subscriptions = m.persistedSubscriptions(id)
+		}
+
 		if ses, err = newSession(sConfig); err != nil {
 			ses = nil
 			resp.SetReturnCode(message.ErrServerUnavailable) // nolint: errcheck
@@ -368,6 +793,13 @@ func (m *Manager) allocSession(id string, msg *message.ConnectMessage, resp *mes
 				m.log.dev.Debug("Create new persist entry", zap.String("ClientID", id))
 				if _, err = m.config.Persist.New(id); err != nil {
 					m.log.prod.Error("Couldn't create persis object for session", zap.String("ClientID", id), zap.Error(err))
+
+					// tenant is out of quota. refuse new session rather than serve it without persistence
+					if err == persistenceTypes.ErrQuotaExceeded && !present {
+						resp.SetReturnCode(message.ErrServerUnavailable) // nolint: errcheck
+						ses.discard()
+						return nil, false, err
+					}
 				}
 			}
 		} else {
@@ -384,9 +816,14 @@ func (m *Manager) allocSession(id string, msg *message.ConnectMessage, resp *mes
 }
 
 // onStop is only invoked for non-clean session
-func (m *Manager) onStop(id string, s message.TopicsQoS) {
+func (m *Manager) onStop(id string, s message.Subscriptions) {
 	defer m.sessions.suspended.count.Done()
 
+	// shared subscriptions are written through on every change
+	if m.config.SharedPersistence || len(s) == 0 {
+		return
+	}
+
 	ses, err := m.config.Persist.Get(id)
 	if err != nil {
 		m.log.prod.Error("Trying to persist session that has not been initiated for persistence", zap.String("ClientID", id), zap.Error(err))
@@ -402,11 +839,64 @@ func (m *Manager) onStop(id string, s message.TopicsQoS) {
 	}
 }
 
+// onSubscriptions replace persisted subscriptions of session
+func (m *Manager) onSubscriptions(id string, s message.Subscriptions) {
+	ses, err := m.config.Persist.Get(id)
+	if err != nil {
+		m.log.prod.Error("Couldn't persist subscriptions", zap.String("ClientID", id), zap.Error(err))
+		return
+	}
+
+	var sesSubs persistenceTypes.Subscriptions
+	if sesSubs, err = ses.Subscriptions(); err == nil {
+		var stored message.Subscriptions
+		if stored, err = sesSubs.Get(); err == nil && len(stored) > 0 {
+			err = sesSubs.Delete()
+		} else if err == persistenceTypes.ErrNotFound {
+			err = nil
+		}
+
+		if err == nil && len(s) > 0 {
+			err = sesSubs.Add(s)
+		}
+	}
+
+	if err != nil {
+		m.log.prod.Error("Couldn't persist subscriptions", zap.String("ClientID", id), zap.Error(err))
+	}
+}
+
+// persistedSubscriptions of session. Empty if session has none
+func (m *Manager) persistedSubscriptions(id string) message.Subscriptions {
+	res := make(message.Subscriptions)
+
+	ses, err := m.config.Persist.Get(id)
+	if err != nil {
+		return res
+	}
+
+	var sesSubs persistenceTypes.Subscriptions
+	if sesSubs, err = ses.Subscriptions(); err == nil {
+		var subs message.Subscriptions
+		if subs, err = sesSubs.Get(); err == nil {
+			for t, o := range subs {
+				res[t] = o
+			}
+		}
+	}
+
+	if err != nil && err != persistenceTypes.ErrNotFound {
+		m.log.prod.Error("Couldn't load persisted subscriptions", zap.String("ClientID", id), zap.Error(err))
+	}
+
+	return res
+}
+
 func (m *Manager) onPublish(id string, msg *message.PublishMessage) {
 	if ses, err := m.config.Persist.Get(id); err == nil {
 		var sesMsg persistenceTypes.Messages
 		if sesMsg, err = ses.Messages(); err == nil {
-			if err = sesMsg.Store("out", []message.Provider{msg}); err != nil {
+			if err = m.store(sesMsg, "out", []message.Provider{msg}); err != nil {
 				m.log.prod.Error("Couldn't store messages", zap.String("ClientID", id), zap.Error(err))
 			}
 		} else {
@@ -417,9 +907,21 @@ func (m *Manager) onPublish(id string, msg *message.PublishMessage) {
 	}
 }
 
+func (m *Manager) onSysPublish(id string, msg *message.PublishMessage) {
+	if m.config.OnSysPublish == nil {
+		m.log.dev.Debug("Publish to system topic ignored", zap.String("ClientID", id), zap.String("topic", msg.Topic()))
+		return
+	}
+
+	m.config.OnSysPublish(id, msg)
+}
+
 func (m *Manager) onDisconnect(id string, messages *persistenceTypes.SessionMessages, shutdown bool) {
 	defer m.sessions.active.count.Done()
 
+	// in-flight messages either stored below or dropped along with clean session
+	defer m.clearWAL(id)
+
 	// non-nil messages object means this is non-clean session
 	if messages != nil {
 		// persist messages if any
@@ -429,13 +931,13 @@ func (m *Manager) onDisconnect(id string, messages *persistenceTypes.SessionMess
 			var sesMsg persistenceTypes.Messages
 			if sesMsg, err = ses.Messages(); err == nil {
 				if len(messages.Out.Messages) > 0 {
-					if err = sesMsg.Store("out", messages.Out.Messages); err != nil {
+					if err = m.store(sesMsg, "out", messages.Out.Messages); err != nil {
 						m.log.prod.Error("Couldn't persist messages", zap.String("ClientID", id), zap.Error(err))
 					}
 				}
 
 				if len(messages.In.Messages) > 0 {
-					if err = sesMsg.Store("in", messages.In.Messages); err != nil {
+					if err = m.store(sesMsg, "in", messages.In.Messages); err != nil {
 						m.log.prod.Error("Couldn't persist messages", zap.String("ClientID", id), zap.Error(err))
 					}
 				}
@@ -467,8 +969,85 @@ func (m *Manager) onDisconnect(id string, messages *persistenceTypes.SessionMess
 	m.log.prod.Info("Client disconnected", zap.String("ClientID", id))
 }
 
+// replayWAL move in-flight messages left in write-ahead log by crash into persisted sessions
+// Messages already stored under same packet ID are skipped thus crash between store and
+// log clear does not duplicate them
+func (m *Manager) replayWAL() {
+	for id, messages := range m.config.WAL.Sessions() {
+		pSes, err := m.config.Persist.Get(id)
+		if err != nil {
+			// clean session or session has been deleted. in-flight state is not needed anymore
+			m.log.dev.Debug("Drop in-flight messages of unknown session", zap.String("ClientID", id))
+			m.clearWAL(id)
+			continue
+		}
+
+		var sesMsg persistenceTypes.Messages
+		if sesMsg, err = pSes.Messages(); err != nil {
+			m.log.prod.Error("Couldn't restore in-flight messages", zap.String("ClientID", id), zap.Error(err))
+			continue
+		}
+
+		stored, _ := sesMsg.Load() // nolint: gas
+		if stored == nil {
+			stored = &persistenceTypes.SessionMessages{}
+		}
+
+		in := missingMessages(messages.In.Messages, stored.In.Messages)
+		out := missingMessages(messages.Out.Messages, stored.Out.Messages)
+
+		if len(in) > 0 {
+			err = m.store(sesMsg, "in", in)
+		}
+
+		if err == nil && len(out) > 0 {
+			err = m.store(sesMsg, "out", out)
+		}
+
+		if err != nil {
+			m.log.prod.Error("Couldn't restore in-flight messages", zap.String("ClientID", id), zap.Error(err))
+			continue
+		}
+
+		m.log.prod.Info("Restored in-flight messages", zap.String("ClientID", id), zap.Int("in", len(in)), zap.Int("out", len(out)))
+		m.clearWAL(id)
+	}
+}
+
+func (m *Manager) clearWAL(id string) {
+	if m.config.WAL == nil {
+		return
+	}
+
+	if err := m.config.WAL.Clear(id); err != nil {
+		m.log.prod.Error("Couldn't clear in-flight journal", zap.String("ClientID", id), zap.Error(err))
+	}
+}
+
+// missingMessages messages of list not present in existing by type and packet ID
+func missingMessages(list []message.Provider, existing []message.Provider) []message.Provider {
+	type key struct {
+		t  message.Type
+		id uint16
+	}
+
+	present := make(map[key]bool)
+	for _, e := range existing {
+		present[key{e.Type(), e.PacketID()}] = true
+	}
+
+	var res []message.Provider
+	for _, msg := range list {
+		if !present[key{msg.Type(), msg.PacketID()}] {
+			res = append(res, msg)
+		}
+	}
+
+	return res
+}
+
 // WriteMessage into connection
-func (m *Manager) writeMessage(conn io.Closer, msg message.Provider) error {
+func (m *Manager) writeMessage(conn types.Conn, msg message.Provider) error {
 	size, err := msg.Size()
 	if err != nil {
 		return err
@@ -483,16 +1062,11 @@ func (m *Manager) writeMessage(conn io.Closer, msg message.Provider) error {
 	return m.writeMessageBuffer(conn, buf)
 }
 
-func (m *Manager) writeMessageBuffer(c io.Closer, b []byte) error {
+func (m *Manager) writeMessageBuffer(c types.Conn, b []byte) error {
 	if c == nil {
 		return types.ErrInvalidConnectionType
 	}
 
-	conn, ok := c.(net.Conn)
-	if !ok {
-		return types.ErrInvalidConnectionType
-	}
-
-	_, err := conn.Write(b)
+	_, err := c.Write(b)
 	return err
 }
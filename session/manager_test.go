@@ -0,0 +1,386 @@
+package session
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+	persistenceTypes "github.com/troian/surgemq/persistence/types"
+	"github.com/troian/surgemq/systree"
+	"github.com/troian/surgemq/topics/mem"
+	topicsTypes "github.com/troian/surgemq/topics/types"
+	"github.com/troian/surgemq/types"
+)
+
+// memSessions persistence of sessions counting writes of subscriptions
+type memSessions struct {
+	lock     sync.Mutex
+	sessions map[string]*memSession
+	adds     int
+}
+
+type memSession struct {
+	p    *memSessions
+	id   string
+	subs message.Subscriptions
+}
+
+type memMessages struct{}
+
+func newMemSessions() *memSessions {
+	return &memSessions{sessions: make(map[string]*memSession)}
+}
+
+func (p *memSessions) New(id string) (persistenceTypes.Session, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s := &memSession{p: p, id: id}
+	p.sessions[id] = s
+
+	return s, nil
+}
+
+func (p *memSessions) Get(id string) (persistenceTypes.Session, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if s, ok := p.sessions[id]; ok {
+		return s, nil
+	}
+
+	return nil, persistenceTypes.ErrNotFound
+}
+
+func (p *memSessions) GetAll() ([]persistenceTypes.Session, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	res := make([]persistenceTypes.Session, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		res = append(res, s)
+	}
+
+	return res, nil
+}
+
+func (p *memSessions) Delete(id string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.sessions, id)
+
+	return nil
+}
+
+func (s *memSession) Subscriptions() (persistenceTypes.Subscriptions, error) { return s, nil }
+func (s *memSession) Messages() (persistenceTypes.Messages, error)           { return memMessages{}, nil }
+func (s *memSession) ID() (string, error)                                    { return s.id, nil }
+
+func (s *memSession) Add(subs message.Subscriptions) error {
+	s.p.lock.Lock()
+	defer s.p.lock.Unlock()
+
+	s.p.adds++
+	if s.subs == nil {
+		s.subs = make(message.Subscriptions)
+	}
+
+	for t, o := range subs {
+		s.subs[t] = o
+	}
+
+	return nil
+}
+
+func (s *memSession) Get() (message.Subscriptions, error) {
+	s.p.lock.Lock()
+	defer s.p.lock.Unlock()
+
+	if len(s.subs) == 0 {
+		return nil, persistenceTypes.ErrNotFound
+	}
+
+	res := make(message.Subscriptions, len(s.subs))
+	for t, o := range s.subs {
+		res[t] = o
+	}
+
+	return res, nil
+}
+
+func (s *memSession) Delete() error {
+	s.p.lock.Lock()
+	defer s.p.lock.Unlock()
+
+	s.subs = nil
+
+	return nil
+}
+
+func (memMessages) Store(string, []message.Provider) error { return nil }
+func (memMessages) Load() (*persistenceTypes.SessionMessages, error) {
+	return &persistenceTypes.SessionMessages{}, nil
+}
+func (memMessages) Delete() error { return nil }
+
+// restoredManager with suspended session of client restored from persistence
+func restoredManager(t *testing.T, id string, filter string, hooks ...Hooks) (*Manager, *memSessions, topicsTypes.Provider) {
+	topics, err := mem.NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	persist := newMemSessions()
+	ses, err := persist.New(id)
+	require.NoError(t, err)
+
+	subs, err := ses.Subscriptions()
+	require.NoError(t, err)
+	require.NoError(t, subs.Add(message.Subscriptions{filter: {QoS: message.QoS1}}))
+	persist.adds = 0
+
+	tree, err := systree.NewTree()
+	require.NoError(t, err)
+
+	config := Config{TopicsMgr: topics, Persist: persist, Hooks: hooks}
+	config.Metric.Packets = tree.Metric().Packets()
+	config.Metric.Bytes = tree.Metric().Bytes()
+	config.Metric.Session = tree.Session()
+	config.Metric.Sessions = tree.Sessions()
+	config.Metric.Connections = tree.Connections()
+	config.Metric.Violations = tree.Violations()
+	config.Metric.Latency = tree.Latency()
+	config.Metric.Drops = tree.Drops()
+
+	m, err := NewManager(config)
+	require.NoError(t, err)
+
+	return m, persist, topics
+}
+
+func subscribers(t *testing.T, topics topicsTypes.Provider, topic string) int {
+	var subs types.Subscribers
+	require.NoError(t, topics.Subscribers(topic, message.QoS0, &subs))
+
+	for _, s := range subs {
+		s.WgWriters.Done()
+	}
+
+	return len(subs)
+}
+
+func TestExpire(t *testing.T) {
+	m, persist, topics := restoredManager(t, "dev1", "sensors/#")
+
+	info, ok := m.Session("dev1")
+	require.True(t, ok)
+	require.Equal(t, StateSuspended, info.State)
+	require.Equal(t, 1, subscribers(t, topics, "sensors/temp"))
+
+	require.True(t, m.Expire("dev1"))
+
+	// only persisted state is left for garbage collector
+	info, ok = m.Session("dev1")
+	require.True(t, ok)
+	require.Equal(t, StatePersisted, info.State)
+
+	// expired session is no longer subscribed and its subscriptions are not persisted again
+	require.Equal(t, 0, subscribers(t, topics, "sensors/temp"))
+	require.Equal(t, 0, persist.adds)
+
+	subs, err := persist.sessions["dev1"].Get()
+	require.Equal(t, persistenceTypes.ErrNotFound, err)
+	require.Empty(t, subs)
+}
+
+// recorder hooks recording invocations
+type recorder struct {
+	HooksBase
+
+	lock   sync.Mutex
+	events []string
+}
+
+func (r *recorder) record(e string) {
+	r.lock.Lock()
+	r.events = append(r.events, e)
+	r.lock.Unlock()
+}
+
+func (r *recorder) list() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]string(nil), r.events...)
+}
+
+func (r *recorder) OnConnect(id string, msg *message.ConnectMessage) error {
+	r.record("connect " + id)
+	return nil
+}
+
+func (r *recorder) OnDisconnect(id string, reason DisconnectReason) {
+	r.record("disconnect " + id + " " + reason.String())
+}
+
+func (r *recorder) OnSubscribe(id string, topic string, qos message.QosType) (message.QosType, error) {
+	r.record("subscribe " + id + " " + topic)
+	return qos, nil
+}
+
+func (r *recorder) OnPublishOut(id string, msg *message.PublishMessage) error {
+	r.record("publish out " + id + " " + msg.Topic())
+	return nil
+}
+
+// connect client over pipe and wait for CONNACK. Packets received by client are sent to
+// channel closed once connection is
+func connect(t *testing.T, m *Manager, id string, present bool) (net.Conn, chan message.Provider) {
+	client, server := net.Pipe()
+
+	received := make(chan message.Provider, 10)
+	go func() {
+		defer close(received)
+
+		for {
+			p, err := message.ReadFrom(client)
+			if err != nil {
+				return
+			}
+
+			received <- p
+		}
+	}()
+
+	msg := message.NewConnectMessage()
+	require.NoError(t, msg.SetVersion(0x4))
+	require.NoError(t, msg.SetClientID([]byte(id)))
+	msg.SetCleanSession(false)
+	msg.SetKeepAlive(10)
+
+	resp := message.NewConnAckMessage()
+	require.NoError(t, m.Start(msg, resp, server, StartParams{}))
+	require.Equal(t, present, resp.SessionPresent())
+
+	require.IsType(t, &message.ConnAckMessage{}, <-received)
+
+	return client, received
+}
+
+func TestRestoredHooks(t *testing.T) {
+	rec := &recorder{}
+
+	m, _, topics := restoredManager(t, "dev1", "sensors/#", rec)
+	defer m.Shutdown() // nolint: errcheck
+
+	// suspended session delivers through hooks
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic("sensors/temp"))
+	require.NoError(t, msg.SetQoS(message.QoS1))
+	require.NoError(t, topics.Publish(msg))
+
+	require.Equal(t, []string{"publish out dev1 sensors/temp"}, rec.list())
+
+	client, received := connect(t, m, "dev1", true)
+	defer client.Close() // nolint: errcheck
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketID(1)
+	require.NoError(t, sub.AddTopic("alerts/#", message.QoS1))
+	require.NoError(t, message.WriteTo(client, sub))
+
+	// queued message and SUBACK, in either order
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			require.Fail(t, "no response of session")
+		}
+	}
+
+	client.Close() // nolint: errcheck
+
+	require.Eventually(t, func() bool { return len(rec.list()) == 4 }, time.Second, 10*time.Millisecond, "%v", rec.list())
+	require.Equal(t, []string{
+		"publish out dev1 sensors/temp",
+		"connect dev1",
+		"subscribe dev1 alerts/#",
+		"disconnect dev1 connection lost",
+	}, rec.list())
+}
+
+// disconnected wait until notice of reason is received and connection is closed
+func disconnected(t *testing.T, received chan message.Provider, reason DisconnectReason) {
+	var notice *message.PublishMessage
+
+	timeout := time.After(time.Second)
+
+	for {
+		select {
+		case p, ok := <-received:
+			if !ok {
+				require.NotNil(t, notice, "connection closed without notice")
+				require.Equal(t, DisconnectTopic, notice.Topic())
+				require.Equal(t, reason.String(), string(notice.Payload()))
+				require.Equal(t, message.QoS0, notice.QoS())
+				return
+			}
+
+			if m, ok := p.(*message.PublishMessage); ok && m.Topic() == DisconnectTopic {
+				notice = m
+			}
+		case <-timeout:
+			require.Fail(t, "connection not closed")
+		}
+	}
+}
+
+func TestDisconnectNotice(t *testing.T) {
+	rec := &recorder{}
+
+	m, _, _ := restoredManager(t, "dev1", "sensors/#", rec)
+
+	// notice is off by default
+	client, received := connect(t, m, "dev1", true)
+	defer client.Close() // nolint: errcheck
+
+	require.True(t, m.Kick("dev1", true))
+
+	for closed := false; !closed; {
+		select {
+		case p, ok := <-received:
+			if pub, isPub := p.(*message.PublishMessage); isPub {
+				require.NotEqual(t, DisconnectTopic, pub.Topic())
+			}
+			closed = !ok
+		case <-time.After(time.Second):
+			require.Fail(t, "connection not closed")
+		}
+	}
+
+	// sessions allocated from now on send notice
+	m.config.DisconnectNotice = true
+
+	client, received = connect(t, m, "dev1", false)
+	defer client.Close() // nolint: errcheck
+
+	require.True(t, m.Kick("dev1", false))
+	disconnected(t, received, DisconnectKick)
+
+	client, received = connect(t, m, "dev1", true)
+	defer client.Close() // nolint: errcheck
+
+	require.NoError(t, m.Shutdown())
+	disconnected(t, received, DisconnectShutdown)
+
+	require.Equal(t, []string{
+		"connect dev1",
+		"disconnect dev1 kick",
+		"connect dev1",
+		"disconnect dev1 kick",
+		"connect dev1",
+		"disconnect dev1 shutdown",
+	}, rec.list())
+}
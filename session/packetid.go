@@ -0,0 +1,57 @@
+package session
+
+// packetIDs allocator of outbound packet IDs. ID stays in use from assigning it to message
+// until exchange completes thus in-flight exchange never shares ID with new one
+// [MQTT-2.3.1-2]. Guarded by publisher lock
+type packetIDs struct {
+	last uint16
+	used map[uint16]bool
+}
+
+// alloc next free ID after last allocated one. Returns false if every ID is in use
+func (p *packetIDs) alloc() (uint16, bool) {
+	if p.used == nil {
+		p.used = make(map[uint16]bool)
+	}
+
+	// 0 is not valid packet ID
+	if len(p.used) >= 0xFFFF {
+		return 0, false
+	}
+
+	id := p.last
+	for {
+		id++
+		if id != 0 && !p.used[id] {
+			break
+		}
+	}
+
+	p.last = id
+	p.used[id] = true
+
+	return id, true
+}
+
+// reserve ID of message restored from persistence
+func (p *packetIDs) reserve(id uint16) {
+	if id == 0 {
+		return
+	}
+
+	if p.used == nil {
+		p.used = make(map[uint16]bool)
+	}
+
+	p.used[id] = true
+}
+
+// free ID of completed exchange
+func (p *packetIDs) free(id uint16) {
+	delete(p.used, id)
+}
+
+// reset release all IDs
+func (p *packetIDs) reset() {
+	p.used = nil
+}
@@ -0,0 +1,69 @@
+package session
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/troian/surgemq/message"
+)
+
+// TracePackets enable or disable reporting of control packets of client to OnPacket
+// Takes effect immediately if client is connected. id includes namespace of virtual host
+func (m *Manager) TracePackets(id string, on bool) {
+	m.traced.lock.Lock()
+	defer m.traced.lock.Unlock()
+
+	if on {
+		if m.traced.ids == nil {
+			m.traced.ids = make(map[string]bool)
+		}
+		m.traced.ids[id] = true
+	} else {
+		delete(m.traced.ids, id)
+	}
+
+	for _, l := range m.stateLists() {
+		l.list.lock.RLock()
+		if s, ok := l.list.list[id]; ok && s != nil {
+			s.setTraced(on)
+		}
+		l.list.lock.RUnlock()
+	}
+}
+
+// TracedClients ids of clients packets are traced of
+func (m *Manager) TracedClients() []string {
+	m.traced.lock.Lock()
+	defer m.traced.lock.Unlock()
+
+	ids := make([]string, 0, len(m.traced.ids))
+	for id := range m.traced.ids {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+func (m *Manager) isTraced(id string) bool {
+	m.traced.lock.Lock()
+	defer m.traced.lock.Unlock()
+
+	return m.traced.ids[id]
+}
+
+func (s *Type) setTraced(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+
+	atomic.StoreInt32(&s.traced, v)
+}
+
+func (s *Type) onPacket(incoming bool, msg message.Provider) {
+	if s.config.onPacket != nil {
+		s.config.onPacket(s.config.id, incoming, msg)
+	}
+}
@@ -0,0 +1,162 @@
+package session
+
+import (
+	"container/list"
+	"errors"
+	"sync/atomic"
+
+	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/systree"
+	"github.com/troian/surgemq/types"
+	"go.uber.org/zap"
+)
+
+// ErrQueueFull message dropped by limits of session queue
+var ErrQueueFull = errors.New("session: queue full")
+
+// msgSize payload bytes of message accounted by queue limits
+func msgSize(m message.Provider) int {
+	if p, ok := m.(*message.PublishMessage); ok {
+		return len(p.Payload())
+	}
+
+	return 0
+}
+
+// pushBack queue message. Caller holds publisher lock
+func (p *publisher) pushBack(m message.Provider) {
+	p.messages.PushBack(m)
+	p.bytes += msgSize(m)
+}
+
+// pushFront queue message ahead of others. Caller holds publisher lock
+func (p *publisher) pushFront(m message.Provider) {
+	p.messages.PushFront(m)
+	p.bytes += msgSize(m)
+}
+
+// remove message from queue. Caller holds publisher lock
+func (p *publisher) remove(e *list.Element) message.Provider {
+	m, _ := p.messages.Remove(e).(message.Provider)
+	p.bytes -= msgSize(m)
+
+	return m
+}
+
+// queueFull check if queuing message of given size exceeds limits
+// Caller holds publisher lock
+func (s *Type) queueFull(size int) bool {
+	q := &s.config.queue
+
+	count := s.publisher.messages.Len() + s.publisher.offline.count
+	bytes := s.publisher.bytes + s.publisher.offline.bytes
+
+	return (q.MaxMessages > 0 && count >= q.MaxMessages) || (q.MaxBytes > 0 && bytes+size > q.MaxBytes)
+}
+
+// admit apply drop policy before message queued. Returns false if message must be dropped
+// Caller holds publisher lock
+func (s *Type) admit(m *message.PublishMessage) bool {
+	size := len(m.Payload())
+
+	for s.queueFull(size) {
+		if s.config.queue.Policy == types.QueueDropOldest && s.dropOldest() {
+			continue
+		}
+
+		s.log.dev.Debug("Offline queue full. Drop message",
+			zap.String("ClientID", s.config.id),
+			zap.String("topic", m.Topic()))
+
+		// message which can never fit queue is told apart from one arriving at full queue
+		if s.config.queue.MaxBytes > 0 && size > s.config.queue.MaxBytes {
+			s.drop(systree.DropOversized)
+		} else {
+			s.drop(systree.DropQueueFull)
+		}
+
+		s.undelivered(m, ErrQueueFull)
+
+		if s.config.queue.Policy == types.QueueDisconnect && atomic.LoadInt64(&s.connected) == 1 {
+			s.log.prod.Warn("Offline queue full. Disconnect client", zap.String("ClientID", s.config.id))
+			go s.disconnect(DisconnectQueueFull)
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// dropOldest remove oldest queued PUBLISH. Returns false if there is nothing to drop
+// Caller holds publisher lock
+func (s *Type) dropOldest() bool {
+	for elem := s.publisher.messages.Front(); elem != nil; elem = elem.Next() {
+		if m, ok := elem.Value.(*message.PublishMessage); ok {
+			s.publisher.remove(elem)
+			s.publisher.ids.free(m.PacketID())
+
+			s.log.dev.Debug("Offline queue full. Drop oldest message",
+				zap.String("ClientID", s.config.id),
+				zap.String("topic", m.Topic()))
+
+			s.drop(systree.DropQueueFull)
+			s.undelivered(m, ErrQueueFull)
+			return true
+		}
+	}
+
+	return false
+}
+
+// undelivered report message session gave up on. Might be called with publisher lock held
+func (s *Type) undelivered(m *message.PublishMessage, reason error) {
+	traceDelivered(m, reason)
+
+	if s.config.onUndelivered != nil {
+		s.config.onUndelivered(s.config.id, m, reason)
+	}
+}
+
+// drop account message dropped for cause
+func (s *Type) drop(cause systree.DropCause) {
+	if s.config.metric.drops != nil {
+		s.config.metric.drops.Dropped(cause)
+	}
+}
+
+// nextMessage first queued message allowed to be sent. In strict ordering mode messages
+// of topic with QoS 1/2 message awaiting acknowledge are skipped. Caller holds publisher lock
+func (s *Type) nextMessage() *list.Element {
+	if !s.config.strictOrdering {
+		return s.publisher.messages.Front()
+	}
+
+	for elem := s.publisher.messages.Front(); elem != nil; elem = elem.Next() {
+		if m, ok := elem.Value.(*message.PublishMessage); !ok || !s.publisher.unacked[m.Topic()] {
+			return elem
+		}
+	}
+
+	return nil
+}
+
+// hold topic of QoS 1/2 message being sent until it is acknowledged
+// Caller holds publisher lock
+func (s *Type) hold(msg message.Provider) {
+	if m, ok := msg.(*message.PublishMessage); ok && s.config.strictOrdering && m.QoS() != message.QoS0 {
+		s.publisher.unacked[m.Topic()] = true
+	}
+}
+
+// release topic held by message and wake publisher up
+func (s *Type) release(m *message.PublishMessage) {
+	if !s.config.strictOrdering {
+		return
+	}
+
+	s.publisher.lock.Lock()
+	delete(s.publisher.unacked, m.Topic())
+	s.publisher.lock.Unlock()
+	s.publisher.cond.Signal()
+}
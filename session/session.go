@@ -15,28 +15,40 @@
 package session
 
 import (
+	"strings"
 	"sync"
 
 	"container/list"
-	"io"
 	"sync/atomic"
+	"time"
 
 	"github.com/troian/surgemq"
+	"github.com/troian/surgemq/audit"
+	"github.com/troian/surgemq/auth"
 	"github.com/troian/surgemq/message"
 	persistenceTypes "github.com/troian/surgemq/persistence/types"
+	"github.com/troian/surgemq/persistence/wal"
+	"github.com/troian/surgemq/ratelimit"
 	"github.com/troian/surgemq/systree"
+	"github.com/troian/surgemq/topics/rewrite"
 	"github.com/troian/surgemq/topics/types"
 	"github.com/troian/surgemq/types"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
-type managerCallbacks struct {
-	// onClose called when session has done all work and should be deleted
-	onStop func(id string, s message.TopicsQoS)
+// events of session handled by manager
+type events interface {
+	// onStop called when session has done all work and should be deleted
+	onStop(id string, s message.Subscriptions)
 	// onDisconnect called when session stopped net connection and should be either suspended or deleted
-	onDisconnect func(id string, messages *persistenceTypes.SessionMessages, shutdown bool)
-	// onPublish
-	onPublish func(id string, msg *message.PublishMessage)
+	onDisconnect(id string, messages *persistenceTypes.SessionMessages, shutdown bool)
+	// onPublish called with message of offline client to be persisted
+	onPublish(id string, msg *message.PublishMessage)
+	// onSysPublish called when client publishes to system topic
+	onSysPublish(id string, msg *message.PublishMessage)
+	// onSubscriptions called with subscriptions once changed if persistence is shared
+	onSubscriptions(id string, s message.Subscriptions)
 }
 
 // Config is system wide configuration parameters for every session
@@ -57,13 +69,61 @@ type config struct {
 	timeoutRetries int
 
 	metric struct {
-		packets systree.PacketsMetric
-		session systree.SessionStat
+		packets    systree.PacketsMetric
+		bytes      systree.BytesMetric
+		session    systree.SessionStat
+		conns      systree.ConnectionsStat
+		violations systree.ViolationsStat
+		latency    systree.LatencyStat
+		drops      systree.DropsStat
 	}
 
-	subscriptions message.TopicsQoS
+	slowClient types.SlowClientConfig
 
-	callbacks managerCallbacks
+	violations types.ViolationConfig
+
+	subscriptions message.Subscriptions
+
+	// manager owning session
+	manager events
+
+	// hooks of embedding application
+	hooks Pipeline
+
+	// onUndelivered called when message could not be delivered to client
+	onUndelivered func(id string, msg *message.PublishMessage, reason error)
+
+	// onPacket called with packets of traced client
+	onPacket func(id string, incoming bool, msg message.Provider)
+
+	// wal journal of in-flight messages. nil if disabled
+	wal *wal.Log
+
+	queue types.OfflineQueueConfig
+
+	// maxQoS highest QoS supported
+	maxQoS message.QosType
+
+	// shared persistence with other brokers, see Config.SharedPersistence
+	shared bool
+
+	// strictOrdering hold messages of topic until previous QoS 1/2 one is acknowledged
+	strictOrdering bool
+
+	// notice of disconnect reason is sent to client, see Config.DisconnectNotice
+	notice bool
+
+	// rewrite rules of client topics. nil if disabled
+	rewrite *rewrite.Rules
+
+	// limits of publishes by topic prefix. nil if disabled
+	limits *ratelimit.Topics
+
+	// tracer of message flow
+	tracer trace.Tracer
+
+	// audit log of denied access. nil if disabled
+	audit audit.Logger
 
 	id string
 }
@@ -79,6 +139,21 @@ type publisher struct {
 	messages *list.List
 	lock     sync.Mutex
 	cond     *sync.Cond
+
+	// bytes payload size of queued messages
+	bytes int
+
+	// offline messages handed to persistence while client is offline
+	offline struct {
+		count int
+		bytes int
+	}
+
+	// unacked topics with QoS 1/2 message awaiting acknowledge in strict ordering mode
+	unacked map[string]bool
+
+	// ids packet IDs of queued and in-flight messages
+	ids packetIDs
 }
 
 // Type session
@@ -120,7 +195,31 @@ type Type struct {
 
 	clean bool
 
-	packetID uint64
+	// topic namespace of the current connection
+	namespace string
+
+	// wildcard restrictions of the current connection
+	policy *topicsTypes.SubscriptionPolicy
+
+	// access control of the current connection
+	auth     *auth.Manager
+	username string
+
+	// peer of the current connection
+	connectedAt time.Time
+	remoteAddr  string
+
+	// closeReason why broker closed the current connection, see DisconnectReason
+	closeReason int32
+
+	// traced either packets of client are reported, see Manager.TracePackets
+	traced int32
+
+	// published messages received from and sent to client over all connections
+	published publishCounts
+
+	// usage of client quota. nil if unlimited
+	quota *ratelimit.Client
 
 	log struct {
 		prod *zap.Logger
@@ -142,16 +241,28 @@ func newSession(config config) (*Type, error) {
 
 	s.publisher.cond = sync.NewCond(&s.publisher.lock)
 
-	s.ack.pubIn = newAckQueue(s.onAckIn)
-	s.ack.pubOut = newAckQueue(s.onAckOut)
+	s.ack.pubIn = newAckQueue(s.onAckIn,
+		ackJournal{log: config.wal, id: config.id, dir: "in", err: s.log.prod, stat: config.metric.latency}, ackRetryPolicy{})
+	s.ack.pubOut = newAckQueue(s.onAckOut,
+		ackJournal{log: config.wal, id: config.id, dir: "out", err: s.log.prod, stat: config.metric.latency},
+		ackRetryPolicy{
+			timeout: time.Duration(config.ackTimeout) * time.Second,
+			retries: config.timeoutRetries,
+		})
+	s.ack.pubOut.latency = config.metric.latency
 	s.subscriber.Publish = s.onSubscribedPublish
+	s.subscriber.ID = config.id
+
+	// restore subscriptions if any, options other than QoS are kept as persisted
+	// maximum QoS might have been lowered since subscriptions persisted
+	for t, o := range s.config.subscriptions {
+		o.QoS = s.grantQoS(o.QoS)
+		s.config.subscriptions[t] = o
 
-	// restore subscriptions if any
-	for t, q := range s.config.subscriptions {
-		if _, err := s.config.topicsMgr.Subscribe(t, q, &s.subscriber); err != nil {
+		if _, err := s.config.topicsMgr.Subscribe(t, o.QoS, &s.subscriber); err != nil {
 			s.log.prod.Error("Couldn't subscribe",
 				zap.String("topic", t),
-				zap.Int8("QoS", int8(q)),
+				zap.Int8("QoS", int8(o.QoS)),
 				zap.Error(err))
 		}
 	}
@@ -160,11 +271,38 @@ func newSession(config config) (*Type, error) {
 }
 
 // restore messages if any
+// Persisted messages are queued ahead of ones arrived while session was suspended
+// in order they were persisted
 func (s *Type) restore(messages *persistenceTypes.SessionMessages) {
 	if messages != nil {
 		s.publisher.lock.Lock()
+
+		// persisted messages are queued again
+		s.publisher.offline.count = 0
+		s.publisher.offline.bytes = 0
+
+		var restored []message.Provider
+
 		for _, m := range messages.Out.Messages {
-			s.publisher.messages.PushBack(m)
+			if p, ok := m.(*message.PublishMessage); ok {
+				// limits might have been lowered since messages persisted
+				if !s.admit(p) {
+					continue
+				}
+
+				// [MQTT-4.4.0-1] unacknowledged PUBLISH is resent with DUP flag
+				if p.PacketID() != 0 {
+					p.SetDup(true)
+				}
+			}
+
+			// exchanges started by previous connection continue with the same IDs
+			s.publisher.ids.reserve(m.PacketID())
+			restored = append(restored, m)
+		}
+
+		for i := len(restored) - 1; i >= 0; i-- {
+			s.publisher.pushFront(restored[i])
 		}
 
 		for _, m := range messages.In.Messages {
@@ -177,7 +315,7 @@ func (s *Type) restore(messages *persistenceTypes.SessionMessages) {
 
 // Start inform session there is a new connection with matching clientID
 // thus provide necessary info to spin
-func (s *Type) start(msg *message.ConnectMessage, conn io.Closer) {
+func (s *Type) start(msg *message.ConnectMessage, conn types.Conn, params StartParams) {
 	if !atomic.CompareAndSwapInt64(&s.connected, 0, 1) {
 		s.wg.conn.started.Wait()
 		s.log.prod.Warn("Starting already running session")
@@ -190,6 +328,7 @@ func (s *Type) start(msg *message.ConnectMessage, conn io.Closer) {
 			close(s.publisher.quit)
 			s.conn = nil
 			atomic.StoreInt64(&s.connected, 0)
+			s.wg.conn.stopped.Done()
 
 			s.log.prod.Warn("Couldn't start session", zap.Error(err))
 		}
@@ -204,21 +343,64 @@ func (s *Type) start(msg *message.ConnectMessage, conn io.Closer) {
 	s.wg.conn.started.Add(1)
 	s.wg.conn.stopped.Add(1)
 
+	s.namespace = params.Namespace
+	s.policy = params.Subscriptions
+	s.auth = params.Auth
+	s.username = params.Username
+
+	ackPolicy := ackRetryPolicy{
+		timeout: time.Duration(s.config.ackTimeout) * time.Second,
+		retries: s.config.timeoutRetries,
+	}
+	if params.Ack != nil {
+		ackPolicy.timeout = params.Ack.Timeout
+		ackPolicy.retries = params.Ack.Retries
+	}
+	s.ack.pubOut.setPolicy(ackPolicy)
+
+	s.quota = ratelimit.NewClient(params.Quota)
+
+	s.will = nil
 	if msg.WillFlag() {
-		s.will = message.NewPublishMessage()
-		s.will.SetQoS(msg.WillQos())     // nolint: errcheck
-		s.will.SetTopic(msg.WillTopic()) // nolint: errcheck
-		s.will.SetPayload(msg.WillMessage())
-		s.will.SetRetain(msg.WillRetain())
+		topic := s.config.rewrite.Publish(msg.WillTopic())
+		if err = s.auth.CheckPublish(s.identity(), topic); err == nil {
+			s.will = message.NewPublishMessage()
+			s.will.SetQoS(s.grantQoS(msg.WillQos())) // nolint: errcheck
+			s.will.SetTopic(s.namespace + topic)     // nolint: errcheck
+			s.will.SetPayload(msg.WillMessage())
+			s.will.SetRetain(msg.WillRetain())
+		} else {
+			s.log.dev.Debug("Will message denied", zap.String("ClientID", s.config.id), zap.String("topic", topic))
+			s.auditDenied(audit.ActionWill, s.namespace+topic)
+			err = nil
+		}
 	}
 
 	s.clean = msg.CleanSession()
 	s.publisher.quit = make(chan struct{})
 
+	// messages in-flight with previous connection are queued again
+	s.publisher.lock.Lock()
+	s.publisher.unacked = make(map[string]bool)
+	s.publisher.lock.Unlock()
+
 	s.mu.Lock()
+	s.connectedAt = time.Now()
+	s.remoteAddr = ""
+	atomic.StoreInt32(&s.closeReason, int32(DisconnectConnectionLost))
+	if addr := conn.RemoteAddr(); addr != nil {
+		s.remoteAddr = addr.String()
+	}
+
+	var publishMetric systree.PublishMetric
+	if params.Listener != nil {
+		publishMetric = params.Listener.Publish()
+	}
+
 	s.conn, err = newConnection(
 		connConfig{
 			id:        s.config.id,
+			namespace: s.namespace,
 			conn:      conn,
 			keepAlive: int(msg.KeepAlive()),
 			on: onProcess{
@@ -229,6 +411,16 @@ func (s *Type) start(msg *message.ConnectMessage, conn io.Closer) {
 				disconnect:  s.onDisconnect,
 			},
 			packetsMetric: s.config.metric.packets,
+			bytesMetric:   s.config.metric.bytes,
+			publishMetric: publishMetric,
+			connStat:      s.config.metric.conns,
+			violationStat: s.config.metric.violations,
+			dropStat:      s.config.metric.drops,
+			slowClient:    s.config.slowClient,
+			violations:    s.config.violations,
+			traced:        &s.traced,
+			published:     &s.published,
+			onPacket:      s.onPacket,
 		})
 	s.mu.Unlock()
 	if err != nil {
@@ -237,22 +429,63 @@ func (s *Type) start(msg *message.ConnectMessage, conn io.Closer) {
 
 	s.conn.start()
 
-	s.publisher.stopped.Add(1)
+	if s.config.metric.session != nil {
+		s.config.metric.session.Connected()
+	}
+
+	s.publisher.stopped.Add(2)
 	s.publisher.started.Add(1)
 	go s.publishWorker()
+	go s.retryWorker()
 	s.publisher.started.Wait()
 }
 
-func (s *Type) disconnect() {
+func (s *Type) disconnect(reason DisconnectReason) {
 	// If Stop has been issued by the server handler it looks like
 	// application about to shutdown, thus we try close network connection.
 	// If close successful connection manager invokes onClose method which cleans up writer.
 	// If close error just check writer goroutine has finished it's job
 	s.mu.Lock()
-	if s.conn != nil {
-		s.conn.config.conn.Close() // nolint: errcheck
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return
+	}
+
+	// first reason wins, connection might be closed by few parties at once
+	if atomic.CompareAndSwapInt32(&s.closeReason, int32(DisconnectConnectionLost), int32(reason)) &&
+		s.config.notice && reason.notified() && s.conn.notify(reason) {
+		// connection is closed once notice is sent thus callers waiting for session
+		// to stop are not held by client which does not read.
+		// Buffer is taken under lock as onDisconnect releases it
+		c, out := s.conn, s.conn.out
+		go func() {
+			c.flush(out, disconnectFlushTimeout)
+			c.config.conn.Close() // nolint: errcheck, gas
+		}()
+
+		return
+	}
+
+	s.conn.config.conn.Close() // nolint: errcheck
+}
+
+// takeover close connection of session replaced by new one with the same client id and
+// wait until session either suspended or persisted by manager
+func (s *Type) takeover(reason DisconnectReason) {
+	s.disconnect(reason)
+	s.wg.conn.stopped.Wait()
+}
+
+// unSubscribeAll drop subscriptions of session which state is discarded
+func (s *Type) unSubscribeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for t := range s.config.subscriptions {
+		s.config.topicsMgr.UnSubscribe(t, &s.subscriber) // nolint: errcheck
+		delete(s.config.subscriptions, t)
 	}
-	s.mu.Unlock()
 }
 
 // stop session. Function assumed to be invoked once server about to shutdown
@@ -263,17 +496,32 @@ func (s *Type) stop(wait bool) {
 	default:
 		close(s.stopped)
 	}
-	s.disconnect()
+	s.disconnect(DisconnectShutdown)
 
 	if wait {
 		s.wg.conn.stopped.Wait()
 	}
 
 	if !s.clean {
-		s.config.callbacks.onStop(s.config.id, s.config.subscriptions)
+		s.config.manager.onStop(s.config.id, s.config.subscriptions)
 	}
 }
 
+// discard session allocated but refused before start
+// It is neither suspended nor persisted thus manager is not told it has stopped
+func (s *Type) discard() {
+	s.unSubscribeAll()
+	s.clean = true
+	s.stop(false)
+}
+
+// handOver stop session taken over by another broker sharing persistence
+// Subscriptions are dropped locally while persisted state is left to new broker
+func (s *Type) handOver() {
+	s.unSubscribeAll()
+	s.stop(false)
+}
+
 func (s *Type) isOpen() bool {
 	select {
 	case <-s.stopped:
@@ -295,6 +543,7 @@ func (s *Type) onSubscribedPublish(msg *message.PublishMessage) error {
 	m.SetQoS(msg.QoS())     // nolint: errcheck
 	m.SetTopic(msg.Topic()) // nolint: errcheck
 	m.SetPayload(msg.Payload())
+	m.SetContext(msg.Context())
 
 	// [MQTT-3.3.1-9]
 	m.SetRetain(false)
@@ -302,13 +551,23 @@ func (s *Type) onSubscribedPublish(msg *message.PublishMessage) error {
 	// [MQTT-3.3.1-3]
 	m.SetDup(false)
 
+	if err := s.config.hooks.OnPublishOut(s.config.id, m); err != nil {
+		s.log.dev.Debug("Publish dropped by hook", zap.String("ClientID", s.config.id), zap.String("topic", m.Topic()), zap.Error(err))
+		return nil
+	}
+
 	// If this is Fire and Forget firstly check is client online
-	if msg.QoS() == message.QoS0 {
+	// With shared persistence messages of any QoS are stored thus other broker finds them
+	if m.QoS() == message.QoS0 || s.config.shared {
 		// By checking s.publisher.quit channel we can effectively detect is client is connected or not
 		select {
 		case <-s.publisher.quit:
 			s.publisher.lock.Lock()
-			s.config.callbacks.onPublish(s.config.id, m)
+			if s.admit(m) {
+				s.config.manager.onPublish(s.config.id, m)
+				s.publisher.offline.count++
+				s.publisher.offline.bytes += len(m.Payload())
+			}
 			s.publisher.lock.Unlock()
 			return nil
 		default:
@@ -316,19 +575,37 @@ func (s *Type) onSubscribedPublish(msg *message.PublishMessage) error {
 	}
 
 	s.publisher.lock.Lock()
-	s.publisher.messages.PushBack(m)
+	if !s.admit(m) {
+		s.publisher.lock.Unlock()
+		return nil
+	}
+	s.publisher.pushBack(m)
 	s.publisher.lock.Unlock()
 	s.publisher.cond.Signal()
 
 	return nil
 }
 
+// identity of client publishes and subscriptions are checked for
+func (s *Type) identity() auth.Client {
+	return auth.Client{ID: s.config.id, Namespace: s.namespace, User: s.username}
+}
+
+// inFlight amount of QoS 1/2 exchanges and queued messages not yet finished
+func (s *Type) inFlight() int {
+	s.publisher.lock.Lock()
+	queued := s.publisher.messages.Len()
+	s.publisher.lock.Unlock()
+
+	return queued + s.ack.pubIn.size() + s.ack.pubOut.size()
+}
+
 // AddTopic add topic
-func (s *Type) addTopic(topic string, qos message.QosType) error {
+func (s *Type) addTopic(topic string, opts message.SubscriptionOptions) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.config.subscriptions[topic] = qos
+	s.config.subscriptions[topic] = opts
 
 	return nil
 }
@@ -343,12 +620,97 @@ func (s *Type) removeTopic(topic string) error {
 	return nil
 }
 
-func (s *Type) newPacketID() uint16 {
-	return uint16(atomic.AddUint64(&s.packetID, 1) & 0xFFFF)
+// persistSubscriptions write subscriptions through if persistence is shared
+func (s *Type) persistSubscriptions() {
+	if !s.config.shared || s.clean {
+		return
+	}
+
+	s.mu.Lock()
+	subs := make(message.Subscriptions, len(s.config.subscriptions))
+	for t, o := range s.config.subscriptions {
+		subs[t] = o
+	}
+	s.mu.Unlock()
+
+	s.config.manager.onSubscriptions(s.config.id, subs)
+}
+
+// reauthorize check subscriptions against current auth rules and drop denied ones
+// Returns amount of dropped subscriptions
+func (s *Type) reauthorize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.auth == nil {
+		return 0
+	}
+
+	dropped := 0
+
+	for t := range s.config.subscriptions {
+		filter := strings.TrimPrefix(t, s.namespace)
+
+		if s.policy.Allowed(filter) && s.auth.CheckSubscribe(s.identity(), filter) == nil {
+			continue
+		}
+
+		s.log.prod.Info("Subscription revoked", zap.String("ClientID", s.config.id), zap.String("topic", filter))
+		s.auditDenied(audit.ActionRevoke, t)
+
+		s.config.topicsMgr.UnSubscribe(t, &s.subscriber) // nolint: errcheck
+		delete(s.config.subscriptions, t)
+		dropped++
+	}
+
+	return dropped
+}
+
+// grantQoS downgrade QoS to maximum supported one
+func (s *Type) grantQoS(qos message.QosType) message.QosType {
+	if qos > s.config.maxQoS {
+		return s.config.maxQoS
+	}
+
+	return qos
+}
+
+// assignPacketID give QoS 1/2 publish without packet ID free one
+// Returns false if all IDs are in use. Caller holds publisher lock
+func (s *Type) assignPacketID(msg message.Provider) bool {
+	m, ok := msg.(*message.PublishMessage)
+	if !ok || m.QoS() == message.QoS0 || m.PacketID() != 0 {
+		return true
+	}
+
+	id, ok := s.publisher.ids.alloc()
+	if ok {
+		m.SetPacketID(id)
+	}
+
+	return ok
+}
+
+// freePacketID release ID of completed exchange and wake publisher up
+// if it is waiting for one
+func (s *Type) freePacketID(id uint16) {
+	s.publisher.lock.Lock()
+	s.publisher.ids.free(id)
+	s.publisher.lock.Unlock()
+	s.publisher.cond.Signal()
 }
 
 // forward PUBLISH message to topics manager which takes care about subscribers
 func (s *Type) publishToTopic(msg *message.PublishMessage) error {
+	// system topics are not routed, they carry commands to the broker
+	// Namespace of virtual host may start with '$' as well thus is not considered
+	if strings.HasPrefix(strings.TrimPrefix(msg.Topic(), s.namespace), "$") {
+		s.config.manager.onSysPublish(s.config.id, msg)
+		return nil
+	}
+
+	defer s.traceRoute(msg).End()
+
 	// [MQTT-3.3.1.3]
 	if msg.Retain() {
 		if err := s.config.topicsMgr.Retain(msg); err != nil {
@@ -384,26 +746,67 @@ func (s *Type) onAckIn(msg message.Provider, status error) {
 	}
 }
 
-// onAckComplete process messages that required ack cycle
-// onAckTimeout if publish message has not been acknowledged withing specified ackTimeout
-// server should mark it as a dup and send again
+// onAckOut message sent to client has been acknowledged
 func (s *Type) onAckOut(msg message.Provider, status error) {
-	//if status == errAckTimedOut {
-	//	appLog.Errorf("[%s] message not acknoweledged: %s", s.id, status.Error())
-	//
-	//	switch m := msg.(type) {
-	//	case *message.PublishMessage:
-	//		// if ack for QoS 1 or 2 has been timed out put this message back to the publish queue
-	//		if m.QoS() == message.QoS1 {
-	//			m.SetDup(true)
-	//		}
-	//		s.publisher.lock.Lock()
-	//		s.publisher.messages.PushBack(msg)
-	//		s.publisher.lock.Unlock()
-	//		s.publisher.cond.Signal()
-	//	case *message.PubRelMessage:
-	//	}
-	//}
+	if m, ok := msg.(*message.PublishMessage); ok {
+		traceDelivered(m, status)
+		s.release(m)
+	}
+}
+
+// retryWorker send again messages client has not acknowledged within ack timeout
+// Timeout doubles on every attempt, messages out of retries are handed to undelivered callback
+func (s *Type) retryWorker() {
+	defer s.publisher.stopped.Done()
+
+	if s.ack.pubOut.policy.timeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(retryPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.publisher.quit:
+			return
+		case now := <-ticker.C:
+			resend, expired := s.ack.pubOut.due(now)
+
+			for _, msg := range resend {
+				// [MQTT-4.4.0-1] publish is sent again with DUP set, PUBREL as is
+				if m, ok := msg.(*message.PublishMessage); ok {
+					m.SetDup(true)
+					traceRetransmit(m)
+				}
+
+				s.log.dev.Debug("Retransmit unacknowledged message",
+					zap.String("ClientID", s.config.id),
+					zap.Uint16("PacketID", msg.PacketID()))
+
+				if _, err := s.conn.writeMessage(msg); err != nil {
+					// connection is going down, message is persisted along with ack queue
+					return
+				}
+			}
+
+			for _, msg := range expired {
+				s.freePacketID(msg.PacketID())
+
+				s.log.prod.Warn("Message not acknowledged",
+					zap.String("ClientID", s.config.id),
+					zap.Uint16("PacketID", msg.PacketID()),
+					zap.String("type", msg.Type().Name()))
+
+				// released QoS 2 message has been received by client already
+				if m, ok := msg.(*message.PublishMessage); ok {
+					s.release(m)
+					s.drop(systree.DropRetriesExhausted)
+					s.undelivered(m, ErrRetriesExhausted)
+				}
+			}
+		}
+	}
 }
 
 // publishWorker publish messages coming from subscribed topics
@@ -420,7 +823,7 @@ func (s *Type) publishWorker() {
 			switch m := elem.Value.(type) {
 			case *message.PublishMessage:
 				if m.QoS() == message.QoS0 {
-					s.publisher.messages.Remove(elem)
+					s.publisher.remove(elem)
 				}
 			}
 		}
@@ -439,19 +842,21 @@ func (s *Type) publishWorker() {
 		}
 
 		s.publisher.cond.L.Lock()
-		for s.publisher.messages.Len() == 0 {
+		// wait for message to send and packet ID for it if all are in use
+		elem := s.nextMessage()
+		for elem == nil || !s.assignPacketID(elem.Value.(message.Provider)) {
 			s.publisher.cond.Wait()
 			if s.publisher.isDone() {
 				s.publisher.cond.L.Unlock()
 				return
 			}
+			elem = s.nextMessage()
 		}
 
 		var msg message.Provider
 
-		elem := s.publisher.messages.Front()
-		msg = elem.Value.(message.Provider)
-		s.publisher.messages.Remove(elem)
+		msg = s.publisher.remove(elem)
+		s.hold(msg)
 		s.publisher.cond.L.Unlock()
 
 		if msg != nil {
@@ -459,13 +864,12 @@ func (s *Type) publishWorker() {
 			case *message.PubRelMessage:
 				s.ack.pubOut.put(msg)
 			case *message.PublishMessage:
+				s.traceDeliver(m)
+
 				switch m.QoS() {
 				case message.QoS1:
 					fallthrough
 				case message.QoS2:
-					if m.PacketID() == 0 {
-						m.SetPacketID(s.newPacketID())
-					}
 					s.ack.pubOut.put(msg)
 				}
 			}
@@ -475,6 +879,8 @@ func (s *Type) publishWorker() {
 				case *message.PubRelMessage:
 					s.ack.pubOut.ack(msg) // nolint: errcheck
 				case *message.PublishMessage:
+					traceRequeued(m, err)
+
 					switch m.QoS() {
 					case message.QoS1:
 						fallthrough
@@ -486,10 +892,23 @@ func (s *Type) publishWorker() {
 
 				// Couldn't deliver message to client thus requeue it back
 				s.publisher.cond.L.Lock()
-				s.publisher.messages.PushBack(msg)
+				if s.config.strictOrdering {
+					s.publisher.pushFront(msg)
+				} else {
+					s.publisher.pushBack(msg)
+				}
 				s.publisher.cond.L.Unlock()
 				return
 			}
+
+			if m, ok := msg.(*message.PublishMessage); ok {
+				s.observeDelivery(m)
+
+				// QoS 1/2 deliveries end once acknowledged
+				if m.QoS() == message.QoS0 {
+					traceDelivered(m, nil)
+				}
+			}
 		}
 	}
 }
@@ -0,0 +1,99 @@
+package session
+
+import (
+	"context"
+	"errors"
+
+	"github.com/troian/surgemq/message"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errDeliveryInterrupted connection closed while message was in-flight
+var errDeliveryInterrupted = errors.New("session: delivery interrupted")
+
+// deliverKey context key of delivery span of message sent to client
+type deliverKey struct{}
+
+// deliverTrace delivery span and context it has been started within
+type deliverTrace struct {
+	parent context.Context
+	span   trace.Span
+}
+
+func (s *Type) traceAttrs(msg *message.PublishMessage) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String("mqtt.client_id", s.config.id),
+		attribute.String("mqtt.topic", msg.Topic()),
+		attribute.Int("mqtt.qos", int(msg.QoS())),
+	)
+}
+
+// traceReceive start span of PUBLISH received from client. Route and deliveries of
+// message to subscribers are traced within context message carries from now on
+func (s *Type) traceReceive(msg *message.PublishMessage) trace.Span {
+	ctx, span := s.config.tracer.Start(msg.Context(), "mqtt.publish.receive",
+		trace.WithSpanKind(trace.SpanKindServer), s.traceAttrs(msg))
+
+	msg.SetContext(ctx)
+
+	return span
+}
+
+// traceRoute start span of message handed to subscribers
+func (s *Type) traceRoute(msg *message.PublishMessage) trace.Span {
+	ctx, span := s.config.tracer.Start(msg.Context(), "mqtt.publish.route", s.traceAttrs(msg))
+
+	msg.SetContext(ctx)
+
+	return span
+}
+
+// traceDeliver start span of message sent to client. Span of QoS 0 message ends once
+// it is written, of QoS 1/2 one once acknowledged or given up, see traceDelivered
+func (s *Type) traceDeliver(msg *message.PublishMessage) {
+	if _, ok := msg.Context().Value(deliverKey{}).(*deliverTrace); ok {
+		return
+	}
+
+	parent := msg.Context()
+	ctx, span := s.config.tracer.Start(parent, "mqtt.publish.deliver",
+		trace.WithSpanKind(trace.SpanKindProducer), s.traceAttrs(msg))
+
+	span.SetAttributes(attribute.Int("mqtt.packet_id", int(msg.PacketID())))
+
+	msg.SetContext(context.WithValue(ctx, deliverKey{}, &deliverTrace{parent: parent, span: span}))
+}
+
+// traceRetransmit record retransmission within delivery span
+func traceRetransmit(msg *message.PublishMessage) {
+	if t, ok := msg.Context().Value(deliverKey{}).(*deliverTrace); ok {
+		t.span.AddEvent("retransmit")
+	}
+}
+
+// traceDelivered end delivery span of message. err is reason delivery failed if any
+func traceDelivered(msg *message.PublishMessage, err error) {
+	if t, ok := msg.Context().Value(deliverKey{}).(*deliverTrace); ok {
+		t.end(err)
+	}
+}
+
+// traceRequeued end delivery span of message put back into queue thus its next
+// attempt is traced as new delivery. Message must not be in-flight
+func traceRequeued(msg *message.PublishMessage, err error) {
+	if t, ok := msg.Context().Value(deliverKey{}).(*deliverTrace); ok {
+		t.end(err)
+		msg.SetContext(t.parent)
+	}
+}
+
+func (t *deliverTrace) end(err error) {
+	if err != nil {
+		t.span.RecordError(err)
+		t.span.SetStatus(codes.Error, err.Error())
+	}
+
+	t.span.End()
+}
@@ -4,6 +4,7 @@ import (
 	"sync"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 type config struct {
@@ -19,29 +20,56 @@ type config struct {
 type Options struct {
 	// LogWithTs either display timestamp messages on log or not
 	LogWithTs bool
+
+	// Logger base logger of broker, e.g. one of application or built on zapcore.Core
+	// bridging into another logging library. Entries are filtered by its level first
+	// If not set then production logger is built
+	Logger *zap.Logger
+
+	// LogLevel default level of subsystems. Zero value is info
+	LogLevel zapcore.Level
+
+	// LogLevels levels by subsystem, e.g. "session": zapcore.DebugLevel. See SetLogLevel
+	LogLevels map[string]zapcore.Level
 }
 
 var cfg config
 
 func init() {
+	// levels are enforced by subsystem levels
 	logCfg := zap.NewProductionConfig()
+	logCfg.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
 	logDebugCfg := zap.NewProductionConfig()
-	logDebugCfg.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+	logDebugCfg.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
 
 	log, _ := logCfg.Build()
 	dLog, _ := logDebugCfg.Build()
 
-	cfg.log.Prod = log.Named("mqtt")
-	cfg.log.Dev = dLog.Named("mqtt")
+	cfg.log.Prod = withLevels(log)
+	cfg.log.Dev = withLevels(dLog)
 }
 
 // Init global MQTT config with given options
 // if not being called default set by init() is used
 func Init(ops Options) {
 	cfg.once.Do(func() {
+		setLevels(func(bySubsystem map[string]zapcore.Level) {
+			for k, v := range ops.LogLevels {
+				bySubsystem[k] = v
+			}
+			bySubsystem[""] = ops.LogLevel
+		})
+
+		if ops.Logger != nil {
+			cfg.log.Prod = withLevels(ops.Logger)
+			cfg.log.Dev = cfg.log.Prod
+			return
+		}
+
 		logCfg := zap.NewProductionConfig()
+		logCfg.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
 		logDebugCfg := zap.NewDevelopmentConfig()
-		logDebugCfg.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+		logDebugCfg.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
 
 		if !ops.LogWithTs {
 			logCfg.EncoderConfig.TimeKey = ""
@@ -50,8 +78,8 @@ func Init(ops Options) {
 
 		log, _ := logCfg.Build()
 		dLog, _ := logDebugCfg.Build()
-		cfg.log.Prod = log.Named("mqtt")
-		cfg.log.Dev = dLog.Named("mqtt")
+		cfg.log.Prod = withLevels(log)
+		cfg.log.Dev = withLevels(dLog)
 	})
 }
 
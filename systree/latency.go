@@ -0,0 +1,57 @@
+package systree
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyStat latencies of message flow within broker
+type LatencyStat interface {
+	// Delivery time from PUBLISH received from client until copy written to subscriber
+	Delivery(d time.Duration)
+
+	// AckRoundTrip time from message sent to client until acknowledged
+	AckRoundTrip(d time.Duration)
+
+	// PersistenceWrite duration of write of messages into persistence or in-flight log
+	PersistenceWrite(d time.Duration)
+}
+
+// latencyBuckets upper bounds in seconds of latency histograms
+var latencyBuckets = [...]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram of durations, last bucket is +Inf
+type histogram struct {
+	buckets [len(latencyBuckets) + 1]uint64
+	sum     int64
+}
+
+type latencyStat struct {
+	delivery histogram
+	ack      histogram
+	persist  histogram
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return latencyBuckets[i] >= s })
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// Delivery account delivery latency
+func (t *latencyStat) Delivery(d time.Duration) {
+	t.delivery.observe(d)
+}
+
+// AckRoundTrip account ack round-trip time
+func (t *latencyStat) AckRoundTrip(d time.Duration) {
+	t.ack.observe(d)
+}
+
+// PersistenceWrite account persistence write latency
+func (t *latencyStat) PersistenceWrite(d time.Duration) {
+	t.persist.observe(d)
+}
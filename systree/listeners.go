@@ -0,0 +1,134 @@
+package systree
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/troian/surgemq/message"
+)
+
+// ListenerStat traffic of connections served by single listener
+type ListenerStat interface {
+	// Bytes metric of listener connections. Bytes are accounted into broker wide metric as well
+	Bytes() BytesMetric
+
+	// Publish PUBLISH packets of listener connections by QoS
+	Publish() PublishMetric
+
+	// Opened account new connection
+	Opened()
+
+	// Closed account connection gone
+	Closed()
+}
+
+// PublishMetric PUBLISH packets by QoS
+type PublishMetric interface {
+	Sent(qos message.QosType)
+	Received(qos message.QosType)
+}
+
+type publishMetric struct {
+	sent     [3]uint64
+	received [3]uint64
+}
+
+type listenerBytes struct {
+	bytesMetric
+	broker *bytesMetric
+}
+
+type listenerStat struct {
+	name    string
+	bytes   listenerBytes
+	publish publishMetric
+
+	conns struct {
+		curr  int64
+		total uint64
+	}
+}
+
+type listenersStat struct {
+	lock sync.Mutex
+	list map[string]*listenerStat
+}
+
+// Listener get stat of listener by name, e.g. its address. Stat is created on first use
+func (t *impl) Listener(name string) ListenerStat {
+	t.listeners.lock.Lock()
+	defer t.listeners.lock.Unlock()
+
+	l, ok := t.listeners.list[name]
+	if !ok {
+		l = &listenerStat{name: name}
+		l.bytes.broker = &t.metrics.bytes
+		t.listeners.list[name] = l
+	}
+
+	return l
+}
+
+// all listeners ordered by name
+func (t *listenersStat) all() []*listenerStat {
+	t.lock.Lock()
+	res := make([]*listenerStat, 0, len(t.list))
+	for _, l := range t.list {
+		res = append(res, l)
+	}
+	t.lock.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].name < res[j].name
+	})
+
+	return res
+}
+
+// Bytes get bytes metric of listener
+func (t *listenerStat) Bytes() BytesMetric {
+	return &t.bytes
+}
+
+// Publish get publish metric of listener
+func (t *listenerStat) Publish() PublishMetric {
+	return &t.publish
+}
+
+// Opened account new connection
+func (t *listenerStat) Opened() {
+	atomic.AddInt64(&t.conns.curr, 1)
+	atomic.AddUint64(&t.conns.total, 1)
+}
+
+// Closed account connection gone
+func (t *listenerStat) Closed() {
+	atomic.AddInt64(&t.conns.curr, -1)
+}
+
+// Sent add sent bytes to listener and broker statistic
+func (t *listenerBytes) Sent(bytes uint64) {
+	t.bytesMetric.Sent(bytes)
+	t.broker.Sent(bytes)
+}
+
+// Received add received bytes to listener and broker statistic
+func (t *listenerBytes) Received(bytes uint64) {
+	t.bytesMetric.Received(bytes)
+	t.broker.Received(bytes)
+}
+
+// Sent add sent PUBLISH to statistic
+func (t *publishMetric) Sent(qos message.QosType) {
+	if int(qos) < len(t.sent) {
+		atomic.AddUint64(&t.sent[qos], 1)
+	}
+}
+
+// Received add received PUBLISH to statistic
+func (t *publishMetric) Received(qos message.QosType) {
+	if int(qos) < len(t.received) {
+		atomic.AddUint64(&t.received[qos], 1)
+	}
+}
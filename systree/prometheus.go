@@ -0,0 +1,178 @@
+package systree
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// promPrefix of exported metric names
+const promPrefix = "surgemq_"
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promWriter Prometheus text format writer keeping first error
+type promWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (p *promWriter) write(parts ...string) {
+	for _, s := range parts {
+		if p.err != nil {
+			return
+		}
+		_, p.err = p.w.WriteString(s)
+	}
+}
+
+// family write HELP and TYPE lines of metric
+func (p *promWriter) family(name, typ, help string) {
+	p.write("# HELP ", promPrefix, name, " ", help, "\n", "# TYPE ", promPrefix, name, " ", typ, "\n")
+}
+
+// sample write value of metric. labels are pairs of name and value
+func (p *promWriter) sample(name string, value string, labels ...string) {
+	p.write(promPrefix, name)
+	if len(labels) > 0 {
+		p.write("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.write(",")
+			}
+			p.write(labels[i], `="`, promEscaper.Replace(labels[i+1]), `"`)
+		}
+		p.write("}")
+	}
+	p.write(" ", value, "\n")
+}
+
+func (p *promWriter) sampleUint(name string, value uint64, labels ...string) {
+	p.sample(name, strconv.FormatUint(value, 10), labels...)
+}
+
+func (p *promWriter) sampleInt(name string, value int64, labels ...string) {
+	p.sample(name, strconv.FormatInt(value, 10), labels...)
+}
+
+// histogram write latency histogram in seconds
+func (p *promWriter) histogram(name, help string, h *histogram) {
+	p.family(name, "histogram", help)
+
+	var cumulative uint64
+	for i, le := range latencyBuckets {
+		cumulative += atomic.LoadUint64(&h.buckets[i])
+		p.sampleUint(name+"_bucket", cumulative, "le", strconv.FormatFloat(le, 'g', -1, 64))
+	}
+	cumulative += atomic.LoadUint64(&h.buckets[len(latencyBuckets)])
+	p.sampleUint(name+"_bucket", cumulative, "le", "+Inf")
+
+	sum := time.Duration(atomic.LoadInt64(&h.sum)).Seconds()
+	p.sample(name+"_sum", strconv.FormatFloat(sum, 'g', -1, 64))
+	p.sampleUint(name+"_count", cumulative)
+}
+
+// WritePrometheus write current values in Prometheus text exposition format
+// Connections, bytes and PUBLISH packets are labeled by listener they are served by
+func (t *impl) WritePrometheus(w io.Writer) error {
+	p := &promWriter{w: bufio.NewWriter(w)}
+
+	p.family("uptime_seconds", "gauge", "Seconds since broker started")
+	p.sample("uptime_seconds", strconv.FormatFloat(time.Since(t.started).Seconds(), 'f', 0, 64))
+
+	p.family("clients_connected", "gauge", "Clients currently connected")
+	p.sampleUint("clients_connected", atomic.LoadUint64(&t.session.clients.curr))
+
+	p.family("clients_maximum", "gauge", "Maximum of simultaneously connected clients")
+	p.sampleUint("clients_maximum", atomic.LoadUint64(&t.session.clients.max))
+
+	listeners := t.listeners.all()
+
+	p.family("connections", "gauge", "Network connections currently served")
+	for _, l := range listeners {
+		p.sampleInt("connections", atomic.LoadInt64(&l.conns.curr), "listener", l.name)
+	}
+
+	p.family("connections_total", "counter", "Network connections accepted")
+	for _, l := range listeners {
+		p.sampleUint("connections_total", atomic.LoadUint64(&l.conns.total), "listener", l.name)
+	}
+
+	p.family("connections_rejected_total", "counter", "CONNECT refused as connection limit is reached")
+	p.sampleUint("connections_rejected_total", atomic.LoadUint64(&t.conns.rejected))
+
+	p.family("bytes_received_total", "counter", "Bytes received from clients")
+	for _, l := range listeners {
+		p.sampleUint("bytes_received_total", atomic.LoadUint64(&l.bytes.received), "listener", l.name)
+	}
+
+	p.family("bytes_sent_total", "counter", "Bytes sent to clients")
+	for _, l := range listeners {
+		p.sampleUint("bytes_sent_total", atomic.LoadUint64(&l.bytes.sent), "listener", l.name)
+	}
+
+	p.family("messages_received_total", "counter", "PUBLISH packets received from clients")
+	for _, l := range listeners {
+		for qos := range l.publish.received {
+			p.sampleUint("messages_received_total", atomic.LoadUint64(&l.publish.received[qos]),
+				"listener", l.name, "qos", strconv.Itoa(qos))
+		}
+	}
+
+	p.family("messages_sent_total", "counter", "PUBLISH packets sent to clients")
+	for _, l := range listeners {
+		for qos := range l.publish.sent {
+			p.sampleUint("messages_sent_total", atomic.LoadUint64(&l.publish.sent[qos]),
+				"listener", l.name, "qos", strconv.Itoa(qos))
+		}
+	}
+
+	p.family("messages_dropped_total", "counter", "Messages dropped before delivery")
+	p.sampleUint("messages_dropped_total", atomic.LoadUint64(&t.conns.dropped), "reason", "slow_client")
+
+	p.family("retained_messages", "gauge", "Retained messages stored")
+	p.sampleUint("retained_messages", atomic.LoadUint64(&t.topics.curr))
+
+	p.family("subscriptions", "gauge", "Active subscriptions")
+	p.sampleUint("subscriptions", t.subs.count())
+
+	p.family("publish_fanout", "histogram", "Subscribers message has been delivered to")
+	var cumulative uint64
+	for i, le := range fanOutBuckets {
+		cumulative += atomic.LoadUint64(&t.subs.fanOut.buckets[i])
+		p.sampleUint("publish_fanout_bucket", cumulative, "le", strconv.FormatUint(le, 10))
+	}
+	cumulative += atomic.LoadUint64(&t.subs.fanOut.buckets[len(fanOutBuckets)])
+	p.sampleUint("publish_fanout_bucket", cumulative, "le", "+Inf")
+	p.sampleUint("publish_fanout_sum", atomic.LoadUint64(&t.subs.fanOut.deliveries))
+	p.sampleUint("publish_fanout_count", cumulative)
+
+	p.histogram("delivery_latency_seconds", "Time from PUBLISH received until written to subscriber", &t.latency.delivery)
+	p.histogram("ack_roundtrip_seconds", "Time from message sent to client until acknowledged", &t.latency.ack)
+	p.histogram("persistence_write_seconds", "Duration of writes into persistence and in-flight log", &t.latency.persist)
+
+	p.family("alarms_active", "gauge", "Alarms currently raised")
+	p.sampleInt("alarms_active", int64(len(t.alarms.Active())))
+
+	p.family("violations_total", "counter", "Protocol violations of clients")
+	for _, v := range t.viols.counts() {
+		p.sample("violations_total", v.Value, "kind", v.Topic)
+	}
+
+	p.family("messages_dropped_total", "counter", "Messages dropped instead of delivered by cause")
+	for c, v := range t.drops.counts() {
+		p.sampleUint("messages_dropped_total", v, "cause", strings.Replace(DropCause(c).String(), " ", "_", -1))
+	}
+
+	p.family("auth_failures_total", "counter", "CONNECT rejected for bad credentials")
+	p.sampleUint("auth_failures_total", atomic.LoadUint64(&t.auth.failed))
+
+	if p.err == nil {
+		p.err = p.w.Flush()
+	}
+
+	return p.err
+}
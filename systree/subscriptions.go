@@ -0,0 +1,97 @@
+package systree
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+type subscriptionsStat struct {
+	lock    sync.Mutex
+	filters map[string]uint64
+	total   uint64
+
+	fanOut struct {
+		messages   uint64
+		deliveries uint64
+		max        uint64
+
+		// buckets counts of messages by fanOutBuckets upper bounds, last one is +Inf
+		buckets [len(fanOutBuckets) + 1]uint64
+	}
+}
+
+// fanOutBuckets upper bounds of subscribers per message histogram
+var fanOutBuckets = [...]uint64{0, 1, 2, 5, 10, 25, 50, 100, 250, 1000}
+
+// Subscribed add subscriber of filter to statistic
+func (t *subscriptionsStat) Subscribed(filter string) {
+	t.lock.Lock()
+	t.filters[filter]++
+	t.total++
+	t.lock.Unlock()
+}
+
+// UnSubscribed remove subscriber of filter from statistic
+func (t *subscriptionsStat) UnSubscribed(filter string) {
+	t.lock.Lock()
+	if n, ok := t.filters[filter]; ok {
+		if n <= 1 {
+			delete(t.filters, filter)
+		} else {
+			t.filters[filter] = n - 1
+		}
+		t.total--
+	}
+	t.lock.Unlock()
+}
+
+// FanOut add published message to statistic
+func (t *subscriptionsStat) FanOut(subscribers int) {
+	n := uint64(subscribers)
+
+	atomic.AddUint64(&t.fanOut.messages, 1)
+	atomic.AddUint64(&t.fanOut.deliveries, n)
+
+	i := sort.Search(len(fanOutBuckets), func(i int) bool { return fanOutBuckets[i] >= n })
+	atomic.AddUint64(&t.fanOut.buckets[i], 1)
+
+	for {
+		max := atomic.LoadUint64(&t.fanOut.max)
+		if n <= max || atomic.CompareAndSwapUint64(&t.fanOut.max, max, n) {
+			return
+		}
+	}
+}
+
+// Filters subscriber counts ordered by amount of subscribers
+func (t *subscriptionsStat) Filters(limit int) []FilterCount {
+	t.lock.Lock()
+	res := make([]FilterCount, 0, len(t.filters))
+	for f, n := range t.filters {
+		res = append(res, FilterCount{Filter: f, Subscribers: n})
+	}
+	t.lock.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Subscribers != res[j].Subscribers {
+			return res[i].Subscribers > res[j].Subscribers
+		}
+
+		return res[i].Filter < res[j].Filter
+	})
+
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+
+	return res
+}
+
+// count amount of subscriptions
+func (t *subscriptionsStat) count() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.total
+}
@@ -0,0 +1,225 @@
+package systree
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry value of single $SYS topic
+type Entry struct {
+	Topic string
+	Value string
+}
+
+// sysPrefix of broker statistics topics
+const sysPrefix = "$SYS/broker/"
+
+// periods of load averages in minutes
+var loadPeriods = []struct {
+	name    string
+	minutes float64
+}{
+	{"1min", 1},
+	{"5min", 5},
+	{"15min", 15},
+}
+
+// load exponentially weighted per minute rate of counter
+type load struct {
+	last uint64
+	avg  []float64
+}
+
+type loads struct {
+	lock   sync.Mutex
+	last   time.Time
+	values map[string]*load
+}
+
+// counter cumulative value load averages are computed of
+type counter struct {
+	name string
+	val  uint64
+}
+
+func (t *impl) counters() []counter {
+	return []counter{
+		{"messages/received", atomic.LoadUint64(&t.metrics.packets.total.received)},
+		{"messages/sent", atomic.LoadUint64(&t.metrics.packets.total.sent)},
+		{"publish/messages/received", atomic.LoadUint64(&t.metrics.packets.publish.received)},
+		{"publish/messages/sent", atomic.LoadUint64(&t.metrics.packets.publish.sent)},
+		{"bytes/received", atomic.LoadUint64(&t.metrics.bytes.received)},
+		{"bytes/sent", atomic.LoadUint64(&t.metrics.bytes.sent)},
+		{"connections", atomic.LoadUint64(&t.metrics.packets.connect.received)},
+	}
+}
+
+// updateLoads advance load averages of counters to now. Returns averages of every
+// counter in order of loadPeriods
+func (t *impl) updateLoads(now time.Time, counters []counter) map[string][]float64 {
+	t.loads.lock.Lock()
+	defer t.loads.lock.Unlock()
+
+	elapsed := now.Sub(t.loads.last).Minutes()
+	if t.loads.last.IsZero() {
+		elapsed = 0
+	}
+	t.loads.last = now
+
+	res := make(map[string][]float64, len(counters))
+
+	for _, c := range counters {
+		l, ok := t.loads.values[c.name]
+		if !ok {
+			l = &load{last: c.val, avg: make([]float64, len(loadPeriods))}
+			t.loads.values[c.name] = l
+		}
+
+		if elapsed > 0 {
+			rate := float64(c.val-l.last) / elapsed
+			for i, p := range loadPeriods {
+				l.avg[i] = rate + math.Exp(-elapsed/p.minutes)*(l.avg[i]-rate)
+			}
+		}
+		l.last = c.val
+
+		res[c.name] = append([]float64(nil), l.avg...)
+	}
+
+	return res
+}
+
+// Snapshot counters, gauges and load averages of broker at a point in time
+type Snapshot struct {
+	Uptime time.Duration
+
+	ClientsConnected uint64
+	ClientsMaximum   uint64
+	Connections      int64
+	Retained         uint64
+	Subscriptions    uint64
+
+	// Totals cumulative counters by name of their $SYS topic without prefix,
+	// e.g. "publish/messages/received"
+	Totals map[string]uint64
+
+	// Rates per minute of Totals averaged over last 1, 5 and 15 minutes
+	Rates map[string]Rates
+
+	// Dropped messages by cause, e.g. "queue full"
+	Dropped map[string]uint64
+
+	// Alarms currently raised
+	Alarms []string
+}
+
+// Rates per minute rate of counter averaged over last 1, 5 and 15 minutes
+type Rates struct {
+	Min1  float64 `json:"1min"`
+	Min5  float64 `json:"5min"`
+	Min15 float64 `json:"15min"`
+}
+
+// Snapshot current values. Load averages are updated as by Entries
+func (t *impl) Snapshot() Snapshot {
+	now := time.Now()
+	counters := t.counters()
+
+	s := Snapshot{
+		Uptime:           now.Sub(t.started),
+		ClientsConnected: atomic.LoadUint64(&t.session.clients.curr),
+		ClientsMaximum:   atomic.LoadUint64(&t.session.clients.max),
+		Connections:      atomic.LoadInt64(&t.conns.curr),
+		Retained:         atomic.LoadUint64(&t.topics.curr),
+		Subscriptions:    t.subs.count(),
+		Totals:           make(map[string]uint64, len(counters)),
+		Rates:            make(map[string]Rates, len(counters)),
+		Dropped:          make(map[string]uint64, dropCauses),
+		Alarms:           t.alarms.Active(),
+	}
+
+	for c, v := range t.drops.counts() {
+		s.Dropped[DropCause(c).String()] = v
+	}
+
+	rates := t.updateLoads(now, counters)
+
+	for _, c := range counters {
+		s.Totals[c.name] = c.val
+		s.Rates[c.name] = Rates{Min1: rates[c.name][0], Min5: rates[c.name][1], Min15: rates[c.name][2]}
+	}
+
+	return s
+}
+
+// Entries current values of $SYS topics
+func (t *impl) Entries() []Entry {
+	now := time.Now()
+
+	counters := t.counters()
+
+	res := []Entry{
+		{sysPrefix + "version", "surgemq"},
+		{sysPrefix + "uptime", strconv.FormatInt(int64(now.Sub(t.started).Seconds()), 10) + " seconds"},
+		{sysPrefix + "clients/connected", strconv.FormatUint(atomic.LoadUint64(&t.session.clients.curr), 10)},
+		{sysPrefix + "clients/maximum", strconv.FormatUint(atomic.LoadUint64(&t.session.clients.max), 10)},
+		{sysPrefix + "retained messages/count", strconv.FormatUint(atomic.LoadUint64(&t.topics.curr), 10)},
+		{sysPrefix + "subscriptions/count", strconv.FormatUint(t.subs.count(), 10)},
+		{sysPrefix + "publish/fanout/maximum", strconv.FormatUint(atomic.LoadUint64(&t.subs.fanOut.max), 10)},
+		{sysPrefix + "auth/failures", strconv.FormatUint(atomic.LoadUint64(&t.auth.failed), 10)},
+		{sysPrefix + "auth/throttled", strconv.FormatUint(atomic.LoadUint64(&t.auth.throttled), 10)},
+		{sysPrefix + "auth/lockouts", strconv.FormatUint(atomic.LoadUint64(&t.auth.lockouts), 10)},
+		{sysPrefix + "connections/current", strconv.FormatInt(atomic.LoadInt64(&t.conns.curr), 10)},
+		{sysPrefix + "connections/limit", strconv.FormatInt(atomic.LoadInt64(&t.conns.limit), 10)},
+		{sysPrefix + "connections/limit per ip", strconv.FormatInt(atomic.LoadInt64(&t.conns.perIP), 10)},
+		{sysPrefix + "connections/rejected", strconv.FormatUint(atomic.LoadUint64(&t.conns.rejected), 10)},
+		{sysPrefix + "connections/keepalive expired", strconv.FormatUint(atomic.LoadUint64(&t.conns.expired), 10)},
+		{sysPrefix + "connections/slow clients", strconv.FormatUint(atomic.LoadUint64(&t.conns.slow), 10)},
+		{sysPrefix + "connections/slow dropped", strconv.FormatUint(atomic.LoadUint64(&t.conns.dropped), 10)},
+	}
+
+	alarms := t.alarms.Active()
+	res = append(res,
+		Entry{sysPrefix + "alarms/count", strconv.Itoa(len(alarms))},
+		Entry{sysPrefix + "alarms/active", strings.Join(alarms, ",")})
+
+	for _, v := range t.viols.counts() {
+		res = append(res, Entry{sysPrefix + "violations/" + v.Topic, v.Value})
+	}
+
+	var dropped uint64
+	for c, v := range t.drops.counts() {
+		dropped += v
+		res = append(res, Entry{sysPrefix + "messages/dropped/" + DropCause(c).String(), strconv.FormatUint(v, 10)})
+	}
+	res = append(res, Entry{sysPrefix + "messages/dropped", strconv.FormatUint(dropped, 10)})
+
+	if msgs := atomic.LoadUint64(&t.subs.fanOut.messages); msgs > 0 {
+		avg := float64(atomic.LoadUint64(&t.subs.fanOut.deliveries)) / float64(msgs)
+		res = append(res, Entry{sysPrefix + "publish/fanout/average", strconv.FormatFloat(avg, 'f', 2, 64)})
+	}
+
+	for _, c := range counters {
+		// connections are reported as load only
+		if c.name != "connections" {
+			res = append(res, Entry{sysPrefix + c.name, strconv.FormatUint(c.val, 10)})
+		}
+	}
+
+	rates := t.updateLoads(now, counters)
+
+	for _, c := range counters {
+		for i, p := range loadPeriods {
+			res = append(res, Entry{
+				Topic: sysPrefix + "load/" + c.name + "/" + p.name,
+				Value: strconv.FormatFloat(rates[c.name][i], 'f', 2, 64),
+			})
+		}
+	}
+
+	return res
+}
@@ -1,8 +1,13 @@
 package systree
 
 import (
+	"io"
 	"math"
+	"sort"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/troian/surgemq/message"
 )
@@ -13,6 +18,28 @@ type Provider interface {
 	Topics() TopicsStat
 	Session() SessionStat
 	Sessions() SessionsStat
+	Alarms() AlarmsStat
+	Persistence() PersistenceStat
+	Subscriptions() SubscriptionsStat
+	Auth() AuthStat
+	Connections() ConnectionsStat
+	Violations() ViolationsStat
+	Drops() DropsStat
+
+	// Listener traffic stat of listener by name, e.g. its address
+	Listener(name string) ListenerStat
+
+	Latency() LatencyStat
+
+	// Entries current values of $SYS topics. Load averages are updated on every call
+	// thus it is expected to be invoked periodically by single caller
+	Entries() []Entry
+
+	// Snapshot current values for inspection. Load averages are updated as by Entries
+	Snapshot() Snapshot
+
+	// WritePrometheus write current values in Prometheus text exposition format
+	WritePrometheus(w io.Writer) error
 }
 
 // Metric is wrap around all of metrics
@@ -53,6 +80,170 @@ type SessionStat interface {
 	UnSubscribed()
 }
 
+// AlarmsStat conditions raised by broker components, e.g. unreachable persistence
+// Raise and Clear report whether state of alarm changed
+type AlarmsStat interface {
+	Raise(name string) bool
+	Clear(name string) bool
+	Active() []string
+}
+
+// SubscriptionsStat subscribers per filter and fan-out of published messages
+type SubscriptionsStat interface {
+	Subscribed(filter string)
+	UnSubscribed(filter string)
+
+	// FanOut account message published to given amount of subscribers
+	FanOut(subscribers int)
+
+	// Filters subscriber counts ordered by amount of subscribers. limit <= 0 returns all
+	Filters(limit int) []FilterCount
+}
+
+// FilterCount amount of subscribers of filter
+type FilterCount struct {
+	Filter      string
+	Subscribers uint64
+}
+
+// AuthStat statistic of failed authentication and its throttling
+type AuthStat interface {
+	// Failed CONNECT rejected for bad credentials
+	Failed()
+
+	// Throttled CONNECT refused without credentials check as source is backing off
+	Throttled()
+
+	// LockedOut client id or address blocked after repeated failures
+	LockedOut()
+}
+
+// ConnectionsStat network connections served by broker and their limits
+type ConnectionsStat interface {
+	// Limits configured. 0 means unlimited
+	Limits(total, perIP int)
+
+	// Opened connection counted against limits
+	Opened()
+
+	// Closed connection released from limits
+	Closed()
+
+	// Rejected CONNECT refused as limit is reached
+	Rejected()
+
+	// KeepAliveExpired connection closed as no packet received within 1.5 keep-alive
+	KeepAliveExpired()
+
+	// SlowClient connection closed as write buffer stayed full
+	SlowClient()
+
+	// SlowDropped QoS 0 message dropped as write buffer was full
+	SlowDropped()
+}
+
+// ViolationsStat protocol violations of clients by kind
+type ViolationsStat interface {
+	Violation(kind string)
+}
+
+// DropCause reason message has been dropped instead of delivered
+type DropCause int
+
+// Causes messages are dropped for
+const (
+	// DropQueueFull queue limits of session reached
+	DropQueueFull DropCause = iota
+
+	// DropExpired removed from persistence by garbage collection before delivery
+	DropExpired
+
+	// DropNoSubscribers published to topic without subscribers. Retained copy, if any,
+	// is still kept for future subscribers
+	DropNoSubscribers
+
+	// DropACLDenied publish of client denied by ACL
+	DropACLDenied
+
+	// DropOversized payload alone exceeds byte limit of session queue
+	DropOversized
+
+	// DropSlowConsumer QoS 0 message dropped as write buffer of client was full
+	DropSlowConsumer
+
+	// DropRetriesExhausted QoS 1/2 message not acknowledged within retries
+	DropRetriesExhausted
+
+	dropCauses
+)
+
+var dropCauseNames = [dropCauses]string{
+	"queue full",
+	"expired",
+	"no subscribers",
+	"acl denied",
+	"oversized",
+	"slow consumer",
+	"retries exhausted",
+}
+
+func (c DropCause) String() string {
+	if c < 0 || c >= dropCauses {
+		return "unknown"
+	}
+
+	return dropCauseNames[c]
+}
+
+// DropsStat messages dropped by cause
+type DropsStat interface {
+	Dropped(cause DropCause)
+}
+
+// PersistenceStat statistic of persisted state reclaimed by garbage collection
+type PersistenceStat interface {
+	Collected(sessions, messages, retained, bytes uint64)
+}
+
+type persistenceStat struct {
+	collected struct {
+		sessions uint64
+		messages uint64
+		retained uint64
+		bytes    uint64
+	}
+}
+
+type connectionsStat struct {
+	curr     int64
+	limit    int64
+	perIP    int64
+	rejected uint64
+	expired  uint64
+	slow     uint64
+	dropped  uint64
+}
+
+type violationsStat struct {
+	lock  sync.Mutex
+	kinds map[string]uint64
+}
+
+type dropsStat struct {
+	causes [dropCauses]uint64
+}
+
+type authStat struct {
+	failed    uint64
+	throttled uint64
+	lockouts  uint64
+}
+
+type alarmsStat struct {
+	lock   sync.Mutex
+	active map[string]struct{}
+}
+
 type sessionsStat struct {
 	curr uint64
 	max  uint64
@@ -139,11 +330,31 @@ type impl struct {
 	topics   topicsStat
 	session  sessionStat
 	sessions sessionsStat
+	alarms   alarmsStat
+	persist  persistenceStat
+	subs     subscriptionsStat
+	auth     authStat
+	conns    connectionsStat
+	viols    violationsStat
+	drops    dropsStat
+
+	listeners listenersStat
+	latency   latencyStat
+
+	started time.Time
+	loads   loads
 }
 
 // NewTree allocate systree provider
 func NewTree() (Provider, error) {
-	tr := &impl{}
+	tr := &impl{
+		started: time.Now(),
+	}
+	tr.alarms.active = make(map[string]struct{})
+	tr.subs.filters = make(map[string]uint64)
+	tr.viols.kinds = make(map[string]uint64)
+	tr.listeners.list = make(map[string]*listenerStat)
+	tr.loads.values = make(map[string]*load)
 
 	return tr, nil
 }
@@ -163,6 +374,46 @@ func (t *impl) Topics() TopicsStat {
 	return &t.topics
 }
 
+// Alarms get alarms provider
+func (t *impl) Alarms() AlarmsStat {
+	return &t.alarms
+}
+
+// Persistence get persistence stat provider
+func (t *impl) Persistence() PersistenceStat {
+	return &t.persist
+}
+
+// Subscriptions get subscriptions stat provider
+func (t *impl) Subscriptions() SubscriptionsStat {
+	return &t.subs
+}
+
+// Auth get authentication stat provider
+func (t *impl) Auth() AuthStat {
+	return &t.auth
+}
+
+// Connections get connections stat provider
+func (t *impl) Connections() ConnectionsStat {
+	return &t.conns
+}
+
+// Latency get latency stat provider
+func (t *impl) Latency() LatencyStat {
+	return &t.latency
+}
+
+// Violations get protocol violations stat provider
+func (t *impl) Violations() ViolationsStat {
+	return &t.viols
+}
+
+// Drops get dropped messages stat provider
+func (t *impl) Drops() DropsStat {
+	return &t.drops
+}
+
 // Metric get metric provider
 func (t *impl) Metric() Metric {
 	return &t.metrics
@@ -293,3 +544,145 @@ func (t *packetsMetric) Received(mt message.Type) {
 		atomic.AddUint64(&t.disconnect.received, 1)
 	}
 }
+
+// Collected add reclaimed state to statistic
+func (t *persistenceStat) Collected(sessions, messages, retained, bytes uint64) {
+	atomic.AddUint64(&t.collected.sessions, sessions)
+	atomic.AddUint64(&t.collected.messages, messages)
+	atomic.AddUint64(&t.collected.retained, retained)
+	atomic.AddUint64(&t.collected.bytes, bytes)
+}
+
+// Failed account rejected credentials
+func (t *authStat) Failed() {
+	atomic.AddUint64(&t.failed, 1)
+}
+
+// Throttled account CONNECT refused while backing off
+func (t *authStat) Throttled() {
+	atomic.AddUint64(&t.throttled, 1)
+}
+
+// LockedOut account blocked client id or address
+func (t *authStat) LockedOut() {
+	atomic.AddUint64(&t.lockouts, 1)
+}
+
+// Limits set connection limits
+func (t *connectionsStat) Limits(total, perIP int) {
+	atomic.StoreInt64(&t.limit, int64(total))
+	atomic.StoreInt64(&t.perIP, int64(perIP))
+}
+
+// Opened account new connection
+func (t *connectionsStat) Opened() {
+	atomic.AddInt64(&t.curr, 1)
+}
+
+// Closed account connection gone
+func (t *connectionsStat) Closed() {
+	atomic.AddInt64(&t.curr, -1)
+}
+
+// Rejected account connection refused by limits
+func (t *connectionsStat) Rejected() {
+	atomic.AddUint64(&t.rejected, 1)
+}
+
+// KeepAliveExpired account connection closed by keep-alive
+func (t *connectionsStat) KeepAliveExpired() {
+	atomic.AddUint64(&t.expired, 1)
+}
+
+// SlowClient account connection of slow client closed
+func (t *connectionsStat) SlowClient() {
+	atomic.AddUint64(&t.slow, 1)
+}
+
+// SlowDropped account message dropped for slow client
+func (t *connectionsStat) SlowDropped() {
+	atomic.AddUint64(&t.dropped, 1)
+}
+
+// Violation account protocol violation of given kind
+func (t *violationsStat) Violation(kind string) {
+	t.lock.Lock()
+	t.kinds[kind]++
+	t.lock.Unlock()
+}
+
+// Dropped account message dropped for cause
+func (t *dropsStat) Dropped(cause DropCause) {
+	if cause >= 0 && cause < dropCauses {
+		atomic.AddUint64(&t.causes[cause], 1)
+	}
+}
+
+// counts of dropped messages by cause in order of causes
+func (t *dropsStat) counts() [dropCauses]uint64 {
+	var res [dropCauses]uint64
+	for i := range res {
+		res[i] = atomic.LoadUint64(&t.causes[i])
+	}
+
+	return res
+}
+
+// counts of violations by kind ordered by kind
+func (t *violationsStat) counts() []Entry {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	res := make([]Entry, 0, len(t.kinds))
+	for k, v := range t.kinds {
+		res = append(res, Entry{Topic: k, Value: strconv.FormatUint(v, 10)})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Topic < res[j].Topic
+	})
+
+	return res
+}
+
+// Raise alarm. Raising active alarm has no effect and returns false
+func (t *alarmsStat) Raise(name string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.active[name]; ok {
+		return false
+	}
+
+	t.active[name] = struct{}{}
+
+	return true
+}
+
+// Clear alarm. Returns false if alarm is not active
+func (t *alarmsStat) Clear(name string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.active[name]; !ok {
+		return false
+	}
+
+	delete(t.active, name)
+
+	return true
+}
+
+// Active alarms sorted by name
+func (t *alarmsStat) Active() []string {
+	t.lock.Lock()
+	res := make([]string, 0, len(t.active))
+	for name := range t.active {
+		res = append(res, name)
+	}
+	t.lock.Unlock()
+
+	sort.Strings(res)
+
+	return res
+}
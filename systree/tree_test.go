@@ -0,0 +1,125 @@
+package systree
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troian/surgemq/message"
+)
+
+func newTree(t *testing.T) Provider {
+	tr, err := NewTree()
+	require.NoError(t, err)
+
+	return tr
+}
+
+// entries of provider by topic
+func entries(p Provider) map[string]string {
+	res := make(map[string]string)
+	for _, e := range p.Entries() {
+		res[e.Topic] = e.Value
+	}
+
+	return res
+}
+
+func TestAlarms(t *testing.T) {
+	tr := newTree(t)
+	a := tr.Alarms()
+
+	require.Empty(t, a.Active())
+
+	require.True(t, a.Raise("persistence"))
+	require.False(t, a.Raise("persistence"))
+	require.True(t, a.Raise("bridge"))
+	require.Equal(t, []string{"bridge", "persistence"}, a.Active())
+
+	e := entries(tr)
+	require.Equal(t, "2", e[sysPrefix+"alarms/count"])
+	require.Equal(t, "bridge,persistence", e[sysPrefix+"alarms/active"])
+	require.Equal(t, []string{"bridge", "persistence"}, tr.Snapshot().Alarms)
+
+	require.True(t, a.Clear("bridge"))
+	require.False(t, a.Clear("bridge"))
+	require.False(t, a.Clear("unknown"))
+	require.Equal(t, []string{"persistence"}, a.Active())
+
+	require.True(t, a.Clear("persistence"))
+
+	e = entries(tr)
+	require.Equal(t, "0", e[sysPrefix+"alarms/count"])
+	require.Equal(t, "", e[sysPrefix+"alarms/active"])
+	require.Empty(t, tr.Snapshot().Alarms)
+}
+
+func TestDrops(t *testing.T) {
+	tr := newTree(t)
+	d := tr.Drops()
+
+	d.Dropped(DropQueueFull)
+	d.Dropped(DropQueueFull)
+	d.Dropped(DropRetriesExhausted)
+
+	// unknown causes are ignored
+	d.Dropped(-1)
+	d.Dropped(dropCauses)
+
+	e := entries(tr)
+	require.Equal(t, "3", e[sysPrefix+"messages/dropped"])
+	require.Equal(t, "2", e[sysPrefix+"messages/dropped/queue full"])
+	require.Equal(t, "1", e[sysPrefix+"messages/dropped/retries exhausted"])
+	require.Equal(t, "0", e[sysPrefix+"messages/dropped/expired"])
+
+	s := tr.Snapshot()
+	require.Len(t, s.Dropped, int(dropCauses))
+	require.Equal(t, uint64(2), s.Dropped["queue full"])
+	require.Equal(t, uint64(1), s.Dropped["retries exhausted"])
+	require.Equal(t, uint64(0), s.Dropped["oversized"])
+
+	require.Equal(t, "unknown", DropCause(-1).String())
+	require.Equal(t, "unknown", dropCauses.String())
+}
+
+func TestSnapshot(t *testing.T) {
+	tr := newTree(t)
+
+	tr.Session().Connected()
+	tr.Session().Connected()
+	tr.Connections().Opened()
+	tr.Topics().Added()
+	tr.Subscriptions().Subscribed("a/#")
+	tr.Metric().Packets().Received(message.PUBLISH)
+	tr.Metric().Bytes().Received(10)
+
+	s := tr.Snapshot()
+	require.Equal(t, uint64(2), s.ClientsConnected)
+	require.Equal(t, uint64(2), s.ClientsMaximum)
+	require.Equal(t, int64(1), s.Connections)
+	require.Equal(t, uint64(1), s.Retained)
+	require.Equal(t, uint64(1), s.Subscriptions)
+	require.Equal(t, uint64(1), s.Totals["publish/messages/received"])
+	require.Equal(t, uint64(10), s.Totals["bytes/received"])
+	require.True(t, s.Uptime >= 0)
+
+	// first update only establishes baseline of loads
+	require.Equal(t, Rates{}, s.Rates["bytes/received"])
+}
+
+func TestLoads(t *testing.T) {
+	tr := newTree(t).(*impl)
+
+	now := time.Now()
+	tr.updateLoads(now, []counter{{"c", 0}})
+
+	// rate of 60 per minute sustained for minute
+	res := tr.updateLoads(now.Add(time.Minute), []counter{{"c", 60}})
+	require.InDelta(t, 60*(1-1/2.718281828), res["c"][0], 0.01)
+	require.True(t, res["c"][0] > res["c"][1])
+	require.True(t, res["c"][1] > res["c"][2])
+
+	// no time elapsed keeps averages
+	again := tr.updateLoads(now.Add(time.Minute), []counter{{"c", 120}})
+	require.Equal(t, res["c"], again["c"])
+}
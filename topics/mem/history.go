@@ -0,0 +1,111 @@
+package mem
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/troian/surgemq/message"
+)
+
+const defaultHistoryDepth = 10
+
+// history bounded store of last messages published to every topic, kept in ring per topic
+// Least recently published topic is evicted once capacity reached
+type history struct {
+	lock  sync.Mutex
+	size  int
+	depth int
+
+	// root last message of every topic, matched against filters
+	root  *rNode
+	order *list.List
+	index map[string]*list.Element
+}
+
+// ring of last messages of topic
+type ring struct {
+	topic string
+	msgs  []*message.PublishMessage
+
+	// next position overwritten once ring is full, i.e. the oldest message
+	next int
+}
+
+func newHistory(size, depth int) *history {
+	return &history{
+		size:  size,
+		depth: depth,
+		root:  newRNode(),
+		order: list.New(),
+		index: make(map[string]*list.Element),
+	}
+}
+
+func (r *ring) put(msg *message.PublishMessage) {
+	if len(r.msgs) < cap(r.msgs) {
+		r.msgs = append(r.msgs, msg)
+		return
+	}
+
+	r.msgs[r.next] = msg
+	r.next = (r.next + 1) % len(r.msgs)
+}
+
+// last n messages oldest first
+func (r *ring) last(n int, msgs *[]*message.PublishMessage) {
+	total := len(r.msgs)
+	if n > total {
+		n = total
+	}
+
+	for i := total - n; i < total; i++ {
+		*msgs = append(*msgs, r.msgs[(r.next+i)%total])
+	}
+}
+
+func (h *history) put(msg *message.PublishMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err := h.root.insert(msg.Topic(), msg); err != nil {
+		return
+	}
+
+	if e, ok := h.index[msg.Topic()]; ok {
+		e.Value.(*ring).put(msg)
+		h.order.MoveToFront(e)
+		return
+	}
+
+	r := &ring{topic: msg.Topic(), msgs: make([]*message.PublishMessage, 0, h.depth)}
+	r.put(msg)
+	h.index[msg.Topic()] = h.order.PushFront(r)
+
+	if h.order.Len() > h.size {
+		last := h.order.Back()
+		topic := last.Value.(*ring).topic
+
+		h.order.Remove(last)
+		delete(h.index, topic)
+		h.root.remove(topic) // nolint: errcheck, gas
+	}
+}
+
+// match up to n last messages of every topic matching filter
+func (h *history) match(filter string, n int, msgs *[]*message.PublishMessage) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var latest []*message.PublishMessage
+	if err := h.root.matchRoot(filter, &latest); err != nil {
+		return err
+	}
+
+	for _, m := range latest {
+		if e, ok := h.index[m.Topic()]; ok {
+			e.Value.(*ring).last(n, msgs)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package mem
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/troian/surgemq/message"
+)
+
+// lastValues bounded cache of last message published to every topic
+// Least recently published topic is evicted once capacity reached
+type lastValues struct {
+	lock  sync.Mutex
+	size  int
+	root  *rNode
+	order *list.List
+	index map[string]*list.Element
+}
+
+func newLastValues(size int) *lastValues {
+	return &lastValues{
+		size:  size,
+		root:  newRNode(),
+		order: list.New(),
+		index: make(map[string]*list.Element),
+	}
+}
+
+func (c *lastValues) put(msg *message.PublishMessage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.root.insert(msg.Topic(), msg); err != nil {
+		return
+	}
+
+	if e, ok := c.index[msg.Topic()]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.index[msg.Topic()] = c.order.PushFront(msg.Topic())
+
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		topic := last.Value.(string)
+
+		c.order.Remove(last)
+		delete(c.index, topic)
+		c.root.remove(topic) // nolint: errcheck, gas
+	}
+}
+
+func (c *lastValues) match(filter string, msgs *[]*message.PublishMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.root.matchRoot(filter, msgs)
+}
@@ -1,6 +1,8 @@
 package mem
 
 import (
+	"strings"
+
 	"github.com/troian/surgemq/message"
 	topicsTypes "github.com/troian/surgemq/topics/types"
 	"github.com/troian/surgemq/types"
@@ -82,14 +84,42 @@ func (rn *rNode) remove(topic string) error {
 		return err
 	}
 
-	// If there are no more rNodes to the next level we just visited let's remove it
-	if len(n.nodes) == 0 {
+	// If there are no more rNodes to the next level we just visited and it does not
+	// hold message itself let's remove it
+	if len(n.nodes) == 0 && n.msg == nil {
 		delete(rn.nodes, level)
 	}
 
 	return nil
 }
 
+// matchRoot match filter starting at root of the tree
+// Filters starting with wildcard do not match topics starting with '$' [MQTT-4.7.2-1]
+func (rn *rNode) matchRoot(topic string, msgs *[]*message.PublishMessage) error {
+	level, rem, err := nextTopicLevel(topic)
+	if err != nil {
+		return err
+	}
+
+	if level != topicsTypes.MWC && level != topicsTypes.SWC {
+		return rn.match(topic, msgs)
+	}
+
+	for k, n := range rn.nodes {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+
+		if level == topicsTypes.MWC {
+			n.allRetained(msgs)
+		} else if err = n.match(rem, msgs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // match() finds the retained messages for the topic and qos provided. It's somewhat
 // of a reverse match compare to match() since the supplied topic can contain
 // wildcards, whereas the retained message topic is a full (no wildcard) topic.
@@ -0,0 +1,91 @@
+package mem
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/troian/surgemq/topics/types"
+)
+
+// sShard part of subscription tree holding filters with the same hash of first topic level
+// Writers of different shards do not contend, readers never lock
+type sShard struct {
+	// Sub/unSub mutex. Serializes writers of the shard only
+	mu sync.Mutex
+
+	// Holds *sNode which is never modified once stored, writers copy path
+	// of changed topic and store new root
+	root atomic.Value
+}
+
+type sShards struct {
+	list []*sShard
+
+	// filters starting with wildcard match topics of every shard thus kept aside
+	wild *sShard
+}
+
+func newSShards(count int) *sShards {
+	if count < 1 {
+		count = 1
+	}
+
+	s := &sShards{
+		list: make([]*sShard, count),
+	}
+
+	for i := range s.list {
+		s.list[i] = newSShard()
+	}
+
+	if count == 1 {
+		s.wild = s.list[0]
+	} else {
+		s.wild = newSShard()
+	}
+
+	return s
+}
+
+func newSShard() *sShard {
+	s := &sShard{}
+	s.root.Store(newSNode())
+	return s
+}
+
+// subscriptions current version of shard tree. Must not be modified
+func (s *sShard) subscriptions() *sNode {
+	return s.root.Load().(*sNode)
+}
+
+// shard filter or topic belongs to
+func (s *sShards) shard(topic string) *sShard {
+	if len(s.list) == 1 {
+		return s.list[0]
+	}
+
+	level := topic
+	if i := strings.IndexByte(topic, '/'); i >= 0 {
+		level = topic[:i]
+	}
+
+	if level == topicsTypes.SWC || level == topicsTypes.MWC {
+		return s.wild
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(level)) // nolint: errcheck, gas
+
+	return s.list[h.Sum32()%uint32(len(s.list))]
+}
+
+// reset all shards to empty trees
+func (s *sShards) reset() {
+	for _, e := range s.list {
+		e.root.Store(newSNode())
+	}
+
+	s.wild.root.Store(newSNode())
+}
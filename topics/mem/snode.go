@@ -1,6 +1,7 @@
 package mem
 
 import (
+	"strings"
 	"unsafe"
 
 	"github.com/troian/surgemq/message"
@@ -9,6 +10,9 @@ import (
 )
 
 // subscription nodes
+// Tree is keyed by topic level with wildcards stored as regular children, thus matching
+// visits at most three children per level: exact, '+' and '#'. Maps are allocated on first
+// use as most nodes of large trees are either leaves or intermediate levels without subscribers
 type sNode struct {
 	// If this is the end of the topic string, then add subscribers here
 	subs subscribers
@@ -18,10 +22,80 @@ type sNode struct {
 }
 
 func newSNode() *sNode {
-	return &sNode{
-		subs:  make(subscribers),
-		nodes: make(map[string]*sNode),
+	return &sNode{}
+}
+
+// copyPath returns copy of the node with all nodes along the topic path copied as well.
+// Other branches are shared with original tree thus insert and remove of the same
+// topic on returned tree leave original intact and it can be read concurrently
+func (sn *sNode) copyPath(topic string) (*sNode, error) {
+	n := &sNode{}
+
+	if len(sn.nodes) > 0 {
+		n.nodes = make(map[string]*sNode, len(sn.nodes))
+		for k, v := range sn.nodes {
+			n.nodes[k] = v
+		}
+	}
+
+	if len(topic) == 0 {
+		// subscriber entries are updated in place by insert thus copied too
+		if len(sn.subs) > 0 {
+			n.subs = make(subscribers, len(sn.subs))
+			for k, v := range sn.subs {
+				n.subs[k] = &subscriber{entry: v.entry, qos: v.qos}
+			}
+		}
+
+		return n, nil
+	}
+
+	n.subs = sn.subs
+
+	level, rem, err := nextTopicLevel(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if child, ok := n.nodes[level]; ok {
+		if n.nodes[level], err = child.copyPath(rem); err != nil {
+			return nil, err
+		}
 	}
+
+	return n, nil
+}
+
+// lookup node of the topic. Returns nil if there is no such node
+func (sn *sNode) lookup(topic string) *sNode {
+	n := sn
+
+	for len(topic) > 0 {
+		level, rem, err := nextTopicLevel(topic)
+		if err != nil {
+			return nil
+		}
+
+		if n = n.nodes[level]; n == nil {
+			return nil
+		}
+
+		topic = rem
+	}
+
+	return n
+}
+
+// subscribed check if subscriber is subscribed to the topic
+func (sn *sNode) subscribed(topic string, sub *types.Subscriber) bool {
+	n := sn.lookup(topic)
+	if n == nil {
+		return false
+	}
+
+	_, ok := n.subs[uintptr(unsafe.Pointer(sub))]
+
+	return ok
 }
 
 func (sn *sNode) insert(topic string, qos message.QosType, sub *types.Subscriber) error {
@@ -34,6 +108,10 @@ func (sn *sNode) insert(topic string, qos message.QosType, sub *types.Subscriber
 		if e, ok := sn.subs[uintptr(unsafe.Pointer(sub))]; ok {
 			e.qos = qos
 		} else {
+			if sn.subs == nil {
+				sn.subs = make(subscribers)
+			}
+
 			sn.subs[uintptr(unsafe.Pointer(sub))] = &subscriber{
 				entry: sub,
 				qos:   qos,
@@ -57,6 +135,10 @@ func (sn *sNode) insert(topic string, qos message.QosType, sub *types.Subscriber
 	// Add sNode if it doesn't already exist
 	n, ok := sn.nodes[level]
 	if !ok {
+		if sn.nodes == nil {
+			sn.nodes = make(map[string]*sNode)
+		}
+
 		n = newSNode()
 		sn.nodes[level] = n
 	}
@@ -72,7 +154,7 @@ func (sn *sNode) remove(topic string, sub *types.Subscriber) error {
 	if len(topic) == 0 {
 		// If subscriber == nil, then it's signal to remove ALL subscribers
 		if sub == nil {
-			sn.subs = make(subscribers)
+			sn.subs = nil
 			return nil
 		}
 
@@ -114,6 +196,29 @@ func (sn *sNode) remove(topic string, sub *types.Subscriber) error {
 		delete(sn.nodes, level)
 	}
 
+	if len(sn.subs) == 0 {
+		sn.subs = nil
+	}
+
+	return nil
+}
+
+// matchRoot match topic starting at root of the tree
+// Topics starting with '$' are not matched by filters starting with wildcard [MQTT-4.7.2-1]
+func (sn *sNode) matchRoot(topic string, qos message.QosType, subs *types.Subscribers) error {
+	if !strings.HasPrefix(topic, "$") {
+		return sn.match(topic, qos, subs)
+	}
+
+	level, rem, err := nextTopicLevel(topic)
+	if err != nil {
+		return err
+	}
+
+	if n, ok := sn.nodes[level]; ok {
+		return n.match(rem, qos, subs)
+	}
+
 	return nil
 }
 
@@ -121,6 +226,8 @@ func (sn *sNode) remove(topic string, sub *types.Subscriber) error {
 // with no wildcards (publish topic), it returns a list of subscribers that subscribes
 // to the topic. For each of the level names, it's a match
 // - if there are subscribers to '#', then all the subscribers are added to result set
+// Children are looked up by key rather than iterated thus cost does not depend on
+// number of siblings, only on depth of topic and number of wildcard branches
 func (sn *sNode) match(topic string, qos message.QosType, subs *types.Subscribers) error {
 	// If the topic is empty, it means we are at the final matching snode. If so,
 	// let's find the subscribers that match the qos and append them to the list.
@@ -135,14 +242,27 @@ func (sn *sNode) match(topic string, qos message.QosType, subs *types.Subscriber
 		return err
 	}
 
+	if len(sn.nodes) == 0 {
+		return nil
+	}
+
 	level := ntl
 
-	for k, n := range sn.nodes {
-		// If the key is "#", then these subscribers are added to the result set
-		if k == topicsTypes.MWC {
-			n.matchQos(qos, subs)
-		} else if k == topicsTypes.SWC || k == level {
-			if err := n.match(rem, qos, subs); err != nil {
+	// If the key is "#", then these subscribers are added to the result set
+	if n, ok := sn.nodes[topicsTypes.MWC]; ok {
+		n.matchQos(qos, subs)
+	}
+
+	if n, ok := sn.nodes[topicsTypes.SWC]; ok {
+		if err = n.match(rem, qos, subs); err != nil {
+			return err
+		}
+	}
+
+	// empty level is stored as '+' and has been visited above
+	if level != topicsTypes.SWC && level != topicsTypes.MWC {
+		if n, ok := sn.nodes[level]; ok {
+			if err = n.match(rem, qos, subs); err != nil {
 				return err
 			}
 		}
@@ -0,0 +1,71 @@
+package mem
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	topicsTypes "github.com/troian/surgemq/topics/types"
+)
+
+// topicStats counters of most recently published topics
+// Least recently published topic is evicted once capacity reached
+type topicStats struct {
+	lock  sync.Mutex
+	size  int
+	order *list.List
+	index map[string]*list.Element
+}
+
+func newTopicStats(size int) *topicStats {
+	return &topicStats{
+		size:  size,
+		order: list.New(),
+		index: make(map[string]*list.Element),
+	}
+}
+
+// published account message published to topic and delivered to given amount of subscribers
+func (t *topicStats) published(topic string, delivered int, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var st *topicsTypes.TopicStat
+
+	if e, ok := t.index[topic]; ok {
+		t.order.MoveToFront(e)
+		st = e.Value.(*topicsTypes.TopicStat)
+	} else {
+		if t.order.Len() >= t.size {
+			last := t.order.Back()
+			t.order.Remove(last)
+			delete(t.index, last.Value.(*topicsTypes.TopicStat).Topic)
+		}
+
+		st = &topicsTypes.TopicStat{Topic: topic}
+		t.index[topic] = t.order.PushFront(st)
+	}
+
+	st.Published++
+	st.Delivered += uint64(delivered)
+	st.LastPublished = now
+}
+
+// top topics by amount of published messages
+func (t *topicStats) top(limit int) []topicsTypes.TopicStat {
+	t.lock.Lock()
+	res := make([]topicsTypes.TopicStat, 0, t.order.Len())
+	for e := t.order.Front(); e != nil; e = e.Next() {
+		res = append(res, *e.Value.(*topicsTypes.TopicStat))
+	}
+	t.lock.Unlock()
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Published > res[j].Published })
+
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+
+	return res
+}
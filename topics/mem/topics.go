@@ -15,9 +15,11 @@
 package mem
 
 import (
+	"container/list"
+	"sort"
+	"strings"
 	"sync"
-
-	"errors"
+	"time"
 
 	"github.com/troian/surgemq"
 	"github.com/troian/surgemq/message"
@@ -41,11 +43,8 @@ type subscriber struct {
 type subscribers map[uintptr]*subscriber
 
 type provider struct {
-	// Sub/unSub mutex
-	smu sync.RWMutex
-
-	// Subscription tree
-	sRoot *sNode
+	// Subscription tree partitioned by first topic level
+	subs *sShards
 
 	// Retained message mutex
 	rmu sync.RWMutex
@@ -53,8 +52,26 @@ type provider struct {
 	// Retained messages topic tree
 	rRoot *rNode
 
+	// Retained topics in order of arrival, oldest first. Used to enforce limits
+	rOrder *list.List
+	rIndex map[string]*list.Element
+	limits topicsTypes.RetainedLimits
+
+	// statistics of published topics. nil if disabled
+	topics *topicStats
+
+	// last messages of published topics. nil if disabled
+	lvc *lastValues
+
+	// history of published topics. nil if disabled
+	history *history
+
 	stat systree.TopicsStat
 
+	subsStat systree.SubscriptionsStat
+
+	drops systree.DropsStat
+
 	persist persistenceTypes.Retained
 
 	log struct {
@@ -67,14 +84,36 @@ var _ topicsTypes.Provider = (*provider)(nil)
 
 // NewMemProvider returns an new instance of the provider, which is implements the
 // TopicsProvider interface. provider is a hidden struct that stores the topic
-// subscriptions and retained messages in memory. The content is not persistend so
-// when the server goes, everything will be gone. Use with care.
+// subscriptions and retained messages in memory. Retained messages are loaded from
+// persistence if provided and every change is written through.
 func NewMemProvider(config *topicsTypes.MemConfig) (topicsTypes.Provider, error) {
 	p := &provider{
-		sRoot:   newSNode(),
-		rRoot:   newRNode(),
-		stat:    config.Stat,
-		persist: config.Persist,
+		rRoot:    newRNode(),
+		rOrder:   list.New(),
+		rIndex:   make(map[string]*list.Element),
+		limits:   config.Retained,
+		stat:     config.Stat,
+		subsStat: config.Subscriptions,
+		drops:    config.Drops,
+		persist:  config.Persist,
+		subs:     newSShards(config.Shards),
+	}
+
+	if config.StatsSize > 0 {
+		p.topics = newTopicStats(config.StatsSize)
+	}
+
+	if config.LastValues > 0 {
+		p.lvc = newLastValues(config.LastValues)
+	}
+
+	if config.History > 0 {
+		depth := config.HistoryDepth
+		if depth <= 0 {
+			depth = defaultHistoryDepth
+		}
+
+		p.history = newHistory(config.History, depth)
 	}
 
 	p.log.prod = surgemq.GetProdLogger().Named("topics").Named("mem")
@@ -90,11 +129,16 @@ func NewMemProvider(config *topicsTypes.MemConfig) (topicsTypes.Provider, error)
 			// Loading retained messages
 			if m, ok := msg.(*message.PublishMessage); ok {
 				p.log.dev.Debug("Loading retained message", zap.String("topic", m.Topic()), zap.Int8("QoS", int8(m.QoS())))
-				p.Retain(m) // nolint: errcheck
+
+				// limits might have been lowered since messages persisted
+				evicted, err := p.retain(m)
+				if err == topicsTypes.ErrRetainedLimit || err == topicsTypes.ErrRetainedTooLarge {
+					evicted = append(evicted, m.Topic())
+				}
+
+				p.unpersist(evicted)
 			}
 		}
-
-		p.persist.Delete() // nolint: errcheck
 	}
 
 	return p, nil
@@ -109,73 +153,242 @@ func (mT *provider) Subscribe(topic string, qos message.QosType, sub *types.Subs
 		return message.QosFailure, topicsTypes.ErrInvalidSubscriber
 	}
 
-	mT.smu.Lock()
-	defer mT.smu.Unlock()
+	shard := mT.subs.shard(topic)
 
-	if err := mT.sRoot.insert(topic, qos, sub); err != nil {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	root, err := shard.subscriptions().copyPath(topic)
+	if err != nil {
 		return message.QosFailure, err
 	}
 
+	if err = root.insert(topic, qos, sub); err != nil {
+		return message.QosFailure, err
+	}
+
+	if mT.subsStat != nil && !shard.subscriptions().subscribed(topic, sub) {
+		mT.subsStat.Subscribed(topic)
+	}
+
+	shard.root.Store(root)
+
 	return qos, nil
 }
 
 func (mT *provider) Subscribers(topic string, qos message.QosType, subs *types.Subscribers) error {
-	mT.smu.RLock()
+	shard := mT.subs.shard(topic)
 
-	if err := mT.sRoot.match(topic, qos, subs); err != nil {
-		mT.smu.RUnlock()
+	if err := shard.subscriptions().matchRoot(topic, qos, subs); err != nil {
 		return err
 	}
-	mT.smu.RUnlock()
+
+	if shard != mT.subs.wild {
+		return mT.subs.wild.subscriptions().matchRoot(topic, qos, subs)
+	}
 
 	return nil
 }
 
 func (mT *provider) UnSubscribe(topic string, sub *types.Subscriber) error {
-	mT.smu.Lock()
-	defer mT.smu.Unlock()
+	shard := mT.subs.shard(topic)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	root, err := shard.subscriptions().copyPath(topic)
+	if err != nil {
+		return err
+	}
+
+	if err = root.remove(topic, sub); err != nil {
+		return err
+	}
+
+	if mT.subsStat != nil {
+		removed := 1
+		if sub == nil {
+			if n := shard.subscriptions().lookup(topic); n != nil {
+				removed = len(n.subs)
+			}
+		}
 
-	return mT.sRoot.remove(topic, sub)
+		for i := 0; i < removed; i++ {
+			mT.subsStat.UnSubscribed(topic)
+		}
+	}
+
+	shard.root.Store(root)
+
+	return nil
 }
 
 func (mT *provider) Publish(msg *message.PublishMessage) error {
-	mT.smu.RLock()
+	if !strings.HasPrefix(msg.Topic(), "$") {
+		if mT.lvc != nil {
+			mT.lvc.put(msg)
+		}
+
+		if mT.history != nil {
+			mT.history.put(msg)
+		}
+	}
 
 	var subs types.Subscribers
 
-	if err := mT.sRoot.match(msg.Topic(), msg.QoS(), &subs); err != nil {
-		mT.smu.RUnlock()
+	if err := mT.Subscribers(msg.Topic(), msg.QoS(), &subs); err != nil {
 		return err
 	}
-	mT.smu.RUnlock()
+
+	delivered := 0
 
 	for _, e := range subs {
 		if e != nil {
 			if err := e.Publish(msg); err != nil {
 				mT.log.prod.Error("Error", zap.Error(err))
+			} else {
+				delivered++
 			}
 
 			e.WgWriters.Done()
 		}
 	}
 
+	// system topics are published by broker itself
+	if !strings.HasPrefix(msg.Topic(), "$") {
+		if mT.subsStat != nil {
+			mT.subsStat.FanOut(len(subs))
+		}
+
+		if mT.topics != nil {
+			mT.topics.published(msg.Topic(), delivered, time.Now())
+		}
+
+		if len(subs) == 0 && mT.drops != nil {
+			mT.drops.Dropped(systree.DropNoSubscribers)
+		}
+	}
+
 	return nil
 }
 
+// TopicStats statistics of most recently published topics
+func (mT *provider) TopicStats(limit int) []topicsTypes.TopicStat {
+	if mT.topics == nil {
+		return nil
+	}
+
+	return mT.topics.top(limit)
+}
+
+// Retain update retained message of the topic and write change through into persistence
 func (mT *provider) Retain(msg *message.PublishMessage) error {
+	evicted, err := mT.retain(msg)
+	mT.unpersist(evicted)
+
+	if err != nil {
+		return err
+	}
+
+	// system topics are regenerated by broker thus not persisted
+	if mT.persist != nil && !strings.HasPrefix(msg.Topic(), "$") {
+		if len(msg.Payload()) == 0 {
+			err = mT.persist.Remove(msg.Topic())
+		} else {
+			err = mT.persist.Put(msg)
+		}
+
+		if err != nil {
+			mT.log.prod.Error("Couldn't persist retained message", zap.String("topic", msg.Topic()), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// RetainReplicated update retained message of the topic. Retained messages of other brokers
+// are not evicted from persistence if limits of this one are exceeded
+func (mT *provider) RetainReplicated(msg *message.PublishMessage) error {
+	_, err := mT.retain(msg)
+
+	return err
+}
+
+// retain update retained message of the topic. Returns topics evicted to make room for it
+func (mT *provider) retain(msg *message.PublishMessage) ([]string, error) {
 	mT.rmu.Lock()
 	defer mT.rmu.Unlock()
 
 	// [MQTT-3.3.1-10]            [MQTT-3.3.1-7]
 	if len(msg.Payload()) == 0 || msg.QoS() == message.QoS0 {
 		mT.rRoot.remove(msg.Topic()) // nolint: errcheck, gas
+		mT.forget(msg.Topic())
 
 		if len(msg.Payload()) == 0 {
-			return nil
+			return nil, nil
 		}
 	}
 
-	return mT.rRoot.insert(msg.Topic(), msg)
+	if mT.limits.MaxPayload > 0 && len(msg.Payload()) > mT.limits.MaxPayload {
+		return nil, topicsTypes.ErrRetainedTooLarge
+	}
+
+	var evicted []string
+
+	e, exists := mT.rIndex[msg.Topic()]
+	if !exists && mT.limits.MaxCount > 0 {
+		for mT.rOrder.Len() >= mT.limits.MaxCount {
+			if mT.limits.Policy != topicsTypes.RetainedEvictOldest {
+				return nil, topicsTypes.ErrRetainedLimit
+			}
+
+			topic := mT.rOrder.Front().Value.(string)
+			mT.rRoot.remove(topic) // nolint: errcheck, gas
+			mT.forget(topic)
+			evicted = append(evicted, topic)
+		}
+	}
+
+	if err := mT.rRoot.insert(msg.Topic(), msg); err != nil {
+		return evicted, err
+	}
+
+	if exists {
+		mT.rOrder.MoveToBack(e)
+	} else {
+		mT.rIndex[msg.Topic()] = mT.rOrder.PushBack(msg.Topic())
+
+		if mT.stat != nil {
+			mT.stat.Added()
+		}
+	}
+
+	return evicted, nil
+}
+
+// forget topic in retained order. Caller must hold rmu
+func (mT *provider) forget(topic string) {
+	if e, ok := mT.rIndex[topic]; ok {
+		mT.rOrder.Remove(e)
+		delete(mT.rIndex, topic)
+
+		if mT.stat != nil {
+			mT.stat.Removed()
+		}
+	}
+}
+
+// unpersist remove retained messages of topics from persistence
+func (mT *provider) unpersist(topics []string) {
+	if mT.persist == nil {
+		return
+	}
+
+	for _, t := range topics {
+		if err := mT.persist.Remove(t); err != nil {
+			mT.log.prod.Error("Couldn't remove persisted retained message", zap.String("topic", t), zap.Error(err))
+		}
+	}
 }
 
 func (mT *provider) Retained(topic string, msgs *[]*message.PublishMessage) error {
@@ -183,27 +396,121 @@ func (mT *provider) Retained(topic string, msgs *[]*message.PublishMessage) erro
 	defer mT.rmu.RUnlock()
 
 	// [MQTT-3.3.1-5]
-	return mT.rRoot.match(topic, msgs)
+	return mT.rRoot.matchRoot(topic, msgs)
 }
 
-func (mT *provider) Close() error {
-	var rMsg []*message.PublishMessage
-	mT.Retained("#", &rMsg) // nolint: errcheck
+// LastValues last messages published to topics matching filter
+func (mT *provider) LastValues(filter string, msgs *[]*message.PublishMessage) error {
+	if mT.lvc == nil {
+		return mT.Retained(filter, msgs)
+	}
 
-	toStore := []message.Provider{}
+	var retained []*message.PublishMessage
+	if err := mT.Retained(filter, &retained); err != nil {
+		return err
+	}
 
-	for _, m := range rMsg {
-		toStore = append(toStore, m)
+	start := len(*msgs)
+	if err := mT.lvc.match(filter, msgs); err != nil {
+		return err
 	}
 
-	if mT.persist != nil {
-		if len(toStore) > 0 {
-			mT.log.dev.Debug("Storing retained messages", zap.Int("amount", len(toStore)))
-			mT.persist.Store(toStore) // nolint: errcheck
+	cached := make(map[string]bool, len(*msgs)-start)
+	for _, m := range (*msgs)[start:] {
+		cached[m.Topic()] = true
+	}
+
+	for _, m := range retained {
+		if !cached[m.Topic()] {
+			*msgs = append(*msgs, m)
 		}
 	}
 
-	mT.sRoot = nil
+	return nil
+}
+
+// History up to n last messages published to topics matching filter
+func (mT *provider) History(filter string, n int, msgs *[]*message.PublishMessage) error {
+	if mT.history == nil || n <= 0 {
+		return mT.Retained(filter, msgs)
+	}
+
+	var retained []*message.PublishMessage
+	if err := mT.Retained(filter, &retained); err != nil {
+		return err
+	}
+
+	start := len(*msgs)
+	if err := mT.history.match(filter, n, msgs); err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool, len(*msgs)-start)
+	for _, m := range (*msgs)[start:] {
+		kept[m.Topic()] = true
+	}
+
+	for _, m := range retained {
+		if !kept[m.Topic()] {
+			*msgs = append(*msgs, m)
+		}
+	}
+
+	return nil
+}
+
+// RetainedList page of retained messages matching filter
+func (mT *provider) RetainedList(filter string, after string, limit int) ([]*message.PublishMessage, error) {
+	var msgs []*message.PublishMessage
+
+	mT.rmu.RLock()
+	err := mT.rRoot.matchRoot(filter, &msgs)
+	mT.rmu.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Topic() < msgs[j].Topic() })
+
+	if after != "" {
+		i := sort.Search(len(msgs), func(i int) bool { return msgs[i].Topic() > after })
+		msgs = msgs[i:]
+	}
+
+	if limit > 0 && len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+
+	return msgs, nil
+}
+
+// RetainedDelete remove retained messages matching filter and write change through into persistence
+func (mT *provider) RetainedDelete(filter string) (int, error) {
+	var msgs []*message.PublishMessage
+
+	mT.rmu.Lock()
+	if err := mT.rRoot.matchRoot(filter, &msgs); err != nil {
+		mT.rmu.Unlock()
+		return 0, err
+	}
+
+	topics := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		mT.rRoot.remove(m.Topic()) // nolint: errcheck, gas
+		mT.forget(m.Topic())
+		topics = append(topics, m.Topic())
+	}
+	mT.rmu.Unlock()
+
+	mT.unpersist(topics)
+
+	return len(msgs), nil
+}
+
+// Close provider. Retained messages are already persisted on every change
+func (mT *provider) Close() error {
+	mT.subs.reset()
 	mT.rRoot = nil
 	return nil
 }
@@ -248,10 +555,6 @@ func nextTopicLevel(topic string) (string, string, error) {
 			s = stateSWC
 
 		case '$':
-			if i == 0 {
-				return "", "", errors.New("memtopics/nextTopicLevel: Cannot publish to $ topics")
-			}
-
 			s = stateSYS
 
 		default:
@@ -1,12 +1,16 @@
 package mem
 
 import (
+	"strconv"
+	"sync"
 	"testing"
 
 	"unsafe"
 
 	"github.com/stretchr/testify/require"
 	"github.com/troian/surgemq/message"
+	"github.com/troian/surgemq/systree"
+	topicsTypes "github.com/troian/surgemq/topics/types"
 	"github.com/troian/surgemq/types"
 )
 
@@ -443,6 +447,39 @@ func TestSNodeMatch9(t *testing.T) {
 	require.Equal(t, 0, len(subs))
 }
 
+func TestSNodeCopyPath(t *testing.T) {
+	n := newSNode()
+
+	sub1 := &types.Subscriber{}
+	sub2 := &types.Subscriber{}
+
+	require.NoError(t, n.insert("sport/tennis/player1", 1, sub1))
+	require.NoError(t, n.insert("sport/golf", 1, sub1))
+
+	c, err := n.copyPath("sport/tennis/player1")
+	require.NoError(t, err)
+
+	require.NoError(t, c.insert("sport/tennis/player1", 2, sub1))
+	require.NoError(t, c.insert("sport/tennis/player1", 1, sub2))
+
+	// untouched branch is shared
+	require.True(t, n.nodes["sport"].nodes["golf"] == c.nodes["sport"].nodes["golf"])
+
+	require.Equal(t, 1, len(n.nodes["sport"].nodes["tennis"].nodes["player1"].subs))
+	require.Equal(t, message.QosType(1), n.nodes["sport"].nodes["tennis"].nodes["player1"].subs[uintptr(unsafe.Pointer(sub1))].qos)
+	require.Equal(t, 2, len(c.nodes["sport"].nodes["tennis"].nodes["player1"].subs))
+
+	c, err = n.copyPath("sport/golf")
+	require.NoError(t, err)
+	require.NoError(t, c.remove("sport/golf", sub1))
+
+	require.Equal(t, 1, len(n.nodes["sport"].nodes["golf"].subs))
+	require.Nil(t, c.nodes["sport"].nodes["golf"])
+
+	_, err = n.copyPath("sport/#/x")
+	require.Error(t, err)
+}
+
 func TestRNodeInsertRemove(t *testing.T) {
 	n := newRNode()
 
@@ -580,6 +617,323 @@ func TestRNodeMatch(t *testing.T) {
 	require.Equal(t, 3, len(msglist))
 }
 
+func TestRetainedListDelete(t *testing.T) {
+	p, err := NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	for _, topic := range []string{"sport/tennis", "sport/tennis/andre", "sport/tennis/ricardo", "sport/golf", "news"} {
+		require.NoError(t, p.Retain(newPublishMessageLarge(topic, 1)))
+	}
+
+	list, err := p.RetainedList("sport/#", "", 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list))
+	require.Equal(t, "sport/golf", list[0].Topic())
+	require.Equal(t, "sport/tennis", list[1].Topic())
+
+	list, err = p.RetainedList("sport/#", list[1].Topic(), 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list))
+	require.Equal(t, "sport/tennis/andre", list[0].Topic())
+	require.Equal(t, "sport/tennis/ricardo", list[1].Topic())
+
+	list, err = p.RetainedList("sport/#", list[1].Topic(), 2)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(list))
+
+	count, err := p.RetainedDelete("sport/tennis/+")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// parent of removed topics keeps its message
+	list, err = p.RetainedList("#", "", 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(list))
+	require.Equal(t, "sport/tennis", list[2].Topic())
+
+	_, err = p.RetainedDelete("sport/#/x")
+	require.Error(t, err)
+}
+
+func TestRetainedLimits(t *testing.T) {
+	p, err := NewMemProvider(&topicsTypes.MemConfig{
+		Retained: topicsTypes.RetainedLimits{MaxCount: 2, MaxPayload: 1024},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, p.Retain(newPublishMessageLarge("a", 1)))
+	require.NoError(t, p.Retain(newPublishMessageLarge("b", 1)))
+	require.Equal(t, topicsTypes.ErrRetainedLimit, p.Retain(newPublishMessageLarge("c", 1)))
+
+	// replacing existing message does not count
+	require.NoError(t, p.Retain(newPublishMessageLarge("a", 1)))
+
+	big := newPublishMessageLarge("a", 1)
+	big.SetPayload(make([]byte, 1025))
+	require.Equal(t, topicsTypes.ErrRetainedTooLarge, p.Retain(big))
+
+	p, err = NewMemProvider(&topicsTypes.MemConfig{
+		Retained: topicsTypes.RetainedLimits{MaxCount: 2, Policy: topicsTypes.RetainedEvictOldest},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, p.Retain(newPublishMessageLarge("a", 1)))
+	require.NoError(t, p.Retain(newPublishMessageLarge("b", 1)))
+	require.NoError(t, p.Retain(newPublishMessageLarge("a", 1)))
+	require.NoError(t, p.Retain(newPublishMessageLarge("c", 1)))
+
+	list, err := p.RetainedList("#", "", 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list))
+	require.Equal(t, "a", list[0].Topic())
+	require.Equal(t, "c", list[1].Topic())
+
+	// removed messages free room
+	empty := newPublishMessageLarge("a", 1)
+	empty.SetPayload(nil)
+	require.NoError(t, p.Retain(empty))
+	require.NoError(t, p.Retain(newPublishMessageLarge("d", 1)))
+
+	list, err = p.RetainedList("#", "", 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list))
+	require.Equal(t, "c", list[0].Topic())
+}
+
+func TestSysTopics(t *testing.T) {
+	p, err := NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	sub1 := &types.Subscriber{}
+	sub2 := &types.Subscriber{}
+
+	_, err = p.Subscribe("#", 1, sub1)
+	require.NoError(t, err)
+
+	_, err = p.Subscribe("$SYS/#", 1, sub2)
+	require.NoError(t, err)
+
+	var subs types.Subscribers
+	require.NoError(t, p.Subscribers("$SYS/broker/uptime", 1, &subs))
+	require.Equal(t, 1, len(subs))
+	require.True(t, subs[0] == sub2)
+
+	require.NoError(t, p.Retain(newPublishMessageLarge("$SYS/broker/uptime", 1)))
+	require.NoError(t, p.Retain(newPublishMessageLarge("sport", 1)))
+
+	var msgs []*message.PublishMessage
+	require.NoError(t, p.Retained("#", &msgs))
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "sport", msgs[0].Topic())
+
+	msgs = msgs[:0]
+	require.NoError(t, p.Retained("+/broker/uptime", &msgs))
+	require.Equal(t, 0, len(msgs))
+
+	msgs = msgs[:0]
+	require.NoError(t, p.Retained("$SYS/+/uptime", &msgs))
+	require.Equal(t, 1, len(msgs))
+}
+
+func TestShards(t *testing.T) {
+	p, err := NewMemProvider(&topicsTypes.MemConfig{Shards: 8})
+	require.NoError(t, err)
+
+	subs := make([]*types.Subscriber, 100)
+
+	var wg sync.WaitGroup
+	for i := range subs {
+		subs[i] = &types.Subscriber{}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, e := p.Subscribe("sensors"+strconv.Itoa(i)+"/temperature", 1, subs[i])
+			require.NoError(t, e)
+		}(i)
+	}
+	wg.Wait()
+
+	wild := &types.Subscriber{}
+	_, err = p.Subscribe("+/temperature", 1, wild)
+	require.NoError(t, err)
+
+	_, err = p.Subscribe("#", 1, wild)
+	require.NoError(t, err)
+
+	for i := range subs {
+		var list types.Subscribers
+		require.NoError(t, p.Subscribers("sensors"+strconv.Itoa(i)+"/temperature", 1, &list))
+		require.Equal(t, 3, len(list))
+		require.True(t, list[0] == subs[i])
+	}
+
+	var list types.Subscribers
+	require.NoError(t, p.Subscribers("$SYS/broker/uptime", 1, &list))
+	require.Equal(t, 0, len(list))
+
+	require.NoError(t, p.UnSubscribe("sensors7/temperature", subs[7]))
+	require.NoError(t, p.UnSubscribe("#", wild))
+
+	list = list[:0]
+	require.NoError(t, p.Subscribers("sensors7/temperature", 1, &list))
+	require.Equal(t, 1, len(list))
+	require.True(t, list[0] == wild)
+
+	require.NoError(t, p.Close())
+}
+
+func TestTopicStats(t *testing.T) {
+	p, err := NewMemProvider(&topicsTypes.MemConfig{StatsSize: 2})
+	require.NoError(t, err)
+
+	sub := &types.Subscriber{
+		Publish: func(msg *message.PublishMessage) error { return nil },
+	}
+
+	_, err = p.Subscribe("a", 1, sub)
+	require.NoError(t, err)
+
+	for _, topic := range []string{"a", "b", "a", "c", "$SYS/broker/uptime"} {
+		require.NoError(t, p.Publish(newPublishMessageLarge(topic, 1)))
+	}
+
+	// b is least recently published thus evicted
+	stats := p.TopicStats(0)
+	require.Equal(t, 2, len(stats))
+	require.Equal(t, "a", stats[0].Topic)
+	require.Equal(t, uint64(2), stats[0].Published)
+	require.Equal(t, uint64(2), stats[0].Delivered)
+	require.False(t, stats[0].LastPublished.IsZero())
+	require.Equal(t, "c", stats[1].Topic)
+	require.Equal(t, uint64(0), stats[1].Delivered)
+
+	require.Equal(t, 1, len(p.TopicStats(1)))
+
+	p, err = NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(newPublishMessageLarge("a", 1)))
+	require.Nil(t, p.TopicStats(0))
+}
+
+func TestSubscriptionsStat(t *testing.T) {
+	tree, err := systree.NewTree()
+	require.NoError(t, err)
+
+	p, err := NewMemProvider(&topicsTypes.MemConfig{Subscriptions: tree.Subscriptions()})
+	require.NoError(t, err)
+
+	sub1 := &types.Subscriber{}
+	sub2 := &types.Subscriber{}
+
+	for _, s := range []*types.Subscriber{sub1, sub1, sub2} {
+		_, err = p.Subscribe("a/+", 1, s)
+		require.NoError(t, err)
+	}
+
+	_, err = p.Subscribe("b", 1, sub1)
+	require.NoError(t, err)
+
+	require.Equal(t, []systree.FilterCount{{Filter: "a/+", Subscribers: 2}, {Filter: "b", Subscribers: 1}}, tree.Subscriptions().Filters(0))
+
+	require.NoError(t, p.UnSubscribe("a/+", sub1))
+	require.NoError(t, p.UnSubscribe("b", nil))
+	require.Error(t, p.UnSubscribe("b", sub1))
+
+	require.Equal(t, []systree.FilterCount{{Filter: "a/+", Subscribers: 1}}, tree.Subscriptions().Filters(0))
+}
+
+func TestLastValues(t *testing.T) {
+	p, err := NewMemProvider(&topicsTypes.MemConfig{LastValues: 2})
+	require.NoError(t, err)
+
+	require.NoError(t, p.Retain(newPublishMessageLarge("s/a", 1)))
+
+	for _, topic := range []string{"s/a", "s/b", "s/c", "$SYS/x"} {
+		require.NoError(t, p.Publish(newPublishMessageLarge(topic, 1)))
+	}
+
+	// s/a evicted from cache thus retained message returned instead
+	var msgs []*message.PublishMessage
+	require.NoError(t, p.LastValues("s/#", &msgs))
+	require.Equal(t, 3, len(msgs))
+
+	topics := map[string]bool{}
+	for _, m := range msgs {
+		topics[m.Topic()] = true
+	}
+	require.Equal(t, map[string]bool{"s/a": true, "s/b": true, "s/c": true}, topics)
+
+	msgs = msgs[:0]
+	require.NoError(t, p.LastValues("#", &msgs))
+	require.Equal(t, 3, len(msgs))
+
+	p, err = NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	require.NoError(t, p.Publish(newPublishMessageLarge("s/b", 1)))
+
+	msgs = msgs[:0]
+	require.NoError(t, p.LastValues("s/#", &msgs))
+	require.Equal(t, 0, len(msgs))
+}
+
+func TestHistory(t *testing.T) {
+	p, err := NewMemProvider(&topicsTypes.MemConfig{History: 2, HistoryDepth: 3})
+	require.NoError(t, err)
+
+	require.NoError(t, p.Retain(newPublishMessageLarge("s/a", 1)))
+
+	payloads := func(msgs []*message.PublishMessage) []string {
+		var res []string
+		for _, m := range msgs {
+			res = append(res, m.Topic()+":"+string(m.Payload()))
+		}
+		return res
+	}
+
+	for i := 0; i < 5; i++ {
+		msg := newPublishMessageLarge("s/b", 0)
+		msg.SetPayload([]byte(strconv.Itoa(i)))
+		require.NoError(t, p.Publish(msg))
+	}
+
+	var msgs []*message.PublishMessage
+	require.NoError(t, p.History("s/b", 10, &msgs))
+	require.Equal(t, []string{"s/b:2", "s/b:3", "s/b:4"}, payloads(msgs))
+
+	msgs = msgs[:0]
+	require.NoError(t, p.History("s/b", 2, &msgs))
+	require.Equal(t, []string{"s/b:3", "s/b:4"}, payloads(msgs))
+
+	// topic without history returns retained message
+	msgs = msgs[:0]
+	require.NoError(t, p.History("s/#", 1, &msgs))
+	require.Equal(t, 2, len(msgs))
+
+	// s/b evicted as least recently published
+	for _, topic := range []string{"s/c", "s/d", "$SYS/x"} {
+		require.NoError(t, p.Publish(newPublishMessageLarge(topic, 0)))
+	}
+
+	msgs = msgs[:0]
+	require.NoError(t, p.History("s/b", 10, &msgs))
+	require.Equal(t, 0, len(msgs))
+
+	msgs = msgs[:0]
+	require.NoError(t, p.History("#", 10, &msgs))
+	require.Equal(t, 3, len(msgs))
+
+	p, err = NewMemProvider(&topicsTypes.MemConfig{})
+	require.NoError(t, err)
+
+	require.NoError(t, p.Publish(newPublishMessageLarge("s/b", 1)))
+
+	msgs = msgs[:0]
+	require.NoError(t, p.History("s/#", 5, &msgs))
+	require.Equal(t, 0, len(msgs))
+}
+
 func newPublishMessageLarge(topic string, qos message.QosType) *message.PublishMessage {
 	msg := message.NewPublishMessage()
 	msg.SetPayload(make([]byte, 1024))
@@ -588,3 +942,67 @@ func newPublishMessageLarge(topic string, qos message.QosType) *message.PublishM
 
 	return msg
 }
+
+// benchSubscriptions tree of devices each having exact, single and multi level wildcard
+// subscriptions plus few global wildcards matching every device
+func benchSubscriptions(b *testing.B, devices int) *sNode {
+	n := newSNode()
+
+	for i := 0; i < devices; i++ {
+		d := strconv.Itoa(i)
+		for _, f := range []string{
+			"dev/" + d + "/temp",
+			"dev/" + d + "/+/state",
+			"dev/" + d + "/#",
+			"+/" + d + "/+/+/+/x",
+		} {
+			if err := n.insert(f, message.QoS1, &types.Subscriber{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	for _, f := range []string{"#", "dev/#", "+/+/+/+/+/x", "dev/+/a/b/c/x", "+/+/+/+/+/+/+/+"} {
+		if err := n.insert(f, message.QoS1, &types.Subscriber{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return n
+}
+
+func benchmarkSNodeMatch(b *testing.B, devices int, topic string) {
+	n := benchSubscriptions(b, devices)
+
+	var subs types.Subscribers
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		subs = subs[:0]
+		if err := n.match(topic, message.QoS1, &subs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSNodeMatchShallow1K(b *testing.B) {
+	benchmarkSNodeMatch(b, 1000, "dev/42/temp")
+}
+
+func BenchmarkSNodeMatchDeep1K(b *testing.B) {
+	benchmarkSNodeMatch(b, 1000, "dev/42/a/b/c/x")
+}
+
+func BenchmarkSNodeMatchShallow100K(b *testing.B) {
+	benchmarkSNodeMatch(b, 100000, "dev/4242/temp")
+}
+
+func BenchmarkSNodeMatchDeep100K(b *testing.B) {
+	benchmarkSNodeMatch(b, 100000, "dev/4242/a/b/c/x")
+}
+
+func BenchmarkSNodeMatchNoMatch100K(b *testing.B) {
+	benchmarkSNodeMatch(b, 100000, "other/topic/with/many/levels/here/and/more")
+}
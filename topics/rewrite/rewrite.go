@@ -0,0 +1,125 @@
+// Package rewrite maps topics used by clients onto topics used by broker
+// Allows remapping legacy topic schemes without changing firmware of devices
+package rewrite
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidRule rule has neither or both of Match and Filter set
+var ErrInvalidRule = errors.New("rewrite: rule must have either Match or Filter")
+
+// Rule single rewrite rule
+// Topic must match entirely, first matching rule is applied
+type Rule struct {
+	// Match regular expression, e.g. ^legacy/(?P<id>[^/]+)/t$
+	Match string
+
+	// Filter topic filter, e.g. legacy/+/t. Every wildcard is captured thus
+	// available in Replace as $1, $2 and so on
+	Filter string
+
+	// Replace template expanded with submatches, e.g. devices/${id}/temperature
+	Replace string
+
+	// Publish rule applies to topics of inbound PUBLISH and will messages
+	// Subscribe rule applies to filters of SUBSCRIBE and UNSUBSCRIBE
+	// If neither set rule applies to both
+	Publish   bool
+	Subscribe bool
+}
+
+type rule struct {
+	re        *regexp.Regexp
+	replace   string
+	publish   bool
+	subscribe bool
+}
+
+// Rules compiled set of rules
+// Messages delivered to client carry rewritten topic, rules are not applied in reverse
+type Rules struct {
+	list []rule
+}
+
+// New compile rules
+func New(rules []Rule) (*Rules, error) {
+	r := &Rules{}
+
+	for _, e := range rules {
+		if (e.Match == "") == (e.Filter == "") {
+			return nil, ErrInvalidRule
+		}
+
+		expr := e.Match
+		if e.Filter != "" {
+			expr = filterExpr(e.Filter)
+		}
+
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, err
+		}
+
+		r.list = append(r.list, rule{
+			re:        re,
+			replace:   e.Replace,
+			publish:   e.Publish || !e.Subscribe,
+			subscribe: e.Subscribe || !e.Publish,
+		})
+	}
+
+	return r, nil
+}
+
+// Publish rewrite topic of inbound message
+func (r *Rules) Publish(topic string) string {
+	return r.apply(topic, false)
+}
+
+// Subscribe rewrite subscription filter
+func (r *Rules) Subscribe(filter string) string {
+	return r.apply(filter, true)
+}
+
+func (r *Rules) apply(topic string, subscribe bool) string {
+	if r == nil {
+		return topic
+	}
+
+	for i := range r.list {
+		e := &r.list[i]
+		if (subscribe && !e.subscribe) || (!subscribe && !e.publish) {
+			continue
+		}
+
+		m := e.re.FindStringSubmatchIndex(topic)
+		if m == nil {
+			continue
+		}
+
+		return string(e.re.ExpandString(nil, e.replace, topic, m))
+	}
+
+	return topic
+}
+
+// filterExpr regular expression of topic filter with wildcards captured
+func filterExpr(filter string) string {
+	levels := strings.Split(filter, "/")
+
+	for i, l := range levels {
+		switch {
+		case l == "+":
+			levels[i] = "([^/]*)"
+		case l == "#" && i == len(levels)-1:
+			levels[i] = "(.*)"
+		default:
+			levels[i] = regexp.QuoteMeta(l)
+		}
+	}
+
+	return strings.Join(levels, "/")
+}
@@ -0,0 +1,51 @@
+package rewrite
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewriteFilter(t *testing.T) {
+	r, err := New([]Rule{
+		{Filter: "legacy/+/t", Replace: "devices/$1/temperature"},
+		{Filter: "legacy/#", Replace: "devices/${1}"},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, "devices/abc/temperature", r.Publish("legacy/abc/t"))
+	require.Equal(t, "devices/abc/h", r.Publish("legacy/abc/h"))
+	require.Equal(t, "other/abc/t", r.Publish("other/abc/t"))
+
+	// wildcards of subscription are captured as regular levels
+	require.Equal(t, "devices/+/temperature", r.Subscribe("legacy/+/t"))
+	require.Equal(t, "devices/#", r.Subscribe("legacy/#"))
+}
+
+func TestRewriteMatch(t *testing.T) {
+	r, err := New([]Rule{
+		{Match: `v1/(?P<id>\d+)/state`, Replace: "devices/${id}/state", Publish: true},
+		{Match: `v1/.*`, Replace: "v1/denied", Subscribe: true},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, "devices/42/state", r.Publish("v1/42/state"))
+	require.Equal(t, "v1/abc/state", r.Publish("v1/abc/state"))
+	require.Equal(t, "v1/42/state/x", r.Publish("v1/42/state/x"))
+
+	require.Equal(t, "v1/denied", r.Subscribe("v1/42/state"))
+}
+
+func TestRewriteInvalid(t *testing.T) {
+	_, err := New([]Rule{{Replace: "a"}})
+	require.Equal(t, ErrInvalidRule, err)
+
+	_, err = New([]Rule{{Match: "a", Filter: "a", Replace: "a"}})
+	require.Equal(t, ErrInvalidRule, err)
+
+	_, err = New([]Rule{{Match: "(", Replace: "a"}})
+	require.Error(t, err)
+
+	var r *Rules
+	require.Equal(t, "a/b", r.Publish("a/b"))
+}
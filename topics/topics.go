@@ -23,11 +23,50 @@
 package topics
 
 import (
+	"sync"
+
 	"github.com/troian/surgemq/topics/mem"
 	"github.com/troian/surgemq/topics/types"
 	"github.com/troian/surgemq/types"
 )
 
+// Factory allocate topics provider. Options common to all providers, e.g. persistence
+// of retained messages and statistics, are passed in MemConfig
+type Factory func(config *topicsTypes.MemConfig) (topicsTypes.Provider, error)
+
+var factories = struct {
+	lock sync.RWMutex
+	list map[string]Factory
+}{
+	list: make(map[string]Factory),
+}
+
+// Register topics provider factory under given name, e.g. sharded or cluster-aware store
+// Provider is selected by Name of config
+func Register(name string, f Factory) error {
+	if name == "" || f == nil {
+		return types.ErrInvalidArgs
+	}
+
+	factories.lock.Lock()
+	defer factories.lock.Unlock()
+
+	if _, ok := factories.list[name]; ok || name == types.DefaultTopicsProvider {
+		return types.ErrAlreadyExists
+	}
+
+	factories.list[name] = f
+
+	return nil
+}
+
+// UnRegister topics provider factory
+func UnRegister(name string) {
+	factories.lock.Lock()
+	delete(factories.list, name)
+	factories.lock.Unlock()
+}
+
 // New topic provider
 func New(config topicsTypes.ProviderConfig) (topicsTypes.Provider, error) {
 	if config == nil {
@@ -36,7 +75,19 @@ func New(config topicsTypes.ProviderConfig) (topicsTypes.Provider, error) {
 
 	switch cfg := config.(type) {
 	case *topicsTypes.MemConfig:
-		return mem.NewMemProvider(cfg)
+		if cfg.Name == "" || cfg.Name == types.DefaultTopicsProvider {
+			return mem.NewMemProvider(cfg)
+		}
+
+		factories.lock.RLock()
+		f, ok := factories.list[cfg.Name]
+		factories.lock.RUnlock()
+
+		if !ok {
+			return nil, types.ErrUnknownProvider
+		}
+
+		return f(cfg)
 	default:
 		return nil, types.ErrUnknownProvider
 	}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 	"github.com/troian/surgemq/message"
+	persistTypes "github.com/troian/surgemq/persistence/types"
 	"github.com/troian/surgemq/topics/types"
 	"github.com/troian/surgemq/types"
 )
@@ -188,6 +189,86 @@ func TestTopicsRetained(t *testing.T) {
 	}
 }
 
+type retainedStore struct {
+	msg map[string]*message.PublishMessage
+}
+
+func (r *retainedStore) Load() ([]message.Provider, error) {
+	if r.msg == nil {
+		return nil, persistTypes.ErrNotFound
+	}
+
+	var res []message.Provider
+	for _, m := range r.msg {
+		res = append(res, m)
+	}
+
+	return res, nil
+}
+
+func (r *retainedStore) Store(msg []message.Provider) error {
+	for _, m := range msg {
+		r.Put(m.(*message.PublishMessage)) // nolint: errcheck
+	}
+
+	return nil
+}
+
+func (r *retainedStore) Delete() error {
+	r.msg = nil
+	return nil
+}
+
+func (r *retainedStore) Put(msg *message.PublishMessage) error {
+	if r.msg == nil {
+		r.msg = make(map[string]*message.PublishMessage)
+	}
+
+	r.msg[msg.Topic()] = msg
+	return nil
+}
+
+func (r *retainedStore) Remove(topic string) error {
+	delete(r.msg, topic)
+	return nil
+}
+
+func TestTopicsRetainedPersist(t *testing.T) {
+	store := &retainedStore{}
+
+	config := &topicsTypes.MemConfig{
+		Name:    "mem",
+		Persist: store,
+	}
+
+	prov, err := New(config)
+	require.NoError(t, err)
+
+	require.NoError(t, prov.Retain(newPublishMessageLarge("sport/tennis/ricardo/stats", 1)))
+	require.NoError(t, prov.Retain(newPublishMessageLarge("sport/tennis/andre/stats", 1)))
+	require.NoError(t, prov.Retain(newPublishMessageLarge("sport/tennis/andre/bio", 1)))
+
+	// written through without waiting for close
+	require.Len(t, store.msg, 3)
+
+	// empty payload clears retained message
+	empty := message.NewPublishMessage()
+	empty.SetTopic("sport/tennis/andre/bio") // nolint: errcheck
+	require.NoError(t, prov.Retain(empty))
+	require.Len(t, store.msg, 2)
+
+	// simulate crash, provider is not closed
+	prov, err = New(config)
+	require.NoError(t, err)
+
+	var msglist []*message.PublishMessage
+	require.NoError(t, prov.Retained("sport/tennis/#", &msglist))
+	require.Len(t, msglist, 2)
+
+	require.NoError(t, prov.Close())
+	require.Len(t, store.msg, 2)
+}
+
 func newPublishMessageLarge(topic string, qos message.QosType) *message.PublishMessage {
 	msg := message.NewPublishMessage()
 	msg.SetPayload(make([]byte, 1024))
@@ -196,3 +277,53 @@ func newPublishMessageLarge(topic string, qos message.QosType) *message.PublishM
 
 	return msg
 }
+
+func TestSubscriptionPolicy(t *testing.T) {
+	var p *topicsTypes.SubscriptionPolicy
+	require.True(t, p.Allowed("#"))
+
+	p = &topicsTypes.SubscriptionPolicy{DenyMultiLevel: true}
+	require.False(t, p.Allowed("#"))
+	require.False(t, p.Allowed("a/b/#"))
+	require.True(t, p.Allowed("a/+/c"))
+
+	p = &topicsTypes.SubscriptionPolicy{MaxWildcards: 1}
+	require.True(t, p.Allowed("a/+/c"))
+	require.True(t, p.Allowed("a/b/c"))
+	require.False(t, p.Allowed("a/+/+"))
+	require.False(t, p.Allowed("+/b/#"))
+
+	p = &topicsTypes.SubscriptionPolicy{MinWildcardLevel: 3}
+	require.True(t, p.Allowed("devices/abc/#"))
+	require.True(t, p.Allowed("devices/abc/+/t"))
+	require.False(t, p.Allowed("devices/#"))
+	require.False(t, p.Allowed("+/abc/t"))
+}
+
+func TestTopicsRegister(t *testing.T) {
+	var got *topicsTypes.MemConfig
+
+	f := func(config *topicsTypes.MemConfig) (topicsTypes.Provider, error) {
+		got = config
+		return New(&topicsTypes.MemConfig{Name: "mem"})
+	}
+
+	require.Equal(t, types.ErrInvalidArgs, Register("", f))
+	require.Equal(t, types.ErrAlreadyExists, Register("mem", f))
+
+	require.NoError(t, Register("custom", f))
+	defer UnRegister("custom")
+
+	require.Equal(t, types.ErrAlreadyExists, Register("custom", f))
+
+	config := &topicsTypes.MemConfig{Name: "custom"}
+	prov, err := New(config)
+	require.NoError(t, err)
+	require.True(t, got == config)
+	require.NoError(t, prov.Close())
+
+	UnRegister("custom")
+
+	_, err = New(config)
+	require.Equal(t, types.ErrUnknownProvider, err)
+}
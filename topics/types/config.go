@@ -8,9 +8,59 @@ import (
 // ProviderConfig interface implemented by every backend
 type ProviderConfig interface{}
 
+// RetainedPolicy action taken on new retained message once count limit reached
+type RetainedPolicy int
+
+// nolint: golint
+const (
+	// RetainedReject new message is published but not retained
+	RetainedReject RetainedPolicy = iota
+	// RetainedEvictOldest least recently retained message is removed
+	RetainedEvictOldest
+)
+
+// RetainedLimits caps of retained messages bounding memory used by them
+type RetainedLimits struct {
+	// MaxCount amount of retained messages. 0 means unlimited
+	MaxCount int
+
+	// MaxPayload size of retained message payload. Larger messages are published
+	// but not retained. 0 means unlimited
+	MaxPayload int
+
+	// Policy once MaxCount reached
+	Policy RetainedPolicy
+}
+
 // MemConfig of topics manager
 type MemConfig struct {
-	Name    string
-	Stat    systree.TopicsStat
-	Persist persistTypes.Retained
+	Name     string
+	Stat     systree.TopicsStat
+	Persist  persistTypes.Retained
+	Retained RetainedLimits
+
+	// Subscriptions statistic of subscribers per filter and fan-out. Optional
+	Subscriptions systree.SubscriptionsStat
+
+	// Drops statistic of messages published to no subscribers. Optional
+	Drops systree.DropsStat
+
+	// StatsSize amount of most recently published topics statistics are kept for
+	// 0 disables statistics
+	StatsSize int
+
+	// LastValues amount of topics last published message is cached for to serve
+	// last-value subscriptions. 0 disables cache
+	LastValues int
+
+	// History amount of topics last messages are kept for to serve replay subscriptions
+	// 0 disables history
+	History int
+
+	// HistoryDepth amount of last messages kept per topic. If not set then default to 10
+	HistoryDepth int
+
+	// Shards amount of partitions subscription tree is split into by hash of first topic level
+	// Subscribe and unsubscribe to topics of different shards do not contend. 0 or 1 keeps single tree
+	Shards int
 }
@@ -0,0 +1,33 @@
+package topicsTypes
+
+import (
+	"strings"
+)
+
+// Match either topic filter matches topic
+func Match(filter, topic string) bool {
+	// [MQTT-4.7.2-1] wildcards of first level do not match topics starting with $
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, MWC) || strings.HasPrefix(filter, SWC)) {
+		return false
+	}
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	for i, level := range f {
+		// [MQTT-4.7.1-2] # matches parent level too
+		if level == MWC {
+			return true
+		}
+
+		if i >= len(t) {
+			return false
+		}
+
+		if level != SWC && level != t[i] {
+			return false
+		}
+	}
+
+	return len(f) == len(t)
+}
@@ -0,0 +1,20 @@
+package topicsTypes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatch(t *testing.T) {
+	require.True(t, Match("a/+/c", "a/b/c"))
+	require.True(t, Match("a/#", "a"))
+	require.True(t, Match("a/#", "a/b/c"))
+	require.True(t, Match("#", "a/b"))
+	require.True(t, Match("$SYS/#", "$SYS/a"))
+	require.False(t, Match("#", "$SYS/a"))
+	require.False(t, Match("+/a", "$SYS/a"))
+	require.False(t, Match("a/+", "a/b/c"))
+	require.False(t, Match("a/b/c", "a/b"))
+	require.False(t, Match("a/b", "a/c"))
+}
@@ -0,0 +1,46 @@
+package topicsTypes
+
+import (
+	"strings"
+)
+
+// SubscriptionPolicy wildcard restrictions of subscription filters
+// Used to limit fan-out untrusted clients can request
+type SubscriptionPolicy struct {
+	// DenyMultiLevel forbid '#' wildcard
+	DenyMultiLevel bool
+
+	// MaxWildcards amount of wildcard levels in filter. 0 means unlimited
+	MaxWildcards int
+
+	// MinWildcardLevel first level (counted from 1) wildcard may appear at, e.g. 3 allows
+	// devices/abc/# but not devices/#. 0 allows wildcards at any level
+	MinWildcardLevel int
+}
+
+// Allowed check filter against policy. nil policy allows everything
+func (p *SubscriptionPolicy) Allowed(filter string) bool {
+	if p == nil {
+		return true
+	}
+
+	wildcards := 0
+
+	for i, level := range strings.Split(filter, "/") {
+		if level != MWC && level != SWC {
+			continue
+		}
+
+		if level == MWC && p.DenyMultiLevel {
+			return false
+		}
+
+		if i+1 < p.MinWildcardLevel {
+			return false
+		}
+
+		wildcards++
+	}
+
+	return p.MaxWildcards <= 0 || wildcards <= p.MaxWildcards
+}
@@ -0,0 +1,28 @@
+package topicsTypes
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ParseReplay filter and amount of messages per topic of replay subscription, e.g.
+// $replay/10/sensors/# requests last 10 messages of every topic matching sensors/#
+func ParseReplay(filter string) (string, int, bool) {
+	if !strings.HasPrefix(filter, Replay) {
+		return "", 0, false
+	}
+
+	rest := filter[len(Replay):]
+
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 || i == len(rest)-1 {
+		return "", 0, false
+	}
+
+	n, err := strconv.Atoi(rest[:i])
+	if err != nil || n <= 0 {
+		return "", 0, false
+	}
+
+	return rest[i+1:], n, true
+}
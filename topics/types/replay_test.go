@@ -0,0 +1,19 @@
+package topicsTypes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReplay(t *testing.T) {
+	filter, n, ok := ParseReplay("$replay/10/sensors/#")
+	require.True(t, ok)
+	require.Equal(t, "sensors/#", filter)
+	require.Equal(t, 10, n)
+
+	for _, f := range []string{"sensors/#", "$replay/10", "$replay/10/", "$replay//a", "$replay/x/a", "$replay/0/a", "$replay/-1/a"} {
+		_, _, ok = ParseReplay(f)
+		require.False(t, ok, f)
+	}
+}
@@ -2,6 +2,7 @@ package topicsTypes
 
 import (
 	"errors"
+	"time"
 
 	"github.com/troian/surgemq/message"
 	"github.com/troian/surgemq/types"
@@ -25,6 +26,14 @@ const (
 	// SYS is the starting character of the system level topics
 	//SYS = "$"
 
+	// LVC prefix of subscription filter requesting last message of matching topics
+	// on subscribe even if it was not retained, e.g. $lvc/sensors/#
+	LVC = "$lvc/"
+
+	// Replay prefix of subscription filter requesting last messages of matching topics
+	// on subscribe, followed by amount of messages per topic, e.g. $replay/10/sensors/#
+	Replay = "$replay/"
+
 	// Both wildcards
 	//BWC = "#+"
 )
@@ -36,10 +45,48 @@ type Provider interface {
 	Subscribers(topic string, qos message.QosType, subs *types.Subscribers) error
 	Publish(msg *message.PublishMessage) error
 	Retain(msg *message.PublishMessage) error
+
+	// RetainReplicated update retained message changed by another broker sharing persistence
+	// Change is not written into persistence again
+	RetainReplicated(msg *message.PublishMessage) error
+
 	Retained(topic string, msgs *[]*message.PublishMessage) error
+
+	// LastValues last messages published to topics matching filter. Retained message
+	// is returned for topics not in cache
+	LastValues(filter string, msgs *[]*message.PublishMessage) error
+
+	// History up to n last messages published to every topic matching filter, oldest first
+	// Retained message is returned for topics without history
+	History(filter string, n int, msgs *[]*message.PublishMessage) error
+
+	// RetainedList retained messages matching filter ordered by topic. Page starts after
+	// given topic, limit <= 0 returns all. Topic of last message is the cursor of next page
+	RetainedList(filter string, after string, limit int) ([]*message.PublishMessage, error)
+
+	// RetainedDelete remove all retained messages matching filter. Returns number of removed messages
+	RetainedDelete(filter string) (int, error)
+
+	// TopicStats statistics of topics ordered by amount of published messages
+	// limit <= 0 returns all tracked topics. nil if statistics disabled
+	TopicStats(limit int) []TopicStat
+
 	Close() error
 }
 
+// TopicStat access statistic of topic
+type TopicStat struct {
+	Topic string
+
+	// Published amount of messages published to topic
+	Published uint64
+
+	// Delivered amount of messages delivered to subscribers
+	Delivered uint64
+
+	LastPublished time.Time
+}
+
 var (
 	// ErrMultiLevel multi-level wildcard
 	ErrMultiLevel = errors.New("Multi-level wildcard found in topic and it's not at the last level")
@@ -51,4 +98,8 @@ var (
 	ErrInvalidWildcardSharp = errors.New("Wildcard character '#' must occupy entire topic level")
 	// ErrInvalidWildcard Wildcard characters '#' and '+' must occupy entire topic level
 	ErrInvalidWildcard = errors.New("Wildcard characters '#' and '+' must occupy entire topic level")
+	// ErrRetainedLimit maximum amount of retained messages reached
+	ErrRetainedLimit = errors.New("Retained messages limit reached")
+	// ErrRetainedTooLarge payload of retained message exceeds limit
+	ErrRetainedTooLarge = errors.New("Retained message payload too large")
 )
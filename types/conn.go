@@ -7,6 +7,7 @@ import (
 	"io"
 
 	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
 	"github.com/troian/surgemq/systree"
 )
 
@@ -75,6 +76,12 @@ type connWs struct {
 	prev io.Reader
 }
 
+type connQUIC struct {
+	conn   *quic.Conn
+	stream *quic.Stream
+	stat   systree.BytesMetric
+}
+
 // NewConnTCP initiate connection with net.Conn tcp object and stat
 func NewConnTCP(conn net.Conn, stat systree.BytesMetric) (Conn, error) {
 	c := &connTCP{
@@ -95,6 +102,17 @@ func NewConnWs(conn *websocket.Conn, stat systree.BytesMetric) (Conn, error) {
 	return c, nil
 }
 
+// NewConnQUIC initiate connection with quic connection and the stream carrying MQTT packets
+func NewConnQUIC(conn *quic.Conn, stream *quic.Stream, stat systree.BytesMetric) (Conn, error) {
+	c := &connQUIC{
+		conn:   conn,
+		stream: stream,
+		stat:   stat,
+	}
+
+	return c, nil
+}
+
 func (c *connTCP) Read(b []byte) (int, error) {
 	n, err := c.conn.Read(b)
 
@@ -230,3 +248,47 @@ func (c *connWs) SetReadDeadline(t time.Time) error {
 func (c *connWs) SetWriteDeadline(t time.Time) error {
 	return c.conn.SetWriteDeadline(t)
 }
+
+func (c *connQUIC) Read(b []byte) (int, error) {
+	n, err := c.stream.Read(b)
+
+	c.stat.Received(uint64(n))
+
+	return n, err
+}
+
+func (c *connQUIC) Write(b []byte) (int, error) {
+	n, err := c.stream.Write(b)
+	c.stat.Sent(uint64(n))
+
+	return n, err
+}
+
+// Close closes stream and tears down whole QUIC connection as there is only
+// one MQTT session per connection
+func (c *connQUIC) Close() error {
+	c.stream.CancelRead(0)
+	c.stream.Close() // nolint: errcheck, gas
+
+	return c.conn.CloseWithError(0, "")
+}
+
+func (c *connQUIC) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *connQUIC) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *connQUIC) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+func (c *connQUIC) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *connQUIC) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
@@ -0,0 +1,146 @@
+package types
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/troian/surgemq/systree"
+)
+
+// Transport source of client connections for custom transports such as serial
+// links or gateways. Stream oriented transports return Conn directly, message
+// oriented ones may wrap FrameConn with NewConnFrames
+type Transport interface {
+	// Accept waits for and returns the next connection
+	// Must return error once transport is closed
+	Accept() (Conn, error)
+
+	// Close stops accepting connections
+	Close() error
+
+	// Addr unique address of transport
+	Addr() net.Addr
+}
+
+// FrameConn connection of transport exchanging data in frames (datagrams, messages)
+// rather than byte stream
+type FrameConn interface {
+	// ReadFrame returns next frame. Returns io.EOF if connection closed
+	ReadFrame() ([]byte, error)
+
+	// WriteFrame sends frame. Broker may pass one or more MQTT packets in single frame
+	WriteFrame(b []byte) error
+
+	Close() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+type connFrames struct {
+	conn FrameConn
+	stat systree.BytesMetric
+
+	lock sync.Mutex
+	prev []byte
+}
+
+type connStream struct {
+	Conn
+	stat systree.BytesMetric
+}
+
+// NewConnStream wrap connection returned by transport to account traffic in stat
+func NewConnStream(conn Conn, stat systree.BytesMetric) (Conn, error) {
+	c := &connStream{
+		Conn: conn,
+		stat: stat,
+	}
+
+	return c, nil
+}
+
+// NewConnFrames initiate connection on top of frame oriented connection
+func NewConnFrames(conn FrameConn, stat systree.BytesMetric) (Conn, error) {
+	c := &connFrames{
+		conn: conn,
+		stat: stat,
+	}
+
+	return c, nil
+}
+
+func (c *connStream) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stat.Received(uint64(n))
+
+	return n, err
+}
+
+func (c *connStream) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stat.Sent(uint64(n))
+
+	return n, err
+}
+
+// Read returns remaining of previous frame if any or reads next one
+func (c *connFrames) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(c.prev) == 0 {
+		frame, err := c.conn.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		c.stat.Received(uint64(len(frame)))
+		c.prev = frame
+	}
+
+	n := copy(b, c.prev)
+	c.prev = c.prev[n:]
+
+	return n, nil
+}
+
+func (c *connFrames) Write(b []byte) (int, error) {
+	if err := c.conn.WriteFrame(b); err != nil {
+		return 0, err
+	}
+
+	c.stat.Sent(uint64(len(b)))
+
+	return len(b), nil
+}
+
+func (c *connFrames) Close() error {
+	return c.conn.Close()
+}
+
+func (c *connFrames) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *connFrames) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *connFrames) SetDeadline(t time.Time) error {
+	if err := c.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *connFrames) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *connFrames) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
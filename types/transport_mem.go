@@ -0,0 +1,77 @@
+package types
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrTransportClosed transport does not accept connections anymore
+var ErrTransportClosed = errors.New("transport closed")
+
+// TransportMem in-process transport for clients embedded into application
+// Each Dial creates net.Pipe pair with broker side delivered to Accept
+type TransportMem struct {
+	addr  memAddr
+	conns chan net.Conn
+	quit  chan struct{}
+	once  sync.Once
+}
+
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
+
+// NewTransportMem allocate in-memory transport with given name
+func NewTransportMem(name string) *TransportMem {
+	return &TransportMem{
+		addr:  memAddr(name),
+		conns: make(chan net.Conn),
+		quit:  make(chan struct{}),
+	}
+}
+
+// Dial connect local client to the broker
+// Returned connection is client side and expects regular MQTT stream
+func (t *TransportMem) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+
+	select {
+	case t.conns <- server:
+		return client, nil
+	case <-t.quit:
+		client.Close() // nolint: errcheck, gas
+		server.Close() // nolint: errcheck, gas
+		return nil, ErrTransportClosed
+	}
+}
+
+// Accept waits for the next local client
+func (t *TransportMem) Accept() (Conn, error) {
+	select {
+	case c := <-t.conns:
+		return c, nil
+	case <-t.quit:
+		return nil, ErrTransportClosed
+	}
+}
+
+// Close stops accepting local clients. Established connections are not affected
+func (t *TransportMem) Close() error {
+	t.once.Do(func() {
+		close(t.quit)
+	})
+
+	return nil
+}
+
+// Addr address of transport in form of name with network "mem"
+func (t *TransportMem) Addr() net.Addr {
+	return t.addr
+}
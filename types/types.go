@@ -2,6 +2,7 @@ package types
 
 import (
 	"sync"
+	"time"
 
 	"errors"
 
@@ -24,6 +25,9 @@ type OnCompleteFunc func(msg, ack message.Provider, err error) error
 type Subscriber struct {
 	WgWriters sync.WaitGroup
 	Publish   OnPublishFunc
+
+	// ID of client subscriber belongs to, empty for subscribers of broker itself
+	ID string
 }
 
 // Subscribers used by topic manager to return list of subscribers matching topic
@@ -39,6 +43,109 @@ type DuplicateConfig struct {
 	OnAttempt func(id string, replaced bool)
 }
 
+// QueuePolicy action taken when offline queue of session is full
+type QueuePolicy int
+
+const (
+	// QueueDropOldest oldest queued message dropped to make room for new one
+	QueueDropOldest QueuePolicy = iota
+
+	// QueueDropNewest new message dropped
+	QueueDropNewest
+
+	// QueueDisconnect new message dropped and connected client disconnected
+	// thus its will message is published
+	QueueDisconnect
+)
+
+// OfflineQueueConfig limits messages queued for session which client is not able to consume
+// Messages persisted for offline session are accounted as well
+type OfflineQueueConfig struct {
+	// MaxMessages 0 means unlimited
+	MaxMessages int
+
+	// MaxBytes limit of payload bytes. 0 means unlimited
+	MaxBytes int
+
+	// Policy applied once queue is full
+	Policy QueuePolicy
+}
+
+// SlowClientPolicy action taken while write buffer of connected client is full
+type SlowClientPolicy int
+
+const (
+	// SlowClientDisconnect writers wait for buffer space, client is disconnected
+	// if buffer stays full for timeout
+	SlowClientDisconnect SlowClientPolicy = iota
+
+	// SlowClientDropQoS0 QoS 0 messages are dropped while buffer is full,
+	// QoS 1/2 ones wait as with SlowClientDisconnect
+	SlowClientDropQoS0
+)
+
+// SlowClientConfig detection of clients not consuming messages as fast as they are sent
+type SlowClientConfig struct {
+	// Timeout write buffer is allowed to stay full. 0 disables detection
+	Timeout time.Duration
+
+	// Policy applied to slow client
+	Policy SlowClientPolicy
+}
+
+// Violation kind of protocol violation by client
+type Violation int
+
+const (
+	// ViolationSecondConnect CONNECT received on established connection [MQTT-3.1.0-2]
+	ViolationSecondConnect Violation = iota
+	// ViolationInvalidUTF8 topic is not well-formed UTF-8 or contains U+0000 [MQTT-1.5.3-1, MQTT-1.5.3-2]
+	ViolationInvalidUTF8
+	// ViolationReservedBits reserved flags of fixed header set or PUBLISH with QoS 3 [MQTT-2.2.2-2]
+	ViolationReservedBits
+)
+
+var violationNames = map[Violation]string{
+	ViolationSecondConnect: "second connect",
+	ViolationInvalidUTF8:   "invalid utf8",
+	ViolationReservedBits:  "reserved bits",
+}
+
+func (v Violation) String() string {
+	if s, ok := violationNames[v]; ok {
+		return s
+	}
+
+	return "unknown"
+}
+
+// ViolationPolicy action taken on protocol violation
+type ViolationPolicy int
+
+const (
+	// ViolationDisconnect close connection as required by spec
+	ViolationDisconnect ViolationPolicy = iota
+	// ViolationDrop log and drop offending packet, connection is kept
+	ViolationDrop
+	// ViolationCount count violation only. Packet is processed unless it cannot be,
+	// e.g. second CONNECT, then it is dropped
+	ViolationCount
+)
+
+// ViolationConfig policies by kind of violation. Violations not listed close connection
+// Every violation is counted regardless of policy
+type ViolationConfig map[Violation]ViolationPolicy
+
+// AckPolicy retransmission of QoS 1/2 messages not acknowledged by client
+type AckPolicy struct {
+	// Timeout to wait for ack before message is sent again. Doubles on every retry
+	// 0 disables retransmission
+	Timeout time.Duration
+
+	// Retries message is dropped once they are exhausted
+	Retries int
+}
+
 // LogInterface inherited by internal packages to provide hierarchical logs
 type LogInterface struct {
 	Prod *zap.Logger